@@ -0,0 +1,176 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "sort"
+    "sync/atomic"
+    "time"
+)
+
+// maintenanceLockKey is the Postgres advisory lock key that serializes maintenance runs
+// across every instance sharing the database.
+const maintenanceLockKey = 7495001
+
+// lastMaintenanceDuration records how long the most recent maintenance run took, in nanoseconds.
+var lastMaintenanceDuration atomic.Int64
+
+// MaintenanceResponse reports the outcome of a maintenance run.
+type MaintenanceResponse struct {
+    Status     string `json:"status"`
+    Operation  string `json:"operation"`
+    DurationMS int64  `json:"duration_ms"`
+}
+
+// analyzeProducts runs ANALYZE (or VACUUM ANALYZE with ?vacuum=true) on the products table.
+func analyzeProducts(w http.ResponseWriter, r *http.Request) {
+    operation := "ANALYZE products"
+    if r.URL.Query().Get("vacuum") == "true" {
+        operation = "VACUUM ANALYZE products"
+    }
+
+    // Maintenance can legitimately take longer than the per-request query timeout, so it
+    // runs without the request's deadline.
+    ctx := context.WithoutCancel(r.Context())
+
+    // Advisory locks are held per session, so pin a single connection for the whole run.
+    conn, err := DB.Conn(ctx)
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to run maintenance.")
+        return
+    }
+    defer conn.Close()
+
+    // Try to take the lock without waiting; another run in progress means we back off.
+    var locked bool
+    err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", maintenanceLockKey).Scan(&locked)
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to run maintenance.")
+        return
+    }
+    if !locked {
+        // The last run's duration is the best guess for how long the current one will take.
+        respondUnavailable(w, r, time.Duration(lastMaintenanceDuration.Load()), "Maintenance is already running.")
+        return
+    }
+    // Unlock with a fresh context so a cancelled request cannot return a locked session to the pool.
+    defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", maintenanceLockKey)
+
+    // Run the maintenance command and time it.
+    start := time.Now()
+    if _, err := conn.ExecContext(ctx, operation); err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to run maintenance.")
+        return
+    }
+
+    duration := time.Since(start)
+    lastMaintenanceDuration.Store(int64(duration))
+
+    // If everything went well, report the completed operation and its duration.
+    respond(w, r, http.StatusOK, MaintenanceResponse{
+        Status:     "completed",
+        Operation:  operation,
+        DurationMS: duration.Milliseconds(),
+    })
+}
+
+// CountDiscrepancy describes a denormalized category count that did not match the source data.
+type CountDiscrepancy struct {
+    Category string `json:"category"`
+    Stored   int    `json:"stored"`
+    Actual   int    `json:"actual"`
+}
+
+// RecomputeCountsResponse reports the discrepancies that a recount found and corrected.
+type RecomputeCountsResponse struct {
+    Discrepancies []CountDiscrepancy `json:"discrepancies"`
+}
+
+// recomputeCounts rebuilds the per-category product counts from the products table and
+// reports every count that had drifted.
+func recomputeCounts(w http.ResponseWriter, r *http.Request) {
+    tx, err := DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to recompute counts.")
+        return
+    }
+    defer tx.Rollback()
+
+    discrepancies, err := reconcileCategoryCounts(r.Context(), tx)
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to recompute counts.")
+        return
+    }
+
+    // If everything went well, report what was corrected.
+    respond(w, r, http.StatusOK, RecomputeCountsResponse{Discrepancies: discrepancies})
+}
+
+// reconcileCategoryCounts compares the stored category counts with the real ones and fixes
+// the ones that differ, returning what it changed.
+func reconcileCategoryCounts(ctx context.Context, tx *sql.Tx) ([]CountDiscrepancy, error) {
+    // Block the trigger from changing counts while we compare them.
+    if _, err := tx.ExecContext(ctx, "LOCK TABLE category_counts IN EXCLUSIVE MODE"); err != nil {
+        return nil, err
+    }
+
+    stored, err := queryCounts(ctx, tx, "SELECT category, product_count FROM category_counts")
+    if err != nil {
+        return nil, err
+    }
+    actual, err := queryCounts(ctx, tx, "SELECT category, COUNT(*) FROM products WHERE deleted_at IS NULL GROUP BY category")
+    if err != nil {
+        return nil, err
+    }
+
+    discrepancies := []CountDiscrepancy{}
+    for category := range stored {
+        if _, ok := actual[category]; !ok {
+            actual[category] = 0
+        }
+    }
+    for category, count := range actual {
+        if stored[category] == count {
+            continue
+        }
+        discrepancies = append(discrepancies, CountDiscrepancy{Category: category, Stored: stored[category], Actual: count})
+        if count == 0 {
+            _, err = tx.ExecContext(ctx, "DELETE FROM category_counts WHERE category = $1", category)
+        } else {
+            _, err = tx.ExecContext(ctx, `INSERT INTO category_counts (category, product_count) VALUES ($1, $2)
+                ON CONFLICT (tenant_id, category) DO UPDATE SET product_count = EXCLUDED.product_count`, category, count)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    sort.Slice(discrepancies, func(i, j int) bool { return discrepancies[i].Category < discrepancies[j].Category })
+    return discrepancies, nil
+}
+
+// queryCounts runs a query returning (category, count) rows and collects them into a map.
+func queryCounts(ctx context.Context, tx *sql.Tx, query string) (map[string]int, error) {
+    rows, err := tx.QueryContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    counts := make(map[string]int)
+    for rows.Next() {
+        var category string
+        var count int
+        if err := rows.Scan(&category, &count); err != nil {
+            return nil, err
+        }
+        counts[category] = count
+    }
+    return counts, rows.Err()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// answerAdvisoryLock answers the maintenance lock query of the stub database with locked.
+func answerAdvisoryLock(locked bool) func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+    return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        if strings.Contains(query, "pg_try_advisory_lock") {
+            return []string{"locked"}, [][]driver.Value{{locked}}, nil
+        }
+        return nil, nil, nil
+    }
+}
+
+func TestAnalyzeProducts(t *testing.T) {
+    tests := []struct {
+        name      string
+        query     string
+        operation string
+    }{
+        {name: "analyze", query: "", operation: "ANALYZE products"},
+        {name: "vacuum", query: "?vacuum=true", operation: "VACUUM ANALYZE products"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            stubDB.answer = answerAdvisoryLock(true)
+
+            w := httptest.NewRecorder()
+            analyzeProducts(w, newTestRequest("POST", "/admin/maintenance/analyze"+tt.query, "", RoleAdmin, nil))
+            if w.Code != http.StatusOK {
+                t.Fatalf("status = %d: %s", w.Code, w.Body)
+            }
+            var resp MaintenanceResponse
+            if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+                t.Fatal(err)
+            }
+            if resp.Status != "completed" || resp.Operation != tt.operation {
+                t.Errorf("response = %+v, want %s completed", resp, tt.operation)
+            }
+            if !stubDB.ran(tt.operation) || !stubDB.ran("pg_advisory_unlock") {
+                t.Errorf("statements = %q, want %s and the lock released", stubDB.statements, tt.operation)
+            }
+        })
+    }
+}
+
+func TestAnalyzeProductsAlreadyRunning(t *testing.T) {
+    setupHandlers(t)
+    stubDB.answer = answerAdvisoryLock(false)
+
+    w := httptest.NewRecorder()
+    analyzeProducts(w, newTestRequest("POST", "/admin/maintenance/analyze", "", RoleAdmin, nil))
+    if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+        t.Fatalf("status = %d, Retry-After = %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+    }
+    if stubDB.ran("ANALYZE products") {
+        t.Error("ran maintenance without the lock")
+    }
+}
+
+func TestRecomputeCounts(t *testing.T) {
+    setupHandlers(t)
+    stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        switch {
+        case strings.Contains(query, "FROM category_counts"):
+            return []string{"category", "product_count"}, [][]driver.Value{{"home", int64(3)}, {"garden", int64(2)}, {"retired", int64(1)}}, nil
+        case strings.Contains(query, "FROM products"):
+            return []string{"category", "count"}, [][]driver.Value{{"home", int64(3)}, {"garden", int64(4)}, {"toys", int64(1)}}, nil
+        }
+        return nil, nil, nil
+    }
+
+    w := httptest.NewRecorder()
+    recomputeCounts(w, newTestRequest("POST", "/admin/recompute-counts", "", RoleAdmin, nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d: %s", w.Code, w.Body)
+    }
+    var resp RecomputeCountsResponse
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    want := []CountDiscrepancy{
+        {Category: "garden", Stored: 2, Actual: 4},
+        {Category: "retired", Stored: 1, Actual: 0},
+        {Category: "toys", Stored: 0, Actual: 1},
+    }
+    if !reflect.DeepEqual(resp.Discrepancies, want) {
+        t.Errorf("discrepancies = %+v, want %+v", resp.Discrepancies, want)
+    }
+    for _, statement := range []string{"LOCK TABLE category_counts", "DELETE FROM category_counts", "INSERT INTO category_counts"} {
+        if !stubDB.ran(statement) {
+            t.Errorf("did not run %s", statement)
+        }
+    }
+}
+
+// The maintenance endpoints work on tables every tenant shares, so other tenants' admins
+// can't run them.
+func TestMaintenanceRequiresPlatformAdmin(t *testing.T) {
+    setupHandlers(t)
+    AppConfig.MaintenanceEnabled, AppConfig.TenancyEnabled, AppConfig.AdminToken = true, true, "secret"
+    stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        if strings.Contains(query, "FROM tenants") {
+            return []string{"id", "slug", "name", "disabled", "created_at"}, [][]driver.Value{{int64(2), "acme", "Acme", false, time.Now()}}, nil
+        }
+        return answerAdvisoryLock(true)(query, args)
+    }
+    t.Cleanup(func() { forgetTenant("acme") })
+    router := newVersionRouter(AppConfig)
+
+    for _, target := range []string{"/admin/maintenance/analyze", "/admin/recompute-counts"} {
+        r := httptest.NewRequest("POST", target, nil)
+        r.Header.Set("Authorization", "Bearer secret")
+        r.Header.Set(AppConfig.TenantHeader, "acme")
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, r)
+        if w.Code != http.StatusForbidden {
+            t.Errorf("POST %s as an admin of another tenant = %d, want 403: %s", target, w.Code, w.Body)
+        }
+    }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// apiKeyPrefix marks issued keys so they are easy to recognise in configs and leaks.
+const apiKeyPrefix = "pk_"
+
+// APIKey is an issued API key. The key itself is only ever returned once, when it is issued.
+type APIKey struct {
+    ID        int        `json:"id"`
+    Name      string     `json:"name"`
+    Role      Role       `json:"role"`
+    VendorID  int        `json:"vendor_id,omitempty"`
+    Key       string     `json:"key,omitempty"`
+    CreatedAt time.Time  `json:"created_at"`
+    RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// hashAPIKey returns the hex SHA-256 hash under which a key is stored. Keys are random and
+// long, so a fast hash is enough to keep a database leak from exposing usable keys.
+func hashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random key.
+func generateAPIKey() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return apiKeyPrefix + hex.EncodeToString(b), nil
+}
+
+// lookupAPIKey returns the unrevoked API key matching key, or errInvalidCredentials.
+func lookupAPIKey(ctx context.Context, key string) (APIKey, error) {
+    var apiKey APIKey
+    if !strings.HasPrefix(key, apiKeyPrefix) {
+        return apiKey, errInvalidCredentials
+    }
+    err := DB.QueryRowContext(ctx, "SELECT id, name, role, COALESCE(vendor_id, 0), created_at FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL",
+        hashAPIKey(key)).Scan(&apiKey.ID, &apiKey.Name, &apiKey.Role, &apiKey.VendorID, &apiKey.CreatedAt)
+    if err == sql.ErrNoRows {
+        return apiKey, errInvalidCredentials
+    }
+    return apiKey, err
+}
+
+// issueAPIKey creates a new API key from a JSON body like {"name": "importer", "role": "editor"}
+// and returns it. This is the only time the key is shown. The role defaults to editor. A key
+// with a vendor_id acts for that vendor and can't be an admin key.
+func issueAPIKey(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Name     string `json:"name"`
+        Role     Role   `json:"role"`
+        VendorID int    `json:"vendor_id"`
+    }
+    if err := decodeJSON(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if req.Role == "" {
+        req.Role = RoleEditor
+    }
+    var errs ValidationErrors
+    if strings.TrimSpace(req.Name) == "" {
+        errs.add("name", "is required")
+    }
+    if !req.Role.Valid() {
+        errs.add("role", "must be one of viewer, editor or admin")
+    } else if req.VendorID != 0 && req.Role == RoleAdmin {
+        errs.add("role", "must be viewer or editor for a vendor key")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    // Generate a random key and store only its hash.
+    key, err := generateAPIKey()
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to issue API key.")
+        return
+    }
+    apiKey := APIKey{Name: req.Name, Role: req.Role, VendorID: req.VendorID, Key: key}
+    err = DB.QueryRowContext(r.Context(), "INSERT INTO api_keys (name, role, vendor_id, key_hash) VALUES ($1, $2, NULLIF($3, 0), $4) RETURNING id, created_at",
+        apiKey.Name, apiKey.Role, apiKey.VendorID, hashAPIKey(apiKey.Key)).Scan(&apiKey.ID, &apiKey.CreatedAt)
+    if isForeignKeyViolation(err) {
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to issue API key.")
+        return
+    }
+
+    // If everything went well, return the new key with a 201 Created response.
+    respond(w, r, http.StatusCreated, apiKey)
+}
+
+// revokeAPIKey revokes the API key with the ID in the URL path.
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid API key ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", keyID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to revoke API key.")
+        return
+    }
+    rowsAffected, err := result.RowsAffected()
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to revoke API key.")
+        return
+    }
+    if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeAPIKeyNotFound, "API key not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
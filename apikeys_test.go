@@ -0,0 +1,33 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestAPIKeyHandlers(t *testing.T) {
+    key := map[string]string{"id": "1"}
+    body := `{"name": "importer", "role": "editor"}`
+    tests := []handlerTest{
+        {name: "issue", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: body,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO api_keys": {int64(1), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "issue malformed", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "vendor_id": "2"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "issue without name", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: `{"role": "editor"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "issue unknown role", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "role": "owner"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "issue admin vendor key", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "role": "admin", "vendor_id": 2}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "issue unknown vendor", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "vendor_id": 2}`,
+            answer: failQueries(foreignKeyViolation), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "revoke", handler: revokeAPIKey, method: "DELETE", target: "/admin/api-keys/1", vars: key,
+            answer: answerRows(map[string][]driver.Value{"UPDATE api_keys": {int64(1)}}), status: http.StatusNoContent},
+        {name: "revoke invalid id", handler: revokeAPIKey, method: "DELETE", target: "/admin/api-keys/abc", vars: map[string]string{"id": "abc"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "revoke missing", handler: revokeAPIKey, method: "DELETE", target: "/admin/api-keys/1", vars: key, status: http.StatusNotFound, code: codeAPIKeyNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "issue", handler: issueAPIKey, method: "POST", target: "/admin/api-keys", body: body},
+        handlerTest{name: "revoke", handler: revokeAPIKey, method: "DELETE", target: "/admin/api-keys/1", vars: key},
+    ))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// Limits on product attributes.
+const (
+    maxAttributes           = 50
+    maxAttributeNameLength  = 100
+    maxAttributeValueLength = 500
+)
+
+// attrFilterPrefix starts the query parameters that filter a listing on an attribute, as in
+// ?attr.brand=Acme.
+const attrFilterPrefix = "attr."
+
+// Attributes are the free-form attributes of a product, like its brand, weight or color,
+// each name mapped to a string. They are held as JSON with the names sorted, so Product
+// stays comparable and equal attributes are always equal strings. The zero value has none.
+type Attributes string
+
+// newAttributes returns the Attributes holding m.
+func newAttributes(m map[string]string) Attributes {
+    if len(m) == 0 {
+        return ""
+    }
+    // Maps are encoded with their keys sorted.
+    b, _ := json.Marshal(m)
+    return Attributes(b)
+}
+
+// Map returns the attributes as a map, which is never nil.
+func (a Attributes) Map() StringMap {
+    m := StringMap{}
+    if a != "" {
+        json.Unmarshal([]byte(a), (*map[string]string)(&m))
+    }
+    return m
+}
+
+// MarshalJSON writes a as a JSON object.
+func (a Attributes) MarshalJSON() ([]byte, error) {
+    if a == "" {
+        return []byte("{}"), nil
+    }
+    return []byte(a), nil
+}
+
+// UnmarshalJSON reads a JSON object of strings; null means no attributes.
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+    var m map[string]string
+    if err := json.Unmarshal(data, &m); err != nil {
+        return fmt.Errorf("attributes must map names to strings: %w", err)
+    }
+    *a = newAttributes(m)
+    return nil
+}
+
+// MarshalXML writes a as StringMap entry elements.
+func (a Attributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    return a.Map().MarshalXML(e, start)
+}
+
+// UnmarshalXML reads entry elements written by MarshalXML.
+func (a *Attributes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var m StringMap
+    if err := m.UnmarshalXML(d, start); err != nil {
+        return err
+    }
+    *a = newAttributes(m)
+    return nil
+}
+
+// EncodeMsgpack writes a as a MessagePack map.
+func (a Attributes) EncodeMsgpack(enc *msgpack.Encoder) error {
+    return enc.Encode(map[string]string(a.Map()))
+}
+
+// DecodeMsgpack reads a MessagePack map of strings.
+func (a *Attributes) DecodeMsgpack(dec *msgpack.Decoder) error {
+    var m map[string]string
+    if err := dec.Decode(&m); err != nil {
+        return err
+    }
+    *a = newAttributes(m)
+    return nil
+}
+
+// Scan reads a JSONB column. Postgres orders object keys its own way, so they are sorted
+// again.
+func (a *Attributes) Scan(src interface{}) error {
+    var data []byte
+    switch v := src.(type) {
+    case nil:
+        *a = ""
+        return nil
+    case []byte:
+        data = v
+    case string:
+        data = []byte(v)
+    default:
+        return fmt.Errorf("cannot scan %T into Attributes", src)
+    }
+    return a.UnmarshalJSON(data)
+}
+
+// Value writes a as JSON text for a JSONB column.
+func (a Attributes) Value() (driver.Value, error) {
+    b, err := a.MarshalJSON()
+    return string(b), err
+}
+
+func validateAttributes(errs *ValidationErrors, attributes Attributes) {
+    m := attributes.Map()
+    if len(m) > maxAttributes {
+        errs.add("attributes", "must have at most 50 entries")
+        return
+    }
+    for name, value := range m {
+        if strings.TrimSpace(name) == "" {
+            errs.add("attributes", "names must not be empty")
+            return
+        }
+        if utf8.RuneCountInString(name) > maxAttributeNameLength {
+            errs.add("attributes", "names must be at most 100 characters")
+            return
+        }
+        if utf8.RuneCountInString(value) > maxAttributeValueLength {
+            errs.add("attributes", "values must be at most 500 characters")
+            return
+        }
+    }
+}
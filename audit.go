@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+// Actions recorded in the audit log.
+const (
+    auditCreate  = "create"
+    auditUpdate  = "update"
+    auditDelete  = "delete"
+    auditRestore = "restore"
+)
+
+// AuditEntry is one recorded change to a product. Before is null for creations.
+type AuditEntry struct {
+    ID        int             `json:"id"`
+    ProductID int             `json:"product_id"`
+    Action    string          `json:"action"`
+    Actor     string          `json:"actor"`
+    RequestID string          `json:"request_id,omitempty"`
+    Before    json.RawMessage `json:"before"`
+    After     json.RawMessage `json:"after"`
+    CreatedAt time.Time       `json:"created_at"`
+}
+
+// recordAudit writes an audit log entry for a product change as part of tx, so the entry
+// exists exactly when the change does, and records the matching product event the same way.
+// The actor and request ID are taken from ctx.
+func recordAudit(ctx context.Context, tx *sql.Tx, action string, productID int, before, after *Product) error {
+    actor := "anonymous"
+    if principal, ok := principalFromContext(ctx); ok {
+        actor = principal.Subject
+    }
+    beforeJSON, err := auditSnapshot(before)
+    if err != nil {
+        return err
+    }
+    afterJSON, err := auditSnapshot(after)
+    if err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, "INSERT INTO audit_log (product_id, action, actor, request_id, before, after) VALUES ($1, $2, $3, $4, $5, $6)",
+        productID, action, actor, requestIDFromContext(ctx), beforeJSON, afterJSON)
+    if err != nil {
+        return err
+    }
+    return recordProductEvent(ctx, tx, action, after)
+}
+
+// auditSnapshot encodes a product for the audit log, or returns nil for no product.
+func auditSnapshot(product *Product) (interface{}, error) {
+    if product == nil {
+        return nil, nil
+    }
+    b, err := json.Marshal(product)
+    if err != nil {
+        return nil, err
+    }
+    return string(b), nil
+}
+
+// getProductHistory returns the audit log of a product, oldest change first. Deleted
+// products keep their history.
+func getProductHistory(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionRead, productID, "Failed to retrieve product history.") {
+        return
+    }
+    rows, err := Reads.QueryContext(r.Context(), `SELECT id, product_id, action, actor, request_id, COALESCE(before, 'null'), after, created_at
+        FROM audit_log WHERE product_id = $1 ORDER BY id`, productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve product history.")
+        return
+    }
+    defer rows.Close()
+
+    entries := []AuditEntry{}
+    for rows.Next() {
+        var e AuditEntry
+        var before, after []byte
+        if err := rows.Scan(&e.ID, &e.ProductID, &e.Action, &e.Actor, &e.RequestID, &before, &after, &e.CreatedAt); err != nil {
+            respondStoreError(w, r, err, "Failed to retrieve product history.")
+            return
+        }
+        e.Before, e.After = before, after
+        entries = append(entries, e)
+    }
+    if err := rows.Err(); err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve product history.")
+        return
+    }
+    if len(entries) == 0 {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    }
+
+    // If everything went well, return the history in the response body.
+    respond(w, r, http.StatusOK, entries)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Role is the level of access granted to a user or API key. Each role includes the
+// permissions of the roles below it: admin > editor > viewer.
+type Role string
+
+const (
+    RoleViewer Role = "viewer"
+    RoleEditor Role = "editor"
+    RoleAdmin  Role = "admin"
+)
+
+// roleRank orders the roles so that higher ranks include lower ones.
+var roleRank = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+    return roleRank[r] > 0
+}
+
+// Includes reports whether r grants at least the access of other.
+func (r Role) Includes(other Role) bool {
+    return r.Valid() && roleRank[r] >= roleRank[other]
+}
+
+// Principal is whoever a request was authenticated as. VendorID is set for API keys issued
+// to a vendor, which may only change that vendor's products.
+type Principal struct {
+    Subject  string `json:"subject"`
+    Role     Role   `json:"role"`
+    VendorID int    `json:"vendor_id,omitempty"`
+}
+
+// principalContextKey is the context key holding the Principal of an authenticated request.
+const principalContextKey contextKey = "principal"
+
+// principalFromContext returns the principal that authenticated the request, if any.
+func principalFromContext(ctx context.Context) (Principal, bool) {
+    principal, ok := ctx.Value(principalContextKey).(Principal)
+    return principal, ok
+}
+
+// errInvalidCredentials is returned by authenticate when credentials were sent but are wrong.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// tokenClaims are the claims carried by the JWTs issued by /login.
+type tokenClaims struct {
+    Role Role `json:"role"`
+    // Tenant is the slug of the tenant the user belongs to. Tokens issued before tenants
+    // existed have none and belong to the default tenant.
+    Tenant string `json:"tenant,omitempty"`
+    jwt.RegisteredClaims
+}
+
+// authenticate works out who sent a request from its bearer token (the admin token or a JWT)
+// or its X-API-Key header. It reports false if the request carries no credentials at all.
+func authenticate(r *http.Request) (Principal, bool, error) {
+    if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+        // The static admin token is kept for operators and automation.
+        if AppConfig.AdminToken != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(AppConfig.AdminToken)) == 1 {
+            return Principal{Subject: "admin-token", Role: RoleAdmin}, true, nil
+        }
+        principal, err := verifyToken(r.Context(), bearer)
+        return principal, true, err
+    }
+    if key := r.Header.Get("X-API-Key"); key != "" {
+        apiKey, err := lookupAPIKey(r.Context(), key)
+        if err != nil {
+            return Principal{}, true, err
+        }
+        return Principal{Subject: "api_key:" + apiKey.Name, Role: apiKey.Role, VendorID: apiKey.VendorID}, true, nil
+    }
+    return Principal{}, false, nil
+}
+
+// verifyToken checks a JWT issued by /login and returns the principal it was issued to. A
+// token is only good for the tenant it was issued for.
+func verifyToken(ctx context.Context, token string) (Principal, error) {
+    if AppConfig.JWTSecret == "" {
+        return Principal{}, errInvalidCredentials
+    }
+    var claims tokenClaims
+    _, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+        return []byte(AppConfig.JWTSecret), nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+    if err != nil || !claims.Role.Valid() {
+        return Principal{}, errInvalidCredentials
+    }
+    if claims.Tenant == "" {
+        claims.Tenant = defaultTenantSlug
+    }
+    if tenant, ok := tenantFromContext(ctx); ok && tenant.Slug != claims.Tenant {
+        return Principal{}, errInvalidCredentials
+    }
+    return Principal{Subject: "user:" + claims.Subject, Role: claims.Role}, nil
+}
+
+// requireRole wraps a handler so that it is only reachable by principals with at least the
+// given role.
+func requireRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+    return withRole(role)(next).ServeHTTP
+}
+
+// withRole returns middleware that only lets through principals with at least the given
+// role. When public reads are enabled, viewer endpoints also accept anonymous requests.
+func withRole(role Role) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            principal, ok, err := authenticate(r)
+            if err == errInvalidCredentials {
+                respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Unauthorized.")
+                return
+            } else if err != nil {
+                respondStoreError(w, r, err, "Failed to check credentials.")
+                return
+            }
+            if !ok {
+                if role == RoleViewer && AppConfig.PublicReads {
+                    next.ServeHTTP(w, r)
+                    return
+                }
+                respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Unauthorized.")
+                return
+            }
+            if !principal.Role.Includes(role) {
+                respondError(w, r, http.StatusForbidden, codeForbidden, "Forbidden.")
+                return
+            }
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalContextKey, principal)))
+        })
+    }
+}
+
+// includeDeleted reports whether the request asks for soft-deleted products with
+// ?include_deleted=true and comes from an admin, the only role allowed to see them.
+func includeDeleted(r *http.Request) bool {
+    if r.URL.Query().Get("include_deleted") != "true" {
+        return false
+    }
+    principal, ok := principalFromContext(r.Context())
+    return ok && principal.Role.Includes(RoleAdmin)
+}
+
+// requireAdmin wraps a handler so that it is only reachable by admins.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return requireRole(RoleAdmin, next)
+}
+
+// LoginResponse is returned by a successful login. UserID is the ID of the user in routes
+// like /users/{id}/favorites.
+type LoginResponse struct {
+    Token     string    `json:"token"`
+    ExpiresAt time.Time `json:"expires_at"`
+    UserID    int       `json:"user_id"`
+}
+
+// login checks a username and password against the users table and issues a JWT carrying
+// the user's role.
+func login(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+    }
+    if err := decodeJSON(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if AppConfig.JWTSecret == "" {
+        logError(r, errors.New("login attempted but JWT_SECRET is not set"))
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Login is not configured.")
+        return
+    }
+
+    // Look up the user and check the password. Unknown users and wrong passwords get the
+    // same response so that usernames can't be probed.
+    var userID int
+    var passwordHash string
+    var role Role
+    err := DB.QueryRowContext(r.Context(), "SELECT id, password_hash, role FROM users WHERE username = $1", req.Username).Scan(&userID, &passwordHash, &role)
+    if err != nil && err != sql.ErrNoRows {
+        respondStoreError(w, r, err, "Failed to log in.")
+        return
+    }
+    if err == sql.ErrNoRows || bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+        respondError(w, r, http.StatusUnauthorized, codeInvalidCredentials, "Invalid username or password.")
+        return
+    }
+
+    // Issue a signed token for the user, good only for the tenant they belong to.
+    tenant, _ := tenantFromContext(r.Context())
+    expiresAt := time.Now().Add(AppConfig.JWTTTL)
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+        Role:   role,
+        Tenant: tenant.Slug,
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   req.Username,
+            IssuedAt:  jwt.NewNumericDate(time.Now()),
+            ExpiresAt: jwt.NewNumericDate(expiresAt),
+        },
+    }).SignedString([]byte(AppConfig.JWTSecret))
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to log in.")
+        return
+    }
+
+    // If everything went well, return the token in the response body.
+    respond(w, r, http.StatusOK, LoginResponse{Token: token, ExpiresAt: expiresAt, UserID: userID})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+func TestLogin(t *testing.T) {
+    hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    configured := func(t *testing.T) { AppConfig.JWTSecret = "test-secret" }
+    user := answerRows(map[string][]driver.Value{"FROM users": {int64(1), string(hash), string(RoleEditor)}})
+    body := `{"username": "ada", "password": "correct horse"}`
+    tests := []handlerTest{
+        {name: "login", handler: login, method: "POST", target: "/login", body: body, anonymous: true, setup: configured, answer: user, status: http.StatusOK},
+        {name: "malformed", handler: login, method: "POST", target: "/login", body: `{"username": "ada", "password": 1}`, anonymous: true, setup: configured,
+            status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "not configured", handler: login, method: "POST", target: "/login", body: body, anonymous: true, answer: user, status: http.StatusInternalServerError, code: codeInternal},
+        {name: "unknown user", handler: login, method: "POST", target: "/login", body: body, anonymous: true, setup: configured,
+            status: http.StatusUnauthorized, code: codeInvalidCredentials},
+        {name: "wrong password", handler: login, method: "POST", target: "/login", body: `{"username": "ada", "password": "battery staple"}`, anonymous: true, setup: configured, answer: user,
+            status: http.StatusUnauthorized, code: codeInvalidCredentials},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "login", handler: login, method: "POST", target: "/login", body: body, anonymous: true, setup: configured},
+    ))
+}
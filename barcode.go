@@ -0,0 +1,69 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/lib/pq"
+)
+
+// validEAN13 reports whether code is a 13-digit EAN with a correct check digit.
+func validEAN13(code string) bool {
+    if len(code) != 13 {
+        return false
+    }
+    sum := 0
+    for i, c := range code {
+        if c < '0' || c > '9' {
+            return false
+        }
+        digit := int(c - '0')
+        if i == 12 {
+            return (10-sum%10)%10 == digit
+        }
+        // Digits in even positions weigh 1 and odd positions weigh 3.
+        if i%2 == 1 {
+            digit *= 3
+        }
+        sum += digit
+    }
+    return false
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+    var pqErr *pq.Error
+    return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isForeignKeyViolation reports whether err is a Postgres foreign key violation.
+func isForeignKeyViolation(err error) bool {
+    var pqErr *pq.Error
+    return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// getProductByBarcode retrieves a single product by its EAN-13 barcode.
+func getProductByBarcode(w http.ResponseWriter, r *http.Request) {
+    // Get the barcode from the URL query string and check it before touching the database.
+    code := r.URL.Query().Get("code")
+    if !validEAN13(code) {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid barcode.")
+        return
+    }
+
+    // Look up the product with the given barcode.
+    product, err := Repo.GetByBarcode(r.Context(), code)
+    if err == ErrProductNotFound {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve product.")
+        return
+    }
+    if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionRead, product), "Failed to retrieve product.") {
+        return
+    }
+
+    // If everything went well, return the product in the response body.
+    respond(w, r, http.StatusOK, product)
+}
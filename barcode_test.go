@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestValidEAN13(t *testing.T) {
+    tests := []struct {
+        code string
+        ok   bool
+    }{
+        {code: "4006381333931", ok: true},
+        {code: "5901234123457", ok: true},
+        {code: "0000000000000", ok: true},
+        {code: "4006381333932", ok: false},
+        {code: "400638133393", ok: false},
+        {code: "40063813339310", ok: false},
+        {code: "40063813339a1", ok: false},
+        {code: "", ok: false},
+    }
+    for _, tt := range tests {
+        if got := validEAN13(tt.code); got != tt.ok {
+            t.Errorf("validEAN13(%q) = %v, want %v", tt.code, got, tt.ok)
+        }
+    }
+}
+
+func TestGetProductByBarcode(t *testing.T) {
+    tests := []struct {
+        name    string
+        code    string
+        status  int
+        errCode string
+    }{
+        {name: "found", code: "4006381333931", status: http.StatusOK},
+        {name: "unknown", code: "5901234123457", status: http.StatusNotFound, errCode: codeProductNotFound},
+        {name: "bad check digit", code: "4006381333932", status: http.StatusBadRequest, errCode: codeInvalidParameter},
+        {name: "missing", code: "", status: http.StatusBadRequest, errCode: codeInvalidParameter},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            lamp := seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD", Barcode: "4006381333931"})
+
+            w := httptest.NewRecorder()
+            getProductByBarcode(w, newTestRequest("GET", "/products/by-barcode?code="+tt.code, "", RoleViewer, nil))
+            if w.Code != tt.status || errorCode(w) != tt.errCode {
+                t.Fatalf("got %d %q, want %d %q: %s", w.Code, errorCode(w), tt.status, tt.errCode, w.Body)
+            }
+            if tt.status != http.StatusOK {
+                return
+            }
+            var product Product
+            if err := json.Unmarshal(w.Body.Bytes(), &product); err != nil {
+                t.Fatalf("decoding product: %v", err)
+            }
+            if product.ID != lamp.ID || product.Barcode != lamp.Barcode {
+                t.Errorf("got product %d with barcode %q, want %d", product.ID, product.Barcode, lamp.ID)
+            }
+        })
+    }
+}
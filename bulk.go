@@ -0,0 +1,156 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// maxBulkProducts is the most products a single bulk request may create.
+const maxBulkProducts = 1000
+
+// BulkResult is the outcome for one item of a bulk request, identified by its position in
+// the request body. Exactly one of ID, Error and Errors is set.
+type BulkResult struct {
+    Index  int              `json:"index"`
+    ID     int              `json:"id,omitempty"`
+    Error  string           `json:"error,omitempty"`
+    Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// BulkCreateResponse reports how many products a bulk request created and what happened to
+// each item.
+type BulkCreateResponse struct {
+    Created  int          `json:"created"`
+    Rejected int          `json:"rejected"`
+    Results  []BulkResult `json:"results"`
+}
+
+// createProducts inserts every valid product of a JSON array in a single transaction.
+// Invalid items and items whose barcode is taken are reported and skipped rather than
+// failing the whole request.
+func createProducts(w http.ResponseWriter, r *http.Request) {
+    // Read the request body into a slice of products.
+    var products []Product
+    if err := decodeJSON(r, &products); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if len(products) == 0 || len(products) > maxBulkProducts {
+        respondError(w, r, http.StatusBadRequest, codeInvalidBatchSize, fmt.Sprintf("Send between 1 and %d products.", maxBulkProducts))
+        return
+    }
+
+    // Validate every item up front and only send the valid ones to the database.
+    results := make([]BulkResult, len(products))
+    var valid []Product
+    var validIndexes []int
+    for i, product := range products {
+        results[i].Index = i
+        if errs := product.Validate(); len(errs) > 0 {
+            results[i].Errors = errs
+            continue
+        }
+        if err := authorizeProduct(r.Context(), ActionCreate, product); err == ErrForbidden {
+            results[i].Error = "Forbidden."
+            continue
+        } else if err != nil {
+            respondStoreError(w, r, err, "Failed to create products.")
+            return
+        }
+        valid = append(valid, product)
+        validIndexes = append(validIndexes, i)
+    }
+
+    if len(valid) > 0 {
+        itemErrs, err := Repo.CreateBatch(r.Context(), valid)
+        if err != nil {
+            respondStoreError(w, r, err, "Failed to create products.")
+            return
+        }
+        for j, i := range validIndexes {
+            switch itemErrs[j] {
+            case ErrBarcodeInUse:
+                results[i].Error = "Barcode is already in use."
+                continue
+            case ErrSKUInUse:
+                results[i].Error = "SKU is already in use."
+                continue
+            case ErrUnknownCategory:
+                results[i].Errors = unknownCategoryErrors
+                continue
+            case ErrUnknownVendor:
+                results[i].Errors = unknownVendorErrors
+                continue
+            }
+            results[i].ID = valid[j].ID
+        }
+        if err := invalidateProductLists(r.Context()); err != nil {
+            logError(r, err)
+        }
+    }
+
+    response := BulkCreateResponse{Results: results}
+    for _, result := range results {
+        if result.ID != 0 {
+            response.Created++
+        } else {
+            response.Rejected++
+        }
+    }
+
+    // If everything went well, report the outcome of every item.
+    respond(w, r, http.StatusOK, response)
+}
+
+// maxBatchGetIDs is the most products a single batch get may fetch.
+const maxBatchGetIDs = 100
+
+// BatchGetRequest is the body of a batch get: the IDs of the products to fetch.
+type BatchGetRequest struct {
+    IDs []int `json:"ids" xml:"ids>id"`
+}
+
+// BatchGetResponse holds the live products a batch get found, in ID order, and the
+// requested IDs it didn't find, in request order.
+type BatchGetResponse struct {
+    Products []Product `json:"products" xml:"products>product"`
+    Missing  []int     `json:"missing" xml:"missing>id"`
+}
+
+// batchGetProducts fetches up to 100 products by ID in one query, from a body like
+// {"ids": [1, 5, 9]}, so a client showing several products doesn't have to fetch them one
+// at a time. Deleted and unknown products are reported as missing rather than failing the
+// request.
+func batchGetProducts(w http.ResponseWriter, r *http.Request) {
+    var request BatchGetRequest
+    if err := decodeBody(r, &request); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if len(request.IDs) == 0 || len(request.IDs) > maxBatchGetIDs {
+        respondError(w, r, http.StatusBadRequest, codeInvalidBatchSize, fmt.Sprintf("Send between 1 and %d IDs.", maxBatchGetIDs))
+        return
+    }
+
+    products, err := Repo.GetByIDs(r.Context(), request.IDs)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve products.")
+        return
+    }
+
+    found := make(map[int]bool, len(products))
+    for _, product := range products {
+        found[product.ID] = true
+    }
+    response := BatchGetResponse{Products: products, Missing: []int{}}
+    for _, id := range request.IDs {
+        if !found[id] {
+            response.Missing = append(response.Missing, id)
+            // Report an ID asked for twice only once.
+            found[id] = true
+        }
+    }
+
+    // If everything went well, return the products found and the IDs that weren't.
+    respond(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// Cache is a byte-oriented key/value cache with per-entry expiry. It is implemented in memory
+// for single-instance deployments and in Redis for horizontally scaled ones.
+type Cache interface {
+    // Get returns the cached value for key and whether it was found.
+    Get(ctx context.Context, key string) ([]byte, bool, error)
+    // Set stores value under key for the given TTL.
+    Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+    // Delete removes key from the cache.
+    Delete(ctx context.Context, key string) error
+}
+
+// ProductCache is a global variable that holds the cache used for product reads, both single
+// products and pages of listings. It is nil when caching is disabled.
+var ProductCache Cache
+
+// newCache builds the cache backend selected by the configuration. The Redis backend uses
+// client.
+func newCache(cfg Config, client *redis.Client) (Cache, error) {
+    switch cfg.CacheBackend {
+    case "", "none":
+        return nil, nil
+    case "memory":
+        return newMemoryCache(cfg.CacheMaxEntries), nil
+    case "redis":
+        return &redisCache{client: client}, nil
+    default:
+        return nil, errors.New("unknown cache backend " + strconv.Quote(cfg.CacheBackend))
+    }
+}
+
+// productCacheKey returns the cache key for the product with the given ID, as seen by the
+// tenant of ctx.
+func productCacheKey(ctx context.Context, id int) string {
+    return "product:" + strconv.Itoa(tenantIDFromContext(ctx)) + ":" + strconv.Itoa(id)
+}
+
+// listGenerationKey holds the current generation of cached listings. Every listing is cached
+// under a key that includes the generation, so replacing it invalidates all of them at once.
+const listGenerationKey = "products:list:generation"
+
+// listCacheKey returns the cache key for a page of a product listing. The key covers
+// everything that decides the page's contents, in a normalized form, so the same listing
+// asked for with its parameters in a different order still hits.
+func listCacheKey(ctx context.Context, q ListQuery) (string, error) {
+    generation, ok, err := ProductCache.Get(ctx, listGenerationKey)
+    if err != nil {
+        return "", err
+    }
+    if !ok {
+        generation = []byte(newID())
+        if err := ProductCache.Set(ctx, listGenerationKey, generation, listGenerationTTL); err != nil {
+            return "", err
+        }
+    }
+
+    normalized, err := json.Marshal(struct {
+        Tenant   int
+        Filter   ProductFilter
+        Sort     string
+        Desc     bool
+        Limit    int
+        Currency string
+        After    *listCursor
+        Fields   FieldSelection
+    }{tenantIDFromContext(ctx), q.Filter, q.Sort, q.Desc, q.Limit, q.Currency, q.After, q.Fields})
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(normalized)
+    return "products:list:" + string(generation) + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// listGenerationTTL is how long a listing generation lives. It only has to outlast the
+// listings cached under it.
+const listGenerationTTL = 24 * time.Hour
+
+// invalidateProduct drops a product, and every cached listing, from the cache after it has
+// been changed. Callers only log failures, because the entries will expire after their TTL
+// anyway.
+func invalidateProduct(ctx context.Context, id int) error {
+    if ProductCache == nil {
+        return nil
+    }
+    if err := ProductCache.Delete(ctx, productCacheKey(ctx, id)); err != nil {
+        return err
+    }
+    return invalidateProductLists(ctx)
+}
+
+// invalidateProductLists drops every cached listing, for changes that can move products in
+// or out of a listing without changing a cached product. Callers only log failures.
+func invalidateProductLists(ctx context.Context) error {
+    if ProductCache == nil {
+        return nil
+    }
+    return ProductCache.Delete(ctx, listGenerationKey)
+}
+
+// memoryEntry is a value stored in a memoryCache.
+type memoryEntry struct {
+    key       string
+    value     []byte
+    expiresAt time.Time
+}
+
+// memoryCache is an in-process Cache. It holds at most maxEntries values and evicts the
+// least recently used one to make room.
+type memoryCache struct {
+    mu         sync.Mutex
+    maxEntries int
+    // order has the most recently used entry at the front.
+    order   *list.List
+    entries map[string]*list.Element
+}
+
+// newMemoryCache returns an empty in-memory cache holding up to maxEntries values.
+func newMemoryCache(maxEntries int) *memoryCache {
+    return &memoryCache{maxEntries: maxEntries, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    elem, ok := c.entries[key]
+    if !ok {
+        return nil, false, nil
+    }
+    entry := elem.Value.(*memoryEntry)
+    if time.Now().After(entry.expiresAt) {
+        c.remove(elem)
+        return nil, false, nil
+    }
+    c.order.MoveToFront(elem)
+    return entry.value, true, nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if elem, ok := c.entries[key]; ok {
+        elem.Value = &memoryEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+        c.order.MoveToFront(elem)
+        return nil
+    }
+    c.entries[key] = c.order.PushFront(&memoryEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+    for c.order.Len() > c.maxEntries {
+        c.remove(c.order.Back())
+    }
+    return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if elem, ok := c.entries[key]; ok {
+        c.remove(elem)
+    }
+    return nil
+}
+
+// remove drops elem from the cache. The caller must hold c.mu.
+func (c *memoryCache) remove(elem *list.Element) {
+    c.order.Remove(elem)
+    delete(c.entries, elem.Value.(*memoryEntry).key)
+}
+
+// redisCache is a Cache shared by every instance through Redis.
+type redisCache struct {
+    client *redis.Client
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+    value, err := c.client.Get(ctx, key).Bytes()
+    if err == redis.Nil {
+        return nil, false, nil
+    } else if err != nil {
+        return nil, false, err
+    }
+    return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+    return c.client.Del(ctx, key).Err()
+}
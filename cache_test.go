@@ -0,0 +1,104 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestMemoryCache(t *testing.T) {
+    ctx := context.Background()
+    cache := newMemoryCache(2)
+    check := func(key, want string) {
+        t.Helper()
+        value, ok, err := cache.Get(ctx, key)
+        if err != nil {
+            t.Fatalf("Get(%q): %v", key, err)
+        }
+        if got := string(value); ok != (want != "") || got != want {
+            t.Errorf("Get(%q) = %q, %v, want %q", key, got, ok, want)
+        }
+    }
+
+    cache.Set(ctx, "a", []byte("1"), time.Minute)
+    cache.Set(ctx, "b", []byte("2"), time.Minute)
+    // Reading a makes b the least recently used entry, so c evicts it.
+    check("a", "1")
+    cache.Set(ctx, "c", []byte("3"), time.Minute)
+    check("b", "")
+    check("c", "3")
+    check("a", "1")
+
+    cache.Delete(ctx, "c")
+    check("c", "")
+    cache.Set(ctx, "expired", []byte("4"), -time.Second)
+    check("expired", "")
+    check("a", "1")
+}
+
+func TestGetProductReadThroughCache(t *testing.T) {
+    repo := setupHandlers(t)
+    ProductCache = newMemoryCache(AppConfig.CacheMaxEntries)
+    product := seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD"})
+    get := func() string {
+        t.Helper()
+        w := httptest.NewRecorder()
+        getProduct(w, newTestRequest("GET", "/products/1", "", RoleViewer, map[string]string{"id": "1"}))
+        if w.Code != http.StatusOK {
+            t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+        }
+        var detail ProductDetail
+        if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil {
+            t.Fatalf("decoding product: %v", err)
+        }
+        return detail.Name
+    }
+
+    if name := get(); name != "Lamp" {
+        t.Fatalf("name = %q, want %q", name, "Lamp")
+    }
+    // A change made behind the cache's back is not seen until the product is invalidated.
+    product.Name = "Desk lamp"
+    repo.products[product.ID] = product
+    if name := get(); name != "Lamp" {
+        t.Errorf("name = %q, want the cached %q", name, "Lamp")
+    }
+    if err := invalidateProduct(context.Background(), product.ID); err != nil {
+        t.Fatalf("invalidating product: %v", err)
+    }
+    if name := get(); name != "Desk lamp" {
+        t.Errorf("name after invalidation = %q, want %q", name, "Desk lamp")
+    }
+}
+
+func TestListCacheKey(t *testing.T) {
+    setupHandlers(t)
+    ProductCache = newMemoryCache(10)
+    ctx := context.Background()
+    key := func(q ListQuery) string {
+        t.Helper()
+        key, err := listCacheKey(ctx, q)
+        if err != nil {
+            t.Fatalf("listCacheKey: %v", err)
+        }
+        return key
+    }
+
+    homeByPrice := ListQuery{Filter: ProductFilter{Categories: []string{"home"}}, Sort: "price", Limit: 10}
+    first := key(homeByPrice)
+    if again := key(homeByPrice); again != first {
+        t.Errorf("same listing got keys %q and %q", first, again)
+    }
+    if other := key(ListQuery{Filter: ProductFilter{Categories: []string{"garden"}}, Sort: "price", Limit: 10}); other == first {
+        t.Error("different listings got the same key")
+    }
+    if err := invalidateProductLists(ctx); err != nil {
+        t.Fatalf("invalidating listings: %v", err)
+    }
+    if after := key(homeByPrice); after == first {
+        t.Error("listing key did not change after invalidation")
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Errors returned by a CartRepository.
+var (
+    ErrCartNotFound     = errors.New("cart not found")
+    ErrCartItemNotFound = errors.New("cart item not found")
+)
+
+// CartRepository stores shopping carts. Carts that have expired are left out of every
+// method as if they didn't exist, until DeleteExpired deletes them.
+type CartRepository interface {
+    // Create stores a new empty cart and fills in its ID and times.
+    Create(ctx context.Context, cart *Cart) error
+    // Get returns the cart with the given ID with its items, in the order they were added,
+    // or ErrCartNotFound.
+    Get(ctx context.Context, id int) (Cart, error)
+    // SetItem sets the quantity of a product in a cart, adding the product if it isn't in
+    // the cart yet, and keeps the cart until expiresAt. It returns ErrCartNotFound, or
+    // ErrProductNotFound if there is no such product.
+    SetItem(ctx context.Context, cartID, productID, quantity int, expiresAt time.Time) error
+    // RemoveItem takes a product out of a cart and keeps the cart until expiresAt. It
+    // returns ErrCartNotFound or ErrCartItemNotFound.
+    RemoveItem(ctx context.Context, cartID, productID int, expiresAt time.Time) error
+    // Delete deletes a cart with its items, or returns ErrCartNotFound.
+    Delete(ctx context.Context, id int) error
+    // DeleteExpired deletes the carts that expired before now and reports how many.
+    DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// Carts is a global variable that holds the cart repository used by the handlers.
+var Carts CartRepository
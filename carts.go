@@ -0,0 +1,411 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// maxCartQuantity is the most of one product a cart may hold.
+const maxCartQuantity = 999
+
+// Statuses of a cart line. Only lines that are ok count towards the cart's subtotal.
+const (
+    cartItemOK = "ok"
+    // cartItemInsufficientStock is a line for more than is in stock now; it was in stock
+    // when it was added.
+    cartItemInsufficientStock = "insufficient_stock"
+    // cartItemUnavailable is a line for a product that was deleted or that the owner can no
+    // longer see, like one moved back to draft.
+    cartItemUnavailable = "unavailable"
+)
+
+// Cart is a signed-in user's shopping cart. It is kept for CART_TTL after it last changed,
+// and its lines are priced when it is read, at the current prices in its currency.
+type Cart struct {
+    ID int `json:"id" xml:"id"`
+    // Owner is the subject of the principal that created the cart.
+    Owner    string     `json:"owner" xml:"owner"`
+    Currency string     `json:"currency" xml:"currency"`
+    Items    []CartItem `json:"items" xml:"items>item"`
+    // Subtotal and ItemCount add up the lines that are ok.
+    Subtotal  Money     `json:"subtotal" xml:"subtotal"`
+    ItemCount int       `json:"item_count" xml:"item_count"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+    UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+    ExpiresAt time.Time `json:"expires_at" xml:"expires_at"`
+}
+
+// CartItem is a line of a cart. The repository keeps the product and quantity; the rest is
+// filled in by priceCart.
+type CartItem struct {
+    ProductID int       `json:"product_id" xml:"product_id"`
+    Quantity  int       `json:"quantity" xml:"quantity"`
+    AddedAt   time.Time `json:"added_at" xml:"added_at"`
+    Name      string    `json:"name,omitempty" xml:"name,omitempty"`
+    Category  string    `json:"category,omitempty" xml:"category,omitempty"`
+    // UnitPrice is the price after the promotion PromotionID, if one applies.
+    UnitPrice   Money  `json:"unit_price" xml:"unit_price"`
+    PromotionID int    `json:"promotion_id,omitempty" xml:"promotion_id,omitempty"`
+    LineTotal   Money  `json:"line_total" xml:"line_total"`
+    Stock       int    `json:"stock" xml:"stock"`
+    Status      string `json:"status" xml:"status"`
+}
+
+// CreateCartRequest is the optional body of a request creating a cart. The currency
+// defaults to the base currency.
+type CreateCartRequest struct {
+    Currency string `json:"currency" xml:"currency"`
+}
+
+// CartItemRequest is the body of a request adding a product to a cart, or, without the
+// product ID, setting the quantity of a line.
+type CartItemRequest struct {
+    ProductID int `json:"product_id" xml:"product_id"`
+    Quantity  int `json:"quantity" xml:"quantity"`
+}
+
+// validateCartQuantity checks the quantity of a cart line.
+func validateCartQuantity(quantity int) ValidationErrors {
+    if quantity < 1 || quantity > maxCartQuantity {
+        return ValidationErrors{{Field: "quantity", Message: "must be between 1 and " + strconv.Itoa(maxCartQuantity)}}
+    }
+    return nil
+}
+
+// priceCart fills in the lines of cart from the products as they are now, priced in the
+// cart's currency with the running promotions, and adds up its subtotal.
+func priceCart(ctx context.Context, cart *Cart) error {
+    ids := make([]int, len(cart.Items))
+    for i, item := range cart.Items {
+        ids[i] = item.ProductID
+    }
+    found, err := Repo.GetByIDs(ctx, ids)
+    if err != nil {
+        return err
+    }
+    var products []Product
+    for _, product := range found {
+        if authorizeProduct(ctx, ActionRead, product) == nil {
+            products = append(products, product)
+        }
+    }
+    if err := convertPrices(ctx, products, cart.Currency); err != nil {
+        return err
+    }
+    if err := applyPromotions(ctx, products); err != nil {
+        return err
+    }
+    expanded, err := Repo.Expand(ctx, products, Expansion{Inventory: true})
+    if err != nil {
+        return err
+    }
+    byID := make(map[int]ExpandedProduct, len(expanded))
+    for _, product := range expanded {
+        byID[product.ID] = product
+    }
+
+    cart.Subtotal, cart.ItemCount = 0, 0
+    for i := range cart.Items {
+        item := &cart.Items[i]
+        product, ok := byID[item.ProductID]
+        if !ok {
+            item.Status = cartItemUnavailable
+            continue
+        }
+        item.Name, item.Category, item.UnitPrice, item.Stock = product.Name, product.Category, product.Price, product.Inventory.Quantity
+        if product.EffectivePrice != nil {
+            item.UnitPrice, item.PromotionID = *product.EffectivePrice, product.PromotionID
+        }
+        item.LineTotal = item.UnitPrice * Money(item.Quantity)
+        if item.Quantity > item.Stock {
+            item.Status = cartItemInsufficientStock
+            continue
+        }
+        item.Status = cartItemOK
+        cart.Subtotal += item.LineTotal
+        cart.ItemCount += item.Quantity
+    }
+    return nil
+}
+
+// cartIDFromRequest returns the cart ID from the {id} path variable.
+func cartIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// cartPrincipal returns the principal of the request, whose subject owns the carts it
+// creates. If there is none it writes a 401 Unauthorized response and reports false.
+func cartPrincipal(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+    principal, ok := principalFromContext(r.Context())
+    if !ok {
+        respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Sign in to use a cart.")
+    }
+    return principal, ok
+}
+
+// loadCart returns the cart of the {id} path variable, like findCart.
+func loadCart(w http.ResponseWriter, r *http.Request, message string) (Cart, bool) {
+    cartID, err := cartIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid cart ID.")
+        return Cart{}, false
+    }
+    return findCart(w, r, cartID, message)
+}
+
+// findCart returns the cart with the given ID. Only its owner and admins may use a cart; for
+// anyone else it is not found. If it can't be used it writes the error response, or answers
+// a failed lookup with message, and reports false.
+func findCart(w http.ResponseWriter, r *http.Request, cartID int, message string) (Cart, bool) {
+    principal, ok := cartPrincipal(w, r)
+    if !ok {
+        return Cart{}, false
+    }
+
+    cart, err := Carts.Get(r.Context(), cartID)
+    if err == ErrCartNotFound || err == nil && cart.Owner != principal.Subject && !principal.Role.Includes(RoleAdmin) {
+        respondError(w, r, http.StatusNotFound, codeCartNotFound, "Cart not found.")
+        return Cart{}, false
+    } else if err != nil {
+        respondStoreError(w, r, err, message)
+        return Cart{}, false
+    }
+    return cart, true
+}
+
+// respondCart prices the cart with the given ID and writes it as the response body. A cart
+// that expired since it was changed is not found.
+func respondCart(w http.ResponseWriter, r *http.Request, cartID int, message string) {
+    cart, err := Carts.Get(r.Context(), cartID)
+    if err == ErrCartNotFound {
+        respondError(w, r, http.StatusNotFound, codeCartNotFound, "Cart not found.")
+        return
+    }
+    if err == nil {
+        err = priceCart(r.Context(), &cart)
+    }
+    if err == errUnsupportedCurrency {
+        respondConversionError(w, r, err)
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, message)
+        return
+    }
+    respond(w, r, http.StatusOK, cart)
+}
+
+// createCart creates an empty cart for the caller, priced in the currency of an optional
+// body like {"currency": "EUR"}.
+func createCart(w http.ResponseWriter, r *http.Request) {
+    principal, ok := cartPrincipal(w, r)
+    if !ok {
+        return
+    }
+    var req CreateCartRequest
+    if r.ContentLength != 0 {
+        if err := decodeBody(r, &req); err != nil {
+            respondBodyError(w, r, err)
+            return
+        }
+    }
+    currency := strings.ToUpper(strings.TrimSpace(req.Currency))
+    if currency == "" {
+        currency = AppConfig.BaseCurrency
+    }
+    var errs ValidationErrors
+    if validateCurrency(&errs, currency); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    cart := Cart{Owner: principal.Subject, Currency: currency, ExpiresAt: time.Now().Add(AppConfig.CartTTL)}
+    if err := Carts.Create(r.Context(), &cart); err != nil {
+        respondStoreError(w, r, err, "Failed to create cart.")
+        return
+    }
+    cart.Items = []CartItem{}
+
+    // If everything went well, return a 201 Created response with the new cart.
+    w.Header().Set("Location", "/carts/"+strconv.Itoa(cart.ID))
+    respond(w, r, http.StatusCreated, cart)
+}
+
+// getCart retrieves a cart with its lines priced as the products are now.
+func getCart(w http.ResponseWriter, r *http.Request) {
+    cart, ok := loadCart(w, r, "Failed to retrieve cart.")
+    if !ok {
+        return
+    }
+
+    // If everything went well, return the priced cart in the response body.
+    respondCart(w, r, cart.ID, "Failed to retrieve cart.")
+}
+
+// deleteCart deletes a cart with its lines.
+func deleteCart(w http.ResponseWriter, r *http.Request) {
+    cart, ok := loadCart(w, r, "Failed to delete cart.")
+    if !ok {
+        return
+    }
+
+    err := Carts.Delete(r.Context(), cart.ID)
+    if err == ErrCartNotFound {
+        respondError(w, r, http.StatusNotFound, codeCartNotFound, "Cart not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to delete cart.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// setCartItem stores the quantity of a product in a cart, if that many are in stock. Stock
+// isn't reserved, so the line may run short later; priceCart reports that.
+func setCartItem(w http.ResponseWriter, r *http.Request, cart Cart, productID, quantity int, message string) {
+    // Anyone who may see a product may put it in a cart.
+    if !requireLiveProduct(w, r, productID, ActionRead, message) {
+        return
+    }
+    level, err := queryStockLevel(r.Context(), productID)
+    if err != nil {
+        respondStoreError(w, r, err, message)
+        return
+    }
+    if quantity > level.Quantity {
+        respondError(w, r, http.StatusConflict, codeInsufficientStock, "Not enough stock for this quantity.")
+        return
+    }
+
+    err = Carts.SetItem(r.Context(), cart.ID, productID, quantity, time.Now().Add(AppConfig.CartTTL))
+    switch {
+    case err == ErrCartNotFound:
+        respondError(w, r, http.StatusNotFound, codeCartNotFound, "Cart not found.")
+        return
+    case err == ErrProductNotFound:
+        // The product was purged in the meantime.
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    case err != nil:
+        respondStoreError(w, r, err, message)
+        return
+    }
+
+    // If everything went well, return the cart with the changed line.
+    respondCart(w, r, cart.ID, message)
+}
+
+// addCartItem adds a product to a cart from a body like {"product_id": 7, "quantity": 2}.
+// A product already in the cart has its quantity increased.
+func addCartItem(w http.ResponseWriter, r *http.Request) {
+    cart, ok := loadCart(w, r, "Failed to add item.")
+    if !ok {
+        return
+    }
+    var req CartItemRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    errs := validateCartQuantity(req.Quantity)
+    if req.ProductID < 1 {
+        errs.add("product_id", "must be positive")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    quantity := req.Quantity
+    for _, item := range cart.Items {
+        if item.ProductID == req.ProductID {
+            quantity += item.Quantity
+        }
+    }
+    if errs := validateCartQuantity(quantity); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+    setCartItem(w, r, cart, req.ProductID, quantity, "Failed to add item.")
+}
+
+// updateCartItem sets the quantity of a line of a cart from a body like {"quantity": 3}.
+func updateCartItem(w http.ResponseWriter, r *http.Request) {
+    cart, ok := loadCart(w, r, "Failed to update item.")
+    if !ok {
+        return
+    }
+    productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    var req CartItemRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if errs := validateCartQuantity(req.Quantity); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    inCart := false
+    for _, item := range cart.Items {
+        inCart = inCart || item.ProductID == productID
+    }
+    if !inCart {
+        respondError(w, r, http.StatusNotFound, codeCartItemNotFound, "Product is not in the cart.")
+        return
+    }
+    setCartItem(w, r, cart, productID, req.Quantity, "Failed to update item.")
+}
+
+// removeCartItem takes a product out of a cart.
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+    cart, ok := loadCart(w, r, "Failed to remove item.")
+    if !ok {
+        return
+    }
+    productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    err = Carts.RemoveItem(r.Context(), cart.ID, productID, time.Now().Add(AppConfig.CartTTL))
+    switch {
+    case err == ErrCartNotFound:
+        respondError(w, r, http.StatusNotFound, codeCartNotFound, "Cart not found.")
+        return
+    case err == ErrCartItemNotFound:
+        respondError(w, r, http.StatusNotFound, codeCartItemNotFound, "Product is not in the cart.")
+        return
+    case err != nil:
+        respondStoreError(w, r, err, "Failed to remove item.")
+        return
+    }
+
+    // If everything went well, return the cart without the line.
+    respondCart(w, r, cart.ID, "Failed to remove item.")
+}
+
+// expireCarts deletes the carts that expired. It runs as the cart-expiry job, across
+// tenants.
+func expireCarts(ctx context.Context) error {
+    deleted, err := Carts.DeleteExpired(ctx, time.Now())
+    if err != nil {
+        return err
+    }
+    if deleted > 0 {
+        slog.Info("deleted expired carts", "count", deleted)
+    }
+    return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// stockedRepository is a memoryRepository that reports stock levels, which the memory
+// repository doesn't keep.
+type stockedRepository struct {
+    *memoryRepository
+    stock map[int]int
+}
+
+func (repo stockedRepository) Expand(ctx context.Context, products []Product, e Expansion) ([]ExpandedProduct, error) {
+    expanded, err := repo.memoryRepository.Expand(ctx, products, e)
+    for i := range expanded {
+        if expanded[i].Inventory != nil {
+            expanded[i].Inventory.Quantity = repo.stock[expanded[i].ID]
+        }
+    }
+    return expanded, err
+}
+
+func TestPriceCart(t *testing.T) {
+    repo := setupHandlers(t)
+    lamp := seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+    desk := seedProduct(t, repo, Product{Name: "Desk", Category: "office", Price: 19999})
+    draft := seedProduct(t, repo, Product{Name: "Chair", Category: "home", Price: 4999, Status: StatusDraft})
+    Repo = stockedRepository{repo, map[int]int{lamp.ID: 5, desk.ID: 1, draft.ID: 10}}
+
+    cart := Cart{Currency: AppConfig.BaseCurrency, Items: []CartItem{
+        {ProductID: lamp.ID, Quantity: 2},
+        {ProductID: desk.ID, Quantity: 3},
+        {ProductID: draft.ID, Quantity: 1},
+        {ProductID: 99, Quantity: 1},
+    }}
+    ctx := context.WithValue(context.Background(), principalContextKey, Principal{Subject: "alice", Role: RoleViewer})
+    if err := priceCart(ctx, &cart); err != nil {
+        t.Fatal(err)
+    }
+
+    want := []CartItem{
+        {ProductID: lamp.ID, Quantity: 2, Name: "Lamp", Category: "home", UnitPrice: 1999, LineTotal: 3998, Stock: 5, Status: cartItemOK},
+        {ProductID: desk.ID, Quantity: 3, Name: "Desk", Category: "office", UnitPrice: 19999, LineTotal: 59997, Stock: 1, Status: cartItemInsufficientStock},
+        // Viewers can't see drafts, so they can't buy them either.
+        {ProductID: draft.ID, Quantity: 1, Status: cartItemUnavailable},
+        {ProductID: 99, Quantity: 1, Status: cartItemUnavailable},
+    }
+    for i, item := range cart.Items {
+        if item != want[i] {
+            t.Errorf("line %d = %+v, want %+v", i, item, want[i])
+        }
+    }
+    // Only the lines that are ok count.
+    if cart.Subtotal != 3998 || cart.ItemCount != 2 {
+        t.Errorf("subtotal = %v, item count = %d, want 39.98 and 2", cart.Subtotal, cart.ItemCount)
+    }
+}
+
+func TestFindCart(t *testing.T) {
+    tests := []struct {
+        name      string
+        principal *Principal
+        cartID    int
+        status    int
+    }{
+        {name: "owner", principal: &Principal{Subject: "alice", Role: RoleViewer}, cartID: 1, status: http.StatusOK},
+        {name: "admin", principal: &Principal{Subject: "root", Role: RoleAdmin}, cartID: 1, status: http.StatusOK},
+        {name: "someone else", principal: &Principal{Subject: "bob", Role: RoleEditor}, cartID: 1, status: http.StatusNotFound},
+        {name: "expired", principal: &Principal{Subject: "alice", Role: RoleViewer}, cartID: 2, status: http.StatusNotFound},
+        {name: "missing", principal: &Principal{Subject: "alice", Role: RoleViewer}, cartID: 99, status: http.StatusNotFound},
+        {name: "anonymous", cartID: 1, status: http.StatusUnauthorized},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            ctx := context.Background()
+            Carts.Create(ctx, &Cart{Owner: "alice", Currency: "USD", ExpiresAt: time.Now().Add(time.Hour)})
+            Carts.Create(ctx, &Cart{Owner: "alice", Currency: "USD", ExpiresAt: time.Now().Add(-time.Second)})
+
+            r := httptest.NewRequest("GET", "/carts", nil)
+            if tt.principal != nil {
+                r = r.WithContext(context.WithValue(r.Context(), principalContextKey, *tt.principal))
+            }
+            w := httptest.NewRecorder()
+            cart, ok := findCart(w, r, tt.cartID, "Failed to retrieve cart.")
+            if ok != (tt.status == http.StatusOK) {
+                t.Fatalf("ok = %v for status %d", ok, tt.status)
+            }
+            if ok && cart.ID != tt.cartID {
+                t.Errorf("cart = %d, want %d", cart.ID, tt.cartID)
+            }
+            if !ok && w.Code != tt.status {
+                t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+        })
+    }
+}
+
+func TestExpireCarts(t *testing.T) {
+    setupHandlers(t)
+    carts := newMemoryCartRepository()
+    Carts = carts
+    ctx := context.Background()
+    now := time.Now()
+    for _, expiresAt := range []time.Time{now.Add(-time.Hour), now.Add(-time.Second), now.Add(time.Hour)} {
+        if err := carts.Create(ctx, &Cart{Owner: "alice", Currency: "USD", ExpiresAt: expiresAt}); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if err := expireCarts(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if len(carts.carts) != 1 {
+        t.Fatalf("%d carts left, want 1", len(carts.carts))
+    }
+    if _, err := carts.Get(ctx, 3); err != nil {
+        t.Errorf("unexpired cart: %v", err)
+    }
+
+    // A cart expires once the clock passes its expiry.
+    carts.now = func() time.Time { return now.Add(2 * time.Hour) }
+    if _, err := carts.Get(ctx, 3); err != ErrCartNotFound {
+        t.Errorf("Get after expiry = %v, want ErrCartNotFound", err)
+    }
+}
+
+// failingCarts is a cart repository all of whose calls fail with err.
+type failingCarts struct {
+    err error
+}
+
+func (c failingCarts) Create(ctx context.Context, cart *Cart) error  { return c.err }
+func (c failingCarts) Get(ctx context.Context, id int) (Cart, error) { return Cart{}, c.err }
+func (c failingCarts) SetItem(ctx context.Context, cartID, productID, quantity int, expiresAt time.Time) error {
+    return c.err
+}
+func (c failingCarts) RemoveItem(ctx context.Context, cartID, productID int, expiresAt time.Time) error {
+    return c.err
+}
+func (c failingCarts) Delete(ctx context.Context, id int) error { return c.err }
+func (c failingCarts) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+    return 0, c.err
+}
+
+// createCarts gives the caller of the test requests cart 1, holding one of product 1,
+// and someone else cart 2.
+func createCarts(t *testing.T) {
+    ctx := context.Background()
+    expiresAt := time.Now().Add(time.Hour)
+    for _, owner := range []string{"tester", "someone else"} {
+        if err := Carts.Create(ctx, &Cart{Owner: owner, Currency: AppConfig.BaseCurrency, ExpiresAt: expiresAt}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := Carts.SetItem(ctx, 1, 1, 1, expiresAt); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCartHandlers(t *testing.T) {
+    cart := map[string]string{"id": "1"}
+    item := map[string]string{"id": "1", "product_id": "1"}
+    inStock := answerRows(map[string][]driver.Value{"SELECT stock": {int64(5)}})
+    tests := []handlerTest{
+        {name: "create", handler: createCart, method: "POST", target: "/carts", body: `{"currency": "EUR"}`, status: http.StatusCreated},
+        {name: "create anonymous", handler: createCart, method: "POST", target: "/carts", anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "create malformed", handler: createCart, method: "POST", target: "/carts", body: `{"currency": 978}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid currency", handler: createCart, method: "POST", target: "/carts", body: `{"currency": "euro"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "get", handler: getCart, target: "/carts/1", vars: cart, setup: createCarts, status: http.StatusOK},
+        {name: "get invalid id", handler: getCart, target: "/carts/abc", vars: map[string]string{"id": "abc"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get anonymous", handler: getCart, target: "/carts/1", vars: cart, anonymous: true, setup: createCarts, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "get someone else's cart as admin", handler: getCart, target: "/carts/2", vars: map[string]string{"id": "2"}, setup: createCarts, status: http.StatusOK},
+        {name: "get missing", handler: getCart, target: "/carts/1", vars: cart, status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "delete", handler: deleteCart, method: "DELETE", target: "/carts/1", vars: cart, setup: createCarts, status: http.StatusNoContent},
+        {name: "delete missing", handler: deleteCart, method: "DELETE", target: "/carts/1", vars: cart, status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "add", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 2}`, vars: cart, setup: createCarts, answer: inStock, status: http.StatusOK},
+        {name: "add malformed", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": "1"}`, vars: cart, setup: createCarts, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "add no quantity", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1}`, vars: cart, setup: createCarts, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "add too many", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 999}`, vars: cart, setup: createCarts,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "add missing product", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 99, "quantity": 1}`, vars: cart, setup: createCarts, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "add to missing cart", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 1}`, vars: cart, status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "add out of stock", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 9}`, vars: cart, setup: createCarts, answer: inStock,
+            status: http.StatusConflict, code: codeInsufficientStock},
+        {name: "update", handler: updateCartItem, method: "PUT", target: "/carts/1/items/1", body: `{"quantity": 3}`, vars: item, setup: createCarts, answer: inStock, status: http.StatusOK},
+        {name: "update invalid product id", handler: updateCartItem, method: "PUT", target: "/carts/1/items/abc", body: `{"quantity": 3}`, vars: map[string]string{"id": "1", "product_id": "abc"},
+            setup: createCarts, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update invalid quantity", handler: updateCartItem, method: "PUT", target: "/carts/1/items/1", body: `{"quantity": 0}`, vars: item, setup: createCarts, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update not in cart", handler: updateCartItem, method: "PUT", target: "/carts/1/items/7", body: `{"quantity": 3}`, vars: map[string]string{"id": "1", "product_id": "7"},
+            setup: createCarts, status: http.StatusNotFound, code: codeCartItemNotFound},
+        {name: "remove", handler: removeCartItem, method: "DELETE", target: "/carts/1/items/1", vars: item, setup: createCarts, status: http.StatusOK},
+        {name: "remove invalid product id", handler: removeCartItem, method: "DELETE", target: "/carts/1/items/abc", vars: map[string]string{"id": "1", "product_id": "abc"},
+            setup: createCarts, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "remove not in cart", handler: removeCartItem, method: "DELETE", target: "/carts/1/items/7", vars: map[string]string{"id": "1", "product_id": "7"},
+            setup: createCarts, status: http.StatusNotFound, code: codeCartItemNotFound},
+    }
+    // Other people's carts are not found, for every cart endpoint, unless the caller is an admin.
+    for _, tt := range []handlerTest{
+        {name: "get", handler: getCart},
+        {name: "delete", handler: deleteCart, method: "DELETE"},
+        {name: "add", handler: addCartItem, method: "POST", body: `{"product_id": 1, "quantity": 1}`},
+        {name: "update", handler: updateCartItem, method: "PUT", body: `{"quantity": 1}`},
+        {name: "remove", handler: removeCartItem, method: "DELETE"},
+    } {
+        tt.name, tt.target, tt.vars, tt.setup = tt.name+" someone else's cart", "/carts/2/items/1", map[string]string{"id": "2", "product_id": "1"}, createCarts
+        tt.role, tt.answer, tt.status, tt.code = RoleEditor, inStock, http.StatusNotFound, codeCartNotFound
+        tests = append(tests, tt)
+    }
+    // Cart lookups and changes that fail are answered like failed queries.
+    for _, e := range []struct {
+        name   string
+        err    error
+        status int
+        code   string
+    }{
+        {name: "database unavailable", err: errDatabaseUnavailable{RetryAfter: time.Second}, status: http.StatusServiceUnavailable, code: codeUnavailable},
+        {name: "database timeout", err: context.DeadlineExceeded, status: http.StatusGatewayTimeout, code: codeTimeout},
+    } {
+        fail := func(t *testing.T) { Carts = failingCarts{e.err} }
+        for _, tt := range []handlerTest{
+            {name: "create", handler: createCart, method: "POST"},
+            {name: "get", handler: getCart},
+            {name: "delete", handler: deleteCart, method: "DELETE"},
+            {name: "add", handler: addCartItem, method: "POST", body: `{"product_id": 1, "quantity": 1}`},
+            {name: "update", handler: updateCartItem, method: "PUT", body: `{"quantity": 1}`},
+            {name: "remove", handler: removeCartItem, method: "DELETE"},
+        } {
+            tt.name, tt.target, tt.vars, tt.setup = fmt.Sprintf("%s %s", tt.name, e.name), "/carts/1/items/1", item, fail
+            tt.status, tt.code = e.status, e.code
+            tests = append(tests, tt)
+        }
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "add", handler: addCartItem, method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 2}`, vars: cart, setup: createCarts},
+        handlerTest{name: "update", handler: updateCartItem, method: "PUT", target: "/carts/1/items/1", body: `{"quantity": 3}`, vars: item, setup: createCarts},
+    ))
+}
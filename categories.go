@@ -0,0 +1,352 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Category is a node of the category tree. Products refer to categories by name.
+type Category struct {
+    ID        int         `json:"id" xml:"id"`
+    Name      string      `json:"name" xml:"name"`
+    ParentID  *int        `json:"parent_id" xml:"parent_id"`
+    CreatedAt time.Time   `json:"created_at" xml:"created_at"`
+    Children  []*Category `json:"children,omitempty" xml:"children>category,omitempty"`
+}
+
+// errCategoryCycle is returned when a category would become its own ancestor.
+var errCategoryCycle = errors.New("category cycle")
+
+// Validate checks the fields of a category payload.
+func (c Category) Validate() ValidationErrors {
+    var errs ValidationErrors
+    validateCategory(&errs, c.Name)
+    if c.ParentID != nil && *c.ParentID == c.ID {
+        errs.add("parent_id", "must not be the category itself")
+    }
+    return errs
+}
+
+// categoryIDFromRequest returns the category ID from the {id} path variable.
+func categoryIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// queryCategory returns the category with the given ID, or sql.ErrNoRows.
+func queryCategory(ctx context.Context, id int) (Category, error) {
+    var c Category
+    err := Reads.QueryRowScan(ctx, []interface{}{&c.ID, &c.Name, &c.ParentID, &c.CreatedAt},
+        "SELECT id, name, parent_id, created_at FROM categories WHERE id = $1", id)
+    return c, err
+}
+
+// queryCategoryByName returns the category with the given name, or sql.ErrNoRows.
+func queryCategoryByName(ctx context.Context, name string) (Category, error) {
+    var c Category
+    err := Reads.QueryRowScan(ctx, []interface{}{&c.ID, &c.Name, &c.ParentID, &c.CreatedAt},
+        "SELECT id, name, parent_id, created_at FROM categories WHERE name = $1", name)
+    return c, err
+}
+
+// queryCategories returns the categories matching an optional WHERE clause, by name.
+func queryCategories(ctx context.Context, where string, args ...interface{}) ([]*Category, error) {
+    rows, err := Reads.QueryContext(ctx, "SELECT id, name, parent_id, created_at FROM categories "+where+" ORDER BY name", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    categories := []*Category{}
+    for rows.Next() {
+        c := &Category{}
+        if err := rows.Scan(&c.ID, &c.Name, &c.ParentID, &c.CreatedAt); err != nil {
+            return nil, err
+        }
+        categories = append(categories, c)
+    }
+    return categories, rows.Err()
+}
+
+// getCategories returns every category, as a flat list or, with ?tree=true, nested under
+// their parents.
+func getCategories(w http.ResponseWriter, r *http.Request) {
+    categories, err := queryCategories(r.Context(), "")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve categories.")
+        return
+    }
+
+    if r.URL.Query().Get("tree") == "true" {
+        categories = categoryTree(categories)
+    }
+
+    if respondEmptyList(w, r, len(categories)) {
+        return
+    }
+
+    // If everything went well, return the categories in the response body.
+    respond(w, r, http.StatusOK, categories)
+}
+
+// categoryTree nests categories under their parents and returns the roots. The order of
+// siblings follows the order of the input.
+func categoryTree(categories []*Category) []*Category {
+    byID := make(map[int]*Category, len(categories))
+    for _, c := range categories {
+        byID[c.ID] = c
+    }
+    roots := []*Category{}
+    for _, c := range categories {
+        if c.ParentID != nil {
+            if parent, ok := byID[*c.ParentID]; ok {
+                parent.Children = append(parent.Children, c)
+                continue
+            }
+        }
+        roots = append(roots, c)
+    }
+    return roots
+}
+
+// getCategory retrieves a single category.
+func getCategory(w http.ResponseWriter, r *http.Request) {
+    categoryID, err := categoryIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid category ID.")
+        return
+    }
+
+    category, err := queryCategory(r.Context(), categoryID)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeCategoryNotFound, "Category not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve category.")
+        return
+    }
+
+    // If everything went well, return the category in the response body.
+    respond(w, r, http.StatusOK, category)
+}
+
+// createCategory creates a category from a JSON body like {"name": "Shoes", "parent_id": 3}.
+func createCategory(w http.ResponseWriter, r *http.Request) {
+    var category Category
+    if err := decodeJSON(r, &category); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    category.Name = strings.TrimSpace(category.Name)
+    if errs := category.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    err := DB.QueryRowContext(r.Context(), "INSERT INTO categories (name, parent_id) VALUES ($1, $2) RETURNING id, created_at",
+        category.Name, category.ParentID).Scan(&category.ID, &category.CreatedAt)
+    if !respondCategoryWriteError(w, r, err) {
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new category.
+    w.Header().Set("Location", "/categories/"+strconv.Itoa(category.ID))
+    respond(w, r, http.StatusCreated, category)
+}
+
+// updateCategory renames a category or moves it under another parent. Renaming a category
+// renames it on all of its products too, which get a new version and an audited update as
+// their representation changed.
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+    categoryID, err := categoryIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid category ID.")
+        return
+    }
+
+    var category Category
+    if err := decodeJSON(r, &category); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    category.ID = categoryID
+    category.Name = strings.TrimSpace(category.Name)
+    if errs := category.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    tx, err := DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to update category.")
+        return
+    }
+    defer tx.Rollback()
+
+    // Refuse to move a category under one of its own descendants.
+    if category.ParentID != nil {
+        var cycle bool
+        err = tx.QueryRowContext(r.Context(), `WITH RECURSIVE subtree AS (
+                SELECT id FROM categories WHERE id = $1
+                UNION ALL
+                SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+            )
+            SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`, categoryID, *category.ParentID).Scan(&cycle)
+        if err == nil && cycle {
+            err = errCategoryCycle
+        }
+    }
+    // The products are locked before the rename reaches them through the foreign key.
+    var renamed []Product
+    if err == nil {
+        err = queryTxRows(r.Context(), tx, func(scan func(dest ...interface{}) error) error {
+            var product Product
+            if err := scan(productFields(&product)...); err != nil {
+                return err
+            }
+            renamed = append(renamed, product)
+            return nil
+        }, "SELECT "+productColumns+` FROM products
+            WHERE category = (SELECT name FROM categories WHERE id = $1 AND name <> $2)
+            ORDER BY id FOR UPDATE`, categoryID, category.Name)
+    }
+    if err == nil {
+        err = tx.QueryRowContext(r.Context(), "UPDATE categories SET name = $1, parent_id = $2 WHERE id = $3 RETURNING created_at",
+            category.Name, category.ParentID, categoryID).Scan(&category.CreatedAt)
+    }
+    for i := 0; err == nil && i < len(renamed); i++ {
+        before := &renamed[i]
+        var after Product
+        err = tx.QueryRowContext(r.Context(), "UPDATE products SET version = version + 1 WHERE id = $1 RETURNING "+productColumns, before.ID).Scan(productFields(&after)...)
+        if err == nil {
+            err = recordAudit(r.Context(), tx, auditUpdate, before.ID, before, &after)
+        }
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeCategoryNotFound, "Category not found.")
+        return
+    }
+    if !respondCategoryWriteError(w, r, err) {
+        return
+    }
+    for _, product := range renamed {
+        if err := invalidateProduct(r.Context(), product.ID); err != nil {
+            logError(r, err)
+        }
+    }
+
+    // If everything went well, return the updated category in the response body.
+    respond(w, r, http.StatusOK, category)
+}
+
+// respondCategoryWriteError answers a failed category insert or update. It reports whether
+// err was nil, in which case nothing was written.
+func respondCategoryWriteError(w http.ResponseWriter, r *http.Request, err error) bool {
+    switch {
+    case err == nil:
+        return true
+    case isUniqueViolation(err):
+        respondError(w, r, http.StatusConflict, codeCategoryExists, "A category with this name already exists.")
+    case isForeignKeyViolation(err):
+        respondValidationErrors(w, r, ValidationErrors{{Field: "parent_id", Message: "does not exist"}})
+    case err == errCategoryCycle:
+        respondValidationErrors(w, r, ValidationErrors{{Field: "parent_id", Message: "must not be the category itself or one of its descendants"}})
+    default:
+        respondStoreError(w, r, err, "Failed to save category.")
+    }
+    return false
+}
+
+// deleteCategory deletes a category that has neither products nor subcategories.
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+    categoryID, err := categoryIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid category ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM categories WHERE id = $1", categoryID)
+    if isForeignKeyViolation(err) {
+        respondError(w, r, http.StatusConflict, codeCategoryNotEmpty, "Category still has products or subcategories.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to delete category.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete category.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeCategoryNotFound, "Category not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// getCategoryProducts lists the products of a category and all of its subcategories. It
+// takes the same sort and paging parameters as /products.
+func getCategoryProducts(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+
+    categoryID, err := categoryIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid category ID.")
+        return
+    }
+    q, err := parseListQuery(r.URL.Query(), start)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+
+    names, err := categorySubtreeNames(r.Context(), categoryID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve products.")
+        return
+    }
+    if len(names) == 0 {
+        respondError(w, r, http.StatusNotFound, codeCategoryNotFound, "Category not found.")
+        return
+    }
+
+    q.Filter.Categories = names
+    q.Filter.IncludeDeleted = includeDeleted(r)
+    q.Filter.PublishedOnly = !includeUnpublished(r.Context())
+    listProducts(w, r, q)
+}
+
+// categorySubtreeNames returns the names of a category and everything below it. The result
+// is empty if there is no such category.
+func categorySubtreeNames(ctx context.Context, categoryID int) ([]string, error) {
+    rows, err := Reads.QueryContext(ctx, `WITH RECURSIVE subtree AS (
+            SELECT id, name FROM categories WHERE id = $1
+            UNION ALL
+            SELECT c.id, c.name FROM categories c JOIN subtree s ON c.parent_id = s.id
+        )
+        SELECT name FROM subtree`, categoryID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var names []string
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+    }
+    return names, rows.Err()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// TestUpdateCategoryRename checks that renaming a category gives its products a new version
+// and drops them, and the listings, from the cache, while moving it leaves them be.
+func TestUpdateCategoryRename(t *testing.T) {
+    tests := []struct {
+        name    string
+        body    string
+        bumped  []int64
+        dropped bool
+    }{
+        {name: "rename", body: `{"name": "lighting"}`, bumped: []int64{1, 2}, dropped: true},
+        {name: "same name", body: `{"name": "home"}`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            ProductCache = newMemoryCache(10)
+            ctx := context.Background()
+            for _, key := range []string{productCacheKey(ctx, 1), productCacheKey(ctx, 2), listGenerationKey} {
+                if err := ProductCache.Set(ctx, key, []byte("cached"), time.Hour); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            // The category is called home and holds products 1 and 2.
+            var mu sync.Mutex
+            var bumped []int64
+            stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                switch {
+                case strings.HasPrefix(query, "SELECT "+productColumns) && strings.Contains(query, "FOR UPDATE"):
+                    if args[1] == "home" {
+                        return nil, nil, nil
+                    }
+                    columns, first := productRow(Product{ID: 1, Name: "Lamp", Category: "home", Version: 3})
+                    _, second := productRow(Product{ID: 2, Name: "Desk", Category: "home", Version: 1})
+                    return columns, [][]driver.Value{first, second}, nil
+                case strings.HasPrefix(query, "UPDATE categories"):
+                    return []string{"created_at"}, [][]driver.Value{{time.Unix(0, 0)}}, nil
+                case strings.HasPrefix(query, "UPDATE products SET version"):
+                    mu.Lock()
+                    bumped = append(bumped, args[0].(int64))
+                    mu.Unlock()
+                    columns, row := productRow(Product{ID: int(args[0].(int64)), Name: "Renamed", Category: "lighting", Version: 4})
+                    return columns, [][]driver.Value{row}, nil
+                }
+                return nil, nil, nil
+            }
+
+            w := httptest.NewRecorder()
+            updateCategory(w, newTestRequest("PUT", "/categories/7", tt.body, RoleAdmin, map[string]string{"id": "7"}))
+
+            if w.Code != http.StatusOK {
+                t.Fatalf("status = %d: %s", w.Code, w.Body)
+            }
+            var category Category
+            if err := json.Unmarshal(w.Body.Bytes(), &category); err != nil || category.ID != 7 {
+                t.Fatalf("body = %s (%v), want category 7", w.Body, err)
+            }
+            if !reflect.DeepEqual(bumped, tt.bumped) {
+                t.Errorf("bumped the versions of products %v, want %v", bumped, tt.bumped)
+            }
+            if got := stubDB.ran("INSERT INTO audit_log"); got != tt.dropped {
+                t.Errorf("audited = %v, want %v", got, tt.dropped)
+            }
+            for _, key := range []string{productCacheKey(ctx, 1), productCacheKey(ctx, 2), listGenerationKey} {
+                if _, ok, _ := ProductCache.Get(ctx, key); ok == tt.dropped {
+                    t.Errorf("%s cached = %v, want %v", key, ok, !tt.dropped)
+                }
+            }
+        })
+    }
+}
+
+func TestCategoryHandlers(t *testing.T) {
+    category := map[string]string{"id": "7"}
+    invalid := map[string]string{"id": "abc"}
+    created := time.Unix(0, 0)
+    tests := []handlerTest{
+        {name: "list", handler: getCategories, target: "/categories", answer: answerRows(map[string][]driver.Value{"FROM categories": {int64(7), "home", nil, created}}), status: http.StatusOK},
+        {name: "get", handler: getCategory, target: "/categories/7", vars: category, answer: answerRows(map[string][]driver.Value{"FROM categories": {int64(7), "home", nil, created}}), status: http.StatusOK},
+        {name: "get invalid id", handler: getCategory, target: "/categories/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getCategory, target: "/categories/7", vars: category, status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "create", handler: createCategory, method: "POST", target: "/categories", body: `{"name": "garden"}`, answer: answerRows(map[string][]driver.Value{"INSERT INTO categories": {int64(8), created}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createCategory, method: "POST", target: "/categories", body: `{"name": `, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create without name", handler: createCategory, method: "POST", target: "/categories", body: `{"name": " "}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create duplicate", handler: createCategory, method: "POST", target: "/categories", body: `{"name": "home"}`, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeCategoryExists},
+        {name: "create unknown parent", handler: createCategory, method: "POST", target: "/categories", body: `{"name": "garden", "parent_id": 99}`, answer: failQueries(foreignKeyViolation), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update invalid id", handler: updateCategory, method: "PUT", target: "/categories/abc", body: `{"name": "home"}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update malformed", handler: updateCategory, method: "PUT", target: "/categories/7", body: `[]`, vars: category, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "update without name", handler: updateCategory, method: "PUT", target: "/categories/7", body: `{}`, vars: category, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", handler: updateCategory, method: "PUT", target: "/categories/7", body: `{"name": "home"}`, vars: category, status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "update into own subtree", handler: updateCategory, method: "PUT", target: "/categories/7", body: `{"name": "home", "parent_id": 9}`, vars: category,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {true}}), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update duplicate", handler: updateCategory, method: "PUT", target: "/categories/7", body: `{"name": "office"}`, vars: category, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeCategoryExists},
+        {name: "delete", handler: deleteCategory, method: "DELETE", target: "/categories/7", vars: category, answer: answerRows(map[string][]driver.Value{"DELETE FROM categories": {int64(7)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deleteCategory, method: "DELETE", target: "/categories/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteCategory, method: "DELETE", target: "/categories/7", vars: category, status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "delete in use", handler: deleteCategory, method: "DELETE", target: "/categories/7", vars: category, answer: failQueries(foreignKeyViolation), status: http.StatusConflict, code: codeCategoryNotEmpty},
+        {name: "products", handler: getCategoryProducts, target: "/categories/7/products", vars: category, answer: answerRows(map[string][]driver.Value{"WITH RECURSIVE subtree": {"home"}}), status: http.StatusOK},
+        {name: "products invalid id", handler: getCategoryProducts, target: "/categories/abc/products", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "products invalid limit", handler: getCategoryProducts, target: "/categories/7/products?limit=0", vars: category, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "products missing", handler: getCategoryProducts, target: "/categories/7/products", vars: category, status: http.StatusNotFound, code: codeCategoryNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getCategories, target: "/categories"},
+        handlerTest{name: "get", handler: getCategory, target: "/categories/7", vars: category},
+        handlerTest{name: "create", handler: createCategory, method: "POST", target: "/categories", body: `{"name": "garden"}`},
+        handlerTest{name: "update", handler: updateCategory, method: "PUT", target: "/categories/7", body: `{"name": "garden"}`, vars: category},
+        handlerTest{name: "delete", handler: deleteCategory, method: "DELETE", target: "/categories/7", vars: category},
+        handlerTest{name: "products", handler: getCategoryProducts, target: "/categories/7/products", vars: category},
+    ))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "os/signal"
+    "sort"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// command is a subcommand of the binary. Run gets the arguments after the command's name
+// and exits through fatal if it fails.
+type command struct {
+    Usage string
+    Run   func(args []string)
+}
+
+// Usage of the commands that take arguments beyond the configuration flags.
+const (
+    migrateUsage = "migrate up|down [flags]\n\tApply every pending migration, or revert the latest applied one."
+    loadgenUsage = "loadgen [-url http://localhost:8080] [-paths /products,/products/1] [-rate 50] [-duration 30s] [-max-in-flight 100] [-timeout 10s] [-api-key key | -token jwt] [-tenant slug]\n\tSend GET requests to a running instance at a steady rate and report latency percentiles."
+    seedUsage    = "seed -file products.csv | -count n [-categories a,b] [-price-distribution lognormal] [-min-price 1.99] [-max-price 1999.99] [-random-seed n] [-tenant slug] [flags]\n\tUpsert the products of a CSV file, like POST /products/import, or add n fake ones."
+)
+
+// commands are the subcommands of the binary, by name. Each takes the configuration flags
+// of serve as well as its own, except loadgen, which only talks to a running instance.
+var commands = map[string]command{
+    "serve": {
+        Usage: "serve [flags]\n\tServe the API. This is what runs when no command is given.",
+        Run:   serve,
+    },
+    "migrate": {
+        Usage: migrateUsage,
+        Run:   runMigrate,
+    },
+    "seed": {
+        Usage: seedUsage,
+        Run:   runSeed,
+    },
+    "loadgen": {
+        Usage: loadgenUsage,
+        Run:   runLoadgen,
+    },
+    "routes": {
+        Usage: "routes [flags]\n\tList the routes the API serves with the current configuration.",
+        Run:   runRoutes,
+    },
+}
+
+// cliPrincipal is who changes made from the command line are recorded as in the audit log.
+var cliPrincipal = Principal{Subject: "cli", Role: RoleAdmin}
+
+func main() {
+    // Serving the API is what the binary does by default, so flags may follow it directly.
+    name, args := "serve", os.Args[1:]
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        name, args = args[0], args[1:]
+    }
+    cmd, ok := commands[name]
+    if !ok {
+        printUsage()
+        os.Exit(2)
+    }
+    cmd.Run(args)
+}
+
+// printUsage lists the commands on standard error.
+func printUsage() {
+    names := make([]string, 0, len(commands))
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    fmt.Fprintln(os.Stderr, "Usage: product-api <command> [arguments]\n\nCommands:")
+    for _, name := range names {
+        fmt.Fprintln(os.Stderr, "  "+commands[name].Usage)
+    }
+}
+
+// setUpCommand loads the configuration from args, with the command's own flags, and sets
+// up logging. It exits if the configuration isn't valid.
+func setUpCommand(args []string, commandFlags ...func(flags *flag.FlagSet)) {
+    var err error
+    AppConfig, err = loadConfig(args, commandFlags...)
+    if err != nil {
+        fatal("loading configuration", err)
+    }
+    setupLogger(AppConfig)
+}
+
+// openStore connects to the database and to everything a change to the catalog reaches,
+// the way serve does, so a command's changes are cached, audited and dispatched like the
+// API's. The returned function closes it all.
+func openStore() func() {
+    var err error
+    DB, err = openDB(AppConfig)
+    if err != nil {
+        fatal("opening database", err)
+    }
+    Reads = newReadRouter(DB, nil, AppConfig.DBStatementCacheSize)
+    Repo = newPostgresRepository(DB, Reads)
+
+    Redis, err = newRedisClient(AppConfig)
+    if err != nil {
+        fatal("setting up redis", err)
+    }
+    if Redis != nil {
+        if err := pingWithRetry("redis", pingRedis, AppConfig.RedisConnectTimeout); err != nil {
+            fatal("connecting to redis", err)
+        }
+    }
+    ProductCache, err = newCache(AppConfig, Redis)
+    if err != nil {
+        fatal("setting up cache", err)
+    }
+    Rates = newCachingRateProvider(dbRateProvider{}, AppConfig.RateCacheTTL)
+
+    // Events are recorded for every configured sink, for the servers to dispatch.
+    Events, err = newEventPublisher(AppConfig)
+    if err != nil {
+        fatal("setting up event publisher", err)
+    }
+    if index := newOpenSearchIndex(context.Background(), AppConfig); index != nil {
+        Searches = index
+    }
+    OutboxSinks = newOutboxSinks(Events, Searches)
+
+    return func() {
+        if Events != nil {
+            Events.Close()
+        }
+        if Redis != nil {
+            Redis.Close()
+        }
+        DB.Close()
+    }
+}
+
+// runMigrate applies or reverts migrations.
+func runMigrate(args []string) {
+    if len(args) == 0 || (args[0] != "up" && args[0] != "down") {
+        fmt.Fprintln(os.Stderr, "Usage: product-api "+migrateUsage)
+        os.Exit(2)
+    }
+    direction := args[0]
+    setUpCommand(args[1:])
+
+    db, err := openDB(AppConfig)
+    if err != nil {
+        fatal("opening database", err)
+    }
+    defer db.Close()
+
+    if direction == "up" {
+        if err := migrate(context.Background(), db); err != nil {
+            fatal("migrating database", err)
+        }
+        return
+    }
+    version, err := migrateDown(context.Background(), db)
+    if err != nil {
+        fatal("reverting migration", err)
+    }
+    if version == "" {
+        fmt.Println("No migration is applied.")
+    }
+}
+
+// runSeed fills the catalog of a tenant, from a CSV file or with fake products, and prints
+// what it stored.
+func runSeed(args []string) {
+    var path, tenantSlug, categories string
+    var minPrice, maxPrice string
+    opts := DefaultSeedOptions(0)
+    setUpCommand(args, func(flags *flag.FlagSet) {
+        flags.StringVar(&path, "file", "", "CSV file of products to upsert, with the columns of POST /products/import")
+        flags.IntVar(&opts.Count, "count", 0, "number of fake products to add instead of reading a file")
+        flags.StringVar(&categories, "categories", "", "comma-separated categories of the fake products, created if missing (default: a set of common ones)")
+        flags.StringVar(&opts.PriceDistribution, "price-distribution", opts.PriceDistribution, "distribution of fake prices: uniform, normal or lognormal")
+        flags.StringVar(&minPrice, "min-price", opts.MinPrice.String(), "lowest fake price")
+        flags.StringVar(&maxPrice, "max-price", opts.MaxPrice.String(), "highest fake price")
+        flags.Int64Var(&opts.Seed, "random-seed", 0, "seed that makes fake products the same on every run; 0 for random ones")
+        flags.StringVar(&tenantSlug, "tenant", defaultTenantSlug, "slug of the tenant whose catalog is seeded")
+    })
+    if (path == "") == (opts.Count == 0) {
+        fmt.Fprintln(os.Stderr, "Usage: product-api "+seedUsage)
+        os.Exit(2)
+    }
+    if categories != "" {
+        for _, category := range strings.Split(categories, ",") {
+            opts.Categories = append(opts.Categories, strings.TrimSpace(category))
+        }
+    }
+    var err error
+    if opts.MinPrice, err = ParseMoney(minPrice); err != nil {
+        fatal("parsing -min-price", err)
+    }
+    if opts.MaxPrice, err = ParseMoney(maxPrice); err != nil {
+        fatal("parsing -max-price", err)
+    }
+    if path == "" {
+        if err := opts.Validate(); err != nil {
+            fatal("checking seed options", err)
+        }
+    }
+
+    closeStore := openStore()
+    defer closeStore()
+    ctx := context.WithValue(context.Background(), principalContextKey, cliPrincipal)
+    tenant, err := resolveTenant(ctx, tenantSlug)
+    if err != nil {
+        fatal("finding tenant", err)
+    }
+    ctx = withTenant(ctx, tenant)
+
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    if path != "" {
+        file, err := os.Open(path)
+        if err != nil {
+            fatal("opening seed file", err)
+        }
+        defer file.Close()
+        report, err := importCSV(ctx, file)
+        if err != nil {
+            fatal("seeding products", err)
+        }
+        enc.Encode(report)
+        return
+    }
+
+    if err := ensureSeedCategories(ctx, opts); err != nil {
+        fatal("creating categories", err)
+    }
+    stored, err := SeedProducts(ctx, Repo, opts)
+    if err != nil {
+        fatal("seeding products", err)
+    }
+    if err := invalidateProductLists(ctx); err != nil {
+        logContextError(ctx, err)
+    }
+    enc.Encode(ImportReport{Inserted: stored, Rejected: []ImportRowError{}})
+}
+
+// runLoadgen drives load against a running instance until the duration is up or it is
+// interrupted, and prints the report. It reads the address and tenant header of the
+// instance from the environment, like serve, but needs no other configuration.
+func runLoadgen(args []string) {
+    if err := loadDotEnv(".env"); err != nil {
+        fatal("loading configuration", err)
+    }
+    var paths, apiKey, token, tenantHeader, tenantSlug string
+    opts := LoadOptions{Header: http.Header{}}
+    addr := getEnv("ADDR", ":8080")
+    if strings.HasPrefix(addr, ":") {
+        addr = "localhost" + addr
+    }
+    flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+    flags.StringVar(&opts.BaseURL, "url", "http://"+addr, "base URL of the instance")
+    flags.StringVar(&paths, "paths", "/products", "comma-separated paths to request in turn")
+    flags.IntVar(&opts.Rate, "rate", 50, "requests started per second")
+    flags.DurationVar(&opts.Duration, "duration", 30*time.Second, "how long to send requests for")
+    flags.IntVar(&opts.MaxInFlight, "max-in-flight", 100, "requests awaiting a response beyond which new ones are dropped")
+    flags.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "timeout of each request")
+    flags.StringVar(&apiKey, "api-key", "", "API key to send in the X-API-Key header")
+    flags.StringVar(&token, "token", "", "bearer token to send in the Authorization header")
+    flags.StringVar(&tenantHeader, "tenant-header", getEnv("TENANT_HEADER", "X-Tenant"), "header the tenant is sent in")
+    flags.StringVar(&tenantSlug, "tenant", "", "slug of the tenant to send in the tenant header")
+    flags.Parse(args)
+    for _, path := range strings.Split(paths, ",") {
+        if path = strings.TrimSpace(path); path != "" {
+            opts.Paths = append(opts.Paths, path)
+        }
+    }
+    if apiKey != "" {
+        opts.Header.Set("X-API-Key", apiKey)
+    }
+    if token != "" {
+        opts.Header.Set("Authorization", "Bearer "+token)
+    }
+    if tenantSlug != "" {
+        opts.Header.Set(tenantHeader, tenantSlug)
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    report, err := runLoad(ctx, opts)
+    if err != nil {
+        fatal("generating load", err)
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    enc.Encode(report)
+}
+
+// runRoutes prints the method and path of every route, sorted by path.
+func runRoutes(args []string) {
+    setUpCommand(args)
+
+    type route struct {
+        path, methods string
+    }
+    var routes []route
+    err := newVersionRouter(AppConfig).Walk(func(r *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+        path, err := r.GetPathTemplate()
+        if err != nil {
+            // A route matching on something other than its path, like a prefix handler.
+            return nil
+        }
+        methods, err := r.GetMethods()
+        if err != nil {
+            methods = []string{"*"}
+        }
+        routes = append(routes, route{path: path, methods: strings.Join(methods, ",")})
+        return nil
+    })
+    if err != nil {
+        fatal("listing routes", err)
+    }
+    sort.SliceStable(routes, func(i, j int) bool { return routes[i].path < routes[j].path })
+    for _, r := range routes {
+        fmt.Printf("%-8s %s\n", r.methods, r.path)
+    }
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+    "compress/flate"
+    "compress/gzip"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/andybalholm/brotli"
+)
+
+// compressionEncodings are the content codings responses can be compressed with, most
+// preferred first: brotli compresses JSON best, and gzip is understood everywhere.
+var compressionEncodings = []string{"br", "gzip", "deflate"}
+
+// compressibleTypes are the content types worth compressing. Everything else, like images,
+// is either already compressed or too small to matter.
+var compressibleTypes = map[string]bool{
+    mediaJSON:              true,
+    mediaXML:               true,
+    mediaMsgpack:           true,
+    "text/csv":             true,
+    "application/x-ndjson": true,
+    "text/plain":           true,
+    "text/html":            true,
+}
+
+// compressor is a compressing writer that can be flushed mid-stream and reset for reuse.
+type compressor interface {
+    io.WriteCloser
+    Flush() error
+    Reset(w io.Writer)
+}
+
+// compressorPools keep compressors for reuse per encoding, as they are costly to allocate.
+var compressorPools = map[string]*sync.Pool{
+    "br": {New: func() interface{} { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }},
+    "gzip": {New: func() interface{} {
+        cw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+        return cw
+    }},
+    "deflate": {New: func() interface{} {
+        cw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+        return cw
+    }},
+}
+
+// compressionMiddleware compresses responses for clients that accept it, with the best
+// encoding their Accept-Encoding allows. Only compressible content types are compressed,
+// and only bodies of at least cfg.CompressionMinSize bytes, or bodies that are flushed
+// before reaching it, like streamed exports. Responses that already have a
+// Content-Encoding are left alone.
+func compressionMiddleware(cfg Config) Middleware {
+    return func(next http.Handler) http.Handler {
+        if !cfg.CompressionEnabled {
+            return next
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+            if encoding == "" || r.Method == http.MethodHead {
+                next.ServeHTTP(w, r)
+                return
+            }
+            cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: cfg.CompressionMinSize}
+            defer cw.Close()
+            next.ServeHTTP(cw, r)
+        })
+    }
+}
+
+// negotiateEncoding returns the encoding in compressionEncodings that acceptEncoding gives
+// the highest quality, or "" if it accepts none of them.
+func negotiateEncoding(acceptEncoding string) string {
+    qualities := map[string]float64{}
+    for _, part := range strings.Split(acceptEncoding, ",") {
+        name, params, _ := strings.Cut(part, ";")
+        quality := 1.0
+        if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            var err error
+            if quality, err = strconv.ParseFloat(q, 64); err != nil {
+                quality = 0
+            }
+        }
+        qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+    }
+
+    best, bestQuality := "", 0.0
+    for _, encoding := range compressionEncodings {
+        quality, ok := qualities[encoding]
+        if !ok {
+            quality = qualities["*"]
+        }
+        if quality > bestQuality {
+            best, bestQuality = encoding, quality
+        }
+    }
+    return best
+}
+
+// compressWriter holds back the status and the start of the body until it knows whether to
+// compress: when the body reaches minSize, is flushed, or ends.
+type compressWriter struct {
+    http.ResponseWriter
+    encoding string
+    minSize  int
+
+    status     int
+    buf        []byte
+    started    bool
+    compressor compressor
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+    if cw.started {
+        cw.ResponseWriter.WriteHeader(status)
+        return
+    }
+    if cw.status == 0 {
+        cw.status = status
+    }
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+    if cw.started {
+        if cw.compressor != nil {
+            return cw.compressor.Write(b)
+        }
+        return cw.ResponseWriter.Write(b)
+    }
+    cw.buf = append(cw.buf, b...)
+    if len(cw.buf) >= cw.minSize {
+        if err := cw.start(true); err != nil {
+            return 0, err
+        }
+    }
+    return len(b), nil
+}
+
+// Flush starts the response, compressed if the content type allows, since a body that is
+// flushed is being streamed and its size is unknown, and sends what has been written.
+func (cw *compressWriter) Flush() {
+    if !cw.started {
+        cw.start(true)
+    }
+    if cw.compressor != nil {
+        cw.compressor.Flush()
+    }
+    http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+    return cw.ResponseWriter
+}
+
+// Close finishes the response: a body still held back is sent uncompressed, being too
+// small to be worth it, and a compressed body is completed.
+func (cw *compressWriter) Close() error {
+    if !cw.started {
+        if cw.status == 0 && len(cw.buf) == 0 {
+            // The handler wrote nothing; leave the response to the server.
+            return nil
+        }
+        if err := cw.start(false); err != nil {
+            return err
+        }
+    }
+    if cw.compressor == nil {
+        return nil
+    }
+    err := cw.compressor.Close()
+    compressorPools[cw.encoding].Put(cw.compressor)
+    cw.compressor = nil
+    return err
+}
+
+// start writes the status and headers, compressing the body if large is set and the
+// response is compressible, then writes the held-back start of the body.
+func (cw *compressWriter) start(large bool) error {
+    cw.started = true
+    if cw.status == 0 {
+        cw.status = http.StatusOK
+    }
+    header := cw.Header()
+    contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+    if compressibleTypes[contentType] && header.Get("Content-Encoding") == "" {
+        // Whether the body is compressed depends on Accept-Encoding, even if this one isn't.
+        header.Add("Vary", "Accept-Encoding")
+        if large && cw.status >= http.StatusOK && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+            header.Set("Content-Encoding", cw.encoding)
+            header.Del("Content-Length")
+            cw.compressor = compressorPools[cw.encoding].Get().(compressor)
+            cw.compressor.Reset(cw.ResponseWriter)
+        }
+    }
+    cw.ResponseWriter.WriteHeader(cw.status)
+
+    buf := cw.buf
+    cw.buf = nil
+    if len(buf) == 0 {
+        return nil
+    }
+    var err error
+    if cw.compressor != nil {
+        _, err = cw.compressor.Write(buf)
+    } else {
+        _, err = cw.ResponseWriter.Write(buf)
+    }
+    return err
+}
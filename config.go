@@ -0,0 +1,666 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Config holds the settings the server reads at startup.
+type Config struct {
+    Addr     string
+    LogLevel string
+    // GRPCAddr is the address the gRPC API listens on. Empty disables it.
+    GRPCAddr string
+    // Timeouts of the HTTP server, and how long shutdown waits for in-flight requests.
+    ReadTimeout     time.Duration
+    WriteTimeout    time.Duration
+    IdleTimeout     time.Duration
+    ShutdownTimeout time.Duration
+    // CompressionEnabled compresses compressible responses of at least CompressionMinSize
+    // bytes for clients that accept it.
+    CompressionEnabled bool
+    CompressionMinSize int
+    // MaxBodySize is the largest request body accepted, in bytes. CSV imports may be up to
+    // MaxImportSize, and image uploads MaxImageSize plus MaxBodySize for the rest of the form.
+    MaxBodySize   int64
+    MaxImportSize int64
+    // The API is served over HTTPS with the certificate in TLSCertFile and TLSKeyFile, or
+    // with certificates for AutocertDomains obtained from Let's Encrypt and kept in
+    // AutocertCacheDir. HTTPRedirectAddr is then a plain HTTP listener that redirects to
+    // HTTPS and answers the ACME HTTP-01 challenges; autocert needs it on port 80.
+    TLSCertFile      string
+    TLSKeyFile       string
+    AutocertDomains  []string
+    AutocertEmail    string
+    AutocertCacheDir string
+    HTTPRedirectAddr string
+
+    // TracingEnabled turns on OpenTelemetry tracing of requests and SQL queries, sampling
+    // TraceSampleRatio of new traces and reporting them as ServiceName.
+    TracingEnabled   bool
+    ServiceName      string
+    TraceSampleRatio float64
+
+    DatabaseURL string
+    // DatabaseReplicaURL, if set, is a read replica that takes the reads of GET requests
+    // while it is up, which is checked every DBReplicaCheckInterval.
+    DatabaseReplicaURL     string
+    DBReplicaCheckInterval time.Duration
+    // Connection pool settings. DBConnectTimeout is how long startup keeps retrying to
+    // reach the database; zero means try once and fail fast.
+    DBMaxOpenConns    int
+    DBMaxIdleConns    int
+    DBConnMaxLifetime time.Duration
+    DBConnectTimeout  time.Duration
+    // DBQueryTimeout bounds how long a request may spend waiting on the database before it
+    // is answered with 504 Gateway Timeout. Zero disables the limit.
+    DBQueryTimeout time.Duration
+    // DBStatementCacheSize is how many prepared statements of hot queries are kept per
+    // connection pool. Zero turns prepared statements off, as needed behind a pooler like
+    // PgBouncer in transaction mode.
+    DBStatementCacheSize int
+    // A connection attempt that can't reach the database is retried DBConnectRetries times
+    // with backoff. After DBBreakerThreshold such failures in a row, connecting stops for
+    // DBBreakerCooldown and requests fail fast with 503s; zero turns the breaker off.
+    DBConnectRetries   int
+    DBBreakerThreshold int
+    DBBreakerCooldown  time.Duration
+    // AutoMigrate applies pending schema migrations at startup. MigrateOnly, set by the
+    // -migrate flag, applies them and exits without serving, like "migrate up".
+    AutoMigrate bool
+    MigrateOnly bool
+    // PriceSchedulerInterval is how often scheduled price changes that have come due are
+    // applied. Zero disables the scheduler on this instance.
+    PriceSchedulerInterval time.Duration
+    // PublisherInterval is how often drafts whose publish_at has passed are published. Zero
+    // disables the publisher on this instance.
+    PublisherInterval time.Duration
+    // CartTTL is how long a cart is kept after it last changed. CartExpiryInterval is how
+    // often expired carts are deleted; zero disables the deletion on this instance.
+    CartTTL            time.Duration
+    CartExpiryInterval time.Duration
+    // WebhookDispatchInterval is how often due webhook deliveries are sent; zero disables
+    // sending on this instance. A delivery is given up after WebhookMaxAttempts attempts,
+    // each of which may take up to WebhookTimeout.
+    WebhookDispatchInterval time.Duration
+    WebhookMaxAttempts      int
+    WebhookTimeout          time.Duration
+    // EventBroker selects where product events are published: "" for nowhere, "kafka", to
+    // KafkaTopic on KafkaBrokers, or "nats", under NATSSubjectPrefix on the server at NATSURL.
+    EventBroker       string
+    KafkaBrokers      []string
+    KafkaTopic        string
+    NATSURL           string
+    NATSSubjectPrefix string
+    // OpenSearchURL, if set, is an OpenSearch or Elasticsearch cluster product searches go
+    // to, with products indexed in OpenSearchIndex from the outbox. Otherwise searches use
+    // Postgres full-text search.
+    OpenSearchURL      string
+    OpenSearchIndex    string
+    OpenSearchUsername string
+    OpenSearchPassword string
+    // Events are written to an outbox table along with the change, and dispatched from it to
+    // webhooks, the broker and the search index every OutboxPollInterval.
+    OutboxPollInterval time.Duration
+    // IdempotencyTTL is how long a response stored under an Idempotency-Key is replayed.
+    // IdempotencyBackend selects where the responses are stored: "postgres" or "redis".
+    IdempotencyTTL     time.Duration
+    IdempotencyBackend string
+
+    AdminToken string
+    // JWTSecret signs the tokens issued by /login, which are valid for JWTTTL.
+    JWTSecret string
+    JWTTTL    time.Duration
+    // PublicReads lets anonymous clients use the endpoints that only need the viewer role.
+    PublicReads bool
+    // CORSAllowedOrigins lists the origins, like https://admin.example.com, that browsers may
+    // call the API from, or "*" for any; when it is empty, CORS is off. CORSAllowCredentials
+    // lets browsers send cookies and credentials along, which needs explicit origins.
+    // Preflight responses are cached by browsers for CORSMaxAge.
+    CORSAllowedOrigins   []string
+    CORSAllowedMethods   []string
+    CORSAllowedHeaders   []string
+    CORSExposedHeaders   []string
+    CORSAllowCredentials bool
+    CORSMaxAge           time.Duration
+
+    MaintenanceEnabled bool
+    // ReadOnly forces read-only mode on, refusing changes with 503s and ReadOnlyMessage;
+    // otherwise /admin/read-only turns it on and off. Every instance checks the mode every
+    // ReadOnlyRefreshInterval. Refused requests are told to retry after ReadOnlyRetryAfter.
+    ReadOnly                bool
+    ReadOnlyMessage         string
+    ReadOnlyRefreshInterval time.Duration
+    ReadOnlyRetryAfter      time.Duration
+    // DocsEnabled serves Swagger UI for the OpenAPI document at /docs.
+    DocsEnabled bool
+    // MetricsEnabled serves Prometheus metrics at /metrics.
+    MetricsEnabled    bool
+    AllowedImageHosts []string
+
+    // BaseCurrency is the currency products are priced in unless they name another one, and
+    // the currency exchange rates are quoted against. When ExchangeRatesURL is set, rates
+    // are fetched from it every ExchangeRatesRefreshInterval. RateCacheTTL is how long a
+    // rate is kept in memory before it is looked up again.
+    BaseCurrency                 string
+    ExchangeRatesURL             string
+    ExchangeRatesRefreshInterval time.Duration
+    RateCacheTTL                 time.Duration
+
+    // ImageStorage selects where uploaded product images are kept: "local", in ImageDir, or
+    // "s3", in an S3-compatible bucket. ImageBaseURL is where clients fetch them from; when
+    // empty, local images are served by this server and S3 images from the bucket itself.
+    ImageStorage      string
+    ImageDir          string
+    ImageBaseURL      string
+    S3Endpoint        string
+    S3Bucket          string
+    S3Region          string
+    S3AccessKeyID     string
+    S3SecretAccessKey string
+    // MaxImageSize is the largest image upload accepted, in bytes. A thumbnail is generated
+    // for each of ThumbnailSizes, the length of the longest edge in pixels.
+    MaxImageSize   int64
+    ThumbnailSizes []int
+
+    // CorrelationIDHeader is the header used to receive and echo correlation IDs, and
+    // TrustCorrelationID controls whether an incoming one is kept or always replaced.
+    CorrelationIDHeader string
+    TrustCorrelationID  bool
+
+    // RateLimitRPS is how many requests per second each client may make on average, in
+    // bursts of up to RateLimitBurst. Zero disables rate limiting. RateLimitBackend selects
+    // where the buckets are kept: "memory" or "redis".
+    RateLimitRPS     float64
+    RateLimitBurst   int
+    RateLimitBackend string
+    // TrustForwardedFor makes the client IP come from X-Forwarded-For, which is only safe
+    // behind a proxy that sets it.
+    TrustForwardedFor bool
+
+    // CacheBackend selects the product read cache: "none", "memory" or "redis". The memory
+    // cache holds at most CacheMaxEntries products and listing pages. RedisURL is the server
+    // of every backend set to "redis", which startup waits up to RedisConnectTimeout for.
+    CacheBackend        string
+    RedisURL            string
+    RedisConnectTimeout time.Duration
+    ProductCacheTTL     time.Duration
+    CacheMaxEntries     int
+    // HTTPCacheMaxAge is the max-age clients and proxies are told they may reuse product
+    // reads for. Zero makes them revalidate every time.
+    HTTPCacheMaxAge time.Duration
+
+    // ListMaxInitialCapacity caps how many rows getProducts allocates room for up front.
+    ListMaxInitialCapacity int
+    // DefaultPageSize is the page size used when a listing has no limit parameter, and
+    // MaxPageSize is the most a client may ask for.
+    DefaultPageSize int
+    MaxPageSize     int
+    // ListScanBudget is how long getProducts may spend on a page. Counting may take half of
+    // it before the total is estimated instead, and scanning rows stops with a partial page
+    // when it runs out. Zero disables the budget.
+    ListScanBudget time.Duration
+    // EmptyListNotFound makes every list endpoint answer 404 instead of 200 with an empty
+    // array when nothing matches, including a page of reviews. A barcode lookup always
+    // answers 404 when no product has the code.
+    EmptyListNotFound bool
+    // SearchFuzzyThreshold is the trigram similarity, between 0 and 1, a product name needs
+    // to match a fuzzy search.
+    SearchFuzzyThreshold float64
+
+    // TenancyEnabled serves a separate catalog per tenant. A request is for the tenant named
+    // by TenantHeader, else the one whose subdomain of TenantBaseDomain it was sent to, else
+    // the default tenant.
+    TenancyEnabled   bool
+    TenantHeader     string
+    TenantBaseDomain string
+}
+
+// AppConfig is a global variable that holds the loaded configuration.
+var AppConfig Config
+
+// loadConfig reads the configuration. Command-line flags take precedence over environment
+// variables, which take precedence over a .env file in the working directory, which takes
+// precedence over the defaults. The result is validated before it is returned. A command
+// taking flags of its own adds them to the flag set through commandFlags.
+func loadConfig(args []string, commandFlags ...func(flags *flag.FlagSet)) (Config, error) {
+    if err := loadDotEnv(".env"); err != nil {
+        return Config{}, err
+    }
+
+    cfg := Config{
+        Addr:            getEnv("ADDR", ":8080"),
+        LogLevel:        getEnv("LOG_LEVEL", "info"),
+        GRPCAddr:        getEnv("GRPC_ADDR", ":9090"),
+        ReadTimeout:     getEnvDuration("READ_TIMEOUT", 10*time.Second),
+        WriteTimeout:    getEnvDuration("WRITE_TIMEOUT", 30*time.Second),
+        IdleTimeout:     getEnvDuration("IDLE_TIMEOUT", 120*time.Second),
+        ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+
+        CompressionEnabled: getEnvBool("COMPRESSION_ENABLED", true),
+        MaxBodySize:        int64(getEnvInt("MAX_BODY_SIZE", 1<<20)),
+        MaxImportSize:      int64(getEnvInt("MAX_IMPORT_SIZE", 32<<20)),
+        CompressionMinSize: getEnvInt("COMPRESSION_MIN_SIZE", 1024),
+
+        TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+        TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+        AutocertDomains:  getEnvList("AUTOCERT_DOMAINS", nil),
+        AutocertEmail:    os.Getenv("AUTOCERT_EMAIL"),
+        AutocertCacheDir: getEnv("AUTOCERT_CACHE_DIR", "certs"),
+        HTTPRedirectAddr: os.Getenv("HTTP_REDIRECT_ADDR"),
+
+        TracingEnabled:   getEnvBool("OTEL_ENABLED", false),
+        ServiceName:      getEnv("OTEL_SERVICE_NAME", "product-api"),
+        TraceSampleRatio: getEnvFloat("OTEL_TRACE_SAMPLE_RATIO", 1),
+
+        DatabaseURL:             os.Getenv("DATABASE_URL"),
+        DatabaseReplicaURL:      os.Getenv("DATABASE_REPLICA_URL"),
+        DBReplicaCheckInterval:  getEnvDuration("DB_REPLICA_CHECK_INTERVAL", 5*time.Second),
+        DBMaxOpenConns:          getEnvInt("DB_MAX_OPEN_CONNS", 25),
+        DBMaxIdleConns:          getEnvInt("DB_MAX_IDLE_CONNS", 25),
+        DBConnMaxLifetime:       getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+        DBConnectTimeout:        getEnvDuration("DB_CONNECT_TIMEOUT", 30*time.Second),
+        DBQueryTimeout:          getEnvDuration("DB_QUERY_TIMEOUT", 5*time.Second),
+        DBStatementCacheSize:    getEnvInt("DB_STATEMENT_CACHE_SIZE", 64),
+        DBConnectRetries:        getEnvInt("DB_CONNECT_RETRIES", 2),
+        DBBreakerThreshold:      getEnvInt("DB_BREAKER_THRESHOLD", 5),
+        DBBreakerCooldown:       getEnvDuration("DB_BREAKER_COOLDOWN", 10*time.Second),
+        IdempotencyTTL:          getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+        IdempotencyBackend:      getEnv("IDEMPOTENCY_BACKEND", "postgres"),
+        PriceSchedulerInterval:  getEnvDuration("PRICE_SCHEDULER_INTERVAL", time.Minute),
+        PublisherInterval:       getEnvDuration("PUBLISHER_INTERVAL", time.Minute),
+        CartTTL:                 getEnvDuration("CART_TTL", 72*time.Hour),
+        CartExpiryInterval:      getEnvDuration("CART_EXPIRY_INTERVAL", 10*time.Minute),
+        WebhookDispatchInterval: getEnvDuration("WEBHOOK_DISPATCH_INTERVAL", 5*time.Second),
+        WebhookMaxAttempts:      getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+        WebhookTimeout:          getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+        EventBroker:             os.Getenv("EVENT_BROKER"),
+        KafkaBrokers:            getEnvList("KAFKA_BROKERS", []string{"localhost:9092"}),
+        KafkaTopic:              getEnv("KAFKA_TOPIC", "product-events"),
+        NATSURL:                 getEnv("NATS_URL", "nats://localhost:4222"),
+        NATSSubjectPrefix:       getEnv("NATS_SUBJECT_PREFIX", "catalog"),
+        OpenSearchURL:           os.Getenv("OPENSEARCH_URL"),
+        OpenSearchIndex:         getEnv("OPENSEARCH_INDEX", "products"),
+        OpenSearchUsername:      os.Getenv("OPENSEARCH_USERNAME"),
+        OpenSearchPassword:      os.Getenv("OPENSEARCH_PASSWORD"),
+        OutboxPollInterval:      getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+        AutoMigrate:             getEnvBool("AUTO_MIGRATE", true),
+
+        AdminToken:  os.Getenv("ADMIN_TOKEN"),
+        JWTSecret:   os.Getenv("JWT_SECRET"),
+        JWTTTL:      getEnvDuration("JWT_TTL", 12*time.Hour),
+        PublicReads: getEnvBool("PUBLIC_READS", false),
+
+        CORSAllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS", nil),
+        CORSAllowedMethods:   getEnvList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+        CORSAllowedHeaders:   getEnvList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "X-API-Key", "Idempotency-Key", "If-Match", "If-None-Match", "If-Modified-Since", "API-Version"}),
+        CORSExposedHeaders:   getEnvList("CORS_EXPOSED_HEADERS", []string{"ETag", "Location", "Retry-After", "X-Request-ID", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Idempotent-Replayed", "API-Version", "Deprecation", "Sunset", "Link", "Warning"}),
+        CORSAllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+        CORSMaxAge:           getEnvDuration("CORS_MAX_AGE", 10*time.Minute),
+
+        MaintenanceEnabled:      getEnvBool("MAINTENANCE_ENDPOINTS_ENABLED", false),
+        ReadOnly:                getEnvBool("READ_ONLY", false),
+        ReadOnlyMessage:         os.Getenv("READ_ONLY_MESSAGE"),
+        ReadOnlyRefreshInterval: getEnvDuration("READ_ONLY_REFRESH_INTERVAL", 5*time.Second),
+        ReadOnlyRetryAfter:      getEnvDuration("READ_ONLY_RETRY_AFTER", time.Minute),
+        DocsEnabled:             getEnvBool("DOCS_ENABLED", false),
+        MetricsEnabled:          getEnvBool("METRICS_ENABLED", false),
+        AllowedImageHosts:       getEnvList("ALLOWED_IMAGE_HOSTS", []string{"*"}),
+
+        BaseCurrency:                 strings.ToUpper(getEnv("BASE_CURRENCY", "USD")),
+        ExchangeRatesURL:             os.Getenv("EXCHANGE_RATES_URL"),
+        ExchangeRatesRefreshInterval: getEnvDuration("EXCHANGE_RATES_REFRESH_INTERVAL", time.Hour),
+        RateCacheTTL:                 getEnvDuration("RATE_CACHE_TTL", time.Hour),
+
+        ImageStorage:      getEnv("IMAGE_STORAGE", "local"),
+        ImageDir:          getEnv("IMAGE_DIR", "data/images"),
+        ImageBaseURL:      os.Getenv("IMAGE_BASE_URL"),
+        S3Endpoint:        os.Getenv("S3_ENDPOINT"),
+        S3Bucket:          os.Getenv("S3_BUCKET"),
+        S3Region:          getEnv("S3_REGION", "us-east-1"),
+        S3AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+        S3SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+        MaxImageSize:      int64(getEnvInt("MAX_IMAGE_SIZE", 10<<20)),
+        ThumbnailSizes:    getEnvIntList("THUMBNAIL_SIZES", []int{150, 600}),
+
+        CorrelationIDHeader: getEnv("CORRELATION_ID_HEADER", "X-Correlation-ID"),
+        TrustCorrelationID:  getEnvBool("TRUST_CORRELATION_ID", true),
+
+        RateLimitRPS:      getEnvFloat("RATE_LIMIT_RPS", 0),
+        RateLimitBurst:    getEnvInt("RATE_LIMIT_BURST", 20),
+        RateLimitBackend:  getEnv("RATE_LIMIT_BACKEND", "memory"),
+        TrustForwardedFor: getEnvBool("TRUST_FORWARDED_FOR", false),
+
+        CacheBackend:        getEnv("CACHE_BACKEND", "memory"),
+        RedisURL:            getEnv("REDIS_URL", "redis://localhost:6379/0"),
+        RedisConnectTimeout: getEnvDuration("REDIS_CONNECT_TIMEOUT", 30*time.Second),
+        ProductCacheTTL:     getEnvDuration("PRODUCT_CACHE_TTL", time.Minute),
+        CacheMaxEntries:     getEnvInt("CACHE_MAX_ENTRIES", 10000),
+        HTTPCacheMaxAge:     getEnvDuration("HTTP_CACHE_MAX_AGE", 0),
+
+        ListMaxInitialCapacity: getEnvInt("LIST_MAX_INITIAL_CAPACITY", 64),
+        DefaultPageSize:        getEnvInt("DEFAULT_PAGE_SIZE", 50),
+        MaxPageSize:            getEnvInt("MAX_PAGE_SIZE", 100),
+        ListScanBudget:         getEnvDuration("LIST_SCAN_BUDGET", 2*time.Second),
+        EmptyListNotFound:      getEnvBool("EMPTY_LIST_NOT_FOUND", false),
+        SearchFuzzyThreshold:   getEnvFloat("SEARCH_FUZZY_THRESHOLD", 0.3),
+
+        TenancyEnabled:   getEnvBool("MULTI_TENANCY_ENABLED", false),
+        TenantHeader:     getEnv("TENANT_HEADER", "X-Tenant"),
+        TenantBaseDomain: strings.ToLower(os.Getenv("TENANT_BASE_DOMAIN")),
+    }
+
+    // The settings most often changed per run can also be given as flags.
+    flags := flag.NewFlagSet("product-api", flag.ContinueOnError)
+    flags.StringVar(&cfg.Addr, "addr", cfg.Addr, "address to listen on")
+    flags.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "address for the gRPC API to listen on, empty to disable")
+    flags.StringVar(&cfg.DatabaseURL, "database-url", cfg.DatabaseURL, "Postgres connection string")
+    flags.StringVar(&cfg.DatabaseReplicaURL, "database-replica-url", cfg.DatabaseReplicaURL, "Postgres connection string of a read replica, empty for none")
+    flags.DurationVar(&cfg.DBConnectTimeout, "db-connect-timeout", cfg.DBConnectTimeout, "how long to wait for the database at startup")
+    flags.DurationVar(&cfg.DBQueryTimeout, "db-query-timeout", cfg.DBQueryTimeout, "how long a request may wait on the database")
+    flags.BoolVar(&cfg.MigrateOnly, "migrate", false, "apply pending database migrations and exit")
+    flags.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level: debug, info, warn or error")
+    flags.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "maximum duration for reading a request")
+    flags.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "maximum duration for writing a response")
+    flags.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "how long keep-alive connections stay open")
+    flags.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+    for _, addFlags := range commandFlags {
+        addFlags(flags)
+    }
+    if err := flags.Parse(args); err != nil {
+        return Config{}, err
+    }
+
+    return cfg, cfg.Validate()
+}
+
+// TLSEnabled reports whether the API is served over HTTPS.
+func (cfg Config) TLSEnabled() bool {
+    return cfg.TLSCertFile != "" || len(cfg.AutocertDomains) > 0
+}
+
+// Validate checks that required settings are present and that the others make sense.
+func (cfg Config) Validate() error {
+    var problems []string
+    if cfg.DatabaseURL == "" {
+        problems = append(problems, "DATABASE_URL is required")
+    }
+    if cfg.DBMaxOpenConns < 1 || cfg.DBMaxIdleConns < 0 || cfg.DBMaxIdleConns > cfg.DBMaxOpenConns {
+        problems = append(problems, "DB_MAX_OPEN_CONNS must be positive and DB_MAX_IDLE_CONNS between 0 and it")
+    }
+    if cfg.DBQueryTimeout < 0 {
+        problems = append(problems, "DB_QUERY_TIMEOUT must not be negative")
+    }
+    if cfg.DBStatementCacheSize < 0 {
+        problems = append(problems, "DB_STATEMENT_CACHE_SIZE must not be negative")
+    }
+    if cfg.DBConnectRetries < 0 {
+        problems = append(problems, "DB_CONNECT_RETRIES must not be negative")
+    }
+    if cfg.DBBreakerThreshold < 0 || (cfg.DBBreakerThreshold > 0 && cfg.DBBreakerCooldown <= 0) {
+        problems = append(problems, "DB_BREAKER_THRESHOLD must not be negative, and DB_BREAKER_COOLDOWN must be positive when it is set")
+    }
+    if cfg.DatabaseReplicaURL != "" && cfg.DBReplicaCheckInterval <= 0 {
+        problems = append(problems, "DB_REPLICA_CHECK_INTERVAL must be positive when DATABASE_REPLICA_URL is set")
+    }
+    if cfg.IdempotencyTTL <= 0 {
+        problems = append(problems, "IDEMPOTENCY_TTL must be positive")
+    }
+    if cfg.PriceSchedulerInterval < 0 {
+        problems = append(problems, "PRICE_SCHEDULER_INTERVAL must not be negative")
+    }
+    if cfg.ReadOnlyRefreshInterval <= 0 {
+        problems = append(problems, "READ_ONLY_REFRESH_INTERVAL must be positive")
+    }
+    if cfg.ReadOnlyRetryAfter <= 0 {
+        problems = append(problems, "READ_ONLY_RETRY_AFTER must be positive")
+    }
+    if cfg.PublisherInterval < 0 {
+        problems = append(problems, "PUBLISHER_INTERVAL must not be negative")
+    }
+    if cfg.CartTTL <= 0 || cfg.CartExpiryInterval < 0 {
+        problems = append(problems, "CART_TTL must be positive and CART_EXPIRY_INTERVAL must not be negative")
+    }
+    if cfg.WebhookDispatchInterval < 0 || cfg.WebhookMaxAttempts < 1 || cfg.WebhookTimeout <= 0 || cfg.WebhookTimeout >= webhookLease {
+        problems = append(problems, "WEBHOOK_DISPATCH_INTERVAL must not be negative, WEBHOOK_MAX_ATTEMPTS must be positive and WEBHOOK_TIMEOUT must be positive and under a minute")
+    }
+    if !validCurrency(cfg.BaseCurrency) {
+        problems = append(problems, "BASE_CURRENCY must be an ISO 4217 currency code")
+    }
+    if cfg.ExchangeRatesRefreshInterval <= 0 || cfg.RateCacheTTL <= 0 {
+        problems = append(problems, "EXCHANGE_RATES_REFRESH_INTERVAL and RATE_CACHE_TTL must be positive")
+    }
+    switch cfg.EventBroker {
+    case "", "kafka", "nats":
+    default:
+        problems = append(problems, "EVENT_BROKER must be empty or one of kafka or nats")
+    }
+    if cfg.EventBroker == "kafka" && (len(cfg.KafkaBrokers) == 0 || cfg.KafkaTopic == "") {
+        problems = append(problems, "KAFKA_BROKERS and KAFKA_TOPIC are required when EVENT_BROKER is kafka")
+    }
+    if cfg.OpenSearchURL != "" && (cfg.OpenSearchIndex == "" || cfg.OpenSearchIndex != strings.ToLower(cfg.OpenSearchIndex)) {
+        problems = append(problems, "OPENSEARCH_INDEX must be a lower-case name when OPENSEARCH_URL is set")
+    }
+    if cfg.OutboxPollInterval <= 0 {
+        problems = append(problems, "OUTBOX_POLL_INTERVAL must be positive")
+    }
+    for _, origin := range cfg.CORSAllowedOrigins {
+        if origin == "*" {
+            if cfg.CORSAllowCredentials {
+                problems = append(problems, "CORS_ALLOWED_ORIGINS must list origins rather than * when CORS_ALLOW_CREDENTIALS is set")
+            }
+        } else if !validOrigin(origin) {
+            problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS has %q, which is not an origin like https://example.com", origin))
+        }
+    }
+    if cfg.CORSMaxAge < 0 {
+        problems = append(problems, "CORS_MAX_AGE must not be negative")
+    }
+    if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+        problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    }
+    if len(cfg.AutocertDomains) > 0 {
+        if cfg.TLSCertFile != "" {
+            problems = append(problems, "AUTOCERT_DOMAINS and TLS_CERT_FILE cannot both be set")
+        }
+        if cfg.HTTPRedirectAddr == "" {
+            problems = append(problems, "HTTP_REDIRECT_ADDR is required for AUTOCERT_DOMAINS, to answer HTTP-01 challenges")
+        }
+    }
+    if cfg.HTTPRedirectAddr != "" && !cfg.TLSEnabled() {
+        problems = append(problems, "HTTP_REDIRECT_ADDR needs TLS_CERT_FILE or AUTOCERT_DOMAINS")
+    }
+    if cfg.CompressionMinSize < 0 {
+        problems = append(problems, "COMPRESSION_MIN_SIZE must not be negative")
+    }
+    if cfg.Addr == "" {
+        problems = append(problems, "ADDR must not be empty")
+    }
+    switch cfg.LogLevel {
+    case "debug", "info", "warn", "error":
+    default:
+        problems = append(problems, "LOG_LEVEL must be one of debug, info, warn or error")
+    }
+    if cfg.ReadTimeout <= 0 || cfg.WriteTimeout <= 0 || cfg.IdleTimeout <= 0 || cfg.ShutdownTimeout <= 0 {
+        problems = append(problems, "server timeouts must be positive")
+    }
+    switch cfg.CacheBackend {
+    case "", "none", "memory", "redis":
+    default:
+        problems = append(problems, "CACHE_BACKEND must be one of none, memory or redis")
+    }
+    if cfg.RedisConnectTimeout < 0 {
+        problems = append(problems, "REDIS_CONNECT_TIMEOUT must not be negative")
+    }
+    if cfg.CacheMaxEntries < 1 || cfg.HTTPCacheMaxAge < 0 {
+        problems = append(problems, "CACHE_MAX_ENTRIES must be positive and HTTP_CACHE_MAX_AGE not negative")
+    }
+    if cfg.RateLimitRPS < 0 || (cfg.RateLimitRPS > 0 && cfg.RateLimitBurst < 1) {
+        problems = append(problems, "RATE_LIMIT_RPS must not be negative and RATE_LIMIT_BURST must be positive")
+    }
+    switch cfg.RateLimitBackend {
+    case "", "memory", "redis":
+    default:
+        problems = append(problems, "RATE_LIMIT_BACKEND must be one of memory or redis")
+    }
+    switch cfg.IdempotencyBackend {
+    case "", "postgres", "redis":
+    default:
+        problems = append(problems, "IDEMPOTENCY_BACKEND must be one of postgres or redis")
+    }
+    switch cfg.ImageStorage {
+    case "local":
+    case "s3":
+        if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+            problems = append(problems, "S3_ENDPOINT and S3_BUCKET are required when IMAGE_STORAGE is s3")
+        }
+    default:
+        problems = append(problems, "IMAGE_STORAGE must be one of local or s3")
+    }
+    if cfg.MaxBodySize < 1 || cfg.MaxImportSize < 1 {
+        problems = append(problems, "MAX_BODY_SIZE and MAX_IMPORT_SIZE must be positive")
+    }
+    if cfg.MaxImageSize < 1 {
+        problems = append(problems, "MAX_IMAGE_SIZE must be positive")
+    }
+    for _, size := range cfg.ThumbnailSizes {
+        if size < 1 {
+            problems = append(problems, "THUMBNAIL_SIZES must be positive")
+            break
+        }
+    }
+    if cfg.SearchFuzzyThreshold <= 0 || cfg.SearchFuzzyThreshold > 1 {
+        problems = append(problems, "SEARCH_FUZZY_THRESHOLD must be above 0 and at most 1")
+    }
+    if cfg.DefaultPageSize < 1 || cfg.MaxPageSize < cfg.DefaultPageSize {
+        problems = append(problems, "DEFAULT_PAGE_SIZE must be positive and not above MAX_PAGE_SIZE")
+    }
+    if len(problems) > 0 {
+        return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+// dotEnvKeys are the environment variables loadDotEnv set, which it sets again from the file
+// as it is on the next load, so that a configuration reload sees changes to it.
+var dotEnvKeys = map[string]bool{}
+
+// loadDotEnv sets environment variables from KEY=VALUE lines in the file at path, without
+// overriding variables that were set otherwise. A missing file is not an error.
+func loadDotEnv(path string) error {
+    for key := range dotEnvKeys {
+        os.Unsetenv(key)
+    }
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+        if !ok {
+            continue
+        }
+        key = strings.TrimSpace(key)
+        value = strings.Trim(strings.TrimSpace(value), `"'`)
+        if _, set := os.LookupEnv(key); !set {
+            os.Setenv(key, value)
+            dotEnvKeys[key] = true
+        }
+    }
+    return scanner.Err()
+}
+
+// getEnv returns the value of the environment variable or the given default if it is unset.
+func getEnv(key, def string) string {
+    if value, ok := os.LookupEnv(key); ok {
+        return value
+    }
+    return def
+}
+
+// getEnvBool returns the boolean value of the environment variable or the given default
+// if it is unset or cannot be parsed.
+func getEnvBool(key string, def bool) bool {
+    value, err := strconv.ParseBool(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return value
+}
+
+// getEnvInt returns the integer value of the environment variable or the given default
+// if it is unset or cannot be parsed.
+func getEnvInt(key string, def int) int {
+    value, err := strconv.Atoi(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return value
+}
+
+// getEnvFloat returns the float value of the environment variable or the given default
+// if it is unset or cannot be parsed.
+func getEnvFloat(key string, def float64) float64 {
+    value, err := strconv.ParseFloat(os.Getenv(key), 64)
+    if err != nil {
+        return def
+    }
+    return value
+}
+
+// getEnvDuration returns the duration value of the environment variable or the given default
+// if it is unset or cannot be parsed.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+    value, err := time.ParseDuration(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return value
+}
+
+// getEnvList returns the comma-separated values of the environment variable or the given
+// default if it is unset or empty.
+func getEnvList(key string, def []string) []string {
+    var values []string
+    for _, value := range strings.Split(os.Getenv(key), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            values = append(values, value)
+        }
+    }
+    if len(values) == 0 {
+        return def
+    }
+    return values
+}
+
+// getEnvIntList returns the comma-separated integer values of the environment variable or
+// the given default if it is unset, empty or any value cannot be parsed.
+func getEnvIntList(key string, def []int) []int {
+    var values []int
+    for _, value := range getEnvList(key, nil) {
+        n, err := strconv.Atoi(value)
+        if err != nil {
+            return def
+        }
+        values = append(values, n)
+    }
+    if len(values) == 0 {
+        return def
+    }
+    return values
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// corsMiddleware returns middleware that lets browsers on the origins in
+// cfg.CORSAllowedOrigins call the API. It answers preflight requests itself and adds the
+// CORS headers to the other responses. Requests from other origins get no CORS headers, so
+// browsers keep them from reading the response. With no origins configured it does nothing.
+func corsMiddleware(cfg Config) Middleware {
+    if len(cfg.CORSAllowedOrigins) == 0 {
+        return func(next http.Handler) http.Handler { return next }
+    }
+
+    allowAny := false
+    origins := map[string]bool{}
+    for _, origin := range cfg.CORSAllowedOrigins {
+        if origin == "*" {
+            allowAny = true
+        }
+        origins[strings.ToLower(origin)] = true
+    }
+    // The correlation ID and tenant headers are configurable, so they are added here rather
+    // than listed in the defaults.
+    allowedMethods := strings.Join(cfg.CORSAllowedMethods, ", ")
+    allowedHeaders := strings.Join(cfg.CORSAllowedHeaders, ", ") + ", " + cfg.CorrelationIDHeader
+    if cfg.TenancyEnabled {
+        allowedHeaders += ", " + cfg.TenantHeader
+    }
+    exposedHeaders := strings.Join(cfg.CORSExposedHeaders, ", ") + ", " + cfg.CorrelationIDHeader
+    maxAge := strconv.Itoa(int(cfg.CORSMaxAge.Seconds()))
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            origin := r.Header.Get("Origin")
+            if !allowAny {
+                // The response depends on the origin, so caches must not share it between them.
+                w.Header().Add("Vary", "Origin")
+            }
+            if origin == "" || !allowAny && !origins[strings.ToLower(origin)] {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            if allowAny {
+                w.Header().Set("Access-Control-Allow-Origin", "*")
+            } else {
+                w.Header().Set("Access-Control-Allow-Origin", origin)
+            }
+            if cfg.CORSAllowCredentials {
+                w.Header().Set("Access-Control-Allow-Credentials", "true")
+            }
+
+            if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+                // A preflight request: say what the actual request may do and stop here.
+                w.Header().Add("Vary", "Access-Control-Request-Method")
+                w.Header().Add("Vary", "Access-Control-Request-Headers")
+                w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+                w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+                if cfg.CORSMaxAge > 0 {
+                    w.Header().Set("Access-Control-Max-Age", maxAge)
+                }
+                w.WriteHeader(http.StatusNoContent)
+                return
+            }
+
+            w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// validOrigin reports whether origin is a bare http or https origin, like
+// https://admin.example.com or http://localhost:3000, with no path.
+func validOrigin(origin string) bool {
+    u, err := url.Parse(origin)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+        u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
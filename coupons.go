@@ -0,0 +1,467 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// maxCouponItems is the most lines a coupon can be checked against, and the most products
+// and categories a coupon can list.
+const maxCouponItems = 100
+
+// couponCodePattern is what a coupon code looks like once upper-cased, like "SUMMER-25".
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9-]{2,31}$`)
+
+// Reasons a coupon can't be used, with the messages a redemption is refused with.
+const (
+    couponExpired       = "expired"
+    couponUsedUp        = "usage_limit_reached"
+    couponNotApplicable = "not_applicable"
+)
+
+var couponReasonMessages = map[string]string{
+    couponExpired:       "Coupon has expired.",
+    couponUsedUp:        "Coupon has been used up.",
+    couponNotApplicable: "Coupon doesn't apply to any of the items.",
+}
+
+// Coupon is a code that discounts the products it lists and those of the categories it
+// lists, or every product if it lists neither, until ExpiresAt or until it has been
+// redeemed UsageLimit times. Either may be left open. Coupons can't be changed once they are
+// handed out; they are deleted and created anew instead.
+type Coupon struct {
+    ID   int    `json:"id" xml:"id"`
+    Code string `json:"code" xml:"code"`
+    Discount
+    ProductIDs []int      `json:"product_ids" xml:"product_ids>product_id"`
+    Categories []string   `json:"categories" xml:"categories>category"`
+    ExpiresAt  *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+    UsageLimit *int       `json:"usage_limit,omitempty" xml:"usage_limit,omitempty"`
+    UsageCount int        `json:"usage_count" xml:"usage_count"`
+    CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+}
+
+// Validate checks the fields of a coupon payload.
+func (c Coupon) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if !couponCodePattern.MatchString(c.Code) {
+        errs.add("code", "must be 3 to 32 letters, digits and hyphens")
+    }
+    c.Discount.validate(&errs)
+    if len(c.ProductIDs) > maxCouponItems {
+        errs.add("product_ids", "must have at most 100 products")
+    }
+    for _, id := range c.ProductIDs {
+        if id < 1 {
+            errs.add("product_ids", "must be positive")
+            break
+        }
+    }
+    if len(c.Categories) > maxCouponItems {
+        errs.add("categories", "must have at most 100 categories")
+    }
+    for _, category := range c.Categories {
+        if category == "" {
+            errs.add("categories", "must not be empty")
+            break
+        }
+    }
+    if c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now()) {
+        errs.add("expires_at", "must be in the future")
+    }
+    if c.UsageLimit != nil && *c.UsageLimit < 1 {
+        errs.add("usage_limit", "must be positive")
+    }
+    return errs
+}
+
+// appliesTo reports whether the coupon discounts a cart line.
+func (c Coupon) appliesTo(item CartItem) bool {
+    if len(c.ProductIDs) == 0 && len(c.Categories) == 0 {
+        return true
+    }
+    for _, id := range c.ProductIDs {
+        if id == item.ProductID {
+            return true
+        }
+    }
+    for _, category := range c.Categories {
+        if category == item.Category {
+            return true
+        }
+    }
+    return false
+}
+
+// CouponRequest is the body of a request checking or redeeming a coupon against a cart, or
+// against items priced in currency, which defaults to the base currency.
+type CouponRequest struct {
+    Code     string            `json:"code" xml:"code"`
+    CartID   int               `json:"cart_id,omitempty" xml:"cart_id,omitempty"`
+    Items    []CartItemRequest `json:"items,omitempty" xml:"items>item,omitempty"`
+    Currency string            `json:"currency,omitempty" xml:"currency,omitempty"`
+}
+
+// Validate checks the fields of a coupon request.
+func (req CouponRequest) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if req.Code == "" {
+        errs.add("code", "is required")
+    }
+    switch {
+    case req.CartID != 0 && len(req.Items) > 0:
+        errs.add("items", "must be left out with cart_id")
+    case req.CartID < 0:
+        errs.add("cart_id", "must be positive")
+    case req.CartID == 0 && len(req.Items) == 0:
+        errs.add("items", "are required without cart_id")
+    case len(req.Items) > maxCouponItems:
+        errs.add("items", "must have at most 100 items")
+    }
+    for i, item := range req.Items {
+        if item.ProductID < 1 {
+            errs.add(fmt.Sprintf("items[%d].product_id", i), "must be positive")
+        }
+        for _, e := range validateCartQuantity(item.Quantity) {
+            errs.add(fmt.Sprintf("items[%d].%s", i, e.Field), e.Message)
+        }
+    }
+    if req.CartID == 0 {
+        validateCurrency(&errs, req.Currency)
+    } else if req.Currency != "" {
+        errs.add("currency", "must be left out with cart_id")
+    }
+    return errs
+}
+
+// ValidateRedemption checks the fields of a request redeeming a coupon. Coupons are only
+// redeemed against a cart of the caller, so items and a currency can't be given.
+func (req CouponRequest) ValidateRedemption() ValidationErrors {
+    var errs ValidationErrors
+    if req.Code == "" {
+        errs.add("code", "is required")
+    }
+    if req.CartID == 0 {
+        errs.add("cart_id", "is required")
+    } else if req.CartID < 0 {
+        errs.add("cart_id", "must be positive")
+    }
+    if len(req.Items) > 0 {
+        errs.add("items", "must be left out; coupons are redeemed against a cart")
+    }
+    if req.Currency != "" {
+        errs.add("currency", "must be left out; coupons are redeemed against a cart")
+    }
+    return errs
+}
+
+// CouponCheck is what a coupon would take off a cart. Valid is false, with the Reason and
+// a Message, if the coupon can't be used; the totals are then those without it. Only the
+// lines of the cart that are ok count.
+type CouponCheck struct {
+    Code             string `json:"code" xml:"code"`
+    CouponID         int    `json:"coupon_id" xml:"coupon_id"`
+    Valid            bool   `json:"valid" xml:"valid"`
+    Reason           string `json:"reason,omitempty" xml:"reason,omitempty"`
+    Message          string `json:"message,omitempty" xml:"message,omitempty"`
+    Currency         string `json:"currency" xml:"currency"`
+    Subtotal         Money  `json:"subtotal" xml:"subtotal"`
+    EligibleSubtotal Money  `json:"eligible_subtotal" xml:"eligible_subtotal"`
+    Discount         Money  `json:"discount" xml:"discount"`
+    Total            Money  `json:"total" xml:"total"`
+    // Redeemed is set when the coupon was redeemed with the check.
+    Redeemed bool `json:"redeemed,omitempty" xml:"redeemed,omitempty"`
+}
+
+// check works out what the coupon takes off a priced cart at now. It returns
+// errUnsupportedCurrency if a fixed discount can't be converted to the cart's currency.
+func (c Coupon) check(ctx context.Context, cart Cart, now time.Time) (CouponCheck, error) {
+    check := CouponCheck{Code: c.Code, CouponID: c.ID, Currency: cart.Currency, Subtotal: cart.Subtotal, Total: cart.Subtotal}
+    switch {
+    case c.ExpiresAt != nil && !c.ExpiresAt.After(now):
+        check.Reason = couponExpired
+    case c.UsageLimit != nil && c.UsageCount >= *c.UsageLimit:
+        check.Reason = couponUsedUp
+    }
+    for _, item := range cart.Items {
+        if item.Status == cartItemOK && c.appliesTo(item) {
+            check.EligibleSubtotal += item.LineTotal
+        }
+    }
+    if check.Reason == "" && check.EligibleSubtotal == 0 {
+        check.Reason = couponNotApplicable
+    }
+    if check.Reason != "" {
+        check.Message = couponReasonMessages[check.Reason]
+        return check, nil
+    }
+
+    off, err := c.off(ctx, check.EligibleSubtotal, cart.Currency)
+    if err != nil {
+        return CouponCheck{}, err
+    }
+    check.Valid, check.Discount, check.Total = true, off, check.Subtotal-off
+    return check, nil
+}
+
+// couponColumns are the columns scanned by scanCoupon, in order.
+const couponColumns = "id, code, type, value, COALESCE(currency, ''), product_ids, categories, expires_at, usage_limit, usage_count, created_at"
+
+// scanCoupon reads the couponColumns of one row through scan.
+func scanCoupon(scan func(dest ...interface{}) error) (Coupon, error) {
+    var c Coupon
+    var productIDs pq.Int64Array
+    var categories pq.StringArray
+    err := scan(&c.ID, &c.Code, &c.Type, &c.Value, &c.Currency, &productIDs, &categories, &c.ExpiresAt, &c.UsageLimit, &c.UsageCount, &c.CreatedAt)
+    c.ProductIDs = make([]int, len(productIDs))
+    for i, id := range productIDs {
+        c.ProductIDs[i] = int(id)
+    }
+    c.Categories = []string(categories)
+    if c.Categories == nil {
+        c.Categories = []string{}
+    }
+    return c, err
+}
+
+// couponIDFromRequest returns the coupon ID from the {id} path variable.
+func couponIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// getCoupons lists every coupon, by ID.
+func getCoupons(w http.ResponseWriter, r *http.Request) {
+    coupons := []Coupon{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        coupon, err := scanCoupon(scan)
+        if err != nil {
+            return err
+        }
+        coupons = append(coupons, coupon)
+        return nil
+    }, "SELECT "+couponColumns+" FROM coupons ORDER BY id")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve coupons.")
+        return
+    }
+    if respondEmptyList(w, r, len(coupons)) {
+        return
+    }
+
+    // If everything went well, return the coupons in the response body.
+    respond(w, r, http.StatusOK, coupons)
+}
+
+// getCoupon retrieves a single coupon with how often it was redeemed.
+func getCoupon(w http.ResponseWriter, r *http.Request) {
+    couponID, err := couponIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid coupon ID.")
+        return
+    }
+
+    coupon, err := scanCoupon(Reads.ScanRow(r.Context(), "SELECT "+couponColumns+" FROM coupons WHERE id = $1", couponID))
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeCouponNotFound, "Coupon not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve coupon.")
+        return
+    }
+
+    // If everything went well, return the coupon in the response body.
+    respond(w, r, http.StatusOK, coupon)
+}
+
+// createCoupon creates a coupon from a body like {"code": "SUMMER-25", "type": "percentage",
+// "value": 25, "categories": ["Shoes"], "usage_limit": 500}. Codes are upper-cased.
+func createCoupon(w http.ResponseWriter, r *http.Request) {
+    var coupon Coupon
+    if err := decodeBody(r, &coupon); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    coupon.Code = strings.ToUpper(strings.TrimSpace(coupon.Code))
+    coupon.normalize()
+    if coupon.ProductIDs == nil {
+        coupon.ProductIDs = []int{}
+    }
+    if coupon.Categories == nil {
+        coupon.Categories = []string{}
+    }
+    for i, category := range coupon.Categories {
+        coupon.Categories[i] = strings.TrimSpace(category)
+    }
+    if errs := coupon.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+    coupon.UsageCount = 0
+
+    err := DB.QueryRowContext(r.Context(), `INSERT INTO coupons (code, type, value, currency, product_ids, categories, expires_at, usage_limit)
+        VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8) RETURNING id, created_at`,
+        coupon.Code, coupon.Type, coupon.Value, coupon.Currency, pq.Array(coupon.ProductIDs), pq.Array(coupon.Categories), coupon.ExpiresAt, coupon.UsageLimit).Scan(
+        &coupon.ID, &coupon.CreatedAt)
+    if isUniqueViolation(err) {
+        respondError(w, r, http.StatusConflict, codeCouponExists, "A coupon with this code already exists.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create coupon.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new coupon.
+    w.Header().Set("Location", "/coupons/"+strconv.Itoa(coupon.ID))
+    respond(w, r, http.StatusCreated, coupon)
+}
+
+// deleteCoupon deletes a coupon, so its code can't be used any more.
+func deleteCoupon(w http.ResponseWriter, r *http.Request) {
+    couponID, err := couponIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid coupon ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM coupons WHERE id = $1", couponID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete coupon.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete coupon.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeCouponNotFound, "Coupon not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCoupon reads a coupon request and works out what its coupon takes off its cart or
+// items; a request to redeem must name a cart, which has to be the caller's. If that can't
+// be done it writes the error response, or answers a failed lookup with message, and
+// reports false.
+func checkCoupon(w http.ResponseWriter, r *http.Request, redeem bool, message string) (CouponCheck, bool) {
+    var req CouponRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return CouponCheck{}, false
+    }
+    req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+    req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+    validate := req.ValidateRedemption
+    if !redeem {
+        if req.CartID == 0 && req.Currency == "" {
+            req.Currency = AppConfig.BaseCurrency
+        }
+        validate = req.Validate
+    }
+    if errs := validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return CouponCheck{}, false
+    }
+
+    // The items are priced like the lines of a cart, a product listed twice on one line.
+    cart := Cart{Currency: req.Currency}
+    if req.CartID != 0 {
+        var ok bool
+        if cart, ok = findCart(w, r, req.CartID, message); !ok {
+            return CouponCheck{}, false
+        }
+    } else {
+        lines := map[int]int{}
+        for _, item := range req.Items {
+            if i, ok := lines[item.ProductID]; ok {
+                cart.Items[i].Quantity += item.Quantity
+                continue
+            }
+            lines[item.ProductID] = len(cart.Items)
+            cart.Items = append(cart.Items, CartItem{ProductID: item.ProductID, Quantity: item.Quantity})
+        }
+    }
+    if err := priceCart(r.Context(), &cart); err != nil {
+        if err == errUnsupportedCurrency {
+            respondConversionError(w, r, err)
+        } else {
+            respondStoreError(w, r, err, message)
+        }
+        return CouponCheck{}, false
+    }
+
+    coupon, err := scanCoupon(DB.QueryRowContext(r.Context(), "SELECT "+couponColumns+" FROM coupons WHERE code = $1", req.Code).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeCouponNotFound, "Coupon not found.")
+        return CouponCheck{}, false
+    } else if err != nil {
+        respondStoreError(w, r, err, message)
+        return CouponCheck{}, false
+    }
+    check, err := coupon.check(r.Context(), cart, time.Now())
+    if err != nil {
+        respondConversionError(w, r, err)
+        return CouponCheck{}, false
+    }
+    return check, true
+}
+
+// validateCoupon reports what a coupon would take off a cart or items, from a body like
+// {"code": "SUMMER-25", "cart_id": 12} or {"code": "SUMMER-25", "items": [{"product_id": 7,
+// "quantity": 2}], "currency": "EUR"}. A coupon that can't be used is reported with
+// "valid": false and the reason. Nothing is redeemed.
+func validateCoupon(w http.ResponseWriter, r *http.Request) {
+    check, ok := checkCoupon(w, r, false, "Failed to validate coupon.")
+    if !ok {
+        return
+    }
+
+    // If everything went well, return the check in the response body.
+    respond(w, r, http.StatusOK, check)
+}
+
+// redeemCoupon redeems a coupon at checkout against a cart of the caller, from a body like
+// {"code": "SUMMER-25", "cart_id": 12}. Items can't be redeemed against, since the caller
+// could list anything. The usage count is only incremented while the coupon is unexpired
+// and under its limit, in one statement, so concurrent redemptions can't pass the limit.
+func redeemCoupon(w http.ResponseWriter, r *http.Request) {
+    if _, ok := principalFromContext(r.Context()); !ok {
+        respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Sign in to redeem a coupon.")
+        return
+    }
+    check, ok := checkCoupon(w, r, true, "Failed to redeem coupon.")
+    if !ok {
+        return
+    }
+    if !check.Valid {
+        respondError(w, r, http.StatusConflict, codeCouponNotRedeemable, check.Message)
+        return
+    }
+
+    var usageCount int
+    err := DB.QueryRowContext(r.Context(), `UPDATE coupons SET usage_count = usage_count + 1
+        WHERE id = $1 AND (expires_at IS NULL OR expires_at > now()) AND (usage_limit IS NULL OR usage_count < usage_limit)
+        RETURNING usage_count`, check.CouponID).Scan(&usageCount)
+    if err == sql.ErrNoRows {
+        // Another redemption used it up, or it expired or was deleted, since the check.
+        respondError(w, r, http.StatusConflict, codeCouponNotRedeemable, "Coupon can no longer be redeemed.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to redeem coupon.")
+        return
+    }
+
+    // If everything went well, return the redeemed discount in the response body.
+    check.Redeemed = true
+    respond(w, r, http.StatusOK, check)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestCouponHandlers(t *testing.T) {
+    coupon := map[string]string{"id": "1"}
+    summer := []driver.Value{int64(1), "SUMMER-25", discountPercentage, "25", "", "{}", "{}", nil, nil, int64(0), time.Unix(0, 0)}
+    found := answerRows(map[string][]driver.Value{"FROM coupons": summer})
+    tests := []handlerTest{
+        {name: "list", handler: getCoupons, target: "/coupons", answer: found, status: http.StatusOK},
+        {name: "get", handler: getCoupon, target: "/coupons/1", vars: coupon, answer: found, status: http.StatusOK},
+        {name: "get invalid id", handler: getCoupon, target: "/coupons/abc", vars: map[string]string{"id": "abc"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getCoupon, target: "/coupons/1", vars: coupon, status: http.StatusNotFound, code: codeCouponNotFound},
+        {name: "create", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": "summer-25", "type": "percentage", "value": 25}`,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO coupons": {int64(1), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": 25}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid code", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": "25%", "type": "percentage", "value": 25}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create invalid discount", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": "SUMMER-25", "type": "percentage", "value": 125}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create duplicate", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": "SUMMER-25", "type": "percentage", "value": 25}`,
+            answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeCouponExists},
+        {name: "delete", handler: deleteCoupon, method: "DELETE", target: "/coupons/1", vars: coupon, answer: answerRows(map[string][]driver.Value{"DELETE FROM coupons": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deleteCoupon, method: "DELETE", target: "/coupons/abc", vars: map[string]string{"id": "abc"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteCoupon, method: "DELETE", target: "/coupons/1", vars: coupon, status: http.StatusNotFound, code: codeCouponNotFound},
+        {name: "validate", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "summer-25", "items": [{"product_id": 1, "quantity": 1}]}`, answer: found, status: http.StatusOK},
+        {name: "validate malformed", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25", "items": {}}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "validate without items", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "validate missing coupon", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25", "items": [{"product_id": 1, "quantity": 1}]}`,
+            status: http.StatusNotFound, code: codeCouponNotFound},
+        {name: "validate missing cart", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25", "cart_id": 1}`, answer: found,
+            status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "redeem anonymous", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, anonymous: true, setup: createCarts,
+            status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "redeem without cart", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "items": [{"product_id": 1, "quantity": 1}]}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "redeem missing cart", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, answer: found,
+            status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "redeem missing coupon", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, setup: createCarts,
+            status: http.StatusNotFound, code: codeCouponNotFound},
+        // The memory repository keeps no stock, so the lamp in the cart can't be bought.
+        {name: "redeem not applicable", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, setup: createCarts, answer: found,
+            status: http.StatusConflict, code: codeCouponNotRedeemable},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getCoupons, target: "/coupons"},
+        handlerTest{name: "get", handler: getCoupon, target: "/coupons/1", vars: coupon},
+        handlerTest{name: "create", handler: createCoupon, method: "POST", target: "/coupons", body: `{"code": "SUMMER-25", "type": "percentage", "value": 25}`},
+        handlerTest{name: "delete", handler: deleteCoupon, method: "DELETE", target: "/coupons/1", vars: coupon},
+        handlerTest{name: "validate", handler: validateCoupon, method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25", "items": [{"product_id": 1, "quantity": 1}]}`},
+        handlerTest{name: "redeem", handler: redeemCoupon, method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, setup: createCarts},
+    ))
+}
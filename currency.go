@@ -0,0 +1,479 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math"
+    "net/http"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// currencyPattern matches an ISO 4217 currency code.
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// errUnsupportedCurrency is returned when there is no exchange rate for a currency.
+var errUnsupportedCurrency = errors.New("unsupported currency")
+
+// Rates is a global variable that holds the exchange rates prices are converted with.
+var Rates RateProvider
+
+// CurrencyPrice is the price of a product in one currency, set explicitly rather than
+// converted from its own price.
+type CurrencyPrice struct {
+    ProductID int       `json:"product_id"`
+    Currency  string    `json:"currency"`
+    Price     Money     `json:"price"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExchangeRate is how many units of Currency one unit of the base currency buys.
+type ExchangeRate struct {
+    Currency  string    `json:"currency"`
+    Rate      float64   `json:"rate"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExchangeRates is the response body of getExchangeRates.
+type ExchangeRates struct {
+    Base  string         `json:"base"`
+    Rates []ExchangeRate `json:"rates"`
+}
+
+// RateProvider looks up the exchange rate for converting an amount from one currency to another.
+type RateProvider interface {
+    Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+// cachedRate is an exchange rate together with the time it was fetched.
+type cachedRate struct {
+    rate      float64
+    fetchedAt time.Time
+}
+
+// CachingRateProvider is a RateProvider that keeps rates from another provider in memory
+// for a configurable TTL. When a refresh fails, it falls back to the stale rate if it has one.
+type CachingRateProvider struct {
+    provider RateProvider
+    ttl      time.Duration
+    now      func() time.Time
+
+    mu    sync.Mutex
+    rates map[string]cachedRate
+}
+
+// newCachingRateProvider wraps provider in an in-memory cache with the given TTL.
+func newCachingRateProvider(provider RateProvider, ttl time.Duration) *CachingRateProvider {
+    return &CachingRateProvider{
+        provider: provider,
+        ttl:      ttl,
+        now:      time.Now,
+        rates:    make(map[string]cachedRate),
+    }
+}
+
+// Rate returns the cached rate if it is still fresh, otherwise it refreshes it from the
+// underlying provider.
+func (c *CachingRateProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+    key := strings.ToUpper(from) + "/" + strings.ToUpper(to)
+
+    c.mu.Lock()
+    cached, ok := c.rates[key]
+    c.mu.Unlock()
+    if ok && c.now().Sub(cached.fetchedAt) < c.ttl {
+        return cached.rate, nil
+    }
+
+    rate, err := c.provider.Rate(ctx, from, to)
+    if err != nil {
+        if ok {
+            // Serving a stale rate is better than failing the request outright.
+            slog.Warn("refreshing exchange rate failed, using stale rate",
+                "pair", key, "fetched_at", cached.fetchedAt, "error", err)
+            return cached.rate, nil
+        }
+        return 0, err
+    }
+
+    c.mu.Lock()
+    c.rates[key] = cachedRate{rate: rate, fetchedAt: c.now()}
+    c.mu.Unlock()
+    return rate, nil
+}
+
+// Clear forgets every cached rate, so the next lookups go to the underlying provider.
+func (c *CachingRateProvider) Clear() {
+    c.mu.Lock()
+    c.rates = make(map[string]cachedRate)
+    c.mu.Unlock()
+}
+
+// dbRateProvider is a RateProvider reading the exchange_rates table, which holds the rate
+// of every currency against the base currency.
+type dbRateProvider struct{}
+
+func (dbRateProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+    fromRate, err := baseRate(ctx, from)
+    if err != nil {
+        return 0, err
+    }
+    toRate, err := baseRate(ctx, to)
+    if err != nil {
+        return 0, err
+    }
+    return toRate / fromRate, nil
+}
+
+// baseRate returns how many units of currency one unit of the base currency buys.
+func baseRate(ctx context.Context, currency string) (float64, error) {
+    if currency == AppConfig.BaseCurrency {
+        return 1, nil
+    }
+    var rate float64
+    err := Reads.QueryRowScan(ctx, []interface{}{&rate}, "SELECT rate FROM exchange_rates WHERE currency = $1", currency)
+    if err == sql.ErrNoRows {
+        return 0, errUnsupportedCurrency
+    }
+    return rate, err
+}
+
+// validCurrency reports whether code is an ISO 4217 currency code.
+func validCurrency(code string) bool {
+    return currencyPattern.MatchString(code)
+}
+
+// defaultCurrency prices product in the base currency if it names no currency of its own.
+func defaultCurrency(product *Product) {
+    if product.Currency == "" {
+        product.Currency = AppConfig.BaseCurrency
+    }
+}
+
+// requestedCurrency returns the currency asked for with ?currency=, upper-cased, or "" if
+// prices should stay in each product's own currency. The returned error message is
+// suitable for a 400 Bad Request response.
+func requestedCurrency(r *http.Request) (string, error) {
+    currency := strings.ToUpper(r.URL.Query().Get("currency"))
+    if currency != "" && !validCurrency(currency) {
+        return "", errors.New("Invalid currency.")
+    }
+    return currency, nil
+}
+
+// convertPrices prices products in currency. A price set explicitly for the currency is
+// used as it is; any other price is converted with Rates. It returns errUnsupportedCurrency
+// if a price can't be converted.
+func convertPrices(ctx context.Context, products []Product, currency string) error {
+    var ids []int64
+    for _, p := range products {
+        if p.Currency != currency {
+            ids = append(ids, int64(p.ID))
+        }
+    }
+    if len(ids) == 0 {
+        return nil
+    }
+
+    explicit := make(map[int]Money)
+    err := queryRows(ctx, func(scan func(dest ...interface{}) error) error {
+        var id int
+        var price Money
+        if err := scan(&id, &price); err != nil {
+            return err
+        }
+        explicit[id] = price
+        return nil
+    }, "SELECT product_id, price FROM product_prices WHERE currency = $1 AND product_id = ANY($2)", currency, pq.Array(ids))
+    if err != nil {
+        return err
+    }
+
+    for i := range products {
+        p := &products[i]
+        if p.Currency == currency {
+            continue
+        }
+        if price, ok := explicit[p.ID]; ok {
+            p.Price, p.Currency = price, currency
+            continue
+        }
+        rate, err := Rates.Rate(ctx, p.Currency, currency)
+        if err != nil {
+            return err
+        }
+        p.Price, p.Currency = p.Price.Mul(rate), currency
+    }
+    return nil
+}
+
+// convertVariantPrices converts the price overrides of variants from currency from to
+// currency to with Rates.
+func convertVariantPrices(ctx context.Context, variants []ProductVariant, from, to string) error {
+    for i := range variants {
+        if variants[i].Price == nil {
+            continue
+        }
+        rate, err := Rates.Rate(ctx, from, to)
+        if err != nil {
+            return err
+        }
+        price := variants[i].Price.Mul(rate)
+        variants[i].Price = &price
+    }
+    return nil
+}
+
+// respondConversionError answers a failed price conversion.
+func respondConversionError(w http.ResponseWriter, r *http.Request, err error) {
+    if err == errUnsupportedCurrency {
+        respondError(w, r, http.StatusBadRequest, codeUnsupportedCurrency, "Unsupported currency.")
+        return
+    }
+    respondStoreError(w, r, err, "Failed to convert prices.")
+}
+
+// getCurrencyPrices lists the prices set explicitly for a live product in other currencies.
+func getCurrencyPrices(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve prices.") {
+        return
+    }
+
+    prices := []CurrencyPrice{}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var p CurrencyPrice
+        if err := scan(&p.ProductID, &p.Currency, &p.Price, &p.UpdatedAt); err != nil {
+            return err
+        }
+        prices = append(prices, p)
+        return nil
+    }, "SELECT product_id, currency, price, updated_at FROM product_prices WHERE product_id = $1 ORDER BY currency", productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve prices.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(prices)) {
+        return
+    }
+
+    // If everything went well, return the prices in the response body.
+    respond(w, r, http.StatusOK, prices)
+}
+
+// setCurrencyPrice sets the price of a live product in the currency in the path from a
+// JSON body like {"price": 18.5}. Reads in that currency use it instead of converting.
+func setCurrencyPrice(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    currency := mux.Vars(r)["currency"]
+
+    var price CurrencyPrice
+    if err := decodeJSON(r, &price); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    validatePrice(&errs, price.Price)
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to set price.") {
+        return
+    }
+
+    // The insert selects nothing, and so returns no row, if the product isn't live.
+    price.ProductID, price.Currency = productID, currency
+    err = DB.QueryRowContext(r.Context(), `INSERT INTO product_prices (product_id, currency, price)
+        SELECT id, $2, $3 FROM products WHERE id = $1 AND deleted_at IS NULL
+        ON CONFLICT (product_id, currency) DO UPDATE SET price = EXCLUDED.price, updated_at = now()
+        RETURNING updated_at`, productID, currency, price.Price).Scan(&price.UpdatedAt)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to set price.")
+        return
+    }
+    // Listings in this currency may show the old price.
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the price in the response body.
+    respond(w, r, http.StatusOK, price)
+}
+
+// deleteCurrencyPrice removes the price of a product in the currency in the path, so that
+// reads in that currency convert the product's own price again.
+func deleteCurrencyPrice(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to delete price.") {
+        return
+    }
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM product_prices WHERE product_id = $1 AND currency = $2", productID, mux.Vars(r)["currency"])
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete price.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete price.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codePriceNotFound, "Price not found.")
+        return
+    }
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// getExchangeRates lists the known exchange rates against the base currency.
+func getExchangeRates(w http.ResponseWriter, r *http.Request) {
+    rates := ExchangeRates{Base: AppConfig.BaseCurrency, Rates: []ExchangeRate{}}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var rate ExchangeRate
+        if err := scan(&rate.Currency, &rate.Rate, &rate.UpdatedAt); err != nil {
+            return err
+        }
+        rates.Rates = append(rates.Rates, rate)
+        return nil
+    }, "SELECT currency, rate, updated_at FROM exchange_rates ORDER BY currency")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve exchange rates.")
+        return
+    }
+
+    // If everything went well, return the rates in the response body.
+    respond(w, r, http.StatusOK, rates)
+}
+
+// setExchangeRates stores exchange rates against the base currency from a JSON body like
+// {"EUR": 0.92, "GBP": 0.79}, for deployments without a rates feed.
+func setExchangeRates(w http.ResponseWriter, r *http.Request) {
+    var rates map[string]float64
+    if err := decodeJSON(r, &rates); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if errs := validateRates(rates); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    if err := storeExchangeRates(r.Context(), rates); err != nil {
+        respondStoreError(w, r, err, "Failed to store exchange rates.")
+        return
+    }
+    getExchangeRates(w, r)
+}
+
+// validateRates checks a set of exchange rates keyed by currency code.
+func validateRates(rates map[string]float64) ValidationErrors {
+    var errs ValidationErrors
+    for currency, rate := range rates {
+        if !validCurrency(currency) {
+            errs.add(currency, "must be an ISO 4217 currency code")
+        } else if currency == AppConfig.BaseCurrency {
+            errs.add(currency, "is the base currency")
+        } else if math.IsNaN(rate) || math.IsInf(rate, 0) || rate <= 0 {
+            errs.add(currency, "must be a positive rate")
+        }
+    }
+    return errs
+}
+
+// storeExchangeRates writes rates to the exchange_rates table in one transaction. The
+// converted prices in cached listings are stale afterwards, so listings are invalidated.
+func storeExchangeRates(ctx context.Context, rates map[string]float64) error {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    for currency, rate := range rates {
+        _, err := tx.ExecContext(ctx, `INSERT INTO exchange_rates (currency, rate) VALUES ($1, $2)
+            ON CONFLICT (currency) DO UPDATE SET rate = EXCLUDED.rate, updated_at = now()`, currency, rate)
+        if err != nil {
+            return err
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    if caching, ok := Rates.(*CachingRateProvider); ok {
+        caching.Clear()
+    }
+    if err := invalidateProductLists(ctx); err != nil {
+        logContextError(ctx, err)
+    }
+    return nil
+}
+
+// refreshExchangeRates fetches exchange rates against the base currency from url, which
+// must answer with a JSON object like {"rates": {"EUR": 0.92}}, and stores them. Rates for
+// the base currency itself and invalid entries are ignored. It runs as the exchange-rates
+// job.
+func refreshExchangeRates(ctx context.Context, url string) error {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("exchange rates feed answered %s", resp.Status)
+    }
+
+    var feed struct {
+        Rates map[string]float64 `json:"rates"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+        return err
+    }
+    rates := make(map[string]float64, len(feed.Rates))
+    for currency, rate := range feed.Rates {
+        if validateRates(map[string]float64{currency: rate}) == nil {
+            rates[currency] = rate
+        }
+    }
+    if len(rates) == 0 {
+        return errors.New("exchange rates feed returned no usable rates")
+    }
+    if err := storeExchangeRates(ctx, rates); err != nil {
+        return err
+    }
+    slog.Info("refreshed exchange rates", "count", len(rates))
+    return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// countingRateProvider returns rate for every pair, or err if set, and counts the lookups.
+type countingRateProvider struct {
+    rate  float64
+    err   error
+    calls int
+}
+
+func (p *countingRateProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+    p.calls++
+    return p.rate, p.err
+}
+
+func TestCachingRateProvider(t *testing.T) {
+    ctx := context.Background()
+    source := &countingRateProvider{rate: 0.9}
+    cache := newCachingRateProvider(source, time.Minute)
+    now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    cache.now = func() time.Time { return now }
+
+    rate := func() float64 {
+        t.Helper()
+        rate, err := cache.Rate(ctx, "usd", "EUR")
+        if err != nil {
+            t.Fatal(err)
+        }
+        return rate
+    }
+
+    // A fresh rate is served from the cache, whatever case the codes are in.
+    if got := rate(); got != 0.9 {
+        t.Fatalf("rate = %v, want 0.9", got)
+    }
+    source.rate = 0.95
+    now = now.Add(59 * time.Second)
+    if got := rate(); got != 0.9 || source.calls != 1 {
+        t.Fatalf("rate within the TTL = %v after %d lookups, want 0.9 after 1", got, source.calls)
+    }
+    if _, err := cache.Rate(ctx, "USD", "eur"); err != nil || source.calls != 1 {
+        t.Fatalf("the pair in another case was looked up again")
+    }
+
+    // Once the TTL has passed the rate is refreshed.
+    now = now.Add(time.Second)
+    if got := rate(); got != 0.95 || source.calls != 2 {
+        t.Fatalf("rate after the TTL = %v after %d lookups, want 0.95 after 2", got, source.calls)
+    }
+
+    // A failed refresh falls back to the stale rate.
+    source.err = errors.New("rates unavailable")
+    now = now.Add(time.Hour)
+    if got := rate(); got != 0.95 {
+        t.Fatalf("rate after a failed refresh = %v, want the stale 0.95", got)
+    }
+
+    // Without a stale rate the failure is returned.
+    cache.Clear()
+    if _, err := cache.Rate(ctx, "USD", "EUR"); err != source.err {
+        t.Fatalf("error = %v, want %v", err, source.err)
+    }
+}
+
+func TestCurrencyHandlers(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    missing := map[string]string{"id": "99"}
+    invalid := map[string]string{"id": "abc", "currency": "EUR"}
+    price := map[string]string{"id": "1", "currency": "EUR"}
+    tests := []handlerTest{
+        {name: "list", handler: getCurrencyPrices, target: "/products/1/currency-prices", vars: product,
+            answer: answerRows(map[string][]driver.Value{"FROM product_prices": {int64(1), "EUR", "18.50", time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "list invalid id", handler: getCurrencyPrices, target: "/products/abc/currency-prices", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "list missing product", handler: getCurrencyPrices, target: "/products/99/currency-prices", vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "set", handler: setCurrencyPrice, method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": 18.5}`, vars: price,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO product_prices": {time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "set invalid id", handler: setCurrencyPrice, method: "PUT", target: "/products/abc/currency-prices/EUR", body: `{"price": 18.5}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "set malformed", handler: setCurrencyPrice, method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": 1e3}`, vars: price, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "set negative", handler: setCurrencyPrice, method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": -18.5}`, vars: price, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set missing product", handler: setCurrencyPrice, method: "PUT", target: "/products/99/currency-prices/EUR", body: `{"price": 18.5}`, vars: map[string]string{"id": "99", "currency": "EUR"},
+            status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "delete", handler: deleteCurrencyPrice, method: "DELETE", target: "/products/1/currency-prices/EUR", vars: price,
+            answer: answerRows(map[string][]driver.Value{"DELETE FROM product_prices": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deleteCurrencyPrice, method: "DELETE", target: "/products/abc/currency-prices/EUR", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteCurrencyPrice, method: "DELETE", target: "/products/1/currency-prices/EUR", vars: price, status: http.StatusNotFound, code: codePriceNotFound},
+        {name: "rates", handler: getExchangeRates, target: "/exchange-rates", answer: answerRows(map[string][]driver.Value{"FROM exchange_rates": {"EUR", 0.92, time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "set rates", handler: setExchangeRates, method: "PUT", target: "/exchange-rates", body: `{"EUR": 0.92}`, status: http.StatusOK},
+        {name: "set rates malformed", handler: setExchangeRates, method: "PUT", target: "/exchange-rates", body: `{"EUR": "0.92"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "set rates negative", handler: setExchangeRates, method: "PUT", target: "/exchange-rates", body: `{"EUR": -0.92}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set rates of base currency", handler: setExchangeRates, method: "PUT", target: "/exchange-rates", body: `{"USD": 1}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getCurrencyPrices, target: "/products/1/currency-prices", vars: product},
+        handlerTest{name: "set", handler: setCurrencyPrice, method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": 18.5}`, vars: price},
+        handlerTest{name: "delete", handler: deleteCurrencyPrice, method: "DELETE", target: "/products/1/currency-prices/EUR", vars: price},
+        handlerTest{name: "rates", handler: getExchangeRates, target: "/exchange-rates"},
+        handlerTest{name: "set rates", handler: setExchangeRates, method: "PUT", target: "/exchange-rates", body: `{"EUR": 0.92}`},
+    ))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "time"
+)
+
+// listCursor identifies the last product of a page, so the listing can continue after it
+// with the same sort order.
+type listCursor struct {
+    Sort  string `json:"s"`
+    Value string `json:"v,omitempty"`
+    ID    int    `json:"id"`
+}
+
+// encodeCursor returns an opaque continuation cursor that resumes a listing sorted by
+// sortColumn after the given product.
+func encodeCursor(sortColumn string, after Product) string {
+    raw, _ := json.Marshal(listCursor{Sort: sortColumn, Value: sortKey(after, sortColumn), ID: after.ID})
+    return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor parses a cursor produced by encodeCursor.
+func decodeCursor(cursor string) (listCursor, error) {
+    var c listCursor
+    raw, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil {
+        return c, err
+    }
+    if err := json.Unmarshal(raw, &c); err != nil {
+        return c, err
+    }
+    if _, ok := sortColumns[c.Sort]; !ok || c.ID < 0 || !validSortKey(c.Sort, c.Value) {
+        return c, errors.New("invalid cursor")
+    }
+    return c, nil
+}
+
+// validSortKey reports whether value could have been returned by sortKey for sortColumn, so
+// that a tampered cursor is rejected rather than failing the query it is compared in.
+func validSortKey(sortColumn, value string) bool {
+    switch sortColumn {
+    case "id":
+        return value == ""
+    case "price":
+        _, err := ParseMoney(value)
+        return err == nil
+    case "created_at":
+        _, err := time.Parse(time.RFC3339Nano, value)
+        return err == nil
+    }
+    return validQueryText(value)
+}
+
+// sortKey returns the value of product in the given sort column, formatted so that
+// Postgres can compare it against the column again.
+func sortKey(product Product, sortColumn string) string {
+    switch sortColumn {
+    case "name":
+        return product.Name
+    case "category":
+        return product.Category
+    case "price":
+        return product.Price.String()
+    case "created_at":
+        return product.CreatedAt.Format(time.RFC3339Nano)
+    }
+    return ""
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "errors"
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// dbConnectBackoff is how long the first retry of a failed connection attempt waits. Each
+// further retry waits twice as long.
+const dbConnectBackoff = 100 * time.Millisecond
+
+// errDatabaseUnavailable is returned instead of connecting while the circuit breaker of the
+// pool is open.
+type errDatabaseUnavailable struct {
+    // RetryAfter is how long until the breaker lets a connection attempt through again.
+    RetryAfter time.Duration
+}
+
+func (e errDatabaseUnavailable) Error() string {
+    return "database is unavailable: circuit breaker is open"
+}
+
+// circuitBreaker stops a connection pool from connecting to a database that keeps failing,
+// so that requests fail fast with 503s instead of piling up on connection attempts while
+// Postgres fails over. After threshold transient failures in a row it opens for cooldown,
+// then lets a single attempt through: success closes it, failure opens it again.
+type circuitBreaker struct {
+    threshold int
+    cooldown  time.Duration
+
+    // clean is whether there is nothing to reset on success, so the common case takes no lock.
+    clean    atomic.Bool
+    mu       sync.Mutex
+    failures int
+    // openUntil is when the breaker lets an attempt through again; zero while closed.
+    openUntil time.Time
+    // probing is whether the attempt let through after the cooldown hasn't finished yet.
+    probing bool
+}
+
+// newCircuitBreaker returns a closed breaker that opens after threshold failures in a row,
+// or never if threshold is zero.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+    b := &circuitBreaker{threshold: threshold, cooldown: cooldown}
+    b.clean.Store(true)
+    return b
+}
+
+// allow returns errDatabaseUnavailable if the breaker is open. After the cooldown one caller
+// is let through to find out whether the database is back.
+func (b *circuitBreaker) allow() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.openUntil.IsZero() {
+        return nil
+    }
+    if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+        if wait <= 0 {
+            wait = dbConnectBackoff
+        }
+        return errDatabaseUnavailable{RetryAfter: wait}
+    }
+    b.probing = true
+    return nil
+}
+
+// record counts the outcome of talking to the database. Only errors that mean it couldn't
+// be reached count as failures; any other outcome shows it is up, except the caller giving
+// up, which shows nothing.
+func (b *circuitBreaker) record(err error) {
+    unreachable := databaseUnreachable(err)
+    if b == nil || b.threshold == 0 || (!unreachable && b.clean.Load()) {
+        return
+    }
+    if errors.As(err, new(errDatabaseUnavailable)) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !unreachable {
+        b.clean.Store(true)
+        if !b.openUntil.IsZero() {
+            slog.Info("database is reachable again, closing circuit breaker")
+        }
+        b.failures, b.openUntil, b.probing = 0, time.Time{}, false
+        return
+    }
+    b.clean.Store(false)
+    b.failures++
+    if b.probing || (b.openUntil.IsZero() && b.failures >= b.threshold) {
+        if b.openUntil.IsZero() {
+            slog.Warn("database is unreachable, opening circuit breaker", "failures", b.failures, "cooldown", b.cooldown, "error", err)
+        }
+        b.openUntil, b.probing = time.Now().Add(b.cooldown), false
+    }
+}
+
+// tenantConnector opens the connections of one pool, retrying transient failures with
+// backoff and going through the pool's circuit breaker.
+type tenantConnector struct {
+    driver  tenantDriver
+    name    string
+    retries int
+    breaker *circuitBreaker
+}
+
+func (d tenantDriver) OpenConnector(name string) (driver.Connector, error) {
+    return &tenantConnector{
+        driver:  d,
+        name:    name,
+        retries: AppConfig.DBConnectRetries,
+        breaker: newCircuitBreaker(AppConfig.DBBreakerThreshold, AppConfig.DBBreakerCooldown),
+    }, nil
+}
+
+func (c *tenantConnector) Connect(ctx context.Context) (driver.Conn, error) {
+    backoff := dbConnectBackoff
+    for attempt := 0; ; attempt++ {
+        if err := c.breaker.allow(); err != nil {
+            return nil, err
+        }
+        conn, err := c.driver.Open(c.name)
+        c.breaker.record(err)
+        if err == nil {
+            conn.(*tenantConn).breaker = c.breaker
+            return conn, nil
+        }
+        // Connecting sends no statement, so it is always safe to try again.
+        if attempt == c.retries || !databaseUnreachable(err) {
+            return nil, err
+        }
+        select {
+        case <-ctx.Done():
+            return nil, err
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+func (c *tenantConnector) Driver() driver.Driver {
+    return c.driver
+}
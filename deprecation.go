@@ -0,0 +1,258 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "mime"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Deprecation describes a deprecated route or field of the API.
+type Deprecation struct {
+    // Since is when it was deprecated.
+    Since time.Time
+    // Sunset, when set, is when it stops working.
+    Sunset time.Time
+    // Successor, when set, is what replaces it: the path of the route to use instead, whose
+    // {name} placeholders are filled in from the path variables and query parameters of the
+    // request, or the name of the field to use instead.
+    Successor string
+}
+
+// Warning is an entry of the warnings a response about something deprecated carries.
+type Warning struct {
+    Code         string     `json:"code"`
+    Message      string     `json:"message"`
+    Field        string     `json:"field,omitempty"`
+    DeprecatedAt time.Time  `json:"deprecated_at"`
+    Sunset       *time.Time `json:"sunset,omitempty"`
+    Successor    string     `json:"successor,omitempty"`
+}
+
+// warningDeprecated is the code of the warning about something deprecated.
+const warningDeprecated = "DEPRECATED"
+
+// legacyProductRoutes is the deprecation of the query-string product routes, like
+// /product?id=, in favour of the /products ones.
+var legacyProductRoutes = Deprecation{
+    Since:  time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC),
+    Sunset: time.Date(2027, time.April, 16, 0, 0, 0, 0, time.UTC),
+}
+
+// deprecatedRoutes are the deprecated routes, by method and path template, like
+// "GET /product".
+var deprecatedRoutes = map[string]Deprecation{
+    "GET /product":            legacyProductRoutes.replacedBy("/products/{id}"),
+    "POST /product":           legacyProductRoutes.replacedBy("/products"),
+    "PUT /product":            legacyProductRoutes.replacedBy("/products/{id}"),
+    "DELETE /product":         legacyProductRoutes.replacedBy("/products/{id}"),
+    "GET /product/by-barcode": legacyProductRoutes.replacedBy("/products/by-barcode?code={code}"),
+}
+
+// deprecatedFields are the deprecated fields of JSON responses, by name. A response is
+// warned about one when the field is in the object it sends, or in an object of its
+// products. No field is deprecated at the moment.
+var deprecatedFields = map[string]Deprecation{}
+
+// replacedBy returns d with the given successor.
+func (d Deprecation) replacedBy(successor string) Deprecation {
+    d.Successor = successor
+    return d
+}
+
+// placeholderPattern matches a {name} placeholder of a successor path.
+var placeholderPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// successorFor returns the successor path of d for r, with its placeholders filled in.
+// Placeholders without a value are left as they are.
+func (d Deprecation) successorFor(r *http.Request) string {
+    vars, query := mux.Vars(r), r.URL.Query()
+    return placeholderPattern.ReplaceAllStringFunc(d.Successor, func(placeholder string) string {
+        name := placeholder[1 : len(placeholder)-1]
+        if value, ok := vars[name]; ok {
+            return url.PathEscape(value)
+        }
+        if value := query.Get(name); value != "" {
+            return url.PathEscape(value)
+        }
+        return placeholder
+    })
+}
+
+// warning returns the warning about d. route is the deprecated route, like "GET /product",
+// or else field is the deprecated field.
+func (d Deprecation) warning(route, field, successor string) Warning {
+    w := Warning{Code: warningDeprecated, Field: field, DeprecatedAt: d.Since, Successor: successor}
+    if route != "" {
+        w.Message = route + " is deprecated"
+    } else {
+        w.Message = "The " + field + " field is deprecated"
+    }
+    if successor != "" {
+        w.Message += "; use " + successor + " instead"
+    }
+    if !d.Sunset.IsZero() {
+        sunset := d.Sunset
+        w.Sunset = &sunset
+        w.Message += fmt.Sprintf(". It will stop working on %s", sunset.Format(time.DateOnly))
+    }
+    w.Message += "."
+    return w
+}
+
+// deprecationMiddleware tells clients of deprecated routes and fields about it: with a
+// Deprecation header (RFC 9745), a Sunset header (RFC 8594) when a date is set, a Link to
+// the successor of a route and a Warning header, and with a warnings array added to JSON
+// object bodies. Only responses that may need it are held back to be inspected.
+func deprecationMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        dw := &deprecationWriter{ResponseWriter: w}
+        if route := mux.CurrentRoute(r); route != nil {
+            if path, err := route.GetPathTemplate(); err == nil {
+                name := r.Method + " " + path
+                if d, ok := deprecatedRoutes[name]; ok {
+                    successor := d.successorFor(r)
+                    dw.route = &d
+                    dw.warnings = append(dw.warnings, d.warning(name, "", successor))
+                    dw.successor = successor
+                }
+            }
+        }
+        if dw.route == nil && len(deprecatedFields) == 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        next.ServeHTTP(dw, r)
+        dw.finish()
+    })
+}
+
+// deprecationWriter holds back a JSON body to add warnings to it, and adds the headers
+// about deprecated routes and fields before the status is written.
+type deprecationWriter struct {
+    http.ResponseWriter
+    // route is the deprecation of the route, if it is deprecated.
+    route     *Deprecation
+    successor string
+    warnings  []Warning
+
+    status  int
+    holding bool
+    started bool
+    buf     bytes.Buffer
+}
+
+func (dw *deprecationWriter) WriteHeader(status int) {
+    if dw.started || dw.holding {
+        return
+    }
+    contentType, _, _ := mime.ParseMediaType(dw.Header().Get("Content-Type"))
+    if contentType == mediaJSON && status != http.StatusNoContent && status != http.StatusNotModified {
+        dw.status, dw.holding = status, true
+        return
+    }
+    dw.start(status)
+}
+
+func (dw *deprecationWriter) Write(b []byte) (int, error) {
+    if !dw.started && !dw.holding {
+        dw.WriteHeader(http.StatusOK)
+    }
+    if dw.holding {
+        return dw.buf.Write(b)
+    }
+    return dw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (dw *deprecationWriter) Unwrap() http.ResponseWriter {
+    return dw.ResponseWriter
+}
+
+// start writes the headers about deprecation and the status.
+func (dw *deprecationWriter) start(status int) {
+    dw.started = true
+    header := dw.Header()
+    var since, sunset time.Time
+    if dw.route != nil {
+        since, sunset = dw.route.Since, dw.route.Sunset
+        if dw.successor != "" {
+            header.Add("Link", "<"+dw.successor+`>; rel="successor-version"`)
+        }
+    }
+    for _, warning := range dw.warnings {
+        if dw.route == nil && (since.IsZero() || warning.DeprecatedAt.Before(since)) {
+            since = warning.DeprecatedAt
+        }
+        header.Add("Warning", "299 - "+strconv.Quote(warning.Message))
+    }
+    if !since.IsZero() {
+        header.Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+    }
+    if !sunset.IsZero() {
+        header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+    }
+    dw.ResponseWriter.WriteHeader(status)
+}
+
+// finish adds the warnings to a held-back body, about the route and the deprecated fields
+// it has, and sends it. The warnings go last, so the rest of the body is left as it was.
+func (dw *deprecationWriter) finish() {
+    if !dw.holding {
+        return
+    }
+    body := dw.buf.Bytes()
+    var object map[string]json.RawMessage
+    if json.Unmarshal(body, &object) == nil && object != nil {
+        dw.warnings = append(dw.warnings, deprecatedFieldWarnings(object)...)
+        if warnings, err := json.Marshal(dw.warnings); err == nil && len(dw.warnings) > 0 {
+            trimmed := bytes.TrimRight(body, " \t\r\n")
+            withWarnings := append([]byte{}, trimmed[:len(trimmed)-1]...)
+            if len(object) > 0 {
+                withWarnings = append(withWarnings, ',')
+            }
+            withWarnings = append(withWarnings, `"warnings":`...)
+            withWarnings = append(withWarnings, warnings...)
+            body = append(withWarnings, "}\n"...)
+        }
+    }
+    dw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+    dw.start(dw.status)
+    dw.ResponseWriter.Write(body)
+}
+
+// deprecatedFieldWarnings returns the warnings about the deprecatedFields that object, or
+// an object of its products, has.
+func deprecatedFieldWarnings(object map[string]json.RawMessage) []Warning {
+    if len(deprecatedFields) == 0 {
+        return nil
+    }
+    present := map[string]bool{}
+    for name := range object {
+        present[name] = true
+    }
+    var products []map[string]json.RawMessage
+    if json.Unmarshal(object["products"], &products) == nil {
+        for _, product := range products {
+            for name := range product {
+                present[name] = true
+            }
+        }
+    }
+    var warnings []Warning
+    for name, d := range deprecatedFields {
+        if present[name] {
+            warnings = append(warnings, d.warning("", name, d.Successor))
+        }
+    }
+    sort.Slice(warnings, func(i, j int) bool { return warnings[i].Field < warnings[j].Field })
+    return warnings
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types the API can read and write. JSON is the default; XML is for legacy consumers
+// and MessagePack for high-volume internal callers.
+const (
+    mediaJSON    = "application/json"
+    mediaXML     = "application/xml"
+    mediaMsgpack = "application/msgpack"
+)
+
+// mediaTypes maps the names clients use in Accept and Content-Type headers to the media
+// type they stand for.
+var mediaTypes = map[string]string{
+    "application/json":        mediaJSON,
+    "application/xml":         mediaXML,
+    "text/xml":                mediaXML,
+    "application/msgpack":     mediaMsgpack,
+    "application/x-msgpack":   mediaMsgpack,
+    "application/vnd.msgpack": mediaMsgpack,
+    // Wildcards get the default.
+    "*/*":           mediaJSON,
+    "application/*": mediaJSON,
+}
+
+// responseMediaType picks the media type to answer r in: the supported type its Accept
+// header gives the highest quality, the earliest on a tie. Clients that send no Accept
+// header, or accept nothing the API supports, get JSON rather than a 406.
+func responseMediaType(r *http.Request) string {
+    best, bestQuality := mediaJSON, 0.0
+    for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+        name, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+        if err != nil {
+            continue
+        }
+        mediaType, ok := mediaTypes[name]
+        if !ok {
+            continue
+        }
+        quality := 1.0
+        if q, ok := params["q"]; ok {
+            if quality, err = strconv.ParseFloat(q, 64); err != nil {
+                continue
+            }
+        }
+        if quality > bestQuality {
+            best, bestQuality = mediaType, quality
+        }
+    }
+    return best
+}
+
+// marshalBody encodes v as mediaType. JSON and MessagePack use the json field names; XML
+// uses the xml ones, under a root element named by xmlRootName.
+func marshalBody(mediaType string, v interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    switch mediaType {
+    case mediaXML:
+        buf.WriteString(xml.Header)
+        root := xml.StartElement{Name: xml.Name{Local: xmlRootName(v)}}
+        if reflect.Indirect(reflect.ValueOf(v)).Kind() == reflect.Slice {
+            // A slice would be encoded as a run of sibling elements, so wrap it.
+            v = struct {
+                Items interface{} `xml:"item"`
+            }{v}
+        }
+        if err := xml.NewEncoder(&buf).EncodeElement(v, root); err != nil {
+            return nil, err
+        }
+        buf.WriteByte('\n')
+    case mediaMsgpack:
+        enc := msgpack.NewEncoder(&buf)
+        enc.SetCustomStructTag("json")
+        enc.UseCompactInts(true)
+        if err := enc.Encode(v); err != nil {
+            return nil, err
+        }
+    default:
+        if err := json.NewEncoder(&buf).Encode(v); err != nil {
+            return nil, err
+        }
+    }
+    return buf.Bytes(), nil
+}
+
+// xmlRootName returns the name of the root element v is encoded under in XML.
+func xmlRootName(v interface{}) string {
+    switch reflect.Indirect(reflect.ValueOf(v)).Interface().(type) {
+    case ErrorResponse:
+        return "error"
+    case Product, ProductDetail, ExpandedProduct, UpdateResult, ProductView:
+        return "product"
+    case ProductList, ProductListView, BatchGetResponse:
+        return "products"
+    case Review:
+        return "review"
+    case ReviewPage:
+        return "reviews"
+    case ProductFacets:
+        return "facets"
+    case CatalogStats:
+        return "stats"
+    case Tenant, ProvisionedTenant:
+        return "tenant"
+    case Vendor:
+        return "vendor"
+    case Favorite:
+        return "favorite"
+    case FavoritePage:
+        return "favorites"
+    case Cart:
+        return "cart"
+    case Promotion:
+        return "promotion"
+    case Coupon:
+        return "coupon"
+    case CouponCheck:
+        return "coupon_check"
+    case ProductVariant:
+        return "variant"
+    case []ProductVariant:
+        return "variants"
+    case []Recommendation:
+        return "recommendations"
+    case []SearchResult:
+        return "results"
+    case Category:
+        return "category"
+    case []*Category:
+        return "categories"
+    case ProductImage:
+        return "image"
+    case []ProductImage:
+        return "images"
+    case CurrencyPrice:
+        return "price"
+    case []CurrencyPrice:
+        return "prices"
+    case ExchangeRates:
+        return "rates"
+    case PriceHistory:
+        return "price_history"
+    case ScheduledPrice:
+        return "scheduled_price"
+    case StockLevel:
+        return "stock"
+    case StockAdjustment:
+        return "adjustment"
+    case []AuditEntry:
+        return "history"
+    case Webhook:
+        return "webhook"
+    case []Webhook:
+        return "webhooks"
+    case []WebhookDelivery:
+        return "deliveries"
+    case []WebhookAttempt:
+        return "attempts"
+    case APIKey:
+        return "api_key"
+    case LoginResponse:
+        return "login"
+    case HealthResponse:
+        return "health"
+    }
+    return "response"
+}
+
+// respond writes v as the response body with the given status, in the media type the
+// client asked for.
+func respond(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+    mediaType := responseMediaType(r)
+    body, err := marshalBody(mediaType, v)
+    if err != nil {
+        // Only XML fails here, on values like maps it has no form for.
+        logError(r, err)
+        respondError(w, r, http.StatusNotAcceptable, codeNotAcceptable, "The response can't be represented in the requested media type.")
+        return
+    }
+    writeBody(w, mediaType, status, body)
+}
+
+// respondJSONBody writes body, the JSON encoding of a value of the type v points to, with a
+// 200 OK status. Clients asking for another media type get the value decoded into v and
+// encoded in that type instead; this lets handlers keep caching the JSON form.
+func respondJSONBody(w http.ResponseWriter, r *http.Request, body []byte, v interface{}) {
+    if responseMediaType(r) == mediaJSON {
+        writeBody(w, mediaJSON, http.StatusOK, body)
+        return
+    }
+    if err := json.Unmarshal(body, v); err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to encode response.")
+        return
+    }
+    respond(w, r, http.StatusOK, v)
+}
+
+// writeBody writes an encoded response body. The body depends on the Accept header, so
+// caches are told to keep one copy per Accept value.
+func writeBody(w http.ResponseWriter, mediaType string, status int, body []byte) {
+    w.Header().Add("Vary", "Accept")
+    w.Header().Set("Content-Type", mediaType)
+    w.WriteHeader(status)
+    w.Write(body)
+}
+
+// decodeBody decodes the request body into v according to its Content-Type: XML or
+// MessagePack when it says so, and JSON otherwise, including when it is missing or wrong,
+// as clients like curl send form content types with JSON bodies.
+func decodeBody(r *http.Request, v interface{}) error {
+    name, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    switch mediaTypes[name] {
+    case mediaXML:
+        return xml.NewDecoder(r.Body).Decode(v)
+    case mediaMsgpack:
+        dec := msgpack.NewDecoder(r.Body)
+        dec.SetCustomStructTag("json")
+        dec.DisallowUnknownFields(true)
+        return dec.Decode(v)
+    }
+    return decodeJSON(r, v)
+}
+
+// errTrailingData is returned by decodeJSON for a body holding more than one JSON value.
+var errTrailingData = errors.New("body must hold a single JSON value")
+
+// decodeJSON decodes the JSON request body into v. Fields v doesn't have and anything after
+// the value are errors, so a misspelt field or a second document isn't silently ignored.
+func decodeJSON(r *http.Request, v interface{}) error {
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        return err
+    }
+    if _, err := dec.Token(); err != io.EOF {
+        if isBodyTooLarge(err) {
+            return err
+        }
+        return errTrailingData
+    }
+    return nil
+}
+
+// isBodyTooLarge reports whether err comes from reading past the request body size limit.
+func isBodyTooLarge(err error) bool {
+    var tooLarge *http.MaxBytesError
+    return errors.As(err, &tooLarge)
+}
+
+// respondBodyError answers a request whose body couldn't be decoded: with 413 Request
+// Entity Too Large if it was over the size limit, and otherwise with 400 Bad Request saying
+// what is wrong with it.
+func respondBodyError(w http.ResponseWriter, r *http.Request, err error) {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        respondError(w, r, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("Request body must be at most %d bytes.", tooLarge.Limit))
+        return
+    }
+    respondError(w, r, http.StatusBadRequest, codeInvalidBody, "Failed to parse request body: "+bodyErrorDetail(err)+".")
+}
+
+// bodyErrorDetail describes what is wrong with a request body in terms of the document
+// rather than of the Go types it was decoded into.
+func bodyErrorDetail(err error) string {
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case errors.Is(err, io.EOF):
+        return "body is empty"
+    case errors.Is(err, io.ErrUnexpectedEOF):
+        return "body ends in the middle of a value"
+    case errors.As(err, &syntaxErr):
+        return fmt.Sprintf("malformed JSON at byte %d", syntaxErr.Offset)
+    case errors.As(err, &typeErr):
+        if typeErr.Field == "" {
+            return "body must be " + jsonKind(typeErr.Type)
+        }
+        return typeErr.Field + " must be " + jsonKind(typeErr.Type)
+    }
+    return strings.TrimPrefix(err.Error(), "json: ")
+}
+
+// jsonKind names the kind of JSON value that decodes into t.
+func jsonKind(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.String:
+        return "a string"
+    case reflect.Bool:
+        return "a boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return "an integer"
+    case reflect.Float32, reflect.Float64:
+        return "a number"
+    case reflect.Slice, reflect.Array:
+        return "an array"
+    case reflect.Ptr:
+        return jsonKind(t.Elem())
+    }
+    return "an object"
+}
+
+// StringMap is a map of strings, like variant attributes, that can also be encoded as XML,
+// as a list of <entry key="name">value</entry> elements.
+type StringMap map[string]string
+
+// xmlEntry is an element of an encoded StringMap.
+type xmlEntry struct {
+    Key   string `xml:"key,attr"`
+    Value string `xml:",chardata"`
+}
+
+// MarshalXML writes m as entry elements, sorted by key so the output is stable.
+func (m StringMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    keys := make([]string, 0, len(m))
+    for key := range m {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    entries := make([]xmlEntry, len(keys))
+    for i, key := range keys {
+        entries[i] = xmlEntry{Key: key, Value: m[key]}
+    }
+    return e.EncodeElement(struct {
+        Entries []xmlEntry `xml:"entry"`
+    }{entries}, start)
+}
+
+// UnmarshalXML reads entry elements written by MarshalXML.
+func (m *StringMap) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var body struct {
+        Entries []xmlEntry `xml:"entry"`
+    }
+    if err := d.DecodeElement(&body, &start); err != nil {
+        return err
+    }
+    *m = make(StringMap, len(body.Entries))
+    for _, entry := range body.Entries {
+        (*m)[entry.Key] = entry.Value
+    }
+    return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// benchmarkList returns a page of n products like a listing sends.
+func benchmarkList(n int) ProductList {
+    list := ProductList{Products: make([]Product, n)}
+    created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+    for i := range list.Products {
+        list.Products[i] = Product{ID: i + 1, Name: "Product " + strconv.Itoa(i), Category: "home", Price: Money(1999 + i),
+            Currency: "USD", Attributes: `{"color":"red"}`, Tags: "sale", CreatedAt: created, UpdatedAt: created, Version: 1, Status: StatusPublished}
+    }
+    return list
+}
+
+func BenchmarkRespond(b *testing.B) {
+    setupHandlers(b)
+    list := benchmarkList(50)
+    for _, mediaType := range []string{mediaJSON, mediaXML, mediaMsgpack} {
+        b.Run(mediaType, func(b *testing.B) {
+            r := httptest.NewRequest("GET", "/products", nil)
+            r.Header.Set("Accept", mediaType)
+
+            b.ReportAllocs()
+            for b.Loop() {
+                w := httptest.NewRecorder()
+                respond(w, r, http.StatusOK, list)
+                if w.Code != http.StatusOK {
+                    b.Fatalf("status = %d: %s", w.Code, w.Body)
+                }
+            }
+        })
+    }
+}
+
+func TestHandlersNegotiateMediaType(t *testing.T) {
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        target  string
+        vars    map[string]string
+        xmlRoot string
+    }{
+        {name: "health", handler: healthz, target: "/healthz", xmlRoot: "<health>"},
+        {name: "categories", handler: getCategories, target: "/categories", xmlRoot: "<categories>"},
+        {name: "stock", handler: getStock, target: "/products/1/stock", vars: map[string]string{"id": "1"}, xmlRoot: "<stock>"},
+        {name: "webhooks", handler: getWebhooks, target: "/admin/webhooks", xmlRoot: "<webhooks>"},
+    }
+    for _, tt := range tests {
+        for _, mediaType := range []string{mediaJSON, mediaXML, mediaMsgpack} {
+            t.Run(tt.name+" as "+mediaType, func(t *testing.T) {
+                repo := setupHandlers(t)
+                seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD"})
+                stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                    if strings.HasPrefix(query, "SELECT stock") {
+                        return []string{"stock"}, [][]driver.Value{{int64(4)}}, nil
+                    }
+                    return nil, nil, nil
+                }
+
+                r := newTestRequest("GET", tt.target, "", RoleAdmin, tt.vars)
+                r.Header.Set("Accept", mediaType)
+                w := httptest.NewRecorder()
+                tt.handler(w, r)
+                if w.Code != http.StatusOK {
+                    t.Fatalf("status = %d: %s", w.Code, w.Body)
+                }
+                if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, mediaType) {
+                    t.Errorf("Content-Type = %q, want %s", got, mediaType)
+                }
+                if mediaType == mediaXML && !strings.Contains(w.Body.String(), tt.xmlRoot) {
+                    t.Errorf("body = %s, want it under %s", w.Body, tt.xmlRoot)
+                }
+            })
+        }
+    }
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// productETag returns the ETag of a product: its version, which is what If-Match checks, and
+// when it last changed, which also covers changes that don't make a new version, like reviews
+// and images.
+func productETag(product Product) string {
+    tag := strconv.Itoa(product.Version)
+    if !product.UpdatedAt.IsZero() {
+        tag += "." + strconv.FormatInt(product.UpdatedAt.UnixMicro(), 36)
+    }
+    return `"` + tag + `"`
+}
+
+// bodyETag returns an ETag derived from the bytes of a response body, for responses such as
+// listings that have no version of their own.
+func bodyETag(body []byte) string {
+    sum := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// setCacheControl tells clients and proxies how they may cache a product read. Reads are
+// private to the credentials that made them unless anonymous reads are allowed.
+func setCacheControl(w http.ResponseWriter) {
+    scope := "private"
+    if AppConfig.PublicReads {
+        scope = "public"
+    }
+    maxAge := currentConfig().HTTPCacheMaxAge
+    if maxAge <= 0 {
+        w.Header().Set("Cache-Control", scope+", no-cache")
+        return
+    }
+    w.Header().Set("Cache-Control", scope+", max-age="+strconv.Itoa(int(maxAge.Seconds())))
+}
+
+// respondNotModified sets the headers a read is revalidated with, and writes a 304 Not
+// Modified response if the client's copy, named by If-None-Match or else If-Modified-Since,
+// is still current. It reports whether it did. A zero lastModified isn't sent.
+func respondNotModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+    w.Header().Set("ETag", etag)
+    if !lastModified.IsZero() {
+        w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+    }
+    setCacheControl(w)
+    if !notModified(r, etag, lastModified) {
+        return false
+    }
+    w.Header().Add("Vary", "Accept")
+    w.WriteHeader(http.StatusNotModified)
+    return true
+}
+
+// notModified reports whether the request's preconditions say the client already has the
+// representation with the given ETag and modification time. If-None-Match takes precedence
+// over If-Modified-Since, which HTTP dates only give to the second.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+    if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+        for _, tag := range strings.Split(ifNoneMatch, ",") {
+            tag = strings.TrimSpace(tag)
+            if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+                return true
+            }
+        }
+        return false
+    }
+    if lastModified.IsZero() {
+        return false
+    }
+    since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+    return err == nil && !lastModified.Truncate(time.Second).After(since)
+}
+
+// requireIfMatch reads the product version a write was based on from the If-Match header.
+// "*" matches any version and yields zero. If the header is missing it writes 428
+// Precondition Required, and if it can't be one of our ETags it writes 412 Precondition
+// Failed. It reports whether the write may go ahead.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) (int, bool) {
+    ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+    if ifMatch == "" {
+        respondError(w, r, http.StatusPreconditionRequired, codePreconditionRequired, "If-Match header with the product's ETag is required.")
+        return 0, false
+    }
+    if ifMatch == "*" {
+        return 0, true
+    }
+    // Only the version matters: a review or a new image doesn't get in the way of a write.
+    tag, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), ".")
+    version, err := strconv.Atoi(tag)
+    if err != nil || version < 1 {
+        respondVersionMismatch(w, r)
+        return 0, false
+    }
+    return version, true
+}
+
+// respondVersionMismatch writes a 412 Precondition Failed response for a write based on a
+// stale version of a product.
+func respondVersionMismatch(w http.ResponseWriter, r *http.Request) {
+    respondError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, "Product has been changed since it was read; fetch it again and retry.")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// Product change events, delivered to webhooks and published to the event broker.
+const (
+    eventProductCreated = "product.created"
+    eventProductUpdated = "product.updated"
+    eventProductDeleted = "product.deleted"
+)
+
+// auditEventTypes maps audit actions to the event they are recorded as. A restored product
+// is recorded as an update, since it existed before.
+var auditEventTypes = map[string]string{
+    auditCreate:  eventProductCreated,
+    auditUpdate:  eventProductUpdated,
+    auditDelete:  eventProductDeleted,
+    auditRestore: eventProductUpdated,
+}
+
+// Event is a product change. Data is the product after the change; for deletions it has
+// deleted_at set. TenantID is the tenant the product belongs to. CorrelationID is that of
+// the request that made the change; it is sent as a header rather than in the payload.
+type Event struct {
+    ID            string          `json:"id"`
+    Type          string          `json:"type"`
+    TenantID      int             `json:"tenant_id"`
+    ProductID     int             `json:"product_id"`
+    CreatedAt     time.Time       `json:"created_at"`
+    Data          json.RawMessage `json:"data"`
+    CorrelationID string          `json:"-"`
+}
+
+// EventPublisher sends events to a message broker. Publish returns only once the broker
+// has accepted every event, so that events it fails on are tried again.
+type EventPublisher interface {
+    Publish(ctx context.Context, events []Event) error
+    Close() error
+}
+
+// Events is a global variable that holds the publisher of the broker sink, or nil when no
+// broker is configured.
+var Events EventPublisher
+
+// recordProductEvent writes the event for an audited product change to the outbox as part of
+// tx, pending for every configured sink. The event exists exactly when the change is
+// committed, so it is neither lost nor dispatched for a change that was rolled back.
+func recordProductEvent(ctx context.Context, tx *sql.Tx, action string, product *Product) error {
+    eventType, ok := auditEventTypes[action]
+    if !ok || product == nil {
+        return nil
+    }
+    data, err := json.Marshal(product)
+    if err != nil {
+        return err
+    }
+    event := Event{ID: newID(), Type: eventType, ProductID: product.ID, CreatedAt: time.Now().UTC(), Data: data,
+        CorrelationID: correlationIDFromContext(ctx)}
+    payload, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, "INSERT INTO event_outbox (event_id, event_type, product_id, payload, pending_sinks, correlation_id) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))",
+        event.ID, event.Type, event.ProductID, string(payload), pq.Array(outboxSinkNames()), event.CorrelationID)
+    return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "reflect"
+    "strings"
+)
+
+// Expansion is the set of related resources a client asked to have embedded in product
+// representations with ?expand=category,variants,images,inventory.
+type Expansion struct {
+    Category  bool
+    Variants  bool
+    Images    bool
+    Inventory bool
+}
+
+// ExpandedProduct is a product together with the related resources that can be expanded.
+// Only the expanded ones are loaded and sent.
+type ExpandedProduct struct {
+    ProductDetail
+    Variants       []ProductVariant `json:"variants" xml:"variants>variant"`
+    CategoryDetail *Category        `json:"category_detail" xml:"category_detail"`
+    Inventory      *StockLevel      `json:"inventory" xml:"inventory"`
+}
+
+// expansionFields are the fields of ExpandedProduct that hold each related resource, by the
+// name it is expanded with. The category has a field of its own, as category is its name.
+var expansionFields = map[string]string{
+    "category":  "category_detail",
+    "variants":  "variants",
+    "images":    "images",
+    "inventory": "inventory",
+}
+
+// resource returns the flag of the related resource with the given name, or nil if there
+// is no such resource.
+func (e *Expansion) resource(name string) *bool {
+    switch name {
+    case "category":
+        return &e.Category
+    case "variants":
+        return &e.Variants
+    case "images":
+        return &e.Images
+    case "inventory":
+        return &e.Inventory
+    }
+    return nil
+}
+
+// parseExpansion reads the expand parameter. When fields are selected, the resources
+// expanded are those whose fields are among them, so ?fields=id,variants needs no
+// ?expand=variants and a resource that wouldn't be sent isn't loaded.
+func parseExpansion(queryValues url.Values, fields FieldSelection) (Expansion, error) {
+    var e Expansion
+    for _, name := range strings.Split(strings.Join(queryValues["expand"], ","), ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        expand := e.resource(name)
+        if expand == nil {
+            return e, fmt.Errorf("Unknown resource %q in expand; expected category, variants, images or inventory.", name)
+        }
+        *expand = true
+    }
+    if fields != nil {
+        for name, field := range expansionFields {
+            *e.resource(name) = fields[field]
+        }
+    }
+    return e, nil
+}
+
+// selection returns the fields to send of a representation whose fields by default are
+// those of example: the ones asked for with ?fields=, or else the default ones and the
+// expanded resources. It is nil if that is just the default fields.
+func (e Expansion) selection(fields FieldSelection, example interface{}) FieldSelection {
+    if fields != nil {
+        return fields
+    }
+    selection := FieldSelection{}
+    for _, field := range viewFields(reflect.ValueOf(example)) {
+        selection[field.json] = true
+    }
+    expanded := false
+    for name, field := range expansionFields {
+        if *e.resource(name) && !selection[field] {
+            selection[field] = true
+            expanded = true
+        }
+    }
+    if !expanded {
+        return nil
+    }
+    return selection
+}
+
+// newExpandedProducts returns products ready to be expanded by a repository, with empty
+// lists of the expanded resources so that products without any still send them, and a
+// stock level of zero if inventory is expanded.
+func newExpandedProducts(products []Product, e Expansion) []ExpandedProduct {
+    expanded := make([]ExpandedProduct, len(products))
+    for i, product := range products {
+        expanded[i].Product = product
+        if e.Images {
+            expanded[i].Images = []ProductImage{}
+        }
+        if e.Variants {
+            expanded[i].Variants = []ProductVariant{}
+        }
+        if e.Inventory {
+            expanded[i].Inventory = &StockLevel{ProductID: product.ID}
+        }
+    }
+    return expanded
+}
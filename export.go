@@ -0,0 +1,126 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// exportFlushEvery is how many rows an export writes between flushes to the client.
+const exportFlushEvery = 500
+
+// exportProducts streams every product matching the /products filter parameters as CSV
+// (?format=csv, the default) or newline-delimited JSON (?format=ndjson). Rows are written as
+// they are read from the database, so the export never holds the whole catalog in memory.
+func exportProducts(w http.ResponseWriter, r *http.Request) {
+    queryValues := r.URL.Query()
+    filter, err := parseProductFilters(queryValues)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    filter.IncludeDeleted = includeDeleted(r)
+    filter.PublishedOnly = !includeUnpublished(r.Context())
+
+    var writeRow func(Product) error
+    var flush func()
+    switch queryValues.Get("format") {
+    case "", "csv":
+        cw := csv.NewWriter(w)
+        w.Header().Set("Content-Type", "text/csv")
+        w.Header().Set("Content-Disposition", `attachment; filename="products.csv"`)
+        cw.Write([]string{"id", "name", "category", "price", "currency", "image_url", "barcode", "sku", "attributes", "created_at"})
+        writeRow = func(p Product) error {
+            return cw.Write([]string{strconv.Itoa(p.ID), p.Name, p.Category, p.Price.String(),
+                p.Currency, p.ImageURL, p.Barcode, p.SKU, string(p.Attributes), p.CreatedAt.Format(time.RFC3339)})
+        }
+        flush = cw.Flush
+    case "ndjson":
+        enc := json.NewEncoder(w)
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        w.Header().Set("Content-Disposition", `attachment; filename="products.ndjson"`)
+        writeRow = func(p Product) error { return enc.Encode(p) }
+        flush = func() {}
+    default:
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid format.")
+        return
+    }
+
+    // A large export outlasts the server's write timeout, so lift it for this response.
+    rc := http.NewResponseController(w)
+    if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+        logError(r, err)
+    }
+
+    // Once the first row is written the status is sent, so a failure part way through can
+    // only be logged and the response cut short.
+    rows := 0
+    err = Repo.Each(r.Context(), filter, func(p Product) error {
+        if err := writeRow(p); err != nil {
+            return err
+        }
+        rows++
+        if rows%exportFlushEvery == 0 {
+            flush()
+            return rc.Flush()
+        }
+        return nil
+    })
+    flush()
+    if err != nil {
+        logError(r, err)
+    }
+}
+
+// streamProducts streams every product matching the /products filter parameters as
+// newline-delimited JSON, in ID order, as the rows are scanned. It is meant for syncing the
+// whole catalog: a sync that breaks off resumes with ?after_id= set to the ID of the last
+// product it received.
+func streamProducts(w http.ResponseWriter, r *http.Request) {
+    queryValues := r.URL.Query()
+    filter, err := parseProductFilters(queryValues)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    filter.IncludeDeleted = includeDeleted(r)
+    filter.PublishedOnly = !includeUnpublished(r.Context())
+    if afterID := queryValues.Get("after_id"); afterID != "" {
+        filter.AfterID, err = strconv.Atoi(afterID)
+        if err != nil || filter.AfterID < 0 {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid after_id.")
+            return
+        }
+    }
+
+    // The stream outlasts the server's write timeout, so lift it for this response, and
+    // send the headers right away so the client knows the stream has started.
+    rc := http.NewResponseController(w)
+    if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+        logError(r, err)
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.WriteHeader(http.StatusOK)
+    rc.Flush()
+
+    // Rows are flushed in batches; a failure part way through can only be logged and the
+    // stream cut short, and the client resumes from the last row it got.
+    enc := json.NewEncoder(w)
+    rows := 0
+    err = Repo.Each(r.Context(), filter, func(p Product) error {
+        if err := enc.Encode(p); err != nil {
+            return err
+        }
+        rows++
+        if rows%exportFlushEvery == 0 {
+            return rc.Flush()
+        }
+        return nil
+    })
+    rc.Flush()
+    if err != nil {
+        logError(r, err)
+    }
+}
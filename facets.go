@@ -0,0 +1,92 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+)
+
+// defaultPriceInterval is the width of the price buckets when ?price_interval= isn't given.
+const defaultPriceInterval Money = 1000
+
+// maxPriceBuckets caps how many price buckets a histogram can have, so a tiny interval
+// over a wide price range can't produce an enormous response.
+const maxPriceBuckets = 100
+
+// FacetCount is how many products have one value of a facet, such as one category.
+type FacetCount struct {
+    Value string `json:"value" xml:"value"`
+    Count int    `json:"count" xml:"count"`
+}
+
+// PriceBucket is how many products are priced from Min up to, but not including, Max.
+type PriceBucket struct {
+    Min   Money `json:"min" xml:"min"`
+    Max   Money `json:"max" xml:"max"`
+    Count int   `json:"count" xml:"count"`
+}
+
+// ProductFacets breaks the products matching a filter down by category, tag and price. Each
+// facet ignores the filter's own condition on it, so a sidebar still shows the other values
+// a user could pick; Total is the number of products matching the whole filter. Counts are
+// largest first, and buckets in price order, leaving out empty ones.
+type ProductFacets struct {
+    Total      int           `json:"total" xml:"total"`
+    Categories []FacetCount  `json:"categories" xml:"categories>category"`
+    Tags       []FacetCount  `json:"tags" xml:"tags>tag"`
+    Prices     []PriceBucket `json:"prices" xml:"prices>bucket"`
+}
+
+// facetFilters returns the filters the category, tag and price facets are counted with:
+// f without its condition on that facet.
+func facetFilters(f ProductFilter) (byCategory, byTag, byPrice ProductFilter) {
+    byCategory, byTag, byPrice = f, f, f
+    byCategory.Categories = nil
+    byTag.Tags, byTag.TagsMatchAll = nil, false
+    byPrice.MinPrice, byPrice.MaxPrice = nil, nil
+    return byCategory, byTag, byPrice
+}
+
+// sortFacetCounts orders counts largest first, then by value.
+func sortFacetCounts(counts []FacetCount) {
+    sort.Slice(counts, func(i, j int) bool {
+        if counts[i].Count != counts[j].Count {
+            return counts[i].Count > counts[j].Count
+        }
+        return counts[i].Value < counts[j].Value
+    })
+}
+
+// getProductFacets counts the products matching the listing filters of the query string by
+// category, tag and price, with ?price_interval= setting the width of the price buckets.
+func getProductFacets(w http.ResponseWriter, r *http.Request) {
+    queryValues := r.URL.Query()
+    filter, err := parseProductFilters(queryValues)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    filter.IncludeDeleted = includeDeleted(r)
+    filter.PublishedOnly = !includeUnpublished(r.Context())
+
+    interval := defaultPriceInterval
+    if intervalStr := queryValues.Get("price_interval"); intervalStr != "" {
+        interval, err = ParseMoney(intervalStr)
+        if err != nil || interval <= 0 {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid price interval.")
+            return
+        }
+    }
+
+    facets, err := Repo.Facets(r.Context(), filter, interval)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve facets.")
+        return
+    }
+    if len(facets.Prices) > maxPriceBuckets {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Price interval is too small for the price range.")
+        return
+    }
+
+    // If everything went well, return the facets in the response body.
+    respond(w, r, http.StatusOK, facets)
+}
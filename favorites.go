@@ -0,0 +1,238 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Favorite is a product a user has marked as a favorite, an entry of their wishlist.
+type Favorite struct {
+    ID        int       `json:"id" xml:"id"`
+    ProductID int       `json:"product_id" xml:"product_id"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+    // Product is the favorite product itself, sent with listings.
+    Product *Product `json:"product,omitempty" xml:"product,omitempty"`
+}
+
+// FavoritePage is one page of a user's favorites, most recent first. NextBeforeID, when
+// set, fetches the following page as ?before_id=.
+type FavoritePage struct {
+    Favorites    []Favorite `json:"favorites" xml:"favorites>favorite"`
+    NextBeforeID int        `json:"next_before_id,omitempty" xml:"next_before_id,omitempty"`
+}
+
+// userIDFromRequest returns the user ID from the {id} path variable.
+func userIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// queryUserID returns the ID of the user with the given username, or sql.ErrNoRows.
+func queryUserID(ctx context.Context, username string) (int, error) {
+    var id int
+    err := Reads.QueryRowScan(ctx, []interface{}{&id}, "SELECT id FROM users WHERE username = $1", username)
+    return id, err
+}
+
+// allowFavorites checks that the request may see and change the favorites of the user with
+// the given ID: only the user themselves and admins may. If not, it writes the error
+// response, or answers a failed check with message, and reports false.
+func allowFavorites(w http.ResponseWriter, r *http.Request, userID int, message string) bool {
+    principal, ok := principalFromContext(r.Context())
+    if !ok {
+        respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Sign in to keep favorites.")
+        return false
+    }
+    if principal.Role.Includes(RoleAdmin) {
+        var exists bool
+        err := Reads.QueryRowScan(r.Context(), []interface{}{&exists}, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID)
+        if err != nil {
+            respondStoreError(w, r, err, message)
+            return false
+        }
+        if !exists {
+            respondError(w, r, http.StatusNotFound, codeUserNotFound, "User not found.")
+            return false
+        }
+        return true
+    }
+    // API keys and the admin token aren't users, so only tokens from /login get here.
+    username, isUser := strings.CutPrefix(principal.Subject, "user:")
+    if !isUser {
+        respondError(w, r, http.StatusForbidden, codeForbidden, "Forbidden.")
+        return false
+    }
+    id, err := queryUserID(r.Context(), username)
+    if err != nil && err != sql.ErrNoRows {
+        respondStoreError(w, r, err, message)
+        return false
+    }
+    if err == sql.ErrNoRows || id != userID {
+        respondError(w, r, http.StatusForbidden, codeForbidden, "Forbidden.")
+        return false
+    }
+    return true
+}
+
+// getFavorites lists the favorites of a user, most recent first, a page at a time, with
+// their products. Favorites of products that were deleted, or that the caller can't see,
+// are left out.
+func getFavorites(w http.ResponseWriter, r *http.Request) {
+    userID, err := userIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid user ID.")
+        return
+    }
+    limit := AppConfig.DefaultPageSize
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > AppConfig.MaxPageSize {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+    beforeID := 0
+    if beforeStr := r.URL.Query().Get("before_id"); beforeStr != "" {
+        if beforeID, err = strconv.Atoi(beforeStr); err != nil || beforeID < 1 {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid before_id.")
+            return
+        }
+    }
+
+    if !allowFavorites(w, r, userID, "Failed to retrieve favorites.") {
+        return
+    }
+
+    // Fetch one favorite more than the page holds to learn whether another page follows.
+    page := FavoritePage{Favorites: []Favorite{}}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var favorite Favorite
+        if err := scan(&favorite.ID, &favorite.ProductID, &favorite.CreatedAt); err != nil {
+            return err
+        }
+        page.Favorites = append(page.Favorites, favorite)
+        return nil
+    }, `SELECT f.id, f.product_id, f.created_at FROM favorites f
+        WHERE f.user_id = $1 AND ($2 = 0 OR f.id < $2)
+        AND EXISTS (SELECT 1 FROM products p WHERE p.id = f.product_id AND p.deleted_at IS NULL AND ($4 OR p.status = $5))
+        ORDER BY f.id DESC LIMIT $3`, userID, beforeID, limit+1, includeUnpublished(r.Context()), StatusPublished)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve favorites.")
+        return
+    }
+    if respondEmptyList(w, r, len(page.Favorites)) {
+        return
+    }
+    if len(page.Favorites) > limit {
+        page.Favorites = page.Favorites[:limit]
+        page.NextBeforeID = page.Favorites[limit-1].ID
+    }
+
+    // Add the products of the page, all read at once.
+    ids := make([]int, len(page.Favorites))
+    for i, favorite := range page.Favorites {
+        ids[i] = favorite.ProductID
+    }
+    products, err := Repo.GetByIDs(r.Context(), ids)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve favorites.")
+        return
+    }
+    byID := make(map[int]*Product, len(products))
+    for i := range products {
+        byID[products[i].ID] = &products[i]
+    }
+    for i := range page.Favorites {
+        page.Favorites[i].Product = byID[page.Favorites[i].ProductID]
+    }
+
+    // If everything went well, return the page of favorites in the response body.
+    respond(w, r, http.StatusOK, page)
+}
+
+// addFavorite marks a live product as a favorite of a user. Adding a favorite twice is not
+// an error: the second time answers 200 OK with the favorite there already is.
+func addFavorite(w http.ResponseWriter, r *http.Request) {
+    userID, err := userIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid user ID.")
+        return
+    }
+    productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !allowFavorites(w, r, userID, "Failed to add favorite.") {
+        return
+    }
+    // Anyone who may see a product may favorite it.
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to add favorite.") {
+        return
+    }
+
+    favorite := Favorite{ProductID: productID}
+    status := http.StatusCreated
+    err = DB.QueryRowContext(r.Context(), `INSERT INTO favorites (user_id, product_id) VALUES ($1, $2)
+        ON CONFLICT (user_id, product_id) DO NOTHING RETURNING id, created_at`, userID, productID).Scan(&favorite.ID, &favorite.CreatedAt)
+    if err == sql.ErrNoRows {
+        // The product is a favorite already.
+        status = http.StatusOK
+        err = DB.QueryRowContext(r.Context(), "SELECT id, created_at FROM favorites WHERE user_id = $1 AND product_id = $2",
+            userID, productID).Scan(&favorite.ID, &favorite.CreatedAt)
+    }
+    if isForeignKeyViolation(err) {
+        // The product was purged in the meantime.
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to add favorite.")
+        return
+    }
+
+    // If everything went well, return the favorite, with 201 Created if it is new.
+    if status == http.StatusCreated {
+        w.Header().Set("Location", fmt.Sprintf("/users/%d/favorites/%d", userID, productID))
+    }
+    respond(w, r, status, favorite)
+}
+
+// removeFavorite takes a product off the favorites of a user.
+func removeFavorite(w http.ResponseWriter, r *http.Request) {
+    userID, err := userIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid user ID.")
+        return
+    }
+    productID, err := strconv.Atoi(mux.Vars(r)["product_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !allowFavorites(w, r, userID, "Failed to remove favorite.") {
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM favorites WHERE user_id = $1 AND product_id = $2", userID, productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to remove favorite.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to remove favorite.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeFavoriteNotFound, "Favorite not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "fmt"
+    "net/url"
+    "reflect"
+    "strings"
+
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// FieldSelection is the set of fields a client asked for with ?fields=id,name,price, by
+// their JSON names. A nil selection means every field.
+type FieldSelection map[string]bool
+
+// parseFieldSelection reads the fields parameter, which may name any field of the
+// representation v is an example of.
+func parseFieldSelection(queryValues url.Values, v interface{}) (FieldSelection, error) {
+    param, ok := queryValues["fields"]
+    if !ok {
+        return nil, nil
+    }
+    known := map[string]bool{}
+    for _, field := range viewFields(reflect.ValueOf(v)) {
+        known[field.json] = true
+    }
+    fields := FieldSelection{}
+    for _, name := range strings.Split(strings.Join(param, ","), ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        if !known[name] {
+            return nil, fmt.Errorf("Unknown field %q in fields.", name)
+        }
+        fields[name] = true
+    }
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("Invalid fields; name at least one field.")
+    }
+    return fields, nil
+}
+
+// view returns v limited to the selected fields, or v itself if every field is selected.
+func (s FieldSelection) view(v interface{}) interface{} {
+    if s == nil {
+        return v
+    }
+    var view ProductView
+    for _, field := range viewFields(reflect.ValueOf(v)) {
+        if s[field.json] {
+            view.fields = append(view.fields, field)
+        }
+    }
+    return view
+}
+
+// list returns list with each product limited to the selected fields. If the products were
+// expanded, their expanded representations are given too and take their place.
+func (s FieldSelection) list(list ProductList, expanded []ExpandedProduct) interface{} {
+    if s == nil {
+        return list
+    }
+    views := make([]interface{}, len(list.Products))
+    for i, product := range list.Products {
+        if expanded != nil {
+            views[i] = s.view(expanded[i])
+        } else {
+            views[i] = s.view(product)
+        }
+    }
+    return ProductListView{Products: views, Total: list.Total, TotalApproximate: list.TotalApproximate, Partial: list.Partial, NextCursor: list.NextCursor}
+}
+
+// ProductListView is a page of products limited to the selected fields.
+type ProductListView struct {
+    Products         []interface{} `json:"products" xml:"products>product"`
+    Total            int           `json:"total" xml:"total"`
+    TotalApproximate bool          `json:"total_approximate" xml:"total_approximate"`
+    Partial          bool          `json:"partial" xml:"partial"`
+    NextCursor       string        `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+}
+
+// viewField is a field of a ProductView, with the names it is encoded under.
+type viewField struct {
+    json  string
+    xml   string
+    value interface{}
+}
+
+// ProductView is a representation limited to some of its fields. It is encoded like the
+// full representation would be, in the order of its fields.
+type ProductView struct {
+    fields []viewField
+}
+
+// viewFields lists the fields of the struct v, flattening embedded structs as the encoders do.
+func viewFields(v reflect.Value) []viewField {
+    v = reflect.Indirect(v)
+    var fields []viewField
+    for i := 0; i < v.NumField(); i++ {
+        f := v.Type().Field(i)
+        if !f.IsExported() {
+            continue
+        }
+        jsonName, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+        if f.Anonymous && jsonName == "" {
+            fields = append(fields, viewFields(v.Field(i))...)
+            continue
+        }
+        if jsonName == "" || jsonName == "-" {
+            continue
+        }
+        xmlName, _, _ := strings.Cut(f.Tag.Get("xml"), ",")
+        if xmlName == "" {
+            xmlName = jsonName
+        }
+        fields = append(fields, viewField{json: jsonName, xml: xmlName, value: v.Field(i).Interface()})
+    }
+    return fields
+}
+
+// MarshalJSON writes the fields as an object.
+func (p ProductView) MarshalJSON() ([]byte, error) {
+    var buf bytes.Buffer
+    buf.WriteByte('{')
+    for i, field := range p.fields {
+        if i > 0 {
+            buf.WriteByte(',')
+        }
+        name, _ := json.Marshal(field.json)
+        value, err := json.Marshal(field.value)
+        if err != nil {
+            return nil, err
+        }
+        buf.Write(name)
+        buf.WriteByte(':')
+        buf.Write(value)
+    }
+    buf.WriteByte('}')
+    return buf.Bytes(), nil
+}
+
+// EncodeMsgpack writes the fields as a map.
+func (p ProductView) EncodeMsgpack(enc *msgpack.Encoder) error {
+    if err := enc.EncodeMapLen(len(p.fields)); err != nil {
+        return err
+    }
+    for _, field := range p.fields {
+        if err := enc.EncodeString(field.json); err != nil {
+            return err
+        }
+        if err := enc.Encode(field.value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// MarshalXML writes the fields as child elements, including wrappers like images>image.
+func (p ProductView) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    if err := e.EncodeToken(start); err != nil {
+        return err
+    }
+    for _, field := range p.fields {
+        parent, child, nested := strings.Cut(field.xml, ">")
+        if !nested {
+            child = parent
+        } else if err := e.EncodeToken(xml.StartElement{Name: xml.Name{Local: parent}}); err != nil {
+            return err
+        }
+        if err := e.EncodeElement(field.value, xml.StartElement{Name: xml.Name{Local: child}}); err != nil {
+            return err
+        }
+        if nested {
+            if err := e.EncodeToken(xml.EndElement{Name: xml.Name{Local: parent}}); err != nil {
+                return err
+            }
+        }
+    }
+    return e.EncodeToken(start.End())
+}
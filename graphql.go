@@ -0,0 +1,920 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// This file is a small GraphQL engine serving /graphql. It implements the parts of the
+// language the product schema needs: queries and mutations, arguments and variables,
+// aliases, fragments and __typename. Introspection and directives are not supported; the
+// schema is published as SDL at /graphql/schema instead.
+
+// maxGraphQLDepth bounds how deeply selections may nest, so that a query can't walk
+// product → category → products → ... until it has read the whole database.
+const maxGraphQLDepth = 8
+
+// GraphQLRequest is the body of a POST /graphql request.
+type GraphQLRequest struct {
+    Query         string                 `json:"query"`
+    OperationName string                 `json:"operationName"`
+    Variables     map[string]interface{} `json:"variables"`
+    // Extensions are sent by some clients, like for persisted queries, and ignored.
+    Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// GraphQLError is an error in a GraphQL response. Path locates the field that failed.
+type GraphQLError struct {
+    Message string        `json:"message"`
+    Path    []interface{} `json:"path,omitempty"`
+}
+
+// GraphQLResponse is the body of every /graphql response.
+type GraphQLResponse struct {
+    Data   interface{}    `json:"data"`
+    Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// graphqlField describes a field of an object type. Type names the object type of the
+// result, or is empty for scalars. Resolve receives the object the field is selected on
+// and the field's arguments, with variables already substituted.
+type graphqlField struct {
+    Type    string
+    Resolve func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error)
+}
+
+// graphqlSchema maps each object type to its fields.
+type graphqlSchema map[string]map[string]graphqlField
+
+// graphqlHandler executes a GraphQL query or mutation against graphqlProductSchema.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+    var req GraphQLRequest
+    if err := decodeJSON(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+
+    // Requests that can't be executed at all are answered with 400 and no data.
+    doc, err := parseGraphQL(req.Query)
+    var op *graphqlOperation
+    if err == nil {
+        op, err = doc.operation(req.OperationName)
+    }
+    var variables map[string]interface{}
+    if err == nil {
+        variables, err = op.coerceVariables(req.Variables)
+    }
+    if err != nil {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+        return
+    }
+
+    if op.kind == "mutation" && respondReadOnly(w, r) {
+        return
+    }
+
+    exec := &graphqlExecution{schema: graphqlProductSchema, fragments: doc.fragments, variables: variables}
+    rootType := "Query"
+    if op.kind == "mutation" {
+        rootType = "Mutation"
+    }
+    data := exec.executeSelections(r.Context(), rootType, nil, op.selections, nil, 0)
+    for _, e := range exec.errors {
+        if e.err != nil {
+            logError(r, e.err)
+        }
+    }
+
+    // If everything went well, return the data along with any field errors.
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(GraphQLResponse{Data: data, Errors: exec.responseErrors()})
+}
+
+// graphqlExecution holds the state of executing one operation.
+type graphqlExecution struct {
+    schema    graphqlSchema
+    fragments map[string]*graphqlFragment
+    variables map[string]interface{}
+    errors    []graphqlFieldError
+}
+
+// graphqlFieldError is a failed field. err is set for unexpected errors, which are logged
+// and not shown to the client.
+type graphqlFieldError struct {
+    GraphQLError
+    err error
+}
+
+// graphqlUserError is an error whose message is safe to return to the client.
+type graphqlUserError string
+
+func (e graphqlUserError) Error() string { return string(e) }
+
+// addError records the failure of the field at path.
+func (e *graphqlExecution) addError(path []interface{}, err error) {
+    fieldErr := graphqlFieldError{GraphQLError: GraphQLError{Path: append([]interface{}(nil), path...)}}
+    var userErr graphqlUserError
+    if errors.As(err, &userErr) {
+        fieldErr.Message = userErr.Error()
+    } else if errors.Is(err, context.DeadlineExceeded) {
+        fieldErr.Message = "The database did not respond in time."
+    } else {
+        fieldErr.Message = "Internal error."
+        fieldErr.err = err
+    }
+    e.errors = append(e.errors, fieldErr)
+}
+
+// responseErrors returns the errors to send to the client.
+func (e *graphqlExecution) responseErrors() []GraphQLError {
+    var errs []GraphQLError
+    for _, fieldErr := range e.errors {
+        errs = append(errs, fieldErr.GraphQLError)
+    }
+    return errs
+}
+
+// executeSelections resolves the selected fields of source, an object of type typeName.
+func (e *graphqlExecution) executeSelections(ctx context.Context, typeName string, source interface{}, selections []graphqlSelection, path []interface{}, depth int) *graphqlObject {
+    result := &graphqlObject{values: make(map[string]interface{})}
+    keys, fields := e.collectFields(typeName, selections, nil, make(map[string]*graphqlSelection))
+    for _, key := range keys {
+        sel := fields[key]
+        fieldPath := append(path, key)
+        if sel.name == "__typename" {
+            result.set(key, typeName)
+            continue
+        }
+        field, ok := e.schema[typeName][sel.name]
+        if !ok {
+            e.addError(fieldPath, graphqlUserError(fmt.Sprintf("Cannot query field %q on type %q.", sel.name, typeName)))
+            result.set(key, nil)
+            continue
+        }
+        args := make(map[string]interface{}, len(sel.args))
+        for _, arg := range sel.args {
+            args[arg.name] = substituteVariables(arg.value, e.variables)
+        }
+        value, err := field.Resolve(ctx, source, args)
+        if err != nil {
+            e.addError(fieldPath, err)
+            result.set(key, nil)
+            continue
+        }
+        result.set(key, e.completeValue(ctx, field.Type, value, sel.selections, fieldPath, depth+1))
+    }
+    return result
+}
+
+// completeValue turns a resolved value into its part of the response, resolving the
+// selections on objects and on each element of lists.
+func (e *graphqlExecution) completeValue(ctx context.Context, typeName string, value interface{}, selections []graphqlSelection, path []interface{}, depth int) interface{} {
+    v := reflect.ValueOf(value)
+    if value == nil || ((v.Kind() == reflect.Pointer || v.Kind() == reflect.Slice) && v.IsNil()) {
+        return nil
+    }
+    if v.Kind() == reflect.Slice {
+        list := make([]interface{}, v.Len())
+        for i := range list {
+            list[i] = e.completeValue(ctx, typeName, v.Index(i).Interface(), selections, append(path, i), depth)
+        }
+        return list
+    }
+    if typeName == "" {
+        if len(selections) > 0 {
+            e.addError(path, graphqlUserError("Scalar fields have no subfields."))
+            return nil
+        }
+        return value
+    }
+    if len(selections) == 0 {
+        e.addError(path, graphqlUserError(fmt.Sprintf("Field of type %q must have a selection of subfields.", typeName)))
+        return nil
+    }
+    if depth > maxGraphQLDepth {
+        e.addError(path, graphqlUserError("Query is nested too deeply."))
+        return nil
+    }
+    return e.executeSelections(ctx, typeName, value, selections, path, depth)
+}
+
+// collectFields flattens fragments into the fields they select on typeName, keyed by
+// response name. Fields selected more than once under the same name have their
+// subselections merged.
+func (e *graphqlExecution) collectFields(typeName string, selections []graphqlSelection, keys []string, fields map[string]*graphqlSelection) ([]string, map[string]*graphqlSelection) {
+    for i := range selections {
+        sel := &selections[i]
+        switch {
+        case sel.spread != "":
+            fragment, ok := e.fragments[sel.spread]
+            if ok && fragment.typeCondition == typeName {
+                keys, fields = e.collectFields(typeName, fragment.selections, keys, fields)
+            }
+        case sel.name == "":
+            if sel.typeCondition == "" || sel.typeCondition == typeName {
+                keys, fields = e.collectFields(typeName, sel.selections, keys, fields)
+            }
+        default:
+            key := sel.responseKey()
+            if existing, ok := fields[key]; ok {
+                merged := *existing
+                merged.selections = append(append([]graphqlSelection(nil), existing.selections...), sel.selections...)
+                fields[key] = &merged
+                continue
+            }
+            keys = append(keys, key)
+            fields[key] = sel
+        }
+    }
+    return keys, fields
+}
+
+// graphqlObject is a JSON object that keeps its keys in the order they were selected, as
+// GraphQL responses must.
+type graphqlObject struct {
+    keys   []string
+    values map[string]interface{}
+}
+
+func (o *graphqlObject) set(key string, value interface{}) {
+    if _, ok := o.values[key]; !ok {
+        o.keys = append(o.keys, key)
+    }
+    o.values[key] = value
+}
+
+func (o *graphqlObject) MarshalJSON() ([]byte, error) {
+    var b strings.Builder
+    b.WriteByte('{')
+    for i, key := range o.keys {
+        if i > 0 {
+            b.WriteByte(',')
+        }
+        name, _ := json.Marshal(key)
+        value, err := json.Marshal(o.values[key])
+        if err != nil {
+            return nil, err
+        }
+        b.Write(name)
+        b.WriteByte(':')
+        b.Write(value)
+    }
+    b.WriteByte('}')
+    return []byte(b.String()), nil
+}
+
+// graphqlVariable is a reference to a variable in a parsed value.
+type graphqlVariable string
+
+// substituteVariables replaces variable references in a parsed value with their values.
+func substituteVariables(value interface{}, variables map[string]interface{}) interface{} {
+    switch v := value.(type) {
+    case graphqlVariable:
+        return variables[string(v)]
+    case []interface{}:
+        list := make([]interface{}, len(v))
+        for i, item := range v {
+            list[i] = substituteVariables(item, variables)
+        }
+        return list
+    case map[string]interface{}:
+        object := make(map[string]interface{}, len(v))
+        for key, item := range v {
+            object[key] = substituteVariables(item, variables)
+        }
+        return object
+    }
+    return value
+}
+
+// Argument accessors for resolvers. Each reports a client error if the argument has the
+// wrong type; a missing or null argument yields the zero value and false.
+
+func argString(args map[string]interface{}, name string) (string, bool, error) {
+    switch v := args[name].(type) {
+    case nil:
+        return "", false, nil
+    case string:
+        return v, true, nil
+    }
+    return "", false, graphqlUserError(fmt.Sprintf("Argument %q must be a string.", name))
+}
+
+func argInt(args map[string]interface{}, name string) (int, bool, error) {
+    switch v := args[name].(type) {
+    case nil:
+        return 0, false, nil
+    case int:
+        return v, true, nil
+    case float64:
+        // Numbers in JSON variables arrive as floats.
+        if v == float64(int(v)) {
+            return int(v), true, nil
+        }
+    }
+    return 0, false, graphqlUserError(fmt.Sprintf("Argument %q must be an integer.", name))
+}
+
+func argFloat(args map[string]interface{}, name string) (float64, bool, error) {
+    switch v := args[name].(type) {
+    case nil:
+        return 0, false, nil
+    case int:
+        return float64(v), true, nil
+    case float64:
+        return v, true, nil
+    }
+    return 0, false, graphqlUserError(fmt.Sprintf("Argument %q must be a number.", name))
+}
+
+// argMoney reads an exact amount. The number arrives as a float, so it is formatted back to
+// its shortest decimal form and parsed from that.
+func argMoney(args map[string]interface{}, name string) (Money, bool, error) {
+    f, ok, err := argFloat(args, name)
+    if !ok || err != nil {
+        return 0, ok, err
+    }
+    m, err := ParseMoney(strconv.FormatFloat(f, 'f', -1, 64))
+    if err != nil {
+        return 0, false, graphqlUserError(fmt.Sprintf("Argument %q %s.", name, err))
+    }
+    return m, true, nil
+}
+
+func argBool(args map[string]interface{}, name string) (bool, bool, error) {
+    switch v := args[name].(type) {
+    case nil:
+        return false, false, nil
+    case bool:
+        return v, true, nil
+    }
+    return false, false, graphqlUserError(fmt.Sprintf("Argument %q must be a boolean.", name))
+}
+
+func argStrings(args map[string]interface{}, name string) ([]string, error) {
+    switch v := args[name].(type) {
+    case nil:
+        return nil, nil
+    case string:
+        // A single value is accepted where a list is expected.
+        return []string{v}, nil
+    case []interface{}:
+        list := make([]string, len(v))
+        for i, item := range v {
+            s, ok := item.(string)
+            if !ok {
+                return nil, graphqlUserError(fmt.Sprintf("Argument %q must be a list of strings.", name))
+            }
+            list[i] = s
+        }
+        return list, nil
+    }
+    return nil, graphqlUserError(fmt.Sprintf("Argument %q must be a list of strings.", name))
+}
+
+// Parsed documents.
+
+type graphqlDocument struct {
+    operations []*graphqlOperation
+    fragments  map[string]*graphqlFragment
+}
+
+type graphqlOperation struct {
+    kind       string
+    name       string
+    variables  []graphqlVariableDefinition
+    selections []graphqlSelection
+}
+
+type graphqlVariableDefinition struct {
+    name         string
+    nonNull      bool
+    defaultValue interface{}
+}
+
+type graphqlFragment struct {
+    typeCondition string
+    selections    []graphqlSelection
+}
+
+type graphqlArgument struct {
+    name  string
+    value interface{}
+}
+
+// graphqlSelection is a field, a fragment spread (spread is set) or an inline fragment
+// (name and spread are empty).
+type graphqlSelection struct {
+    alias         string
+    name          string
+    args          []graphqlArgument
+    selections    []graphqlSelection
+    spread        string
+    typeCondition string
+}
+
+func (s *graphqlSelection) responseKey() string {
+    if s.alias != "" {
+        return s.alias
+    }
+    return s.name
+}
+
+// operation picks the operation to execute: the one named, or the only one.
+func (d *graphqlDocument) operation(name string) (*graphqlOperation, error) {
+    if name == "" {
+        if len(d.operations) != 1 {
+            return nil, errors.New("operationName is required when the document has several operations.")
+        }
+        return d.operations[0], nil
+    }
+    for _, op := range d.operations {
+        if op.name == name {
+            return op, nil
+        }
+    }
+    return nil, fmt.Errorf("Unknown operation %q.", name)
+}
+
+// coerceVariables applies default values to the given variables and checks that the
+// required ones are present.
+func (op *graphqlOperation) coerceVariables(given map[string]interface{}) (map[string]interface{}, error) {
+    variables := make(map[string]interface{}, len(op.variables))
+    for _, def := range op.variables {
+        value, ok := given[def.name]
+        if !ok {
+            value = def.defaultValue
+        }
+        if value == nil && def.nonNull {
+            return nil, fmt.Errorf("Variable $%s is required.", def.name)
+        }
+        variables[def.name] = value
+    }
+    return variables, nil
+}
+
+// Lexing.
+
+type graphqlTokenKind int
+
+const (
+    graphqlEOF graphqlTokenKind = iota
+    graphqlPunctuator
+    graphqlName
+    graphqlInt
+    graphqlFloat
+    graphqlString
+)
+
+type graphqlToken struct {
+    kind  graphqlTokenKind
+    value string
+}
+
+type graphqlLexer struct {
+    src string
+    pos int
+}
+
+// next returns the next token, skipping whitespace, commas and comments.
+func (l *graphqlLexer) next() (graphqlToken, error) {
+    for l.pos < len(l.src) {
+        c := l.src[l.pos]
+        if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+            l.pos++
+        } else if c == '#' {
+            for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+                l.pos++
+            }
+        } else {
+            break
+        }
+    }
+    if l.pos >= len(l.src) {
+        return graphqlToken{kind: graphqlEOF}, nil
+    }
+
+    start := l.pos
+    c := l.src[l.pos]
+    switch {
+    case strings.HasPrefix(l.src[l.pos:], "..."):
+        l.pos += 3
+        return graphqlToken{kind: graphqlPunctuator, value: "..."}, nil
+    case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+        l.pos++
+        return graphqlToken{kind: graphqlPunctuator, value: string(c)}, nil
+    case c == '_' || isLetter(c):
+        for l.pos < len(l.src) && (l.src[l.pos] == '_' || isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+            l.pos++
+        }
+        return graphqlToken{kind: graphqlName, value: l.src[start:l.pos]}, nil
+    case c == '-' || isDigit(c):
+        kind := graphqlInt
+        l.pos++
+        for l.pos < len(l.src) {
+            d := l.src[l.pos]
+            if d == '.' || d == 'e' || d == 'E' || ((d == '+' || d == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E')) {
+                kind = graphqlFloat
+            } else if !isDigit(d) {
+                break
+            }
+            l.pos++
+        }
+        return graphqlToken{kind: kind, value: l.src[start:l.pos]}, nil
+    case c == '"':
+        return l.string()
+    }
+    return graphqlToken{}, fmt.Errorf("Syntax error: unexpected character %q.", c)
+}
+
+// string lexes a quoted string. Block strings are not supported.
+func (l *graphqlLexer) string() (graphqlToken, error) {
+    if strings.HasPrefix(l.src[l.pos:], `"""`) {
+        return graphqlToken{}, errors.New("Syntax error: block strings are not supported.")
+    }
+    start := l.pos
+    l.pos++
+    for l.pos < len(l.src) {
+        switch l.src[l.pos] {
+        case '\\':
+            l.pos += 2
+            continue
+        case '\n':
+            return graphqlToken{}, errors.New("Syntax error: unterminated string.")
+        case '"':
+            l.pos++
+            // GraphQL string escapes are a subset of Go's, apart from \u{...} which we
+            // don't accept.
+            value, err := strconv.Unquote(l.src[start:l.pos])
+            if err != nil {
+                return graphqlToken{}, errors.New("Syntax error: invalid string.")
+            }
+            return graphqlToken{kind: graphqlString, value: value}, nil
+        }
+        l.pos++
+    }
+    return graphqlToken{}, errors.New("Syntax error: unterminated string.")
+}
+
+func isLetter(c byte) bool {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// Parsing.
+
+type graphqlParser struct {
+    lexer graphqlLexer
+    token graphqlToken
+}
+
+// parseGraphQL parses a query document.
+func parseGraphQL(src string) (doc *graphqlDocument, err error) {
+    p := &graphqlParser{lexer: graphqlLexer{src: src}}
+    if err := p.advance(); err != nil {
+        return nil, err
+    }
+    doc = &graphqlDocument{fragments: make(map[string]*graphqlFragment)}
+    for p.token.kind != graphqlEOF {
+        switch {
+        case p.peek(graphqlPunctuator, "{"):
+            selections, err := p.selectionSet()
+            if err != nil {
+                return nil, err
+            }
+            doc.operations = append(doc.operations, &graphqlOperation{kind: "query", selections: selections})
+        case p.peek(graphqlName, "query"), p.peek(graphqlName, "mutation"):
+            op, err := p.operation()
+            if err != nil {
+                return nil, err
+            }
+            doc.operations = append(doc.operations, op)
+        case p.peek(graphqlName, "fragment"):
+            name, fragment, err := p.fragment()
+            if err != nil {
+                return nil, err
+            }
+            doc.fragments[name] = fragment
+        default:
+            return nil, p.unexpected()
+        }
+    }
+    if len(doc.operations) == 0 {
+        return nil, errors.New("The document has no operations.")
+    }
+    return doc, nil
+}
+
+func (p *graphqlParser) advance() (err error) {
+    p.token, err = p.lexer.next()
+    return err
+}
+
+// peek reports whether the current token is the given one. An empty value matches any
+// token of the kind.
+func (p *graphqlParser) peek(kind graphqlTokenKind, value string) bool {
+    return p.token.kind == kind && (value == "" || p.token.value == value)
+}
+
+// skip consumes the current token if it is the given one, and reports whether it did.
+func (p *graphqlParser) skip(kind graphqlTokenKind, value string) (bool, error) {
+    if !p.peek(kind, value) {
+        return false, nil
+    }
+    return true, p.advance()
+}
+
+// expect consumes the given token and returns its value, or fails.
+func (p *graphqlParser) expect(kind graphqlTokenKind, value string) (string, error) {
+    if !p.peek(kind, value) {
+        return "", p.unexpected()
+    }
+    found := p.token.value
+    return found, p.advance()
+}
+
+func (p *graphqlParser) unexpected() error {
+    if p.token.kind == graphqlEOF {
+        return errors.New("Syntax error: unexpected end of document.")
+    }
+    return fmt.Errorf("Syntax error: unexpected %q.", p.token.value)
+}
+
+func (p *graphqlParser) operation() (*graphqlOperation, error) {
+    op := &graphqlOperation{kind: p.token.value}
+    if err := p.advance(); err != nil {
+        return nil, err
+    }
+    if p.peek(graphqlName, "") {
+        op.name = p.token.value
+        if err := p.advance(); err != nil {
+            return nil, err
+        }
+    }
+    if ok, err := p.skip(graphqlPunctuator, "("); err != nil {
+        return nil, err
+    } else if ok {
+        for !p.peek(graphqlPunctuator, ")") {
+            def, err := p.variableDefinition()
+            if err != nil {
+                return nil, err
+            }
+            op.variables = append(op.variables, def)
+        }
+        if err := p.advance(); err != nil {
+            return nil, err
+        }
+    }
+    if err := p.noDirectives(); err != nil {
+        return nil, err
+    }
+    var err error
+    op.selections, err = p.selectionSet()
+    return op, err
+}
+
+// variableDefinition parses "$name: Type = default". Types are only checked for being
+// non-null; values are checked by the resolvers that use them.
+func (p *graphqlParser) variableDefinition() (graphqlVariableDefinition, error) {
+    var def graphqlVariableDefinition
+    if _, err := p.expect(graphqlPunctuator, "$"); err != nil {
+        return def, err
+    }
+    name, err := p.expect(graphqlName, "")
+    if err != nil {
+        return def, err
+    }
+    def.name = name
+    if _, err := p.expect(graphqlPunctuator, ":"); err != nil {
+        return def, err
+    }
+    if def.nonNull, err = p.typeReference(); err != nil {
+        return def, err
+    }
+    if ok, err := p.skip(graphqlPunctuator, "="); err != nil {
+        return def, err
+    } else if ok {
+        if def.defaultValue, err = p.value(true); err != nil {
+            return def, err
+        }
+    }
+    return def, nil
+}
+
+// typeReference parses a type such as [String!]! and reports whether it is non-null.
+func (p *graphqlParser) typeReference() (bool, error) {
+    if ok, err := p.skip(graphqlPunctuator, "["); err != nil {
+        return false, err
+    } else if ok {
+        if _, err := p.typeReference(); err != nil {
+            return false, err
+        }
+        if _, err := p.expect(graphqlPunctuator, "]"); err != nil {
+            return false, err
+        }
+    } else if _, err := p.expect(graphqlName, ""); err != nil {
+        return false, err
+    }
+    return p.skip(graphqlPunctuator, "!")
+}
+
+func (p *graphqlParser) fragment() (string, *graphqlFragment, error) {
+    if err := p.advance(); err != nil {
+        return "", nil, err
+    }
+    name, err := p.expect(graphqlName, "")
+    if err != nil {
+        return "", nil, err
+    }
+    if _, err := p.expect(graphqlName, "on"); err != nil {
+        return "", nil, err
+    }
+    fragment := &graphqlFragment{}
+    if fragment.typeCondition, err = p.expect(graphqlName, ""); err != nil {
+        return "", nil, err
+    }
+    if err := p.noDirectives(); err != nil {
+        return "", nil, err
+    }
+    fragment.selections, err = p.selectionSet()
+    return name, fragment, err
+}
+
+func (p *graphqlParser) selectionSet() ([]graphqlSelection, error) {
+    if _, err := p.expect(graphqlPunctuator, "{"); err != nil {
+        return nil, err
+    }
+    var selections []graphqlSelection
+    for !p.peek(graphqlPunctuator, "}") {
+        sel, err := p.selection()
+        if err != nil {
+            return nil, err
+        }
+        selections = append(selections, sel)
+    }
+    if len(selections) == 0 {
+        return nil, errors.New("Syntax error: empty selection set.")
+    }
+    return selections, p.advance()
+}
+
+func (p *graphqlParser) selection() (graphqlSelection, error) {
+    var sel graphqlSelection
+    if ok, err := p.skip(graphqlPunctuator, "..."); err != nil {
+        return sel, err
+    } else if ok {
+        if p.peek(graphqlName, "") && p.token.value != "on" {
+            sel.spread = p.token.value
+            if err := p.advance(); err != nil {
+                return sel, err
+            }
+            return sel, p.noDirectives()
+        }
+        if ok, err := p.skip(graphqlName, "on"); err != nil {
+            return sel, err
+        } else if ok {
+            if sel.typeCondition, err = p.expect(graphqlName, ""); err != nil {
+                return sel, err
+            }
+        }
+        if err := p.noDirectives(); err != nil {
+            return sel, err
+        }
+        var err error
+        sel.selections, err = p.selectionSet()
+        return sel, err
+    }
+
+    name, err := p.expect(graphqlName, "")
+    if err != nil {
+        return sel, err
+    }
+    if ok, err := p.skip(graphqlPunctuator, ":"); err != nil {
+        return sel, err
+    } else if ok {
+        sel.alias = name
+        if name, err = p.expect(graphqlName, ""); err != nil {
+            return sel, err
+        }
+    }
+    sel.name = name
+
+    if ok, err := p.skip(graphqlPunctuator, "("); err != nil {
+        return sel, err
+    } else if ok {
+        for !p.peek(graphqlPunctuator, ")") {
+            argName, err := p.expect(graphqlName, "")
+            if err != nil {
+                return sel, err
+            }
+            if _, err := p.expect(graphqlPunctuator, ":"); err != nil {
+                return sel, err
+            }
+            value, err := p.value(false)
+            if err != nil {
+                return sel, err
+            }
+            sel.args = append(sel.args, graphqlArgument{name: argName, value: value})
+        }
+        if err := p.advance(); err != nil {
+            return sel, err
+        }
+    }
+    if err := p.noDirectives(); err != nil {
+        return sel, err
+    }
+    if p.peek(graphqlPunctuator, "{") {
+        sel.selections, err = p.selectionSet()
+    }
+    return sel, err
+}
+
+// noDirectives rejects directives, which this engine does not implement.
+func (p *graphqlParser) noDirectives() error {
+    if p.peek(graphqlPunctuator, "@") {
+        return errors.New("Directives are not supported.")
+    }
+    return nil
+}
+
+// value parses an input value. Enum values are returned as strings. Constant values, such
+// as variable defaults, can't refer to variables.
+func (p *graphqlParser) value(constant bool) (interface{}, error) {
+    token := p.token
+    switch {
+    case p.peek(graphqlPunctuator, "$") && !constant:
+        if err := p.advance(); err != nil {
+            return nil, err
+        }
+        name, err := p.expect(graphqlName, "")
+        return graphqlVariable(name), err
+    case token.kind == graphqlInt:
+        n, err := strconv.Atoi(token.value)
+        if err != nil {
+            return nil, fmt.Errorf("Syntax error: invalid integer %q.", token.value)
+        }
+        return n, p.advance()
+    case token.kind == graphqlFloat:
+        f, err := strconv.ParseFloat(token.value, 64)
+        if err != nil {
+            return nil, fmt.Errorf("Syntax error: invalid number %q.", token.value)
+        }
+        return f, p.advance()
+    case token.kind == graphqlString:
+        return token.value, p.advance()
+    case token.kind == graphqlName:
+        var value interface{} = token.value
+        switch token.value {
+        case "true":
+            value = true
+        case "false":
+            value = false
+        case "null":
+            value = nil
+        }
+        return value, p.advance()
+    case p.peek(graphqlPunctuator, "["):
+        if err := p.advance(); err != nil {
+            return nil, err
+        }
+        list := []interface{}{}
+        for !p.peek(graphqlPunctuator, "]") {
+            item, err := p.value(constant)
+            if err != nil {
+                return nil, err
+            }
+            list = append(list, item)
+        }
+        return list, p.advance()
+    case p.peek(graphqlPunctuator, "{"):
+        if err := p.advance(); err != nil {
+            return nil, err
+        }
+        object := map[string]interface{}{}
+        for !p.peek(graphqlPunctuator, "}") {
+            name, err := p.expect(graphqlName, "")
+            if err != nil {
+                return nil, err
+            }
+            if _, err := p.expect(graphqlPunctuator, ":"); err != nil {
+                return nil, err
+            }
+            if object[name], err = p.value(constant); err != nil {
+                return nil, err
+            }
+        }
+        return object, p.advance()
+    }
+    return nil, p.unexpected()
+}
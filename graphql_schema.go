@@ -0,0 +1,509 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// graphqlSchemaSDL describes graphqlProductSchema in the GraphQL schema language. It is
+// served at /graphql/schema and has to be kept in step with the resolvers below.
+const graphqlSchemaSDL = `scalar Time
+
+type Query {
+  product(id: Int!): Product
+  products(name: String, categories: [String!], minPrice: Float, maxPrice: Float, sort: String, desc: Boolean, first: Int, after: String): ProductConnection!
+  categories: [Category!]!
+  category(id: Int!): Category
+}
+
+type Mutation {
+  createProduct(input: ProductInput!): Product!
+  # version is the product's current version; 0 skips the check.
+  updateProduct(id: Int!, version: Int!, input: ProductInput!): Product!
+  deleteProduct(id: Int!, version: Int!): Boolean!
+}
+
+type Product {
+  id: Int!
+  name: String!
+  price: Float!
+  currency: String!
+  imageUrl: String!
+  barcode: String!
+  sku: String!
+  averageRating: Float!
+  reviewCount: Int!
+  tags: [String!]!
+  createdAt: Time!
+  updatedAt: Time!
+  version: Int!
+  category: Category
+  stock: StockLevel
+}
+
+type ProductConnection {
+  nodes: [Product!]!
+  totalCount: Int!
+  totalCountApproximate: Boolean!
+  partial: Boolean!
+  nextCursor: String
+}
+
+type Category {
+  id: Int!
+  name: String!
+  createdAt: Time!
+  parent: Category
+  children: [Category!]!
+  # Products of this category and all of its subcategories.
+  products(sort: String, desc: Boolean, first: Int, after: String): ProductConnection!
+}
+
+type StockLevel {
+  quantity: Int!
+  adjustments(first: Int = 20): [StockAdjustment!]!
+}
+
+type StockAdjustment {
+  id: Int!
+  delta: Int!
+  reason: String!
+  note: String!
+  quantity: Int!
+  createdAt: Time!
+}
+
+input ProductInput {
+  name: String!
+  category: String!
+  price: Float!
+  currency: String
+  imageUrl: String
+  barcode: String
+  sku: String
+}
+`
+
+// maxStockAdjustments caps how many adjustments StockLevel.adjustments returns.
+const maxStockAdjustments = 100
+
+// graphqlProductSchema is the schema served at /graphql. Reads need the viewer role, like
+// the REST API, and mutations check for the role their REST counterpart needs.
+var graphqlProductSchema = graphqlSchema{
+    "Query": {
+        "product":    {Type: "Product", Resolve: resolveProduct},
+        "products":   {Type: "ProductConnection", Resolve: resolveProducts},
+        "categories": {Type: "Category", Resolve: resolveCategories},
+        "category":   {Type: "Category", Resolve: resolveCategory},
+    },
+    "Mutation": {
+        "createProduct": {Type: "Product", Resolve: resolveCreateProduct},
+        "updateProduct": {Type: "Product", Resolve: resolveUpdateProduct},
+        "deleteProduct": {Resolve: resolveDeleteProduct},
+    },
+    "Product": {
+        "id":            productField(func(p Product) interface{} { return p.ID }),
+        "name":          productField(func(p Product) interface{} { return p.Name }),
+        "price":         productField(func(p Product) interface{} { return p.Price.Float64() }),
+        "currency":      productField(func(p Product) interface{} { return p.Currency }),
+        "imageUrl":      productField(func(p Product) interface{} { return p.ImageURL }),
+        "barcode":       productField(func(p Product) interface{} { return p.Barcode }),
+        "sku":           productField(func(p Product) interface{} { return p.SKU }),
+        "averageRating": productField(func(p Product) interface{} { return p.AverageRating }),
+        "reviewCount":   productField(func(p Product) interface{} { return p.ReviewCount }),
+        "tags":          productField(func(p Product) interface{} { return p.Tags.Names() }),
+        "createdAt":     productField(func(p Product) interface{} { return p.CreatedAt }),
+        "updatedAt":     productField(func(p Product) interface{} { return p.UpdatedAt }),
+        "version":       productField(func(p Product) interface{} { return p.Version }),
+        "category":      {Type: "Category", Resolve: resolveProductCategory},
+        "stock":         {Type: "StockLevel", Resolve: resolveProductStock},
+    },
+    "ProductConnection": {
+        "nodes":                 {Type: "Product", Resolve: listField(func(l ProductList) interface{} { return l.Products })},
+        "totalCount":            {Resolve: listField(func(l ProductList) interface{} { return l.Total })},
+        "totalCountApproximate": {Resolve: listField(func(l ProductList) interface{} { return l.TotalApproximate })},
+        "partial":               {Resolve: listField(func(l ProductList) interface{} { return l.Partial })},
+        "nextCursor": {Resolve: listField(func(l ProductList) interface{} {
+            if l.NextCursor == "" {
+                return nil
+            }
+            return l.NextCursor
+        })},
+    },
+    "Category": {
+        "id":        categoryField(func(c *Category) interface{} { return c.ID }),
+        "name":      categoryField(func(c *Category) interface{} { return c.Name }),
+        "createdAt": categoryField(func(c *Category) interface{} { return c.CreatedAt }),
+        "parent":    {Type: "Category", Resolve: resolveCategoryParent},
+        "children":  {Type: "Category", Resolve: resolveCategoryChildren},
+        "products":  {Type: "ProductConnection", Resolve: resolveCategoryProducts},
+    },
+    "StockLevel": {
+        "quantity": {Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+            return source.(StockLevel).Quantity, nil
+        }},
+        "adjustments": {Type: "StockAdjustment", Resolve: resolveStockAdjustments},
+    },
+    "StockAdjustment": {
+        "id":        adjustmentField(func(a StockAdjustment) interface{} { return a.ID }),
+        "delta":     adjustmentField(func(a StockAdjustment) interface{} { return a.Delta }),
+        "reason":    adjustmentField(func(a StockAdjustment) interface{} { return a.Reason }),
+        "note":      adjustmentField(func(a StockAdjustment) interface{} { return a.Note }),
+        "quantity":  adjustmentField(func(a StockAdjustment) interface{} { return a.Quantity }),
+        "createdAt": adjustmentField(func(a StockAdjustment) interface{} { return a.CreatedAt }),
+    },
+}
+
+// getGraphQLSchema returns the schema served at /graphql in the GraphQL schema language.
+func getGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Write([]byte(graphqlSchemaSDL))
+}
+
+// Field helpers for scalars that are read straight off their object.
+
+func productField(get func(Product) interface{}) graphqlField {
+    return graphqlField{Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+        return get(source.(Product)), nil
+    }}
+}
+
+func listField(get func(ProductList) interface{}) func(context.Context, interface{}, map[string]interface{}) (interface{}, error) {
+    return func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+        return get(source.(ProductList)), nil
+    }
+}
+
+func categoryField(get func(*Category) interface{}) graphqlField {
+    return graphqlField{Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+        return get(source.(*Category)), nil
+    }}
+}
+
+func adjustmentField(get func(StockAdjustment) interface{}) graphqlField {
+    return graphqlField{Resolve: func(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+        return get(source.(StockAdjustment)), nil
+    }}
+}
+
+// graphqlRequireRole fails a mutation unless the request was authenticated with at least
+// the given role.
+func graphqlRequireRole(ctx context.Context, role Role) error {
+    principal, ok := principalFromContext(ctx)
+    if !ok || !principal.Role.Includes(role) {
+        return graphqlUserError("Forbidden.")
+    }
+    return nil
+}
+
+// graphqlStoreError converts the repository's errors into messages for the client.
+// Unexpected errors are passed through, to be logged and hidden.
+func graphqlStoreError(err error) error {
+    switch err {
+    case ErrProductNotFound:
+        return graphqlUserError("Product not found.")
+    case ErrBarcodeInUse:
+        return graphqlUserError("Barcode is already in use.")
+    case ErrSKUInUse:
+        return graphqlUserError("SKU is already in use.")
+    case ErrUnknownCategory:
+        return graphqlValidationError(unknownCategoryErrors)
+    case ErrUnknownVendor:
+        return graphqlValidationError(unknownVendorErrors)
+    case ErrVersionMismatch:
+        return graphqlUserError("Product has been changed since it was read; fetch it again and retry.")
+    case ErrForbidden:
+        return graphqlUserError("Forbidden.")
+    }
+    return err
+}
+
+// graphqlValidationError reports invalid fields in one message.
+func graphqlValidationError(errs ValidationErrors) error {
+    messages := make([]string, len(errs))
+    for i, e := range errs {
+        messages[i] = e.Field + " " + e.Message
+    }
+    return graphqlUserError("Validation failed: " + strings.Join(messages, "; ") + ".")
+}
+
+// listArgs reads the sort and paging arguments shared by the product connections.
+func listArgs(args map[string]interface{}) (listParams, error) {
+    var params listParams
+    var err error
+    if params.Sort, _, err = argString(args, "sort"); err != nil {
+        return params, err
+    }
+    if params.Desc, _, err = argBool(args, "desc"); err != nil {
+        return params, err
+    }
+    if params.Limit, _, err = argInt(args, "first"); err != nil {
+        return params, err
+    }
+    params.Cursor, _, err = argString(args, "after")
+    return params, err
+}
+
+// listProductPage fetches a page of products for a connection field.
+func listProductPage(ctx context.Context, params listParams) (interface{}, error) {
+    q, err := parseListQuery(params.values(), time.Now())
+    if err != nil {
+        return nil, graphqlUserError(err.Error())
+    }
+    q.Filter.PublishedOnly = !includeUnpublished(ctx)
+    list, err := Repo.List(ctx, q)
+    if err != nil {
+        return nil, err
+    }
+    return list, nil
+}
+
+func resolveProduct(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    id, _, err := argInt(args, "id")
+    if err != nil {
+        return nil, err
+    }
+    product, err := Repo.GetByID(ctx, id)
+    if err == ErrProductNotFound {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if err := authorizeProduct(ctx, ActionRead, product); err == ErrProductNotFound {
+        return nil, nil
+    } else if err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    return product, nil
+}
+
+func resolveProducts(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    params, err := listArgs(args)
+    if err != nil {
+        return nil, err
+    }
+    if params.Name, _, err = argString(args, "name"); err != nil {
+        return nil, err
+    }
+    if params.Categories, err = argStrings(args, "categories"); err != nil {
+        return nil, err
+    }
+    if minPrice, ok, err := argFloat(args, "minPrice"); err != nil {
+        return nil, err
+    } else if ok {
+        params.MinPrice = &minPrice
+    }
+    if maxPrice, ok, err := argFloat(args, "maxPrice"); err != nil {
+        return nil, err
+    } else if ok {
+        params.MaxPrice = &maxPrice
+    }
+    return listProductPage(ctx, params)
+}
+
+func resolveCategories(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    return queryCategories(ctx, "")
+}
+
+func resolveCategory(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    id, _, err := argInt(args, "id")
+    if err != nil {
+        return nil, err
+    }
+    category, err := queryCategory(ctx, id)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return &category, nil
+}
+
+// productInput reads a ProductInput argument.
+func productInput(args map[string]interface{}) (Product, error) {
+    input, ok := args["input"].(map[string]interface{})
+    if !ok {
+        return Product{}, graphqlUserError(`Argument "input" must be an object.`)
+    }
+    var product Product
+    var err error
+    if product.Name, _, err = argString(input, "name"); err != nil {
+        return product, err
+    }
+    if product.Category, _, err = argString(input, "category"); err != nil {
+        return product, err
+    }
+    if product.Price, _, err = argMoney(input, "price"); err != nil {
+        return product, err
+    }
+    if product.Currency, _, err = argString(input, "currency"); err != nil {
+        return product, err
+    }
+    if product.ImageURL, _, err = argString(input, "imageUrl"); err != nil {
+        return product, err
+    }
+    if product.Barcode, _, err = argString(input, "barcode"); err != nil {
+        return product, err
+    }
+    product.SKU, _, err = argString(input, "sku")
+    return product, err
+}
+
+func resolveCreateProduct(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    if err := graphqlRequireRole(ctx, RoleEditor); err != nil {
+        return nil, err
+    }
+    product, err := productInput(args)
+    if err != nil {
+        return nil, err
+    }
+    if errs := product.Validate(); len(errs) > 0 {
+        return nil, graphqlValidationError(errs)
+    }
+    if err := authorizeProduct(ctx, ActionCreate, product); err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    if err := Repo.Create(ctx, &product); err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    if err := invalidateProductLists(ctx); err != nil {
+        logContextError(ctx, err)
+    }
+    return product, nil
+}
+
+func resolveUpdateProduct(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    if err := graphqlRequireRole(ctx, RoleEditor); err != nil {
+        return nil, err
+    }
+    product, err := productInput(args)
+    if err != nil {
+        return nil, err
+    }
+    if product.ID, _, err = argInt(args, "id"); err != nil {
+        return nil, err
+    }
+    if product.Version, _, err = argInt(args, "version"); err != nil {
+        return nil, err
+    }
+    if errs := product.Validate(); len(errs) > 0 {
+        return nil, graphqlValidationError(errs)
+    }
+    if err := authorizeProductID(ctx, ActionUpdate, product.ID); err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    changed, err := Repo.Update(ctx, &product)
+    if err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    if changed {
+        if err := invalidateProduct(ctx, product.ID); err != nil {
+            logContextError(ctx, err)
+        }
+    }
+    return product, nil
+}
+
+func resolveDeleteProduct(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    if err := graphqlRequireRole(ctx, RoleAdmin); err != nil {
+        return nil, err
+    }
+    id, _, err := argInt(args, "id")
+    if err != nil {
+        return nil, err
+    }
+    version, _, err := argInt(args, "version")
+    if err != nil {
+        return nil, err
+    }
+    if err := authorizeProductID(ctx, ActionDelete, id); err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    if err := Repo.Delete(ctx, id, version); err != nil {
+        return nil, graphqlStoreError(err)
+    }
+    if err := invalidateProduct(ctx, id); err != nil {
+        logContextError(ctx, err)
+    }
+    return true, nil
+}
+
+func resolveProductCategory(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    category, err := queryCategoryByName(ctx, source.(Product).Category)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return &category, nil
+}
+
+func resolveProductStock(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    level, err := queryStockLevel(ctx, source.(Product).ID)
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    return level, nil
+}
+
+func resolveCategoryParent(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    parentID := source.(*Category).ParentID
+    if parentID == nil {
+        return nil, nil
+    }
+    parent, err := queryCategory(ctx, *parentID)
+    if err != nil {
+        return nil, err
+    }
+    return &parent, nil
+}
+
+func resolveCategoryChildren(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    return queryCategories(ctx, "WHERE parent_id = $1", source.(*Category).ID)
+}
+
+func resolveCategoryProducts(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    params, err := listArgs(args)
+    if err != nil {
+        return nil, err
+    }
+    if params.Categories, err = categorySubtreeNames(ctx, source.(*Category).ID); err != nil {
+        return nil, err
+    }
+    return listProductPage(ctx, params)
+}
+
+func resolveStockAdjustments(ctx context.Context, source interface{}, args map[string]interface{}) (interface{}, error) {
+    limit, ok, err := argInt(args, "first")
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        limit = 20
+    }
+    if limit < 1 || limit > maxStockAdjustments {
+        return nil, graphqlUserError("Argument \"first\" must be between 1 and 100.")
+    }
+
+    rows, err := Reads.QueryContext(ctx, "SELECT id, product_id, delta, reason, note, quantity, created_at FROM stock_adjustments WHERE product_id = $1 ORDER BY id DESC LIMIT $2",
+        source.(StockLevel).ProductID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    adjustments := []StockAdjustment{}
+    for rows.Next() {
+        var a StockAdjustment
+        if err := rows.Scan(&a.ID, &a.ProductID, &a.Delta, &a.Reason, &a.Note, &a.Quantity, &a.CreatedAt); err != nil {
+            return nil, err
+        }
+        adjustments = append(adjustments, a)
+    }
+    return adjustments, rows.Err()
+}
@@ -0,0 +1,286 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative product.proto
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcMethodRoles is the role each ProductService method requires, the same as its REST
+// counterpart.
+var grpcMethodRoles = map[string]Role{
+    ProductService_GetProduct_FullMethodName:    RoleViewer,
+    ProductService_ListProducts_FullMethodName:  RoleViewer,
+    ProductService_CreateProduct_FullMethodName: RoleEditor,
+    ProductService_UpdateProduct_FullMethodName: RoleEditor,
+    ProductService_DeleteProduct_FullMethodName: RoleAdmin,
+}
+
+// newGRPCServer returns a gRPC server exposing ProductService.
+func newGRPCServer() *grpc.Server {
+    server := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcRequestInterceptor, grpcAuthInterceptor))
+    RegisterProductServiceServer(server, productServer{})
+    return server
+}
+
+// stopGRPCServer lets in-flight calls finish, but cuts them off when ctx is done.
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+    stopped := make(chan struct{})
+    go func() {
+        server.GracefulStop()
+        close(stopped)
+    }()
+    select {
+    case <-stopped:
+    case <-ctx.Done():
+        server.Stop()
+    }
+}
+
+// grpcRequestInterceptor gives every call a request ID for the audit log and the same
+// database deadline as an HTTP request.
+func grpcRequestInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    ctx = context.WithValue(ctx, requestIDKey, newID())
+    if AppConfig.DBQueryTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, AppConfig.DBQueryTimeout)
+        defer cancel()
+    }
+    return handler(ctx, req)
+}
+
+// grpcAuthInterceptor scopes a call to the tenant named by its tenant header metadata,
+// authenticates it from its authorization or x-api-key metadata, which take the same
+// credentials as the HTTP headers, and checks it against the role the method requires.
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+    role, ok := grpcMethodRoles[info.FullMethod]
+    if !ok {
+        return nil, status.Error(codes.Unimplemented, "Unknown method.")
+    }
+    // Only the methods for viewers leave the catalog as it is.
+    if mode := currentReadOnlyMode(); mode.Enabled && role != RoleViewer {
+        return nil, status.Error(codes.Unavailable, mode.reason())
+    }
+
+    // authenticate works on HTTP requests, so present the credentials as one.
+    r, err := http.NewRequestWithContext(ctx, http.MethodPost, info.FullMethod, nil)
+    if err != nil {
+        return nil, err
+    }
+    md, _ := metadata.FromIncomingContext(ctx)
+    if values := md.Get("authorization"); len(values) > 0 {
+        r.Header.Set("Authorization", values[0])
+    }
+    if values := md.Get("x-api-key"); len(values) > 0 {
+        r.Header.Set("X-API-Key", values[0])
+    }
+    if values := md.Get(strings.ToLower(AppConfig.TenantHeader)); len(values) > 0 {
+        r.Header.Set(AppConfig.TenantHeader, values[0])
+    }
+
+    tenant, err := resolveTenant(ctx, tenantSlugFromRequest(r))
+    switch {
+    case err == errTenantNotFound:
+        return nil, status.Error(codes.NotFound, "Tenant not found.")
+    case err == errTenantDisabled:
+        return nil, status.Error(codes.PermissionDenied, "Tenant is disabled.")
+    case err != nil:
+        return nil, grpcStoreError(ctx, info.FullMethod, err)
+    }
+    ctx = withTenant(ctx, tenant)
+    r = r.WithContext(ctx)
+
+    principal, ok, err := authenticate(r)
+    if err == errInvalidCredentials {
+        return nil, status.Error(codes.Unauthenticated, "Unauthorized.")
+    } else if err != nil {
+        return nil, grpcStoreError(ctx, info.FullMethod, err)
+    }
+    if !ok {
+        if role == RoleViewer && AppConfig.PublicReads {
+            return handler(ctx, req)
+        }
+        return nil, status.Error(codes.Unauthenticated, "Unauthorized.")
+    }
+    if !principal.Role.Includes(role) {
+        return nil, status.Error(codes.PermissionDenied, "Forbidden.")
+    }
+    return handler(context.WithValue(ctx, principalContextKey, principal), req)
+}
+
+// grpcStoreError converts a repository error into a gRPC status. Unexpected errors are
+// logged and reported as INTERNAL without their details.
+func grpcStoreError(ctx context.Context, method string, err error) error {
+    switch {
+    case err == ErrProductNotFound:
+        return status.Error(codes.NotFound, "Product not found.")
+    case err == ErrBarcodeInUse:
+        return status.Error(codes.AlreadyExists, "Barcode is already in use.")
+    case err == ErrSKUInUse:
+        return status.Error(codes.AlreadyExists, "SKU is already in use.")
+    case err == ErrUnknownCategory:
+        return grpcValidationError(unknownCategoryErrors)
+    case err == ErrUnknownVendor:
+        return grpcValidationError(unknownVendorErrors)
+    case err == ErrVersionMismatch:
+        return status.Error(codes.FailedPrecondition, "Product has been changed since it was read; fetch it again and retry.")
+    case err == ErrForbidden:
+        return status.Error(codes.PermissionDenied, "Forbidden.")
+    case errors.Is(err, context.DeadlineExceeded):
+        return status.Error(codes.DeadlineExceeded, "The database did not respond in time.")
+    case errors.As(err, new(errDatabaseUnavailable)):
+        return status.Error(codes.Unavailable, "The database is unavailable.")
+    }
+    logContextError(ctx, err, "method", method)
+    return status.Error(codes.Internal, "Internal error.")
+}
+
+// grpcValidationError reports invalid fields as INVALID_ARGUMENT with a BadRequest detail
+// listing them.
+func grpcValidationError(errs ValidationErrors) error {
+    st := status.New(codes.InvalidArgument, "Validation failed.")
+    details := &errdetails.BadRequest{}
+    for _, e := range errs {
+        details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: e.Field, Description: e.Message})
+    }
+    if withDetails, err := st.WithDetails(details); err == nil {
+        st = withDetails
+    }
+    return st.Err()
+}
+
+// productMessage converts a product to its wire form.
+func productMessage(p Product) *ProductMessage {
+    return &ProductMessage{
+        Id:        int32(p.ID),
+        Name:      p.Name,
+        Category:  p.Category,
+        Price:     p.Price.Float64(),
+        ImageUrl:  p.ImageURL,
+        Barcode:   p.Barcode,
+        CreatedAt: timestamppb.New(p.CreatedAt),
+        Version:   int32(p.Version),
+    }
+}
+
+// productFromMessage converts the wire form of a product back. CreatedAt is ignored, since
+// it is never written by clients.
+func productFromMessage(m *ProductMessage) Product {
+    return Product{
+        ID:       int(m.GetId()),
+        Name:     m.GetName(),
+        Category: m.GetCategory(),
+        Price:    MoneyFromFloat(m.GetPrice()),
+        ImageURL: m.GetImageUrl(),
+        Barcode:  m.GetBarcode(),
+        Version:  int(m.GetVersion()),
+    }
+}
+
+// productServer implements ProductService on top of the product repository.
+type productServer struct {
+    UnimplementedProductServiceServer
+}
+
+func (productServer) GetProduct(ctx context.Context, req *GetProductRequest) (*ProductMessage, error) {
+    ctx = withReadOnly(ctx)
+    product, err := Repo.GetByID(ctx, int(req.GetId()))
+    if err == nil {
+        err = authorizeProduct(ctx, ActionRead, product)
+    }
+    if err != nil {
+        return nil, grpcStoreError(ctx, ProductService_GetProduct_FullMethodName, err)
+    }
+    return productMessage(product), nil
+}
+
+func (productServer) ListProducts(ctx context.Context, req *ListProductsRequest) (*ListProductsResponse, error) {
+    ctx = withReadOnly(ctx)
+    params := listParams{
+        Name:       req.GetName(),
+        Categories: req.GetCategories(),
+        MinPrice:   req.MinPrice,
+        MaxPrice:   req.MaxPrice,
+        Sort:       req.GetSort(),
+        Desc:       req.GetDesc(),
+        Limit:      int(req.GetLimit()),
+        Cursor:     req.GetCursor(),
+    }
+    q, err := parseListQuery(params.values(), time.Now())
+    if err != nil {
+        return nil, status.Error(codes.InvalidArgument, err.Error())
+    }
+    q.Filter.PublishedOnly = !includeUnpublished(ctx)
+    list, err := Repo.List(ctx, q)
+    if err != nil {
+        return nil, grpcStoreError(ctx, ProductService_ListProducts_FullMethodName, err)
+    }
+
+    resp := &ListProductsResponse{Total: int32(list.Total), Partial: list.Partial, NextCursor: list.NextCursor}
+    for _, product := range list.Products {
+        resp.Products = append(resp.Products, productMessage(product))
+    }
+    return resp, nil
+}
+
+func (productServer) CreateProduct(ctx context.Context, req *CreateProductRequest) (*ProductMessage, error) {
+    product := productFromMessage(req.GetProduct())
+    if errs := product.Validate(); len(errs) > 0 {
+        return nil, grpcValidationError(errs)
+    }
+    if err := authorizeProduct(ctx, ActionCreate, product); err != nil {
+        return nil, grpcStoreError(ctx, ProductService_CreateProduct_FullMethodName, err)
+    }
+    if err := Repo.Create(ctx, &product); err != nil {
+        return nil, grpcStoreError(ctx, ProductService_CreateProduct_FullMethodName, err)
+    }
+    if err := invalidateProductLists(ctx); err != nil {
+        logContextError(ctx, err)
+    }
+    return productMessage(product), nil
+}
+
+func (productServer) UpdateProduct(ctx context.Context, req *UpdateProductRequest) (*ProductMessage, error) {
+    product := productFromMessage(req.GetProduct())
+    if errs := product.Validate(); len(errs) > 0 {
+        return nil, grpcValidationError(errs)
+    }
+    if err := authorizeProductID(ctx, ActionUpdate, product.ID); err != nil {
+        return nil, grpcStoreError(ctx, ProductService_UpdateProduct_FullMethodName, err)
+    }
+    changed, err := Repo.Update(ctx, &product)
+    if err != nil {
+        return nil, grpcStoreError(ctx, ProductService_UpdateProduct_FullMethodName, err)
+    }
+    if changed {
+        if err := invalidateProduct(ctx, product.ID); err != nil {
+            logContextError(ctx, err)
+        }
+    }
+    return productMessage(product), nil
+}
+
+func (productServer) DeleteProduct(ctx context.Context, req *DeleteProductRequest) (*DeleteProductResponse, error) {
+    id := int(req.GetId())
+    if err := authorizeProductID(ctx, ActionDelete, id); err != nil {
+        return nil, grpcStoreError(ctx, ProductService_DeleteProduct_FullMethodName, err)
+    }
+    if err := Repo.Delete(ctx, id, int(req.GetVersion())); err != nil {
+        return nil, grpcStoreError(ctx, ProductService_DeleteProduct_FullMethodName, err)
+    }
+    if err := invalidateProduct(ctx, id); err != nil {
+        logContextError(ctx, err)
+    }
+    return &DeleteProductResponse{}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// readyCheckTimeout bounds how long the readiness probe waits for the database.
+const readyCheckTimeout = 2 * time.Second
+
+// readyRetryAfter is how long clients are told to wait after a failed ping before asking
+// whether the service is ready again.
+const readyRetryAfter = 5 * time.Second
+
+// shuttingDown is set once the server starts draining, so load balancers stop routing to it.
+var shuttingDown atomic.Bool
+
+// shutdownDeadline is when the draining server stops waiting for in-flight requests, in
+// Unix nanoseconds.
+var shutdownDeadline atomic.Int64
+
+// startShutdown marks the server as draining for at most timeout.
+func startShutdown(timeout time.Duration) {
+    shutdownDeadline.Store(time.Now().Add(timeout).UnixNano())
+    shuttingDown.Store(true)
+}
+
+// HealthResponse is the body of the health and readiness endpoints.
+type HealthResponse struct {
+    Status string `json:"status"`
+}
+
+// healthz reports that the process is alive. It deliberately checks nothing else, so a
+// database outage doesn't get the pod restarted.
+func healthz(w http.ResponseWriter, r *http.Request) {
+    respond(w, r, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyz reports whether the service can take traffic: it is not shutting down and the
+// database, and Redis if it is used, answer a ping within readyCheckTimeout.
+func readyz(w http.ResponseWriter, r *http.Request) {
+    if shuttingDown.Load() {
+        // By the deadline the instance is gone or, if it was restarted, ready again.
+        respondUnavailable(w, r, time.Until(time.Unix(0, shutdownDeadline.Load())), "Shutting down.")
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+    defer cancel()
+    if err := DB.PingContext(ctx); err != nil {
+        logError(r, err)
+        retryAfter := readyRetryAfter
+        var open errDatabaseUnavailable
+        if errors.As(err, &open) {
+            retryAfter = open.RetryAfter
+        }
+        respondUnavailable(w, r, retryAfter, "Database is not reachable.")
+        return
+    }
+    if err := pingRedis(ctx); err != nil {
+        logError(r, err)
+        respondUnavailable(w, r, readyRetryAfter, "Redis is not reachable.")
+        return
+    }
+
+    respond(w, r, http.StatusOK, HealthResponse{Status: "ready"})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// failingConnector is a database that can't be connected to, failing with err.
+type failingConnector struct{ err error }
+
+func (c failingConnector) Connect(context.Context) (driver.Conn, error) { return nil, c.err }
+func (c failingConnector) Driver() driver.Driver                        { return stubDB }
+
+func TestReadyz(t *testing.T) {
+    tests := []struct {
+        name           string
+        drain          time.Duration
+        connectErr     error
+        wantStatus     int
+        wantRetryAfter string
+    }{
+        {name: "ready", wantStatus: http.StatusOK},
+        {name: "shutting down", drain: 12 * time.Second, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "12"},
+        {name: "breaker open", connectErr: errDatabaseUnavailable{RetryAfter: 7 * time.Second}, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "7"},
+        {name: "unreachable", connectErr: errors.New("connection refused"), wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "5"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            if tt.connectErr != nil {
+                db := sql.OpenDB(failingConnector{tt.connectErr})
+                t.Cleanup(func() { db.Close() })
+                DB = db
+            }
+            if tt.drain > 0 {
+                startShutdown(tt.drain)
+                t.Cleanup(func() { shuttingDown.Store(false) })
+            }
+
+            w := httptest.NewRecorder()
+            readyz(w, newTestRequest(http.MethodGet, "/readyz", "", "", nil))
+
+            if w.Code != tt.wantStatus {
+                t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+            }
+            if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+                t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+            }
+        })
+    }
+}
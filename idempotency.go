@@ -0,0 +1,320 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header we are willing to store.
+const maxIdempotencyKeyLength = 255
+
+// replayedHeaders are the response headers stored with an idempotent response and sent
+// again when it is replayed.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// Errors returned by IdempotencyStore.Claim.
+var (
+    errIdempotencyMismatch   = errors.New("idempotency key reused for a different request")
+    errIdempotencyInProgress = errors.New("idempotent request still in progress")
+)
+
+// storedResponse is a response saved under an idempotency key.
+type storedResponse struct {
+    Status  int
+    Headers map[string]string
+    Body    []byte
+}
+
+// responseCapture passes a response through to the client while keeping a copy of its body.
+type responseCapture struct {
+    statusRecorder
+    body bytes.Buffer
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+    c.body.Write(b)
+    return c.statusRecorder.Write(b)
+}
+
+// idempotencyMiddleware makes mutating requests that carry an Idempotency-Key header safe to
+// retry. The first request with a key runs normally and its response is stored; repeats of
+// the same request within IdempotencyTTL get the stored response replayed instead of being
+// run again. Keys are scoped to the credentials the request was sent with.
+func idempotencyMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("Idempotency-Key")
+        if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if len(key) > maxIdempotencyKeyLength {
+            respondError(w, r, http.StatusBadRequest, codeInvalidIdempotencyKey, "Idempotency-Key is too long.")
+            return
+        }
+
+        // The body is needed to tell a retry from a different request that reuses the key.
+        body, err := io.ReadAll(r.Body)
+        if isBodyTooLarge(err) {
+            respondBodyError(w, r, err)
+            return
+        } else if err != nil {
+            respondError(w, r, http.StatusBadRequest, codeInvalidBody, "Failed to read request body.")
+            return
+        }
+        r.Body = io.NopCloser(bytes.NewReader(body))
+
+        scope := idempotencyScope(r)
+        stored, err := Idempotency.Claim(r.Context(), scope, key, requestHash(r, body))
+        if err == errIdempotencyMismatch {
+            respondError(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used for a different request.")
+            return
+        } else if err == errIdempotencyInProgress {
+            respondError(w, r, http.StatusConflict, codeIdempotencyKeyInProgress, "A request with this Idempotency-Key is still in progress.")
+            return
+        } else if err != nil {
+            respondStoreError(w, r, err, "Failed to check Idempotency-Key.")
+            return
+        }
+        if stored != nil {
+            for name, value := range stored.Headers {
+                w.Header().Set(name, value)
+            }
+            w.Header().Set("Idempotent-Replayed", "true")
+            w.WriteHeader(stored.Status)
+            w.Write(stored.Body)
+            return
+        }
+
+        capture := &responseCapture{statusRecorder: statusRecorder{ResponseWriter: w}}
+        next.ServeHTTP(capture, r)
+
+        // The response must be saved even if the request's own deadline has passed. Server
+        // errors are not saved, so that the client's retry gets another chance.
+        ctx := context.WithoutCancel(r.Context())
+        if capture.status == 0 {
+            capture.status = http.StatusOK
+        }
+        if capture.status >= 500 {
+            err = Idempotency.Release(ctx, scope, key)
+        } else {
+            err = Idempotency.Save(ctx, scope, key, storedResponse{
+                Status:  capture.status,
+                Headers: pickHeaders(w.Header(), replayedHeaders),
+                Body:    capture.body.Bytes(),
+            })
+        }
+        if err != nil {
+            logError(r, err)
+        }
+    })
+}
+
+// idempotencyScope identifies the credentials a request was sent with, so that two clients
+// can't see each other's responses by picking the same key.
+func idempotencyScope(r *http.Request) string {
+    sum := sha256.Sum256([]byte(r.Header.Get("Authorization") + "\n" + r.Header.Get("X-API-Key")))
+    return hex.EncodeToString(sum[:])
+}
+
+// requestHash fingerprints the parts of a request that must match for a retry.
+func requestHash(r *http.Request, body []byte) string {
+    h := sha256.New()
+    io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+    h.Write(body)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// pickHeaders returns the values of the named headers that are set.
+func pickHeaders(header http.Header, names []string) map[string]string {
+    picked := make(map[string]string)
+    for _, name := range names {
+        if value := header.Get(name); value != "" {
+            picked[name] = value
+        }
+    }
+    return picked
+}
+
+// IdempotencyStore keeps the responses to requests sent with an Idempotency-Key.
+type IdempotencyStore interface {
+    // Claim reserves key for a request with the given hash. It returns the stored response
+    // if the request was already completed, nil if the caller now owns the key and must run
+    // the request, or errIdempotencyMismatch or errIdempotencyInProgress.
+    Claim(ctx context.Context, scope, key, hash string) (*storedResponse, error)
+    // Save stores the response to the request that claimed key.
+    Save(ctx context.Context, scope, key string, response storedResponse) error
+    // Release gives up a claimed key so that the request can be retried.
+    Release(ctx context.Context, scope, key string) error
+}
+
+// Idempotency is a global variable that holds the store of idempotent responses.
+var Idempotency IdempotencyStore
+
+// newIdempotencyStore builds the idempotency store selected by the configuration. The Redis
+// backend uses client.
+func newIdempotencyStore(cfg Config, client *redis.Client) (IdempotencyStore, error) {
+    switch cfg.IdempotencyBackend {
+    case "", "postgres":
+        return postgresIdempotencyStore{}, nil
+    case "redis":
+        return redisIdempotencyStore{client: client, ttl: cfg.IdempotencyTTL}, nil
+    default:
+        return nil, errors.New("unknown idempotency backend " + strconv.Quote(cfg.IdempotencyBackend))
+    }
+}
+
+// postgresIdempotencyStore keeps idempotent responses in the idempotency_keys table.
+type postgresIdempotencyStore struct{}
+
+func (postgresIdempotencyStore) Claim(ctx context.Context, scope, key, hash string) (*storedResponse, error) {
+    // An expired entry no longer protects its key.
+    _, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND created_at < now() - make_interval(secs => $3)",
+        scope, key, AppConfig.IdempotencyTTL.Seconds())
+    if err != nil {
+        return nil, err
+    }
+
+    result, err := DB.ExecContext(ctx, "INSERT INTO idempotency_keys (scope, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+        scope, key, hash)
+    if err != nil {
+        return nil, err
+    }
+    if claimed, err := result.RowsAffected(); err != nil {
+        return nil, err
+    } else if claimed == 1 {
+        return nil, nil
+    }
+
+    // Someone has used the key before; find out what for.
+    var storedHash string
+    var status sql.NullInt64
+    var headers, body []byte
+    err = DB.QueryRowContext(ctx, "SELECT request_hash, status, headers, body FROM idempotency_keys WHERE scope = $1 AND key = $2",
+        scope, key).Scan(&storedHash, &status, &headers, &body)
+    if err == sql.ErrNoRows {
+        // The other request failed and released the key in the meantime.
+        return nil, errIdempotencyInProgress
+    } else if err != nil {
+        return nil, err
+    }
+    if storedHash != hash {
+        return nil, errIdempotencyMismatch
+    }
+    if !status.Valid {
+        return nil, errIdempotencyInProgress
+    }
+    stored := &storedResponse{Status: int(status.Int64), Body: body}
+    if err := json.Unmarshal(headers, &stored.Headers); err != nil {
+        return nil, err
+    }
+    return stored, nil
+}
+
+func (postgresIdempotencyStore) Save(ctx context.Context, scope, key string, response storedResponse) error {
+    headers, err := json.Marshal(response.Headers)
+    if err != nil {
+        return err
+    }
+    _, err = DB.ExecContext(ctx, "UPDATE idempotency_keys SET status = $3, headers = $4, body = $5 WHERE scope = $1 AND key = $2",
+        scope, key, response.Status, string(headers), response.Body)
+    return err
+}
+
+func (postgresIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+    _, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key)
+    return err
+}
+
+// redisIdempotencyStore keeps idempotent responses in Redis, where they expire after ttl.
+type redisIdempotencyStore struct {
+    client *redis.Client
+    ttl    time.Duration
+}
+
+// redisIdempotencyEntry is what is stored under an idempotency key in Redis. Status is zero
+// while the request that claimed the key is still running.
+type redisIdempotencyEntry struct {
+    RequestHash string            `json:"request_hash"`
+    Status      int               `json:"status,omitempty"`
+    Headers     map[string]string `json:"headers,omitempty"`
+    Body        []byte            `json:"body,omitempty"`
+}
+
+// redisIdempotencyKey returns the Redis key of an idempotency key used with scope.
+func redisIdempotencyKey(scope, key string) string {
+    return "idempotency:" + scope + ":" + key
+}
+
+func (s redisIdempotencyStore) Claim(ctx context.Context, scope, key, hash string) (*storedResponse, error) {
+    claim, err := json.Marshal(redisIdempotencyEntry{RequestHash: hash})
+    if err != nil {
+        return nil, err
+    }
+    claimed, err := s.client.SetNX(ctx, redisIdempotencyKey(scope, key), claim, s.ttl).Result()
+    if err != nil {
+        return nil, err
+    } else if claimed {
+        return nil, nil
+    }
+
+    // Someone has used the key before; find out what for.
+    value, err := s.client.Get(ctx, redisIdempotencyKey(scope, key)).Bytes()
+    if err == redis.Nil {
+        // The other request failed and released the key in the meantime.
+        return nil, errIdempotencyInProgress
+    } else if err != nil {
+        return nil, err
+    }
+    var entry redisIdempotencyEntry
+    if err := json.Unmarshal(value, &entry); err != nil {
+        return nil, err
+    }
+    if entry.RequestHash != hash {
+        return nil, errIdempotencyMismatch
+    }
+    if entry.Status == 0 {
+        return nil, errIdempotencyInProgress
+    }
+    return &storedResponse{Status: entry.Status, Headers: entry.Headers, Body: entry.Body}, nil
+}
+
+func (s redisIdempotencyStore) Save(ctx context.Context, scope, key string, response storedResponse) error {
+    redisKey := redisIdempotencyKey(scope, key)
+    value, err := s.client.Get(ctx, redisKey).Bytes()
+    if err == redis.Nil {
+        // The claim expired while the request ran; there is nothing to complete.
+        return nil
+    } else if err != nil {
+        return err
+    }
+    var entry redisIdempotencyEntry
+    if err := json.Unmarshal(value, &entry); err != nil {
+        return err
+    }
+    entry.Status, entry.Headers, entry.Body = response.Status, response.Headers, response.Body
+    if value, err = json.Marshal(entry); err != nil {
+        return err
+    }
+    // The response is replayed until the claim expires, as in Postgres. XX leaves a claim
+    // that expired since the read expired.
+    err = s.client.SetArgs(ctx, redisKey, value, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+    if err == redis.Nil {
+        return nil
+    }
+    return err
+}
+
+func (s redisIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+    return s.client.Del(ctx, redisIdempotencyKey(scope, key)).Err()
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// maxImagePixels bounds the size of an uploaded image once decoded, so a small file that
+// expands to a huge bitmap can't exhaust memory.
+const maxImagePixels = 40_000_000
+
+// imageExtensions are the accepted image types and the file extension each is stored with.
+var imageExtensions = map[string]string{
+    "image/jpeg": "jpg",
+    "image/png":  "png",
+    "image/gif":  "gif",
+}
+
+// ProductImage is an uploaded picture of a product. Thumbnails maps each generated size,
+// the longest edge in pixels, to its URL; sizes larger than the original are not generated.
+type ProductImage struct {
+    ID          int       `json:"id" xml:"id"`
+    ProductID   int       `json:"product_id" xml:"product_id"`
+    Position    int       `json:"position" xml:"position"`
+    ContentType string    `json:"content_type" xml:"content_type"`
+    Width       int       `json:"width" xml:"width"`
+    Height      int       `json:"height" xml:"height"`
+    Size        int       `json:"size" xml:"size"`
+    URL         string    `json:"url" xml:"url"`
+    Thumbnails  StringMap `json:"thumbnails" xml:"thumbnails"`
+    CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+
+    // storageKey is the directory of the image's files in the image store.
+    storageKey     string
+    thumbnailSizes []int64
+}
+
+// ImageOrder is the request body of reorderImages.
+type ImageOrder struct {
+    ImageIDs []int `json:"image_ids"`
+}
+
+// imageColumns are the columns scanned by scanImage, in order.
+const imageColumns = "id, product_id, position, content_type, width, height, size_bytes, storage_key, thumbnail_sizes, created_at"
+
+// validateImageURL checks that a product image URL is an absolute http(s) URL on one of the
+// allowed image hosts. An empty URL is always accepted, and a "*" entry disables the check.
+// Entries of the form "*.example.com" match any subdomain of example.com.
+func validateImageURL(imageURL string) error {
+    if imageURL == "" {
+        return nil
+    }
+    u, err := url.Parse(imageURL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return errors.New("must be an absolute http or https URL")
+    }
+
+    host := strings.ToLower(u.Hostname())
+    for _, allowed := range AppConfig.AllowedImageHosts {
+        allowed = strings.ToLower(allowed)
+        switch {
+        case allowed == "*":
+            return nil
+        case strings.HasPrefix(allowed, "*."):
+            if strings.HasSuffix(host, allowed[1:]) {
+                return nil
+            }
+        case host == allowed:
+            return nil
+        }
+    }
+    return errors.New("host is not allowed")
+}
+
+// scanImage reads the imageColumns of one row through scan and fills in the image URLs.
+func scanImage(scan func(dest ...interface{}) error) (ProductImage, error) {
+    var img ProductImage
+    err := scan(&img.ID, &img.ProductID, &img.Position, &img.ContentType, &img.Width, &img.Height, &img.Size,
+        &img.storageKey, pq.Array(&img.thumbnailSizes), &img.CreatedAt)
+    if err != nil {
+        return img, err
+    }
+    img.URL = Images.URL(img.originalKey())
+    img.Thumbnails = make(map[string]string, len(img.thumbnailSizes))
+    for _, size := range img.thumbnailSizes {
+        img.Thumbnails[strconv.FormatInt(size, 10)] = Images.URL(img.thumbnailKey(size))
+    }
+    return img, nil
+}
+
+// originalKey is where the uploaded file of img is stored.
+func (img ProductImage) originalKey() string {
+    return img.storageKey + "/original." + imageExtensions[img.ContentType]
+}
+
+// thumbnailKey is where the thumbnail of img with the given longest edge is stored.
+// Thumbnails of JPEGs are JPEGs; the rest are PNGs so that transparency survives.
+func (img ProductImage) thumbnailKey(size int64) string {
+    ext := "png"
+    if img.ContentType == "image/jpeg" {
+        ext = "jpg"
+    }
+    return fmt.Sprintf("%s/%d.%s", img.storageKey, size, ext)
+}
+
+// keys returns the keys of every file stored for img.
+func (img ProductImage) keys() []string {
+    keys := []string{img.originalKey()}
+    for _, size := range img.thumbnailSizes {
+        keys = append(keys, img.thumbnailKey(size))
+    }
+    return keys
+}
+
+// queryImages returns the images of a product in display order.
+func queryImages(ctx context.Context, productID int) ([]ProductImage, error) {
+    rows, err := Reads.QueryContext(ctx, "SELECT "+imageColumns+" FROM product_images WHERE product_id = $1 ORDER BY position, id", productID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    images := []ProductImage{}
+    for rows.Next() {
+        img, err := scanImage(rows.Scan)
+        if err != nil {
+            return nil, err
+        }
+        images = append(images, img)
+    }
+    return images, rows.Err()
+}
+
+// imageIDFromRequest returns the image ID from the {image_id} path variable.
+func imageIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["image_id"])
+}
+
+// getImages lists the images of a live product in display order.
+func getImages(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve images.") {
+        return
+    }
+    images, err := queryImages(r.Context(), productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve images.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(images)) {
+        return
+    }
+
+    // If everything went well, return the images in the response body.
+    respond(w, r, http.StatusOK, images)
+}
+
+// uploadImage stores the image in the "file" part of a multipart upload, generates its
+// thumbnails and adds it after the product's other images. JPEG, PNG and GIF images of up
+// to the configured size are accepted; the type is worked out from the content rather than
+// taken from the client.
+func uploadImage(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !requireLiveProduct(w, r, productID, ActionUpdate, "Failed to store image.") {
+        return
+    }
+
+    file, err := importFile(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidUpload, err.Error())
+        return
+    }
+    data, err := io.ReadAll(io.LimitReader(file, AppConfig.MaxImageSize+1))
+    if isBodyTooLarge(err) {
+        respondBodyError(w, r, err)
+        return
+    } else if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidUpload, "Failed to read upload.")
+        return
+    }
+    if int64(len(data)) > AppConfig.MaxImageSize {
+        respondError(w, r, http.StatusRequestEntityTooLarge, codeImageTooLarge, fmt.Sprintf("Images may be at most %d bytes.", AppConfig.MaxImageSize))
+        return
+    }
+
+    img := ProductImage{
+        ProductID:   productID,
+        ContentType: http.DetectContentType(data),
+        Size:        len(data),
+        storageKey:  fmt.Sprintf("products/%d/%s", productID, newID()),
+        // The column is NOT NULL, and a nil slice would be stored as NULL.
+        thumbnailSizes: []int64{},
+    }
+    if _, ok := imageExtensions[img.ContentType]; !ok {
+        respondError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedImageType, "Images must be JPEG, PNG or GIF.")
+        return
+    }
+    files, err := renderImage(&img, data)
+    if err != nil {
+        respondError(w, r, http.StatusUnprocessableEntity, codeInvalidImage, err.Error())
+        return
+    }
+
+    // Store the files before the row that points at them, and clean them up if the row
+    // can't be written.
+    for _, f := range files {
+        if err = Images.Put(r.Context(), f.key, f.contentType, f.data); err != nil {
+            break
+        }
+    }
+    stored := img
+    if err == nil {
+        stored, err = scanImage(DB.QueryRowContext(r.Context(), `INSERT INTO product_images (product_id, position, content_type, width, height, size_bytes, storage_key, thumbnail_sizes)
+            SELECT id, COALESCE((SELECT MAX(position) + 1 FROM product_images WHERE product_id = $1), 0), $2, $3, $4, $5, $6, $7
+            FROM products WHERE id = $1 AND deleted_at IS NULL
+            RETURNING `+imageColumns, productID, img.ContentType, img.Width, img.Height, img.Size, img.storageKey, pq.Array(img.thumbnailSizes)).Scan)
+    }
+    if err != nil {
+        deleteImageFiles(r, img)
+    }
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to store image.")
+        return
+    }
+    // Single product reads include the product's images.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 201 Created response with the new image.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d/images/%d", productID, stored.ID))
+    respond(w, r, http.StatusCreated, stored)
+}
+
+// reorderImages sets the display order of a product's images from a JSON body like
+// {"image_ids": [3, 1, 2]}, which must list each of the product's images exactly once.
+func reorderImages(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    var order ImageOrder
+    if err := decodeJSON(r, &order); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if !requireLiveProduct(w, r, productID, ActionUpdate, "Failed to reorder images.") {
+        return
+    }
+
+    tx, err := DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to reorder images.")
+        return
+    }
+    defer tx.Rollback()
+
+    // Lock the product's images so a concurrent upload can't slip in between the check
+    // and the update.
+    rows, err := tx.QueryContext(r.Context(), "SELECT id FROM product_images WHERE product_id = $1 FOR UPDATE", productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to reorder images.")
+        return
+    }
+    current := make(map[int]bool)
+    for rows.Next() {
+        var id int
+        if err = rows.Scan(&id); err != nil {
+            break
+        }
+        current[id] = true
+    }
+    rows.Close()
+    if err == nil {
+        err = rows.Err()
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to reorder images.")
+        return
+    }
+
+    seen := make(map[int]bool, len(order.ImageIDs))
+    for _, id := range order.ImageIDs {
+        if !current[id] || seen[id] {
+            break
+        }
+        seen[id] = true
+    }
+    if len(seen) != len(current) || len(order.ImageIDs) != len(current) {
+        respondValidationErrors(w, r, ValidationErrors{{Field: "image_ids", Message: "must list each of the product's images exactly once"}})
+        return
+    }
+
+    for position, id := range order.ImageIDs {
+        if _, err := tx.ExecContext(r.Context(), "UPDATE product_images SET position = $1 WHERE id = $2", position, id); err != nil {
+            respondStoreError(w, r, err, "Failed to reorder images.")
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        respondStoreError(w, r, err, "Failed to reorder images.")
+        return
+    }
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    images, err := queryImages(r.Context(), productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve images.")
+        return
+    }
+
+    // If everything went well, return the images in their new order.
+    respond(w, r, http.StatusOK, images)
+}
+
+// deleteImage removes an image of a product together with its files.
+func deleteImage(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    imageID, err := imageIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid image ID.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to delete image.") {
+        return
+    }
+    img, err := scanImage(DB.QueryRowContext(r.Context(), "DELETE FROM product_images WHERE id = $1 AND product_id = $2 RETURNING "+imageColumns,
+        imageID, productID).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeImageNotFound, "Image not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to delete image.")
+        return
+    }
+    // The row is gone, so a file that can't be removed is only wasted space.
+    deleteImageFiles(r, img)
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteImageFiles removes the stored files of img, logging the ones that can't be removed.
+func deleteImageFiles(r *http.Request, img ProductImage) {
+    ctx := context.WithoutCancel(r.Context())
+    for _, key := range img.keys() {
+        if err := Images.Delete(ctx, key); err != nil {
+            logError(r, err)
+        }
+    }
+}
+
+// imageFile is one file to be stored for an image.
+type imageFile struct {
+    key         string
+    contentType string
+    data        []byte
+}
+
+// renderImage decodes an uploaded image, fills in its dimensions and thumbnail sizes and
+// returns the files to store for it under img.storageKey: the upload itself and one
+// thumbnail per configured size smaller than the image. Its errors can go to the client.
+func renderImage(img *ProductImage, data []byte) ([]imageFile, error) {
+    config, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, errors.New("Failed to decode image.")
+    }
+    if config.Width*config.Height > maxImagePixels {
+        return nil, fmt.Errorf("Images may have at most %d pixels.", maxImagePixels)
+    }
+    src, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, errors.New("Failed to decode image.")
+    }
+    img.Width, img.Height = config.Width, config.Height
+
+    files := []imageFile{{key: img.originalKey(), contentType: img.ContentType, data: data}}
+    for _, size := range AppConfig.ThumbnailSizes {
+        if size >= img.Width && size >= img.Height {
+            continue
+        }
+        width, height := size, img.Height*size/img.Width
+        if img.Height > img.Width {
+            width, height = img.Width*size/img.Height, size
+        }
+        thumbnail := resizeImage(src, max(width, 1), max(height, 1))
+
+        var buf bytes.Buffer
+        contentType := "image/png"
+        if img.ContentType == "image/jpeg" {
+            contentType = "image/jpeg"
+            err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 85})
+        } else {
+            err = png.Encode(&buf, thumbnail)
+        }
+        if err != nil {
+            return nil, err
+        }
+        img.thumbnailSizes = append(img.thumbnailSizes, int64(size))
+        files = append(files, imageFile{key: img.thumbnailKey(int64(size)), contentType: contentType, data: buf.Bytes()})
+    }
+    return files, nil
+}
+
+// resizeImage scales src down to width by height pixels, averaging the source pixels that
+// fall into each destination pixel so that thumbnails don't alias.
+func resizeImage(src image.Image, width, height int) *image.NRGBA {
+    bounds := src.Bounds()
+    dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        y0 := bounds.Min.Y + y*bounds.Dy()/height
+        y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+        for x := 0; x < width; x++ {
+            x0 := bounds.Min.X + x*bounds.Dx()/width
+            x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+
+            // Sum premultiplied colors, then divide by the total alpha to unpremultiply.
+            var r, g, b, a, n uint64
+            for sy := y0; sy < y1; sy++ {
+                for sx := x0; sx < x1; sx++ {
+                    cr, cg, cb, ca := src.At(sx, sy).RGBA()
+                    r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+                }
+            }
+            if a == 0 {
+                continue
+            }
+            dst.SetNRGBA(x, y, color.NRGBA{
+                R: uint8(r * 0xff / a),
+                G: uint8(g * 0xff / a),
+                B: uint8(b * 0xff / a),
+                A: uint8(a / n >> 8),
+            })
+        }
+    }
+    return dst
+}
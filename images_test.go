@@ -0,0 +1,180 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql/driver"
+    "image"
+    "image/png"
+    "io"
+    "io/fs"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestValidateImageURL(t *testing.T) {
+    tests := []struct {
+        name  string
+        hosts []string
+        url   string
+        ok    bool
+    }{
+        {name: "empty", hosts: []string{"cdn.example.com"}, url: "", ok: true},
+        {name: "allowed host", hosts: []string{"cdn.example.com"}, url: "https://cdn.example.com/lamp.jpg", ok: true},
+        {name: "host case", hosts: []string{"CDN.example.com"}, url: "https://cdn.EXAMPLE.com:8443/lamp.jpg", ok: true},
+        {name: "other host", hosts: []string{"cdn.example.com"}, url: "https://evil.test/lamp.jpg", ok: false},
+        {name: "subdomain wildcard", hosts: []string{"*.example.com"}, url: "http://img.eu.example.com/lamp.jpg", ok: true},
+        {name: "wildcard needs a subdomain", hosts: []string{"*.example.com"}, url: "http://badexample.com/lamp.jpg", ok: false},
+        {name: "any host", hosts: []string{"*"}, url: "https://anywhere.test/lamp.jpg", ok: true},
+        {name: "relative", hosts: []string{"*"}, url: "/images/lamp.jpg", ok: false},
+        {name: "other scheme", hosts: []string{"*"}, url: "ftp://cdn.example.com/lamp.jpg", ok: false},
+        {name: "no hosts", hosts: nil, url: "https://cdn.example.com/lamp.jpg", ok: false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            AppConfig.AllowedImageHosts = tt.hosts
+            if err := validateImageURL(tt.url); (err == nil) != tt.ok {
+                t.Errorf("validateImageURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+            }
+        })
+    }
+}
+
+func TestProductValidateImageHost(t *testing.T) {
+    setupHandlers(t)
+    AppConfig.AllowedImageHosts = []string{"cdn.example.com"}
+
+    errs := Product{Name: "Lamp", Category: "home", ImageURL: "https://evil.test/lamp.jpg"}.Validate()
+    if len(errs) != 1 || errs[0].Field != "image_url" || errs[0].Message != "host is not allowed" {
+        t.Errorf("errors = %+v, want image_url: host is not allowed", errs)
+    }
+}
+
+// useImageDir stores images in a directory of their own until t ends, and returns it.
+func useImageDir(t *testing.T) string {
+    t.Helper()
+    dir := t.TempDir()
+    saved := Images
+    Images = &localImageStore{dir: dir, baseURL: "/images"}
+    t.Cleanup(func() { Images = saved })
+    return dir
+}
+
+func TestImageHandlers(t *testing.T) {
+    useImageDir(t)
+    product := map[string]string{"id": "1"}
+    missing := map[string]string{"id": "99"}
+    invalid := map[string]string{"id": "abc", "image_id": "3"}
+    img := map[string]string{"id": "1", "image_id": "3"}
+    row := []driver.Value{int64(3), int64(1), int64(0), "image/png", int64(10), int64(10), int64(100), "products/1/abc", "{}", time.Unix(0, 0)}
+    tests := []handlerTest{
+        {name: "list", handler: getImages, target: "/products/1/images", vars: product, answer: answerRows(map[string][]driver.Value{"FROM product_images": row}), status: http.StatusOK},
+        {name: "list invalid id", handler: getImages, target: "/products/abc/images", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "list missing product", handler: getImages, target: "/products/99/images", vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "reorder", handler: reorderImages, method: "PUT", target: "/products/1/images/order", body: `{"image_ids": [3]}`, vars: product,
+            answer: answerRows(map[string][]driver.Value{"FOR UPDATE": {int64(3)}, "storage_key": row}), status: http.StatusOK},
+        {name: "reorder invalid id", handler: reorderImages, method: "PUT", target: "/products/abc/images/order", body: `{"image_ids": [3]}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "reorder malformed", handler: reorderImages, method: "PUT", target: "/products/1/images/order", body: `{"image_ids": 3}`, vars: product, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "reorder missing product", handler: reorderImages, method: "PUT", target: "/products/99/images/order", body: `{"image_ids": [3]}`, vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "reorder other images", handler: reorderImages, method: "PUT", target: "/products/1/images/order", body: `{"image_ids": [4]}`, vars: product,
+            answer: answerRows(map[string][]driver.Value{"FOR UPDATE": {int64(3)}}), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "delete", handler: deleteImage, method: "DELETE", target: "/products/1/images/3", vars: img, answer: answerRows(map[string][]driver.Value{"DELETE FROM product_images": row}), status: http.StatusNoContent},
+        {name: "delete invalid product id", handler: deleteImage, method: "DELETE", target: "/products/abc/images/3", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete invalid image id", handler: deleteImage, method: "DELETE", target: "/products/1/images/x", vars: map[string]string{"id": "1", "image_id": "x"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteImage, method: "DELETE", target: "/products/1/images/3", vars: img, status: http.StatusNotFound, code: codeImageNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getImages, target: "/products/1/images", vars: product},
+        handlerTest{name: "reorder", handler: reorderImages, method: "PUT", target: "/products/1/images/order", body: `{"image_ids": [3]}`, vars: product},
+        handlerTest{name: "delete", handler: deleteImage, method: "DELETE", target: "/products/1/images/3", vars: img},
+    ))
+}
+
+// uploadBody returns a multipart upload holding data in a part called name, and its
+// content type.
+func uploadBody(t *testing.T, name string, data []byte) (*bytes.Buffer, string) {
+    t.Helper()
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    part, err := mw.CreateFormFile(name, "upload")
+    if err == nil {
+        _, err = part.Write(data)
+    }
+    if err == nil {
+        err = mw.Close()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &body, mw.FormDataContentType()
+}
+
+func TestUploadImage(t *testing.T) {
+    var encoded bytes.Buffer
+    if err := png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+        t.Fatal(err)
+    }
+    pixel := encoded.Bytes()
+    row := []driver.Value{int64(3), int64(1), int64(0), "image/png", int64(4), int64(4), int64(len(pixel)), "products/1/abc", "{}", time.Unix(0, 0)}
+    tests := []struct {
+        name    string
+        id      string
+        part    string
+        data    []byte
+        answer  func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+        status  int
+        code    string
+        written bool
+    }{
+        {name: "stored", id: "1", part: "file", data: pixel, answer: answerRows(map[string][]driver.Value{"INSERT INTO product_images": row}), status: http.StatusCreated, written: true},
+        {name: "invalid id", id: "abc", part: "file", data: pixel, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "missing product", id: "99", part: "file", data: pixel, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "no file part", id: "1", part: "image", data: pixel, status: http.StatusBadRequest, code: codeInvalidUpload},
+        {name: "too large", id: "1", part: "file", data: bytes.Repeat(pixel, 200), status: http.StatusRequestEntityTooLarge, code: codeImageTooLarge},
+        {name: "not an image", id: "1", part: "file", data: []byte("just some text"), status: http.StatusUnsupportedMediaType, code: codeUnsupportedImageType},
+        {name: "corrupt image", id: "1", part: "file", data: pixel[:len(pixel)/2], status: http.StatusUnprocessableEntity, code: codeInvalidImage},
+        {name: "product gone", id: "1", part: "file", data: pixel, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "database unavailable", id: "1", part: "file", data: pixel, answer: failQueries(errDatabaseUnavailable{RetryAfter: time.Second}), status: http.StatusServiceUnavailable, code: codeUnavailable},
+        {name: "database timeout", id: "1", part: "file", data: pixel, answer: failQueries(context.DeadlineExceeded), status: http.StatusGatewayTimeout, code: codeTimeout},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            dir := useImageDir(t)
+            AppConfig.MaxImageSize = 10 * int64(len(pixel))
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            stubDB.answer = tt.answer
+
+            body, contentType := uploadBody(t, tt.part, tt.data)
+            r := newTestRequest("POST", "/products/"+tt.id+"/images", "", RoleAdmin, map[string]string{"id": tt.id})
+            r.Body, r.ContentLength = io.NopCloser(body), int64(body.Len())
+            r.Header.Set("Content-Type", contentType)
+            w := httptest.NewRecorder()
+            uploadImage(w, r)
+
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            // Files of an image that wasn't stored are cleaned up.
+            written := false
+            err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+                written = written || err == nil && !d.IsDir()
+                return err
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+            if written != tt.written {
+                t.Errorf("files written = %v, want %v", written, tt.written)
+            }
+        })
+    }
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// ImageStore keeps uploaded image files. Keys are slash-separated relative paths made up of
+// letters, digits, dots and slashes only.
+type ImageStore interface {
+    // Put stores data under key, replacing anything already there.
+    Put(ctx context.Context, key, contentType string, data []byte) error
+    // Delete removes the file stored under key. Deleting a missing file is not an error.
+    Delete(ctx context.Context, key string) error
+    // URL returns the address clients fetch the file stored under key from.
+    URL(key string) string
+}
+
+// Images is a global variable that holds the store product images are uploaded to.
+var Images ImageStore
+
+// localImagePrefix is the path the local image store's files are served under.
+const localImagePrefix = "/images/"
+
+// newImageStore returns the image store selected by cfg.
+func newImageStore(cfg Config) (ImageStore, error) {
+    switch cfg.ImageStorage {
+    case "s3":
+        baseURL := cfg.ImageBaseURL
+        if baseURL == "" {
+            baseURL = strings.TrimSuffix(cfg.S3Endpoint, "/") + "/" + cfg.S3Bucket
+        }
+        return &s3ImageStore{
+            endpoint:  strings.TrimSuffix(cfg.S3Endpoint, "/"),
+            bucket:    cfg.S3Bucket,
+            region:    cfg.S3Region,
+            accessKey: cfg.S3AccessKeyID,
+            secretKey: cfg.S3SecretAccessKey,
+            baseURL:   strings.TrimSuffix(baseURL, "/"),
+            client:    &http.Client{Timeout: 30 * time.Second},
+        }, nil
+    default:
+        if err := os.MkdirAll(cfg.ImageDir, 0o755); err != nil {
+            return nil, err
+        }
+        baseURL := cfg.ImageBaseURL
+        if baseURL == "" {
+            baseURL = localImagePrefix
+        }
+        return &localImageStore{dir: cfg.ImageDir, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+    }
+}
+
+// localImageStore keeps images in a directory on disk. Unless another base URL is
+// configured, the server itself serves them under localImagePrefix.
+type localImageStore struct {
+    dir     string
+    baseURL string
+}
+
+func (s *localImageStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+    path := filepath.Join(s.dir, filepath.FromSlash(key))
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    // Write to a temporary file first so a reader never sees half an image.
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+func (s *localImageStore) Delete(ctx context.Context, key string) error {
+    err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    return err
+}
+
+func (s *localImageStore) URL(key string) string {
+    return s.baseURL + "/" + key
+}
+
+// imageFileServer serves the files of a local image store. Directory listings are not
+// served, so clients can only fetch images whose URL they were given.
+func imageFileServer(dir string) http.Handler {
+    files := http.StripPrefix(localImagePrefix, http.FileServer(http.Dir(dir)))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/") {
+            http.NotFound(w, r)
+            return
+        }
+        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+        files.ServeHTTP(w, r)
+    })
+}
+
+// s3ImageStore keeps images in a bucket of an S3-compatible object store, addressed
+// path-style so it also works with MinIO and similar servers. Requests are signed with AWS
+// Signature Version 4. Clients fetch images straight from the bucket or from baseURL, so
+// the bucket (or whatever sits in front of it) must allow public reads.
+type s3ImageStore struct {
+    endpoint  string
+    bucket    string
+    region    string
+    accessKey string
+    secretKey string
+    baseURL   string
+    client    *http.Client
+}
+
+func (s *s3ImageStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+    return s.do(ctx, http.MethodPut, key, contentType, data)
+}
+
+func (s *s3ImageStore) Delete(ctx context.Context, key string) error {
+    // S3 answers 204 whether or not the object existed.
+    return s.do(ctx, http.MethodDelete, key, "", nil)
+}
+
+func (s *s3ImageStore) URL(key string) string {
+    return s.baseURL + "/" + key
+}
+
+// do sends a signed request for the object stored under key.
+func (s *s3ImageStore) do(ctx context.Context, method, key, contentType string, body []byte) error {
+    req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    s.sign(req, body, time.Now().UTC())
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, bytes.TrimSpace(message))
+    }
+    return nil
+}
+
+// sign adds the AWS Signature Version 4 headers for req, whose body is body, at time now.
+func (s *s3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+    amzDate := now.Format("20060102T150405Z")
+    date := now.Format("20060102")
+    payloadHash := sha256Hex(body)
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+    // The signed headers must be listed in sorted order.
+    signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        "host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+        signedHeaders,
+        payloadHash,
+    }, "\n")
+    scope := date + "/" + s.region + "/s3/aws4_request"
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+    key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+    key = hmacSHA256(key, s.region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.accessKey, scope, signedHeaders, signature))
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of data.
+func sha256Hex(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
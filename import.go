@@ -0,0 +1,229 @@
+package main
+
+import (
+    "context"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// importColumns are the CSV columns an import understands. The header row may list them in
+// any order; name, category and price are required. Rows without a currency are priced
+// in the base currency.
+var importColumns = []string{"name", "category", "price", "currency", "image_url", "barcode", "sku", "attributes"}
+
+// ImportRowError describes why one CSV row was rejected. Row numbers count the header as 1,
+// matching what a spreadsheet shows.
+type ImportRowError struct {
+    Row    int              `json:"row"`
+    Error  string           `json:"error,omitempty"`
+    Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// ImportReport summarises a catalog import.
+type ImportReport struct {
+    Inserted int              `json:"inserted"`
+    Updated  int              `json:"updated"`
+    Rejected []ImportRowError `json:"rejected"`
+}
+
+// importInputError is an import that failed because of what was uploaded rather than the
+// store. Message is what the client is told; Err, if set, is what went wrong underneath.
+type importInputError struct {
+    Message string
+    Err     error
+}
+
+func (e *importInputError) Error() string {
+    return e.Message
+}
+
+func (e *importInputError) Unwrap() error {
+    return e.Err
+}
+
+// importProducts reads a CSV catalog from the "file" part of a multipart upload and upserts
+// each row by product name, as described by importCSV.
+func importProducts(w http.ResponseWriter, r *http.Request) {
+    file, err := importFile(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidUpload, err.Error())
+        return
+    }
+
+    report, err := importCSV(r.Context(), file)
+    var inputErr *importInputError
+    if isBodyTooLarge(err) {
+        respondBodyError(w, r, err)
+        return
+    } else if errors.As(err, &inputErr) {
+        if inputErr.Err != nil {
+            logError(r, inputErr.Err)
+        }
+        respondError(w, r, http.StatusBadRequest, codeInvalidUpload, inputErr.Message)
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to import products.")
+        return
+    }
+
+    // If everything went well, return the summary report.
+    respond(w, r, http.StatusOK, report)
+}
+
+// importCSV upserts each row of a CSV catalog by product name, for the principal and tenant
+// of ctx. Rows are validated and written one at a time as they are read, so the file is
+// never held in memory. Bad rows are reported and skipped; a file that can't be read fails
+// with an *importInputError.
+func importCSV(ctx context.Context, file io.Reader) (ImportReport, error) {
+    // Work out which column holds which field from the header row.
+    reader := csv.NewReader(file)
+    reader.TrimLeadingSpace = true
+    header, err := reader.Read()
+    if err != nil {
+        return ImportReport{}, &importInputError{Message: "Failed to read CSV header.", Err: err}
+    }
+    columns, err := importHeader(header)
+    if err != nil {
+        return ImportReport{}, &importInputError{Message: err.Error()}
+    }
+    reader.FieldsPerRecord = len(header)
+
+    report := ImportReport{Rejected: []ImportRowError{}}
+    for row := 2; ; row++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        var parseErr *csv.ParseError
+        if errors.As(err, &parseErr) {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Error: parseErr.Err.Error()})
+            continue
+        } else if err != nil {
+            // The file itself broke off, so there is nothing more to read.
+            return ImportReport{}, &importInputError{Message: "Failed to read CSV upload.", Err: err}
+        }
+
+        product, errs := importRow(record, columns)
+        if len(errs) == 0 {
+            errs = product.Validate()
+        }
+        if len(errs) > 0 {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Errors: errs})
+            continue
+        }
+        if err := authorizeProduct(ctx, ActionCreate, product); err == ErrForbidden {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Error: "Forbidden."})
+            continue
+        } else if err != nil {
+            return ImportReport{}, err
+        }
+
+        created, err := Repo.Upsert(ctx, &product)
+        if err == ErrBarcodeInUse {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Error: "Barcode is already in use."})
+            continue
+        } else if err == ErrSKUInUse {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Error: "SKU is already in use."})
+            continue
+        } else if err == ErrUnknownCategory {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Errors: unknownCategoryErrors})
+            continue
+        } else if err == ErrUnknownVendor {
+            report.Rejected = append(report.Rejected, ImportRowError{Row: row, Errors: unknownVendorErrors})
+            continue
+        } else if err != nil {
+            return ImportReport{}, err
+        }
+        if created {
+            report.Inserted++
+            continue
+        }
+        report.Updated++
+        if err := invalidateProduct(ctx, product.ID); err != nil {
+            logContextError(ctx, err)
+        }
+    }
+    if report.Inserted > 0 {
+        if err := invalidateProductLists(ctx); err != nil {
+            logContextError(ctx, err)
+        }
+    }
+    return report, nil
+}
+
+// importFile returns the "file" part of a multipart upload without buffering it.
+func importFile(r *http.Request) (io.Reader, error) {
+    mr, err := r.MultipartReader()
+    if err != nil {
+        return nil, errors.New("Expected a multipart/form-data upload.")
+    }
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            return nil, errors.New("Missing file part.")
+        } else if err != nil {
+            return nil, errors.New("Failed to read upload.")
+        }
+        if part.FormName() == "file" {
+            return part, nil
+        }
+    }
+}
+
+// importHeader maps each known column name to its position in the header row.
+func importHeader(header []string) (map[string]int, error) {
+    columns := make(map[string]int)
+    for i, name := range header {
+        // Spreadsheet exports often start with a byte order mark.
+        name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+        for _, known := range importColumns {
+            if name == known {
+                columns[name] = i
+            }
+        }
+    }
+    for _, required := range []string{"name", "category", "price"} {
+        if _, ok := columns[required]; !ok {
+            return nil, fmt.Errorf("CSV header is missing the %s column.", required)
+        }
+    }
+    return columns, nil
+}
+
+// importRow builds a product from one CSV record.
+func importRow(record []string, columns map[string]int) (Product, ValidationErrors) {
+    field := func(name string) string {
+        if i, ok := columns[name]; ok {
+            return strings.TrimSpace(record[i])
+        }
+        return ""
+    }
+
+    var errs ValidationErrors
+    price, err := ParseMoney(field("price"))
+    if err != nil {
+        errs.add("price", err.Error())
+    }
+    // Attributes are a JSON object, as exported.
+    var attributes Attributes
+    if text := field("attributes"); text != "" {
+        if err := json.Unmarshal([]byte(text), &attributes); err != nil {
+            errs.add("attributes", "must be a JSON object of strings")
+        }
+    }
+    return Product{
+        Name:       field("name"),
+        Category:   field("category"),
+        Price:      price,
+        Currency:   strings.ToUpper(field("currency")),
+        ImageURL:   field("image_url"),
+        Barcode:    field("barcode"),
+        SKU:        field("sku"),
+        Attributes: attributes,
+    }, errs
+}
@@ -0,0 +1,919 @@
+//go:build integration
+
+// The integration tests run against Postgres in a container, with every migration applied:
+//
+//	go test -tags integration ./...
+//
+// They need a Docker daemon. The container is started by the first test that asks for it
+// and shared by the rest; each test leaves the tables empty for the next.
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/png"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/lib/pq"
+    "github.com/testcontainers/testcontainers-go/modules/postgres"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// postgresImage is the image the integration tests run Postgres from.
+const postgresImage = "postgres:16-alpine"
+
+// keptTables are left alone between tests: the migrations record and the rows the
+// migrations seed, which the schema relies on.
+var keptTables = map[string]bool{"schema_migrations": true, "tenants": true, "service_settings": true}
+
+var (
+    postgresOnce sync.Once
+    postgresDB   *sql.DB
+    postgresErr  error
+)
+
+// startPostgres starts the Postgres container and applies the migrations. The container is
+// removed once every test has run.
+func startPostgres() (*sql.DB, error) {
+    ctx := context.Background()
+    container, err := postgres.Run(ctx, postgresImage,
+        postgres.WithDatabase("products"),
+        postgres.WithUsername("products"),
+        postgres.WithPassword("products"),
+        postgres.BasicWaitStrategies())
+    if err != nil {
+        return nil, err
+    }
+    suiteCleanups = append(suiteCleanups, func() { container.Terminate(context.Background()) })
+
+    dsn, err := container.ConnectionString(ctx, "sslmode=disable")
+    if err != nil {
+        return nil, err
+    }
+    db, err := sql.Open("postgres", dsn)
+    if err != nil {
+        return nil, err
+    }
+    suiteCleanups = append(suiteCleanups, func() { db.Close() })
+    if err := migrate(ctx, db); err != nil {
+        return nil, err
+    }
+    return db, nil
+}
+
+// setupPostgres is like setupHandlers, with the handlers backed by the Postgres
+// repositories on the test database. Whatever the test wrote is deleted when it ends.
+func setupPostgres(t *testing.T) *sql.DB {
+    t.Helper()
+    setupHandlers(t)
+    postgresOnce.Do(func() { postgresDB, postgresErr = startPostgres() })
+    if postgresErr != nil {
+        t.Fatalf("starting Postgres: %v", postgresErr)
+    }
+    t.Cleanup(func() {
+        if err := resetPostgres(postgresDB); err != nil {
+            t.Errorf("cleaning up the database: %v", err)
+        }
+    })
+
+    DB, Reads = postgresDB, newReadRouter(postgresDB, nil, AppConfig.DBStatementCacheSize)
+    Repo, Carts = newPostgresRepository(DB, Reads), newPostgresCartRepository(DB)
+    return postgresDB
+}
+
+// resetPostgres empties every table but the keptTables, and drops the tenants tests
+// created.
+func resetPostgres(db *sql.DB) error {
+    ctx := context.Background()
+    var tables []string
+    rows, err := db.QueryContext(ctx, "SELECT tablename FROM pg_tables WHERE schemaname = 'public'")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var table string
+        if err := rows.Scan(&table); err != nil {
+            return err
+        }
+        if !keptTables[table] {
+            tables = append(tables, pq.QuoteIdentifier(table))
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    if _, err := db.ExecContext(ctx, "TRUNCATE "+strings.Join(tables, ", ")+" RESTART IDENTITY CASCADE"); err != nil {
+        return err
+    }
+    _, err = db.ExecContext(ctx, "DELETE FROM tenants WHERE id <> 1")
+    return err
+}
+
+func TestPostgresProductRepository(t *testing.T) {
+    db := setupPostgres(t)
+    ctx := context.Background()
+    if _, err := db.ExecContext(ctx, "INSERT INTO categories (name) VALUES ('home'), ('office')"); err != nil {
+        t.Fatal(err)
+    }
+
+    lamp := Product{Name: "Lamp", Category: "home", Price: 1999, Barcode: "4006381333931", Status: StatusPublished}
+    if err := Repo.Create(ctx, &lamp); err != nil {
+        t.Fatalf("Create: %v", err)
+    }
+    desk := Product{Name: "Desk", Category: "office", Price: 19999, Status: StatusPublished}
+    if err := Repo.Create(ctx, &desk); err != nil {
+        t.Fatalf("Create: %v", err)
+    }
+    if err := Repo.Create(ctx, &Product{Name: "Chair", Category: "garden", Price: 4999}); err != ErrUnknownCategory {
+        t.Errorf("Create with an unknown category = %v, want ErrUnknownCategory", err)
+    }
+    if err := Repo.Create(ctx, &Product{Name: "Lamp", Category: "home", Price: 1999, Barcode: lamp.Barcode}); err != ErrBarcodeInUse {
+        t.Errorf("Create with a taken barcode = %v, want ErrBarcodeInUse", err)
+    }
+
+    got, err := Repo.GetByID(ctx, lamp.ID)
+    if err != nil || got.Name != "Lamp" || got.Price != 1999 || got.Version != 1 {
+        t.Fatalf("GetByID = %+v, %v", got, err)
+    }
+    list, err := Repo.List(ctx, ListQuery{Filter: ProductFilter{Categories: []string{"office"}}, Sort: "id", Limit: 10})
+    if err != nil || len(list.Products) != 1 || list.Products[0].ID != desk.ID {
+        t.Fatalf("List by category = %+v, %v", list.Products, err)
+    }
+
+    if err := Repo.Delete(ctx, lamp.ID, 1); err != nil {
+        t.Fatalf("Delete: %v", err)
+    }
+    if _, err := Repo.GetByID(ctx, lamp.ID); err != ErrProductNotFound {
+        t.Errorf("GetByID of a deleted product = %v, want ErrProductNotFound", err)
+    }
+}
+
+func TestPostgresCartExpiry(t *testing.T) {
+    setupPostgres(t)
+    ctx := context.Background()
+
+    cart := Cart{Owner: "tester", Currency: "USD", ExpiresAt: time.Now().Add(-time.Minute)}
+    if err := Carts.Create(ctx, &cart); err != nil {
+        t.Fatalf("Create: %v", err)
+    }
+    if _, err := Carts.Get(ctx, cart.ID); err != ErrCartNotFound {
+        t.Errorf("Get of an expired cart = %v, want ErrCartNotFound", err)
+    }
+    if n, err := Carts.DeleteExpired(ctx, time.Now()); err != nil || n != 1 {
+        t.Errorf("DeleteExpired = %d, %v, want 1", n, err)
+    }
+}
+
+// integrationAdminToken is the bearer token the API tests send, which makes them admins.
+const integrationAdminToken = "integration-admin-token"
+
+// setupAPI is like setupPostgres, and returns the router of every API version serving the
+// handlers. The test database starts with the categories home and office.
+func setupAPI(t *testing.T) http.Handler {
+    t.Helper()
+    db := setupPostgres(t)
+    useImageDir(t)
+    AppConfig.AdminToken, AppConfig.JWTSecret = integrationAdminToken, "integration-secret"
+    savedRates, savedIdempotency := Rates, Idempotency
+    Rates, Idempotency = newCachingRateProvider(dbRateProvider{}, AppConfig.RateCacheTTL), postgresIdempotencyStore{}
+    t.Cleanup(func() { Rates, Idempotency = savedRates, savedIdempotency })
+    if _, err := db.ExecContext(context.Background(), "INSERT INTO categories (name) VALUES ('home'), ('office')"); err != nil {
+        t.Fatal(err)
+    }
+    return newVersionRouter(AppConfig)
+}
+
+// apiTest is a request sent through the router and the response it should get. The API
+// tests run their requests in order, each against what the ones before it left behind.
+type apiTest struct {
+    name   string
+    method string
+    target string
+    body   string
+    // header holds headers to send besides the credentials, like If-Match.
+    header map[string]string
+    // token is the bearer token to send instead of integrationAdminToken. Anonymous
+    // requests send none.
+    token     string
+    anonymous bool
+    status    int
+    code      string
+}
+
+// serveAPI sends the request of tt through router and returns the response.
+func serveAPI(router http.Handler, tt apiTest) *httptest.ResponseRecorder {
+    method := tt.method
+    if method == "" {
+        method = "GET"
+    }
+    r := httptest.NewRequest(method, tt.target, strings.NewReader(tt.body))
+    if tt.body != "" {
+        r.Header.Set("Content-Type", "application/json")
+    }
+    for name, value := range tt.header {
+        r.Header.Set(name, value)
+    }
+    if !tt.anonymous {
+        token := tt.token
+        if token == "" {
+            token = integrationAdminToken
+        }
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, r)
+    return w
+}
+
+// runAPITests sends each request of tests in turn and checks its status and error code.
+func runAPITests(t *testing.T, router http.Handler, tests []apiTest) {
+    t.Helper()
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := serveAPI(router, tt)
+            if w.Code != tt.status {
+                t.Fatalf("%s %s = %d, want %d: %s", tt.method, tt.target, w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+        })
+    }
+}
+
+// decodeAPI decodes the JSON body of w into v.
+func decodeAPI(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+    t.Helper()
+    if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+        t.Fatalf("decoding %s: %v", w.Body, err)
+    }
+}
+
+// serveConcurrently sends n requests through router at once, the ith built by request, and
+// counts the responses by status.
+func serveConcurrently(router http.Handler, n int, request func(i int) apiTest) map[int]int {
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    statuses := make(map[int]int)
+    start := make(chan struct{})
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            <-start
+            w := serveAPI(router, request(i))
+            mu.Lock()
+            statuses[w.Code]++
+            mu.Unlock()
+        }(i)
+    }
+    close(start)
+    wg.Wait()
+    return statuses
+}
+
+// signIn adds a user with role and returns the token /login gives them.
+func signIn(t *testing.T, router http.Handler, username string, role Role) string {
+    t.Helper()
+    hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := DB.ExecContext(context.Background(), "INSERT INTO users (username, password_hash, role) VALUES ($1, $2, $3)", username, string(hash), role); err != nil {
+        t.Fatal(err)
+    }
+    w := serveAPI(router, apiTest{method: "POST", target: "/login", body: fmt.Sprintf(`{"username": %q, "password": "correct horse"}`, username), anonymous: true})
+    if w.Code != http.StatusOK {
+        t.Fatalf("logging in as %s = %d: %s", username, w.Code, w.Body)
+    }
+    var login LoginResponse
+    decodeAPI(t, w, &login)
+    return login.Token
+}
+
+// upload returns a multipart body holding data in a part called name, and the header to
+// send it with.
+func upload(t *testing.T, name string, data []byte) (string, map[string]string) {
+    t.Helper()
+    body, contentType := uploadBody(t, name, data)
+    return body.String(), map[string]string{"Content-Type": contentType}
+}
+
+// ifMatch returns the If-Match header of a write to the product version etag.
+func ifMatch(etag string) map[string]string {
+    return map[string]string{"If-Match": etag}
+}
+
+func TestAPIProducts(t *testing.T) {
+    router := setupAPI(t)
+    lamp := `{"name": "Lamp", "category": "home", "price": 19.99, "barcode": "4006381333931"}`
+    csv, csvHeader := upload(t, "file", []byte("name,category,price\nChair,office,49.99\nStool,garden,9.99\n"))
+
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/products", body: lamp, status: http.StatusCreated},
+        {name: "create another", method: "POST", target: "/products", body: `{"name": "Desk", "category": "office", "price": 199.99}`, status: http.StatusCreated},
+        {name: "create malformed", method: "POST", target: "/products", body: `{"name": `, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid", method: "POST", target: "/products", body: `{"name": "", "category": "home", "price": -1}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create in unknown category", method: "POST", target: "/products", body: `{"name": "Chair", "category": "garden", "price": 49.99}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create with barcode in use", method: "POST", target: "/products", body: `{"name": "Chair", "category": "office", "price": 49.99, "barcode": "4006381333931"}`,
+            status: http.StatusConflict, code: codeBarcodeInUse},
+        {name: "create anonymous", method: "POST", target: "/products", body: lamp, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "create with bad token", method: "POST", target: "/products", body: lamp, token: "nope", status: http.StatusUnauthorized, code: codeUnauthorized},
+
+        {name: "get", target: "/products/1", status: http.StatusOK},
+        {name: "get in a version", target: "/v1/products/1", status: http.StatusOK},
+        {name: "get in an unknown version", target: "/v9/products/1", status: http.StatusNotFound, code: codeUnknownAPIVersion},
+        {name: "get legacy", target: "/product?id=1", status: http.StatusOK},
+        {name: "get legacy invalid id", target: "/product?id=abc", status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", target: "/products/99", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "get not an id", target: "/products/abc", status: http.StatusNotFound, code: codeNotFound},
+        {name: "get invalid currency", target: "/products/1?currency=euro", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "list", target: "/products?category=office", status: http.StatusOK},
+        {name: "list invalid limit", target: "/products?limit=0", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "list anonymous", target: "/products", anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "method not allowed", method: "PATCH", target: "/products", body: `{}`, status: http.StatusMethodNotAllowed, code: codeMethodNotAllowed},
+        {name: "by barcode", target: "/products/by-barcode?code=4006381333931", status: http.StatusOK},
+        {name: "by unknown barcode", target: "/products/by-barcode?code=5901234123457", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "by invalid barcode", target: "/products/by-barcode?code=123", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "search", target: "/products/search?q=lamp", status: http.StatusOK},
+        {name: "search without query", target: "/products/search", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "facets", target: "/products/facets", status: http.StatusOK},
+        {name: "export", target: "/products/export", status: http.StatusOK},
+        {name: "stream", target: "/products/stream", status: http.StatusOK},
+        {name: "recommendations", target: "/products/1/recommendations", status: http.StatusOK},
+        {name: "recommendations of missing product", target: "/products/99/recommendations", status: http.StatusNotFound, code: codeProductNotFound},
+
+        {name: "update without If-Match", method: "PUT", target: "/products/1", body: lamp, status: http.StatusPreconditionRequired, code: codePreconditionRequired},
+        {name: "update", method: "PUT", target: "/products/1", header: ifMatch(`"1"`), body: `{"name": "Desk lamp", "category": "home", "price": 24.99, "barcode": "4006381333931"}`,
+            status: http.StatusOK},
+        {name: "update stale version", method: "PUT", target: "/products/1", header: ifMatch(`"1"`), body: lamp, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+        {name: "update invalid", method: "PUT", target: "/products/1", header: ifMatch(`"2"`), body: `{"name": "Desk lamp", "category": "home", "price": -1}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update into unknown category", method: "PUT", target: "/products/1", header: ifMatch(`"2"`), body: `{"name": "Desk lamp", "category": "garden", "price": 24.99}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update with barcode in use", method: "PUT", target: "/products/2", header: ifMatch("*"), body: `{"name": "Desk", "category": "office", "price": 199.99, "barcode": "4006381333931"}`,
+            status: http.StatusConflict, code: codeBarcodeInUse},
+        {name: "update missing", method: "PUT", target: "/products/99", header: ifMatch("*"), body: lamp, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "patch", method: "PATCH", target: "/products/1", header: ifMatch(`"2"`), body: `{"price": 17.5}`, status: http.StatusOK},
+        {name: "patch stale version", method: "PATCH", target: "/products/1", header: ifMatch(`"2"`), body: `{"price": 18}`, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+        {name: "patch without If-Match", method: "PATCH", target: "/products/1", body: `{"price": 18}`, status: http.StatusPreconditionRequired, code: codePreconditionRequired},
+        {name: "patch invalid", method: "PATCH", target: "/products/1", header: ifMatch("*"), body: `{"name": ""}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "patch missing", method: "PATCH", target: "/products/99", header: ifMatch("*"), body: `{"price": 18}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "history", target: "/products/1/history", status: http.StatusOK},
+        {name: "history of missing product", target: "/products/99/history", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "upsert by sku", method: "PUT", target: "/products/by-sku/LMP-9", body: `{"name": "Floor lamp", "category": "home", "price": 89}`, status: http.StatusCreated},
+        {name: "upsert by sku again", method: "PUT", target: "/products/by-sku/LMP-9", body: `{"name": "Floor lamp", "category": "home", "price": 79}`, status: http.StatusOK},
+        {name: "upsert by sku invalid", method: "PUT", target: "/products/by-sku/LMP-9", body: `{"name": "", "category": "home", "price": 79}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+
+        {name: "archive", method: "PUT", target: "/products/1/status", body: `{"status": "archived"}`, status: http.StatusOK},
+        {name: "publish", method: "PUT", target: "/products/1/status", body: `{"status": "published"}`, status: http.StatusOK},
+        {name: "status missing", method: "PUT", target: "/products/1/status", body: `{}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "status unknown", method: "PUT", target: "/products/1/status", body: `{"status": "gone"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "status of missing product", method: "PUT", target: "/products/99/status", body: `{"status": "archived"}`, status: http.StatusNotFound, code: codeProductNotFound},
+
+        {name: "batch get", method: "POST", target: "/products/batch-get", body: `{"ids": [1, 2, 99]}`, status: http.StatusOK},
+        {name: "batch get nothing", method: "POST", target: "/products/batch-get", body: `{"ids": []}`, status: http.StatusBadRequest, code: codeInvalidBatchSize},
+        {name: "bulk create", method: "POST", target: "/products/bulk", body: `[{"name": "Shelf", "category": "office", "price": 59}, {"name": "", "category": "office", "price": 1}]`,
+            status: http.StatusOK},
+        {name: "bulk create nothing", method: "POST", target: "/products/bulk", body: `[]`, status: http.StatusBadRequest, code: codeInvalidBatchSize},
+        {name: "import", method: "POST", target: "/products/import", body: csv, header: csvHeader, status: http.StatusOK},
+        {name: "import without upload", method: "POST", target: "/products/import", body: `{}`, status: http.StatusBadRequest, code: codeInvalidUpload},
+        {name: "create idempotently", method: "POST", target: "/products", header: map[string]string{"Idempotency-Key": "create-bench"},
+            body: `{"name": "Bench", "category": "home", "price": 120}`, status: http.StatusCreated},
+        {name: "create idempotently again", method: "POST", target: "/products", header: map[string]string{"Idempotency-Key": "create-bench"},
+            body: `{"name": "Bench", "category": "home", "price": 120}`, status: http.StatusCreated},
+
+        {name: "delete without If-Match", method: "DELETE", target: "/products/1", status: http.StatusPreconditionRequired, code: codePreconditionRequired},
+        {name: "delete stale version", method: "DELETE", target: "/products/1", header: ifMatch(`"1"`), status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+        {name: "delete", method: "DELETE", target: "/products/1", header: ifMatch("*"), status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/products/1", header: ifMatch("*"), status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "get deleted", target: "/products/1", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "get deleted as admin", target: "/products/1?include_deleted=true", status: http.StatusOK},
+        {name: "restore", method: "POST", target: "/products/1/restore", status: http.StatusOK},
+        {name: "restore live product", method: "POST", target: "/products/1/restore", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "get restored", target: "/products/1", status: http.StatusOK},
+    })
+}
+
+func TestAPICategories(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "list", target: "/categories", status: http.StatusOK},
+        {name: "get", target: "/categories/1", status: http.StatusOK},
+        {name: "get missing", target: "/categories/99", status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "create", method: "POST", target: "/categories", body: `{"name": "lighting", "parent_id": 1}`, status: http.StatusCreated},
+        {name: "create malformed", method: "POST", target: "/categories", body: `{"name": `, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create without name", method: "POST", target: "/categories", body: `{"name": " "}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create duplicate", method: "POST", target: "/categories", body: `{"name": "home"}`, status: http.StatusConflict, code: codeCategoryExists},
+        {name: "create under unknown parent", method: "POST", target: "/categories", body: `{"name": "garden", "parent_id": 99}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "move into own subtree", method: "PUT", target: "/categories/1", body: `{"name": "home", "parent_id": 3}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "rename to a taken name", method: "PUT", target: "/categories/3", body: `{"name": "office", "parent_id": 1}`, status: http.StatusConflict, code: codeCategoryExists},
+        {name: "update missing", method: "PUT", target: "/categories/99", body: `{"name": "garden"}`, status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "rename", method: "PUT", target: "/categories/1", body: `{"name": "living"}`, status: http.StatusOK},
+        {name: "products of renamed category", target: "/products?category=living", status: http.StatusOK},
+        {name: "products", target: "/categories/1/products", status: http.StatusOK},
+        {name: "products of missing category", target: "/categories/99/products", status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "delete with products", method: "DELETE", target: "/categories/1", status: http.StatusConflict, code: codeCategoryNotEmpty},
+        {name: "delete as editor", method: "DELETE", target: "/categories/3", token: signIn(t, router, "eve", RoleEditor), status: http.StatusForbidden, code: codeForbidden},
+        {name: "delete", method: "DELETE", target: "/categories/3", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/categories/3", status: http.StatusNotFound, code: codeCategoryNotFound},
+        {name: "delete empty", method: "DELETE", target: "/categories/2", status: http.StatusNoContent},
+    })
+
+    // The rename reached the product, and counted as a change to it.
+    var product Product
+    decodeAPI(t, serveAPI(router, apiTest{target: "/products/1"}), &product)
+    if product.Category != "living" || product.Version != 2 {
+        t.Errorf("product after the rename = %+v, want category living at version 2", product)
+    }
+}
+
+func TestAPIVendors(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/vendors", body: `{"name": "Acme", "contact_email": "sales@acme.test"}`, status: http.StatusCreated},
+        {name: "create another", method: "POST", target: "/vendors", body: `{"name": "Globex"}`, status: http.StatusCreated},
+        {name: "create duplicate", method: "POST", target: "/vendors", body: `{"name": "Acme"}`, status: http.StatusConflict, code: codeVendorExists},
+        {name: "create invalid email", method: "POST", target: "/vendors", body: `{"name": "Initech", "contact_email": "sales"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create malformed", method: "POST", target: "/vendors", body: `{"name": "Initech", "phone": "555"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "list", target: "/vendors", status: http.StatusOK},
+        {name: "get", target: "/vendors/1", status: http.StatusOK},
+        {name: "get missing", target: "/vendors/99", status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "update", method: "PUT", target: "/vendors/1", body: `{"name": "Acme Corp", "contact_email": "sales@acme.test"}`, status: http.StatusOK},
+        {name: "update to a taken name", method: "PUT", target: "/vendors/1", body: `{"name": "Globex"}`, status: http.StatusConflict, code: codeVendorExists},
+        {name: "update without name", method: "PUT", target: "/vendors/1", body: `{"name": ""}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", method: "PUT", target: "/vendors/99", body: `{"name": "Initech"}`, status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "set product vendor", method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 1}`, status: http.StatusOK},
+        {name: "set unknown vendor", method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 99}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set vendor of missing product", method: "PUT", target: "/products/99/vendor", body: `{"vendor_id": 1}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "products", target: "/vendors/1/products", status: http.StatusOK},
+        {name: "products of missing vendor", target: "/vendors/99/products", status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "delete with products", method: "DELETE", target: "/vendors/1", status: http.StatusConflict, code: codeVendorNotEmpty},
+        {name: "delete", method: "DELETE", target: "/vendors/2", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/vendors/2", status: http.StatusNotFound, code: codeVendorNotFound},
+    })
+}
+
+func TestAPIReviewsAndRelations(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "create another product", method: "POST", target: "/products", body: `{"name": "Bulb", "category": "home", "price": 2.99}`, status: http.StatusCreated},
+
+        {name: "review", method: "POST", target: "/products/1/reviews", body: `{"rating": 4}`, status: http.StatusCreated},
+        {name: "review again", method: "POST", target: "/products/1/reviews", body: `{"rating": 5}`, status: http.StatusConflict, code: codeReviewExists},
+        {name: "review with invalid rating", method: "POST", target: "/products/2/reviews", body: `{"rating": 6}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "review malformed", method: "POST", target: "/products/2/reviews", body: `{"rating": "four"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "review missing product", method: "POST", target: "/products/99/reviews", body: `{"rating": 4}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "review anonymous", method: "POST", target: "/products/2/reviews", body: `{"rating": 4}`, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "reviews", target: "/products/1/reviews", status: http.StatusOK},
+        {name: "reviews invalid limit", target: "/products/1/reviews?limit=-1", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "reviews of missing product", target: "/products/99/reviews", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "delete review", method: "DELETE", target: "/products/1/reviews/1", status: http.StatusNoContent},
+        {name: "delete review again", method: "DELETE", target: "/products/1/reviews/1", status: http.StatusNotFound, code: codeReviewNotFound},
+
+        {name: "relate", method: "POST", target: "/products/1/relations", body: `{"related_id": 2, "kind": "accessory"}`, status: http.StatusCreated},
+        {name: "relate again", method: "POST", target: "/products/1/relations", body: `{"related_id": 2, "kind": "accessory"}`, status: http.StatusCreated},
+        {name: "relate to itself", method: "POST", target: "/products/1/relations", body: `{"related_id": 1, "kind": "related"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "relate with unknown kind", method: "POST", target: "/products/1/relations", body: `{"related_id": 2, "kind": "spare"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "relate to missing product", method: "POST", target: "/products/1/relations", body: `{"related_id": 99, "kind": "related"}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "relations", target: "/products/1/relations", status: http.StatusOK},
+        {name: "related", target: "/products/1/related?kind=accessory", status: http.StatusOK},
+        {name: "related of unknown kind", target: "/products/1/related?kind=spare", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "unrelate with unknown kind", method: "DELETE", target: "/products/1/relations/2?kind=spare", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "unrelate", method: "DELETE", target: "/products/1/relations/2?kind=accessory", status: http.StatusNoContent},
+        {name: "unrelate again", method: "DELETE", target: "/products/1/relations/2", status: http.StatusNotFound, code: codeRelationNotFound},
+    })
+}
+
+func TestAPITags(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/tags", body: `{"name": "sale"}`, status: http.StatusCreated},
+        {name: "create duplicate", method: "POST", target: "/tags", body: `{"name": "sale"}`, status: http.StatusConflict, code: codeTagExists},
+        {name: "create invalid name", method: "POST", target: "/tags", body: `{"name": "On Sale"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "list", target: "/tags", status: http.StatusOK},
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "tag product", method: "PUT", target: "/products/1/tags", body: `{"tags": ["sale", "new"]}`, status: http.StatusOK},
+        {name: "tag product with invalid name", method: "PUT", target: "/products/1/tags", body: `{"tags": ["on sale"]}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "tag missing product", method: "PUT", target: "/products/99/tags", body: `{"tags": ["sale"]}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "list by tag", target: "/products?tags=sale", status: http.StatusOK},
+        {name: "untag product", method: "DELETE", target: "/products/1/tags/sale", status: http.StatusOK},
+        {name: "untag product again", method: "DELETE", target: "/products/1/tags/sale", status: http.StatusNotFound, code: codeTagNotFound},
+        {name: "delete", method: "DELETE", target: "/tags/sale", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/tags/sale", status: http.StatusNotFound, code: codeTagNotFound},
+    })
+}
+
+func TestAPIVariantsAndStock(t *testing.T) {
+    router := setupAPI(t)
+    variant := `{"sku": "TS-RED-M", "attributes": {"color": "red"}, "price": 21.5, "stock": 10}`
+    runAPITests(t, router, []apiTest{
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "T-shirt", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+
+        {name: "create variant", method: "POST", target: "/products/1/variants", body: variant, status: http.StatusCreated},
+        {name: "create variant with sku in use", method: "POST", target: "/products/1/variants", body: variant, status: http.StatusConflict, code: codeSKUInUse},
+        {name: "create variant without sku", method: "POST", target: "/products/1/variants", body: `{"sku": " ", "stock": 10}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create variant with negative stock", method: "POST", target: "/products/1/variants", body: `{"sku": "TS-RED-L", "stock": -1}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create variant of missing product", method: "POST", target: "/products/99/variants", body: `{"sku": "TS-RED-L", "stock": 1}`,
+            status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "variants", target: "/products/1/variants", status: http.StatusOK},
+        {name: "variants of missing product", target: "/products/99/variants", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "variant", target: "/products/1/variants/1", status: http.StatusOK},
+        {name: "missing variant", target: "/products/1/variants/99", status: http.StatusNotFound, code: codeVariantNotFound},
+        {name: "update variant", method: "PUT", target: "/products/1/variants/1", body: `{"sku": "TS-RED-L", "stock": 5}`, status: http.StatusOK},
+        {name: "update variant without sku", method: "PUT", target: "/products/1/variants/1", body: `{"stock": 5}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing variant", method: "PUT", target: "/products/1/variants/99", body: variant, status: http.StatusNotFound, code: codeVariantNotFound},
+        {name: "delete variant", method: "DELETE", target: "/products/1/variants/1", status: http.StatusNoContent},
+        {name: "delete variant again", method: "DELETE", target: "/products/1/variants/1", status: http.StatusNotFound, code: codeVariantNotFound},
+
+        {name: "stock", target: "/products/1/stock", status: http.StatusOK},
+        {name: "stock of missing product", target: "/products/99/stock", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "receive", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 5, "reason": "received"}`, status: http.StatusOK},
+        {name: "sell", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": -2, "reason": "sold"}`, status: http.StatusOK},
+        {name: "sell more than in stock", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": -4, "reason": "sold"}`, status: http.StatusConflict, code: codeInsufficientStock},
+        {name: "adjust by nothing", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 0, "reason": "sold"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "adjust for unknown reason", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": -1, "reason": "lost"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "adjust malformed", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": "-1"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "adjust missing product", method: "POST", target: "/products/99/stock/adjust", body: `{"delta": 1, "reason": "received"}`, status: http.StatusNotFound, code: codeProductNotFound},
+    })
+}
+
+func TestAPIPricesAndCurrencies(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+
+        {name: "price history", target: "/products/1/prices", status: http.StatusOK},
+        {name: "price history of missing product", target: "/products/99/prices", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "schedule", method: "POST", target: "/products/1/prices", body: `{"price": 9.99, "effective_from": "2099-01-01T00:00:00Z"}`, status: http.StatusCreated},
+        {name: "schedule in the past", method: "POST", target: "/products/1/prices", body: `{"price": 9.99, "effective_from": "2001-01-01T00:00:00Z"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "schedule negative price", method: "POST", target: "/products/1/prices", body: `{"price": -1, "effective_from": "2099-01-01T00:00:00Z"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "schedule malformed", method: "POST", target: "/products/1/prices", body: `{"price": 9.99, "effective_from": "soon"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "schedule for missing product", method: "POST", target: "/products/99/prices", body: `{"price": 9.99, "effective_from": "2099-01-01T00:00:00Z"}`,
+            status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "cancel", method: "DELETE", target: "/products/1/prices/scheduled/1", status: http.StatusNoContent},
+        {name: "cancel again", method: "DELETE", target: "/products/1/prices/scheduled/1", status: http.StatusConflict, code: codeScheduledPriceNotPending},
+        {name: "cancel missing", method: "DELETE", target: "/products/1/prices/scheduled/99", status: http.StatusNotFound, code: codeScheduledPriceNotFound},
+
+        {name: "set exchange rates", method: "PUT", target: "/admin/exchange-rates", body: `{"EUR": 0.92, "GBP": 0.79}`, status: http.StatusOK},
+        {name: "set rate of base currency", method: "PUT", target: "/admin/exchange-rates", body: `{"USD": 1}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set negative rate", method: "PUT", target: "/admin/exchange-rates", body: `{"EUR": -0.92}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "exchange rates", target: "/exchange-rates", status: http.StatusOK},
+        {name: "get converted", target: "/products/1?currency=GBP", status: http.StatusOK},
+        {name: "set currency price", method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": 18.5}`, status: http.StatusOK},
+        {name: "set negative currency price", method: "PUT", target: "/products/1/currency-prices/EUR", body: `{"price": -18.5}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set currency price of missing product", method: "PUT", target: "/products/99/currency-prices/EUR", body: `{"price": 18.5}`,
+            status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "set currency price of lowercase currency", method: "PUT", target: "/products/1/currency-prices/eur", body: `{"price": 18.5}`,
+            status: http.StatusNotFound, code: codeNotFound},
+        {name: "currency prices", target: "/products/1/currency-prices", status: http.StatusOK},
+        {name: "get in currency with a set price", target: "/products/1?currency=EUR", status: http.StatusOK},
+        {name: "delete currency price", method: "DELETE", target: "/products/1/currency-prices/EUR", status: http.StatusNoContent},
+        {name: "delete currency price again", method: "DELETE", target: "/products/1/currency-prices/EUR", status: http.StatusNotFound, code: codePriceNotFound},
+    })
+}
+
+func TestAPIImages(t *testing.T) {
+    router := setupAPI(t)
+    var encoded bytes.Buffer
+    if err := png.Encode(&encoded, image.NewNRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+        t.Fatal(err)
+    }
+    pixel, pixelHeader := upload(t, "file", encoded.Bytes())
+    text, textHeader := upload(t, "file", []byte("just some text"))
+    corrupt, corruptHeader := upload(t, "file", encoded.Bytes()[:encoded.Len()/2])
+    misnamed, misnamedHeader := upload(t, "image", encoded.Bytes())
+
+    runAPITests(t, router, []apiTest{
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "upload", method: "POST", target: "/products/1/images", body: pixel, header: pixelHeader, status: http.StatusCreated},
+        {name: "upload another", method: "POST", target: "/products/1/images", body: pixel, header: pixelHeader, status: http.StatusCreated},
+        {name: "upload text", method: "POST", target: "/products/1/images", body: text, header: textHeader, status: http.StatusUnsupportedMediaType, code: codeUnsupportedImageType},
+        {name: "upload corrupt image", method: "POST", target: "/products/1/images", body: corrupt, header: corruptHeader, status: http.StatusUnprocessableEntity, code: codeInvalidImage},
+        {name: "upload without file part", method: "POST", target: "/products/1/images", body: misnamed, header: misnamedHeader, status: http.StatusBadRequest, code: codeInvalidUpload},
+        {name: "upload for missing product", method: "POST", target: "/products/99/images", body: pixel, header: pixelHeader, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "images", target: "/products/1/images", status: http.StatusOK},
+        {name: "images of missing product", target: "/products/99/images", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "reorder", method: "PUT", target: "/products/1/images/order", body: `{"image_ids": [2, 1]}`, status: http.StatusOK},
+        {name: "reorder other images", method: "PUT", target: "/products/1/images/order", body: `{"image_ids": [3]}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "reorder malformed", method: "PUT", target: "/products/1/images/order", body: `{"image_ids": 2}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "delete", method: "DELETE", target: "/products/1/images/1", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/products/1/images/1", status: http.StatusNotFound, code: codeImageNotFound},
+    })
+}
+
+func TestAPIPromotions(t *testing.T) {
+    router := setupAPI(t)
+    promotion := `{"name": "Summer sale", "type": "percentage", "value": 20, "category": "home"}`
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/promotions", body: promotion, status: http.StatusCreated},
+        {name: "create malformed", method: "POST", target: "/promotions", body: `{"name": "Summer sale", "discount": 20}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid type", method: "POST", target: "/promotions", body: `{"name": "Summer sale", "type": "bogo", "value": 20}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create in unknown category", method: "POST", target: "/promotions", body: `{"name": "Garden sale", "type": "percentage", "value": 20, "category": "garden"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "list", target: "/promotions", status: http.StatusOK},
+        {name: "list active", target: "/promotions?active=true", status: http.StatusOK},
+        {name: "list invalid active", target: "/promotions?active=yes", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "get", target: "/promotions/1", status: http.StatusOK},
+        {name: "get missing", target: "/promotions/99", status: http.StatusNotFound, code: codePromotionNotFound},
+        {name: "discounted listing", target: "/products?category=home", status: http.StatusOK},
+        {name: "update", method: "PUT", target: "/promotions/1", body: `{"name": "Summer sale", "type": "percentage", "value": 30, "category": "home"}`, status: http.StatusOK},
+        {name: "update invalid discount", method: "PUT", target: "/promotions/1", body: `{"name": "Summer sale", "type": "fixed", "value": -5}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", method: "PUT", target: "/promotions/99", body: promotion, status: http.StatusNotFound, code: codePromotionNotFound},
+        {name: "delete", method: "DELETE", target: "/promotions/1", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/promotions/1", status: http.StatusNotFound, code: codePromotionNotFound},
+    })
+}
+
+func TestAPICartsAndCoupons(t *testing.T) {
+    router := setupAPI(t)
+    runAPITests(t, router, []apiTest{
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "receive stock", method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 5, "reason": "received"}`, status: http.StatusOK},
+
+        {name: "create cart", method: "POST", target: "/carts", body: `{"currency": "USD"}`, status: http.StatusCreated},
+        {name: "create cart in invalid currency", method: "POST", target: "/carts", body: `{"currency": "euro"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create cart anonymous", method: "POST", target: "/carts", body: `{"currency": "USD"}`, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "cart", target: "/carts/1", status: http.StatusOK},
+        {name: "missing cart", target: "/carts/99", status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "add item", method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 2}`, status: http.StatusOK},
+        {name: "add more than in stock", method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 6}`, status: http.StatusConflict, code: codeInsufficientStock},
+        {name: "add missing product", method: "POST", target: "/carts/1/items", body: `{"product_id": 99, "quantity": 1}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "add without quantity", method: "POST", target: "/carts/1/items", body: `{"product_id": 1}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "add to missing cart", method: "POST", target: "/carts/99/items", body: `{"product_id": 1, "quantity": 1}`, status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "update item", method: "PUT", target: "/carts/1/items/1", body: `{"quantity": 3}`, status: http.StatusOK},
+        {name: "update item to nothing", method: "PUT", target: "/carts/1/items/1", body: `{"quantity": 0}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update item not in cart", method: "PUT", target: "/carts/1/items/7", body: `{"quantity": 3}`, status: http.StatusNotFound, code: codeCartItemNotFound},
+
+        {name: "create coupon", method: "POST", target: "/coupons", body: `{"code": "summer-25", "type": "percentage", "value": 25, "usage_limit": 1}`, status: http.StatusCreated},
+        {name: "create duplicate coupon", method: "POST", target: "/coupons", body: `{"code": "SUMMER-25", "type": "percentage", "value": 10}`, status: http.StatusConflict, code: codeCouponExists},
+        {name: "create coupon with invalid code", method: "POST", target: "/coupons", body: `{"code": "25%", "type": "percentage", "value": 25}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "coupons", target: "/coupons", status: http.StatusOK},
+        {name: "coupon", target: "/coupons/1", status: http.StatusOK},
+        {name: "missing coupon", target: "/coupons/99", status: http.StatusNotFound, code: codeCouponNotFound},
+        {name: "validate", method: "POST", target: "/coupons/validate", body: `{"code": "summer-25", "items": [{"product_id": 1, "quantity": 1}]}`, status: http.StatusOK},
+        {name: "validate against cart", method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25", "cart_id": 1}`, status: http.StatusOK},
+        {name: "validate without items", method: "POST", target: "/coupons/validate", body: `{"code": "SUMMER-25"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "validate missing coupon", method: "POST", target: "/coupons/validate", body: `{"code": "WINTER-10", "items": [{"product_id": 1, "quantity": 1}]}`,
+            status: http.StatusNotFound, code: codeCouponNotFound},
+        {name: "redeem against missing cart", method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 99}`, status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "redeem", method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, status: http.StatusOK},
+        {name: "redeem used up coupon", method: "POST", target: "/coupons/redeem", body: `{"code": "SUMMER-25", "cart_id": 1}`, status: http.StatusConflict, code: codeCouponNotRedeemable},
+
+        {name: "remove item", method: "DELETE", target: "/carts/1/items/1", status: http.StatusOK},
+        {name: "remove item again", method: "DELETE", target: "/carts/1/items/1", status: http.StatusNotFound, code: codeCartItemNotFound},
+        {name: "delete cart", method: "DELETE", target: "/carts/1", status: http.StatusNoContent},
+        {name: "delete cart again", method: "DELETE", target: "/carts/1", status: http.StatusNotFound, code: codeCartNotFound},
+        {name: "delete coupon", method: "DELETE", target: "/coupons/1", status: http.StatusNoContent},
+        {name: "delete coupon again", method: "DELETE", target: "/coupons/1", status: http.StatusNotFound, code: codeCouponNotFound},
+    })
+}
+
+func TestAPIUsersAndFavorites(t *testing.T) {
+    router := setupAPI(t)
+    ada, bob := signIn(t, router, "ada", RoleViewer), signIn(t, router, "bob", RoleViewer)
+    runAPITests(t, router, []apiTest{
+        {name: "login with wrong password", method: "POST", target: "/login", body: `{"username": "ada", "password": "battery staple"}`, anonymous: true,
+            status: http.StatusUnauthorized, code: codeInvalidCredentials},
+        {name: "login as unknown user", method: "POST", target: "/login", body: `{"username": "eve", "password": "correct horse"}`, anonymous: true,
+            status: http.StatusUnauthorized, code: codeInvalidCredentials},
+        {name: "login malformed", method: "POST", target: "/login", body: `{"username": "ada", "password": 1}`, anonymous: true, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "viewer reads", target: "/products/1", token: ada, status: http.StatusOK},
+        {name: "viewer can't write", method: "POST", target: "/products", body: `{"name": "Desk", "category": "office", "price": 199}`, token: ada,
+            status: http.StatusForbidden, code: codeForbidden},
+        {name: "viewer can't administer", target: "/stats", token: ada, status: http.StatusForbidden, code: codeForbidden},
+
+        {name: "add favorite", method: "POST", target: "/users/1/favorites/1", token: ada, status: http.StatusCreated},
+        {name: "add favorite again", method: "POST", target: "/users/1/favorites/1", token: ada, status: http.StatusOK},
+        {name: "add favorite of missing product", method: "POST", target: "/users/1/favorites/99", token: ada, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "add favorite for someone else", method: "POST", target: "/users/1/favorites/1", token: bob, status: http.StatusForbidden, code: codeForbidden},
+        {name: "favorites", target: "/users/1/favorites", token: ada, status: http.StatusOK},
+        {name: "favorites of someone else", target: "/users/1/favorites", token: bob, status: http.StatusForbidden, code: codeForbidden},
+        {name: "favorites as admin", target: "/users/1/favorites", status: http.StatusOK},
+        {name: "favorites of missing user", target: "/users/99/favorites", status: http.StatusNotFound, code: codeUserNotFound},
+        {name: "favorites invalid limit", target: "/users/1/favorites?limit=0", token: ada, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "remove favorite", method: "DELETE", target: "/users/1/favorites/1", token: ada, status: http.StatusNoContent},
+        {name: "remove favorite again", method: "DELETE", target: "/users/1/favorites/1", token: ada, status: http.StatusNotFound, code: codeFavoriteNotFound},
+    })
+}
+
+func TestAPIKeys(t *testing.T) {
+    router := setupAPI(t)
+    w := serveAPI(router, apiTest{method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "role": "editor"}`})
+    if w.Code != http.StatusCreated {
+        t.Fatalf("issuing an API key = %d: %s", w.Code, w.Body)
+    }
+    var issued APIKey
+    decodeAPI(t, w, &issued)
+    key := map[string]string{"X-API-Key": issued.Key}
+
+    runAPITests(t, router, []apiTest{
+        {name: "issue without name", method: "POST", target: "/admin/api-keys", body: `{"role": "editor"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "issue with unknown role", method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "role": "owner"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "issue for unknown vendor", method: "POST", target: "/admin/api-keys", body: `{"name": "importer", "role": "editor", "vendor_id": 99}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "key writes", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, header: key, anonymous: true, status: http.StatusCreated},
+        {name: "key can't delete", method: "DELETE", target: "/products/1", header: map[string]string{"X-API-Key": issued.Key, "If-Match": "*"}, anonymous: true,
+            status: http.StatusForbidden, code: codeForbidden},
+        {name: "key can't issue keys", method: "POST", target: "/admin/api-keys", body: `{"name": "other", "role": "viewer"}`, header: key, anonymous: true,
+            status: http.StatusForbidden, code: codeForbidden},
+        {name: "unknown key", target: "/products", header: map[string]string{"X-API-Key": "nope"}, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "revoke", method: "DELETE", target: fmt.Sprintf("/admin/api-keys/%d", issued.ID), status: http.StatusNoContent},
+        {name: "revoke again", method: "DELETE", target: fmt.Sprintf("/admin/api-keys/%d", issued.ID), status: http.StatusNotFound, code: codeAPIKeyNotFound},
+        {name: "revoked key", target: "/products", header: key, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+    })
+}
+
+func TestAPIWebhooks(t *testing.T) {
+    router := setupAPI(t)
+    webhook := `{"url": "https://example.com/hooks", "events": ["product.created"]}`
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/admin/webhooks", body: webhook, status: http.StatusCreated},
+        {name: "create with relative url", method: "POST", target: "/admin/webhooks", body: `{"url": "/hooks"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create for unknown event", method: "POST", target: "/admin/webhooks", body: `{"url": "https://example.com/hooks", "events": ["order.created"]}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create malformed", method: "POST", target: "/admin/webhooks", body: `{"url": 1}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "list", target: "/admin/webhooks", status: http.StatusOK},
+        {name: "get", target: "/admin/webhooks/1", status: http.StatusOK},
+        {name: "get missing", target: "/admin/webhooks/99", status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "update", method: "PUT", target: "/admin/webhooks/1", body: `{"url": "https://example.com/hooks/v2", "events": ["product.created"]}`, status: http.StatusOK},
+        {name: "update with relative url", method: "PUT", target: "/admin/webhooks/1", body: `{"url": "/hooks"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", method: "PUT", target: "/admin/webhooks/99", body: webhook, status: http.StatusNotFound, code: codeWebhookNotFound},
+    })
+
+    // A delivery that ran out of attempts and one that went through, for the delivery
+    // endpoints to find.
+    if _, err := DB.ExecContext(context.Background(), `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, status, attempts, last_error)
+        VALUES (1, 'evt-1', 'product.created', '{}', 'failed', 8, 'connection refused'), (1, 'evt-2', 'product.created', '{}', 'delivered', 1, NULL)`); err != nil {
+        t.Fatal(err)
+    }
+    runAPITests(t, router, []apiTest{
+        {name: "deliveries", target: "/admin/webhooks/1/deliveries?status=failed", status: http.StatusOK},
+        {name: "deliveries of unknown status", target: "/admin/webhooks/1/deliveries?status=lost", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "deliveries of missing webhook", target: "/admin/webhooks/99/deliveries", status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "attempts", target: "/admin/webhooks/1/deliveries/1/attempts", status: http.StatusOK},
+        {name: "attempts of missing delivery", target: "/admin/webhooks/1/deliveries/99/attempts", status: http.StatusNotFound, code: codeDeliveryNotFound},
+        {name: "retry", method: "POST", target: "/admin/webhooks/1/deliveries/1/retry", status: http.StatusAccepted},
+        {name: "retry delivered delivery", method: "POST", target: "/admin/webhooks/1/deliveries/2/retry", status: http.StatusConflict, code: codeDeliveryNotFailed},
+        {name: "retry missing delivery", method: "POST", target: "/admin/webhooks/1/deliveries/99/retry", status: http.StatusNotFound, code: codeDeliveryNotFound},
+        {name: "delete", method: "DELETE", target: "/admin/webhooks/1", status: http.StatusNoContent},
+        {name: "delete again", method: "DELETE", target: "/admin/webhooks/1", status: http.StatusNotFound, code: codeWebhookNotFound},
+    })
+}
+
+func TestAPIOperations(t *testing.T) {
+    router := setupAPI(t)
+    saved := readOnlyMode.Load()
+    t.Cleanup(func() {
+        // Read-only mode is kept in a table resetPostgres leaves alone, so turn it off
+        // whatever happened.
+        DB.ExecContext(context.Background(), "UPDATE service_settings SET read_only = false, read_only_message = ''")
+        readOnlyMode.Store(saved)
+    })
+    runAPITests(t, router, []apiTest{
+        {name: "healthz", target: "/healthz", anonymous: true, status: http.StatusOK},
+        {name: "readyz", target: "/readyz", anonymous: true, status: http.StatusOK},
+        {name: "openapi", target: "/openapi.json", anonymous: true, status: http.StatusOK},
+        {name: "graphql schema", target: "/graphql/schema", anonymous: true, status: http.StatusOK},
+        {name: "no such endpoint", target: "/nowhere", status: http.StatusNotFound, code: codeNotFound},
+        {name: "create product", method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {name: "graphql", method: "POST", target: "/graphql", body: `{"query": "{ product(id: 1) { id name } }"}`, status: http.StatusOK},
+        {name: "graphql malformed", method: "POST", target: "/graphql", body: `{"query": 1}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "graphql syntax error", method: "POST", target: "/graphql", body: `{"query": "{ product(id: "}`, status: http.StatusBadRequest},
+        {name: "stats", target: "/stats", status: http.StatusOK},
+        {name: "stats invalid range", target: "/stats?from=yesterday", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "jobs", target: "/jobs", status: http.StatusOK},
+        {name: "outbox", target: "/admin/outbox", status: http.StatusOK},
+
+        {name: "read-only mode", target: "/admin/read-only", status: http.StatusOK},
+        {name: "turn on read-only mode", method: "PUT", target: "/admin/read-only", body: `{"enabled": true, "message": "Back at 02:00 UTC."}`, status: http.StatusOK},
+        {name: "write in read-only mode", method: "POST", target: "/products", body: `{"name": "Desk", "category": "office", "price": 199}`,
+            status: http.StatusServiceUnavailable, code: codeUnavailable},
+        {name: "read in read-only mode", target: "/products/1", status: http.StatusOK},
+        {name: "batch get in read-only mode", method: "POST", target: "/products/batch-get", body: `{"ids": [1]}`, status: http.StatusOK},
+        {name: "turn off read-only mode", method: "PUT", target: "/admin/read-only", body: `{"enabled": false}`, status: http.StatusOK},
+        {name: "write after read-only mode", method: "POST", target: "/products", body: `{"name": "Desk", "category": "office", "price": 199}`, status: http.StatusCreated},
+    })
+}
+
+func TestAPITenants(t *testing.T) {
+    setupAPI(t)
+    AppConfig.TenancyEnabled = true
+    router := newVersionRouter(AppConfig)
+    t.Cleanup(func() {
+        forgetTenant("acme")
+        forgetTenant("nowhere")
+    })
+    acme := map[string]string{AppConfig.TenantHeader: "acme"}
+    runAPITests(t, router, []apiTest{
+        {name: "create", method: "POST", target: "/tenants", body: `{"slug": "acme", "name": "Acme Inc."}`, status: http.StatusCreated},
+        {name: "create duplicate", method: "POST", target: "/tenants", body: `{"slug": "acme", "name": "Acme Again"}`, status: http.StatusConflict, code: codeTenantExists},
+        {name: "create invalid slug", method: "POST", target: "/tenants", body: `{"slug": "Acme!", "name": "Acme Inc."}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "list", target: "/tenants", status: http.StatusOK},
+        {name: "get", target: "/tenants/acme", status: http.StatusOK},
+        {name: "get missing", target: "/tenants/nowhere", status: http.StatusNotFound, code: codeTenantNotFound},
+        {name: "tenant reads", target: "/products", header: acme, status: http.StatusOK},
+        {name: "tenant admin can't manage tenants", target: "/tenants", header: acme, status: http.StatusForbidden, code: codeForbidden},
+        {name: "disable default tenant", method: "PATCH", target: "/tenants/default", body: `{"disabled": true}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "disable", method: "PATCH", target: "/tenants/acme", body: `{"disabled": true}`, status: http.StatusOK},
+        {name: "disabled tenant", target: "/products", header: acme, status: http.StatusForbidden, code: codeTenantDisabled},
+        {name: "unknown tenant", target: "/products", header: map[string]string{AppConfig.TenantHeader: "nowhere"}, status: http.StatusNotFound, code: codeTenantNotFound},
+        {name: "update missing", method: "PATCH", target: "/tenants/nowhere", body: `{"name": "Nowhere"}`, status: http.StatusNotFound, code: codeTenantNotFound},
+    })
+}
+
+func TestAPIConcurrentUpdates(t *testing.T) {
+    router := setupAPI(t)
+    w := serveAPI(router, apiTest{method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`})
+    if w.Code != http.StatusCreated {
+        t.Fatalf("creating a product = %d: %s", w.Code, w.Body)
+    }
+
+    // Every request is made against version 1, so only the first to lock the row may apply.
+    const n = 10
+    statuses := serveConcurrently(router, n, func(i int) apiTest {
+        return apiTest{method: "PUT", target: "/products/1", header: ifMatch(`"1"`),
+            body: fmt.Sprintf(`{"name": "Lamp %d", "category": "home", "price": 19.99}`, i)}
+    })
+    if statuses[http.StatusOK] != 1 || statuses[http.StatusPreconditionFailed] != n-1 {
+        t.Errorf("statuses = %v, want one 200 and %d 412", statuses, n-1)
+    }
+    var product Product
+    decodeAPI(t, serveAPI(router, apiTest{target: "/products/1"}), &product)
+    if product.Version != 2 {
+        t.Errorf("version = %d, want 2", product.Version)
+    }
+}
+
+func TestAPIConcurrentStockAdjustments(t *testing.T) {
+    router := setupAPI(t)
+    for _, tt := range []apiTest{
+        {method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 5, "reason": "received"}`, status: http.StatusOK},
+    } {
+        if w := serveAPI(router, tt); w.Code != tt.status {
+            t.Fatalf("%s %s = %d: %s", tt.method, tt.target, w.Code, w.Body)
+        }
+    }
+
+    // Twice as many sales as there is stock for: half of them have to be refused.
+    statuses := serveConcurrently(router, 10, func(int) apiTest {
+        return apiTest{method: "POST", target: "/products/1/stock/adjust", body: `{"delta": -1, "reason": "sold"}`}
+    })
+    if statuses[http.StatusOK] != 5 || statuses[http.StatusConflict] != 5 {
+        t.Errorf("statuses = %v, want five 200 and five 409", statuses)
+    }
+    var stock StockLevel
+    decodeAPI(t, serveAPI(router, apiTest{target: "/products/1/stock"}), &stock)
+    if stock.Quantity != 0 {
+        t.Errorf("stock = %d, want 0", stock.Quantity)
+    }
+}
+
+func TestAPIConcurrentCouponRedemptions(t *testing.T) {
+    router := setupAPI(t)
+    for _, tt := range []apiTest{
+        {method: "POST", target: "/products", body: `{"name": "Lamp", "category": "home", "price": 19.99}`, status: http.StatusCreated},
+        {method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 5, "reason": "received"}`, status: http.StatusOK},
+        {method: "POST", target: "/carts", body: `{"currency": "USD"}`, status: http.StatusCreated},
+        {method: "POST", target: "/carts/1/items", body: `{"product_id": 1, "quantity": 1}`, status: http.StatusOK},
+        {method: "POST", target: "/coupons", body: `{"code": "ONCE", "type": "percentage", "value": 10, "usage_limit": 1}`, status: http.StatusCreated},
+    } {
+        if w := serveAPI(router, tt); w.Code != tt.status {
+            t.Fatalf("%s %s = %d: %s", tt.method, tt.target, w.Code, w.Body)
+        }
+    }
+
+    const n = 10
+    statuses := serveConcurrently(router, n, func(int) apiTest {
+        return apiTest{method: "POST", target: "/coupons/redeem", body: `{"code": "ONCE", "cart_id": 1}`}
+    })
+    if statuses[http.StatusOK] != 1 || statuses[http.StatusConflict] != n-1 {
+        t.Errorf("statuses = %v, want one 200 and %d 409", statuses, n-1)
+    }
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "time"
+)
+
+// Reason codes accepted by stock adjustments.
+var stockReasons = map[string]bool{
+    "received":   true,
+    "sold":       true,
+    "returned":   true,
+    "damaged":    true,
+    "correction": true,
+}
+
+// errInsufficientStock is returned when an adjustment would take stock below zero.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// StockLevel is the current stock of a product.
+type StockLevel struct {
+    ProductID int `json:"product_id" xml:"product_id"`
+    Quantity  int `json:"quantity" xml:"quantity"`
+}
+
+// StockAdjustment is a recorded change to a product's stock.
+type StockAdjustment struct {
+    ID        int       `json:"id"`
+    ProductID int       `json:"product_id"`
+    Delta     int       `json:"delta"`
+    Reason    string    `json:"reason"`
+    Note      string    `json:"note,omitempty"`
+    Quantity  int       `json:"quantity"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// getStock returns the stock level of a product.
+func getStock(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionRead, productID, "Failed to retrieve stock.") {
+        return
+    }
+    level, err := queryStockLevel(r.Context(), productID)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve stock.")
+        return
+    }
+
+    // If everything went well, return the stock level in the response body.
+    respond(w, r, http.StatusOK, level)
+}
+
+// queryStockLevel returns the stock level of a live product, or sql.ErrNoRows.
+func queryStockLevel(ctx context.Context, productID int) (StockLevel, error) {
+    level := StockLevel{ProductID: productID}
+    err := Reads.QueryRowScan(ctx, []interface{}{&level.Quantity}, "SELECT stock FROM products WHERE id = $1 AND deleted_at IS NULL", productID)
+    return level, err
+}
+
+// adjustStock applies a change to a product's stock from a JSON body like
+// {"delta": -2, "reason": "sold"}. Adjustments that would take the stock below zero are
+// rejected with 409 Conflict and leave it unchanged.
+func adjustStock(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    var adjustment StockAdjustment
+    if err := decodeJSON(r, &adjustment); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    if adjustment.Delta == 0 {
+        errs.add("delta", "must not be zero")
+    }
+    if !stockReasons[adjustment.Reason] {
+        errs.add("reason", "must be one of received, sold, returned, damaged or correction")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to adjust stock.") {
+        return
+    }
+    adjustment.ProductID = productID
+    err = applyStockAdjustment(r.Context(), &adjustment)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err == errInsufficientStock {
+        respondError(w, r, http.StatusConflict, codeInsufficientStock, "Not enough stock for this adjustment.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to adjust stock.")
+        return
+    }
+
+    // If everything went well, return the recorded adjustment with the new stock level.
+    respond(w, r, http.StatusOK, adjustment)
+}
+
+// applyStockAdjustment changes the stock and records the adjustment in one transaction,
+// filling in the resulting quantity, ID and time. The stock is changed with a single
+// conditional UPDATE, so concurrent decrements can never take it below zero.
+func applyStockAdjustment(ctx context.Context, adjustment *StockAdjustment) error {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    err = tx.QueryRowContext(ctx, "UPDATE products SET stock = stock + $1 WHERE id = $2 AND deleted_at IS NULL AND stock + $1 >= 0 RETURNING stock",
+        adjustment.Delta, adjustment.ProductID).Scan(&adjustment.Quantity)
+    if err == sql.ErrNoRows {
+        // Either the product doesn't exist or there isn't enough stock; find out which.
+        var exists bool
+        if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM products WHERE id = $1 AND deleted_at IS NULL)", adjustment.ProductID).Scan(&exists); err != nil {
+            return err
+        }
+        if exists {
+            return errInsufficientStock
+        }
+        return sql.ErrNoRows
+    } else if err != nil {
+        return err
+    }
+
+    err = tx.QueryRowContext(ctx, "INSERT INTO stock_adjustments (product_id, delta, reason, note, quantity) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+        adjustment.ProductID, adjustment.Delta, adjustment.Reason, adjustment.Note, adjustment.Quantity).Scan(&adjustment.ID, &adjustment.CreatedAt)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
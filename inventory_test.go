@@ -0,0 +1,36 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestInventoryHandlers(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    invalid := map[string]string{"id": "abc"}
+    body := `{"delta": -2, "reason": "sold"}`
+    tests := []handlerTest{
+        {name: "get", handler: getStock, target: "/products/1/stock", vars: product, answer: answerRows(map[string][]driver.Value{"SELECT stock": {int64(5)}}), status: http.StatusOK},
+        {name: "get invalid id", handler: getStock, target: "/products/abc/stock", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getStock, target: "/products/1/stock", vars: product, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "adjust", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: body, vars: product,
+            answer: answerRows(map[string][]driver.Value{"UPDATE products SET stock": {int64(3)}, "INSERT INTO stock_adjustments": {int64(1), time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "adjust invalid id", handler: adjustStock, method: "POST", target: "/products/abc/stock/adjust", body: body, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "adjust malformed", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: `{"delta": "-2"}`, vars: product,
+            status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "adjust by nothing", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: `{"delta": 0, "reason": "sold"}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "adjust unknown reason", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: `{"delta": -2, "reason": "lost"}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "adjust missing", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: body, vars: product,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {false}}), status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "adjust below zero", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: body, vars: product,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {true}}), status: http.StatusConflict, code: codeInsufficientStock},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "get", handler: getStock, target: "/products/1/stock", vars: product},
+        handlerTest{name: "adjust", handler: adjustStock, method: "POST", target: "/products/1/stock/adjust", body: body, vars: product},
+    ))
+}
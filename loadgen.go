@@ -0,0 +1,174 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// maxLoadRate is the most requests per second runLoad starts, more than one client machine
+// can sustain anyway.
+const maxLoadRate = 100000
+
+// LoadOptions describes the load runLoad sends to a running instance.
+type LoadOptions struct {
+    // BaseURL is where the instance is served, like http://localhost:8080.
+    BaseURL string
+    // Paths are requested with GET in turn, like /products?limit=20 or /products/1.
+    Paths []string
+    // Rate is how many requests are started per second, whether or not earlier ones have
+    // finished, so a slow server shows up as latency rather than as a lower rate.
+    Rate     int
+    Duration time.Duration
+    // MaxInFlight bounds the requests waiting for a response. Requests that would exceed it
+    // are dropped and counted rather than queued.
+    MaxInFlight int
+    Timeout     time.Duration
+    // Header is sent with every request, for credentials and the tenant.
+    Header http.Header
+}
+
+// Validate checks that the options describe load that can be sent.
+func (o LoadOptions) Validate() error {
+    switch {
+    case o.BaseURL == "":
+        return errors.New("base URL is required")
+    case len(o.Paths) == 0:
+        return errors.New("at least one path is required")
+    case o.Rate < 1 || o.Rate > maxLoadRate:
+        return fmt.Errorf("rate must be between 1 and %d", maxLoadRate)
+    case o.Duration <= 0:
+        return errors.New("duration must be positive")
+    case o.MaxInFlight < 1:
+        return errors.New("max in flight must be positive")
+    }
+    for _, path := range o.Paths {
+        if !strings.HasPrefix(path, "/") {
+            return fmt.Errorf("path %q must start with /", path)
+        }
+    }
+    return nil
+}
+
+// LoadReport summarizes the responses to a load run. Latencies are in milliseconds and only
+// cover requests that got a response.
+type LoadReport struct {
+    Requests int            `json:"requests"`
+    Dropped  int            `json:"dropped"`
+    Errors   int            `json:"errors"`
+    Statuses map[string]int `json:"statuses"`
+    Rate     float64        `json:"rate"`
+    Latency  LoadLatency    `json:"latency_ms"`
+}
+
+// LoadLatency holds latency percentiles in milliseconds.
+type LoadLatency struct {
+    P50 float64 `json:"p50"`
+    P90 float64 `json:"p90"`
+    P95 float64 `json:"p95"`
+    P99 float64 `json:"p99"`
+    Max float64 `json:"max"`
+}
+
+// runLoad sends the load opts describe and reports how the instance answered. It stops
+// early if ctx is done, reporting what was sent until then.
+func runLoad(ctx context.Context, opts LoadOptions) (LoadReport, error) {
+    if err := opts.Validate(); err != nil {
+        return LoadReport{}, err
+    }
+    client := &http.Client{
+        Timeout:   opts.Timeout,
+        Transport: &http.Transport{MaxIdleConnsPerHost: opts.MaxInFlight},
+    }
+    baseURL := strings.TrimSuffix(opts.BaseURL, "/")
+
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    report := LoadReport{Statuses: map[string]int{}}
+    var latencies []time.Duration
+    inFlight := make(chan struct{}, opts.MaxInFlight)
+
+    send := func(path string) {
+        defer wg.Done()
+        defer func() { <-inFlight }()
+        req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path, nil)
+        if err != nil {
+            mu.Lock()
+            report.Errors++
+            mu.Unlock()
+            return
+        }
+        req.Header = opts.Header.Clone()
+        start := time.Now()
+        resp, err := client.Do(req)
+        if err == nil {
+            // Read the whole body, so the latency covers it and the connection is reused.
+            _, err = io.Copy(io.Discard, resp.Body)
+            resp.Body.Close()
+        }
+        elapsed := time.Since(start)
+
+        mu.Lock()
+        defer mu.Unlock()
+        if err != nil {
+            report.Errors++
+            return
+        }
+        report.Statuses[strconv.Itoa(resp.StatusCode)]++
+        latencies = append(latencies, elapsed)
+    }
+
+    ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+    defer ticker.Stop()
+    deadline := time.NewTimer(opts.Duration)
+    defer deadline.Stop()
+    started := time.Now()
+loop:
+    for i := 0; ; i++ {
+        select {
+        case <-ctx.Done():
+            break loop
+        case <-deadline.C:
+            break loop
+        case <-ticker.C:
+        }
+        report.Requests++
+        select {
+        case inFlight <- struct{}{}:
+            wg.Add(1)
+            go send(opts.Paths[i%len(opts.Paths)])
+        default:
+            report.Dropped++
+        }
+    }
+    elapsed := time.Since(started)
+    wg.Wait()
+
+    report.Rate = math.Round(float64(report.Requests-report.Dropped)/elapsed.Seconds()*10) / 10
+    report.Latency = latencyPercentiles(latencies)
+    return report, nil
+}
+
+// latencyPercentiles returns the percentiles of latencies, using the nearest-rank method.
+func latencyPercentiles(latencies []time.Duration) LoadLatency {
+    if len(latencies) == 0 {
+        return LoadLatency{}
+    }
+    sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+    at := func(p float64) float64 {
+        rank := int(math.Ceil(p/100*float64(len(latencies)))) - 1
+        if rank < 0 {
+            rank = 0
+        }
+        return float64(latencies[rank].Microseconds()) / 1000
+    }
+    return LoadLatency{P50: at(50), P90: at(90), P95: at(95), P99: at(99), Max: at(100)}
+}
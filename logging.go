@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// requestIDKey is the context key holding the request's generated ID.
+const requestIDKey contextKey = "request_id"
+
+// requestLogKey is the context key holding the requestLog of the current request.
+const requestLogKey contextKey = "request_log"
+
+// logLevel is the level of the default logger, which a configuration reload changes.
+var logLevel slog.LevelVar
+
+// setupLogger makes a JSON slog logger at the configured level the default logger.
+func setupLogger(cfg Config) {
+    logLevel.UnmarshalText([]byte(cfg.LogLevel))
+    slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})))
+}
+
+// fatal logs err and exits. It is for startup failures only.
+func fatal(msg string, err error) {
+    slog.Error(msg, "error", err)
+    os.Exit(1)
+}
+
+// requestIDFromContext returns the request ID stored in ctx, or an empty string.
+func requestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey).(string)
+    return id
+}
+
+// requestLog collects the errors handlers report for a request, so they can be logged
+// together with the response status and latency once the request is done.
+type requestLog struct {
+    mu     sync.Mutex
+    errors []string
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status code written.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    if rec.status == 0 {
+        rec.status = status
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// requestLoggingMiddleware gives every request a generated ID, returned in the X-Request-ID
+// header, and logs one line per request with its method, path, status, latency, IDs and any
+// errors reported through logError.
+func requestLoggingMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        requestID := newID()
+        w.Header().Set("X-Request-ID", requestID)
+
+        reqLog := &requestLog{}
+        ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+        ctx = context.WithValue(ctx, requestLogKey, reqLog)
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r.WithContext(ctx))
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+
+        attrs := []any{
+            "method", r.Method,
+            "path", r.URL.Path,
+            "status", rec.status,
+            "latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+            "request_id", requestID,
+            "correlation_id", correlationIDFromContext(ctx),
+        }
+        reqLog.mu.Lock()
+        defer reqLog.mu.Unlock()
+        if len(reqLog.errors) > 0 {
+            slog.Error("request failed", append(attrs, "error", strings.Join(reqLog.errors, "; "))...)
+        } else {
+            slog.Info("request", attrs...)
+        }
+    })
+}
+
+// logError records an error that occurred while handling r. It is logged with the request's
+// status and latency when the request completes.
+func logError(r *http.Request, err error) {
+    if reqLog, ok := r.Context().Value(requestLogKey).(*requestLog); ok {
+        reqLog.mu.Lock()
+        reqLog.errors = append(reqLog.errors, err.Error())
+        reqLog.mu.Unlock()
+        return
+    }
+    slog.Error(err.Error(),
+        "method", r.Method,
+        "path", r.URL.Path,
+        "correlation_id", correlationIDFromContext(r.Context()),
+    )
+}
+
+// logContextError logs err for work that is not tied to an HTTP request, such as gRPC calls
+// and GraphQL resolvers, with the request ID from ctx and any other attributes given.
+func logContextError(ctx context.Context, err error, attrs ...interface{}) {
+    slog.Error(err.Error(), append([]interface{}{"request_id", requestIDFromContext(ctx)}, attrs...)...)
+}
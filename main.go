@@ -1,250 +1,1249 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "encoding/json"
+    "errors"
     "fmt"
-    "log"
+    "log/slog"
+    "net"
     "net/http"
+    "net/url"
+    "os"
+    "os/signal"
     "strconv"
     "strings"
+    "syscall"
+    "time"
 
+    "github.com/gorilla/mux"
     _ "github.com/lib/pq"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+    "google.golang.org/grpc"
 )
 
-http.HandleFunc("/product", getProduct).Methods("GET")
-http.HandleFunc("/products", getProducts).Methods("GET")
-http.HandleFunc("/product", deleteProduct).Methods("DELETE")
-http.HandleFunc("/product", updateProduct).Methods("PUT")
+// serve runs the API until it is interrupted or terminated, with the configuration flags in
+// args.
+func serve(args []string) {
+    var err error
+    AppConfig, err = loadConfig(args)
+    if err != nil {
+        fatal("loading configuration", err)
+    }
+    configArgs = args
+    setupLogger(AppConfig)
+
+    // Set up tracing before anything that creates spans.
+    shutdownTracing, err := setupTracing(context.Background(), AppConfig)
+    if err != nil {
+        fatal("setting up tracing", err)
+    }
+    defer shutdownTracing(context.Background())
+
+    // Open the database connection.
+    DB, err = openDB(AppConfig)
+    if err != nil {
+        fatal("opening database", err)
+    }
+    defer DB.Close()
+    var replica *sql.DB
+    if AppConfig.DatabaseReplicaURL != "" {
+        replica, err = openReplicaDB(AppConfig)
+        if err != nil {
+            fatal("opening read replica", err)
+        }
+        defer replica.Close()
+    }
+    Reads = newReadRouter(DB, replica, AppConfig.DBStatementCacheSize)
+
+    // Bring the schema up to date.
+    if AppConfig.AutoMigrate || AppConfig.MigrateOnly {
+        if err := migrate(context.Background(), DB); err != nil {
+            fatal("migrating database", err)
+        }
+    }
+    if AppConfig.MigrateOnly {
+        return
+    }
+    if AppConfig.TenancyEnabled {
+        if err := checkRowLevelSecurity(context.Background(), DB); err != nil {
+            fatal("checking tenant isolation", err)
+        }
+    }
+
+    // Find out whether changes are refused, before taking any.
+    if err := refreshReadOnlyMode(context.Background()); err != nil {
+        slog.Warn("reading read-only mode", "error", err)
+    }
+
+    // Set up the product and cart repositories.
+    Repo = newPostgresRepository(DB, Reads)
+    Carts = newPostgresCartRepository(DB)
+
+    // Connect to Redis, if anything is kept there.
+    Redis, err = newRedisClient(AppConfig)
+    if err != nil {
+        fatal("setting up redis", err)
+    }
+    if Redis != nil {
+        defer Redis.Close()
+        if err := pingWithRetry("redis", pingRedis, AppConfig.RedisConnectTimeout); err != nil {
+            fatal("connecting to redis", err)
+        }
+    }
+
+    // Set up the product cache.
+    ProductCache, err = newCache(AppConfig, Redis)
+    if err != nil {
+        fatal("setting up cache", err)
+    }
+
+    // Set up currency conversion.
+    Rates = newCachingRateProvider(dbRateProvider{}, AppConfig.RateCacheTTL)
+
+    // Set up the image store.
+    Images, err = newImageStore(AppConfig)
+    if err != nil {
+        fatal("setting up image store", err)
+    }
+
+    // Set up the event broker, if there is one.
+    Events, err = newEventPublisher(AppConfig)
+    if err != nil {
+        fatal("setting up event publisher", err)
+    }
+    if Events != nil {
+        defer Events.Close()
+    }
+
+    // Set up the search index, if there is one.
+    if index := newOpenSearchIndex(context.Background(), AppConfig); index != nil {
+        Searches = index
+    }
+    OutboxSinks = newOutboxSinks(Events, Searches)
+
+    // Set up the idempotency store.
+    Idempotency, err = newIdempotencyStore(AppConfig, Redis)
+    if err != nil {
+        fatal("setting up idempotency store", err)
+    }
+
+    // Set up the rate limiter. It is served with the configuration, which reloads can change.
+    limiter, err := newRateLimiter(AppConfig, Redis)
+    if err != nil {
+        fatal("setting up rate limiter", err)
+    }
+    liveConfig.Store(&LiveConfig{Config: AppConfig, RateLimit: limiter})
+
+    router := newVersionRouter(AppConfig)
+    if err := checkOpenAPIRoutes(router); err != nil {
+        fatal("checking OpenAPI document", err)
+    }
+    // CORS wraps the router rather than joining its middleware chain, because preflight
+    // OPTIONS requests match no route.
+    server := newServer(AppConfig, corsMiddleware(AppConfig)(router))
+    redirectServer, err := setupTLS(AppConfig, server)
+    if err != nil {
+        fatal("setting up TLS", err)
+    }
+
+    // Start the server in the background and wait for it to fail or for a shutdown signal.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    // Run the background jobs until shutdown. A job with a zero interval is off.
+    Jobs.Add(Job{Name: "price-scheduler", Interval: AppConfig.PriceSchedulerInterval, Run: applyScheduledPrices})
+    Jobs.Add(Job{Name: "publisher", Interval: AppConfig.PublisherInterval, Run: publishScheduledProducts})
+    Jobs.Add(Job{Name: "cart-expiry", Interval: AppConfig.CartExpiryInterval, Run: expireCarts})
+    Jobs.Add(webhookDispatchJob(AppConfig.WebhookDispatchInterval))
+    Jobs.Add(Job{Name: "outbox-cleanup", Interval: outboxCleanupInterval, Run: cleanUpOutbox})
+    // Every instance follows read-only mode for itself.
+    Jobs.Add(Job{Name: "read-only-mode", Interval: AppConfig.ReadOnlyRefreshInterval, Shared: true, Run: refreshReadOnlyMode})
+    // Every instance checks the replica, as each decides for itself where its reads go.
+    if replica != nil {
+        Jobs.Add(Job{Name: "replica-check", Interval: AppConfig.DBReplicaCheckInterval, Shared: true, Run: Reads.checkReplica})
+    }
+    // Keep exchange rates up to date from the configured feed.
+    if url := AppConfig.ExchangeRatesURL; url != "" {
+        Jobs.Add(Job{Name: "exchange-rates", Interval: AppConfig.ExchangeRatesRefreshInterval, Run: func(ctx context.Context) error {
+            return refreshExchangeRates(ctx, url)
+        }})
+    }
+    Jobs.Start(ctx)
+    go runOutboxDispatcher(ctx, OutboxSinks, AppConfig.OutboxPollInterval)
+
+    serveErr := make(chan error, 3)
+    go func() {
+        if server.TLSConfig != nil {
+            // The certificates come from server.TLSConfig.
+            serveErr <- server.ListenAndServeTLS("", "")
+        } else {
+            serveErr <- server.ListenAndServe()
+        }
+    }()
+    if redirectServer != nil {
+        go func() {
+            serveErr <- redirectServer.ListenAndServe()
+        }()
+    }
+
+    // Serve the gRPC API alongside, if it is enabled.
+    var grpcServer *grpc.Server
+    if AppConfig.GRPCAddr != "" {
+        listener, err := net.Listen("tcp", AppConfig.GRPCAddr)
+        if err != nil {
+            fatal("listening for gRPC", err)
+        }
+        grpcServer = newGRPCServer()
+        go func() {
+            serveErr <- grpcServer.Serve(listener)
+        }()
+    }
+    select {
+    case err := <-serveErr:
+        fatal("serving HTTP", err)
+    case <-ctx.Done():
+    }
+
+    // Stop accepting connections and let in-flight requests finish. The database is closed
+    // by the deferred DB.Close once they have.
+    slog.Info("shutting down")
+    startShutdown(AppConfig.ShutdownTimeout)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), AppConfig.ShutdownTimeout)
+    defer cancel()
+    if grpcServer != nil {
+        stopGRPCServer(shutdownCtx, grpcServer)
+    }
+    if redirectServer != nil {
+        redirectServer.Shutdown(shutdownCtx)
+    }
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        slog.Error("shutting down HTTP server", "error", err)
+    }
+}
+
+// openDB opens the Postgres connection pool described by cfg and waits until the database
+// answers, so the service fails at startup rather than on its first request.
+func openDB(cfg Config) (*sql.DB, error) {
+    db, err := openTracedDB(cfg)
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+    db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+    db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
+    if err := pingWithRetry("database", db.PingContext, cfg.DBConnectTimeout); err != nil {
+        db.Close()
+        return nil, err
+    }
+    return db, nil
+}
+
+// pingWithRetry calls ping until the named dependency answers or timeout has passed, backing
+// off exponentially between attempts. This lets the service start alongside a database or
+// Redis that is still booting, as happens in docker-compose and Kubernetes.
+func pingWithRetry(name string, ping func(ctx context.Context) error, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    backoff := 250 * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        err := ping(ctx)
+        cancel()
+        if err == nil {
+            return nil
+        }
+        if time.Now().Add(backoff).After(deadline) {
+            return fmt.Errorf("%s not reachable after %d attempts: %w", name, attempt, err)
+        }
+        slog.Warn(name+" not ready, retrying", "attempt", attempt, "backoff", backoff.String(), "error", err)
+        time.Sleep(backoff)
+        if backoff *= 2; backoff > 5*time.Second {
+            backoff = 5 * time.Second
+        }
+    }
+}
+
+// newServer returns an HTTP server for handler using the addresses and timeouts in cfg.
+func newServer(cfg Config, handler http.Handler) *http.Server {
+    return &http.Server{
+        Addr:         cfg.Addr,
+        Handler:      handler,
+        ReadTimeout:  cfg.ReadTimeout,
+        WriteTimeout: cfg.WriteTimeout,
+        IdleTimeout:  cfg.IdleTimeout,
+    }
+}
+
+// newRouter returns a router that serves the routes registered on it through the middleware
+// chain, and answers requests matching none of them with a 404.
+func newRouter(cfg Config) *mux.Router {
+    router := mux.NewRouter()
+    // Every routed request goes through this chain, outermost first. The recoverer sits inside
+    // logging and metrics so that a panic is logged and counted as the 500 it becomes.
+    middlewares := newChain(
+        Middleware(otelmux.Middleware(cfg.ServiceName)),
+        correlationIDMiddleware,
+        requestLoggingMiddleware,
+        metricsMiddleware,
+        compressionMiddleware(cfg),
+        recoverer,
+        deprecationMiddleware,
+        rateLimitMiddleware,
+        queryTimeoutMiddleware,
+        readOnlyModeMiddleware,
+        bodyLimitMiddleware,
+        tenantMiddleware,
+        readOnlyMiddleware,
+        idempotencyMiddleware,
+    )
+    router.Use(middlewares.Then)
+    router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        respondError(w, r, http.StatusNotFound, codeNotFound, "No such endpoint.")
+    })
+    router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        respondError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed.")
+    })
+    return router
+}
+
+// registerRoutes registers every route of the first version of the API.
+func registerRoutes(router *mux.Router, cfg Config) {
+    router.HandleFunc("/healthz", healthz).Methods("GET")
+    router.HandleFunc("/readyz", readyz).Methods("GET")
+    router.HandleFunc("/login", login).Methods("POST")
+    router.HandleFunc("/openapi.json", getOpenAPISpec).Methods("GET")
+    if cfg.DocsEnabled {
+        router.HandleFunc("/docs", getDocs).Methods("GET")
+    }
+    if cfg.MetricsEnabled {
+        router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+    }
+
+    // Reads need the viewer role, writes the editor role and deletes the admin role.
+    router.HandleFunc("/products", requireRole(RoleViewer, getProducts)).Methods("GET")
+    router.HandleFunc("/products", requireRole(RoleEditor, createProduct)).Methods("POST")
+    router.HandleFunc("/products/bulk", requireRole(RoleEditor, createProducts)).Methods("POST")
+    router.HandleFunc("/products/batch-get", requireRole(RoleViewer, batchGetProducts)).Methods("POST")
+    router.HandleFunc("/products/import", requireRole(RoleEditor, importProducts)).Methods("POST").Name(importRouteName)
+    router.HandleFunc("/products/export", requireRole(RoleViewer, exportProducts)).Methods("GET").Name(exportRouteName)
+    router.HandleFunc("/products/stream", requireRole(RoleViewer, streamProducts)).Methods("GET").Name(streamRouteName)
+    router.HandleFunc("/products/facets", requireRole(RoleViewer, getProductFacets)).Methods("GET")
+    router.HandleFunc("/products/search", requireRole(RoleViewer, searchProducts)).Methods("GET")
+    router.HandleFunc("/products/by-barcode", requireRole(RoleViewer, getProductByBarcode)).Methods("GET")
+    router.HandleFunc("/products/by-sku/{sku}", requireRole(RoleEditor, upsertProductBySKU)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}", requireRole(RoleViewer, getProduct)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}", requireRole(RoleEditor, updateProduct)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}", requireRole(RoleEditor, patchProduct)).Methods("PATCH")
+    router.HandleFunc("/products/{id:[0-9]+}", requireRole(RoleAdmin, deleteProduct)).Methods("DELETE")
+    router.HandleFunc("/categories", requireRole(RoleViewer, getCategories)).Methods("GET")
+    router.HandleFunc("/categories", requireRole(RoleEditor, createCategory)).Methods("POST")
+    router.HandleFunc("/categories/{id:[0-9]+}", requireRole(RoleViewer, getCategory)).Methods("GET")
+    router.HandleFunc("/categories/{id:[0-9]+}", requireRole(RoleEditor, updateCategory)).Methods("PUT")
+    router.HandleFunc("/categories/{id:[0-9]+}", requireRole(RoleAdmin, deleteCategory)).Methods("DELETE")
+    router.HandleFunc("/categories/{id:[0-9]+}/products", requireRole(RoleViewer, getCategoryProducts)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/history", requireRole(RoleEditor, getProductHistory)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/restore", requireRole(RoleAdmin, restoreProduct)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/stock", requireRole(RoleViewer, getStock)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/stock/adjust", requireRole(RoleEditor, adjustStock)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/recommendations", requireRole(RoleViewer, getRecommendations)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/images", requireRole(RoleViewer, getImages)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/images", requireRole(RoleEditor, uploadImage)).Methods("POST").Name(uploadImageRouteName)
+    router.HandleFunc("/products/{id:[0-9]+}/images/order", requireRole(RoleEditor, reorderImages)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/images/{image_id:[0-9]+}", requireRole(RoleAdmin, deleteImage)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/prices", requireRole(RoleViewer, getPrices)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/prices", requireRole(RoleEditor, schedulePrice)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/prices/scheduled/{schedule_id:[0-9]+}", requireRole(RoleEditor, cancelScheduledPrice)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/currency-prices", requireRole(RoleViewer, getCurrencyPrices)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/currency-prices/{currency:[A-Z]{3}}", requireRole(RoleEditor, setCurrencyPrice)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/currency-prices/{currency:[A-Z]{3}}", requireRole(RoleEditor, deleteCurrencyPrice)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/variants", requireRole(RoleViewer, getVariants)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/variants", requireRole(RoleEditor, createVariant)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/variants/{variant_id:[0-9]+}", requireRole(RoleViewer, getVariant)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/variants/{variant_id:[0-9]+}", requireRole(RoleEditor, updateVariant)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/variants/{variant_id:[0-9]+}", requireRole(RoleAdmin, deleteVariant)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/reviews", requireRole(RoleViewer, getReviews)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/reviews", requireRole(RoleViewer, createReview)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/reviews/{review_id:[0-9]+}", requireRole(RoleAdmin, deleteReview)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/tags", requireRole(RoleEditor, setProductTags)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/tags/{tag}", requireRole(RoleEditor, deleteProductTag)).Methods("DELETE")
+    router.HandleFunc("/products/{id:[0-9]+}/vendor", requireRole(RoleAdmin, setProductVendor)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/status", requireRole(RoleEditor, setProductStatus)).Methods("PUT")
+    router.HandleFunc("/products/{id:[0-9]+}/related", requireRole(RoleViewer, getRelatedProducts)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/relations", requireRole(RoleViewer, getProductRelations)).Methods("GET")
+    router.HandleFunc("/products/{id:[0-9]+}/relations", requireRole(RoleEditor, createProductRelation)).Methods("POST")
+    router.HandleFunc("/products/{id:[0-9]+}/relations/{related_id:[0-9]+}", requireRole(RoleEditor, deleteProductRelation)).Methods("DELETE")
+    router.HandleFunc("/tags", requireRole(RoleViewer, getTags)).Methods("GET")
+    router.HandleFunc("/tags", requireRole(RoleEditor, createTag)).Methods("POST")
+    router.HandleFunc("/tags/{name}", requireRole(RoleAdmin, deleteTag)).Methods("DELETE")
+    router.HandleFunc("/vendors", requireRole(RoleViewer, getVendors)).Methods("GET")
+    router.HandleFunc("/vendors", requireRole(RoleAdmin, createVendor)).Methods("POST")
+    router.HandleFunc("/vendors/{id:[0-9]+}", requireRole(RoleViewer, getVendor)).Methods("GET")
+    router.HandleFunc("/vendors/{id:[0-9]+}", requireRole(RoleAdmin, updateVendor)).Methods("PUT")
+    router.HandleFunc("/vendors/{id:[0-9]+}", requireRole(RoleAdmin, deleteVendor)).Methods("DELETE")
+    router.HandleFunc("/vendors/{id:[0-9]+}/products", requireRole(RoleViewer, getVendorProducts)).Methods("GET")
+    router.HandleFunc("/users/{id:[0-9]+}/favorites", requireRole(RoleViewer, getFavorites)).Methods("GET")
+    router.HandleFunc("/users/{id:[0-9]+}/favorites/{product_id:[0-9]+}", requireRole(RoleViewer, addFavorite)).Methods("POST")
+    router.HandleFunc("/users/{id:[0-9]+}/favorites/{product_id:[0-9]+}", requireRole(RoleViewer, removeFavorite)).Methods("DELETE")
+    router.HandleFunc("/promotions", requireRole(RoleViewer, getPromotions)).Methods("GET")
+    router.HandleFunc("/promotions", requireRole(RoleEditor, createPromotion)).Methods("POST")
+    router.HandleFunc("/promotions/{id:[0-9]+}", requireRole(RoleViewer, getPromotion)).Methods("GET")
+    router.HandleFunc("/promotions/{id:[0-9]+}", requireRole(RoleEditor, updatePromotion)).Methods("PUT")
+    router.HandleFunc("/promotions/{id:[0-9]+}", requireRole(RoleAdmin, deletePromotion)).Methods("DELETE")
+    router.HandleFunc("/coupons", requireRole(RoleEditor, getCoupons)).Methods("GET")
+    router.HandleFunc("/coupons", requireRole(RoleEditor, createCoupon)).Methods("POST")
+    router.HandleFunc("/coupons/validate", requireRole(RoleViewer, validateCoupon)).Methods("POST")
+    router.HandleFunc("/coupons/redeem", requireRole(RoleViewer, redeemCoupon)).Methods("POST")
+    router.HandleFunc("/coupons/{id:[0-9]+}", requireRole(RoleEditor, getCoupon)).Methods("GET")
+    router.HandleFunc("/coupons/{id:[0-9]+}", requireRole(RoleAdmin, deleteCoupon)).Methods("DELETE")
+    router.HandleFunc("/carts", requireRole(RoleViewer, createCart)).Methods("POST")
+    router.HandleFunc("/carts/{id:[0-9]+}", requireRole(RoleViewer, getCart)).Methods("GET")
+    router.HandleFunc("/carts/{id:[0-9]+}", requireRole(RoleViewer, deleteCart)).Methods("DELETE")
+    router.HandleFunc("/carts/{id:[0-9]+}/items", requireRole(RoleViewer, addCartItem)).Methods("POST")
+    router.HandleFunc("/carts/{id:[0-9]+}/items/{product_id:[0-9]+}", requireRole(RoleViewer, updateCartItem)).Methods("PUT")
+    router.HandleFunc("/carts/{id:[0-9]+}/items/{product_id:[0-9]+}", requireRole(RoleViewer, removeCartItem)).Methods("DELETE")
+    router.HandleFunc("/exchange-rates", requireRole(RoleViewer, getExchangeRates)).Methods("GET")
+    router.HandleFunc("/graphql", requireRole(RoleViewer, graphqlHandler)).Methods("POST")
+    router.HandleFunc("/graphql/schema", getGraphQLSchema).Methods("GET")
+
+    // Legacy query-string routes, kept for existing clients until they are sunset. See
+    // deprecatedRoutes.
+    router.HandleFunc("/product", requireRole(RoleViewer, getProduct)).Methods("GET")
+    router.HandleFunc("/product", requireRole(RoleEditor, createProduct)).Methods("POST")
+    router.HandleFunc("/product", requireRole(RoleEditor, updateProduct)).Methods("PUT")
+    router.HandleFunc("/product", requireRole(RoleAdmin, deleteProduct)).Methods("DELETE")
+    router.HandleFunc("/product/by-barcode", requireRole(RoleViewer, getProductByBarcode)).Methods("GET")
+
+    // API key management.
+    router.HandleFunc("/admin/api-keys", requireAdmin(issueAPIKey)).Methods("POST")
+    router.HandleFunc("/admin/api-keys/{id:[0-9]+}", requireAdmin(revokeAPIKey)).Methods("DELETE")
+    router.HandleFunc("/admin/exchange-rates", requireAdmin(setExchangeRates)).Methods("PUT")
 
-// Start the server.
-log.Fatal(http.ListenAndServe(":8080", nil))
+    // Webhooks.
+    router.HandleFunc("/admin/webhooks", requireAdmin(getWebhooks)).Methods("GET")
+    router.HandleFunc("/admin/webhooks", requireAdmin(createWebhook)).Methods("POST")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}", requireAdmin(getWebhook)).Methods("GET")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}", requireAdmin(updateWebhook)).Methods("PUT")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}", requireAdmin(deleteWebhook)).Methods("DELETE")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries", requireAdmin(getWebhookDeliveries)).Methods("GET")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}/attempts", requireAdmin(getDeliveryAttempts)).Methods("GET")
+    router.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}/retry", requireAdmin(retryDelivery)).Methods("POST")
+    router.HandleFunc("/admin/outbox", requireAdmin(getOutboxStatus)).Methods("GET")
+    // The search index holds every tenant's products, so only admins of the default tenant
+    // rebuild it.
+    if cfg.OpenSearchURL != "" {
+        router.HandleFunc("/admin/search/reindex", requirePlatformAdmin(reindexSearch)).Methods("POST")
+    }
+
+    // Catalog statistics.
+    router.HandleFunc("/stats", requireAdmin(getStats)).Methods("GET")
+    // Background jobs run across tenants, so only admins of the default tenant see them.
+    router.HandleFunc("/jobs", requirePlatformAdmin(getJobs)).Methods("GET")
+    // Each instance reloads its own configuration.
+    router.HandleFunc("/admin/config/reload", requirePlatformAdmin(reloadConfigHandler)).Methods("POST")
+    // Read-only mode applies to every tenant, so only admins of the default tenant change it.
+    router.HandleFunc("/admin/read-only", requirePlatformAdmin(getReadOnlyMode)).Methods("GET")
+    router.HandleFunc("/admin/read-only", requirePlatformAdmin(setReadOnlyMode)).Methods("PUT")
+
+    // Tenant management, for admins of the default tenant.
+    if cfg.TenancyEnabled {
+        router.HandleFunc("/tenants", requirePlatformAdmin(getTenants)).Methods("GET")
+        router.HandleFunc("/tenants", requirePlatformAdmin(createTenant)).Methods("POST")
+        router.HandleFunc("/tenants/{slug}", requirePlatformAdmin(getTenant)).Methods("GET")
+        router.HandleFunc("/tenants/{slug}", requirePlatformAdmin(updateTenant)).Methods("PATCH")
+    }
+
+    // Images in the local store are served from disk, unless they are published elsewhere.
+    if cfg.ImageStorage == "local" && cfg.ImageBaseURL == "" {
+        router.PathPrefix(localImagePrefix).Handler(imageFileServer(cfg.ImageDir)).Methods("GET", "HEAD")
+    }
 
-// Product represents a product in the database.
+    // Admin maintenance endpoints are opt-in. They work on tables every tenant shares, so
+    // only admins of the default tenant run them.
+    if cfg.MaintenanceEnabled {
+        router.HandleFunc("/admin/maintenance/analyze", requirePlatformAdmin(analyzeProducts)).Methods("POST")
+        router.HandleFunc("/admin/recompute-counts", requirePlatformAdmin(recomputeCounts)).Methods("POST")
+    }
+}
+
+// Product represents a product in the database. Price is in Currency, an ISO 4217 code.
 type Product struct {
-    ID          int     `json:"id"`
-    Name        string  `json:"name"`
-    Category    string  `json:"category"`
-    Price       float64 `json:"price"`
+    ID       int    `json:"id" xml:"id"`
+    Name     string `json:"name" xml:"name"`
+    Category string `json:"category" xml:"category"`
+    Price    Money  `json:"price" xml:"price"`
+    Currency string `json:"currency" xml:"currency"`
+    // EffectivePrice is the price after the promotion PromotionID. Listings set both while a
+    // promotion discounts the product.
+    EffectivePrice *Money `json:"effective_price,omitempty" xml:"effective_price,omitempty"`
+    PromotionID    int    `json:"promotion_id,omitempty" xml:"promotion_id,omitempty"`
+    ImageURL       string `json:"image_url,omitempty" xml:"image_url,omitempty"`
+    Barcode        string `json:"barcode,omitempty" xml:"barcode,omitempty"`
+    // SKU, when set, identifies the product to the external systems that sync it.
+    SKU string `json:"sku,omitempty" xml:"sku,omitempty"`
+    // Attributes are free-form details like brand or color, which listings can filter on.
+    Attributes Attributes `json:"attributes" xml:"attributes,omitempty"`
+    CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+    // UpdatedAt is when the product last changed in a way its reads show, which includes
+    // reviews, images and variants. It is sent as Last-Modified.
+    UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+    // DeletedAt is set on soft-deleted products, which only admins can see.
+    DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+    // Version is incremented by every change and is sent as the product's ETag.
+    Version int `json:"version" xml:"version"`
+    // ProductRating summarises the product's reviews. Reviews don't change Version, so a
+    // review doesn't get in the way of an editor's pending change.
+    ProductRating
+    // Tags are managed through /products/{id}/tags rather than written with the product.
+    Tags TagList `json:"tags" xml:"tags"`
+    // VendorID is the vendor supplying the product, if any. It is set when the product is
+    // created and changed through /products/{id}/vendor.
+    VendorID int `json:"vendor_id,omitempty" xml:"vendor_id,omitempty"`
+    // Status decides whether the product is on the storefront. A draft with PublishAt set is
+    // published at that time. Both are set when the product is created and changed through
+    // /products/{id}/status.
+    Status    ProductStatus `json:"status" xml:"status"`
+    PublishAt *time.Time    `json:"publish_at,omitempty" xml:"publish_at,omitempty"`
+}
+
+// keepDerived copies from current the fields of product that are not written with it: its
+// rating and tags, which are kept in other tables, its update time, which the database keeps,
+// its effective price, which only listings resolve, and the vendor and status of an existing
+// product. A new product starts from the zero Product, with the vendor and status it was
+// given; the status defaults to published.
+func (p *Product) keepDerived(current Product) {
+    p.ProductRating, p.Tags, p.UpdatedAt = current.ProductRating, current.Tags, current.UpdatedAt
+    p.EffectivePrice, p.PromotionID = current.EffectivePrice, current.PromotionID
+    if current.ID != 0 {
+        p.VendorID, p.Status, p.PublishAt = current.VendorID, current.Status, current.PublishAt
+    } else if p.Status == "" {
+        p.Status = StatusPublished
+    }
+}
+
+// ProductDetail is the representation of a single product, which also lists its images.
+type ProductDetail struct {
+    Product
+    Images []ProductImage `json:"images" xml:"images>image"`
+}
+
+// applyPatch copies the non-nil fields of patch onto product.
+func applyPatch(product *Product, patch ProductPatch) {
+    if patch.Name != nil {
+        product.Name = *patch.Name
+    }
+    if patch.Category != nil {
+        product.Category = *patch.Category
+    }
+    if patch.Price != nil {
+        product.Price = *patch.Price
+    }
+    if patch.Currency != nil {
+        product.Currency = *patch.Currency
+    }
+    if patch.ImageURL != nil {
+        product.ImageURL = *patch.ImageURL
+    }
+    if patch.Barcode != nil {
+        product.Barcode = *patch.Barcode
+    }
+    if patch.SKU != nil {
+        product.SKU = *patch.SKU
+    }
+    if patch.Attributes != nil {
+        product.Attributes = *patch.Attributes
+    }
+}
+
+// UpdateResult is the response body of updateProduct. Unchanged is set when the request
+// matched the stored product and nothing was written.
+type UpdateResult struct {
+    Product
+    Unchanged bool `json:"unchanged,omitempty" xml:"unchanged,omitempty"`
 }
 
 // Products is a collection of Product objects.
 type Products []Product
 
+// ProductList is the response envelope for product listings. Total counts every product
+// matching the filters, or estimates it when TotalApproximate is set because counting took
+// too long. NextCursor, when set, fetches the following page. Partial is set when the
+// server stopped scanning before the page was full.
+type ProductList struct {
+    Products         Products `json:"products" xml:"products>product"`
+    Total            int      `json:"total" xml:"total"`
+    TotalApproximate bool     `json:"total_approximate" xml:"total_approximate"`
+    Partial          bool     `json:"partial" xml:"partial"`
+    NextCursor       string   `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+}
+
 // DB is a global variable that represents the database connection.
 var DB *sql.DB
 
-// ErrorResponse is a helper struct for returning error messages in a standard format.
+// ErrorResponse is the body of every error response. Code identifies the error for
+// programs, Error describes it for people, Errors lists the problems with each field when
+// a body fails validation, and RequestID matches the X-Request-ID header, for support.
 type ErrorResponse struct {
-    Error string `json:"error"`
+    Code      string           `json:"code" xml:"code"`
+    Error     string           `json:"error" xml:"error"`
+    Errors    ValidationErrors `json:"errors,omitempty" xml:"errors>field_error,omitempty"`
+    RequestID string           `json:"request_id,omitempty" xml:"request_id,omitempty"`
+}
+
+// productIDFromRequest returns the product ID from the {id} path variable, or from the
+// id query parameter on the legacy /product routes.
+func productIDFromRequest(r *http.Request) (int, error) {
+    productIDStr, ok := mux.Vars(r)["id"]
+    if !ok {
+        productIDStr = r.URL.Query().Get("id")
+    }
+    return strconv.Atoi(productIDStr)
+}
+
+// requireLiveProduct checks that the product with the given ID exists, is not deleted and
+// that the policy allows action on it. If not, it writes a 404 Not Found or 403 Forbidden
+// response, or answers a failed lookup with message, and reports false.
+func requireLiveProduct(w http.ResponseWriter, r *http.Request, productID int, action Action, message string) bool {
+    product, err := Repo.GetByID(r.Context(), productID)
+    if err == ErrProductNotFound {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return false
+    } else if err != nil {
+        respondStoreError(w, r, err, message)
+        return false
+    }
+    return respondPolicyError(w, r, authorizeProduct(r.Context(), action, product), message)
 }
 
 // getProduct retrieves a single product from the database based on the product ID.
 func getProduct(w http.ResponseWriter, r *http.Request) {
-    // Get the product ID from the URL query string.
-    productIDStr := r.URL.Query().Get("id")
-    productID, err := strconv.Atoi(productIDStr)
+    // Get the product ID from the URL path or query string.
+    productID, err := productIDFromRequest(r)
     if err != nil {
         // If the product ID is not a valid integer, return an error.
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid product ID."})
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    // Admins can ask for soft-deleted products too. Those requests skip the cache, which
+    // only holds live products.
+    withDeleted := includeDeleted(r)
+    // Prices are only converted when asked for with ?currency=, and only the fields asked
+    // for with ?fields= are sent. The images are sent unless left out of those; the other
+    // related resources only when asked for with ?expand=.
+    currency, err := requestedCurrency(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
         return
     }
+    fields, err := parseFieldSelection(r.URL.Query(), ExpandedProduct{})
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    expand, err := parseExpansion(r.URL.Query(), fields)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    expand.Images = expand.Images || fields == nil
+    selection := expand.selection(fields, ProductDetail{})
+    // The cache holds the plain product with its images, so the other requests skip it too.
+    plain := !withDeleted && currency == "" && expand == Expansion{Images: expand.Images}
 
-    // Query the database for the product with the given ID.
-    row := DB.QueryRow("SELECT id, name, category, price FROM products WHERE id = $1", productID)
+    // Serve the product from the cache if we have it. A cache failure is not fatal: we
+    // log it and read from the database instead.
+    if ProductCache != nil && plain {
+        cached, ok, err := ProductCache.Get(r.Context(), productCacheKey(r.Context(), productID))
+        if err != nil {
+            logError(r, err)
+        } else if ok {
+            // The policy is checked against the cached copy of the product. One that can't
+            // be read is refreshed from the database.
+            var cachedDetail ProductDetail
+            if err := json.Unmarshal(cached, &cachedDetail); err != nil {
+                logError(r, err)
+            } else {
+                if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionRead, cachedDetail.Product), "Failed to retrieve product.") {
+                    return
+                }
+                if respondNotModified(w, r, productETag(cachedDetail.Product), cachedDetail.UpdatedAt) {
+                    return
+                }
+                if selection != nil {
+                    respond(w, r, http.StatusOK, selection.view(cachedDetail))
+                } else {
+                    respondJSONBody(w, r, cached, &ProductDetail{})
+                }
+                return
+            }
+        }
+    }
 
-    // Scan the result into a Product object.
+    // Look up the product with the given ID.
     var product Product
-    err = row.Scan(&product.ID, &product.Name, &product.Category, &product.Price)
-    if err == sql.ErrNoRows {
+    if withDeleted {
+        product, err = Repo.GetByIDWithDeleted(r.Context(), productID)
+    } else {
+        product, err = Repo.GetByID(r.Context(), productID)
+    }
+    if err == ErrProductNotFound {
         // If there is no product with the given ID, return an error.
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Product not found."})
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
         return
     } else if err != nil {
-        // If there is any other error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve product."})
+        // If there is any other error, log it and return a 500, or a 504 if the database timed out.
+        respondStoreError(w, r, err, "Failed to retrieve product.")
+        return
+    }
+    if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionRead, product), "Failed to retrieve product.") {
+        return
+    }
+
+    // A client polling an unchanged product is answered before its related resources are
+    // loaded. Converted prices change with the exchange rates, so those reads are always
+    // sent in full.
+    if currency == "" && respondNotModified(w, r, productETag(product), product.UpdatedAt) {
+        return
+    }
+
+    // Convert the price if asked for. Variant price overrides are in the product's own
+    // currency, so they are converted at the same rate.
+    productCurrency := product.Currency
+    if currency != "" {
+        products := []Product{product}
+        if err := convertPrices(r.Context(), products, currency); err != nil {
+            respondConversionError(w, r, err)
+            return
+        }
+        product = products[0]
+    }
+
+    // Add the related resources to be sent.
+    expanded, err := Repo.Expand(r.Context(), []Product{product}, expand)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve product.")
+        return
+    }
+    representation := expanded[0]
+    if representation.Variants != nil && currency != "" && currency != productCurrency {
+        if err := convertVariantPrices(r.Context(), representation.Variants, productCurrency, currency); err != nil {
+            respondConversionError(w, r, err)
+            return
+        }
+    }
+
+    // Encode the product once so the same bytes can be cached and returned.
+    body, err := json.Marshal(representation.ProductDetail)
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to retrieve product.")
         return
     }
+    body = append(body, '\n')
+    if ProductCache != nil && product.DeletedAt == nil && plain && expand.Images {
+        if err := ProductCache.Set(r.Context(), productCacheKey(r.Context(), productID), body, currentConfig().ProductCacheTTL); err != nil {
+            logError(r, err)
+        }
+    }
 
     // If everything went well, return the product in the response body.
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(product)
+    if currency != "" {
+        w.Header().Set("ETag", productETag(product))
+        setCacheControl(w)
+    }
+    switch {
+    case selection != nil:
+        respond(w, r, http.StatusOK, selection.view(representation))
+    case responseMediaType(r) == mediaJSON:
+        writeBody(w, mediaJSON, http.StatusOK, body)
+    default:
+        respond(w, r, http.StatusOK, representation.ProductDetail)
+    }
 }
 
-// getProducts retrieves a list of products from the database based on the query parameters.
 // getProducts retrieves a list of products from the database based on the query parameters.
 func getProducts(w http.ResponseWriter, r *http.Request) {
-    // Parse the query parameters into a map.
-    queryValues := r.URL.Query()
-
-    // Build the WHERE clause of the SQL query based on the query parameters.
-    var whereClauses []string
-    var whereArgs []interface{}
-    if name := queryValues.Get("name"); name != "" {
-        whereClauses = append(whereClauses, "name LIKE $1")
-        whereArgs = append(whereArgs, fmt.Sprintf("%%%s%%", name))
-    }
-    if category := queryValues.Get("category"); category != "" {
-        whereClauses = append(whereClauses, "category = $2")
-        whereArgs = append(whereArgs, category)
-    }
-    if minPriceStr := queryValues.Get("min_price"); minPriceStr != "" {
-        minPrice, err := strconv.ParseFloat(minPriceStr, 64)
+    // The scan budget starts counting as soon as the request is being handled.
+    start := time.Now()
+
+    // Work out the filters, sort order and page from the query parameters.
+    q, err := parseListQuery(r.URL.Query(), start)
+    if err != nil {
+        // If a parameter is malformed, return an error.
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    q.Filter.IncludeDeleted = includeDeleted(r)
+    q.Filter.PublishedOnly = !includeUnpublished(r.Context())
+
+    listProducts(w, r, q)
+}
+
+// parseListQuery reads the filter, sort and paging parameters of a product listing. start is
+// when handling of the request began, from which the scan budget is counted. The returned
+// error message is suitable for a 400 Bad Request response.
+func parseListQuery(queryValues url.Values, start time.Time) (ListQuery, error) {
+    // Work out the filters based on the query parameters.
+    var q ListQuery
+    var err error
+    q.Filter, err = parseProductFilters(queryValues)
+    if err != nil {
+        return q, err
+    }
+
+    // Work out the sort order.
+    q.Sort, q.Desc, err = parseProductSort(queryValues)
+    if err != nil {
+        return q, err
+    }
+
+    // Work out the page size, capped so a single request can't pull the whole table.
+    q.Limit = AppConfig.DefaultPageSize
+    if limitStr := queryValues.Get("limit"); limitStr != "" {
+        q.Limit, err = strconv.Atoi(limitStr)
+        if err != nil || q.Limit < 1 {
+            return q, errors.New("Invalid limit.")
+        }
+    }
+    if q.Limit > AppConfig.MaxPageSize {
+        q.Limit = AppConfig.MaxPageSize
+    }
+
+    // Convert prices to the requested currency, if any.
+    q.Currency = strings.ToUpper(queryValues.Get("currency"))
+    if q.Currency != "" && !validCurrency(q.Currency) {
+        return q, errors.New("Invalid currency.")
+    }
+
+    // Only include the fields asked for, if any, and the related resources asked for.
+    if q.Fields, err = parseFieldSelection(queryValues, ExpandedProduct{}); err != nil {
+        return q, err
+    }
+    if q.Expand, err = parseExpansion(queryValues, q.Fields); err != nil {
+        return q, err
+    }
+
+    // Continue after the previous page if a cursor was given.
+    if cursor := queryValues.Get("cursor"); cursor != "" {
+        after, err := decodeCursor(cursor)
+        if err != nil || after.Sort != q.Sort {
+            // The cursor was not produced by us for this sort order.
+            return q, errors.New("Invalid cursor.")
+        }
+        q.After = &after
+    }
+
+    // Stop scanning with a partial page rather than letting a pathological query time out.
+    if AppConfig.ListScanBudget > 0 {
+        q.Deadline = start.Add(AppConfig.ListScanBudget)
+    }
+    return q, nil
+}
+
+// listProducts fetches one page of products and writes it as the response.
+func listProducts(w http.ResponseWriter, r *http.Request, q ListQuery) {
+    // Serve the page from the cache if we have it. Listings that include deleted products
+    // are rare and admin-only, so they are not cached, nor are expanded listings, as changes
+    // to variants, stock and categories leave cached listings be. A cache failure is not
+    // fatal: we log it and read from the database instead.
+    cacheKey := ""
+    if ProductCache != nil && !q.Filter.IncludeDeleted && q.Expand == (Expansion{}) {
+        var err error
+        cacheKey, err = listCacheKey(r.Context(), q)
         if err != nil {
-            // If the minimum price is not a valid float, return an error.
-            w.WriteHeader(http.StatusBadRequest)
-            json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid minimum price."})
+            logError(r, err)
+        } else if cached, ok, err := ProductCache.Get(r.Context(), cacheKey); err != nil {
+            logError(r, err)
+        } else if ok {
+            writeProductList(w, r, cached, q)
             return
         }
-        whereClauses = append(whereClauses, "price >= $3")
-        whereArgs = append(whereArgs, minPrice)
     }
-    if maxPriceStr := queryValues.Get("max_price"); maxPriceStr != "" {
-        maxPrice, err := strconv.ParseFloat(maxPriceStr, 64)
+
+    // Fetch the page of products.
+    list, err := Repo.List(r.Context(), q)
+    if err != nil {
+        // If there is an error, log it and return a 500, or a 504 if the database timed out.
+        respondStoreError(w, r, err, "Failed to retrieve products.")
+        return
+    }
+
+    // Add the related resources asked for. Variant price overrides are in the currency of
+    // their product, so they are converted before the product's price is.
+    var expanded []ExpandedProduct
+    if q.Expand != (Expansion{}) {
+        expanded, err = Repo.Expand(r.Context(), list.Products, q.Expand)
         if err != nil {
-            // If the maximum price is not a valid float, return an error.
-            w.WriteHeader(http.StatusBadRequest)
-            json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid maximum price."})
+            respondStoreError(w, r, err, "Failed to retrieve products.")
             return
         }
-        whereClauses = append(whereCla
+    }
+    if q.Currency != "" {
+        for i, product := range list.Products {
+            if expanded != nil && expanded[i].Variants != nil && product.Currency != q.Currency {
+                if err := convertVariantPrices(r.Context(), expanded[i].Variants, product.Currency, q.Currency); err != nil {
+                    respondConversionError(w, r, err)
+                    return
+                }
+            }
+        }
+        if err := convertPrices(r.Context(), list.Products, q.Currency); err != nil {
+            respondConversionError(w, r, err)
+            return
+        }
+    }
+    // Add the effective prices of the products on promotion, at the prices being sent. The
+    // cached page keeps them until the promotions change, or for PRODUCT_CACHE_TTL when a
+    // promotion starts or ends by itself.
+    if err := applyPromotions(r.Context(), list.Products); err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve products.")
+        return
+    }
+    for i := range expanded {
+        expanded[i].Product = list.Products[i]
+    }
 
-uses, "price <= $4")
-        whereArgs = append(whereArgs, maxPrice)
+    if respondEmptyList(w, r, len(list.Products)) {
+        return
     }
 
-    // Build the final SQL query.
-    query := "SELECT id, name, category, price FROM products"
-    if len(whereClauses) > 0 {
-        query += fmt.Sprintf(" WHERE %s", strings.Join(whereClauses, " AND "))
+    // Encode the page once so the same bytes can be cached and returned.
+    body, err := json.Marshal(q.selection().list(list, expanded))
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to retrieve products.")
+        return
+    }
+    body = append(body, '\n')
+    // A partial page or an estimated total depends on how fast the database was, so it is
+    // not worth keeping.
+    if cacheKey != "" && !list.Partial && !list.TotalApproximate {
+        if err := ProductCache.Set(r.Context(), cacheKey, body, currentConfig().ProductCacheTTL); err != nil {
+            logError(r, err)
+        }
     }
 
-    // Query the database for the products that match the WHERE clause.
-    rows, err := DB.Query(query, whereArgs...)
+    // If everything went well, return the products in the response body.
+    writeProductList(w, r, body, q)
+}
+
+// writeProductList writes a JSON-encoded page of products, limited to the fields q selects,
+// as a successful response in the media type the client asked for. The ETag is that of the
+// body actually sent.
+func writeProductList(w http.ResponseWriter, r *http.Request, body []byte, q ListQuery) {
+    mediaType := responseMediaType(r)
+    if mediaType != mediaJSON {
+        var list ProductList
+        var expanded struct {
+            Products []ExpandedProduct `json:"products"`
+        }
+        err := json.Unmarshal(body, &list)
+        if err == nil && q.Expand != (Expansion{}) {
+            err = json.Unmarshal(body, &expanded)
+        }
+        if err == nil {
+            body, err = marshalBody(mediaType, q.selection().list(list, expanded.Products))
+        }
+        if err != nil {
+            logError(r, err)
+            respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to retrieve products.")
+            return
+        }
+    }
+    if respondNotModified(w, r, bodyETag(body), time.Time{}) {
+        return
+    }
+    writeBody(w, mediaType, http.StatusOK, body)
+}
+
+// createProduct inserts a new product into the database from the request body.
+func createProduct(w http.ResponseWriter, r *http.Request) {
+    // Read the request body into a Product object.
+    var product Product
+    err := decodeBody(r, &product)
     if err != nil {
-        // If there is an error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to retrieve products."})
+        // If there is an error, log it and return a 400 Bad Request response.
+        logError(r, err)
+        respondBodyError(w, r, err)
         return
     }
-    defer rows.Close()
 
-    // Scan the results into a slice of Product objects.
-    var products Products
-    for rows.Next() {
-        var product Product
-        err := rows.Scan(&product.ID, &product.Name, &product.Category, &product.Price)
-		if err != nil {
-			// If the product ID is not a valid integer, return an error.
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid product ID."})
-			return
-		}
-	}
+    // Validate the product before storing it.
+    if errs := product.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+    if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionCreate, product), "Failed to create product.") {
+        return
+    }
 
+    // Insert the product into the database and get its new ID.
+    err = Repo.Create(r.Context(), &product)
+    if err == ErrBarcodeInUse {
+        // Another product already has this barcode.
+        respondError(w, r, http.StatusConflict, codeBarcodeInUse, "Barcode is already in use.")
+        return
+    } else if err == ErrSKUInUse {
+        respondError(w, r, http.StatusConflict, codeSKUInUse, "SKU is already in use.")
+        return
+    } else if err == ErrUnknownCategory {
+        respondValidationErrors(w, r, unknownCategoryErrors)
+        return
+    } else if err == ErrUnknownVendor {
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    } else if err != nil {
+        // If there is an error, log it and return a 500, or a 504 if the database timed out.
+        respondStoreError(w, r, err, "Failed to create product.")
+        return
+    }
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
 
+    // If everything went well, return a 201 Created response pointing at the new product.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d", product.ID))
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusCreated, product)
+}
 
-// deleteProduct deletes a single product from the database based on the product ID.
+// deleteProduct soft-deletes a single product based on the product ID. It can be brought
+// back with restoreProduct.
 func deleteProduct(w http.ResponseWriter, r *http.Request) {
-    // Get the product ID from the URL query string.
-    productIDStr := r.URL.Query().Get("id")
-    productID, err := strconv.Atoi(productIDStr)
+    // Get the product ID from the URL path or query string.
+    productID, err := productIDFromRequest(r)
     if err != nil {
         // If the product ID is not a valid integer, return an error.
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid product ID."})
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
         return
     }
 
-    // Delete the product with the given ID from the database.
-    result, err := DB.Exec("DELETE FROM products WHERE id = $1", productID)
-    if err != nil {
-        // If there is an error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete product."})
+    // Only delete the version of the product the client has seen.
+    version, ok := requireIfMatch(w, r)
+    if !ok {
         return
     }
-
-    // Get the number of rows affected by the DELETE operation.
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        // If there is an error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to delete product."})
+    if !allowProduct(w, r, ActionDelete, productID, "Failed to delete product.") {
         return
     }
-    if rowsAffected == 0 {
-        // If no rows were affected by the DELETE operation, the product with the given ID
-        // must not exist in the database, so return a 404 Not Found response.
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Product not found."})
+
+    // Mark the product with the given ID as deleted.
+    err = Repo.Delete(r.Context(), productID, version)
+    if err == ErrProductNotFound {
+        // If the product with the given ID does not exist, return a 404 Not Found response.
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err == ErrVersionMismatch {
+        respondVersionMismatch(w, r)
+        return
+    } else if err != nil {
+        // If there is an error, log it and return a 500, or a 504 if the database timed out.
+        respondStoreError(w, r, err, "Failed to delete product.")
         return
     }
 
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
     // If everything went well, return a 204 No Content response.
     w.WriteHeader(http.StatusNoContent)
 }
 
+// restoreProduct undoes the soft delete of a product and returns it.
+func restoreProduct(w http.ResponseWriter, r *http.Request) {
+    // Get the product ID from the URL path.
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    // Undoing a delete takes the same access as deleting.
+    if !allowProduct(w, r, ActionDelete, productID, "Failed to restore product.") {
+        return
+    }
+    product, err := Repo.Restore(r.Context(), productID)
+    if err == ErrProductNotFound {
+        // Either there is no such product or it isn't deleted.
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Deleted product not found.")
+        return
+    } else if err == ErrBarcodeInUse {
+        // Another product took over the barcode while this one was deleted.
+        respondError(w, r, http.StatusConflict, codeBarcodeInUse, "Barcode is already in use.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to restore product.")
+        return
+    }
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the restored product in the response body.
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusOK, product)
+}
+
 // updateProduct updates a single product in the database based on the product ID.
 func updateProduct(w http.ResponseWriter, r *http.Request) {
-    // Get the product ID from the URL query string.
-    productIDStr := r.URL.Query().Get("id")
-    productID, err := strconv.Atoi(productIDStr)
+    // Get the product ID from the URL path or query string.
+    productID, err := productIDFromRequest(r)
     if err != nil {
         // If the product ID is not a valid integer, return an error.
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid product ID."})
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
         return
     }
 
     // Read the request body into a Product object.
     var product Product
-    err = json.NewDecoder(r.Body).Decode(&product)
+    err = decodeBody(r, &product)
     if err != nil {
         // If there is an error, log it and return a 400 Bad Request response.
-        log.Println(err)
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to parse request body."})
+        logError(r, err)
+        respondBodyError(w, r, err)
         return
     }
 
-    // Update the product with the given ID in the database.
-    result, err := DB.Exec("UPDATE products SET name = $1, category = $2, price = $3 WHERE id = $4",
-        product.Name, product.Category, product.Price, productID)
-    if err != nil {
-        // If there is an error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update product."})
+    // Validate the product before storing it.
+    if errs := product.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
         return
     }
 
-    // Get the number of rows affected by the UPDATE operation.
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        // If there is an error, log it and return a 500 Internal Server Error response.
-        log.Println(err)
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to update product."})
+    // Only overwrite the version of the product the client has seen.
+    version, ok := requireIfMatch(w, r)
+    if !ok {
+        return
+    }
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to update product.") {
+        return
+    }
+
+    // Update the product with the given ID. Nothing is written if no field would change.
+    product.ID, product.Version = productID, version
+    changed, err := Repo.Update(r.Context(), &product)
+    if err == ErrProductNotFound {
+        // If there is no product with the given ID, return a 404 Not Found response.
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err == ErrVersionMismatch {
+        respondVersionMismatch(w, r)
+        return
+    } else if err == ErrBarcodeInUse {
+        // Another product already has this barcode.
+        respondError(w, r, http.StatusConflict, codeBarcodeInUse, "Barcode is already in use.")
+        return
+    } else if err == ErrSKUInUse {
+        respondError(w, r, http.StatusConflict, codeSKUInUse, "SKU is already in use.")
+        return
+    } else if err == ErrUnknownCategory {
+        respondValidationErrors(w, r, unknownCategoryErrors)
+        return
+    } else if err == ErrUnknownVendor {
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    } else if err != nil {
+        // If there is an error, log it and return a 500, or a 504 if the database timed out.
+        respondStoreError(w, r, err, "Failed to update product.")
         return
     }
-    if rowsAffected == 0 {
-        // If no rows were affected by the UPDATE operation, the product with the given ID
-        // must not exist in the database, so return a 404 Not Found response.
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(ErrorResponse{Error: "Product not found."})
+    w.Header().Set("ETag", productETag(product))
+    if !changed {
+        respond(w, r, http.StatusOK, UpdateResult{Product: product, Unchanged: true})
         return
     }
 
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
     // If everything went well, return the updated product in the response body.
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(product)
+    respond(w, r, http.StatusOK, UpdateResult{Product: product})
+}
+
+// initialListCapacity returns the capacity to pre-size a product list with when at most
+// limit rows are expected, bounded by the configured maximum.
+func initialListCapacity(limit int) int {
+    if limit > AppConfig.ListMaxInitialCapacity {
+        limit = AppConfig.ListMaxInitialCapacity
+    }
+    if limit < 0 {
+        limit = 0
+    }
+    return limit
 }
 
+// patchProduct updates only the fields present in the JSON request body.
+func patchProduct(w http.ResponseWriter, r *http.Request) {
+    // Get the product ID from the URL path.
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        // If the product ID is not a valid integer, return an error.
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    // Read the request body into a ProductPatch; absent fields stay nil.
+    var patch ProductPatch
+    err = decodeBody(r, &patch)
+    if err != nil {
+        // If there is an error, log it and return a 400 Bad Request response.
+        logError(r, err)
+        respondBodyError(w, r, err)
+        return
+    }
+
+    // Validate the fields that are being changed.
+    if errs := patch.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    // Only patch the version of the product the client has seen.
+    version, ok := requireIfMatch(w, r)
+    if !ok {
+        return
+    }
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to update product.") {
+        return
+    }
+
+    // Apply the patch.
+    product, err := Repo.Patch(r.Context(), productID, version, patch)
+    if err == ErrProductNotFound {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err == ErrVersionMismatch {
+        respondVersionMismatch(w, r)
+        return
+    } else if err == ErrBarcodeInUse {
+        respondError(w, r, http.StatusConflict, codeBarcodeInUse, "Barcode is already in use.")
+        return
+    } else if err == ErrSKUInUse {
+        respondError(w, r, http.StatusConflict, codeSKUInUse, "SKU is already in use.")
+        return
+    } else if err == ErrUnknownCategory {
+        respondValidationErrors(w, r, unknownCategoryErrors)
+        return
+    } else if err == ErrUnknownVendor {
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to update product.")
+        return
+    }
+
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the patched product in the response body.
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusOK, product)
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// stubDatabase is a database/sql driver standing in for Postgres under the handlers that
+// read or write something along the way, like the running promotions. Queries find what
+// answer returns for them, nothing by default, and statements change nothing.
+type stubDatabase struct {
+    mu sync.Mutex
+    // answer returns the columns and rows a query finds, or the error it fails with.
+    answer func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+    // statements are the queries and statements run so far, in order.
+    statements []string
+    // delay, when set, is how long a query takes to answer, unless its context ends first,
+    // and rowDelay how long each row it finds takes to arrive.
+    delay    func(query string) time.Duration
+    rowDelay func(query string) time.Duration
+}
+
+// stubDB is the stub database of the running test, set up by setupHandlers.
+var stubDB *stubDatabase
+
+func (db *stubDatabase) Open(name string) (driver.Conn, error) { return stubConn{db}, nil }
+
+func (db *stubDatabase) Connect(ctx context.Context) (driver.Conn, error) { return stubConn{db}, nil }
+
+func (db *stubDatabase) Driver() driver.Driver { return db }
+
+// run records query and returns the rows it finds.
+func (db *stubDatabase) run(query string, args []driver.Value) (*stubRows, error) {
+    db.mu.Lock()
+    db.statements = append(db.statements, query)
+    answer := db.answer
+    db.mu.Unlock()
+    if answer == nil {
+        return &stubRows{}, nil
+    }
+    columns, rows, err := answer(query, args)
+    if err != nil {
+        return nil, err
+    }
+    var delay time.Duration
+    if db.rowDelay != nil {
+        delay = db.rowDelay(query)
+    }
+    return &stubRows{columns: columns, rows: rows, delay: delay}, nil
+}
+
+// wait holds up query for its delay, or until ctx ends.
+func (db *stubDatabase) wait(ctx context.Context, query string) error {
+    if db.delay == nil {
+        return nil
+    }
+    select {
+    case <-time.After(db.delay(query)):
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// ran reports whether a query or statement containing s has been run.
+func (db *stubDatabase) ran(s string) bool {
+    db.mu.Lock()
+    defer db.mu.Unlock()
+    for _, statement := range db.statements {
+        if strings.Contains(statement, s) {
+            return true
+        }
+    }
+    return false
+}
+
+type stubConn struct {
+    db *stubDatabase
+}
+
+func (c stubConn) Prepare(query string) (driver.Stmt, error) { return stubStmt{c.db, query}, nil }
+func (c stubConn) Close() error                              { return nil }
+func (c stubConn) Begin() (driver.Tx, error)                 { return stubTx{}, nil }
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubStmt struct {
+    db    *stubDatabase
+    query string
+}
+
+func (s stubStmt) Close() error  { return nil }
+func (s stubStmt) NumInput() int { return -1 }
+
+func (s stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+    rows, err := s.db.run(s.query, args)
+    if err != nil {
+        return nil, err
+    }
+    return driver.RowsAffected(len(rows.rows)), nil
+}
+
+func (s stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+    return s.db.run(s.query, args)
+}
+
+func (s stubStmt) QueryContext(ctx context.Context, named []driver.NamedValue) (driver.Rows, error) {
+    if err := s.db.wait(ctx, s.query); err != nil {
+        return nil, err
+    }
+    args := make([]driver.Value, len(named))
+    for i, arg := range named {
+        args[i] = arg.Value
+    }
+    return s.db.run(s.query, args)
+}
+
+type stubRows struct {
+    columns []string
+    rows    [][]driver.Value
+    delay   time.Duration
+}
+
+func (r *stubRows) Columns() []string { return r.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+    if len(r.rows) == 0 {
+        return io.EOF
+    }
+    time.Sleep(r.delay)
+    copy(dest, r.rows[0])
+    r.rows = r.rows[1:]
+    return nil
+}
+
+// suiteCleanups are run once every test has, to release what tests share, like the
+// database container of the integration tests.
+var suiteCleanups []func()
+
+func TestMain(m *testing.M) {
+    // Handlers log the errors they answer; the tests check the answers.
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    code := m.Run()
+    for i := len(suiteCleanups) - 1; i >= 0; i-- {
+        suiteCleanups[i]()
+    }
+    os.Exit(code)
+}
+
+// setupHandlers points the globals the handlers use at a fresh in-memory repository and
+// the stub database, with the default configuration, and puts them back when t ends. It
+// returns the repository so tests can seed it.
+func setupHandlers(t testing.TB) *memoryRepository {
+    t.Helper()
+    t.Setenv("DATABASE_URL", "postgres://localhost/products_test")
+    cfg, err := loadConfig(nil)
+    if err != nil {
+        t.Fatalf("loading configuration: %v", err)
+    }
+    stubDB = &stubDatabase{}
+    db := sql.OpenDB(stubDB)
+    savedConfig, savedRepo, savedCarts, savedDB, savedReads, savedCache := AppConfig, Repo, Carts, DB, Reads, ProductCache
+    t.Cleanup(func() {
+        AppConfig, Repo, Carts, DB, Reads, ProductCache = savedConfig, savedRepo, savedCarts, savedDB, savedReads, savedCache
+        db.Close()
+    })
+
+    repo := newMemoryRepository()
+    AppConfig, Repo, Carts, DB, Reads, ProductCache = cfg, repo, newMemoryCartRepository(), db, newReadRouter(db, nil, 0), nil
+    return repo
+}
+
+// seedProduct stores a product in repo and returns it with its ID and version filled in.
+func seedProduct(t testing.TB, repo *memoryRepository, product Product) Product {
+    t.Helper()
+    if product.Status == "" {
+        product.Status = StatusPublished
+    }
+    if err := repo.Create(context.Background(), &product); err != nil {
+        t.Fatalf("seeding product: %v", err)
+    }
+    return product
+}
+
+// newTestRequest returns a request made by a principal with role, or an anonymous one if
+// role is empty, with the given route variables.
+func newTestRequest(method, target, body string, role Role, vars map[string]string) *http.Request {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    if body != "" {
+        r.Header.Set("Content-Type", "application/json")
+    }
+    if role != "" {
+        r = r.WithContext(context.WithValue(r.Context(), principalContextKey, Principal{Subject: "tester", Role: role}))
+    }
+    if vars != nil {
+        r = mux.SetURLVars(r, vars)
+    }
+    return r
+}
+
+// errorCode returns the code of the error response in w, or "" if it holds none.
+func errorCode(w *httptest.ResponseRecorder) string {
+    if w.Code < http.StatusBadRequest {
+        return ""
+    }
+    var body ErrorResponse
+    json.Unmarshal(w.Body.Bytes(), &body)
+    return body.Code
+}
+
+// productRow returns the row the stub database answers for product, in the columns of
+// productColumns followed by extra.
+func productRow(product Product, extra ...driver.Value) ([]string, []driver.Value) {
+    row := []driver.Value{int64(product.ID), product.Name, product.Category, product.Price.String(), product.Currency, product.ImageURL,
+        product.Barcode, product.SKU, "{}", product.CreatedAt, product.UpdatedAt, nil, int64(product.Version),
+        int64(product.ReviewCount), product.AverageRating, "{}", int64(product.VendorID), string(product.Status), nil}
+    row = append(row, extra...)
+    columns := make([]string, len(row))
+    for i := range columns {
+        columns[i] = fmt.Sprintf("column%d", i)
+    }
+    return columns, row
+}
+
+// Errors the stub database fails statements with like Postgres does when a constraint
+// doesn't hold.
+var (
+    uniqueViolation     = &pq.Error{Code: "23505"}
+    foreignKeyViolation = &pq.Error{Code: "23503"}
+)
+
+// failQueries answers every query with err.
+func failQueries(err error) func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+    return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        return nil, nil, err
+    }
+}
+
+// answerRows answers each query containing one of the keys of rows with the row under the
+// longest such key, and finds nothing for the others.
+func answerRows(rows map[string][]driver.Value) func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+    return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        match := ""
+        for key := range rows {
+            if strings.Contains(query, key) && len(key) > len(match) {
+                match = key
+            }
+        }
+        if match == "" {
+            return nil, nil, nil
+        }
+        columns := make([]string, len(rows[match]))
+        for i := range columns {
+            columns[i] = fmt.Sprintf("column%d", i)
+        }
+        return columns, [][]driver.Value{rows[match]}, nil
+    }
+}
+
+// handlerTest is a request to a handler and the status and error code it should be
+// answered with. The stub database answers its queries as answer does, and setup prepares
+// anything else it needs. Requests are made by an admin, unless role or anonymous is set.
+type handlerTest struct {
+    name      string
+    handler   http.HandlerFunc
+    method    string
+    target    string
+    body      string
+    vars      map[string]string
+    role      Role
+    anonymous bool
+    answer    func(query string, args []driver.Value) ([]string, [][]driver.Value, error)
+    setup     func(t *testing.T)
+    status    int
+    code      string
+}
+
+// withStoreErrors returns tests with, for each request that reaches the database, two more
+// whose queries fail: with the database unavailable, answered with 503, and timing out,
+// answered with 504.
+func withStoreErrors(tests []handlerTest, reaching ...handlerTest) []handlerTest {
+    for _, tt := range reaching {
+        unavailable, timeout := tt, tt
+        unavailable.name, unavailable.answer = tt.name+" database unavailable", failQueries(errDatabaseUnavailable{RetryAfter: time.Second})
+        unavailable.status, unavailable.code = http.StatusServiceUnavailable, codeUnavailable
+        timeout.name, timeout.answer = tt.name+" database timeout", failQueries(context.DeadlineExceeded)
+        timeout.status, timeout.code = http.StatusGatewayTimeout, codeTimeout
+        tests = append(tests, unavailable, timeout)
+    }
+    return tests
+}
+
+// runHandlerTests runs tests, each against a fresh in-memory repository holding a single
+// product, with ID 1.
+func runHandlerTests(t *testing.T, tests []handlerTest) {
+    t.Helper()
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            stubDB.answer = tt.answer
+            if tt.setup != nil {
+                tt.setup(t)
+            }
+            method, role := tt.method, RoleAdmin
+            if tt.role != "" {
+                role = tt.role
+            }
+            if method == "" {
+                method = "GET"
+            }
+            if tt.anonymous {
+                role = ""
+            }
+
+            w := httptest.NewRecorder()
+            tt.handler(w, newTestRequest(method, tt.target, tt.body, role, tt.vars))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+        })
+    }
+}
+
+func TestGetProduct(t *testing.T) {
+    tests := []struct {
+        name   string
+        id     string
+        role   Role
+        status int
+        code   string
+    }{
+        {name: "found", id: "1", role: RoleViewer, status: http.StatusOK},
+        {name: "invalid id", id: "abc", role: RoleViewer, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "missing", id: "99", role: RoleViewer, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "draft hidden from viewers", id: "2", role: RoleViewer, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "draft shown to editors", id: "2", role: RoleEditor, status: http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            seedProduct(t, repo, Product{Name: "Chair", Category: "home", Price: 4999, Status: StatusDraft})
+
+            w := httptest.NewRecorder()
+            getProduct(w, newTestRequest("GET", "/products/"+tt.id, "", tt.role, map[string]string{"id": tt.id}))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            if tt.status == http.StatusOK {
+                var product ProductDetail
+                if err := json.Unmarshal(w.Body.Bytes(), &product); err != nil {
+                    t.Fatal(err)
+                }
+                if strconv.Itoa(product.ID) != tt.id {
+                    t.Errorf("id = %d, want %s", product.ID, tt.id)
+                }
+                if w.Header().Get("ETag") == "" {
+                    t.Error("no ETag")
+                }
+            }
+        })
+    }
+}
+
+func TestListProducts(t *testing.T) {
+    tests := []struct {
+        name   string
+        query  string
+        role   Role
+        status int
+        want   []string
+    }{
+        {name: "published only", query: "", role: RoleViewer, status: http.StatusOK, want: []string{"Lamp", "Desk"}},
+        {name: "editors see drafts", query: "", role: RoleEditor, status: http.StatusOK, want: []string{"Lamp", "Chair", "Desk"}},
+        {name: "by category", query: "category=office", role: RoleViewer, status: http.StatusOK, want: []string{"Desk"}},
+        {name: "by several categories", query: "category=office&category=home", role: RoleViewer, status: http.StatusOK, want: []string{"Lamp", "Desk"}},
+        {name: "sorted by price", query: "sort=price&order=desc", role: RoleViewer, status: http.StatusOK, want: []string{"Desk", "Lamp"}},
+        {name: "no match", query: "category=garden", role: RoleViewer, status: http.StatusOK, want: []string{}},
+        {name: "invalid limit", query: "limit=0", role: RoleViewer, status: http.StatusBadRequest},
+        {name: "invalid cursor", query: "cursor=!!", role: RoleViewer, status: http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            seedProduct(t, repo, Product{Name: "Chair", Category: "home", Price: 4999, Status: StatusDraft})
+            seedProduct(t, repo, Product{Name: "Desk", Category: "office", Price: 19999})
+
+            w := httptest.NewRecorder()
+            getProducts(w, newTestRequest("GET", "/products?"+tt.query, "", tt.role, nil))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if tt.status != http.StatusOK {
+                if got := errorCode(w); got != codeInvalidParameter {
+                    t.Errorf("code = %q, want %q", got, codeInvalidParameter)
+                }
+                return
+            }
+            var list ProductList
+            if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+                t.Fatal(err)
+            }
+            names := []string{}
+            for _, p := range list.Products {
+                names = append(names, p.Name)
+            }
+            if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+                t.Errorf("products = %v, want %v", names, tt.want)
+            }
+        })
+    }
+}
+
+func TestListProductsEmptyListNotFound(t *testing.T) {
+    setupHandlers(t)
+    AppConfig.EmptyListNotFound = true
+
+    w := httptest.NewRecorder()
+    getProducts(w, newTestRequest("GET", "/products", "", RoleViewer, nil))
+    if w.Code != http.StatusNotFound || errorCode(w) != codeNoResults {
+        t.Fatalf("status = %d, code = %q, want 404 %s", w.Code, errorCode(w), codeNoResults)
+    }
+}
+
+func TestCreateProduct(t *testing.T) {
+    tests := []struct {
+        name   string
+        body   string
+        role   Role
+        status int
+        code   string
+    }{
+        {name: "created", body: `{"name": "Desk", "category": "office", "price": 199.99}`, role: RoleEditor, status: http.StatusCreated},
+        {name: "malformed body", body: `{"name": `, role: RoleEditor, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "unknown field", body: `{"name": "Desk", "category": "office", "colour": "red"}`, role: RoleEditor, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "invalid fields", body: `{"name": "", "category": "office", "price": -1}`, role: RoleEditor, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "barcode in use", body: `{"name": "Desk", "category": "office", "price": 1, "barcode": "4006381333931"}`, role: RoleEditor, status: http.StatusConflict, code: codeBarcodeInUse},
+        {name: "viewers can't create", body: `{"name": "Desk", "category": "office", "price": 1}`, role: RoleViewer, status: http.StatusForbidden, code: codeForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999, Barcode: "4006381333931"})
+
+            w := httptest.NewRecorder()
+            createProduct(w, newTestRequest("POST", "/products", tt.body, tt.role, nil))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            if tt.status == http.StatusCreated {
+                if got := w.Header().Get("Location"); got != "/products/2" {
+                    t.Errorf("Location = %q, want /products/2", got)
+                }
+                if _, err := repo.GetByID(context.Background(), 2); err != nil {
+                    t.Errorf("created product not stored: %v", err)
+                }
+            }
+        })
+    }
+}
+
+func TestUpdateProduct(t *testing.T) {
+    tests := []struct {
+        name    string
+        id      string
+        body    string
+        ifMatch string
+        status  int
+        code    string
+    }{
+        {name: "updated", id: "1", body: `{"name": "Desk lamp", "category": "home", "price": 24.99}`, ifMatch: `"1"`, status: http.StatusOK},
+        {name: "invalid id", id: "x", body: `{"name": "Desk lamp", "category": "home", "price": 24.99}`, ifMatch: `"1"`, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "malformed body", id: "1", body: `[]`, ifMatch: `"1"`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "missing", id: "99", body: `{"name": "Desk lamp", "category": "home", "price": 24.99}`, ifMatch: "*", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "barcode in use", id: "1", body: `{"name": "Lamp", "category": "home", "price": 19.99, "barcode": "4006381333931"}`, ifMatch: "*", status: http.StatusConflict, code: codeBarcodeInUse},
+        {name: "stale version", id: "1", body: `{"name": "Desk lamp", "category": "home", "price": 24.99}`, ifMatch: `"7"`, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+        {name: "no If-Match", id: "1", body: `{"name": "Desk lamp", "category": "home", "price": 24.99}`, status: http.StatusPreconditionRequired, code: codePreconditionRequired},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            seedProduct(t, repo, Product{Name: "Chair", Category: "home", Price: 4999, Barcode: "4006381333931"})
+
+            r := newTestRequest("PUT", "/products/"+tt.id, tt.body, RoleEditor, map[string]string{"id": tt.id})
+            if tt.ifMatch != "" {
+                r.Header.Set("If-Match", tt.ifMatch)
+            }
+            w := httptest.NewRecorder()
+            updateProduct(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            if tt.status == http.StatusOK {
+                product, _ := repo.GetByID(context.Background(), 1)
+                if product.Name != "Desk lamp" || product.Price != 2499 || product.Version != 2 {
+                    t.Errorf("stored product = %+v", product)
+                }
+            }
+        })
+    }
+}
+
+func TestUpdateProductUnchanged(t *testing.T) {
+    repo := setupHandlers(t)
+    ProductCache = newMemoryCache(10)
+    lamp := seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999, Currency: "USD"})
+    ProductCache.Set(context.Background(), productCacheKey(context.Background(), lamp.ID), []byte("{}"), time.Minute)
+
+    r := newTestRequest("PUT", "/products/1", `{"name": "Lamp", "category": "home", "price": 19.99}`, RoleEditor, map[string]string{"id": "1"})
+    r.Header.Set("If-Match", `"1"`)
+    w := httptest.NewRecorder()
+    updateProduct(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d: %s", w.Code, w.Body)
+    }
+    var result UpdateResult
+    if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+        t.Fatalf("decoding result: %v", err)
+    }
+    if !result.Unchanged || result.Version != 1 || w.Header().Get("ETag") != productETag(lamp) {
+        t.Errorf("result = %+v, ETag %s, want unchanged version 1", result, w.Header().Get("ETag"))
+    }
+    if stored, _ := repo.GetByID(context.Background(), lamp.ID); stored != lamp {
+        t.Errorf("stored product = %+v, want it untouched", stored)
+    }
+    if _, ok, _ := ProductCache.Get(context.Background(), productCacheKey(context.Background(), lamp.ID)); !ok {
+        t.Error("unchanged product was dropped from the cache")
+    }
+}
+
+func TestPatchProduct(t *testing.T) {
+    tests := []struct {
+        name   string
+        id     string
+        body   string
+        status int
+        code   string
+    }{
+        {name: "patched", id: "1", body: `{"price": 24.99}`, status: http.StatusOK},
+        {name: "invalid id", id: "x", body: `{"price": 24.99}`, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "malformed body", id: "1", body: `{"price": "cheap"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "invalid field", id: "1", body: `{"name": ""}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "missing", id: "99", body: `{"price": 24.99}`, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "barcode in use", id: "1", body: `{"barcode": "4006381333931"}`, status: http.StatusConflict, code: codeBarcodeInUse},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+            seedProduct(t, repo, Product{Name: "Chair", Category: "home", Price: 4999, Barcode: "4006381333931"})
+
+            r := newTestRequest("PATCH", "/products/"+tt.id, tt.body, RoleEditor, map[string]string{"id": tt.id})
+            r.Header.Set("If-Match", "*")
+            w := httptest.NewRecorder()
+            patchProduct(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            if tt.status == http.StatusOK {
+                product, _ := repo.GetByID(context.Background(), 1)
+                if product.Name != "Lamp" || product.Price != 2499 {
+                    t.Errorf("stored product = %+v", product)
+                }
+            }
+        })
+    }
+}
+
+func TestApplyPatch(t *testing.T) {
+    lamp := Product{ID: 1, Name: "Lamp", Category: "home", Price: 1999, Currency: "USD", ImageURL: "https://cdn.example.com/lamp.jpg", Barcode: "4006381333931", Version: 3}
+    tests := []struct {
+        name  string
+        patch string
+        want  func(p *Product)
+    }{
+        {name: "empty", patch: `{}`, want: func(p *Product) {}},
+        {name: "price", patch: `{"price": 24.99}`, want: func(p *Product) { p.Price = 2499 }},
+        {name: "null is absent", patch: `{"name": null, "price": 24.99}`, want: func(p *Product) { p.Price = 2499 }},
+        {name: "cleared", patch: `{"image_url": "", "barcode": ""}`, want: func(p *Product) { p.ImageURL, p.Barcode = "", "" }},
+        {name: "several", patch: `{"name": "Desk lamp", "category": "office", "currency": "EUR", "sku": "LMP-1"}`, want: func(p *Product) {
+            p.Name, p.Category, p.Currency, p.SKU = "Desk lamp", "office", "EUR", "LMP-1"
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var patch ProductPatch
+            if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+                t.Fatalf("decoding patch: %v", err)
+            }
+            got, want := lamp, lamp
+            applyPatch(&got, patch)
+            tt.want(&want)
+            if got != want {
+                t.Errorf("patched product = %+v, want %+v", got, want)
+            }
+        })
+    }
+}
+
+func TestDeleteProduct(t *testing.T) {
+    tests := []struct {
+        name    string
+        id      string
+        role    Role
+        ifMatch string
+        status  int
+        code    string
+    }{
+        {name: "deleted", id: "1", role: RoleAdmin, ifMatch: `"1"`, status: http.StatusNoContent},
+        {name: "invalid id", id: "x", role: RoleAdmin, ifMatch: "*", status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "missing", id: "99", role: RoleAdmin, ifMatch: "*", status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "stale version", id: "1", role: RoleAdmin, ifMatch: `"3"`, status: http.StatusPreconditionFailed, code: codePreconditionFailed},
+        {name: "editors can't delete", id: "1", role: RoleEditor, ifMatch: "*", status: http.StatusForbidden, code: codeForbidden},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+
+            r := newTestRequest("DELETE", "/products/"+tt.id, "", tt.role, map[string]string{"id": tt.id})
+            r.Header.Set("If-Match", tt.ifMatch)
+            w := httptest.NewRecorder()
+            deleteProduct(w, r)
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if got := errorCode(w); got != tt.code {
+                t.Errorf("code = %q, want %q", got, tt.code)
+            }
+            _, err := repo.GetByID(context.Background(), 1)
+            if deleted := err == ErrProductNotFound; deleted != (tt.status == http.StatusNoContent) {
+                t.Errorf("product deleted = %v", deleted)
+            }
+        })
+    }
+}
+
+// seedCatalog stores n published products spread over a few categories.
+func seedCatalog(b *testing.B, repo *memoryRepository, n int) {
+    categories := []string{"home", "office", "garden", "kitchen"}
+    for i := 0; i < n; i++ {
+        seedProduct(b, repo, Product{Name: "Product " + strconv.Itoa(i), Category: categories[i%len(categories)], Price: Money(100 + i)})
+    }
+}
+
+func BenchmarkGetProduct(b *testing.B) {
+    repo := setupHandlers(b)
+    seedCatalog(b, repo, 1000)
+    r := newTestRequest("GET", "/products/500", "", RoleViewer, map[string]string{"id": "500"})
+
+    b.ReportAllocs()
+    for b.Loop() {
+        w := httptest.NewRecorder()
+        getProduct(w, r)
+        if w.Code != http.StatusOK {
+            b.Fatalf("status = %d: %s", w.Code, w.Body)
+        }
+    }
+}
+
+func BenchmarkListProductsFiltered(b *testing.B) {
+    repo := setupHandlers(b)
+    seedCatalog(b, repo, 1000)
+    r := newTestRequest("GET", "/products?category=office&min_price=5&max_price=8&sort=price&order=desc&limit=50", "", RoleViewer, nil)
+
+    b.ReportAllocs()
+    for b.Loop() {
+        w := httptest.NewRecorder()
+        getProducts(w, r)
+        if w.Code != http.StatusOK {
+            b.Fatalf("status = %d: %s", w.Code, w.Body)
+        }
+    }
+}
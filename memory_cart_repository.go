@@ -0,0 +1,122 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+)
+
+// memoryCartRepository is a CartRepository that keeps carts in memory. Like
+// memoryRepository, it is meant for tests and local experiments. It can't tell whether a
+// product exists, so it takes any product ID.
+type memoryCartRepository struct {
+    mu     sync.Mutex
+    carts  map[int]Cart
+    nextID int
+    // now tells the time, so tests can move it along to expire carts.
+    now func() time.Time
+}
+
+// newMemoryCartRepository returns an empty in-memory CartRepository.
+func newMemoryCartRepository() *memoryCartRepository {
+    return &memoryCartRepository{carts: make(map[int]Cart), nextID: 1, now: time.Now}
+}
+
+func (repo *memoryCartRepository) Create(ctx context.Context, cart *Cart) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    cart.ID = repo.nextID
+    repo.nextID++
+    cart.CreatedAt = repo.now()
+    cart.UpdatedAt = cart.CreatedAt
+    cart.Items = []CartItem{}
+    repo.carts[cart.ID] = *cart
+    return nil
+}
+
+// live returns the cart with the given ID if it hasn't expired. The caller holds mu.
+func (repo *memoryCartRepository) live(id int) (Cart, bool) {
+    cart, ok := repo.carts[id]
+    if !ok || !cart.ExpiresAt.After(repo.now()) {
+        return Cart{}, false
+    }
+    return cart, true
+}
+
+func (repo *memoryCartRepository) Get(ctx context.Context, id int) (Cart, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    cart, ok := repo.live(id)
+    if !ok {
+        return Cart{}, ErrCartNotFound
+    }
+    cart.Items = append([]CartItem{}, cart.Items...)
+    return cart, nil
+}
+
+func (repo *memoryCartRepository) SetItem(ctx context.Context, cartID, productID, quantity int, expiresAt time.Time) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    cart, ok := repo.live(cartID)
+    if !ok {
+        return ErrCartNotFound
+    }
+    items := make([]CartItem, 0, len(cart.Items)+1)
+    found := false
+    for _, item := range cart.Items {
+        if item.ProductID == productID {
+            item.Quantity, found = quantity, true
+        }
+        items = append(items, item)
+    }
+    if !found {
+        items = append(items, CartItem{ProductID: productID, Quantity: quantity, AddedAt: repo.now()})
+    }
+    cart.Items, cart.UpdatedAt, cart.ExpiresAt = items, repo.now(), expiresAt
+    repo.carts[cartID] = cart
+    return nil
+}
+
+func (repo *memoryCartRepository) RemoveItem(ctx context.Context, cartID, productID int, expiresAt time.Time) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    cart, ok := repo.live(cartID)
+    if !ok {
+        return ErrCartNotFound
+    }
+    items := make([]CartItem, 0, len(cart.Items))
+    for _, item := range cart.Items {
+        if item.ProductID != productID {
+            items = append(items, item)
+        }
+    }
+    if len(items) == len(cart.Items) {
+        return ErrCartItemNotFound
+    }
+    cart.Items, cart.UpdatedAt, cart.ExpiresAt = items, repo.now(), expiresAt
+    repo.carts[cartID] = cart
+    return nil
+}
+
+func (repo *memoryCartRepository) Delete(ctx context.Context, id int) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    if _, ok := repo.live(id); !ok {
+        return ErrCartNotFound
+    }
+    delete(repo.carts, id)
+    return nil
+}
+
+func (repo *memoryCartRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    deleted := 0
+    for id, cart := range repo.carts {
+        if !cart.ExpiresAt.After(now) {
+            delete(repo.carts, id)
+            deleted++
+        }
+    }
+    return deleted, nil
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// memoryRepository is a ProductRepository that keeps products in memory. It is meant for
+// tests and local experiments, not for production use.
+type memoryRepository struct {
+    mu       sync.Mutex
+    products map[int]Product
+    // deleted holds soft-deleted products, out of the way of every lookup of products.
+    deleted map[int]Product
+    nextID  int
+}
+
+// newMemoryRepository returns an empty in-memory ProductRepository.
+func newMemoryRepository() *memoryRepository {
+    return &memoryRepository{products: make(map[int]Product), deleted: make(map[int]Product), nextID: 1}
+}
+
+func (repo *memoryRepository) GetByID(ctx context.Context, id int) (Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    product, ok := repo.products[id]
+    if !ok {
+        return Product{}, ErrProductNotFound
+    }
+    return product, nil
+}
+
+func (repo *memoryRepository) GetByIDWithDeleted(ctx context.Context, id int) (Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    if product, ok := repo.products[id]; ok {
+        return product, nil
+    }
+    if product, ok := repo.deleted[id]; ok {
+        return product, nil
+    }
+    return Product{}, ErrProductNotFound
+}
+
+func (repo *memoryRepository) GetByIDs(ctx context.Context, ids []int) ([]Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    products := []Product{}
+    seen := map[int]bool{}
+    for _, id := range ids {
+        if product, ok := repo.products[id]; ok && !seen[id] {
+            products = append(products, product)
+            seen[id] = true
+        }
+    }
+    sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+    return products, nil
+}
+
+func (repo *memoryRepository) GetByBarcode(ctx context.Context, code string) (Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    for _, product := range repo.products {
+        if product.Barcode == code {
+            return product, nil
+        }
+    }
+    return Product{}, ErrProductNotFound
+}
+
+func (repo *memoryRepository) List(ctx context.Context, q ListQuery) (ProductList, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+
+    // Collect the matching products and count them before the cursor narrows them to a page.
+    matches := repo.matching(q.Filter)
+    list := ProductList{Total: len(matches)}
+
+    sort.Slice(matches, func(i, j int) bool {
+        return lessProduct(matches[i], matches[j], q.Sort, q.Desc)
+    })
+    if q.After != nil {
+        after := cursorProduct(*q.After)
+        i := sort.Search(len(matches), func(i int) bool {
+            return lessProduct(after, matches[i], q.Sort, q.Desc)
+        })
+        matches = matches[i:]
+    }
+
+    if len(matches) > q.Limit {
+        matches = matches[:q.Limit]
+        list.NextCursor = encodeCursor(q.Sort, matches[len(matches)-1])
+    }
+    list.Products = append(make(Products, 0, len(matches)), matches...)
+    return list, nil
+}
+
+func (repo *memoryRepository) Each(ctx context.Context, f ProductFilter, fn func(Product) error) error {
+    // Take a snapshot so fn can run without holding the lock.
+    repo.mu.Lock()
+    matches := repo.matching(f)
+    repo.mu.Unlock()
+
+    sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+    for _, product := range matches {
+        if err := fn(product); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Expand returns products without images, variants or stock, which the memory repository
+// doesn't keep, nor categories, which it doesn't either.
+func (repo *memoryRepository) Expand(ctx context.Context, products []Product, e Expansion) ([]ExpandedProduct, error) {
+    return newExpandedProducts(products, e), nil
+}
+
+func (repo *memoryRepository) Facets(ctx context.Context, f ProductFilter, priceInterval Money) (ProductFacets, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+
+    byCategory, byTag, byPrice := facetFilters(f)
+    facets := ProductFacets{Total: len(repo.matching(f))}
+    categories := map[string]int{}
+    for _, product := range repo.matching(byCategory) {
+        categories[product.Category]++
+    }
+    tags := map[string]int{}
+    for _, product := range repo.matching(byTag) {
+        for _, tag := range product.Tags.Names() {
+            tags[tag]++
+        }
+    }
+    buckets := map[Money]int{}
+    for _, product := range repo.matching(byPrice) {
+        buckets[product.Price/priceInterval*priceInterval]++
+    }
+
+    facets.Categories, facets.Tags = facetCounts(categories), facetCounts(tags)
+    facets.Prices = []PriceBucket{}
+    for min, count := range buckets {
+        facets.Prices = append(facets.Prices, PriceBucket{Min: min, Max: min + priceInterval, Count: count})
+    }
+    sort.Slice(facets.Prices, func(i, j int) bool { return facets.Prices[i].Min < facets.Prices[j].Min })
+    return facets, nil
+}
+
+// facetCounts turns counts by value into sorted FacetCounts.
+func facetCounts(counts map[string]int) []FacetCount {
+    facets := []FacetCount{}
+    for value, count := range counts {
+        facets = append(facets, FacetCount{Value: value, Count: count})
+    }
+    sortFacetCounts(facets)
+    return facets
+}
+
+func (repo *memoryRepository) Search(ctx context.Context, terms []string, limit int) ([]SearchResult, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+
+    // Approximate ts_rank: a term found in the name counts more than one in the category.
+    results := []SearchResult{}
+    for _, product := range repo.products {
+        if product.Status != StatusPublished {
+            continue
+        }
+        name := searchTerms(product.Name)
+        category := searchTerms(product.Category)
+        var rank float64
+        for i, term := range terms {
+            prefix := i == len(terms)-1
+            if containsTerm(name, term, prefix) {
+                rank += 1
+            } else if containsTerm(category, term, prefix) {
+                rank += 0.4
+            } else {
+                rank = 0
+                break
+            }
+        }
+        if rank > 0 {
+            results = append(results, SearchResult{Product: product, Rank: rank})
+        }
+    }
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Rank != results[j].Rank {
+            return results[i].Rank > results[j].Rank
+        }
+        return results[i].ID < results[j].ID
+    })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results, nil
+}
+
+func (repo *memoryRepository) FuzzySearch(ctx context.Context, text string, threshold float64, limit int) ([]SearchResult, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+
+    results := []SearchResult{}
+    for _, product := range repo.products {
+        if product.Status != StatusPublished {
+            continue
+        }
+        if similarity := trigramSimilarity(product.Name, text); similarity >= threshold {
+            results = append(results, SearchResult{Product: product, Similarity: similarity})
+        }
+    }
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Similarity != results[j].Similarity {
+            return results[i].Similarity > results[j].Similarity
+        }
+        return results[i].ID < results[j].ID
+    })
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results, nil
+}
+
+// trigramSimilarity approximates pg_trgm's similarity: the share of the trigrams of a and
+// b, taken per word padded with spaces, that they have in common.
+func trigramSimilarity(a, b string) float64 {
+    ta, tb := trigrams(a), trigrams(b)
+    if len(ta) == 0 || len(tb) == 0 {
+        return 0
+    }
+    common := 0
+    for t := range ta {
+        if tb[t] {
+            common++
+        }
+    }
+    return float64(common) / float64(len(ta)+len(tb)-common)
+}
+
+// trigrams returns the set of trigrams of the words of s.
+func trigrams(s string) map[string]bool {
+    set := map[string]bool{}
+    for _, word := range searchTerms(s) {
+        padded := []rune("  " + word + " ")
+        for i := 0; i+3 <= len(padded); i++ {
+            set[string(padded[i:i+3])] = true
+        }
+    }
+    return set
+}
+
+// containsTerm reports whether words contains term, or a word starting with it if prefix is set.
+func containsTerm(words []string, term string, prefix bool) bool {
+    for _, word := range words {
+        if word == term || (prefix && strings.HasPrefix(word, term)) {
+            return true
+        }
+    }
+    return false
+}
+
+// matching returns the products that pass f, in no particular order. The caller must hold
+// repo.mu.
+func (repo *memoryRepository) matching(f ProductFilter) Products {
+    var matches Products
+    for _, product := range repo.products {
+        if matchesFilter(product, f) {
+            matches = append(matches, product)
+        }
+    }
+    if f.IncludeDeleted {
+        for _, product := range repo.deleted {
+            if matchesFilter(product, f) {
+                matches = append(matches, product)
+            }
+        }
+    }
+    return matches
+}
+
+// matchesFilter reports whether product passes every condition of f.
+func matchesFilter(product Product, f ProductFilter) bool {
+    if product.ID <= f.AfterID {
+        return false
+    }
+    if f.VendorID > 0 && product.VendorID != f.VendorID {
+        return false
+    }
+    if f.Status != "" && product.Status != f.Status || f.PublishedOnly && product.Status != StatusPublished {
+        return false
+    }
+    if f.Name != "" && !strings.Contains(product.Name, f.Name) {
+        return false
+    }
+    if len(f.Categories) > 0 {
+        found := false
+        for _, category := range f.Categories {
+            if product.Category == category {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    if f.MinPrice != nil && product.Price < *f.MinPrice {
+        return false
+    }
+    if f.MaxPrice != nil && product.Price > *f.MaxPrice {
+        return false
+    }
+    if len(f.Attributes) > 0 {
+        attributes := product.Attributes.Map()
+        for name, value := range f.Attributes {
+            if got, ok := attributes[name]; !ok || got != value {
+                return false
+            }
+        }
+    }
+    if len(f.Tags) > 0 {
+        matched := 0
+        for _, tag := range f.Tags {
+            if product.Tags.Has(tag) {
+                matched++
+            }
+        }
+        if matched == 0 || f.TagsMatchAll && matched < len(f.Tags) {
+            return false
+        }
+    }
+    return true
+}
+
+// lessProduct reports whether a sorts before b by the given column, with ID breaking ties.
+func lessProduct(a, b Product, column string, desc bool) bool {
+    cmp := 0
+    switch column {
+    case "name":
+        cmp = strings.Compare(a.Name, b.Name)
+    case "category":
+        cmp = strings.Compare(a.Category, b.Category)
+    case "price":
+        if a.Price < b.Price {
+            cmp = -1
+        } else if a.Price > b.Price {
+            cmp = 1
+        }
+    case "created_at":
+        cmp = a.CreatedAt.Compare(b.CreatedAt)
+    }
+    if cmp == 0 {
+        cmp = a.ID - b.ID
+    }
+    if desc {
+        return cmp > 0
+    }
+    return cmp < 0
+}
+
+// cursorProduct rebuilds enough of the product a cursor points at to compare others with it.
+func cursorProduct(c listCursor) Product {
+    product := Product{ID: c.ID}
+    switch c.Sort {
+    case "name":
+        product.Name = c.Value
+    case "category":
+        product.Category = c.Value
+    case "price":
+        product.Price, _ = ParseMoney(c.Value)
+    case "created_at":
+        product.CreatedAt, _ = time.Parse(time.RFC3339Nano, c.Value)
+    }
+    return product
+}
+
+func (repo *memoryRepository) Create(ctx context.Context, product *Product) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    if err := repo.conflict(*product, 0); err != nil {
+        return err
+    }
+    product.ID, product.Version = repo.nextID, 1
+    product.CreatedAt, product.DeletedAt = time.Now(), nil
+    product.keepDerived(Product{})
+    product.UpdatedAt = product.CreatedAt
+    defaultCurrency(product)
+    repo.nextID++
+    repo.products[product.ID] = *product
+    return nil
+}
+
+func (repo *memoryRepository) CreateBatch(ctx context.Context, products []Product) ([]error, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    itemErrs := make([]error, len(products))
+    for i := range products {
+        if err := repo.conflict(products[i], 0); err != nil {
+            itemErrs[i] = err
+            continue
+        }
+        products[i].ID, products[i].Version = repo.nextID, 1
+        products[i].CreatedAt, products[i].DeletedAt = time.Now(), nil
+        products[i].keepDerived(Product{})
+        products[i].UpdatedAt = products[i].CreatedAt
+        defaultCurrency(&products[i])
+        repo.nextID++
+        repo.products[products[i].ID] = products[i]
+    }
+    return itemErrs, nil
+}
+
+func (repo *memoryRepository) Update(ctx context.Context, product *Product) (bool, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    current, ok := repo.products[product.ID]
+    if !ok {
+        return false, ErrProductNotFound
+    }
+    if !versionMatches(product.Version, current.Version) {
+        return false, ErrVersionMismatch
+    }
+    if product.Currency == "" {
+        product.Currency = current.Currency
+    }
+    product.CreatedAt, product.DeletedAt, product.Version = current.CreatedAt, nil, current.Version
+    product.keepDerived(current)
+    if *product == current {
+        return false, nil
+    }
+    if err := repo.conflict(*product, product.ID); err != nil {
+        return false, err
+    }
+    product.Version++
+    product.UpdatedAt = time.Now()
+    repo.products[product.ID] = *product
+    return true, nil
+}
+
+func (repo *memoryRepository) Upsert(ctx context.Context, product *Product) (bool, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    var existing *Product
+    for _, p := range repo.products {
+        if p.Name == product.Name && (existing == nil || p.ID < existing.ID) {
+            p := p
+            existing = &p
+        }
+    }
+    exceptID := 0
+    if existing != nil {
+        exceptID = existing.ID
+    }
+    if err := repo.conflict(*product, exceptID); err != nil {
+        return false, err
+    }
+    product.DeletedAt = nil
+    product.keepDerived(Product{})
+    if existing != nil {
+        product.ID, product.CreatedAt, product.Version = existing.ID, existing.CreatedAt, existing.Version+1
+        product.keepDerived(*existing)
+        if product.Currency == "" {
+            product.Currency = existing.Currency
+        }
+    } else {
+        defaultCurrency(product)
+        product.ID, product.CreatedAt, product.Version = repo.nextID, time.Now(), 1
+        repo.nextID++
+    }
+    product.UpdatedAt = time.Now()
+    repo.products[product.ID] = *product
+    return existing == nil, nil
+}
+
+func (repo *memoryRepository) UpsertBySKU(ctx context.Context, product *Product) (bool, bool, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    current, ok := repo.bySKU(product.SKU)
+    exceptID := 0
+    if ok {
+        exceptID = current.ID
+    }
+    if err := repo.conflict(*product, exceptID); err != nil {
+        return false, false, err
+    }
+    if ok {
+        if product.Currency == "" {
+            product.Currency = current.Currency
+        }
+        product.ID, product.CreatedAt, product.DeletedAt, product.Version = current.ID, current.CreatedAt, nil, current.Version
+        product.keepDerived(current)
+        if *product == current {
+            return false, false, nil
+        }
+        product.Version++
+        product.UpdatedAt = time.Now()
+        delete(repo.deleted, product.ID)
+    } else {
+        defaultCurrency(product)
+        product.ID, product.CreatedAt, product.DeletedAt, product.Version = repo.nextID, time.Now(), nil, 1
+        product.keepDerived(Product{})
+        product.UpdatedAt = product.CreatedAt
+        repo.nextID++
+    }
+    repo.products[product.ID] = *product
+    return !ok, true, nil
+}
+
+func (repo *memoryRepository) Patch(ctx context.Context, id, version int, patch ProductPatch) (Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    product, ok := repo.products[id]
+    if !ok {
+        return Product{}, ErrProductNotFound
+    }
+    if !versionMatches(version, product.Version) {
+        return Product{}, ErrVersionMismatch
+    }
+    if patch == (ProductPatch{}) {
+        return product, nil
+    }
+    applyPatch(&product, patch)
+    if err := repo.conflict(product, id); err != nil {
+        return Product{}, err
+    }
+    product.Version++
+    product.UpdatedAt = time.Now()
+    repo.products[id] = product
+    return product, nil
+}
+
+func (repo *memoryRepository) Delete(ctx context.Context, id, version int) error {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    product, ok := repo.products[id]
+    if !ok {
+        return ErrProductNotFound
+    }
+    if !versionMatches(version, product.Version) {
+        return ErrVersionMismatch
+    }
+    deletedAt := time.Now()
+    product.DeletedAt = &deletedAt
+    product.Version++
+    product.UpdatedAt = time.Now()
+    repo.deleted[id] = product
+    delete(repo.products, id)
+    return nil
+}
+
+func (repo *memoryRepository) Restore(ctx context.Context, id int) (Product, error) {
+    repo.mu.Lock()
+    defer repo.mu.Unlock()
+    product, ok := repo.deleted[id]
+    if !ok {
+        return Product{}, ErrProductNotFound
+    }
+    if err := repo.conflict(product, id); err != nil {
+        return Product{}, err
+    }
+    product.DeletedAt = nil
+    product.Version++
+    product.UpdatedAt = time.Now()
+    repo.products[id] = product
+    delete(repo.deleted, id)
+    return product, nil
+}
+
+// conflict returns ErrBarcodeInUse or ErrSKUInUse if a product other than exceptID already
+// uses the barcode or SKU of product. The caller must hold repo.mu.
+func (repo *memoryRepository) conflict(product Product, exceptID int) error {
+    if repo.barcodeTaken(product.Barcode, exceptID) {
+        return ErrBarcodeInUse
+    }
+    if other, ok := repo.bySKU(product.SKU); ok && other.ID != exceptID {
+        return ErrSKUInUse
+    }
+    return nil
+}
+
+// bySKU returns the product, deleted or not, with the given SKU. The caller must hold
+// repo.mu.
+func (repo *memoryRepository) bySKU(sku string) (Product, bool) {
+    if sku == "" {
+        return Product{}, false
+    }
+    for _, products := range []map[int]Product{repo.products, repo.deleted} {
+        for _, product := range products {
+            if product.SKU == sku {
+                return product, true
+            }
+        }
+    }
+    return Product{}, false
+}
+
+// barcodeTaken reports whether a product other than exceptID already uses barcode.
+// The caller must hold repo.mu.
+func (repo *memoryRepository) barcodeTaken(barcode string, exceptID int) bool {
+    if barcode == "" {
+        return false
+    }
+    for id, product := range repo.products {
+        if id != exceptID && product.Barcode == barcode {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "reflect"
+    "testing"
+)
+
+func TestMemoryRepository(t *testing.T) {
+    repo := newMemoryRepository()
+    ctx := context.Background()
+
+    lamp := Product{Name: "Lamp", Category: "home", Price: 1999, Barcode: "4006381333931", Status: StatusPublished}
+    if err := repo.Create(ctx, &lamp); err != nil {
+        t.Fatalf("Create: %v", err)
+    }
+    for _, name := range []string{"Desk", "Chair", "Shelf"} {
+        if err := repo.Create(ctx, &Product{Name: name, Category: "office", Price: 4999, Status: StatusPublished}); err != nil {
+            t.Fatalf("Create: %v", err)
+        }
+    }
+    if err := repo.Create(ctx, &Product{Name: "Lamp", Category: "home", Price: 1999, Barcode: lamp.Barcode}); err != ErrBarcodeInUse {
+        t.Errorf("Create with a taken barcode = %v, want ErrBarcodeInUse", err)
+    }
+
+    got, err := repo.GetByID(ctx, lamp.ID)
+    if err != nil || got.Name != "Lamp" || got.Version != 1 {
+        t.Fatalf("GetByID = %+v, %v", got, err)
+    }
+    if got, err := repo.GetByBarcode(ctx, lamp.Barcode); err != nil || got.ID != lamp.ID {
+        t.Errorf("GetByBarcode = %+v, %v, want product %d", got, err, lamp.ID)
+    }
+
+    // The office products come back two to a page, continued with the cursor.
+    q := ListQuery{Filter: ProductFilter{Categories: []string{"office"}}, Sort: "name", Limit: 2}
+    var names []string
+    for page := 0; ; page++ {
+        list, err := repo.List(ctx, q)
+        if err != nil || list.Total != 3 {
+            t.Fatalf("List page %d = %+v, %v", page, list, err)
+        }
+        for _, product := range list.Products {
+            names = append(names, product.Name)
+        }
+        if list.NextCursor == "" {
+            break
+        }
+        after, err := decodeCursor(list.NextCursor)
+        if err != nil {
+            t.Fatalf("decoding cursor: %v", err)
+        }
+        q.After = &after
+    }
+    if want := []string{"Chair", "Desk", "Shelf"}; !reflect.DeepEqual(names, want) {
+        t.Errorf("listed %q, want %q", names, want)
+    }
+
+    if err := repo.Delete(ctx, lamp.ID, 7); err != ErrVersionMismatch {
+        t.Errorf("Delete of another version = %v, want ErrVersionMismatch", err)
+    }
+    if err := repo.Delete(ctx, lamp.ID, 1); err != nil {
+        t.Fatalf("Delete: %v", err)
+    }
+    if _, err := repo.GetByID(ctx, lamp.ID); err != ErrProductNotFound {
+        t.Errorf("GetByID of a deleted product = %v, want ErrProductNotFound", err)
+    }
+    if deleted, err := repo.GetByIDWithDeleted(ctx, lamp.ID); err != nil || deleted.DeletedAt == nil {
+        t.Errorf("GetByIDWithDeleted = %+v, %v, want the deleted product", deleted, err)
+    }
+    restored, err := repo.Restore(ctx, lamp.ID)
+    if err != nil || restored.DeletedAt != nil || restored.Version != 3 {
+        t.Errorf("Restore = %+v, %v, want version 3", restored, err)
+    }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HTTP metrics, served in the Prometheus format at /metrics. Requests are labeled with their
+// route template rather than their path, so product IDs don't each make a new series.
+var (
+    httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "http_requests_total",
+        Help: "HTTP requests handled, by method, route and status.",
+    }, []string{"method", "route", "status"})
+    httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "http_request_duration_seconds",
+        Help:    "Time taken to handle HTTP requests, by method and route.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"method", "route"})
+)
+
+// metricsMiddleware counts and times every request.
+func metricsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w}
+        next.ServeHTTP(rec, r)
+        if rec.status == 0 {
+            rec.status = http.StatusOK
+        }
+
+        route := "unmatched"
+        if current := mux.CurrentRoute(r); current != nil {
+            if template, err := current.GetPathTemplate(); err == nil {
+                route = template
+            }
+        }
+        httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+        httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+    })
+}
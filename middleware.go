@@ -0,0 +1,172 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "runtime/debug"
+
+    "github.com/gorilla/mux"
+)
+
+// Middleware wraps a handler with behavior that runs around it, such as logging or auth.
+type Middleware func(http.Handler) http.Handler
+
+// Chain is a list of middleware applied in order, the first one outermost.
+type Chain []Middleware
+
+// newChain returns a chain of middlewares.
+func newChain(middlewares ...Middleware) Chain {
+    return append(Chain(nil), middlewares...)
+}
+
+// Append returns a new chain running c and then middlewares; c itself is left unchanged.
+func (c Chain) Append(middlewares ...Middleware) Chain {
+    return append(append(Chain(nil), c...), middlewares...)
+}
+
+// Then wraps h in the middlewares of c.
+func (c Chain) Then(h http.Handler) http.Handler {
+    for i := len(c) - 1; i >= 0; i-- {
+        h = c[i](h)
+    }
+    return h
+}
+
+// ThenFunc wraps the handler function h in the middlewares of c.
+func (c Chain) ThenFunc(h http.HandlerFunc) http.Handler {
+    return c.Then(h)
+}
+
+// recoverer turns a panic in a handler into a 500 Internal Server Error JSON response, and
+// logs it with its stack, instead of letting the server drop the connection. If the
+// handler had already started the response, the response is left as it is.
+func recoverer(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rec := &statusRecorder{ResponseWriter: w}
+        defer func() {
+            p := recover()
+            if p == nil {
+                return
+            }
+            if p == http.ErrAbortHandler {
+                // The handler aborted the response on purpose.
+                panic(p)
+            }
+            logError(r, fmt.Errorf("panic: %v\n%s", p, debug.Stack()))
+            if rec.status == 0 {
+                respondError(w, r, http.StatusInternalServerError, codeInternal, "Internal server error.")
+            }
+        }()
+        next.ServeHTTP(rec, r)
+    })
+}
+
+// contextKey is the type of keys this package stores in request contexts.
+type contextKey string
+
+// correlationIDKey is the context key holding the request's correlation ID.
+const correlationIDKey contextKey = "correlation_id"
+
+// maxCorrelationIDLength bounds how much of an upstream correlation ID we are willing to carry.
+const maxCorrelationIDLength = 128
+
+// correlationIDMiddleware takes the correlation ID from the incoming request (when trusted),
+// or generates a new one, stores it in the request context, and echoes it on the response.
+func correlationIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := ""
+        if AppConfig.TrustCorrelationID {
+            id = r.Header.Get(AppConfig.CorrelationIDHeader)
+        }
+        if !validCorrelationID(id) {
+            id = newID()
+        }
+
+        w.Header().Set(AppConfig.CorrelationIDHeader, id)
+        ctx := context.WithValue(r.Context(), correlationIDKey, id)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// Names of the routes that stream the catalog: the export and the NDJSON stream. They run
+// for as long as it takes to read the whole catalog, so they are exempt from the query
+// timeout.
+const (
+    exportRouteName = "export-products"
+    streamRouteName = "stream-products"
+)
+
+// Names of the routes that take uploads, which may be larger than MaxBodySize.
+const (
+    importRouteName      = "import-products"
+    uploadImageRouteName = "upload-image"
+)
+
+// bodyLimitMiddleware bounds how much of a request body handlers may read: MaxImportSize for
+// CSV imports, MaxImageSize plus MaxBodySize for image uploads and MaxBodySize for the rest.
+// A body declared larger than that is answered with 413 Request Entity Too Large before it
+// is read; one that turns out larger fails to decode, with the same response.
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limit := AppConfig.MaxBodySize
+        if route := mux.CurrentRoute(r); route != nil {
+            switch route.GetName() {
+            case importRouteName:
+                limit = AppConfig.MaxImportSize
+            case uploadImageRouteName:
+                limit = AppConfig.MaxImageSize + AppConfig.MaxBodySize
+            }
+        }
+        if r.ContentLength > limit {
+            respondBodyError(w, r, &http.MaxBytesError{Limit: limit})
+            return
+        }
+        r.Body = http.MaxBytesReader(w, r.Body, limit)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// queryTimeoutMiddleware puts a deadline of DBQueryTimeout on the request context, which
+// every database call made on behalf of the request inherits.
+func queryTimeoutMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := mux.CurrentRoute(r)
+        if AppConfig.DBQueryTimeout <= 0 || (route != nil && (route.GetName() == exportRouteName || route.GetName() == streamRouteName)) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        ctx, cancel := context.WithTimeout(r.Context(), AppConfig.DBQueryTimeout)
+        defer cancel()
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// correlationIDFromContext returns the correlation ID stored in ctx, or an empty string.
+func correlationIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(correlationIDKey).(string)
+    return id
+}
+
+// validCorrelationID reports whether an upstream correlation ID is safe to propagate into
+// logs and outbound requests.
+func validCorrelationID(id string) bool {
+    if id == "" || len(id) > maxCorrelationIDLength {
+        return false
+    }
+    for _, c := range id {
+        if c < 0x21 || c > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// newID returns a random 128-bit identifier encoded as hex.
+func newID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
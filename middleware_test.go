@@ -0,0 +1,156 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestCorrelationIDMiddleware(t *testing.T) {
+    tests := []struct {
+        name     string
+        incoming string
+        trusted  bool
+        wantKept bool
+    }{
+        {name: "incoming kept", incoming: "checkout-42", trusted: true, wantKept: true},
+        {name: "missing generated", trusted: true},
+        {name: "untrusted replaced", incoming: "checkout-42"},
+        {name: "invalid replaced", incoming: "has spaces in it", trusted: true},
+        {name: "too long replaced", incoming: strings.Repeat("a", maxCorrelationIDLength+1), trusted: true},
+    }
+    generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            AppConfig.TrustCorrelationID = tt.trusted
+
+            var seen string
+            handler := correlationIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                seen = correlationIDFromContext(r.Context())
+            }))
+            r := httptest.NewRequest(http.MethodGet, "/products", nil)
+            if tt.incoming != "" {
+                r.Header.Set("X-Correlation-ID", tt.incoming)
+            }
+            w := httptest.NewRecorder()
+            handler.ServeHTTP(w, r)
+
+            echoed := w.Header().Get("X-Correlation-ID")
+            if echoed != seen {
+                t.Errorf("echoed ID %q, handler saw %q", echoed, seen)
+            }
+            if tt.wantKept {
+                if echoed != tt.incoming {
+                    t.Errorf("ID = %q, want %q", echoed, tt.incoming)
+                }
+            } else if !generated.MatchString(echoed) {
+                t.Errorf("ID = %q, want a generated one", echoed)
+            }
+        })
+    }
+}
+
+func TestCorrelationIDLogged(t *testing.T) {
+    setupHandlers(t)
+    var logs bytes.Buffer
+    saved := slog.Default()
+    slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+    t.Cleanup(func() { slog.SetDefault(saved) })
+
+    handler := newChain(correlationIDMiddleware, requestLoggingMiddleware).ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    })
+    r := httptest.NewRequest(http.MethodGet, "/products", nil)
+    r.Header.Set("X-Correlation-ID", "checkout-42")
+    handler.ServeHTTP(httptest.NewRecorder(), r)
+
+    var line struct {
+        CorrelationID string `json:"correlation_id"`
+    }
+    if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+        t.Fatalf("decoding log line %q: %v", logs.String(), err)
+    }
+    if line.CorrelationID != "checkout-42" {
+        t.Errorf("logged correlation_id = %q, want %q", line.CorrelationID, "checkout-42")
+    }
+}
+
+// TestCorrelationIDReachesWebhooks follows the ID of a request from the outbox row of the
+// event it records, through the webhook sink, to the header of the webhook delivery.
+func TestCorrelationIDReachesWebhooks(t *testing.T) {
+    setupHandlers(t)
+    var mu sync.Mutex
+    var outboxRow, deliveryRow []driver.Value
+    stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        mu.Lock()
+        defer mu.Unlock()
+        switch {
+        case strings.HasPrefix(query, "INSERT INTO event_outbox"):
+            outboxRow = args
+        case strings.Contains(query, "pg_try_advisory_xact_lock"):
+            return []string{"locked"}, [][]driver.Value{{true}}, nil
+        case strings.HasPrefix(query, "SELECT id, tenant_id, payload") && outboxRow != nil:
+            return []string{"id", "tenant_id", "payload", "correlation_id"}, [][]driver.Value{{int64(1), int64(1), outboxRow[3], outboxRow[5]}}, nil
+        case strings.HasPrefix(query, "INSERT INTO webhook_deliveries"):
+            deliveryRow = args
+        }
+        return nil, nil, nil
+    }
+
+    // A request records an event.
+    handler := correlationIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        tx, err := DB.BeginTx(r.Context(), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer tx.Rollback()
+        if err := recordProductEvent(r.Context(), tx, auditCreate, &Product{ID: 7, Name: "Lamp"}); err != nil {
+            t.Fatalf("recording event: %v", err)
+        }
+    }))
+    r := httptest.NewRequest(http.MethodPost, "/products", nil)
+    r.Header.Set("X-Correlation-ID", "checkout-42")
+    handler.ServeHTTP(httptest.NewRecorder(), r)
+    if outboxRow == nil || outboxRow[5] != "checkout-42" {
+        t.Fatalf("outbox row = %v, want correlation_id checkout-42", outboxRow)
+    }
+
+    // The outbox queues it for the webhooks.
+    if n, err := dispatchOutbox(context.Background(), webhookSink{}); err != nil || n != 1 {
+        t.Fatalf("dispatchOutbox = %d, %v; want 1 event", n, err)
+    }
+    if deliveryRow == nil || deliveryRow[4] != "checkout-42" {
+        t.Fatalf("delivery row = %v, want correlation_id checkout-42", deliveryRow)
+    }
+
+    // The dispatcher sends it with the ID.
+    received := make(chan string, 1)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        received <- r.Header.Get("X-Correlation-ID")
+    }))
+    defer server.Close()
+    claimed := false
+    stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        if !strings.HasPrefix(query, "WITH claimed") || claimed {
+            return nil, nil, nil
+        }
+        claimed = true
+        return []string{"id", "event_id", "event_type", "payload", "attempts", "url", "secret", "correlation_id"},
+            [][]driver.Value{{int64(1), "event-1", eventProductCreated, []byte("{}"), int64(0), server.URL, "secret", deliveryRow[4]}}, nil
+    }
+    if err := dispatchWebhooks(context.Background(), server.Client()); err != nil {
+        t.Fatalf("dispatchWebhooks: %v", err)
+    }
+    if got := <-received; got != "checkout-42" {
+        t.Errorf("webhook X-Correlation-ID = %q, want %q", got, "checkout-42")
+    }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "log/slog"
+    "sort"
+    "strings"
+)
+
+// migrationFiles holds the schema migrations. Each file is applied once, in name order, so
+// new ones must sort after the existing ones: migrations/NNNN_description.sql. Each comes
+// with migrations/NNNN_description.down.sql, which reverts it.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the Postgres advisory lock key that keeps instances starting at the
+// same time from applying migrations concurrently.
+const migrationLockKey = 7495002
+
+// downMigrationSuffix ends the names of the scripts reverting migrations.
+const downMigrationSuffix = ".down.sql"
+
+// migrate applies the migrations that have not been applied to db yet, each in its own
+// transaction, and records them in the schema_migrations table.
+func migrate(ctx context.Context, db *sql.DB) error {
+    names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+    if err != nil {
+        return err
+    }
+    sort.Strings(names)
+
+    return withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+        applied, err := appliedMigrations(ctx, conn)
+        if err != nil {
+            return err
+        }
+        for _, name := range names {
+            if strings.HasSuffix(name, downMigrationSuffix) {
+                continue
+            }
+            version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+            if applied[version] {
+                continue
+            }
+            script, err := migrationFiles.ReadFile(name)
+            if err != nil {
+                return err
+            }
+            if err := applyMigration(ctx, conn, version, string(script)); err != nil {
+                return fmt.Errorf("applying migration %s: %w", version, err)
+            }
+            slog.Info("applied migration", "version", version)
+        }
+        return nil
+    })
+}
+
+// migrateDown reverts the latest applied migration with its down script and returns its
+// version, or an empty string if none is applied.
+func migrateDown(ctx context.Context, db *sql.DB) (string, error) {
+    var version string
+    err := withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+        err := conn.QueryRowContext(ctx, "SELECT version FROM schema_migrations ORDER BY version DESC LIMIT 1").Scan(&version)
+        if err == sql.ErrNoRows {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        script, err := migrationFiles.ReadFile("migrations/" + version + downMigrationSuffix)
+        if errors.Is(err, fs.ErrNotExist) {
+            return fmt.Errorf("migration %s has no down script and can't be reverted", version)
+        } else if err != nil {
+            return err
+        }
+        if err := revertMigration(ctx, conn, version, string(script)); err != nil {
+            return fmt.Errorf("reverting migration %s: %w", version, err)
+        }
+        slog.Info("reverted migration", "version", version)
+        return nil
+    })
+    return version, err
+}
+
+// withMigrationLock runs fn on a connection to db holding the migration lock, once the
+// schema_migrations table exists.
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+    // Advisory locks are held per session, so pin a single connection for the whole run.
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+        return err
+    }
+    defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+    _, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version    TEXT PRIMARY KEY,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`)
+    if err != nil {
+        return err
+    }
+    return fn(conn)
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[string]bool, error) {
+    applied := make(map[string]bool)
+    rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var version string
+        if err := rows.Scan(&version); err != nil {
+            return nil, err
+        }
+        applied[version] = true
+    }
+    return applied, rows.Err()
+}
+
+// applyMigration runs one migration script and records it, atomically.
+func applyMigration(ctx context.Context, conn *sql.Conn, version, script string) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, script); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// revertMigration runs the down script of a migration and forgets it was applied,
+// atomically.
+func revertMigration(ctx context.Context, conn *sql.Conn, version, script string) error {
+    tx, err := conn.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx, script); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", version); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "io/fs"
+    "strings"
+    "testing"
+)
+
+func TestMigrationsHaveDownScripts(t *testing.T) {
+    names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+    if err != nil {
+        t.Fatal(err)
+    }
+    scripts := make(map[string]bool, len(names))
+    for _, name := range names {
+        scripts[name] = true
+    }
+    ups := 0
+    for _, name := range names {
+        if strings.HasSuffix(name, downMigrationSuffix) {
+            if !scripts[strings.TrimSuffix(name, downMigrationSuffix)+".sql"] {
+                t.Errorf("%s reverts a migration that doesn't exist", name)
+            }
+            continue
+        }
+        ups++
+        if !scripts[strings.TrimSuffix(name, ".sql")+downMigrationSuffix] {
+            t.Errorf("migration %s has no down script", name)
+        }
+    }
+    if ups == 0 {
+        t.Fatal("no migrations embedded")
+    }
+}
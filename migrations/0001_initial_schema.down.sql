@@ -0,0 +1,12 @@
+-- Reverting the initial schema deletes the whole catalog, with its users and API keys.
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS api_keys;
+DROP TRIGGER IF EXISTS products_category_counts ON products;
+DROP FUNCTION IF EXISTS update_category_counts();
+DROP TABLE IF EXISTS category_counts;
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS stock_adjustments;
+DROP TABLE IF EXISTS products;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,146 @@
+CREATE TABLE IF NOT EXISTS products (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    category   TEXT NOT NULL,
+    price      DOUBLE PRECISION NOT NULL,
+    image_url  TEXT NOT NULL DEFAULT '',
+    barcode    TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Incremented by every change to a product and used as its ETag, so that concurrent
+-- writers can't silently overwrite each other.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+-- DELETE only marks a product as deleted so it can be restored.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+-- Barcodes only have to be unique among live products, so a deleted product's barcode
+-- can be reused.
+DROP INDEX IF EXISTS products_barcode_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS products_live_barcode_idx ON products (barcode) WHERE deleted_at IS NULL;
+
+-- Full-text search document for /products/search. As a generated column it is backfilled
+-- for existing rows when added and kept up to date by Postgres afterwards.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search tsvector
+    GENERATED ALWAYS AS (
+        setweight(to_tsvector('simple', name), 'A') || setweight(to_tsvector('simple', category), 'B')
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS products_search_idx ON products USING GIN (search);
+
+-- Categories form a tree through parent_id. Products refer to their category by name, so
+-- renaming a category renames it on its products too, and a category in use can't be deleted.
+CREATE TABLE IF NOT EXISTS categories (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE,
+    parent_id  INTEGER REFERENCES categories (id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+
+-- Every category already used by a product becomes a top-level category.
+INSERT INTO categories (name) SELECT DISTINCT category FROM products ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_category_fkey;
+ALTER TABLE products ADD CONSTRAINT products_category_fkey
+    FOREIGN KEY (category) REFERENCES categories (name) ON UPDATE CASCADE;
+
+-- Stock on hand. It is only changed through stock adjustments, each of which is recorded.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0);
+
+CREATE TABLE IF NOT EXISTS stock_adjustments (
+    id         SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    delta      INTEGER NOT NULL,
+    reason     TEXT NOT NULL,
+    note       TEXT NOT NULL DEFAULT '',
+    quantity   INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS stock_adjustments_product_id_idx ON stock_adjustments (product_id, created_at);
+
+-- Every change made to a product through the API, with snapshots before and after it.
+-- There is deliberately no foreign key, so that the log can't be lost with its product.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id         BIGSERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    before     JSONB,
+    after      JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_product_id_idx ON audit_log (product_id, id);
+
+-- Responses stored under Idempotency-Key headers so retried writes are not applied twice.
+-- status is NULL while the first request with a key is still running.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope        TEXT NOT NULL,
+    key          TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status       INTEGER,
+    headers      JSONB,
+    body         BYTEA,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (scope, key)
+);
+
+-- Order line items. Only the columns needed for co-occurrence recommendations are modelled.
+CREATE TABLE IF NOT EXISTS order_items (
+    order_id   INTEGER NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    quantity   INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (order_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS order_items_product_id_idx ON order_items (product_id);
+
+-- Denormalized per-category product counts, kept up to date by a trigger on products.
+-- POST /admin/recompute-counts rebuilds them from the products table if they drift.
+CREATE TABLE IF NOT EXISTS category_counts (
+    category      TEXT PRIMARY KEY,
+    product_count INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE OR REPLACE FUNCTION update_category_counts() RETURNS TRIGGER AS $$
+BEGIN
+    -- Soft-deleted products don't count.
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.deleted_at IS NULL THEN
+        UPDATE category_counts SET product_count = product_count - 1 WHERE category = OLD.category;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.deleted_at IS NULL THEN
+        INSERT INTO category_counts (category, product_count) VALUES (NEW.category, 1)
+        ON CONFLICT (category) DO UPDATE SET product_count = category_counts.product_count + 1;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_category_counts ON products;
+CREATE TRIGGER products_category_counts
+    AFTER INSERT OR DELETE OR UPDATE OF category, deleted_at ON products
+    FOR EACH ROW EXECUTE FUNCTION update_category_counts();
+
+-- API keys for mutating endpoints. Only a SHA-256 hash of each key is stored.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    role       TEXT NOT NULL DEFAULT 'editor',
+    key_hash   TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+-- Users who can log in to get a JWT. Passwords are stored as bcrypt hashes.
+CREATE TABLE IF NOT EXISTS users (
+    id            SERIAL PRIMARY KEY,
+    username      TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    role          TEXT NOT NULL DEFAULT 'viewer' CHECK (role IN ('viewer', 'editor', 'admin')),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,13 @@
+-- Variants are the sellable versions of a product, such as its sizes and colors. Each has
+-- its own SKU and stock, and may override the product's price.
+CREATE TABLE IF NOT EXISTS product_variants (
+    id         SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    sku        TEXT NOT NULL UNIQUE,
+    attributes JSONB NOT NULL DEFAULT '{}',
+    price      DOUBLE PRECISION,
+    stock      INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS product_variants_product_id_idx ON product_variants (product_id);
@@ -0,0 +1,2 @@
+-- The image files are left in the image store.
+DROP TABLE IF EXISTS product_images;
@@ -0,0 +1,16 @@
+-- Uploaded product images. The files live in the image store under storage_key; one
+-- thumbnail is kept for each of thumbnail_sizes, the length of its longest edge in pixels.
+CREATE TABLE IF NOT EXISTS product_images (
+    id              SERIAL PRIMARY KEY,
+    product_id      INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    position        INTEGER NOT NULL,
+    content_type    TEXT NOT NULL,
+    width           INTEGER NOT NULL,
+    height          INTEGER NOT NULL,
+    size_bytes      INTEGER NOT NULL,
+    storage_key     TEXT NOT NULL,
+    thumbnail_sizes INTEGER[] NOT NULL DEFAULT '{}',
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS product_images_product_id_idx ON product_images (product_id, position);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS scheduled_prices;
+DROP TRIGGER IF EXISTS products_price_history ON products;
+DROP FUNCTION IF EXISTS record_price_history();
+DROP TABLE IF EXISTS price_history;
@@ -0,0 +1,42 @@
+-- Every price a product has had. A trigger records a row whenever a product is created or
+-- its price changes, however the change is made.
+CREATE TABLE IF NOT EXISTS price_history (
+    id         SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    price      DOUBLE PRECISION NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS price_history_product_id_idx ON price_history (product_id, changed_at);
+
+-- Existing products start their history with their current price.
+INSERT INTO price_history (product_id, price, changed_at) SELECT id, price, created_at FROM products;
+
+CREATE OR REPLACE FUNCTION record_price_history() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'INSERT' OR NEW.price IS DISTINCT FROM OLD.price THEN
+        INSERT INTO price_history (product_id, price) VALUES (NEW.id, NEW.price);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS products_price_history ON products;
+CREATE TRIGGER products_price_history
+    AFTER INSERT OR UPDATE OF price ON products
+    FOR EACH ROW EXECUTE FUNCTION record_price_history();
+
+-- Price changes staged in advance. The price scheduler applies each pending one once
+-- effective_from has passed.
+CREATE TABLE IF NOT EXISTS scheduled_prices (
+    id             SERIAL PRIMARY KEY,
+    product_id     INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    price          DOUBLE PRECISION NOT NULL,
+    effective_from TIMESTAMPTZ NOT NULL,
+    status         TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'applied', 'cancelled', 'skipped')),
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    applied_at     TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_prices_due_idx ON scheduled_prices (effective_from) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS scheduled_prices_product_id_idx ON scheduled_prices (product_id);
@@ -0,0 +1,4 @@
+-- Every price is read as US dollars again, whatever currency it was set in.
+DROP TABLE IF EXISTS exchange_rates;
+DROP TABLE IF EXISTS product_prices;
+ALTER TABLE products DROP COLUMN IF EXISTS currency;
@@ -0,0 +1,20 @@
+-- The currency each product's price is in. Products created before currencies existed were
+-- all priced in US dollars.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+
+-- Prices set explicitly for a product in another currency. Reads in that currency use them
+-- instead of converting the product's own price.
+CREATE TABLE IF NOT EXISTS product_prices (
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    currency   TEXT NOT NULL,
+    price      DOUBLE PRECISION NOT NULL CHECK (price >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (product_id, currency)
+);
+
+-- How many units of each currency one unit of the base currency buys.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    currency   TEXT PRIMARY KEY,
+    rate       DOUBLE PRECISION NOT NULL CHECK (rate > 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
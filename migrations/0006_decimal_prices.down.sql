@@ -0,0 +1,13 @@
+-- Back to DOUBLE PRECISION, which holds every two-place decimal to within a fraction of a
+-- cent. The price history trigger is dropped for the conversion as on the way up.
+DROP TRIGGER IF EXISTS products_price_history ON products;
+
+ALTER TABLE products ALTER COLUMN price TYPE DOUBLE PRECISION;
+ALTER TABLE product_variants ALTER COLUMN price TYPE DOUBLE PRECISION;
+ALTER TABLE price_history ALTER COLUMN price TYPE DOUBLE PRECISION;
+ALTER TABLE scheduled_prices ALTER COLUMN price TYPE DOUBLE PRECISION;
+ALTER TABLE product_prices ALTER COLUMN price TYPE DOUBLE PRECISION;
+
+CREATE TRIGGER products_price_history
+    AFTER INSERT OR UPDATE OF price ON products
+    FOR EACH ROW EXECUTE FUNCTION record_price_history();
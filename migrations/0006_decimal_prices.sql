@@ -0,0 +1,17 @@
+-- Prices were stored as DOUBLE PRECISION, which can't hold amounts like 19.99 exactly. Store
+-- them as exact decimals with two places instead; the conversion rounds each price to the
+-- nearest hundredth.
+
+-- A column can't change type while a trigger fires on updates of it, so the price history
+-- trigger is dropped for the conversion and created again afterwards.
+DROP TRIGGER IF EXISTS products_price_history ON products;
+
+ALTER TABLE products ALTER COLUMN price TYPE NUMERIC(12, 2) USING round(price::numeric, 2);
+ALTER TABLE product_variants ALTER COLUMN price TYPE NUMERIC(12, 2) USING round(price::numeric, 2);
+ALTER TABLE price_history ALTER COLUMN price TYPE NUMERIC(12, 2) USING round(price::numeric, 2);
+ALTER TABLE scheduled_prices ALTER COLUMN price TYPE NUMERIC(12, 2) USING round(price::numeric, 2);
+ALTER TABLE product_prices ALTER COLUMN price TYPE NUMERIC(12, 2) USING round(price::numeric, 2);
+
+CREATE TRIGGER products_price_history
+    AFTER INSERT OR UPDATE OF price ON products
+    FOR EACH ROW EXECUTE FUNCTION record_price_history();
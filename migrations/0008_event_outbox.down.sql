@@ -0,0 +1,2 @@
+-- Events not yet published are lost.
+DROP TABLE IF EXISTS event_outbox;
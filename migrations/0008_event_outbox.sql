@@ -0,0 +1,14 @@
+-- Product events waiting to be published to the event broker. They are written in the same
+-- transaction as the change, so an event is never lost while the broker is down; the relay
+-- publishes them in id order and sets published_at once the broker has accepted them.
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id           BIGSERIAL PRIMARY KEY,
+    event_id     TEXT NOT NULL UNIQUE,
+    event_type   TEXT NOT NULL,
+    product_id   INTEGER NOT NULL,
+    payload      JSONB NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS event_outbox_unpublished_idx ON event_outbox (id) WHERE published_at IS NULL;
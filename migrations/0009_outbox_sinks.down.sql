@@ -0,0 +1,12 @@
+-- The relay publishes the events the broker is still waiting for. Events only webhooks are
+-- still waiting for count as published, as webhook deliveries used to be queued with the
+-- change itself; those deliveries are not sent.
+ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS published_at TIMESTAMPTZ;
+UPDATE event_outbox SET published_at = created_at WHERE NOT 'broker' = ANY(pending_sinks);
+
+DROP INDEX IF EXISTS webhook_deliveries_event_idx;
+DROP INDEX IF EXISTS event_outbox_created_at_idx;
+DROP INDEX IF EXISTS event_outbox_pending_idx;
+ALTER TABLE event_outbox DROP COLUMN IF EXISTS pending_sinks;
+
+CREATE INDEX IF NOT EXISTS event_outbox_unpublished_idx ON event_outbox (id) WHERE published_at IS NULL;
@@ -0,0 +1,18 @@
+-- The outbox becomes the single source of product events: every change writes one row, and
+-- the dispatcher delivers it to each sink in pending_sinks (webhooks, broker), removing the
+-- sink once it has taken the event. Rows no sink is waiting for are cleaned up later.
+ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS pending_sinks TEXT[] NOT NULL DEFAULT '{}';
+
+-- Webhook deliveries for existing events were queued when they were written; only events
+-- the relay had not published are still waiting, for the broker.
+UPDATE event_outbox SET pending_sinks = ARRAY['broker'] WHERE published_at IS NULL;
+
+DROP INDEX IF EXISTS event_outbox_unpublished_idx;
+ALTER TABLE event_outbox DROP COLUMN IF EXISTS published_at;
+
+CREATE INDEX IF NOT EXISTS event_outbox_pending_idx ON event_outbox (id) WHERE cardinality(pending_sinks) > 0;
+CREATE INDEX IF NOT EXISTS event_outbox_created_at_idx ON event_outbox (created_at) WHERE cardinality(pending_sinks) = 0;
+
+-- The event ID deduplicates deliveries: a webhook gets each event at most once, even if the
+-- dispatcher queues it again.
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (webhook_id, event_id);
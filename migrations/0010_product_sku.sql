@@ -0,0 +1,5 @@
+-- The SKU is the key external systems sync products by. Unlike barcodes it stays reserved
+-- while a product is deleted, so syncing the SKU again brings the same product back.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS sku TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS products_sku_idx ON products (sku);
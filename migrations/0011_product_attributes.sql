@@ -0,0 +1,5 @@
+-- Free-form product attributes, like brand or color, as a JSON object of strings. The GIN
+-- index serves containment filters such as attributes @> '{"brand": "Acme"}'.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS products_attributes_idx ON products USING GIN (attributes jsonb_path_ops);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS product_reviews_ratings ON product_reviews;
+DROP FUNCTION IF EXISTS update_product_ratings();
+ALTER TABLE products DROP COLUMN IF EXISTS rating_total;
+ALTER TABLE products DROP COLUMN IF EXISTS review_count;
+DROP TABLE IF EXISTS product_reviews;
@@ -0,0 +1,36 @@
+-- Customer reviews of products: a star rating with an optional title and text, at most one
+-- per reviewer and product.
+CREATE TABLE IF NOT EXISTS product_reviews (
+    id         SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    author     TEXT NOT NULL,
+    rating     SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    title      TEXT NOT NULL DEFAULT '',
+    body       TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (product_id, author)
+);
+
+CREATE INDEX IF NOT EXISTS product_reviews_product_id_idx ON product_reviews (product_id, id DESC);
+
+-- Denormalized rating totals, kept up to date by a trigger on product_reviews, so product
+-- reads can show the average rating without aggregating reviews.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS review_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS rating_total INTEGER NOT NULL DEFAULT 0;
+
+CREATE OR REPLACE FUNCTION update_product_ratings() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE products SET review_count = review_count - 1, rating_total = rating_total - OLD.rating WHERE id = OLD.product_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE products SET review_count = review_count + 1, rating_total = rating_total + NEW.rating WHERE id = NEW.product_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_reviews_ratings ON product_reviews;
+CREATE TRIGGER product_reviews_ratings
+    AFTER INSERT OR DELETE OR UPDATE OF rating ON product_reviews
+    FOR EACH ROW EXECUTE FUNCTION update_product_ratings();
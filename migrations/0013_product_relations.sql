@@ -0,0 +1,12 @@
+-- Curated relations between products: related products, accessories and alternatives. A
+-- relation points one way; relating two products both ways takes two rows.
+CREATE TABLE IF NOT EXISTS product_relations (
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    related_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    kind       TEXT NOT NULL CHECK (kind IN ('related', 'accessory', 'alternative')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (product_id, kind, related_id),
+    CHECK (product_id <> related_id)
+);
+
+CREATE INDEX IF NOT EXISTS product_relations_related_id_idx ON product_relations (related_id);
@@ -0,0 +1,78 @@
+-- Without tenants every row belongs to one catalog, where names, barcodes and SKUs of
+-- different tenants could clash, so only a database holding the default tenant alone can
+-- be reverted.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM tenants WHERE id <> 1) THEN
+        RAISE EXCEPTION 'tenants other than the default one exist; delete them before reverting';
+    END IF;
+END;
+$$;
+
+CREATE OR REPLACE FUNCTION update_category_counts() RETURNS TRIGGER AS $$
+BEGIN
+    -- Soft-deleted products don't count.
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.deleted_at IS NULL THEN
+        UPDATE category_counts SET product_count = product_count - 1 WHERE category = OLD.category;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.deleted_at IS NULL THEN
+        INSERT INTO category_counts (category, product_count) VALUES (NEW.category, 1)
+        ON CONFLICT (category) DO UPDATE SET product_count = category_counts.product_count + 1;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (scope, key);
+ALTER TABLE category_counts DROP CONSTRAINT IF EXISTS category_counts_pkey;
+ALTER TABLE category_counts ADD PRIMARY KEY (category);
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_username_key;
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+ALTER TABLE tags DROP CONSTRAINT IF EXISTS tags_name_key;
+ALTER TABLE tags ADD CONSTRAINT tags_name_key UNIQUE (name);
+ALTER TABLE product_variants DROP CONSTRAINT IF EXISTS product_variants_sku_key;
+ALTER TABLE product_variants ADD CONSTRAINT product_variants_sku_key UNIQUE (sku);
+
+DROP INDEX IF EXISTS products_sku_idx;
+CREATE UNIQUE INDEX products_sku_idx ON products (sku);
+DROP INDEX IF EXISTS products_live_barcode_idx;
+CREATE UNIQUE INDEX products_live_barcode_idx ON products (barcode) WHERE deleted_at IS NULL;
+
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_category_fkey;
+ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_name_key;
+ALTER TABLE categories ADD CONSTRAINT categories_name_key UNIQUE (name);
+ALTER TABLE products ADD CONSTRAINT products_category_fkey
+    FOREIGN KEY (category) REFERENCES categories (name) ON UPDATE CASCADE;
+
+DROP INDEX IF EXISTS products_tenant_id_idx;
+
+DROP TRIGGER IF EXISTS webhook_attempts_tenant ON webhook_attempts;
+DROP TRIGGER IF EXISTS webhook_deliveries_tenant ON webhook_deliveries;
+
+-- The policies refer to tenant_id, so they go before the column.
+DO $$
+DECLARE
+    tbl TEXT;
+BEGIN
+    FOREACH tbl IN ARRAY ARRAY['stock_adjustments', 'audit_log', 'order_items', 'product_variants', 'product_images', 'price_history',
+        'scheduled_prices', 'product_prices', 'event_outbox', 'product_reviews', 'product_relations', 'product_tags'] LOOP
+        EXECUTE format('DROP TRIGGER IF EXISTS %I ON %I', tbl || '_tenant', tbl);
+    END LOOP;
+    FOREACH tbl IN ARRAY ARRAY['products', 'categories', 'category_counts', 'stock_adjustments', 'audit_log', 'idempotency_keys', 'order_items',
+        'api_keys', 'users', 'product_variants', 'product_images', 'price_history', 'scheduled_prices', 'product_prices',
+        'webhooks', 'webhook_deliveries', 'webhook_attempts', 'event_outbox', 'product_reviews', 'product_relations',
+        'tags', 'product_tags'] LOOP
+        EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %I', tbl);
+        EXECUTE format('ALTER TABLE %I NO FORCE ROW LEVEL SECURITY', tbl);
+        EXECUTE format('ALTER TABLE %I DISABLE ROW LEVEL SECURITY', tbl);
+        EXECUTE format('ALTER TABLE %I DROP COLUMN IF EXISTS tenant_id', tbl);
+    END LOOP;
+END;
+$$;
+
+DROP FUNCTION IF EXISTS inherit_tenant();
+DROP FUNCTION IF EXISTS enable_tenant_isolation(REGCLASS);
+DROP FUNCTION IF EXISTS current_tenant_id();
+DROP TABLE IF EXISTS tenants;
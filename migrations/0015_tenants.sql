@@ -0,0 +1,113 @@
+-- Merchants hosted by the service. Each has its own catalog: every row of the tables below
+-- belongs to one tenant, and row-level security hides the other tenants' rows. Rows created
+-- before tenants existed belong to the default tenant.
+CREATE TABLE IF NOT EXISTS tenants (
+    id          SERIAL PRIMARY KEY,
+    slug        TEXT NOT NULL UNIQUE,
+    name        TEXT NOT NULL,
+    disabled_at TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO tenants (id, slug, name) VALUES (1, 'default', 'Default') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('tenants', 'id'), (SELECT max(id) FROM tenants));
+
+-- The tenant a session works for, set by the application as app.tenant_id. Sessions that
+-- haven't set it, like migrations and background jobs, work across every tenant.
+CREATE OR REPLACE FUNCTION current_tenant_id() RETURNS INTEGER AS $$
+    SELECT NULLIF(current_setting('app.tenant_id', true), '')::INTEGER;
+$$ LANGUAGE sql STABLE;
+
+-- enable_tenant_isolation gives a table a tenant_id column, defaulting to the session's
+-- tenant, and a policy limiting the session to that tenant's rows. Row-level security is
+-- forced so it applies to the table's owner as well; only superusers and roles with
+-- BYPASSRLS still see every row.
+CREATE OR REPLACE FUNCTION enable_tenant_isolation(tbl REGCLASS) RETURNS VOID AS $$
+BEGIN
+    EXECUTE format('ALTER TABLE %s ADD COLUMN IF NOT EXISTS tenant_id INTEGER NOT NULL DEFAULT COALESCE(current_tenant_id(), 1) REFERENCES tenants (id)', tbl);
+    EXECUTE format('ALTER TABLE %s ENABLE ROW LEVEL SECURITY', tbl);
+    EXECUTE format('ALTER TABLE %s FORCE ROW LEVEL SECURITY', tbl);
+    EXECUTE format('DROP POLICY IF EXISTS tenant_isolation ON %s', tbl);
+    EXECUTE format('CREATE POLICY tenant_isolation ON %s USING (current_tenant_id() IS NULL OR tenant_id = current_tenant_id())', tbl);
+END;
+$$ LANGUAGE plpgsql;
+
+-- inherit_tenant sets the tenant of a new row to that of its parent row, whose table and
+-- the column referring to it are the trigger arguments. Rows written by background jobs,
+-- which have no tenant of their own, so land with the right tenant.
+CREATE OR REPLACE FUNCTION inherit_tenant() RETURNS TRIGGER AS $$
+DECLARE
+    parent_tenant_id INTEGER;
+BEGIN
+    EXECUTE format('SELECT tenant_id FROM %I WHERE id = ($1).%I', TG_ARGV[0], TG_ARGV[1]) INTO parent_tenant_id USING NEW;
+    NEW.tenant_id := COALESCE(parent_tenant_id, NEW.tenant_id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Exchange rates are shared by every tenant.
+SELECT enable_tenant_isolation(tbl) FROM unnest(ARRAY[
+    'products', 'categories', 'category_counts', 'stock_adjustments', 'audit_log', 'idempotency_keys', 'order_items',
+    'api_keys', 'users', 'product_variants', 'product_images', 'price_history', 'scheduled_prices', 'product_prices',
+    'webhooks', 'webhook_deliveries', 'webhook_attempts', 'event_outbox', 'product_reviews', 'product_relations',
+    'tags', 'product_tags'
+]::REGCLASS[]) AS tbl;
+
+DO $$
+DECLARE
+    tbl TEXT;
+BEGIN
+    FOREACH tbl IN ARRAY ARRAY['stock_adjustments', 'audit_log', 'order_items', 'product_variants', 'product_images', 'price_history',
+        'scheduled_prices', 'product_prices', 'event_outbox', 'product_reviews', 'product_relations', 'product_tags'] LOOP
+        EXECUTE format('DROP TRIGGER IF EXISTS %I ON %I', tbl || '_tenant', tbl);
+        EXECUTE format('CREATE TRIGGER %I BEFORE INSERT ON %I FOR EACH ROW EXECUTE FUNCTION inherit_tenant(''products'', ''product_id'')', tbl || '_tenant', tbl);
+    END LOOP;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS webhook_deliveries_tenant ON webhook_deliveries;
+CREATE TRIGGER webhook_deliveries_tenant BEFORE INSERT ON webhook_deliveries
+    FOR EACH ROW EXECUTE FUNCTION inherit_tenant('webhooks', 'webhook_id');
+DROP TRIGGER IF EXISTS webhook_attempts_tenant ON webhook_attempts;
+CREATE TRIGGER webhook_attempts_tenant BEFORE INSERT ON webhook_attempts
+    FOR EACH ROW EXECUTE FUNCTION inherit_tenant('webhook_deliveries', 'delivery_id');
+
+CREATE INDEX IF NOT EXISTS products_tenant_id_idx ON products (tenant_id, id);
+
+-- Names, barcodes and SKUs only have to be unique within a tenant.
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_category_fkey;
+ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_name_key;
+ALTER TABLE categories ADD CONSTRAINT categories_name_key UNIQUE (tenant_id, name);
+ALTER TABLE products ADD CONSTRAINT products_category_fkey
+    FOREIGN KEY (tenant_id, category) REFERENCES categories (tenant_id, name) ON UPDATE CASCADE;
+
+DROP INDEX IF EXISTS products_live_barcode_idx;
+CREATE UNIQUE INDEX products_live_barcode_idx ON products (tenant_id, barcode) WHERE deleted_at IS NULL;
+DROP INDEX IF EXISTS products_sku_idx;
+CREATE UNIQUE INDEX products_sku_idx ON products (tenant_id, sku);
+
+ALTER TABLE product_variants DROP CONSTRAINT IF EXISTS product_variants_sku_key;
+ALTER TABLE product_variants ADD CONSTRAINT product_variants_sku_key UNIQUE (tenant_id, sku);
+ALTER TABLE tags DROP CONSTRAINT IF EXISTS tags_name_key;
+ALTER TABLE tags ADD CONSTRAINT tags_name_key UNIQUE (tenant_id, name);
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_username_key;
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (tenant_id, username);
+
+ALTER TABLE category_counts DROP CONSTRAINT IF EXISTS category_counts_pkey;
+ALTER TABLE category_counts ADD PRIMARY KEY (tenant_id, category);
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (tenant_id, scope, key);
+
+CREATE OR REPLACE FUNCTION update_category_counts() RETURNS TRIGGER AS $$
+BEGIN
+    -- Soft-deleted products don't count.
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.deleted_at IS NULL THEN
+        UPDATE category_counts SET product_count = product_count - 1 WHERE tenant_id = OLD.tenant_id AND category = OLD.category;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.deleted_at IS NULL THEN
+        INSERT INTO category_counts (tenant_id, category, product_count) VALUES (NEW.tenant_id, NEW.category, 1)
+        ON CONFLICT (tenant_id, category) DO UPDATE SET product_count = category_counts.product_count + 1;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,11 @@
+-- Keys issued for a vendor would be able to change every product once the vendor is gone,
+-- so they are revoked.
+UPDATE api_keys SET revoked_at = now() WHERE vendor_id IS NOT NULL AND revoked_at IS NULL;
+ALTER TABLE api_keys DROP CONSTRAINT IF EXISTS api_keys_vendor_fkey;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS vendor_id;
+
+DROP INDEX IF EXISTS products_vendor_id_idx;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_vendor_fkey;
+ALTER TABLE products DROP COLUMN IF EXISTS vendor_id;
+
+DROP TABLE IF EXISTS vendors;
@@ -0,0 +1,27 @@
+-- Vendors supply products. A product belongs to at most one vendor, and API keys issued
+-- for a vendor can only change that vendor's products.
+CREATE TABLE IF NOT EXISTS vendors (
+    id            SERIAL PRIMARY KEY,
+    name          TEXT NOT NULL,
+    contact_email TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+SELECT enable_tenant_isolation('vendors');
+
+-- Foreign keys aren't subject to row-level security, so they include the tenant to keep
+-- products and keys from referring to another tenant's vendor.
+ALTER TABLE vendors DROP CONSTRAINT IF EXISTS vendors_name_key;
+ALTER TABLE vendors ADD CONSTRAINT vendors_name_key UNIQUE (tenant_id, name);
+ALTER TABLE vendors DROP CONSTRAINT IF EXISTS vendors_tenant_id_id_key;
+ALTER TABLE vendors ADD CONSTRAINT vendors_tenant_id_id_key UNIQUE (tenant_id, id);
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS vendor_id INTEGER;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_vendor_fkey;
+ALTER TABLE products ADD CONSTRAINT products_vendor_fkey FOREIGN KEY (tenant_id, vendor_id) REFERENCES vendors (tenant_id, id);
+CREATE INDEX IF NOT EXISTS products_vendor_id_idx ON products (vendor_id);
+
+-- A vendor's keys go with it.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS vendor_id INTEGER;
+ALTER TABLE api_keys DROP CONSTRAINT IF EXISTS api_keys_vendor_fkey;
+ALTER TABLE api_keys ADD CONSTRAINT api_keys_vendor_fkey FOREIGN KEY (tenant_id, vendor_id) REFERENCES vendors (tenant_id, id) ON DELETE CASCADE;
@@ -0,0 +1,7 @@
+-- Drafts and archived products can't be told apart from published ones once the status is
+-- gone, so reverting makes every product visible on the storefront.
+DROP INDEX IF EXISTS products_publish_at_idx;
+DROP INDEX IF EXISTS products_status_idx;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_status_check;
+ALTER TABLE products DROP COLUMN IF EXISTS publish_at;
+ALTER TABLE products DROP COLUMN IF EXISTS status;
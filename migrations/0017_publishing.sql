@@ -0,0 +1,10 @@
+-- Products are drafts until published, and are archived rather than deleted when they
+-- leave the storefront for good. Existing products are already on sale, so they start out
+-- published. A draft with a publish_at is published once that time comes.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'published';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_status_check;
+ALTER TABLE products ADD CONSTRAINT products_status_check CHECK (status IN ('draft', 'published', 'archived'));
+
+CREATE INDEX IF NOT EXISTS products_status_idx ON products (status);
+CREATE INDEX IF NOT EXISTS products_publish_at_idx ON products (publish_at) WHERE status = 'draft' AND publish_at IS NOT NULL;
@@ -0,0 +1,11 @@
+-- The outcome of the last run of each background job, on whichever instance ran it. Jobs
+-- work across tenants, so the table isn't tenant-isolated.
+CREATE TABLE IF NOT EXISTS jobs (
+    name             TEXT PRIMARY KEY,
+    last_started_at  TIMESTAMPTZ,
+    last_finished_at TIMESTAMPTZ,
+    last_error       TEXT NOT NULL DEFAULT '',
+    last_instance    TEXT NOT NULL DEFAULT '',
+    runs             BIGINT NOT NULL DEFAULT 0,
+    failures         BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,2 @@
+-- The pg_trgm extension is left installed, as other schemas in the database may use it.
+DROP INDEX IF EXISTS products_name_trgm_idx;
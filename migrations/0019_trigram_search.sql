@@ -0,0 +1,5 @@
+-- Fuzzy search matches product names by trigram similarity, so a typo like "iphnoe" still
+-- finds "iPhone". The GIN index serves the % operator used to find candidates.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS products_name_trgm_idx ON products USING GIN (name gin_trgm_ops);
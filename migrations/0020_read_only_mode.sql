@@ -0,0 +1,10 @@
+-- Settings that apply to the whole service, kept in a single row. Like jobs, they aren't
+-- per tenant, so the table isn't tenant-isolated.
+CREATE TABLE IF NOT EXISTS service_settings (
+    id                BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    read_only         BOOLEAN NOT NULL DEFAULT FALSE,
+    read_only_message TEXT NOT NULL DEFAULT '',
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO service_settings DEFAULT VALUES ON CONFLICT DO NOTHING;
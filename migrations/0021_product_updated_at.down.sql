@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS product_variants_updated_at ON product_variants;
+DROP TRIGGER IF EXISTS product_images_updated_at ON product_images;
+DROP TRIGGER IF EXISTS products_updated_at ON products;
+DROP FUNCTION IF EXISTS touch_parent_product();
+DROP FUNCTION IF EXISTS touch_product();
+ALTER TABLE products DROP COLUMN IF EXISTS updated_at;
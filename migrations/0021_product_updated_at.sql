@@ -0,0 +1,40 @@
+-- When each product last changed in a way its reads show: a new version, a review, or a
+-- change to its images or variants. It is sent as Last-Modified and is part of the ETag,
+-- so polling clients can revalidate a product with a conditional GET.
+ALTER TABLE products ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE OR REPLACE FUNCTION touch_product() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at := now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Every write to the columns of a product makes a new version, except for the review
+-- totals kept by the product_reviews_ratings trigger.
+DROP TRIGGER IF EXISTS products_updated_at ON products;
+CREATE TRIGGER products_updated_at
+    BEFORE UPDATE OF version, review_count, rating_total ON products
+    FOR EACH ROW EXECUTE FUNCTION touch_product();
+
+CREATE OR REPLACE FUNCTION touch_parent_product() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        UPDATE products SET updated_at = now() WHERE id = OLD.product_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        UPDATE products SET updated_at = now() WHERE id = NEW.product_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS product_images_updated_at ON product_images;
+CREATE TRIGGER product_images_updated_at
+    AFTER INSERT OR DELETE OR UPDATE ON product_images
+    FOR EACH ROW EXECUTE FUNCTION touch_parent_product();
+
+DROP TRIGGER IF EXISTS product_variants_updated_at ON product_variants;
+CREATE TRIGGER product_variants_updated_at
+    AFTER INSERT OR DELETE OR UPDATE ON product_variants
+    FOR EACH ROW EXECUTE FUNCTION touch_parent_product();
@@ -0,0 +1,17 @@
+-- Products users have marked as favorites, the wishlists of the storefront. A user can
+-- favorite a product once.
+CREATE TABLE IF NOT EXISTS favorites (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS favorites_product_id_idx ON favorites (product_id);
+
+SELECT enable_tenant_isolation('favorites');
+
+DROP TRIGGER IF EXISTS favorites_tenant ON favorites;
+CREATE TRIGGER favorites_tenant BEFORE INSERT ON favorites
+    FOR EACH ROW EXECUTE FUNCTION inherit_tenant('users', 'user_id');
@@ -0,0 +1,29 @@
+-- Shopping carts of signed-in users. A cart expires when it hasn't changed for CART_TTL;
+-- the cart-expiry job deletes expired carts with their items.
+CREATE TABLE IF NOT EXISTS carts (
+    id         SERIAL PRIMARY KEY,
+    owner      TEXT NOT NULL,
+    currency   TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS carts_expires_at_idx ON carts (expires_at);
+
+-- The products in a cart, one line per product.
+CREATE TABLE IF NOT EXISTS cart_items (
+    cart_id    INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    quantity   INTEGER NOT NULL CHECK (quantity > 0),
+    added_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (cart_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS cart_items_product_id_idx ON cart_items (product_id);
+
+SELECT enable_tenant_isolation(tbl) FROM unnest(ARRAY['carts', 'cart_items']::REGCLASS[]) AS tbl;
+
+DROP TRIGGER IF EXISTS cart_items_tenant ON cart_items;
+CREATE TRIGGER cart_items_tenant BEFORE INSERT ON cart_items
+    FOR EACH ROW EXECUTE FUNCTION inherit_tenant('carts', 'cart_id');
@@ -0,0 +1,32 @@
+-- Promotions discount the products of a category or tag, or every product, between
+-- starts_at and ends_at. A percentage promotion takes value percent off; a fixed one takes
+-- value off in its currency. Where several apply, a product gets the biggest discount.
+CREATE TABLE IF NOT EXISTS promotions (
+    id         SERIAL PRIMARY KEY,
+    name       TEXT NOT NULL,
+    type       TEXT NOT NULL CHECK (type IN ('percentage', 'fixed')),
+    value      NUMERIC(12, 2) NOT NULL CHECK (value > 0),
+    currency   TEXT,
+    category   TEXT,
+    tag        TEXT,
+    starts_at  TIMESTAMPTZ,
+    ends_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (type = 'fixed' OR value <= 100),
+    CHECK ((type = 'fixed') = (currency IS NOT NULL)),
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS promotions_ends_at_idx ON promotions (ends_at);
+
+SELECT enable_tenant_isolation('promotions');
+
+-- The category and tag are those of the promotion's tenant. A promotion follows its category
+-- when it is renamed and goes with it, or with its tag, when that is deleted.
+ALTER TABLE promotions DROP CONSTRAINT IF EXISTS promotions_category_fkey;
+ALTER TABLE promotions ADD CONSTRAINT promotions_category_fkey
+    FOREIGN KEY (tenant_id, category) REFERENCES categories (tenant_id, name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE promotions DROP CONSTRAINT IF EXISTS promotions_tag_fkey;
+ALTER TABLE promotions ADD CONSTRAINT promotions_tag_fkey
+    FOREIGN KEY (tenant_id, tag) REFERENCES tags (tenant_id, name) ON DELETE CASCADE;
@@ -0,0 +1,25 @@
+-- Coupon codes customers enter at checkout. A coupon discounts the products it lists and
+-- those of the categories it lists, or every product if it lists neither, until it expires
+-- or has been redeemed usage_limit times.
+CREATE TABLE IF NOT EXISTS coupons (
+    id          SERIAL PRIMARY KEY,
+    code        TEXT NOT NULL,
+    type        TEXT NOT NULL CHECK (type IN ('percentage', 'fixed')),
+    value       NUMERIC(12, 2) NOT NULL CHECK (value > 0),
+    currency    TEXT,
+    product_ids INTEGER[] NOT NULL DEFAULT '{}',
+    categories  TEXT[] NOT NULL DEFAULT '{}',
+    expires_at  TIMESTAMPTZ,
+    usage_limit INTEGER CHECK (usage_limit > 0),
+    usage_count INTEGER NOT NULL DEFAULT 0 CHECK (usage_count >= 0),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (type = 'fixed' OR value <= 100),
+    CHECK ((type = 'fixed') = (currency IS NOT NULL)),
+    CHECK (usage_count <= usage_limit)
+);
+
+SELECT enable_tenant_isolation('coupons');
+
+-- Codes are unique within a tenant.
+ALTER TABLE coupons DROP CONSTRAINT IF EXISTS coupons_code_key;
+ALTER TABLE coupons ADD CONSTRAINT coupons_code_key UNIQUE (tenant_id, code);
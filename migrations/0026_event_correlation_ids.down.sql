@@ -0,0 +1,2 @@
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS correlation_id;
+ALTER TABLE event_outbox DROP COLUMN IF EXISTS correlation_id;
@@ -0,0 +1,5 @@
+-- The correlation ID of the request that made a product change travels with its event, so
+-- webhook receivers and broker consumers can tie what they get back to the request. Events
+-- recorded outside a request have none.
+ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS correlation_id TEXT;
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS correlation_id TEXT;
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "database/sql/driver"
+    "errors"
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// Money is an exact amount in hundredths of a currency unit, such as cents. Prices are kept
+// as Money rather than float64 so that 19.99 stays 19.99 through arithmetic, storage and
+// comparisons. In JSON it is a number with two decimals, like 19.99, and in Postgres a
+// NUMERIC(12, 2).
+type Money int64
+
+// errInvalidMoney is returned when an amount is not a decimal number with at most two
+// decimal places.
+var errInvalidMoney = errors.New("must be a number with at most two decimal places")
+
+// ParseMoney parses a decimal amount like "19.99", "-3.5" or "12". It is exact: amounts with
+// more than two decimal places are rejected rather than rounded.
+func ParseMoney(s string) (Money, error) {
+    s = strings.TrimSpace(s)
+    negative := strings.HasPrefix(s, "-")
+    s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+    whole, fraction, _ := strings.Cut(s, ".")
+    if whole == "" && fraction == "" || len(fraction) > 2 || strings.ContainsAny(whole+fraction, "+-") {
+        return 0, errInvalidMoney
+    }
+    for len(fraction) < 2 {
+        fraction += "0"
+    }
+    if whole == "" {
+        whole = "0"
+    }
+    cents, err := strconv.ParseInt(whole+fraction, 10, 64)
+    if err != nil {
+        return 0, errInvalidMoney
+    }
+    if negative {
+        cents = -cents
+    }
+    return Money(cents), nil
+}
+
+// MoneyFromFloat converts a float amount to Money, rounding to the nearest hundredth. It is
+// only for inputs that arrive as floats, like gRPC doubles.
+func MoneyFromFloat(f float64) Money {
+    return Money(math.Round(f * 100))
+}
+
+// Float64 returns m as a float, for outputs that can only carry floats.
+func (m Money) Float64() float64 {
+    return float64(m) / 100
+}
+
+// Mul returns m multiplied by factor, rounded to the nearest hundredth.
+func (m Money) Mul(factor float64) Money {
+    return Money(math.Round(float64(m) * factor))
+}
+
+// String formats m with two decimal places, like "19.99".
+func (m Money) String() string {
+    sign := ""
+    cents := int64(m)
+    if cents < 0 {
+        sign, cents = "-", -cents
+    }
+    return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// MarshalJSON writes m as a JSON number with two decimal places.
+func (m Money) MarshalJSON() ([]byte, error) {
+    return []byte(m.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one, without going through float64.
+func (m *Money) UnmarshalJSON(data []byte) error {
+    s := string(data)
+    if s == "null" {
+        return nil
+    }
+    if unquoted, err := strconv.Unquote(s); err == nil {
+        s = unquoted
+    } else if strings.ContainsAny(s, "eE") {
+        // Exponents are valid JSON but no client sends prices that way; rather than expand
+        // them, reject them.
+        return fmt.Errorf("price %s", errInvalidMoney)
+    }
+    parsed, err := ParseMoney(s)
+    if err != nil {
+        return fmt.Errorf("price %s", err)
+    }
+    *m = parsed
+    return nil
+}
+
+// MarshalText writes m like String, which is how it appears in XML.
+func (m Money) MarshalText() ([]byte, error) {
+    return []byte(m.String()), nil
+}
+
+// UnmarshalText reads an amount written by MarshalText.
+func (m *Money) UnmarshalText(text []byte) error {
+    parsed, err := ParseMoney(string(text))
+    if err != nil {
+        return fmt.Errorf("price %s", err)
+    }
+    *m = parsed
+    return nil
+}
+
+// EncodeMsgpack writes m as a MessagePack float, which is what clients expect of a price.
+func (m Money) EncodeMsgpack(enc *msgpack.Encoder) error {
+    return enc.EncodeFloat64(m.Float64())
+}
+
+// DecodeMsgpack reads a MessagePack number, or a string holding one.
+func (m *Money) DecodeMsgpack(dec *msgpack.Decoder) error {
+    v, err := dec.DecodeInterfaceLoose()
+    if err != nil {
+        return err
+    }
+    switch v := v.(type) {
+    case float64:
+        *m = MoneyFromFloat(v)
+    case int64:
+        *m = Money(v * 100)
+    case uint64:
+        *m = Money(v * 100)
+    case string:
+        return m.UnmarshalText([]byte(v))
+    default:
+        return fmt.Errorf("price %s", errInvalidMoney)
+    }
+    return nil
+}
+
+// Scan reads a NUMERIC column, which the driver hands over as text.
+func (m *Money) Scan(src interface{}) error {
+    var err error
+    switch v := src.(type) {
+    case []byte:
+        *m, err = ParseMoney(string(v))
+    case string:
+        *m, err = ParseMoney(v)
+    case int64:
+        *m = Money(v * 100)
+    case float64:
+        *m = MoneyFromFloat(v)
+    default:
+        err = fmt.Errorf("cannot scan %T into Money", src)
+    }
+    return err
+}
+
+// Value writes m as decimal text, which Postgres stores into a NUMERIC column exactly.
+func (m Money) Value() (driver.Value, error) {
+    return m.String(), nil
+}
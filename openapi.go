@@ -0,0 +1,81 @@
+package main
+
+import (
+    _ "embed"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// openAPISpec is the OpenAPI 3 document describing the REST API. The document is written by
+// hand and is the source of truth for the API's contract; checkOpenAPIRoutes warns at
+// startup about routes it does not cover.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUIPage renders openAPISpec with Swagger UI, loaded from a CDN.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Product API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// getOpenAPISpec serves the OpenAPI document.
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(openAPISpec)
+}
+
+// getDocs serves Swagger UI for the OpenAPI document.
+func getDocs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Write([]byte(swaggerUIPage))
+}
+
+// routeVariablePattern matches a path variable with a regular expression, like {id:[0-9]+}.
+var routeVariablePattern = regexp.MustCompile(`\{(\w+):(?:[^{}]|\{[^}]*\})*\}`)
+
+// checkOpenAPIRoutes logs a warning for every route of router that openAPISpec does not
+// document, so that the document is noticed when it falls behind.
+func checkOpenAPIRoutes(router *versionRouter) error {
+    var spec struct {
+        Paths map[string]map[string]json.RawMessage `json:"paths"`
+    }
+    if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+        return err
+    }
+    return router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+        // Prefix routes, which end in a slash, serve files rather than API operations.
+        template, err := route.GetPathTemplate()
+        if err != nil || strings.HasSuffix(template, "/") {
+            return nil
+        }
+        methods, err := route.GetMethods()
+        if err != nil {
+            return nil
+        }
+        path := routeVariablePattern.ReplaceAllString(template, "{$1}")
+        for _, method := range methods {
+            if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+                slog.Warn("route is missing from the OpenAPI document", "method", method, "path", path)
+            }
+        }
+        return nil
+    })
+}
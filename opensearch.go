@@ -0,0 +1,341 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// searchReindexBatchSize is how many products a reindex sends to OpenSearch per bulk request.
+const searchReindexBatchSize = 500
+
+// SearchIndex is a search engine product names and categories are indexed in for
+// /products/search, kept up to date from the outbox by the search sink.
+type SearchIndex interface {
+    // Index adds or replaces the documents of products and removes those of deleted and
+    // unpublished products, which aren't searchable.
+    Index(ctx context.Context, products []IndexedProduct) error
+    // Search returns the IDs of up to limit products of the tenant of ctx matching every
+    // term, the last one also as a prefix, with their scores, best first.
+    Search(ctx context.Context, terms []string, limit int) ([]SearchHit, error)
+}
+
+// IndexedProduct is a product of a tenant, as sent to the search index.
+type IndexedProduct struct {
+    TenantID int
+    Product  Product
+}
+
+// SearchHit is a product found in the search index.
+type SearchHit struct {
+    ProductID int
+    Score     float64
+}
+
+// Searches is a global variable that holds the search index, or nil when searches go to
+// Postgres full-text search.
+var Searches SearchIndex
+
+// openSearchIndex is a SearchIndex kept in an index of an OpenSearch or Elasticsearch
+// cluster, talked to over its REST API.
+type openSearchIndex struct {
+    url      string
+    index    string
+    username string
+    password string
+    client   *http.Client
+}
+
+// newOpenSearchIndex returns the index described by cfg, or nil if OpenSearch isn't
+// configured. The index is created with its mapping if it doesn't exist yet; if the
+// cluster can't be reached, that is left to the first reindex.
+func newOpenSearchIndex(ctx context.Context, cfg Config) *openSearchIndex {
+    if cfg.OpenSearchURL == "" {
+        return nil
+    }
+    s := &openSearchIndex{
+        url:      strings.TrimSuffix(cfg.OpenSearchURL, "/"),
+        index:    cfg.OpenSearchIndex,
+        username: cfg.OpenSearchUsername,
+        password: cfg.OpenSearchPassword,
+        client:   &http.Client{Timeout: 10 * time.Second},
+    }
+    if err := s.createIndex(ctx); err != nil {
+        slog.Warn("creating search index", "index", s.index, "error", err)
+    }
+    return s
+}
+
+// searchDocument is what is indexed of a product. Documents of every tenant share the
+// index and are told apart by tenant_id.
+type searchDocument struct {
+    TenantID  int    `json:"tenant_id"`
+    ProductID int    `json:"product_id"`
+    Name      string `json:"name"`
+    Category  string `json:"category"`
+}
+
+// createIndex creates the index with the mapping of searchDocument, unless it exists.
+func (s *openSearchIndex) createIndex(ctx context.Context) error {
+    err := s.do(ctx, http.MethodHead, "/"+s.index, nil, nil)
+    if err == nil {
+        return nil
+    }
+    mapping := map[string]interface{}{
+        "mappings": map[string]interface{}{
+            "properties": map[string]interface{}{
+                "tenant_id":  map[string]string{"type": "integer"},
+                "product_id": map[string]string{"type": "integer"},
+                "name":       map[string]string{"type": "text"},
+                "category":   map[string]string{"type": "text"},
+            },
+        },
+    }
+    body, err := json.Marshal(mapping)
+    if err != nil {
+        return err
+    }
+    return s.do(ctx, http.MethodPut, "/"+s.index, body, nil)
+}
+
+// documentID is the ID of a product's document, unique across tenants.
+func documentID(tenantID, productID int) string {
+    return strconv.Itoa(tenantID) + "-" + strconv.Itoa(productID)
+}
+
+func (s *openSearchIndex) Index(ctx context.Context, products []IndexedProduct) error {
+    if len(products) == 0 {
+        return nil
+    }
+    var body bytes.Buffer
+    enc := json.NewEncoder(&body)
+    for _, p := range products {
+        meta := map[string]string{"_index": s.index, "_id": documentID(p.TenantID, p.Product.ID)}
+        if p.Product.DeletedAt != nil || p.Product.Status != StatusPublished {
+            if err := enc.Encode(map[string]interface{}{"delete": meta}); err != nil {
+                return err
+            }
+            continue
+        }
+        doc := searchDocument{TenantID: p.TenantID, ProductID: p.Product.ID, Name: p.Product.Name, Category: p.Product.Category}
+        if err := enc.Encode(map[string]interface{}{"index": meta}); err != nil {
+            return err
+        }
+        if err := enc.Encode(doc); err != nil {
+            return err
+        }
+    }
+
+    var resp struct {
+        Errors bool `json:"errors"`
+        Items  []map[string]struct {
+            Status int             `json:"status"`
+            Error  json.RawMessage `json:"error"`
+        } `json:"items"`
+    }
+    if err := s.do(ctx, http.MethodPost, "/_bulk", body.Bytes(), &resp); err != nil {
+        return err
+    }
+    if !resp.Errors {
+        return nil
+    }
+    for _, item := range resp.Items {
+        for action, result := range item {
+            // Deleting a document that was never indexed is fine.
+            if result.Status >= 300 && !(action == "delete" && result.Status == http.StatusNotFound) {
+                return fmt.Errorf("opensearch %s failed with status %d: %s", action, result.Status, result.Error)
+            }
+        }
+    }
+    return nil
+}
+
+func (s *openSearchIndex) Search(ctx context.Context, terms []string, limit int) ([]SearchHit, error) {
+    // A bool_prefix match with the and operator requires every term and treats the last one
+    // as a prefix, like the Postgres search. A match in the name counts more than one in the
+    // category.
+    query := map[string]interface{}{
+        "size":    limit,
+        "_source": []string{"product_id"},
+        "query": map[string]interface{}{
+            "bool": map[string]interface{}{
+                "filter": []interface{}{
+                    map[string]interface{}{"term": map[string]int{"tenant_id": tenantIDFromContext(ctx)}},
+                },
+                "must": []interface{}{
+                    map[string]interface{}{"multi_match": map[string]interface{}{
+                        "query":    strings.Join(terms, " "),
+                        "type":     "bool_prefix",
+                        "fields":   []string{"name^3", "category"},
+                        "operator": "and",
+                    }},
+                },
+            },
+        },
+        "sort": []interface{}{"_score", map[string]string{"product_id": "asc"}},
+    }
+    body, err := json.Marshal(query)
+    if err != nil {
+        return nil, err
+    }
+
+    var resp struct {
+        Hits struct {
+            Hits []struct {
+                Score  float64 `json:"_score"`
+                Source struct {
+                    ProductID int `json:"product_id"`
+                } `json:"_source"`
+            } `json:"hits"`
+        } `json:"hits"`
+    }
+    if err := s.do(ctx, http.MethodPost, "/"+s.index+"/_search", body, &resp); err != nil {
+        return nil, err
+    }
+    hits := make([]SearchHit, len(resp.Hits.Hits))
+    for i, hit := range resp.Hits.Hits {
+        hits[i] = SearchHit{ProductID: hit.Source.ProductID, Score: hit.Score}
+    }
+    return hits, nil
+}
+
+// do sends a request to the cluster and decodes the JSON response into out, unless it is
+// nil. Statuses other than 2xx are returned as errors.
+func (s *openSearchIndex) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+        if path == "/_bulk" {
+            req.Header.Set("Content-Type", "application/x-ndjson")
+        }
+    }
+    if s.username != "" {
+        req.SetBasicAuth(s.username, s.password)
+    }
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("opensearch %s %s returned %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+    }
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// searchSink indexes the products of outbox events in the search index.
+type searchSink struct {
+    index SearchIndex
+}
+
+func (searchSink) Name() string {
+    return sinkSearch
+}
+
+func (s searchSink) Dispatch(ctx context.Context, tx *sql.Tx, events []Event) error {
+    // Only the latest state of each product in the batch needs indexing.
+    latest := map[string]int{}
+    var products []IndexedProduct
+    for _, event := range events {
+        var product Product
+        if err := json.Unmarshal(event.Data, &product); err != nil {
+            return err
+        }
+        key := documentID(event.TenantID, product.ID)
+        if i, ok := latest[key]; ok {
+            products[i].Product = product
+            continue
+        }
+        latest[key] = len(products)
+        products = append(products, IndexedProduct{TenantID: event.TenantID, Product: product})
+    }
+    return s.index.Index(ctx, products)
+}
+
+// searchIndexedProducts returns the products of the search index matching terms, best first,
+// loaded from the repository so they are as current as any other read. Products changed
+// since they were indexed and no longer published are left out.
+func searchIndexedProducts(ctx context.Context, terms []string, limit int) ([]SearchResult, error) {
+    hits, err := Searches.Search(ctx, terms, limit)
+    if err != nil || len(hits) == 0 {
+        return []SearchResult{}, err
+    }
+    ids := make([]int, len(hits))
+    for i, hit := range hits {
+        ids[i] = hit.ProductID
+    }
+    products, err := Repo.GetByIDs(ctx, ids)
+    if err != nil {
+        return nil, err
+    }
+    byID := make(map[int]Product, len(products))
+    for _, product := range products {
+        byID[product.ID] = product
+    }
+    results := []SearchResult{}
+    for _, hit := range hits {
+        if product, ok := byID[hit.ProductID]; ok && product.Status == StatusPublished {
+            results = append(results, SearchResult{Product: product, Rank: hit.Score})
+        }
+    }
+    return results, nil
+}
+
+// SearchReindexResponse reports how many products a reindex sent to the search index.
+type SearchReindexResponse struct {
+    Indexed int `json:"indexed"`
+}
+
+// reindexSearch sends every published product of every tenant to the search index, which
+// fills a new index with the products that existed before it. Changes made meanwhile reach
+// the index through the outbox as usual.
+func reindexSearch(w http.ResponseWriter, r *http.Request) {
+    // Read across tenants, like the background jobs do.
+    ctx := withTenant(r.Context(), Tenant{})
+    indexed := 0
+    batch := make([]IndexedProduct, 0, searchReindexBatchSize)
+    flush := func() error {
+        if err := Searches.Index(ctx, batch); err != nil {
+            return err
+        }
+        indexed += len(batch)
+        batch = batch[:0]
+        return nil
+    }
+    err := queryRows(ctx, func(scan func(dest ...interface{}) error) error {
+        p := IndexedProduct{Product: Product{Status: StatusPublished}}
+        if err := scan(&p.TenantID, &p.Product.ID, &p.Product.Name, &p.Product.Category); err != nil {
+            return err
+        }
+        batch = append(batch, p)
+        if len(batch) < searchReindexBatchSize {
+            return nil
+        }
+        return flush()
+    }, "SELECT tenant_id, id, name, category FROM products WHERE deleted_at IS NULL AND status = $1 ORDER BY tenant_id, id", StatusPublished)
+    if err == nil {
+        err = flush()
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to reindex products.")
+        return
+    }
+
+    // If everything went well, report how many products were indexed.
+    respond(w, r, http.StatusOK, SearchReindexResponse{Indexed: indexed})
+}
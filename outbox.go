@@ -0,0 +1,323 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// Outbox sinks. Every outbox event is dispatched to each sink that was configured when it
+// was written, and each sink keeps its own progress, so a broker outage doesn't hold up
+// webhooks.
+const (
+    sinkWebhooks = "webhooks"
+    sinkBroker   = "broker"
+    sinkSearch   = "search"
+)
+
+// outboxLockKey is the Postgres advisory lock key that, together with a hash of the sink
+// name, keeps instances from dispatching to the same sink at once, which would dispatch
+// events out of order.
+const outboxLockKey = 7495004
+
+// Outbox events are dispatched in batches of up to outboxBatchSize. Events every sink has
+// taken are deleted once they are older than outboxRetention, checked every
+// outboxCleanupInterval.
+const (
+    outboxBatchSize       = 100
+    outboxRetention       = 7 * 24 * time.Hour
+    outboxCleanupInterval = time.Hour
+)
+
+// OutboxSink is a destination outbox events are dispatched to. Dispatch runs as part of tx,
+// which marks the events as dispatched to the sink when it commits, so a sink that writes
+// to the database through tx does so exactly once. Other sinks get events at least once: if
+// the commit fails after Dispatch succeeded, the events are dispatched again, and consumers
+// should use the event ID to ignore duplicates.
+type OutboxSink interface {
+    Name() string
+    Dispatch(ctx context.Context, tx *sql.Tx, events []Event) error
+}
+
+// OutboxSinks is a global variable that holds the sinks outbox events are dispatched to.
+var OutboxSinks []OutboxSink
+
+// newOutboxSinks returns the sinks to dispatch to: webhooks always, the broker when
+// publisher is not nil, and the search index when index is not nil.
+func newOutboxSinks(publisher EventPublisher, index SearchIndex) []OutboxSink {
+    sinks := []OutboxSink{webhookSink{}}
+    if publisher != nil {
+        sinks = append(sinks, brokerSink{publisher: publisher})
+    }
+    if index != nil {
+        sinks = append(sinks, searchSink{index: index})
+    }
+    return sinks
+}
+
+// outboxSinkNames returns the names of OutboxSinks, which new events are pending for.
+func outboxSinkNames() []string {
+    names := make([]string, len(OutboxSinks))
+    for i, sink := range OutboxSinks {
+        names[i] = sink.Name()
+    }
+    return names
+}
+
+// webhookSink queues events for the webhooks subscribed to them. The webhook dispatcher
+// then sends the deliveries, with retries.
+type webhookSink struct{}
+
+func (webhookSink) Name() string {
+    return sinkWebhooks
+}
+
+func (webhookSink) Dispatch(ctx context.Context, tx *sql.Tx, events []Event) error {
+    for _, event := range events {
+        payload, err := json.Marshal(event)
+        if err != nil {
+            return err
+        }
+        if err := enqueueWebhookEvent(ctx, tx, event, payload); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// brokerSink publishes events to the event broker.
+type brokerSink struct {
+    publisher EventPublisher
+}
+
+func (brokerSink) Name() string {
+    return sinkBroker
+}
+
+func (s brokerSink) Dispatch(ctx context.Context, tx *sql.Tx, events []Event) error {
+    return s.publisher.Publish(ctx, events)
+}
+
+// sinkCounters tracks what this instance has dispatched to a sink since it started.
+type sinkCounters struct {
+    dispatched       int64
+    failures         int64
+    lastDispatchedAt time.Time
+    lastError        string
+}
+
+var (
+    outboxCountersMu sync.Mutex
+    outboxCounters   = map[string]*sinkCounters{}
+)
+
+// countDispatch records the outcome of a dispatch run to sink.
+func countDispatch(sink string, dispatched int, err error) {
+    outboxCountersMu.Lock()
+    defer outboxCountersMu.Unlock()
+    counters, ok := outboxCounters[sink]
+    if !ok {
+        counters = &sinkCounters{}
+        outboxCounters[sink] = counters
+    }
+    counters.dispatched += int64(dispatched)
+    if dispatched > 0 {
+        counters.lastDispatchedAt = time.Now().UTC()
+    }
+    if err != nil {
+        counters.failures++
+        counters.lastError = err.Error()
+    }
+}
+
+// runOutboxDispatcher dispatches outbox events to each of sinks every interval until ctx
+// is done. Old dispatched events are deleted by the outbox-cleanup job.
+func runOutboxDispatcher(ctx context.Context, sinks []OutboxSink, interval time.Duration) {
+    for _, sink := range sinks {
+        go runOutboxSink(ctx, sink, interval)
+    }
+}
+
+// cleanUpOutbox deletes events every sink has taken once they are older than
+// outboxRetention. It runs as the outbox-cleanup job.
+func cleanUpOutbox(ctx context.Context) error {
+    _, err := DB.ExecContext(ctx, "DELETE FROM event_outbox WHERE cardinality(pending_sinks) = 0 AND created_at < now() - $1::float8 * interval '1 second'",
+        outboxRetention.Seconds())
+    return err
+}
+
+// runOutboxSink dispatches outbox events to sink every interval until ctx is done. Each run
+// goes on until the sink has caught up or fails; if it fails, the events stay pending for
+// the next run.
+func runOutboxSink(ctx context.Context, sink OutboxSink, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        for {
+            dispatched, err := dispatchOutbox(ctx, sink)
+            if ctx.Err() != nil {
+                return
+            }
+            countDispatch(sink.Name(), dispatched, err)
+            if err != nil {
+                slog.Error("dispatching events", "sink", sink.Name(), "error", err)
+            }
+            if err != nil || dispatched < outboxBatchSize {
+                break
+            }
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// dispatchOutbox dispatches the oldest batch of events pending for sink and marks them
+// dispatched to it, returning how many there were. Only one instance dispatches to a sink
+// at a time; the others find nothing to do.
+func dispatchOutbox(ctx context.Context, sink OutboxSink) (int, error) {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    // The lock is released when the transaction ends.
+    var locked bool
+    if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1, hashtext($2))", outboxLockKey, sink.Name()).Scan(&locked); err != nil {
+        return 0, err
+    } else if !locked {
+        return 0, nil
+    }
+
+    var ids []int64
+    var events []Event
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var id int64
+        var tenantID int
+        var payload []byte
+        var correlationID string
+        var event Event
+        if err := scan(&id, &tenantID, &payload, &correlationID); err != nil {
+            return err
+        }
+        if err := json.Unmarshal(payload, &event); err != nil {
+            return err
+        }
+        event.TenantID, event.CorrelationID = tenantID, correlationID
+        ids, events = append(ids, id), append(events, event)
+        return nil
+    }, "SELECT id, tenant_id, payload, COALESCE(correlation_id, '') FROM event_outbox WHERE $1 = ANY(pending_sinks) ORDER BY id LIMIT $2", sink.Name(), outboxBatchSize)
+    if err != nil || len(events) == 0 {
+        return 0, err
+    }
+
+    if err := sink.Dispatch(ctx, tx, events); err != nil {
+        return 0, err
+    }
+    if _, err := tx.ExecContext(ctx, "UPDATE event_outbox SET pending_sinks = array_remove(pending_sinks, $1) WHERE id = ANY($2)",
+        sink.Name(), pq.Array(ids)); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    return len(events), nil
+}
+
+// queryTxRows runs query in tx and calls fn with the scanner of each row.
+func queryTxRows(ctx context.Context, tx *sql.Tx, fn func(scan func(dest ...interface{}) error) error, query string, args ...interface{}) error {
+    rows, err := tx.QueryContext(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        if err := fn(rows.Scan); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+// OutboxSinkStatus is the state of an outbox sink. Pending and LagSeconds, how long the
+// oldest pending event has waited, cover every instance; the remaining fields count what
+// this instance has dispatched since it started.
+type OutboxSinkStatus struct {
+    Name             string     `json:"name"`
+    Configured       bool       `json:"configured"`
+    Pending          int        `json:"pending"`
+    OldestPendingAt  *time.Time `json:"oldest_pending_at"`
+    LagSeconds       float64    `json:"lag_seconds"`
+    Dispatched       int64      `json:"dispatched"`
+    Failures         int64      `json:"failures"`
+    LastDispatchedAt *time.Time `json:"last_dispatched_at"`
+    LastError        string     `json:"last_error,omitempty"`
+}
+
+// OutboxStatus is the body of the outbox status endpoint.
+type OutboxStatus struct {
+    Sinks []OutboxSinkStatus `json:"sinks"`
+}
+
+// getOutboxStatus reports, per sink, how many events are waiting to be dispatched and how
+// far behind it is. Events still pending for a sink that is no longer configured are
+// listed too, so they don't go unnoticed.
+func getOutboxStatus(w http.ResponseWriter, r *http.Request) {
+    statuses := map[string]*OutboxSinkStatus{}
+    for _, sink := range OutboxSinks {
+        statuses[sink.Name()] = &OutboxSinkStatus{Name: sink.Name(), Configured: true}
+    }
+    now := time.Now().UTC()
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var name string
+        var pending int
+        var oldest time.Time
+        if err := scan(&name, &pending, &oldest); err != nil {
+            return err
+        }
+        status, ok := statuses[name]
+        if !ok {
+            status = &OutboxSinkStatus{Name: name}
+            statuses[name] = status
+        }
+        oldest = oldest.UTC()
+        status.Pending, status.OldestPendingAt = pending, &oldest
+        status.LagSeconds = now.Sub(oldest).Seconds()
+        return nil
+    }, "SELECT sink, count(*), min(created_at) FROM event_outbox, unnest(pending_sinks) AS sink GROUP BY sink")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve outbox status.")
+        return
+    }
+
+    outboxCountersMu.Lock()
+    for name, counters := range outboxCounters {
+        if status, ok := statuses[name]; ok {
+            status.Dispatched, status.Failures, status.LastError = counters.dispatched, counters.failures, counters.lastError
+            if !counters.lastDispatchedAt.IsZero() {
+                lastDispatchedAt := counters.lastDispatchedAt
+                status.LastDispatchedAt = &lastDispatchedAt
+            }
+        }
+    }
+    outboxCountersMu.Unlock()
+
+    body := OutboxStatus{Sinks: []OutboxSinkStatus{}}
+    for _, status := range statuses {
+        body.Sinks = append(body.Sinks, *status)
+    }
+    sort.Slice(body.Sinks, func(i, j int) bool { return body.Sinks[i].Name < body.Sinks[j].Name })
+
+    // If everything went well, return the status in the response body.
+    respond(w, r, http.StatusOK, body)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+)
+
+// Action is something a principal can do with a product.
+type Action string
+
+const (
+    ActionRead   Action = "read"
+    ActionCreate Action = "create"
+    ActionUpdate Action = "update"
+    ActionDelete Action = "delete"
+)
+
+// ErrForbidden is returned by a Policy that doesn't allow an action.
+var ErrForbidden = errors.New("forbidden")
+
+// Policy decides whether a principal may take an action on a specific product. Routes
+// already require a role for what they do; a policy adds rules that depend on the product,
+// like which vendor it belongs to. Changes to a product's variants, images, prices, stock,
+// tags and relations are updates of the product.
+//
+// Authorize returns nil to allow the action, ErrForbidden to deny it, ErrProductNotFound to
+// deny it without admitting the product exists, or any other error if it couldn't decide.
+// For ActionCreate, product is the one about to be created. The principal is the zero
+// Principal for anonymous reads. Listings aren't checked product by product.
+type Policy interface {
+    Authorize(ctx context.Context, principal Principal, action Action, product Product) error
+}
+
+// ProductPolicy is a global variable that holds the policy handlers check product access
+// against.
+var ProductPolicy Policy = publicationPolicy{vendorPolicy{rolePolicy{}}}
+
+// actionRoles is the role each action needs under rolePolicy, the same as the routes
+// require.
+var actionRoles = map[Action]Role{
+    ActionRead:   RoleViewer,
+    ActionCreate: RoleEditor,
+    ActionUpdate: RoleEditor,
+    ActionDelete: RoleAdmin,
+}
+
+// rolePolicy is the default policy: a role allows the same actions on every product.
+// Anonymous principals may read when public reads are enabled.
+type rolePolicy struct{}
+
+func (rolePolicy) Authorize(ctx context.Context, principal Principal, action Action, product Product) error {
+    role, ok := actionRoles[action]
+    if !ok {
+        return ErrForbidden
+    }
+    if principal.Role.Includes(role) || principal.Role == "" && role == RoleViewer && AppConfig.PublicReads {
+        return nil
+    }
+    return ErrForbidden
+}
+
+// vendorPolicy narrows another policy for principals acting for a vendor: they may read
+// any product the inner policy lets them read, but only create, change and delete products
+// of their own vendor.
+type vendorPolicy struct {
+    Policy
+}
+
+func (p vendorPolicy) Authorize(ctx context.Context, principal Principal, action Action, product Product) error {
+    if err := p.Policy.Authorize(ctx, principal, action, product); err != nil {
+        return err
+    }
+    if principal.VendorID != 0 && action != ActionRead && product.VendorID != principal.VendorID {
+        return ErrForbidden
+    }
+    return nil
+}
+
+// authorizeProduct asks ProductPolicy whether the principal of ctx may take action on
+// product.
+func authorizeProduct(ctx context.Context, action Action, product Product) error {
+    principal, _ := principalFromContext(ctx)
+    return ProductPolicy.Authorize(ctx, principal, action, product)
+}
+
+// authorizeProductID is like authorizeProduct for the product with the given ID, deleted or
+// not. A product that doesn't exist passes, so the caller reports it the way it always
+// does.
+func authorizeProductID(ctx context.Context, action Action, id int) error {
+    product, err := Repo.GetByIDWithDeleted(ctx, id)
+    if err == ErrProductNotFound {
+        return nil
+    } else if err != nil {
+        return err
+    }
+    return authorizeProduct(ctx, action, product)
+}
+
+// allowProduct checks the policy for action on the product with the given ID. If it isn't
+// allowed it writes a 403 Forbidden response, or answers a failed check with message, and
+// reports false.
+func allowProduct(w http.ResponseWriter, r *http.Request, action Action, id int, message string) bool {
+    return respondPolicyError(w, r, authorizeProductID(r.Context(), action, id), message)
+}
+
+// respondPolicyError answers a policy check that returned err. It reports whether err was
+// nil, in which case nothing was written.
+func respondPolicyError(w http.ResponseWriter, r *http.Request, err error, message string) bool {
+    switch {
+    case err == nil:
+        return true
+    case err == ErrForbidden:
+        respondError(w, r, http.StatusForbidden, codeForbidden, "Forbidden.")
+    case err == ErrProductNotFound:
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+    default:
+        respondStoreError(w, r, err, message)
+    }
+    return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "time"
+)
+
+// postgresCartRepository is a CartRepository backed by the carts and cart_items tables.
+// Carts change with nearly every read of them, so it reads from the primary only.
+type postgresCartRepository struct {
+    db *sql.DB
+}
+
+// newPostgresCartRepository returns a CartRepository that keeps carts in db.
+func newPostgresCartRepository(db *sql.DB) *postgresCartRepository {
+    return &postgresCartRepository{db: db}
+}
+
+func (repo *postgresCartRepository) Create(ctx context.Context, cart *Cart) error {
+    return repo.db.QueryRowContext(ctx, "INSERT INTO carts (owner, currency, expires_at) VALUES ($1, $2, $3) RETURNING id, created_at, updated_at",
+        cart.Owner, cart.Currency, cart.ExpiresAt).Scan(&cart.ID, &cart.CreatedAt, &cart.UpdatedAt)
+}
+
+func (repo *postgresCartRepository) Get(ctx context.Context, id int) (Cart, error) {
+    cart := Cart{Items: []CartItem{}}
+    err := repo.db.QueryRowContext(ctx, "SELECT id, owner, currency, created_at, updated_at, expires_at FROM carts WHERE id = $1 AND expires_at > now()",
+        id).Scan(&cart.ID, &cart.Owner, &cart.Currency, &cart.CreatedAt, &cart.UpdatedAt, &cart.ExpiresAt)
+    if err == sql.ErrNoRows {
+        return Cart{}, ErrCartNotFound
+    } else if err != nil {
+        return Cart{}, err
+    }
+
+    rows, err := repo.db.QueryContext(ctx, "SELECT product_id, quantity, added_at FROM cart_items WHERE cart_id = $1 ORDER BY added_at, product_id", id)
+    if err != nil {
+        return Cart{}, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var item CartItem
+        if err := rows.Scan(&item.ProductID, &item.Quantity, &item.AddedAt); err != nil {
+            return Cart{}, err
+        }
+        cart.Items = append(cart.Items, item)
+    }
+    return cart, rows.Err()
+}
+
+func (repo *postgresCartRepository) SetItem(ctx context.Context, cartID, productID, quantity int, expiresAt time.Time) error {
+    return repo.change(ctx, cartID, expiresAt, func(tx *sql.Tx) error {
+        _, err := tx.ExecContext(ctx, `INSERT INTO cart_items (cart_id, product_id, quantity) VALUES ($1, $2, $3)
+            ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = EXCLUDED.quantity`, cartID, productID, quantity)
+        if isForeignKeyViolation(err) {
+            return ErrProductNotFound
+        }
+        return err
+    })
+}
+
+func (repo *postgresCartRepository) RemoveItem(ctx context.Context, cartID, productID int, expiresAt time.Time) error {
+    return repo.change(ctx, cartID, expiresAt, func(tx *sql.Tx) error {
+        result, err := tx.ExecContext(ctx, "DELETE FROM cart_items WHERE cart_id = $1 AND product_id = $2", cartID, productID)
+        if err != nil {
+            return err
+        }
+        if n, err := result.RowsAffected(); err != nil {
+            return err
+        } else if n == 0 {
+            return ErrCartItemNotFound
+        }
+        return nil
+    })
+}
+
+// change runs fn in a transaction on the items of an unexpired cart, after marking the cart
+// changed and keeping it until expiresAt. The cart stays locked until the transaction ends,
+// so changes to one cart happen one at a time.
+func (repo *postgresCartRepository) change(ctx context.Context, cartID int, expiresAt time.Time, fn func(tx *sql.Tx) error) error {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.ExecContext(ctx, "UPDATE carts SET updated_at = now(), expires_at = $2 WHERE id = $1 AND expires_at > now()", cartID, expiresAt)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return ErrCartNotFound
+    }
+    if err := fn(tx); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (repo *postgresCartRepository) Delete(ctx context.Context, id int) error {
+    result, err := repo.db.ExecContext(ctx, "DELETE FROM carts WHERE id = $1 AND expires_at > now()", id)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return ErrCartNotFound
+    }
+    return nil
+}
+
+func (repo *postgresCartRepository) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+    result, err := repo.db.ExecContext(ctx, "DELETE FROM carts WHERE expires_at <= $1", now)
+    if err != nil {
+        return 0, err
+    }
+    n, err := result.RowsAffected()
+    return int(n), err
+}
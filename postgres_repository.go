@@ -0,0 +1,875 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// productColumns lists the columns selected for a Product, in the order productFields returns.
+// Queries using it must select from products without an alias, as the tags are looked up
+// by products.id.
+const productColumns = "id, name, category, price, currency, image_url, COALESCE(barcode, ''), COALESCE(sku, ''), attributes, created_at, updated_at, deleted_at, version, " +
+    "review_count, COALESCE(round(rating_total::numeric / NULLIF(review_count, 0), 2), 0), " +
+    "ARRAY(SELECT t.name FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.product_id = products.id ORDER BY t.name), " +
+    "COALESCE(vendor_id, 0), status, publish_at"
+
+// productFields returns pointers to the fields of product in the order of productColumns,
+// ready to be passed to Scan.
+func productFields(product *Product) []interface{} {
+    return []interface{}{&product.ID, &product.Name, &product.Category, &product.Price, &product.Currency, &product.ImageURL, &product.Barcode, &product.SKU, &product.Attributes, &product.CreatedAt, &product.UpdatedAt, &product.DeletedAt, &product.Version, &product.ReviewCount, &product.AverageRating, &product.Tags, &product.VendorID, &product.Status, &product.PublishAt}
+}
+
+// productFieldColumns are the columns of productColumns by the JSON name of the field each is
+// scanned into, so that a listing can select only the fields the client asked for.
+var productFieldColumns = []struct {
+    field  string
+    column string
+    dest   func(p *Product) interface{}
+}{
+    {"id", "id", func(p *Product) interface{} { return &p.ID }},
+    {"name", "name", func(p *Product) interface{} { return &p.Name }},
+    {"category", "category", func(p *Product) interface{} { return &p.Category }},
+    {"price", "price", func(p *Product) interface{} { return &p.Price }},
+    {"currency", "currency", func(p *Product) interface{} { return &p.Currency }},
+    {"image_url", "image_url", func(p *Product) interface{} { return &p.ImageURL }},
+    {"barcode", "COALESCE(barcode, '')", func(p *Product) interface{} { return &p.Barcode }},
+    {"sku", "COALESCE(sku, '')", func(p *Product) interface{} { return &p.SKU }},
+    {"attributes", "attributes", func(p *Product) interface{} { return &p.Attributes }},
+    {"created_at", "created_at", func(p *Product) interface{} { return &p.CreatedAt }},
+    {"updated_at", "updated_at", func(p *Product) interface{} { return &p.UpdatedAt }},
+    {"deleted_at", "deleted_at", func(p *Product) interface{} { return &p.DeletedAt }},
+    {"version", "version", func(p *Product) interface{} { return &p.Version }},
+    {"review_count", "review_count", func(p *Product) interface{} { return &p.ReviewCount }},
+    {"average_rating", "COALESCE(round(rating_total::numeric / NULLIF(review_count, 0), 2), 0)", func(p *Product) interface{} { return &p.AverageRating }},
+    {"tags", "ARRAY(SELECT t.name FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE pt.product_id = products.id ORDER BY t.name)", func(p *Product) interface{} { return &p.Tags }},
+    {"vendor_id", "COALESCE(vendor_id, 0)", func(p *Product) interface{} { return &p.VendorID }},
+    {"status", "status", func(p *Product) interface{} { return &p.Status }},
+    {"publish_at", "publish_at", func(p *Product) interface{} { return &p.PublishAt }},
+}
+
+// selectedProductColumns returns the columns holding the selected fields, and a function
+// returning the fields of a product to scan them into. Without a selection they are
+// productColumns and productFields.
+func selectedProductColumns(fields FieldSelection) (string, func(*Product) []interface{}) {
+    if fields == nil {
+        return productColumns, productFields
+    }
+    var columns []string
+    var dests []func(p *Product) interface{}
+    for _, c := range productFieldColumns {
+        if fields[c.field] {
+            columns = append(columns, c.column)
+            dests = append(dests, c.dest)
+        }
+    }
+    return strings.Join(columns, ", "), func(p *Product) []interface{} {
+        fields := make([]interface{}, len(dests))
+        for i, dest := range dests {
+            fields[i] = dest(p)
+        }
+        return fields
+    }
+}
+
+// postgresRepository is a ProductRepository backed by the products table. Writes go to db;
+// reads go through reads, which may send them to a replica.
+type postgresRepository struct {
+    db    *sql.DB
+    reads *ReadRouter
+}
+
+// newPostgresRepository returns a ProductRepository that writes to db and reads through
+// reads.
+func newPostgresRepository(db *sql.DB, reads *ReadRouter) *postgresRepository {
+    return &postgresRepository{db: db, reads: reads}
+}
+
+func (repo *postgresRepository) GetByID(ctx context.Context, id int) (Product, error) {
+    return repo.getOne(ctx, "SELECT "+productColumns+" FROM products WHERE id = $1 AND deleted_at IS NULL", id)
+}
+
+func (repo *postgresRepository) GetByIDWithDeleted(ctx context.Context, id int) (Product, error) {
+    return repo.getOne(ctx, "SELECT "+productColumns+" FROM products WHERE id = $1", id)
+}
+
+func (repo *postgresRepository) GetByIDs(ctx context.Context, ids []int) ([]Product, error) {
+    rows, err := repo.reads.PreparedQueryContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id", pq.Array(ids))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    products := []Product{}
+    for rows.Next() {
+        var product Product
+        if err := rows.Scan(productFields(&product)...); err != nil {
+            return nil, err
+        }
+        products = append(products, product)
+    }
+    return products, rows.Err()
+}
+
+func (repo *postgresRepository) GetByBarcode(ctx context.Context, code string) (Product, error) {
+    return repo.getOne(ctx, "SELECT "+productColumns+" FROM products WHERE barcode = $1 AND deleted_at IS NULL", code)
+}
+
+// getOne runs a query selecting productColumns and scans its single row.
+func (repo *postgresRepository) getOne(ctx context.Context, query string, args ...interface{}) (Product, error) {
+    var product Product
+    err := repo.reads.PreparedQueryRowScan(ctx, productFields(&product), query, args...)
+    if err == sql.ErrNoRows {
+        return product, ErrProductNotFound
+    }
+    return product, err
+}
+
+func (repo *postgresRepository) List(ctx context.Context, q ListQuery) (ProductList, error) {
+    var list ProductList
+    filters := filterQuery(q.Filter)
+
+    // The page is read under the deadline, so that a slow plan can't take longer than the
+    // budget either.
+    if !q.Deadline.IsZero() {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithDeadline(ctx, q.Deadline)
+        defer cancel()
+    }
+
+    // Count every product matching the filters, before the cursor narrows them to a page.
+    err := repo.countProducts(ctx, q.Deadline, filters, &list)
+    if err != nil {
+        return list, err
+    }
+
+    // Rows come back in a total order so a page can be continued from the last row it
+    // contains. One row more than the page size is fetched to find out whether there is
+    // a next page.
+    if q.After != nil {
+        filters.whereAfter(*q.After, q.Desc)
+    }
+    // A listing of some fields only selects their columns, and those the page needs: the
+    // ID and sort column for the cursor, the currency to convert prices from, the category
+    // to expand and what decides the effective price. Its queries vary too much to be worth
+    // preparing.
+    fields, queryRows := q.Fields, repo.reads.PreparedQueryContext
+    if fields != nil {
+        fields = FieldSelection{"id": true, q.Sort: true}
+        for field := range q.Fields {
+            fields[field] = true
+        }
+        if q.Currency != "" && (fields["price"] || q.Expand.Variants) {
+            fields["currency"] = true
+        }
+        if q.Expand.Category {
+            fields["category"] = true
+        }
+        if q.Fields["effective_price"] || q.Fields["promotion_id"] {
+            for _, field := range []string{"price", "currency", "category", "tags"} {
+                fields[field] = true
+            }
+        }
+        queryRows = repo.reads.QueryContext
+    }
+    columns, scanFields := selectedProductColumns(fields)
+    rows, err := queryRows(ctx, "SELECT "+columns+" FROM products"+filters.WhereClause()+
+        orderBy(q.Sort, q.Desc)+" LIMIT "+filters.Arg(q.Limit+1), filters.Args()...)
+    if err != nil {
+        return list, err
+    }
+    defer rows.Close()
+
+    // The slice starts with a bounded capacity so small pages don't pay for a large allocation.
+    // A page is cut short once it holds a product, so a listing past its deadline still makes
+    // progress as long as the first row arrives in time.
+    products := make(Products, 0, initialListCapacity(q.Limit))
+    for rows.Next() {
+        // A row beyond the page size means there is more to fetch.
+        if len(products) == q.Limit {
+            list.NextCursor = encodeCursor(q.Sort, products[len(products)-1])
+            break
+        }
+        // Stop early with a partial page rather than letting a pathological scan time out.
+        if !q.Deadline.IsZero() && len(products) > 0 && time.Now().After(q.Deadline) {
+            list.Partial = true
+            list.NextCursor = encodeCursor(q.Sort, products[len(products)-1])
+            break
+        }
+        var product Product
+        if err := rows.Scan(scanFields(&product)...); err != nil {
+            return list, err
+        }
+        products = append(products, product)
+    }
+    list.Products = products
+    if err := rows.Err(); err != nil {
+        if !errors.Is(err, context.DeadlineExceeded) || len(products) == 0 || time.Now().Before(q.Deadline) {
+            return list, err
+        }
+        // The deadline ended the scan between two rows.
+        list.Partial = true
+        list.NextCursor = encodeCursor(q.Sort, products[len(products)-1])
+    }
+    return list, nil
+}
+
+// countProducts sets the total of list to the number of products matching filters. With a
+// deadline, the count may take half the time left; if it runs out, the total is the
+// planner's estimate instead, and marked approximate.
+func (repo *postgresRepository) countProducts(ctx context.Context, deadline time.Time, filters *queryBuilder, list *ProductList) error {
+    countCtx := ctx
+    if !deadline.IsZero() {
+        var cancel context.CancelFunc
+        countCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/2)
+        defer cancel()
+    }
+    err := repo.reads.PreparedQueryRowScan(countCtx, []interface{}{&list.Total}, "SELECT COUNT(*) FROM products"+filters.WhereClause(), filters.Args()...)
+    if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+        return err
+    }
+
+    // EXPLAIN only plans the query, which takes no time however many rows it would find.
+    var plan []byte
+    err = repo.reads.QueryRowScan(ctx, []interface{}{&plan}, "EXPLAIN (FORMAT JSON) SELECT 1 FROM products"+filters.WhereClause(), filters.Args()...)
+    if err != nil {
+        return err
+    }
+    var explained []struct {
+        Plan struct {
+            Rows float64 `json:"Plan Rows"`
+        } `json:"Plan"`
+    }
+    if err := json.Unmarshal(plan, &explained); err != nil || len(explained) == 0 {
+        return fmt.Errorf("reading the estimated count from %q: %v", plan, err)
+    }
+    list.Total, list.TotalApproximate = int(explained[0].Plan.Rows), true
+    return nil
+}
+
+// skuIndex is the unique index on products.sku, told apart from the barcode index when a
+// write violates one of them. vendorForeignKey is likewise told apart from the category
+// foreign key.
+const (
+    skuIndex         = "products_sku_idx"
+    vendorForeignKey = "products_vendor_fkey"
+)
+
+// writeError translates constraint violations hit by a product write into the corresponding
+// repository errors.
+func writeError(err error) error {
+    var pqErr *pq.Error
+    if isUniqueViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == skuIndex {
+        return ErrSKUInUse
+    }
+    if isUniqueViolation(err) {
+        return ErrBarcodeInUse
+    }
+    if isForeignKeyViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == vendorForeignKey {
+        return ErrUnknownVendor
+    }
+    if isForeignKeyViolation(err) {
+        return ErrUnknownCategory
+    }
+    return err
+}
+
+// filterQuery turns a ProductFilter into WHERE conditions.
+func filterQuery(f ProductFilter) *queryBuilder {
+    b := &queryBuilder{}
+    if !f.IncludeDeleted {
+        b.Where("deleted_at IS NULL")
+    }
+    if f.AfterID > 0 {
+        b.Where("id > ?", f.AfterID)
+    }
+    if f.VendorID > 0 {
+        b.Where("vendor_id = ?", f.VendorID)
+    }
+    if f.Status != "" {
+        b.Where("status = ?", f.Status)
+    }
+    if f.PublishedOnly {
+        b.Where("status = ?", StatusPublished)
+    }
+    if len(f.Attributes) > 0 {
+        b.Where("attributes @> ?::jsonb", newAttributes(f.Attributes))
+    }
+    if len(f.Tags) > 0 {
+        tagged := "SELECT pt.product_id FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE t.name = ANY(?)"
+        if f.TagsMatchAll {
+            b.Where("id IN ("+tagged+" GROUP BY pt.product_id HAVING count(*) = ?)", pq.Array(f.Tags), len(f.Tags))
+        } else {
+            b.Where("id IN ("+tagged+")", pq.Array(f.Tags))
+        }
+    }
+    if f.Name != "" {
+        b.Where("name LIKE ?", "%"+f.Name+"%")
+    }
+    if len(f.Categories) == 1 {
+        b.Where("category = ?", f.Categories[0])
+    } else if len(f.Categories) > 1 {
+        // Several categories match any of them.
+        b.Where("category = ANY(?)", pq.Array(f.Categories))
+    }
+    if f.MinPrice != nil {
+        b.Where("price >= ?", *f.MinPrice)
+    }
+    if f.MaxPrice != nil {
+        b.Where("price <= ?", *f.MaxPrice)
+    }
+    return b
+}
+
+func (repo *postgresRepository) Each(ctx context.Context, f ProductFilter, fn func(Product) error) error {
+    filters := filterQuery(f)
+    rows, err := repo.reads.QueryContext(ctx, "SELECT "+productColumns+" FROM products"+filters.WhereClause()+" ORDER BY id", filters.Args()...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var product Product
+        if err := rows.Scan(productFields(&product)...); err != nil {
+            return err
+        }
+        if err := fn(product); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+func (repo *postgresRepository) Expand(ctx context.Context, products []Product, e Expansion) ([]ExpandedProduct, error) {
+    expanded := newExpandedProducts(products, e)
+    if len(products) == 0 {
+        return expanded, nil
+    }
+    ids := make([]int, len(products))
+    index := make(map[int]int, len(products))
+    var names []string
+    for i, product := range products {
+        ids[i], index[product.ID] = product.ID, i
+        if product.Category != "" {
+            names = append(names, product.Category)
+        }
+    }
+
+    if e.Images {
+        err := repo.eachRow(ctx, func(scan func(dest ...interface{}) error) error {
+            img, err := scanImage(scan)
+            if err != nil {
+                return err
+            }
+            i := index[img.ProductID]
+            expanded[i].Images = append(expanded[i].Images, img)
+            return nil
+        }, "SELECT "+imageColumns+" FROM product_images WHERE product_id = ANY($1) ORDER BY product_id, position, id", pq.Array(ids))
+        if err != nil {
+            return nil, err
+        }
+    }
+    if e.Variants {
+        err := repo.eachRow(ctx, func(scan func(dest ...interface{}) error) error {
+            v, err := scanVariant(scan)
+            if err != nil {
+                return err
+            }
+            i := index[v.ProductID]
+            expanded[i].Variants = append(expanded[i].Variants, v)
+            return nil
+        }, "SELECT "+variantColumns+" FROM product_variants WHERE product_id = ANY($1) ORDER BY product_id, id", pq.Array(ids))
+        if err != nil {
+            return nil, err
+        }
+    }
+    if e.Inventory {
+        err := repo.eachRow(ctx, func(scan func(dest ...interface{}) error) error {
+            var level StockLevel
+            if err := scan(&level.ProductID, &level.Quantity); err != nil {
+                return err
+            }
+            *expanded[index[level.ProductID]].Inventory = level
+            return nil
+        }, "SELECT id, stock FROM products WHERE id = ANY($1)", pq.Array(ids))
+        if err != nil {
+            return nil, err
+        }
+    }
+    if e.Category && len(names) > 0 {
+        categories := map[string]*Category{}
+        err := repo.eachRow(ctx, func(scan func(dest ...interface{}) error) error {
+            c := &Category{}
+            if err := scan(&c.ID, &c.Name, &c.ParentID, &c.CreatedAt); err != nil {
+                return err
+            }
+            categories[c.Name] = c
+            return nil
+        }, "SELECT id, name, parent_id, created_at FROM categories WHERE name = ANY($1)", pq.Array(names))
+        if err != nil {
+            return nil, err
+        }
+        for i := range expanded {
+            expanded[i].CategoryDetail = categories[expanded[i].Category]
+        }
+    }
+    return expanded, nil
+}
+
+// eachRow runs a read query and calls fn with the scan function of each row.
+func (repo *postgresRepository) eachRow(ctx context.Context, fn func(scan func(dest ...interface{}) error) error, query string, args ...interface{}) error {
+    rows, err := repo.reads.PreparedQueryContext(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        if err := fn(rows.Scan); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+func (repo *postgresRepository) Facets(ctx context.Context, f ProductFilter, priceInterval Money) (ProductFacets, error) {
+    facets := ProductFacets{Categories: []FacetCount{}, Tags: []FacetCount{}, Prices: []PriceBucket{}}
+    byCategory, byTag, byPrice := facetFilters(f)
+
+    filters := filterQuery(f)
+    if err := repo.reads.QueryRowScan(ctx, []interface{}{&facets.Total}, "SELECT COUNT(*) FROM products"+filters.WhereClause(), filters.Args()...); err != nil {
+        return facets, err
+    }
+
+    filters = filterQuery(byCategory)
+    err := repo.queryFacet(ctx, func(scan func(dest ...interface{}) error) error {
+        var c FacetCount
+        if err := scan(&c.Value, &c.Count); err != nil {
+            return err
+        }
+        facets.Categories = append(facets.Categories, c)
+        return nil
+    }, "SELECT category, COUNT(*) FROM products"+filters.WhereClause()+" GROUP BY category ORDER BY 2 DESC, 1", filters.Args()...)
+    if err != nil {
+        return facets, err
+    }
+
+    // Joining the tags in directly would make the filter's column names ambiguous.
+    filters = filterQuery(byTag)
+    err = repo.queryFacet(ctx, func(scan func(dest ...interface{}) error) error {
+        var c FacetCount
+        if err := scan(&c.Value, &c.Count); err != nil {
+            return err
+        }
+        facets.Tags = append(facets.Tags, c)
+        return nil
+    }, `SELECT t.name, COUNT(*) FROM product_tags pt JOIN tags t ON t.id = pt.tag_id
+        WHERE pt.product_id IN (SELECT id FROM products`+filters.WhereClause()+`)
+        GROUP BY t.name ORDER BY 2 DESC, 1`, filters.Args()...)
+    if err != nil {
+        return facets, err
+    }
+
+    filters = filterQuery(byPrice)
+    interval := filters.Arg(priceInterval)
+    err = repo.queryFacet(ctx, func(scan func(dest ...interface{}) error) error {
+        var b PriceBucket
+        if err := scan(&b.Min, &b.Count); err != nil {
+            return err
+        }
+        b.Max = b.Min + priceInterval
+        facets.Prices = append(facets.Prices, b)
+        return nil
+    }, "SELECT floor(price / "+interval+"::numeric) * "+interval+"::numeric AS bucket, COUNT(*) FROM products"+filters.WhereClause()+
+        " GROUP BY bucket ORDER BY bucket", filters.Args()...)
+    return facets, err
+}
+
+// queryFacet runs query and calls fn with the scanner of each row.
+func (repo *postgresRepository) queryFacet(ctx context.Context, fn func(scan func(dest ...interface{}) error) error, query string, args ...interface{}) error {
+    rows, err := repo.reads.QueryContext(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        if err := fn(rows.Scan); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+func (repo *postgresRepository) Search(ctx context.Context, terms []string, limit int) ([]SearchResult, error) {
+    // Terms are already reduced to letters and digits, so they can be joined into a
+    // tsquery without escaping.
+    tsquery := strings.Join(terms, " & ") + ":*"
+    rows, err := repo.reads.QueryContext(ctx, "SELECT "+productColumns+", ts_rank(search, q) AS rank FROM products, to_tsquery('simple', $1) q "+
+        "WHERE search @@ q AND deleted_at IS NULL AND status = 'published' ORDER BY rank DESC, id LIMIT $2", tsquery, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    results := []SearchResult{}
+    for rows.Next() {
+        var result SearchResult
+        if err := rows.Scan(append(productFields(&result.Product), &result.Rank)...); err != nil {
+            return nil, err
+        }
+        results = append(results, result)
+    }
+    return results, rows.Err()
+}
+
+func (repo *postgresRepository) FuzzySearch(ctx context.Context, text string, threshold float64, limit int) ([]SearchResult, error) {
+    var results []SearchResult
+    err := repo.reads.ReadTx(ctx, func(tx *sql.Tx) error {
+        // The % operator, which the trigram index serves, matches against the session's
+        // threshold, so set it for this transaction.
+        if _, err := tx.ExecContext(ctx, "SELECT set_config('pg_trgm.similarity_threshold', $1, true)", strconv.FormatFloat(threshold, 'f', -1, 64)); err != nil {
+            return err
+        }
+        rows, err := tx.QueryContext(ctx, "SELECT "+productColumns+", similarity(name, $1) AS similarity FROM products "+
+            "WHERE name % $1 AND deleted_at IS NULL AND status = 'published' ORDER BY similarity DESC, id LIMIT $2", text, limit)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+
+        results = []SearchResult{}
+        for rows.Next() {
+            var result SearchResult
+            if err := rows.Scan(append(productFields(&result.Product), &result.Similarity)...); err != nil {
+                return err
+            }
+            results = append(results, result)
+        }
+        return rows.Err()
+    })
+    return results, err
+}
+
+func (repo *postgresRepository) Create(ctx context.Context, product *Product) error {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    product.DeletedAt = nil
+    product.keepDerived(Product{})
+    defaultCurrency(product)
+    err = tx.QueryRowContext(ctx, "INSERT INTO products (name, category, price, currency, image_url, barcode, sku, attributes, vendor_id, status, publish_at) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, 0), $10, $11) RETURNING id, created_at, updated_at, version",
+        product.Name, product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.VendorID, product.Status, product.PublishAt).Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt, &product.Version)
+    if err != nil {
+        return writeError(err)
+    }
+    if err := recordAudit(ctx, tx, auditCreate, product.ID, nil, product); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (repo *postgresRepository) CreateBatch(ctx context.Context, products []Product) ([]error, error) {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    stmt, err := tx.PrepareContext(ctx, "INSERT INTO products (name, category, price, currency, image_url, barcode, sku, attributes, vendor_id, status, publish_at) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, 0), $10, $11) RETURNING id, created_at, updated_at, version")
+    if err != nil {
+        return nil, err
+    }
+    defer stmt.Close()
+
+    // Each insert runs under a savepoint so a duplicate barcode only discards that row
+    // instead of aborting the whole transaction.
+    itemErrs := make([]error, len(products))
+    for i := range products {
+        product := &products[i]
+        product.DeletedAt = nil
+        product.keepDerived(Product{})
+        defaultCurrency(product)
+        if _, err := tx.ExecContext(ctx, "SAVEPOINT bulk_item"); err != nil {
+            return nil, err
+        }
+        err := stmt.QueryRowContext(ctx, product.Name, product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.VendorID, product.Status, product.PublishAt).Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt, &product.Version)
+        if isUniqueViolation(err) || isForeignKeyViolation(err) {
+            itemErrs[i] = writeError(err)
+            _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT bulk_item")
+        } else if err == nil {
+            if err = recordAudit(ctx, tx, auditCreate, product.ID, nil, product); err == nil {
+                _, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT bulk_item")
+            }
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return itemErrs, tx.Commit()
+}
+
+func (repo *postgresRepository) Update(ctx context.Context, product *Product) (bool, error) {
+    // Compare and update inside a transaction, holding a row lock so the product can't
+    // change between reading it and writing it.
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    current, err := lockProduct(ctx, tx, "id = $1", product.ID)
+    if err != nil {
+        return false, err
+    }
+    if !versionMatches(product.Version, current.Version) {
+        return false, ErrVersionMismatch
+    }
+
+    // A replacement that names no currency keeps the current one.
+    if product.Currency == "" {
+        product.Currency = current.Currency
+    }
+
+    // Skip the write entirely when nothing would change.
+    product.CreatedAt, product.DeletedAt, product.Version = current.CreatedAt, nil, current.Version
+    product.keepDerived(current)
+    if *product == current {
+        return false, nil
+    }
+
+    err = tx.QueryRowContext(ctx, "UPDATE products SET name = $1, category = $2, price = $3, currency = $4, image_url = $5, barcode = NULLIF($6, ''), sku = NULLIF($7, ''), attributes = $8, version = version + 1 WHERE id = $9 RETURNING version, updated_at",
+        product.Name, product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.ID).Scan(&product.Version, &product.UpdatedAt)
+    if err != nil {
+        return false, writeError(err)
+    }
+    if err := recordAudit(ctx, tx, auditUpdate, product.ID, &current, product); err != nil {
+        return false, err
+    }
+    return true, tx.Commit()
+}
+
+func (repo *postgresRepository) Upsert(ctx context.Context, product *Product) (bool, error) {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    product.DeletedAt = nil
+    product.keepDerived(Product{})
+    current, err := lockProduct(ctx, tx, "name = $1 ORDER BY id LIMIT 1", product.Name)
+    created := err == ErrProductNotFound
+    if created {
+        defaultCurrency(product)
+        err = tx.QueryRowContext(ctx, "INSERT INTO products (name, category, price, currency, image_url, barcode, sku, attributes, vendor_id, status, publish_at) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, 0), $10, $11) RETURNING id, created_at, updated_at, version",
+            product.Name, product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.VendorID, product.Status, product.PublishAt).Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt, &product.Version)
+        if err == nil {
+            err = recordAudit(ctx, tx, auditCreate, product.ID, nil, product)
+        }
+    } else if err == nil {
+        product.ID, product.CreatedAt = current.ID, current.CreatedAt
+        product.keepDerived(current)
+        if product.Currency == "" {
+            product.Currency = current.Currency
+        }
+        err = tx.QueryRowContext(ctx, "UPDATE products SET category = $1, price = $2, currency = $3, image_url = $4, barcode = NULLIF($5, ''), sku = NULLIF($6, ''), attributes = $7, version = version + 1 WHERE id = $8 RETURNING version, updated_at",
+            product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.ID).Scan(&product.Version, &product.UpdatedAt)
+        if err == nil {
+            err = recordAudit(ctx, tx, auditUpdate, product.ID, &current, product)
+        }
+    }
+    if err != nil {
+        return false, writeError(err)
+    }
+    return created, tx.Commit()
+}
+
+func (repo *postgresRepository) UpsertBySKU(ctx context.Context, product *Product) (bool, bool, error) {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return false, false, err
+    }
+    defer tx.Rollback()
+
+    // Lock the current product, deleted or not, so the audit log records what it was and
+    // an unchanged product can be left alone.
+    var current Product
+    err = tx.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE sku = $1 FOR UPDATE", product.SKU).Scan(productFields(&current)...)
+    exists := err == nil
+    if err != nil && err != sql.ErrNoRows {
+        return false, false, err
+    }
+    if exists {
+        if product.Currency == "" {
+            product.Currency = current.Currency
+        }
+        product.ID, product.CreatedAt, product.DeletedAt, product.Version = current.ID, current.CreatedAt, nil, current.Version
+        product.keepDerived(current)
+        if *product == current {
+            return false, false, nil
+        }
+    } else {
+        defaultCurrency(product)
+        product.DeletedAt = nil
+        product.keepDerived(Product{})
+    }
+
+    // A product created with the same SKU since the select is updated rather than
+    // failing on the unique index.
+    var created bool
+    err = tx.QueryRowContext(ctx, `INSERT INTO products (name, category, price, currency, image_url, barcode, sku, attributes, vendor_id, status, publish_at) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, 0), $10, $11)
+        ON CONFLICT (tenant_id, sku) DO UPDATE SET name = EXCLUDED.name, category = EXCLUDED.category, price = EXCLUDED.price, currency = EXCLUDED.currency,
+            image_url = EXCLUDED.image_url, barcode = EXCLUDED.barcode, attributes = EXCLUDED.attributes, deleted_at = NULL, version = products.version + 1
+        RETURNING id, created_at, updated_at, version, xmax = 0`,
+        product.Name, product.Category, product.Price, product.Currency, product.ImageURL, product.Barcode, product.SKU, product.Attributes, product.VendorID, product.Status, product.PublishAt).Scan(&product.ID, &product.CreatedAt, &product.UpdatedAt, &product.Version, &created)
+    if err != nil {
+        return false, false, writeError(err)
+    }
+    action, before := auditUpdate, &current
+    switch {
+    case created:
+        action, before = auditCreate, nil
+    case !exists:
+        // The product was created by another request after the select.
+        before = nil
+    case current.DeletedAt != nil:
+        action = auditRestore
+    }
+    if err := recordAudit(ctx, tx, action, product.ID, before, product); err != nil {
+        return false, false, err
+    }
+    return created, true, tx.Commit()
+}
+
+func (repo *postgresRepository) Patch(ctx context.Context, id, version int, patch ProductPatch) (Product, error) {
+    // Build the SET clause from only the fields present in the patch.
+    b := &queryBuilder{}
+    var set []string
+    if patch.Name != nil {
+        set = append(set, "name = "+b.Arg(*patch.Name))
+    }
+    if patch.Category != nil {
+        set = append(set, "category = "+b.Arg(*patch.Category))
+    }
+    if patch.Price != nil {
+        set = append(set, "price = "+b.Arg(*patch.Price))
+    }
+    if patch.Currency != nil {
+        set = append(set, "currency = "+b.Arg(*patch.Currency))
+    }
+    if patch.ImageURL != nil {
+        set = append(set, "image_url = "+b.Arg(*patch.ImageURL))
+    }
+    if patch.Barcode != nil {
+        set = append(set, "barcode = NULLIF("+b.Arg(*patch.Barcode)+", '')")
+    }
+    if patch.SKU != nil {
+        set = append(set, "sku = NULLIF("+b.Arg(*patch.SKU)+", '')")
+    }
+    if patch.Attributes != nil {
+        set = append(set, "attributes = "+b.Arg(*patch.Attributes))
+    }
+
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return Product{}, err
+    }
+    defer tx.Rollback()
+
+    current, err := lockProduct(ctx, tx, "id = $1", id)
+    if err != nil {
+        return Product{}, err
+    }
+    if !versionMatches(version, current.Version) {
+        return Product{}, ErrVersionMismatch
+    }
+    if len(set) == 0 {
+        // The patch is empty, so there is nothing to write.
+        return current, nil
+    }
+    set = append(set, "version = version + 1")
+
+    var product Product
+    query := "UPDATE products SET " + strings.Join(set, ", ") + " WHERE id = " + b.Arg(id) + " RETURNING " + productColumns
+    if err := tx.QueryRowContext(ctx, query, b.Args()...).Scan(productFields(&product)...); err != nil {
+        return Product{}, writeError(err)
+    }
+    if err := recordAudit(ctx, tx, auditUpdate, id, &current, &product); err != nil {
+        return Product{}, err
+    }
+    return product, tx.Commit()
+}
+
+func (repo *postgresRepository) Delete(ctx context.Context, id, version int) error {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    before, err := lockProduct(ctx, tx, "id = $1", id)
+    if err != nil {
+        return err
+    }
+    if !versionMatches(version, before.Version) {
+        return ErrVersionMismatch
+    }
+
+    // Deleting only marks the product; Restore can bring it back.
+    var product Product
+    err = tx.QueryRowContext(ctx, "UPDATE products SET deleted_at = now(), version = version + 1 WHERE id = $1 RETURNING "+productColumns, id).Scan(productFields(&product)...)
+    if err != nil {
+        return err
+    }
+    if err := recordAudit(ctx, tx, auditDelete, id, &before, &product); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+func (repo *postgresRepository) Restore(ctx context.Context, id int) (Product, error) {
+    tx, err := repo.db.BeginTx(ctx, nil)
+    if err != nil {
+        return Product{}, err
+    }
+    defer tx.Rollback()
+
+    var before Product
+    err = tx.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", id).Scan(productFields(&before)...)
+    if err == sql.ErrNoRows {
+        return Product{}, ErrProductNotFound
+    } else if err != nil {
+        return Product{}, err
+    }
+    product := before
+    product.DeletedAt = nil
+    err = tx.QueryRowContext(ctx, "UPDATE products SET deleted_at = NULL, version = version + 1 WHERE id = $1 RETURNING version, updated_at", id).Scan(&product.Version, &product.UpdatedAt)
+    if err != nil {
+        return Product{}, writeError(err)
+    }
+    if err := recordAudit(ctx, tx, auditRestore, id, &before, &product); err != nil {
+        return Product{}, err
+    }
+    return product, tx.Commit()
+}
+
+// lockProduct selects the first live product matching condition and locks its row for the
+// rest of the transaction. It returns ErrProductNotFound if there is none.
+func lockProduct(ctx context.Context, tx *sql.Tx, condition string, args ...interface{}) (Product, error) {
+    var product Product
+    err := tx.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE deleted_at IS NULL AND "+condition+" FOR UPDATE", args...).Scan(productFields(&product)...)
+    if err == sql.ErrNoRows {
+        return product, ErrProductNotFound
+    }
+    return product, err
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+func TestFilterQuery(t *testing.T) {
+    minPrice, maxPrice := Money(1000), Money(5000)
+    const tagged = "SELECT pt.product_id FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE t.name = ANY"
+    tests := []struct {
+        name   string
+        filter ProductFilter
+        where  string
+        args   []interface{}
+    }{
+        {name: "none", where: " WHERE deleted_at IS NULL"},
+        {name: "including deleted", filter: ProductFilter{IncludeDeleted: true}, where: ""},
+        {name: "one category", filter: ProductFilter{Categories: []string{"home"}}, where: " WHERE deleted_at IS NULL AND category = $1", args: []interface{}{"home"}},
+        {name: "several categories", filter: ProductFilter{Categories: []string{"home", "office"}}, where: " WHERE deleted_at IS NULL AND category = ANY($1)",
+            args: []interface{}{pq.Array([]string{"home", "office"})}},
+        {name: "price range", filter: ProductFilter{MinPrice: &minPrice, MaxPrice: &maxPrice},
+            where: " WHERE deleted_at IS NULL AND price >= $1 AND price <= $2", args: []interface{}{minPrice, maxPrice}},
+        {name: "maximum price", filter: ProductFilter{MaxPrice: &maxPrice}, where: " WHERE deleted_at IS NULL AND price <= $1", args: []interface{}{maxPrice}},
+        {name: "search", filter: ProductFilter{Name: "lamp"}, where: " WHERE deleted_at IS NULL AND name LIKE $1", args: []interface{}{"%lamp%"}},
+        {name: "any tag", filter: ProductFilter{Tags: []string{"sale", "new"}},
+            where: " WHERE deleted_at IS NULL AND id IN (" + tagged + "($1))", args: []interface{}{pq.Array([]string{"sale", "new"})}},
+        {name: "all tags", filter: ProductFilter{Tags: []string{"sale", "new"}, TagsMatchAll: true},
+            where: " WHERE deleted_at IS NULL AND id IN (" + tagged + "($1) GROUP BY pt.product_id HAVING count(*) = $2)",
+            args:  []interface{}{pq.Array([]string{"sale", "new"}), 2}},
+        {name: "vendor", filter: ProductFilter{VendorID: 4}, where: " WHERE deleted_at IS NULL AND vendor_id = $1", args: []interface{}{4}},
+        {name: "published only", filter: ProductFilter{Status: StatusDraft, PublishedOnly: true},
+            where: " WHERE deleted_at IS NULL AND status = $1 AND status = $2", args: []interface{}{StatusDraft, StatusPublished}},
+        {name: "attributes", filter: ProductFilter{Attributes: map[string]string{"color": "red"}},
+            where: " WHERE deleted_at IS NULL AND attributes @> $1::jsonb", args: []interface{}{newAttributes(map[string]string{"color": "red"})}},
+        {
+            name: "everything",
+            filter: ProductFilter{AfterID: 9, VendorID: 4, Status: StatusPublished, Tags: []string{"sale"}, Name: "lamp",
+                Categories: []string{"home", "office"}, MinPrice: &minPrice, MaxPrice: &maxPrice},
+            where: " WHERE deleted_at IS NULL AND id > $1 AND vendor_id = $2 AND status = $3 AND id IN (" + tagged + "($4))" +
+                " AND name LIKE $5 AND category = ANY($6) AND price >= $7 AND price <= $8",
+            args: []interface{}{9, 4, StatusPublished, pq.Array([]string{"sale"}), "%lamp%", pq.Array([]string{"home", "office"}), minPrice, maxPrice},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := filterQuery(tt.filter)
+            if got := b.WhereClause(); got != tt.where {
+                t.Errorf("where = %q, want %q", got, tt.where)
+            }
+            if !reflect.DeepEqual(b.Args(), tt.args) {
+                t.Errorf("args = %#v, want %#v", b.Args(), tt.args)
+            }
+        })
+    }
+}
+
+// answerProducts answers the queries of a postgresRepository listing with a count of total
+// and n products.
+func answerProducts(total, n int) func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+    return func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        if strings.HasPrefix(query, "SELECT COUNT(*)") {
+            return []string{"count"}, [][]driver.Value{{int64(total)}}, nil
+        }
+        if !strings.HasPrefix(query, "SELECT "+productColumns) {
+            return nil, nil, nil
+        }
+        var columns []string
+        var rows [][]driver.Value
+        for i := 1; i <= n; i++ {
+            var row []driver.Value
+            columns, row = productRow(Product{ID: i, Name: "Product", Category: "home", Price: 100, Currency: "USD",
+                Status: StatusPublished, Version: 1, CreatedAt: time.Unix(int64(i), 0).UTC()})
+            rows = append(rows, row)
+        }
+        return columns, rows, nil
+    }
+}
+
+// TestPostgresRepositoryListPlaceholders checks the numbering of the placeholders of a
+// filtered page continuing after a cursor, whose conditions and limit follow the filters.
+func TestPostgresRepositoryListPlaceholders(t *testing.T) {
+    tests := []struct {
+        name  string
+        query ListQuery
+        count string
+        list  string
+        args  []driver.Value
+    }{
+        {
+            name:  "first page",
+            query: ListQuery{Filter: ProductFilter{Categories: []string{"home"}}, Sort: "id", Limit: 10},
+            count: " WHERE deleted_at IS NULL AND category = $1",
+            list:  " WHERE deleted_at IS NULL AND category = $1 ORDER BY id ASC LIMIT $2",
+            args:  []driver.Value{"home", int64(11)},
+        },
+        {
+            name:  "next page by name",
+            query: ListQuery{Filter: ProductFilter{Categories: []string{"home"}, Name: "lamp"}, Sort: "name", Limit: 10, After: &listCursor{Sort: "name", Value: "Lamp", ID: 12}},
+            count: " WHERE deleted_at IS NULL AND name LIKE $1 AND category = $2",
+            list:  " WHERE deleted_at IS NULL AND name LIKE $1 AND category = $2 AND (name, id) > ($3, $4) ORDER BY name ASC, id ASC LIMIT $5",
+            args:  []driver.Value{"%lamp%", "home", "Lamp", int64(12), int64(11)},
+        },
+        {
+            name:  "previous page by id",
+            query: ListQuery{Filter: ProductFilter{VendorID: 4}, Sort: "id", Desc: true, Limit: 5, After: &listCursor{Sort: "id", ID: 30}},
+            count: " WHERE deleted_at IS NULL AND vendor_id = $1",
+            list:  " WHERE deleted_at IS NULL AND vendor_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3",
+            args:  []driver.Value{int64(4), int64(30), int64(6)},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            var listQuery string
+            var listArgs []driver.Value
+            answer := answerProducts(0, 0)
+            stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                if strings.HasPrefix(query, "SELECT "+productColumns) {
+                    listQuery, listArgs = query, args
+                }
+                return answer(query, args)
+            }
+
+            repo := newPostgresRepository(DB, Reads)
+            if _, err := repo.List(context.Background(), tt.query); err != nil {
+                t.Fatalf("List: %v", err)
+            }
+            if !stubDB.ran("SELECT COUNT(*) FROM products" + tt.count) {
+                t.Errorf("count query not run; ran %q", stubDB.statements)
+            }
+            if want := "SELECT " + productColumns + " FROM products" + tt.list; listQuery != want {
+                t.Errorf("list query = %q, want %q", listQuery, want)
+            }
+            if !reflect.DeepEqual(listArgs, tt.args) {
+                t.Errorf("list args = %#v, want %#v", listArgs, tt.args)
+            }
+        })
+    }
+}
+
+func TestPostgresRepositoryListCapacity(t *testing.T) {
+    tests := []struct {
+        name     string
+        limit    int
+        rows     int
+        capacity int
+        next     bool
+    }{
+        {name: "small page", limit: 5, rows: 3, capacity: 5},
+        {name: "large page", limit: 100, rows: 3, capacity: 8},
+        {name: "next page", limit: 4, rows: 5, capacity: 4, next: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            AppConfig.ListMaxInitialCapacity = 8
+            stubDB.answer = answerProducts(50, tt.rows)
+
+            repo := newPostgresRepository(DB, Reads)
+            list, err := repo.List(context.Background(), ListQuery{Sort: "id", Limit: tt.limit})
+            if err != nil {
+                t.Fatalf("List: %v", err)
+            }
+            if want := min(tt.rows, tt.limit); len(list.Products) != want || list.Total != 50 {
+                t.Errorf("got %d of %d products, want %d of 50", len(list.Products), list.Total, want)
+            }
+            if cap(list.Products) != tt.capacity {
+                t.Errorf("capacity = %d, want %d", cap(list.Products), tt.capacity)
+            }
+            if (list.NextCursor != "") != tt.next {
+                t.Errorf("next cursor = %q, want one %v", list.NextCursor, tt.next)
+            }
+        })
+    }
+}
+
+// slowQuery returns a stub delay holding up the queries starting with prefix for d.
+func slowQuery(prefix string, d time.Duration) func(query string) time.Duration {
+    return func(query string) time.Duration {
+        if strings.HasPrefix(query, prefix) {
+            return d
+        }
+        return 0
+    }
+}
+
+func TestPostgresRepositoryListDeadline(t *testing.T) {
+    tests := []struct {
+        name        string
+        budget      time.Duration
+        delay       func(query string) time.Duration
+        rowDelay    func(query string) time.Duration
+        count       int
+        total       int
+        approximate bool
+        partial     bool
+        err         error
+    }{
+        {name: "no deadline", count: 5, total: 5},
+        {name: "deadline ahead", budget: time.Hour, count: 5, total: 5},
+        // A page holds every product that arrived in time, and at least one, so a listing
+        // past its deadline still makes progress.
+        {name: "slow rows", budget: 300 * time.Millisecond, rowDelay: slowQuery("SELECT "+productColumns, 200*time.Millisecond), count: 1, total: 5, partial: true},
+        // A count taking more than half the budget gives way to the planner's estimate.
+        {name: "slow count", budget: 200 * time.Millisecond, delay: slowQuery("SELECT COUNT(*)", time.Second), count: 5, total: 1234, approximate: true},
+        {name: "slow query", budget: 200 * time.Millisecond, delay: slowQuery("SELECT "+productColumns, time.Second), err: context.DeadlineExceeded},
+        {name: "deadline passed", budget: -time.Second, err: context.DeadlineExceeded},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            answer := answerProducts(5, 5)
+            stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                if strings.HasPrefix(query, "EXPLAIN (FORMAT JSON)") {
+                    return []string{"QUERY PLAN"}, [][]driver.Value{{[]byte(`[{"Plan": {"Node Type": "Seq Scan", "Plan Rows": 1234}}]`)}}, nil
+                }
+                return answer(query, args)
+            }
+            stubDB.delay, stubDB.rowDelay = tt.delay, tt.rowDelay
+
+            q := ListQuery{Sort: "id", Limit: 10}
+            if tt.budget != 0 {
+                q.Deadline = time.Now().Add(tt.budget)
+            }
+            repo := newPostgresRepository(DB, Reads)
+            list, err := repo.List(context.Background(), q)
+            if tt.err != nil {
+                if !errors.Is(err, tt.err) {
+                    t.Fatalf("List error = %v, want %v", err, tt.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("List: %v", err)
+            }
+            if len(list.Products) != tt.count || list.Partial != tt.partial {
+                t.Fatalf("got %d products, partial %v, want %d, partial %v", len(list.Products), list.Partial, tt.count, tt.partial)
+            }
+            if list.Total != tt.total || list.TotalApproximate != tt.approximate {
+                t.Errorf("total = %d, approximate %v, want %d, approximate %v", list.Total, list.TotalApproximate, tt.total, tt.approximate)
+            }
+            if !tt.partial {
+                return
+            }
+            last := list.Products[len(list.Products)-1]
+            if after, err := decodeCursor(list.NextCursor); err != nil || after.ID != last.ID {
+                t.Errorf("next cursor = %q (%+v, %v), want one after product %d", list.NextCursor, after, err, last.ID)
+            }
+        })
+    }
+}
+
+func TestGetProductsScanBudget(t *testing.T) {
+    setupHandlers(t)
+    Repo = newPostgresRepository(DB, Reads)
+    ProductCache = newMemoryCache(10)
+    AppConfig.ListScanBudget = 300 * time.Millisecond
+    stubDB.answer = answerProducts(5, 5)
+    stubDB.rowDelay = slowQuery("SELECT "+productColumns, 200*time.Millisecond)
+
+    w := httptest.NewRecorder()
+    getProducts(w, newTestRequest("GET", "/products", "", RoleViewer, nil))
+    if w.Code != http.StatusOK {
+        t.Fatalf("status = %d: %s", w.Code, w.Body)
+    }
+    var page ProductListView
+    if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+        t.Fatalf("decoding page: %v", err)
+    }
+    if !page.Partial || page.NextCursor == "" || len(page.Products) != 1 {
+        t.Errorf("got %d products, partial %v, next cursor %q, want a partial page of one to continue", len(page.Products), page.Partial, page.NextCursor)
+    }
+    // Only the list generation is cached; a partial page depends on how fast the database was.
+    if entries := len(ProductCache.(*memoryCache).entries); entries != 1 {
+        t.Errorf("cache holds %d entries, want only the list generation", entries)
+    }
+}
+
+func TestPostgresRepositoryUpdateUnchanged(t *testing.T) {
+    setupHandlers(t)
+    stubDB.answer = answerProducts(1, 1)
+    repo := newPostgresRepository(DB, Reads)
+    current, err := repo.GetByID(context.Background(), 1)
+    if err != nil {
+        t.Fatalf("GetByID: %v", err)
+    }
+
+    product := Product{ID: current.ID, Name: current.Name, Category: current.Category, Price: current.Price, Version: current.Version}
+    changed, err := repo.Update(context.Background(), &product)
+    if err != nil {
+        t.Fatalf("Update: %v", err)
+    }
+    if changed || product.Version != current.Version {
+        t.Errorf("changed = %v, version = %d, want unchanged version %d", changed, product.Version, current.Version)
+    }
+    if stubDB.ran("UPDATE products") || stubDB.ran("INSERT INTO audit_log") {
+        t.Errorf("statements = %q, want no write", stubDB.statements)
+    }
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// States of a scheduled price change.
+const (
+    scheduleStatusPending   = "pending"
+    scheduleStatusApplied   = "applied"
+    scheduleStatusCancelled = "cancelled"
+    scheduleStatusSkipped   = "skipped"
+)
+
+// schedulerPrincipal is who scheduled price changes are recorded as in the audit log.
+var schedulerPrincipal = Principal{Subject: "price-scheduler", Role: RoleEditor}
+
+// PricePoint is a price a product had from ChangedAt until the next point.
+type PricePoint struct {
+    Price     Money     `json:"price"`
+    ChangedAt time.Time `json:"changed_at"`
+}
+
+// ScheduledPrice is a price change that takes effect at EffectiveFrom. Status is pending
+// until the scheduler gets to it, then applied, or skipped if the product was deleted by then.
+type ScheduledPrice struct {
+    ID            int        `json:"id"`
+    ProductID     int        `json:"product_id"`
+    Price         Money      `json:"price"`
+    EffectiveFrom time.Time  `json:"effective_from"`
+    Status        string     `json:"status"`
+    CreatedAt     time.Time  `json:"created_at"`
+    AppliedAt     *time.Time `json:"applied_at,omitempty"`
+}
+
+// PriceHistory is the response body of getPrices.
+type PriceHistory struct {
+    ProductID int              `json:"product_id"`
+    History   []PricePoint     `json:"history"`
+    Scheduled []ScheduledPrice `json:"scheduled"`
+}
+
+// scheduledPriceColumns are the columns scanned by scanScheduledPrice, in order.
+const scheduledPriceColumns = "id, product_id, price, effective_from, status, created_at, applied_at"
+
+// scanScheduledPrice reads the scheduledPriceColumns of one row through scan.
+func scanScheduledPrice(scan func(dest ...interface{}) error) (ScheduledPrice, error) {
+    var s ScheduledPrice
+    err := scan(&s.ID, &s.ProductID, &s.Price, &s.EffectiveFrom, &s.Status, &s.CreatedAt, &s.AppliedAt)
+    return s, err
+}
+
+// getPrices returns the price history of a live product, oldest first, together with its
+// scheduled price changes.
+func getPrices(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve prices.") {
+        return
+    }
+
+    prices := PriceHistory{ProductID: productID, History: []PricePoint{}, Scheduled: []ScheduledPrice{}}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var p PricePoint
+        if err := scan(&p.Price, &p.ChangedAt); err != nil {
+            return err
+        }
+        prices.History = append(prices.History, p)
+        return nil
+    }, "SELECT price, changed_at FROM price_history WHERE product_id = $1 ORDER BY changed_at, id", productID)
+    if err == nil {
+        err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+            s, err := scanScheduledPrice(scan)
+            if err != nil {
+                return err
+            }
+            prices.Scheduled = append(prices.Scheduled, s)
+            return nil
+        }, "SELECT "+scheduledPriceColumns+" FROM scheduled_prices WHERE product_id = $1 ORDER BY effective_from, id", productID)
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve prices.")
+        return
+    }
+
+    // If everything went well, return the prices in the response body.
+    respond(w, r, http.StatusOK, prices)
+}
+
+// queryRows runs query and calls fn with the scan function of each row. The query of a
+// read-only request may be answered by the replica, so it must only read.
+func queryRows(ctx context.Context, fn func(scan func(dest ...interface{}) error) error, query string, args ...interface{}) error {
+    rows, err := Reads.QueryContext(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        if err := fn(rows.Scan); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
+
+// schedulePrice schedules a price change of a live product from a JSON body like
+// {"price": 9.99, "effective_from": "2030-01-01T00:00:00Z"}. The scheduler applies it once
+// effective_from has passed.
+func schedulePrice(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    var scheduled ScheduledPrice
+    if err := decodeJSON(r, &scheduled); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    validatePrice(&errs, scheduled.Price)
+    if !scheduled.EffectiveFrom.After(time.Now()) {
+        errs.add("effective_from", "must be in the future")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to schedule price.") {
+        return
+    }
+
+    // The insert selects nothing, and so returns no row, if the product isn't live.
+    scheduled, err = scanScheduledPrice(DB.QueryRowContext(r.Context(), `INSERT INTO scheduled_prices (product_id, price, effective_from)
+        SELECT id, $2, $3 FROM products WHERE id = $1 AND deleted_at IS NULL
+        RETURNING `+scheduledPriceColumns, productID, scheduled.Price, scheduled.EffectiveFrom).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to schedule price.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the scheduled change.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d/prices", productID))
+    respond(w, r, http.StatusCreated, scheduled)
+}
+
+// cancelScheduledPrice cancels a scheduled price change that has not been applied yet.
+func cancelScheduledPrice(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    scheduleID, err := strconv.Atoi(mux.Vars(r)["schedule_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid schedule ID.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to cancel scheduled price.") {
+        return
+    }
+    var status string
+    err = DB.QueryRowContext(r.Context(), `UPDATE scheduled_prices SET status = CASE WHEN status = $3 THEN $4 ELSE status END
+        WHERE id = $1 AND product_id = $2 RETURNING status`, scheduleID, productID, scheduleStatusPending, scheduleStatusCancelled).Scan(&status)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeScheduledPriceNotFound, "Scheduled price not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to cancel scheduled price.")
+        return
+    }
+    if status != scheduleStatusCancelled {
+        respondError(w, r, http.StatusConflict, codeScheduledPriceNotPending, "Scheduled price has already been "+status+".")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// applyScheduledPrices applies every pending price change whose time has come, oldest
+// first. The changes go through the repository, so they bump the product's version, show up
+// in the audit log and price history, and clear the cached product. It runs as the
+// price-scheduler job.
+func applyScheduledPrices(ctx context.Context) error {
+    // The scheduler works across tenants, so note whose each change is.
+    var due []ScheduledPrice
+    var tenantIDs []int
+    rows, err := DB.QueryContext(ctx, "SELECT tenant_id, "+scheduledPriceColumns+" FROM scheduled_prices WHERE status = $1 AND effective_from <= now() ORDER BY effective_from, id",
+        scheduleStatusPending)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var tenantID int
+        s, err := scanScheduledPrice(func(dest ...interface{}) error {
+            return rows.Scan(append([]interface{}{&tenantID}, dest...)...)
+        })
+        if err != nil {
+            rows.Close()
+            return err
+        }
+        due, tenantIDs = append(due, s), append(tenantIDs, tenantID)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    ctx = context.WithValue(ctx, principalContextKey, schedulerPrincipal)
+    for i, s := range due {
+        ctx := withTenant(ctx, Tenant{ID: tenantIDs[i]})
+        status := scheduleStatusApplied
+        _, err := Repo.Patch(ctx, s.ProductID, 0, ProductPatch{Price: &s.Price})
+        if err == ErrProductNotFound {
+            status = scheduleStatusSkipped
+        } else if err != nil {
+            return err
+        }
+        if _, err := DB.ExecContext(ctx, "UPDATE scheduled_prices SET status = $2, applied_at = now() WHERE id = $1", s.ID, status); err != nil {
+            return err
+        }
+        if status == scheduleStatusApplied {
+            if err := invalidateProduct(ctx, s.ProductID); err != nil {
+                logContextError(ctx, err)
+            }
+            slog.Info("applied scheduled price", "product_id", s.ProductID, "price", s.Price, "schedule_id", s.ID)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestPriceHandlers(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    missing := map[string]string{"id": "99"}
+    invalid := map[string]string{"id": "abc", "schedule_id": "2"}
+    schedule := map[string]string{"id": "1", "schedule_id": "2"}
+    scheduled := `{"price": 9.99, "effective_from": "2099-01-01T00:00:00Z"}`
+    tests := []handlerTest{
+        {name: "history", handler: getPrices, target: "/products/1/prices", vars: product, answer: answerRows(map[string][]driver.Value{"FROM price_history": {"19.99", time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "history invalid id", handler: getPrices, target: "/products/abc/prices", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "history missing product", handler: getPrices, target: "/products/99/prices", vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "schedule", handler: schedulePrice, method: "POST", target: "/products/1/prices/scheduled", body: scheduled, vars: product,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO scheduled_prices": {int64(2), int64(1), "9.99", time.Unix(4070908800, 0), scheduleStatusPending, time.Unix(0, 0), nil}}),
+            status: http.StatusCreated},
+        {name: "schedule invalid id", handler: schedulePrice, method: "POST", target: "/products/abc/prices/scheduled", body: scheduled, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "schedule malformed", handler: schedulePrice, method: "POST", target: "/products/1/prices/scheduled", body: `{"price": 9.99, "effective_from": "soon"}`, vars: product, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "schedule in the past", handler: schedulePrice, method: "POST", target: "/products/1/prices/scheduled", body: `{"price": 9.99, "effective_from": "2001-01-01T00:00:00Z"}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "schedule negative price", handler: schedulePrice, method: "POST", target: "/products/1/prices/scheduled", body: `{"price": -1, "effective_from": "2099-01-01T00:00:00Z"}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "schedule missing product", handler: schedulePrice, method: "POST", target: "/products/99/prices/scheduled", body: scheduled, vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "cancel", handler: cancelScheduledPrice, method: "DELETE", target: "/products/1/prices/scheduled/2", vars: schedule,
+            answer: answerRows(map[string][]driver.Value{"UPDATE scheduled_prices": {scheduleStatusCancelled}}), status: http.StatusNoContent},
+        {name: "cancel invalid product id", handler: cancelScheduledPrice, method: "DELETE", target: "/products/abc/prices/scheduled/2", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "cancel invalid schedule id", handler: cancelScheduledPrice, method: "DELETE", target: "/products/1/prices/scheduled/x", vars: map[string]string{"id": "1", "schedule_id": "x"},
+            status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "cancel missing", handler: cancelScheduledPrice, method: "DELETE", target: "/products/1/prices/scheduled/2", vars: schedule, status: http.StatusNotFound, code: codeScheduledPriceNotFound},
+        {name: "cancel applied", handler: cancelScheduledPrice, method: "DELETE", target: "/products/1/prices/scheduled/2", vars: schedule,
+            answer: answerRows(map[string][]driver.Value{"UPDATE scheduled_prices": {scheduleStatusApplied}}), status: http.StatusConflict, code: codeScheduledPriceNotPending},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "history", handler: getPrices, target: "/products/1/prices", vars: product},
+        handlerTest{name: "schedule", handler: schedulePrice, method: "POST", target: "/products/1/prices/scheduled", body: scheduled, vars: product},
+        handlerTest{name: "cancel", handler: cancelScheduledPrice, method: "DELETE", target: "/products/1/prices/scheduled/2", vars: schedule},
+    ))
+}
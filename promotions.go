@@ -0,0 +1,354 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// Types of discount.
+const (
+    discountPercentage = "percentage"
+    discountFixed      = "fixed"
+)
+
+// Discount is what a promotion or coupon takes off: Value percent of the price for a
+// percentage discount, or Value converted from Currency for a fixed one, without going
+// below zero.
+type Discount struct {
+    Type     string `json:"type" xml:"type"`
+    Value    Money  `json:"value" xml:"value"`
+    Currency string `json:"currency,omitempty" xml:"currency,omitempty"`
+}
+
+// validate checks the fields of a discount payload.
+func (d Discount) validate(errs *ValidationErrors) {
+    switch d.Type {
+    case discountPercentage:
+        if d.Value <= 0 || d.Value > 100*100 {
+            errs.add("value", "must be between 0 and 100 for a percentage")
+        }
+        if d.Currency != "" {
+            errs.add("currency", "must be empty for a percentage")
+        }
+    case discountFixed:
+        if d.Value <= 0 || d.Value > maxPrice {
+            errs.add("value", "must be between 0 and 1000000000")
+        }
+        validateCurrency(errs, d.Currency)
+    default:
+        errs.add("type", "must be percentage or fixed")
+    }
+}
+
+// normalize upper-cases the currency and defaults that of a fixed discount to the base
+// currency.
+func (d *Discount) normalize() {
+    d.Currency = strings.ToUpper(strings.TrimSpace(d.Currency))
+    if d.Type == discountFixed && d.Currency == "" {
+        d.Currency = AppConfig.BaseCurrency
+    }
+}
+
+// off returns how much the discount takes off amount, which is in currency. It returns
+// errUnsupportedCurrency if a fixed discount can't be converted.
+func (d Discount) off(ctx context.Context, amount Money, currency string) (Money, error) {
+    off := amount.Mul(d.Value.Float64() / 100)
+    if d.Type == discountFixed {
+        off = d.Value
+        if d.Currency != currency {
+            rate, err := Rates.Rate(ctx, d.Currency, currency)
+            if err != nil {
+                return 0, err
+            }
+            off = off.Mul(rate)
+        }
+    }
+    if off > amount {
+        return amount, nil
+    }
+    return off, nil
+}
+
+// Foreign keys of the promotions table, told apart when a write names a category or tag
+// that doesn't exist.
+const (
+    promotionCategoryForeignKey = "promotions_category_fkey"
+    promotionTagForeignKey      = "promotions_tag_fkey"
+)
+
+// Promotion discounts products while it runs, from StartsAt until EndsAt; either may be
+// left open. It applies to the products of Category and with Tag, where set, and to every
+// product if neither is.
+type Promotion struct {
+    ID   int    `json:"id" xml:"id"`
+    Name string `json:"name" xml:"name"`
+    Discount
+    Category  string     `json:"category,omitempty" xml:"category,omitempty"`
+    Tag       string     `json:"tag,omitempty" xml:"tag,omitempty"`
+    StartsAt  *time.Time `json:"starts_at,omitempty" xml:"starts_at,omitempty"`
+    EndsAt    *time.Time `json:"ends_at,omitempty" xml:"ends_at,omitempty"`
+    CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+    UpdatedAt time.Time  `json:"updated_at" xml:"updated_at"`
+}
+
+// Validate checks the fields of a promotion payload.
+func (p Promotion) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if p.Name == "" {
+        errs.add("name", "is required")
+    } else if len(p.Name) > 255 {
+        errs.add("name", "must be at most 255 characters")
+    }
+    p.Discount.validate(&errs)
+    if p.Tag != "" && !validTagName(p.Tag) {
+        errs.add("tag", "must be lowercase words joined by hyphens")
+    }
+    if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+        errs.add("ends_at", "must be after starts_at")
+    }
+    return errs
+}
+
+// appliesTo reports whether the promotion discounts product.
+func (p Promotion) appliesTo(product Product) bool {
+    return (p.Category == "" || p.Category == product.Category) && (p.Tag == "" || product.Tags.Has(p.Tag))
+}
+
+// promotionColumns are the columns scanned by scanPromotion, in order.
+const promotionColumns = "id, name, type, value, COALESCE(currency, ''), COALESCE(category, ''), COALESCE(tag, ''), starts_at, ends_at, created_at, updated_at"
+
+// scanPromotion reads the promotionColumns of one row through scan.
+func scanPromotion(scan func(dest ...interface{}) error) (Promotion, error) {
+    var p Promotion
+    err := scan(&p.ID, &p.Name, &p.Type, &p.Value, &p.Currency, &p.Category, &p.Tag, &p.StartsAt, &p.EndsAt, &p.CreatedAt, &p.UpdatedAt)
+    return p, err
+}
+
+// queryPromotions returns the promotions that match the WHERE conditions in where, by ID.
+func queryPromotions(ctx context.Context, where string, args ...interface{}) ([]Promotion, error) {
+    promotions := []Promotion{}
+    err := queryRows(ctx, func(scan func(dest ...interface{}) error) error {
+        promotion, err := scanPromotion(scan)
+        if err != nil {
+            return err
+        }
+        promotions = append(promotions, promotion)
+        return nil
+    }, "SELECT "+promotionColumns+" FROM promotions WHERE "+where+" ORDER BY id", args...)
+    return promotions, err
+}
+
+// applyPromotions sets the effective price of the products a running promotion discounts,
+// at the prices they have, which may have been converted already. Where several apply, a
+// product gets the lowest price; a fixed discount that can't be converted to the product's
+// currency is left out.
+func applyPromotions(ctx context.Context, products []Product) error {
+    if len(products) == 0 {
+        return nil
+    }
+    promotions, err := queryPromotions(ctx, "(starts_at IS NULL OR starts_at <= now()) AND (ends_at IS NULL OR ends_at > now())")
+    if err != nil || len(promotions) == 0 {
+        return err
+    }
+    for i := range products {
+        product := &products[i]
+        product.EffectivePrice, product.PromotionID = nil, 0
+        for _, promotion := range promotions {
+            if !promotion.appliesTo(*product) {
+                continue
+            }
+            off, err := promotion.off(ctx, product.Price, product.Currency)
+            if err == errUnsupportedCurrency {
+                continue
+            } else if err != nil {
+                return err
+            }
+            price := product.Price - off
+            if product.EffectivePrice == nil || price < *product.EffectivePrice {
+                product.EffectivePrice, product.PromotionID = &price, promotion.ID
+            }
+        }
+    }
+    return nil
+}
+
+// promotionIDFromRequest returns the promotion ID from the {id} path variable.
+func promotionIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// getPromotions lists the promotions by ID, or with ?active=true only the running ones.
+func getPromotions(w http.ResponseWriter, r *http.Request) {
+    where := "true"
+    switch r.URL.Query().Get("active") {
+    case "", "false":
+    case "true":
+        where = "(starts_at IS NULL OR starts_at <= now()) AND (ends_at IS NULL OR ends_at > now())"
+    default:
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid active; expected true or false.")
+        return
+    }
+
+    promotions, err := queryPromotions(r.Context(), where)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve promotions.")
+        return
+    }
+    if respondEmptyList(w, r, len(promotions)) {
+        return
+    }
+
+    // If everything went well, return the promotions in the response body.
+    respond(w, r, http.StatusOK, promotions)
+}
+
+// getPromotion retrieves a single promotion.
+func getPromotion(w http.ResponseWriter, r *http.Request) {
+    promotionID, err := promotionIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid promotion ID.")
+        return
+    }
+
+    promotion, err := scanPromotion(Reads.ScanRow(r.Context(), "SELECT "+promotionColumns+" FROM promotions WHERE id = $1", promotionID))
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codePromotionNotFound, "Promotion not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve promotion.")
+        return
+    }
+
+    // If everything went well, return the promotion in the response body.
+    respond(w, r, http.StatusOK, promotion)
+}
+
+// decodePromotion reads and validates a promotion payload. The currency of a fixed
+// promotion defaults to the base currency. If the payload isn't valid it writes the error
+// response and reports false.
+func decodePromotion(w http.ResponseWriter, r *http.Request, promotion *Promotion) bool {
+    if err := decodeBody(r, promotion); err != nil {
+        respondBodyError(w, r, err)
+        return false
+    }
+    promotion.Name = strings.TrimSpace(promotion.Name)
+    promotion.normalize()
+    if errs := promotion.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return false
+    }
+    return true
+}
+
+// respondPromotionWriteError answers a failed promotion write. It reports whether err was
+// nil, in which case nothing was written.
+func respondPromotionWriteError(w http.ResponseWriter, r *http.Request, err error, message string) bool {
+    var pqErr *pq.Error
+    switch {
+    case err == nil:
+        return true
+    case err == sql.ErrNoRows:
+        respondError(w, r, http.StatusNotFound, codePromotionNotFound, "Promotion not found.")
+    case isForeignKeyViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == promotionTagForeignKey:
+        respondValidationErrors(w, r, ValidationErrors{{Field: "tag", Message: "does not exist"}})
+    case isForeignKeyViolation(err):
+        respondValidationErrors(w, r, unknownCategoryErrors)
+    default:
+        respondStoreError(w, r, err, message)
+    }
+    return false
+}
+
+// createPromotion creates a promotion from a body like {"name": "Summer sale", "type":
+// "percentage", "value": 20, "category": "Shoes", "ends_at": "2026-09-01T00:00:00Z"}.
+func createPromotion(w http.ResponseWriter, r *http.Request) {
+    var promotion Promotion
+    if !decodePromotion(w, r, &promotion) {
+        return
+    }
+
+    err := DB.QueryRowContext(r.Context(), `INSERT INTO promotions (name, type, value, currency, category, tag, starts_at, ends_at)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, $8) RETURNING id, created_at, updated_at`,
+        promotion.Name, promotion.Type, promotion.Value, promotion.Currency, promotion.Category, promotion.Tag, promotion.StartsAt, promotion.EndsAt).Scan(
+        &promotion.ID, &promotion.CreatedAt, &promotion.UpdatedAt)
+    if !respondPromotionWriteError(w, r, err, "Failed to create promotion.") {
+        return
+    }
+
+    // Cached listings show the prices from before the promotion.
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 201 Created response with the new promotion.
+    w.Header().Set("Location", "/promotions/"+strconv.Itoa(promotion.ID))
+    respond(w, r, http.StatusCreated, promotion)
+}
+
+// updatePromotion replaces a promotion.
+func updatePromotion(w http.ResponseWriter, r *http.Request) {
+    promotionID, err := promotionIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid promotion ID.")
+        return
+    }
+    var promotion Promotion
+    if !decodePromotion(w, r, &promotion) {
+        return
+    }
+    promotion.ID = promotionID
+
+    err = DB.QueryRowContext(r.Context(), `UPDATE promotions SET name = $2, type = $3, value = $4, currency = NULLIF($5, ''), category = NULLIF($6, ''),
+        tag = NULLIF($7, ''), starts_at = $8, ends_at = $9, updated_at = now() WHERE id = $1 RETURNING created_at, updated_at`,
+        promotionID, promotion.Name, promotion.Type, promotion.Value, promotion.Currency, promotion.Category, promotion.Tag, promotion.StartsAt, promotion.EndsAt).Scan(
+        &promotion.CreatedAt, &promotion.UpdatedAt)
+    if !respondPromotionWriteError(w, r, err, "Failed to update promotion.") {
+        return
+    }
+
+    // Cached listings show the prices from before the change.
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the updated promotion in the response body.
+    respond(w, r, http.StatusOK, promotion)
+}
+
+// deletePromotion deletes a promotion, ending it at once.
+func deletePromotion(w http.ResponseWriter, r *http.Request) {
+    promotionID, err := promotionIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid promotion ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM promotions WHERE id = $1", promotionID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete promotion.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete promotion.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codePromotionNotFound, "Promotion not found.")
+        return
+    }
+
+    // Cached listings show the prices from before the promotion ended.
+    if err := invalidateProductLists(r.Context()); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+func TestPromotionHandlers(t *testing.T) {
+    promotion := map[string]string{"id": "1"}
+    invalid := map[string]string{"id": "abc"}
+    sale := []driver.Value{int64(1), "Summer sale", discountPercentage, "20", "", "home", "", nil, nil, time.Unix(0, 0), time.Unix(0, 0)}
+    found := answerRows(map[string][]driver.Value{"FROM promotions": sale})
+    body := `{"name": "Summer sale", "type": "percentage", "value": 20, "category": "home"}`
+    tests := []handlerTest{
+        {name: "list", handler: getPromotions, target: "/promotions", answer: found, status: http.StatusOK},
+        {name: "list active", handler: getPromotions, target: "/promotions?active=true", answer: found, status: http.StatusOK},
+        {name: "list invalid active", handler: getPromotions, target: "/promotions?active=yes", status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "get", handler: getPromotion, target: "/promotions/1", vars: promotion, answer: found, status: http.StatusOK},
+        {name: "get invalid id", handler: getPromotion, target: "/promotions/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getPromotion, target: "/promotions/1", vars: promotion, status: http.StatusNotFound, code: codePromotionNotFound},
+        {name: "create", handler: createPromotion, method: "POST", target: "/promotions", body: body,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO promotions": {int64(1), time.Unix(0, 0), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createPromotion, method: "POST", target: "/promotions", body: `{"name": "Summer sale", "value": "20%"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create without name", handler: createPromotion, method: "POST", target: "/promotions", body: `{"type": "percentage", "value": 20}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create invalid type", handler: createPromotion, method: "POST", target: "/promotions", body: `{"name": "Summer sale", "type": "bogo", "value": 20}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create ending before it starts", handler: createPromotion, method: "POST", target: "/promotions",
+            body:   `{"name": "Summer sale", "type": "percentage", "value": 20, "starts_at": "2026-09-01T00:00:00Z", "ends_at": "2026-06-01T00:00:00Z"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create unknown category", handler: createPromotion, method: "POST", target: "/promotions", body: body,
+            answer: failQueries(&pq.Error{Code: "23503", Constraint: promotionCategoryForeignKey}), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create unknown tag", handler: createPromotion, method: "POST", target: "/promotions", body: `{"name": "Summer sale", "type": "percentage", "value": 20, "tag": "summer"}`,
+            answer: failQueries(&pq.Error{Code: "23503", Constraint: promotionTagForeignKey}), status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update", handler: updatePromotion, method: "PUT", target: "/promotions/1", body: body, vars: promotion,
+            answer: answerRows(map[string][]driver.Value{"UPDATE promotions": {time.Unix(0, 0), time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "update invalid id", handler: updatePromotion, method: "PUT", target: "/promotions/abc", body: body, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update invalid discount", handler: updatePromotion, method: "PUT", target: "/promotions/1", body: `{"name": "Summer sale", "type": "fixed", "value": -5}`, vars: promotion,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", handler: updatePromotion, method: "PUT", target: "/promotions/1", body: body, vars: promotion, status: http.StatusNotFound, code: codePromotionNotFound},
+        {name: "delete", handler: deletePromotion, method: "DELETE", target: "/promotions/1", vars: promotion,
+            answer: answerRows(map[string][]driver.Value{"DELETE FROM promotions": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deletePromotion, method: "DELETE", target: "/promotions/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deletePromotion, method: "DELETE", target: "/promotions/1", vars: promotion, status: http.StatusNotFound, code: codePromotionNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getPromotions, target: "/promotions"},
+        handlerTest{name: "get", handler: getPromotion, target: "/promotions/1", vars: promotion},
+        handlerTest{name: "create", handler: createPromotion, method: "POST", target: "/promotions", body: body},
+        handlerTest{name: "update", handler: updatePromotion, method: "PUT", target: "/promotions/1", body: body, vars: promotion},
+        handlerTest{name: "delete", handler: deletePromotion, method: "DELETE", target: "/promotions/1", vars: promotion},
+    ))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "strconv"
+    "time"
+
+    "github.com/nats-io/nats.go"
+    "github.com/segmentio/kafka-go"
+)
+
+// newEventPublisher returns the publisher for the broker selected by cfg, or nil if none is.
+func newEventPublisher(cfg Config) (EventPublisher, error) {
+    switch cfg.EventBroker {
+    case "kafka":
+        return newKafkaPublisher(cfg.KafkaBrokers, cfg.KafkaTopic), nil
+    case "nats":
+        publisher, err := newNATSPublisher(cfg.NATSURL, cfg.NATSSubjectPrefix)
+        if err != nil {
+            return nil, err
+        }
+        return publisher, nil
+    }
+    return nil, nil
+}
+
+// kafkaPublisher publishes events to a Kafka topic. Messages are keyed by product ID, so
+// every event of a product lands on the same partition and is consumed in order. Events
+// made by a request carry its correlation ID in the correlation header.
+type kafkaPublisher struct {
+    writer *kafka.Writer
+}
+
+// newKafkaPublisher returns a publisher writing to topic on the given brokers. Connections
+// are made on the first publish, so a broker that is down doesn't stop the service.
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+    return &kafkaPublisher{writer: &kafka.Writer{
+        Addr:         kafka.TCP(brokers...),
+        Topic:        topic,
+        Balancer:     &kafka.Hash{},
+        RequiredAcks: kafka.RequireAll,
+        // Publish batches right away rather than waiting for more messages to arrive.
+        BatchTimeout: 10 * time.Millisecond,
+    }}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, events []Event) error {
+    messages := make([]kafka.Message, len(events))
+    for i, event := range events {
+        value, err := json.Marshal(event)
+        if err != nil {
+            return err
+        }
+        messages[i] = kafka.Message{
+            Key:   []byte(strconv.Itoa(event.ProductID)),
+            Value: value,
+            Headers: []kafka.Header{
+                {Key: "event-id", Value: []byte(event.ID)},
+                {Key: "event-type", Value: []byte(event.Type)},
+            },
+        }
+        if event.CorrelationID != "" {
+            messages[i].Headers = append(messages[i].Headers, kafka.Header{Key: AppConfig.CorrelationIDHeader, Value: []byte(event.CorrelationID)})
+        }
+    }
+    return p.writer.WriteMessages(ctx, messages...)
+}
+
+func (p *kafkaPublisher) Close() error {
+    return p.writer.Close()
+}
+
+// natsPublisher publishes events to NATS, on subjectPrefix followed by the event type, like
+// "catalog.product.created". Each message carries the event ID as Nats-Msg-Id, so a
+// JetStream stream capturing the subjects drops events that are published twice. Events
+// made by a request carry its correlation ID in the correlation header.
+type natsPublisher struct {
+    conn          *nats.Conn
+    subjectPrefix string
+}
+
+// newNATSPublisher connects to the NATS server at url. The client keeps reconnecting in
+// the background if the connection drops.
+func newNATSPublisher(url, subjectPrefix string) (*natsPublisher, error) {
+    conn, err := nats.Connect(url, nats.Name("product-api"), nats.MaxReconnects(-1), nats.RetryOnFailedConnect(true))
+    if err != nil {
+        return nil, fmt.Errorf("connecting to NATS: %w", err)
+    }
+    return &natsPublisher{conn: conn, subjectPrefix: subjectPrefix}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, events []Event) error {
+    for _, event := range events {
+        data, err := json.Marshal(event)
+        if err != nil {
+            return err
+        }
+        msg := nats.NewMsg(p.subjectPrefix + "." + event.Type)
+        msg.Data = data
+        msg.Header.Set(nats.MsgIdHdr, event.ID)
+        if event.CorrelationID != "" {
+            msg.Header.Set(AppConfig.CorrelationIDHeader, event.CorrelationID)
+        }
+        if err := p.conn.PublishMsg(msg); err != nil {
+            return err
+        }
+    }
+    // Publishing only buffers the messages; a flush round-trip confirms the server has them.
+    return p.conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) Close() error {
+    return p.conn.Drain()
+}
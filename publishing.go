@@ -0,0 +1,188 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "time"
+)
+
+// ProductStatus is where a product is in its life on the storefront.
+type ProductStatus string
+
+const (
+    // StatusDraft products are being prepared and aren't shown on the storefront yet.
+    StatusDraft ProductStatus = "draft"
+    // StatusPublished products are on the storefront.
+    StatusPublished ProductStatus = "published"
+    // StatusArchived products have been taken off the storefront but are kept for reference.
+    StatusArchived ProductStatus = "archived"
+)
+
+// Valid reports whether s is one of the known statuses.
+func (s ProductStatus) Valid() bool {
+    return s == StatusDraft || s == StatusPublished || s == StatusArchived
+}
+
+// publisherPrincipal is who scheduled publications are recorded as in the audit log.
+var publisherPrincipal = Principal{Subject: "publisher", Role: RoleEditor}
+
+// validatePublication checks a product's status and the time it is to be published at. An
+// empty status is allowed, as new products default to published.
+func validatePublication(errs *ValidationErrors, status ProductStatus, publishAt *time.Time) {
+    if status != "" && !status.Valid() {
+        errs.add("status", "must be one of draft, published or archived")
+    }
+    if publishAt != nil && status != StatusDraft {
+        errs.add("publish_at", "can only be set on a draft")
+    }
+}
+
+// includeUnpublished reports whether the principal of ctx gets to see drafts and archived
+// products. Anonymous storefront readers and viewers only see published ones; editors and
+// admins, who manage the catalog, see everything.
+func includeUnpublished(ctx context.Context) bool {
+    principal, ok := principalFromContext(ctx)
+    return ok && principal.Role.Includes(RoleEditor)
+}
+
+// publicationPolicy hides unpublished products from readers who don't get to see them, as
+// if they didn't exist. Anything else is up to the policy it wraps.
+type publicationPolicy struct {
+    Policy
+}
+
+func (p publicationPolicy) Authorize(ctx context.Context, principal Principal, action Action, product Product) error {
+    if action == ActionRead && product.Status != StatusPublished && !principal.Role.Includes(RoleEditor) {
+        return ErrProductNotFound
+    }
+    return p.Policy.Authorize(ctx, principal, action, product)
+}
+
+// ProductStatusRequest is the body of a request changing the status of a product.
+type ProductStatusRequest struct {
+    Status    ProductStatus `json:"status" xml:"status"`
+    PublishAt *time.Time    `json:"publish_at" xml:"publish_at"`
+}
+
+// setProductStatus publishes, archives or unpublishes a product from a body like
+// {"status": "published"}. A draft can be scheduled with {"status": "draft", "publish_at":
+// "2030-01-01T00:00:00Z"}, and is then published by the publisher once that time comes.
+func setProductStatus(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    var req ProductStatusRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    if req.Status == "" {
+        errs.add("status", "is required")
+    }
+    validatePublication(&errs, req.Status, req.PublishAt)
+    if req.PublishAt != nil && !req.PublishAt.After(time.Now()) {
+        errs.add("publish_at", "must be in the future")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to update status.") {
+        return
+    }
+
+    product, err := changeProductStatus(r.Context(), req.Status, req.PublishAt, "id = $1", productID)
+    if err == ErrProductNotFound {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to update status.")
+        return
+    }
+
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the product with its new status.
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusOK, product)
+}
+
+// changeProductStatus gives the live product matching cond, as passed to lockProduct, status
+// and publishAt and returns the product. The change is versioned and audited like any other
+// change to the product; nothing is written if an unscheduled product keeps its status.
+func changeProductStatus(ctx context.Context, status ProductStatus, publishAt *time.Time, cond string, args ...interface{}) (Product, error) {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return Product{}, err
+    }
+    defer tx.Rollback()
+
+    current, err := lockProduct(ctx, tx, cond, args...)
+    if err != nil || current.Status == status && current.PublishAt == nil && publishAt == nil {
+        return current, err
+    }
+
+    var product Product
+    err = tx.QueryRowContext(ctx, "UPDATE products SET status = $2, publish_at = $3, version = version + 1 WHERE id = $1 RETURNING "+productColumns,
+        current.ID, status, publishAt).Scan(productFields(&product)...)
+    if err != nil {
+        return Product{}, err
+    }
+    if err := recordAudit(ctx, tx, auditUpdate, current.ID, &current, &product); err != nil {
+        return Product{}, err
+    }
+    return product, tx.Commit()
+}
+
+// publishScheduledProducts publishes every live draft whose publish_at has passed, oldest
+// first. Each is published like an editor would, so it gets a new version, shows up in the
+// audit log and clears the cached product. It runs as the publisher job.
+func publishScheduledProducts(ctx context.Context) error {
+    // The publisher works across tenants, so note whose each draft is.
+    type dueProduct struct {
+        tenantID, productID int
+    }
+    var due []dueProduct
+    rows, err := DB.QueryContext(ctx, "SELECT tenant_id, id FROM products WHERE status = $1 AND publish_at <= now() AND deleted_at IS NULL ORDER BY publish_at, id",
+        StatusDraft)
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var d dueProduct
+        if err := rows.Scan(&d.tenantID, &d.productID); err != nil {
+            rows.Close()
+            return err
+        }
+        due = append(due, d)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    ctx = context.WithValue(ctx, principalContextKey, publisherPrincipal)
+    for _, d := range due {
+        ctx := withTenant(ctx, Tenant{ID: d.tenantID})
+        // The draft is only published if it is still due, as an editor may have changed or
+        // deleted it since the select.
+        _, err := changeProductStatus(ctx, StatusPublished, nil, "id = $1 AND status = $2 AND publish_at <= now()", d.productID, StatusDraft)
+        if err == ErrProductNotFound {
+            continue
+        } else if err != nil {
+            return err
+        }
+        if err := invalidateProduct(ctx, d.productID); err != nil {
+            logContextError(ctx, err)
+        }
+        slog.Info("published scheduled product", "product_id", d.productID)
+    }
+    return nil
+}
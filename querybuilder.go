@@ -0,0 +1,233 @@
+package main
+
+import (
+    "errors"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// queryBuilder collects the conditions of a WHERE clause together with their arguments,
+// numbering Postgres placeholders ($1, $2, ...) in the order arguments are added. This keeps
+// bindings correct no matter which combination of conditions a request uses.
+type queryBuilder struct {
+    conditions []string
+    args       []interface{}
+}
+
+// Arg adds an argument and returns the placeholder that refers to it.
+func (b *queryBuilder) Arg(value interface{}) string {
+    b.args = append(b.args, value)
+    return "$" + strconv.Itoa(len(b.args))
+}
+
+// Where adds a condition. Each "?" in condition is replaced by the placeholder of the
+// corresponding argument.
+func (b *queryBuilder) Where(condition string, args ...interface{}) {
+    var sb strings.Builder
+    for _, arg := range args {
+        i := strings.IndexByte(condition, '?')
+        if i < 0 {
+            break
+        }
+        sb.WriteString(condition[:i])
+        sb.WriteString(b.Arg(arg))
+        condition = condition[i+1:]
+    }
+    sb.WriteString(condition)
+    b.conditions = append(b.conditions, sb.String())
+}
+
+// WhereClause returns the collected conditions joined with AND, prefixed with " WHERE ",
+// or an empty string when there are none.
+func (b *queryBuilder) WhereClause() string {
+    if len(b.conditions) == 0 {
+        return ""
+    }
+    return " WHERE " + strings.Join(b.conditions, " AND ")
+}
+
+// Args returns the arguments for the placeholders handed out so far.
+func (b *queryBuilder) Args() []interface{} {
+    return b.args
+}
+
+// listParams are the parameters of a product listing as the gRPC and GraphQL APIs take
+// them. They are turned back into a query string so that every API goes through
+// parseListQuery and accepts exactly the same listings.
+type listParams struct {
+    Name       string
+    Categories []string
+    MinPrice   *float64
+    MaxPrice   *float64
+    Sort       string
+    Desc       bool
+    Limit      int
+    Cursor     string
+}
+
+// values returns the query string equivalent to p.
+func (p listParams) values() url.Values {
+    values := url.Values{}
+    if p.Name != "" {
+        values.Set("name", p.Name)
+    }
+    values["category"] = p.Categories
+    if p.MinPrice != nil {
+        values.Set("min_price", strconv.FormatFloat(*p.MinPrice, 'f', -1, 64))
+    }
+    if p.MaxPrice != nil {
+        values.Set("max_price", strconv.FormatFloat(*p.MaxPrice, 'f', -1, 64))
+    }
+    values.Set("sort", p.Sort)
+    if p.Desc {
+        values.Set("order", "desc")
+    }
+    if p.Limit != 0 {
+        values.Set("limit", strconv.Itoa(p.Limit))
+    }
+    values.Set("cursor", p.Cursor)
+    return values
+}
+
+// parseProductFilters reads the filter query parameters of a product listing. The returned
+// error message is suitable for a 400 Bad Request response.
+func parseProductFilters(values url.Values) (ProductFilter, error) {
+    var f ProductFilter
+    for key, vals := range values {
+        if !validQueryText(key) {
+            return f, errors.New("Invalid query parameter.")
+        }
+        for _, val := range vals {
+            if !validQueryText(val) {
+                return f, errors.New("Invalid value for " + key + "; must be UTF-8 text.")
+            }
+        }
+    }
+    f.Name = values.Get("name")
+
+    f.Status = ProductStatus(values.Get("status"))
+    if f.Status != "" && !f.Status.Valid() {
+        return f, errors.New("Invalid status; must be draft, published or archived.")
+    }
+
+    // Repeated category parameters match any of the given categories.
+    for _, category := range values["category"] {
+        if category != "" {
+            f.Categories = append(f.Categories, category)
+        }
+    }
+
+    if minPriceStr := values.Get("min_price"); minPriceStr != "" {
+        minPrice, err := ParseMoney(minPriceStr)
+        if err != nil {
+            return f, errors.New("Invalid minimum price.")
+        }
+        f.MinPrice = &minPrice
+    }
+    if maxPriceStr := values.Get("max_price"); maxPriceStr != "" {
+        maxPrice, err := ParseMoney(maxPriceStr)
+        if err != nil {
+            return f, errors.New("Invalid maximum price.")
+        }
+        f.MaxPrice = &maxPrice
+    }
+
+    // Each attr.<name> parameter requires that attribute value.
+    for key, vals := range values {
+        if !strings.HasPrefix(key, attrFilterPrefix) {
+            continue
+        }
+        name := strings.TrimPrefix(key, attrFilterPrefix)
+        if name == "" {
+            return f, errors.New("Invalid attribute filter.")
+        }
+        if f.Attributes == nil {
+            f.Attributes = map[string]string{}
+        }
+        f.Attributes[name] = vals[0]
+    }
+
+    // tags=sale,clearance matches products with any of the tags, or with all of them for
+    // tag_mode=all.
+    seen := map[string]bool{}
+    for _, tag := range strings.Split(values.Get("tags"), ",") {
+        tag = strings.ToLower(strings.TrimSpace(tag))
+        if tag != "" && !seen[tag] {
+            seen[tag] = true
+            f.Tags = append(f.Tags, tag)
+        }
+    }
+    sort.Strings(f.Tags)
+    switch values.Get("tag_mode") {
+    case "", tagsMatchAny:
+    case tagsMatchAll:
+        f.TagsMatchAll = true
+    default:
+        return f, errors.New("Invalid tag mode; must be any or all.")
+    }
+    return f, nil
+}
+
+// validQueryText reports whether s is text Postgres can take as a parameter: valid UTF-8
+// without NUL characters, which it rejects with an error rather than matching nothing.
+func validQueryText(s string) bool {
+    return utf8.ValidString(s) && !strings.ContainsRune(s, 0)
+}
+
+// sortColumns whitelists the columns a product listing can be sorted by.
+var sortColumns = map[string]bool{
+    "id":         true,
+    "name":       true,
+    "price":      true,
+    "category":   true,
+    "created_at": true,
+}
+
+// parseProductSort reads the sort and order query parameters, defaulting to ascending ID.
+// The returned error message is suitable for a 400 Bad Request response.
+func parseProductSort(values url.Values) (column string, desc bool, err error) {
+    column = values.Get("sort")
+    if column == "" {
+        column = "id"
+    }
+    if !sortColumns[column] {
+        return "", false, errors.New("Invalid sort column.")
+    }
+    switch strings.ToLower(values.Get("order")) {
+    case "", "asc":
+    case "desc":
+        desc = true
+    default:
+        return "", false, errors.New("Invalid sort order.")
+    }
+    return column, desc, nil
+}
+
+// orderBy returns the ORDER BY clause for a sort column. ID breaks ties so that the order is
+// total, which keyset pagination relies on.
+func orderBy(column string, desc bool) string {
+    direction := " ASC"
+    if desc {
+        direction = " DESC"
+    }
+    if column == "id" {
+        return " ORDER BY id" + direction
+    }
+    return " ORDER BY " + column + direction + ", id" + direction
+}
+
+// whereAfter adds the keyset condition that continues a listing after the cursor's row.
+func (b *queryBuilder) whereAfter(c listCursor, desc bool) {
+    op := ">"
+    if desc {
+        op = "<"
+    }
+    if c.Sort == "id" {
+        b.Where("id "+op+" ?", c.ID)
+        return
+    }
+    b.Where("("+c.Sort+", id) "+op+" (?, ?)", c.Value, c.ID)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "net/url"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+)
+
+func FuzzParseProductFilters(f *testing.F) {
+    f.Add("")
+    f.Add("name=lamp&category=home&category=office")
+    f.Add("min_price=10&max_price=99.99")
+    f.Add("min_price=-1&max_price=1e9")
+    f.Add("status=published&tags=Sale,%20clearance,sale&tag_mode=all")
+    f.Add("tag_mode=some")
+    f.Add("attr.color=red&attr.=blue")
+    f.Add("name=%00")
+    f.Add("category=%ff%fe")
+    f.Add("%c3%28=1")
+
+    f.Fuzz(func(t *testing.T, query string) {
+        values, err := url.ParseQuery(query)
+        if err != nil {
+            return
+        }
+        filter, err := parseProductFilters(values)
+        if err != nil {
+            return
+        }
+
+        // Everything the filter holds goes to Postgres as a parameter.
+        texts := append([]string{filter.Name}, filter.Categories...)
+        texts = append(texts, filter.Tags...)
+        for name, value := range filter.Attributes {
+            texts = append(texts, name, value)
+        }
+        for _, text := range texts {
+            if !validQueryText(text) {
+                t.Fatalf("parseProductFilters(%q) let %q through", query, text)
+            }
+        }
+        if filter.Status != "" && !filter.Status.Valid() {
+            t.Fatalf("parseProductFilters(%q) accepted status %q", query, filter.Status)
+        }
+        for _, price := range []*Money{filter.MinPrice, filter.MaxPrice} {
+            if price == nil {
+                continue
+            }
+            if again, err := ParseMoney(price.String()); err != nil || again != *price {
+                t.Fatalf("price %v doesn't round-trip: %v, %v", *price, again, err)
+            }
+        }
+        if !sort.StringsAreSorted(filter.Tags) {
+            t.Fatalf("tags %q aren't sorted", filter.Tags)
+        }
+        for i, tag := range filter.Tags {
+            if tag == "" || tag != strings.ToLower(strings.TrimSpace(tag)) || i > 0 && filter.Tags[i-1] == tag {
+                t.Fatalf("tags %q aren't normalized", filter.Tags)
+            }
+        }
+    })
+}
+
+func TestParseProductFiltersCategories(t *testing.T) {
+    tests := []struct {
+        query string
+        want  []string
+    }{
+        {query: "", want: nil},
+        {query: "category=home", want: []string{"home"}},
+        {query: "category=home&category=office", want: []string{"home", "office"}},
+        // Empty categories are left out rather than matching products without one.
+        {query: "category=&category=office&category=", want: []string{"office"}},
+    }
+    for _, tt := range tests {
+        values, _ := url.ParseQuery(tt.query)
+        filter, err := parseProductFilters(values)
+        if err != nil {
+            t.Fatalf("parseProductFilters(%q): %v", tt.query, err)
+        }
+        if strings.Join(filter.Categories, ",") != strings.Join(tt.want, ",") || len(filter.Categories) != len(tt.want) {
+            t.Errorf("parseProductFilters(%q) categories = %q, want %q", tt.query, filter.Categories, tt.want)
+        }
+    }
+}
+
+func TestQueryBuilder(t *testing.T) {
+    tests := []struct {
+        name  string
+        build func(b *queryBuilder)
+        where string
+        args  []interface{}
+    }{
+        {name: "no conditions", build: func(b *queryBuilder) {}, where: ""},
+        {name: "one condition", build: func(b *queryBuilder) { b.Where("id = ?", 7) }, where: " WHERE id = $1", args: []interface{}{7}},
+        {name: "no arguments", build: func(b *queryBuilder) { b.Where("deleted_at IS NULL") }, where: " WHERE deleted_at IS NULL"},
+        {
+            name: "many conditions",
+            build: func(b *queryBuilder) {
+                b.Where("deleted_at IS NULL")
+                b.Where("price BETWEEN ? AND ?", 100, 200)
+                b.Where("name LIKE ?", "%lamp%")
+            },
+            where: " WHERE deleted_at IS NULL AND price BETWEEN $1 AND $2 AND name LIKE $3",
+            args:  []interface{}{100, 200, "%lamp%"},
+        },
+        {
+            // Placeholders handed out by Arg and Where share one numbering.
+            name: "mixed with Arg",
+            build: func(b *queryBuilder) {
+                b.Where("vendor_id = ?", 3)
+                if got := b.Arg("home"); got != "$2" {
+                    t.Errorf("Arg = %q, want $2", got)
+                }
+                b.Where("status = ?", StatusPublished)
+            },
+            where: " WHERE vendor_id = $1 AND status = $3",
+            args:  []interface{}{3, "home", StatusPublished},
+        },
+        {
+            // A condition with fewer arguments than "?" keeps the rest as they are.
+            name:  "missing argument",
+            build: func(b *queryBuilder) { b.Where("a = ? AND b = ?", 1) },
+            where: " WHERE a = $1 AND b = ?",
+            args:  []interface{}{1},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &queryBuilder{}
+            tt.build(b)
+            if got := b.WhereClause(); got != tt.where {
+                t.Errorf("where = %q, want %q", got, tt.where)
+            }
+            if !reflect.DeepEqual(b.Args(), tt.args) {
+                t.Errorf("args = %#v, want %#v", b.Args(), tt.args)
+            }
+        })
+    }
+}
+
+func TestWhereAfter(t *testing.T) {
+    tests := []struct {
+        name   string
+        cursor listCursor
+        desc   bool
+        where  string
+        args   []interface{}
+    }{
+        {name: "id ascending", cursor: listCursor{Sort: "id", ID: 12}, where: " WHERE deleted_at IS NULL AND id > $1", args: []interface{}{12}},
+        {name: "id descending", cursor: listCursor{Sort: "id", ID: 12}, desc: true, where: " WHERE deleted_at IS NULL AND id < $1", args: []interface{}{12}},
+        {name: "name ascending", cursor: listCursor{Sort: "name", Value: "Lamp", ID: 12},
+            where: " WHERE deleted_at IS NULL AND (name, id) > ($1, $2)", args: []interface{}{"Lamp", 12}},
+        {name: "price descending", cursor: listCursor{Sort: "price", Value: "19.99", ID: 12}, desc: true,
+            where: " WHERE deleted_at IS NULL AND (price, id) < ($1, $2)", args: []interface{}{"19.99", 12}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            b := &queryBuilder{}
+            b.Where("deleted_at IS NULL")
+            b.whereAfter(tt.cursor, tt.desc)
+            if got := b.WhereClause(); got != tt.where {
+                t.Errorf("where = %q, want %q", got, tt.where)
+            }
+            if !reflect.DeepEqual(b.Args(), tt.args) {
+                t.Errorf("args = %#v, want %#v", b.Args(), tt.args)
+            }
+        })
+    }
+}
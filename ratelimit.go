@@ -0,0 +1,239 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// RateLimitResult is the outcome of taking a token from a client's bucket.
+type RateLimitResult struct {
+    Allowed bool
+    // Limit is the bucket size and Remaining the whole tokens left in it.
+    Limit     int
+    Remaining int
+    // RetryAfter is how long until the next token is available, and Reset how long until the
+    // bucket is full again.
+    RetryAfter time.Duration
+    Reset      time.Duration
+}
+
+// RateLimiter hands out requests to clients from token buckets that hold RateLimitBurst
+// tokens and refill at RateLimitRPS. It is implemented in memory for single-instance
+// deployments and in Redis for horizontally scaled ones.
+type RateLimiter interface {
+    // Allow takes a token from the bucket of the client identified by key.
+    Allow(ctx context.Context, key string) (RateLimitResult, error)
+}
+
+// newRateLimiter builds the rate limiter selected by the configuration. The Redis backend
+// uses client.
+func newRateLimiter(cfg Config, client *redis.Client) (RateLimiter, error) {
+    if cfg.RateLimitRPS <= 0 {
+        return nil, nil
+    }
+    switch cfg.RateLimitBackend {
+    case "", "memory":
+        return newMemoryRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst), nil
+    case "redis":
+        return &redisRateLimiter{client: client, rate: cfg.RateLimitRPS, burst: cfg.RateLimitBurst}, nil
+    default:
+        return nil, errors.New("unknown rate limit backend " + strconv.Quote(cfg.RateLimitBackend))
+    }
+}
+
+// rateLimitMiddleware rejects requests from clients that have used up their bucket with
+// 429 Too Many Requests, and tells every client where it stands in X-RateLimit-* headers.
+// Health checks are never limited.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limiter := currentConfig().RateLimit
+        if limiter == nil || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        result, err := limiter.Allow(r.Context(), rateLimitKey(r))
+        if err != nil {
+            // A broken limiter should not take the API down with it, so let the request through.
+            logError(r, err)
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+        w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+        w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+        if !result.Allowed {
+            w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+            respondError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many requests.")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// rateLimitKey identifies the client a request is counted against: its API key or bearer
+// token when it sends one, and otherwise its IP address. Credentials are hashed so they are
+// never stored in the limiter.
+func rateLimitKey(r *http.Request) string {
+    credential := r.Header.Get("X-API-Key")
+    if credential == "" {
+        credential, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    }
+    if credential != "" {
+        sum := sha256.Sum256([]byte(credential))
+        return "ratelimit:credential:" + hex.EncodeToString(sum[:])
+    }
+    return "ratelimit:ip:" + clientIP(r)
+}
+
+// clientIP returns the address of the client that sent r. The first X-Forwarded-For entry is
+// only believed when the service is configured to run behind a trusted proxy.
+func clientIP(r *http.Request) string {
+    if AppConfig.TrustForwardedFor {
+        if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+            first, _, _ := strings.Cut(forwarded, ",")
+            return strings.TrimSpace(first)
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// ceilSeconds rounds d up to whole seconds, as the Retry-After and X-RateLimit-Reset headers
+// expect.
+func ceilSeconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
+}
+
+// bucketResult describes a bucket holding tokens after a request was allowed or not.
+func bucketResult(allowed bool, tokens, rate float64, burst int) RateLimitResult {
+    result := RateLimitResult{
+        Allowed:   allowed,
+        Limit:     burst,
+        Remaining: int(tokens),
+        Reset:     time.Duration((float64(burst) - tokens) / rate * float64(time.Second)),
+    }
+    if !allowed {
+        result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+    }
+    return result
+}
+
+// tokenBucket is the state of one client's bucket in a memoryRateLimiter.
+type tokenBucket struct {
+    tokens  float64
+    updated time.Time
+}
+
+// memoryRateLimiter is an in-process RateLimiter.
+type memoryRateLimiter struct {
+    rate  float64
+    burst int
+
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+// newMemoryRateLimiter returns a limiter with every bucket full.
+func newMemoryRateLimiter(rate float64, burst int) *memoryRateLimiter {
+    return &memoryRateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (l *memoryRateLimiter) Allow(ctx context.Context, key string) (RateLimitResult, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    l.sweep(now)
+    bucket, ok := l.buckets[key]
+    if !ok {
+        bucket = &tokenBucket{tokens: float64(l.burst), updated: now}
+        l.buckets[key] = bucket
+    }
+    bucket.tokens = math.Min(float64(l.burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+    bucket.updated = now
+
+    allowed := bucket.tokens >= 1
+    if allowed {
+        bucket.tokens--
+    }
+    return bucketResult(allowed, bucket.tokens, l.rate, l.burst), nil
+}
+
+// sweep forgets the buckets that have refilled completely, since a new bucket would be in
+// the same state. It runs at most once a minute so it stays cheap.
+func (l *memoryRateLimiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < time.Minute {
+        return
+    }
+    l.lastSweep = now
+    for key, bucket := range l.buckets {
+        if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= float64(l.burst) {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// tokenBucketScript takes a token from the bucket stored in the hash at KEYS[1], refilling
+// it at ARGV[1] tokens per second up to ARGV[2]. It uses the Redis clock so every instance
+// agrees on the time, and lets idle buckets expire once they would be full again.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + (now - updated) / 1000 * rate)
+
+local allowed = 0
+if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// redisRateLimiter is a RateLimiter shared by every instance through Redis.
+type redisRateLimiter struct {
+    client *redis.Client
+    rate   float64
+    burst  int
+}
+
+func (l *redisRateLimiter) Allow(ctx context.Context, key string) (RateLimitResult, error) {
+    reply, err := tokenBucketScript.Run(ctx, l.client, []string{key}, l.rate, l.burst).Slice()
+    if err != nil {
+        return RateLimitResult{}, err
+    }
+    if len(reply) != 2 {
+        return RateLimitResult{}, errors.New("unexpected reply from rate limit script")
+    }
+    allowed, _ := reply[0].(int64)
+    tokensText, _ := reply[1].(string)
+    tokens, err := strconv.ParseFloat(tokensText, 64)
+    if err != nil {
+        return RateLimitResult{}, err
+    }
+    return bucketResult(allowed == 1, tokens, l.rate, l.burst), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// defaultReadOnlyMessage explains refused changes when read-only mode is on without a
+// message of its own.
+const defaultReadOnlyMessage = "The catalog is read-only for maintenance; changes are not accepted right now."
+
+// ReadOnlyMode is whether the service refuses changes, as during a maintenance window.
+// Reads keep working, from the cache where they are cached.
+type ReadOnlyMode struct {
+    Enabled bool   `json:"enabled" xml:"enabled"`
+    Message string `json:"message,omitempty" xml:"message,omitempty"`
+    // Forced is set when the READ_ONLY setting turned the mode on, which the admin endpoint
+    // can't undo.
+    Forced    bool       `json:"forced" xml:"forced"`
+    UpdatedAt *time.Time `json:"updated_at,omitempty" xml:"updated_at,omitempty"`
+}
+
+// ReadOnlyModeRequest is the body of a request turning read-only mode on or off.
+type ReadOnlyModeRequest struct {
+    Enabled bool   `json:"enabled" xml:"enabled"`
+    Message string `json:"message" xml:"message"`
+}
+
+// readOnlyMode is this instance's view of the mode, kept in the service_settings table so
+// that every instance follows the admin endpoint, and refreshed by the read-only-mode job.
+var readOnlyMode atomic.Pointer[ReadOnlyMode]
+
+// currentReadOnlyMode returns the mode this instance is in. The READ_ONLY setting overrides
+// what the database says.
+func currentReadOnlyMode() ReadOnlyMode {
+    var mode ReadOnlyMode
+    if stored := readOnlyMode.Load(); stored != nil {
+        mode = *stored
+    }
+    if cfg := currentConfig(); cfg.ReadOnly {
+        mode.Enabled, mode.Forced = true, true
+        if cfg.ReadOnlyMessage != "" {
+            mode.Message = cfg.ReadOnlyMessage
+        }
+    }
+    return mode
+}
+
+// reason is the message changes are refused with.
+func (m ReadOnlyMode) reason() string {
+    if m.Message == "" {
+        return defaultReadOnlyMessage
+    }
+    return m.Message
+}
+
+// refreshReadOnlyMode loads the mode from the database. It runs as the read-only-mode job
+// on every instance. If the database can't be reached, as may happen during maintenance,
+// the instance keeps the mode it last knew.
+func refreshReadOnlyMode(ctx context.Context) error {
+    var mode ReadOnlyMode
+    var updatedAt time.Time
+    err := DB.QueryRowContext(ctx, "SELECT read_only, read_only_message, updated_at FROM service_settings").Scan(&mode.Enabled, &mode.Message, &updatedAt)
+    if err != nil {
+        return err
+    }
+    mode.UpdatedAt = &updatedAt
+    if previous := readOnlyMode.Swap(&mode); previous == nil || previous.Enabled != mode.Enabled {
+        if mode.Enabled {
+            slog.Warn("read-only mode is on, refusing changes", "message", mode.Message)
+        } else if previous != nil {
+            slog.Info("read-only mode is off, accepting changes")
+        }
+    }
+    return nil
+}
+
+// readOnlyExemptRoutes are the routes that take POST for reads, or that must keep working in
+// read-only mode to turn it off, including by reloading READ_ONLY. graphqlHandler refuses
+// GraphQL mutations itself.
+var readOnlyExemptRoutes = map[string]bool{
+    "/login":               true,
+    "/products/batch-get":  true,
+    "/coupons/validate":    true,
+    "/graphql":             true,
+    "/admin/read-only":     true,
+    "/admin/config/reload": true,
+}
+
+// readOnlyModeMiddleware answers requests that would change something with a 503 while
+// read-only mode is on.
+func readOnlyModeMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            next.ServeHTTP(w, r)
+            return
+        }
+        if route := mux.CurrentRoute(r); route != nil {
+            if path, err := route.GetPathTemplate(); err == nil && readOnlyExemptRoutes[path] {
+                next.ServeHTTP(w, r)
+                return
+            }
+        }
+        if !respondReadOnly(w, r) {
+            next.ServeHTTP(w, r)
+        }
+    })
+}
+
+// respondReadOnly writes a 503 Service Unavailable response explaining that changes are
+// refused if read-only mode is on, and reports whether it did.
+func respondReadOnly(w http.ResponseWriter, r *http.Request) bool {
+    mode := currentReadOnlyMode()
+    if !mode.Enabled {
+        return false
+    }
+    respondUnavailable(w, r, currentConfig().ReadOnlyRetryAfter, mode.reason())
+    return true
+}
+
+// getReadOnlyMode reports whether this instance is in read-only mode.
+func getReadOnlyMode(w http.ResponseWriter, r *http.Request) {
+    // If everything went well, return the mode in the response body.
+    respond(w, r, http.StatusOK, currentReadOnlyMode())
+}
+
+// setReadOnlyMode turns read-only mode on or off for every instance from a body like
+// {"enabled": true, "message": "Back at 02:00 UTC."}. Other instances follow within
+// READ_ONLY_REFRESH_INTERVAL.
+func setReadOnlyMode(w http.ResponseWriter, r *http.Request) {
+    var req ReadOnlyModeRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    req.Message = strings.TrimSpace(req.Message)
+    if len(req.Message) > 500 {
+        respondValidationErrors(w, r, ValidationErrors{{Field: "message", Message: "must be at most 500 characters"}})
+        return
+    }
+    if !req.Enabled && currentConfig().ReadOnly {
+        respondError(w, r, http.StatusConflict, codeReadOnlyForced, "Read-only mode is turned on by the READ_ONLY setting.")
+        return
+    }
+
+    _, err := DB.ExecContext(r.Context(), "UPDATE service_settings SET read_only = $1, read_only_message = $2, updated_at = now()", req.Enabled, req.Message)
+    if err == nil {
+        err = refreshReadOnlyMode(r.Context())
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to change read-only mode.")
+        return
+    }
+
+    // If everything went well, return the new mode in the response body.
+    respond(w, r, http.StatusOK, currentReadOnlyMode())
+}
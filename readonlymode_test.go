@@ -0,0 +1,46 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestReadOnlyModeMiddleware(t *testing.T) {
+    tests := []struct {
+        name           string
+        method         string
+        enabled        bool
+        wantStatus     int
+        wantRetryAfter string
+    }{
+        {name: "write refused", method: http.MethodPost, enabled: true, wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "90"},
+        {name: "read allowed", method: http.MethodGet, enabled: true, wantStatus: http.StatusOK},
+        {name: "write allowed when off", method: http.MethodPost, wantStatus: http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            setupHandlers(t)
+            AppConfig.ReadOnlyRetryAfter = 90 * time.Second
+            saved := readOnlyMode.Swap(&ReadOnlyMode{Enabled: tt.enabled, Message: "Back at 02:00 UTC."})
+            t.Cleanup(func() { readOnlyMode.Store(saved) })
+
+            handler := readOnlyModeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(http.StatusOK)
+            }))
+            w := httptest.NewRecorder()
+            handler.ServeHTTP(w, newTestRequest(tt.method, "/products", "", RoleAdmin, nil))
+
+            if w.Code != tt.wantStatus {
+                t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+            }
+            if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+                t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+            }
+            if tt.wantStatus == http.StatusServiceUnavailable && errorCode(w) != codeUnavailable {
+                t.Errorf("code = %q, want %q", errorCode(w), codeUnavailable)
+            }
+        })
+    }
+}
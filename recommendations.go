@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+)
+
+// Bounds on the number of recommendations returned.
+const (
+    defaultRecommendationLimit = 10
+    maxRecommendationLimit     = 50
+)
+
+// Recommendation is a recommended product together with how strongly it is associated with
+// the requested product. Strength is the number of orders containing both products, or zero
+// for same-category fallbacks.
+type Recommendation struct {
+    Product
+    Strength int `json:"strength"`
+}
+
+// coOccurrenceQuery finds the products most often ordered together with the given product.
+const coOccurrenceQuery = "SELECT " + productColumns + `, strength FROM products
+    JOIN (SELECT b.product_id, COUNT(*) AS strength
+        FROM order_items a
+        JOIN order_items b ON b.order_id = a.order_id AND b.product_id <> a.product_id
+        WHERE a.product_id = $1
+        GROUP BY b.product_id) s ON s.product_id = products.id
+    WHERE deleted_at IS NULL AND status = 'published'
+    ORDER BY strength DESC, id
+    LIMIT $2`
+
+// sameCategoryQuery finds other products in the same category as the given product.
+const sameCategoryQuery = "SELECT " + productColumns + `, 0 AS strength FROM products
+    WHERE category = (SELECT category FROM products WHERE id = $1) AND id <> $1 AND deleted_at IS NULL AND status = 'published'
+    ORDER BY id
+    LIMIT $2`
+
+// getRecommendations returns "customers who bought this also bought" products for a product,
+// falling back to related products from the same category when there is no order history.
+func getRecommendations(w http.ResponseWriter, r *http.Request) {
+    // Get the product ID from the URL path.
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    limit := defaultRecommendationLimit
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        limit, err = strconv.Atoi(limitStr)
+        if err != nil || limit < 1 || limit > maxRecommendationLimit {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+
+    // Make sure the product exists so a typo doesn't look like "no recommendations".
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve recommendations.") {
+        return
+    }
+
+    recommendations, err := queryRecommendations(r.Context(), coOccurrenceQuery, productID, limit)
+    if err == nil && len(recommendations) == 0 {
+        recommendations, err = queryRecommendations(r.Context(), sameCategoryQuery, productID, limit)
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve recommendations.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(recommendations)) {
+        return
+    }
+
+    // If everything went well, return the recommendations in the response body.
+    respond(w, r, http.StatusOK, recommendations)
+}
+
+// queryRecommendations runs one of the recommendation queries and scans its rows.
+func queryRecommendations(ctx context.Context, query string, productID, limit int) ([]Recommendation, error) {
+    rows, err := Reads.QueryContext(ctx, query, productID, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    recommendations := []Recommendation{}
+    for rows.Next() {
+        var rec Recommendation
+        if err := rows.Scan(append(productFields(&rec.Product), &rec.Strength)...); err != nil {
+            return nil, err
+        }
+        recommendations = append(recommendations, rec)
+    }
+    return recommendations, rows.Err()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// recommendationRows answers a recommendation query with a row for each product, with the
+// strength given for it.
+func recommendationRows(products []Product, strengths []int) ([]string, [][]driver.Value) {
+    var columns []string
+    rows := [][]driver.Value{}
+    for i, product := range products {
+        var row []driver.Value
+        columns, row = productRow(product, int64(strengths[i]))
+        rows = append(rows, row)
+    }
+    return columns, rows
+}
+
+func TestGetRecommendations(t *testing.T) {
+    shade := Product{ID: 2, Name: "Shade", Category: "home", Price: 900, Currency: "USD", Status: StatusPublished, Version: 1}
+    bulb := Product{ID: 3, Name: "Bulb", Category: "lighting", Price: 300, Currency: "USD", Status: StatusPublished, Version: 1}
+    desk := Product{ID: 4, Name: "Desk", Category: "office", Price: 19900, Currency: "USD", Status: StatusPublished, Version: 1}
+    rug := Product{ID: 5, Name: "Rug", Category: "home", Price: 5900, Currency: "USD", Status: StatusPublished, Version: 1}
+    tests := []struct {
+        name string
+        // bought are the products ordered together with the lamp, as the co-occurrence
+        // query returns them, and strengths how often; sameCategory the fallback's products.
+        bought        []Product
+        strengths     []int
+        sameCategory  []Product
+        wantIDs       []int
+        wantStrengths []int
+        fallback      bool
+    }{
+        {name: "by strength", bought: []Product{bulb, shade, desk}, strengths: []int{9, 4, 1}, sameCategory: []Product{rug, shade},
+            wantIDs: []int{3, 2, 4}, wantStrengths: []int{9, 4, 1}},
+        {name: "same category fallback", sameCategory: []Product{shade, rug}, wantIDs: []int{2, 5}, wantStrengths: []int{0, 0}, fallback: true},
+        {name: "none", wantIDs: []int{}, wantStrengths: []int{}, fallback: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD"})
+            stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                switch {
+                case strings.Contains(query, "order_items"):
+                    columns, rows := recommendationRows(tt.bought, tt.strengths)
+                    return columns, rows, nil
+                case strings.Contains(query, "0 AS strength"):
+                    columns, rows := recommendationRows(tt.sameCategory, make([]int, len(tt.sameCategory)))
+                    return columns, rows, nil
+                }
+                return nil, nil, nil
+            }
+
+            w := httptest.NewRecorder()
+            getRecommendations(w, newTestRequest("GET", "/products/1/recommendations", "", RoleViewer, map[string]string{"id": "1"}))
+            if w.Code != http.StatusOK {
+                t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+            }
+            var recommendations []Recommendation
+            if err := json.Unmarshal(w.Body.Bytes(), &recommendations); err != nil {
+                t.Fatalf("decoding recommendations: %v", err)
+            }
+            ids, strengths := []int{}, []int{}
+            for _, rec := range recommendations {
+                ids, strengths = append(ids, rec.ID), append(strengths, rec.Strength)
+            }
+            if !reflect.DeepEqual(ids, tt.wantIDs) || !reflect.DeepEqual(strengths, tt.wantStrengths) {
+                t.Errorf("got products %v with strengths %v, want %v with %v", ids, strengths, tt.wantIDs, tt.wantStrengths)
+            }
+            if ran := stubDB.ran("0 AS strength"); ran != tt.fallback {
+                t.Errorf("ran same category query = %v, want %v", ran, tt.fallback)
+            }
+        })
+    }
+}
+
+// The order comes from the co-occurrence query, which must rank the products by how often
+// they were bought together, strongest first.
+func TestCoOccurrenceQueryOrder(t *testing.T) {
+    if !strings.Contains(coOccurrenceQuery, "ORDER BY strength DESC, id") {
+        t.Errorf("co-occurrence query does not order by strength: %s", coOccurrenceQuery)
+    }
+}
+
+func TestGetRecommendationsInvalid(t *testing.T) {
+    tests := []struct {
+        name   string
+        target string
+        vars   map[string]string
+        status int
+        code   string
+    }{
+        {name: "missing product", target: "/products/9/recommendations", vars: map[string]string{"id": "9"}, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "limit too high", target: "/products/1/recommendations?limit=51", vars: map[string]string{"id": "1"}, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "limit not a number", target: "/products/1/recommendations?limit=ten", vars: map[string]string{"id": "1"}, status: http.StatusBadRequest, code: codeInvalidParameter},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD"})
+
+            w := httptest.NewRecorder()
+            getRecommendations(w, newTestRequest("GET", tt.target, "", RoleViewer, tt.vars))
+            if w.Code != tt.status || errorCode(w) != tt.code {
+                t.Errorf("got %d %q, want %d %q", w.Code, errorCode(w), tt.status, tt.code)
+            }
+            if stubDB.ran("order_items") {
+                t.Error("looked up recommendations for an invalid request")
+            }
+        })
+    }
+}
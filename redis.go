@@ -0,0 +1,41 @@
+package main
+
+import (
+    "context"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// Redis is a global variable that holds the client of the Redis server shared by every
+// instance, or nil when nothing is kept there. The product cache, the rate limiter and the
+// idempotency store all go through it when their backend is "redis", so replicas behind a
+// load balancer see the same cached reads, share rate limits and replay each other's
+// idempotent responses.
+var Redis *redis.Client
+
+// usesRedis reports whether anything cfg selects is kept in Redis.
+func usesRedis(cfg Config) bool {
+    return cfg.CacheBackend == "redis" || (cfg.RateLimitRPS > 0 && cfg.RateLimitBackend == "redis") || cfg.IdempotencyBackend == "redis"
+}
+
+// newRedisClient returns a client of the server at cfg.RedisURL, or nil if cfg doesn't use
+// Redis. Connections are made on first use; startup waits for the server with
+// pingWithRetry, and the readiness probe reports it going away later.
+func newRedisClient(cfg Config) (*redis.Client, error) {
+    if !usesRedis(cfg) {
+        return nil, nil
+    }
+    opts, err := redis.ParseURL(cfg.RedisURL)
+    if err != nil {
+        return nil, err
+    }
+    return redis.NewClient(opts), nil
+}
+
+// pingRedis checks that Redis answers, if it is used.
+func pingRedis(ctx context.Context) error {
+    if Redis == nil {
+        return nil
+    }
+    return Redis.Ping(ctx).Err()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Kinds of product relation. relationSameCategory marks the products suggested when a
+// product has no relations of the kind asked for.
+const (
+    relationRelated      = "related"
+    relationAccessory    = "accessory"
+    relationAlternative  = "alternative"
+    relationSameCategory = "same_category"
+)
+
+// relationKinds are the kinds a relation can be created with.
+var relationKinds = map[string]bool{
+    relationRelated:     true,
+    relationAccessory:   true,
+    relationAlternative: true,
+}
+
+// ProductRelation links a product to another one of the given kind.
+type ProductRelation struct {
+    ProductID int       `json:"product_id" xml:"product_id"`
+    RelatedID int       `json:"related_id" xml:"related_id"`
+    Kind      string    `json:"kind" xml:"kind"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+// RelatedProduct is a product related to the requested one, with the kind of relation.
+type RelatedProduct struct {
+    Product
+    Kind string `json:"kind" xml:"kind"`
+}
+
+// relatedQuery selects the live, published products a product is related to, newest
+// relation first within each kind.
+const relatedQuery = "SELECT " + productColumns + `, kind FROM products
+    JOIN (SELECT related_id, kind, created_at AS related_at FROM product_relations WHERE product_id = $1 AND ($2 = '' OR kind = $2)) r ON r.related_id = products.id
+    WHERE deleted_at IS NULL AND status = 'published'
+    ORDER BY kind, related_at DESC, id
+    LIMIT $3`
+
+// sameCategoryRelatedQuery selects the other published products of a product's category, best
+// rated first, for products without curated relations.
+const sameCategoryRelatedQuery = "SELECT " + productColumns + `, 'same_category' FROM products
+    WHERE category = (SELECT category FROM products WHERE id = $1) AND id <> $1 AND deleted_at IS NULL AND status = 'published'
+    ORDER BY rating_total::numeric / NULLIF(review_count, 0) DESC NULLS LAST, review_count DESC, id
+    LIMIT $2`
+
+// getRelatedProducts lists the products a product is related to, optionally only those of
+// one ?kind=. A product without such relations gets the best rated other products of its
+// category instead, with the kind same_category.
+func getRelatedProducts(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    kind := r.URL.Query().Get("kind")
+    if kind != "" && !relationKinds[kind] {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid kind.")
+        return
+    }
+    limit := defaultRecommendationLimit
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        limit, err = strconv.Atoi(limitStr)
+        if err != nil || limit < 1 || limit > maxRecommendationLimit {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+
+    // Make sure the product exists so a typo doesn't look like "nothing related".
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve related products.") {
+        return
+    }
+
+    related, err := queryRelatedProducts(r, relatedQuery, productID, kind, limit)
+    if err == nil && len(related) == 0 {
+        related, err = queryRelatedProducts(r, sameCategoryRelatedQuery, productID, limit)
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve related products.")
+        return
+    }
+    if respondEmptyList(w, r, len(related)) {
+        return
+    }
+
+    // If everything went well, return the related products in the response body.
+    respond(w, r, http.StatusOK, related)
+}
+
+// queryRelatedProducts runs one of the related product queries and scans its rows.
+func queryRelatedProducts(r *http.Request, query string, args ...interface{}) ([]RelatedProduct, error) {
+    related := []RelatedProduct{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var rp RelatedProduct
+        if err := scan(append(productFields(&rp.Product), &rp.Kind)...); err != nil {
+            return err
+        }
+        related = append(related, rp)
+        return nil
+    }, query, args...)
+    return related, err
+}
+
+// getProductRelations lists the curated relations of a product, for managing them.
+func getProductRelations(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve relations.") {
+        return
+    }
+
+    relations := []ProductRelation{}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var rel ProductRelation
+        if err := scan(&rel.ProductID, &rel.RelatedID, &rel.Kind, &rel.CreatedAt); err != nil {
+            return err
+        }
+        relations = append(relations, rel)
+        return nil
+    }, "SELECT product_id, related_id, kind, created_at FROM product_relations WHERE product_id = $1 ORDER BY kind, created_at DESC, related_id", productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve relations.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(relations)) {
+        return
+    }
+
+    // If everything went well, return the relations in the response body.
+    respond(w, r, http.StatusOK, relations)
+}
+
+// createProductRelation relates a product to another one from a body like
+// {"related_id": 7, "kind": "accessory"}. Creating a relation that exists already succeeds
+// and leaves it as it was.
+func createProductRelation(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    var relation ProductRelation
+    if err := decodeBody(r, &relation); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    if !relationKinds[relation.Kind] {
+        errs.add("kind", "must be one of related, accessory or alternative")
+    }
+    if relation.RelatedID == productID {
+        errs.add("related_id", "must not be the product itself")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to create relation.") {
+        return
+    }
+
+    // The insert selects nothing, and so returns no row, unless both products are live. A
+    // relation that exists already is returned as it is.
+    err = DB.QueryRowContext(r.Context(), `WITH inserted AS (
+            INSERT INTO product_relations (product_id, related_id, kind)
+            SELECT p.id, q.id, $3 FROM products p, products q
+            WHERE p.id = $1 AND q.id = $2 AND p.deleted_at IS NULL AND q.deleted_at IS NULL
+            ON CONFLICT DO NOTHING
+            RETURNING product_id, related_id, kind, created_at)
+        SELECT * FROM inserted
+        UNION ALL
+        SELECT product_id, related_id, kind, created_at FROM product_relations WHERE product_id = $1 AND related_id = $2 AND kind = $3`,
+        productID, relation.RelatedID, relation.Kind).Scan(&relation.ProductID, &relation.RelatedID, &relation.Kind, &relation.CreatedAt)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create relation.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the relation.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d/relations/%d?kind=%s", productID, relation.RelatedID, relation.Kind))
+    respond(w, r, http.StatusCreated, relation)
+}
+
+// deleteProductRelation removes the relations from a product to another one: only the one
+// of ?kind= if given, and otherwise every kind.
+func deleteProductRelation(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    relatedID, err := strconv.Atoi(mux.Vars(r)["related_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid related product ID.")
+        return
+    }
+    kind := r.URL.Query().Get("kind")
+    if kind != "" && !relationKinds[kind] {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid kind.")
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to delete relation.") {
+        return
+    }
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM product_relations WHERE product_id = $1 AND related_id = $2 AND ($3 = '' OR kind = $3)",
+        productID, relatedID, kind)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete relation.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete relation.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeRelationNotFound, "Relation not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "net/http"
+    "reflect"
+    "sort"
+    "sync"
+    "sync/atomic"
+)
+
+// reloadableSettings are the fields of Config that a reload applies to the running process,
+// with the environment variables they are read from. Changes to any other field only take
+// effect when the process restarts.
+var reloadableSettings = map[string]string{
+    "LogLevel":           "LOG_LEVEL",
+    "RateLimitRPS":       "RATE_LIMIT_RPS",
+    "RateLimitBurst":     "RATE_LIMIT_BURST",
+    "ProductCacheTTL":    "PRODUCT_CACHE_TTL",
+    "HTTPCacheMaxAge":    "HTTP_CACHE_MAX_AGE",
+    "ReadOnly":           "READ_ONLY",
+    "ReadOnlyMessage":    "READ_ONLY_MESSAGE",
+    "ReadOnlyRetryAfter": "READ_ONLY_RETRY_AFTER",
+}
+
+// LiveConfig is the configuration requests are served with, together with the rate limiter
+// built from it. It is swapped as a whole by a reload, so a request sees either the old
+// settings or the new ones, never a mix.
+type LiveConfig struct {
+    Config
+    // RateLimit is nil when rate limiting is disabled.
+    RateLimit RateLimiter
+}
+
+// liveConfig holds the LiveConfig in effect. Only the reloadableSettings differ from
+// AppConfig, which never changes after startup.
+var liveConfig atomic.Pointer[LiveConfig]
+
+// configArgs are the command-line arguments the configuration was loaded from, which a
+// reload loads it from again.
+var configArgs []string
+
+// reloadMu keeps reloads from running at the same time.
+var reloadMu sync.Mutex
+
+// ConfigReloadResponse reports what a configuration reload changed.
+type ConfigReloadResponse struct {
+    // Applied lists the changed settings that took effect, by environment variable.
+    Applied []string `json:"applied"`
+    // RestartRequired is set when other settings changed too, which are left as they were
+    // until the process restarts.
+    RestartRequired bool `json:"restart_required"`
+}
+
+// currentConfig returns the configuration in effect. Commands that don't serve never reload,
+// so without a live configuration it is AppConfig.
+func currentConfig() *LiveConfig {
+    if live := liveConfig.Load(); live != nil {
+        return live
+    }
+    return &LiveConfig{Config: AppConfig}
+}
+
+// reloadConfig loads the configuration again, from the same arguments, the .env file as it
+// is now and the environment of the process, and applies the reloadableSettings that
+// changed. Nothing is applied if the new configuration isn't valid.
+func reloadConfig() (ConfigReloadResponse, error) {
+    reloadMu.Lock()
+    defer reloadMu.Unlock()
+
+    loaded, err := loadConfig(configArgs)
+    if err != nil {
+        return ConfigReloadResponse{}, err
+    }
+    current := currentConfig()
+    next := &LiveConfig{Config: current.Config, RateLimit: current.RateLimit}
+    resp := ConfigReloadResponse{Applied: []string{}}
+    from, to, set := reflect.ValueOf(current.Config), reflect.ValueOf(loaded), reflect.ValueOf(&next.Config).Elem()
+    for i := 0; i < from.NumField(); i++ {
+        if reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+            continue
+        }
+        name, ok := reloadableSettings[from.Type().Field(i).Name]
+        if !ok {
+            resp.RestartRequired = true
+            continue
+        }
+        set.Field(i).Set(to.Field(i))
+        resp.Applied = append(resp.Applied, name)
+    }
+    sort.Strings(resp.Applied)
+
+    // A new limiter starts every client with a full bucket.
+    if next.RateLimitRPS != current.RateLimitRPS || next.RateLimitBurst != current.RateLimitBurst {
+        if next.RateLimitRPS > 0 && next.RateLimitBackend == "redis" && Redis == nil {
+            return ConfigReloadResponse{}, errors.New("the redis rate limiter needs a restart to connect to Redis")
+        }
+        if next.RateLimit, err = newRateLimiter(next.Config, Redis); err != nil {
+            return ConfigReloadResponse{}, err
+        }
+    }
+    if next.LogLevel != current.LogLevel {
+        logLevel.UnmarshalText([]byte(next.LogLevel))
+    }
+    liveConfig.Store(next)
+    slog.Info("configuration reloaded", "applied", resp.Applied, "restart_required", resp.RestartRequired)
+    return resp, nil
+}
+
+// reloadConfigHandler reloads the configuration of the instance that answers. Each instance
+// has to be reloaded for itself.
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+    resp, err := reloadConfig()
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusUnprocessableEntity, codeInvalidConfig, "Failed to reload configuration: "+err.Error())
+        return
+    }
+
+    // If everything went well, report what changed.
+    respond(w, r, http.StatusOK, resp)
+}
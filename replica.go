@@ -0,0 +1,213 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "sync/atomic"
+
+    "github.com/lib/pq"
+)
+
+// readOnlyContextKey is the context key marking work that only reads, whose queries may go
+// to the read replica.
+const readOnlyContextKey contextKey = "read-only"
+
+// withReadOnly returns a copy of ctx whose reads may be served by the read replica.
+func withReadOnly(ctx context.Context) context.Context {
+    return context.WithValue(ctx, readOnlyContextKey, true)
+}
+
+// isReadOnly reports whether ctx was marked by withReadOnly.
+func isReadOnly(ctx context.Context) bool {
+    readOnly, _ := ctx.Value(readOnlyContextKey).(bool)
+    return readOnly
+}
+
+// readOnlyMiddleware marks GET and HEAD requests as read-only. Other requests read from the
+// primary, so they see what they just wrote.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodGet || r.Method == http.MethodHead {
+            r = r.WithContext(withReadOnly(r.Context()))
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// ReadRouter sends the reads of read-only work to a replica while it is up, and everything
+// else to the primary. The replica lags behind the primary, so a client may briefly not see
+// its own change when it reads it back in another request.
+type ReadRouter struct {
+    primary *sql.DB
+    // replica is nil when none is configured.
+    replica *sql.DB
+    // up is whether the replica answered its last check.
+    up atomic.Bool
+    // stmts holds the prepared statements of each pool, which are only valid on it.
+    stmts map[*sql.DB]*stmtCache
+}
+
+// Reads is a global variable that holds the router queries for reading go through.
+var Reads *ReadRouter
+
+// newReadRouter returns a ReadRouter over primary and replica, which may be nil, keeping up
+// to stmtCacheSize prepared statements on each. The replica isn't used until a check has
+// found it up.
+func newReadRouter(primary, replica *sql.DB, stmtCacheSize int) *ReadRouter {
+    rr := &ReadRouter{primary: primary, replica: replica, stmts: map[*sql.DB]*stmtCache{}}
+    rr.stmts[primary] = newStmtCache(primary, stmtCacheSize)
+    if replica != nil {
+        rr.stmts[replica] = newStmtCache(replica, stmtCacheSize)
+    }
+    return rr
+}
+
+// db returns the pool ctx should read from.
+func (rr *ReadRouter) db(ctx context.Context) *sql.DB {
+    if rr.replica != nil && rr.up.Load() && isReadOnly(ctx) {
+        return rr.replica
+    }
+    return rr.primary
+}
+
+// QueryContext runs a query that only reads. If the replica can't be reached, it is marked
+// down and the query is run on the primary instead.
+func (rr *ReadRouter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    db := rr.db(ctx)
+    rows, err := db.QueryContext(ctx, query, args...)
+    if db == rr.replica && rr.failedOver(err) {
+        return rr.primary.QueryContext(ctx, query, args...)
+    }
+    return rows, err
+}
+
+// QueryRowScan runs a query that only reads one row and scans it into dest, falling back to
+// the primary like QueryContext.
+func (rr *ReadRouter) QueryRowScan(ctx context.Context, dest []interface{}, query string, args ...interface{}) error {
+    db := rr.db(ctx)
+    err := db.QueryRowContext(ctx, query, args...).Scan(dest...)
+    if db == rr.replica && rr.failedOver(err) {
+        return rr.primary.QueryRowContext(ctx, query, args...).Scan(dest...)
+    }
+    return err
+}
+
+// ScanRow returns a function scanning the single row of a query that only reads, for the
+// helpers that take one. The query runs like QueryRowScan when the function is called.
+func (rr *ReadRouter) ScanRow(ctx context.Context, query string, args ...interface{}) func(dest ...interface{}) error {
+    return func(dest ...interface{}) error {
+        return rr.QueryRowScan(ctx, dest, query, args...)
+    }
+}
+
+// PreparedQueryContext is QueryContext for the hot queries worth keeping prepared. Their text
+// must not embed values, only placeholders, or each call would take up a statement.
+func (rr *ReadRouter) PreparedQueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    db := rr.db(ctx)
+    rows, err := rr.stmts[db].QueryContext(ctx, query, args...)
+    if db == rr.replica && rr.failedOver(err) {
+        return rr.stmts[rr.primary].QueryContext(ctx, query, args...)
+    }
+    return rows, err
+}
+
+// PreparedQueryRowScan is QueryRowScan for the hot queries worth keeping prepared, like
+// PreparedQueryContext.
+func (rr *ReadRouter) PreparedQueryRowScan(ctx context.Context, dest []interface{}, query string, args ...interface{}) error {
+    db := rr.db(ctx)
+    err := rr.stmts[db].QueryRowContext(ctx, query, args...).Scan(dest...)
+    if db == rr.replica && rr.failedOver(err) {
+        return rr.stmts[rr.primary].QueryRowContext(ctx, query, args...).Scan(dest...)
+    }
+    return err
+}
+
+// ReadTx runs fn in a read-only transaction, falling back to the primary like QueryContext.
+// fn may then be run a second time, so it must start over on every run.
+func (rr *ReadRouter) ReadTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+    db := rr.db(ctx)
+    err := readTx(ctx, db, fn)
+    if db == rr.replica && rr.failedOver(err) {
+        return readTx(ctx, rr.primary, fn)
+    }
+    return err
+}
+
+// readTx runs fn in a read-only transaction on db.
+func readTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+    tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if err := fn(tx); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// failedOver marks the replica down if err means it couldn't be reached, and reports
+// whether it did.
+func (rr *ReadRouter) failedOver(err error) bool {
+    if !databaseUnreachable(err) {
+        return false
+    }
+    if rr.up.Swap(false) {
+        slog.Warn("read replica is down, reading from the primary", "error", err)
+    }
+    return true
+}
+
+// databaseUnreachable reports whether err means the database couldn't be reached or is
+// shutting down, rather than that the query failed.
+func databaseUnreachable(err error) bool {
+    if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+        return false
+    }
+    var netErr net.Error
+    var pqErr *pq.Error
+    switch {
+    case errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr), errors.As(err, new(errDatabaseUnavailable)):
+        return true
+    case errors.As(err, &pqErr):
+        // Connection exceptions, and the server shutting down or recovering.
+        return pqErr.Code.Class() == "08" || pqErr.Code.Class() == "57"
+    }
+    return false
+}
+
+// checkReplica pings the replica and uses it for reads again once it answers. It runs as
+// the replica-check job on every instance, as each has its own view of the replica.
+func (rr *ReadRouter) checkReplica(ctx context.Context) error {
+    err := rr.replica.PingContext(ctx)
+    if err != nil {
+        if rr.up.Swap(false) {
+            slog.Warn("read replica is down, reading from the primary", "error", err)
+        }
+        return err
+    }
+    if !rr.up.Swap(true) {
+        slog.Info("read replica is up, sending reads to it")
+    }
+    return nil
+}
+
+// openReplicaDB opens the connection pool of the read replica described by cfg, with the
+// same settings as the primary's. Unlike the primary, it isn't waited for: reads go to the
+// primary until the replica-check job finds it up.
+func openReplicaDB(cfg Config) (*sql.DB, error) {
+    cfg.DatabaseURL = cfg.DatabaseReplicaURL
+    db, err := openTracedDB(cfg)
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+    db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+    db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+    return db, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "database/sql"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// setupReplica points Reads at a stub replica that is up, next to the stub primary of
+// setupHandlers, and returns it.
+func setupReplica(t *testing.T) *stubDatabase {
+    t.Helper()
+    replica := &stubDatabase{}
+    db := sql.OpenDB(replica)
+    t.Cleanup(func() { db.Close() })
+    Reads = newReadRouter(DB, db, 0)
+    Reads.up.Store(true)
+    return replica
+}
+
+func TestGetHandlersReadFromReplica(t *testing.T) {
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        target  string
+        vars    map[string]string
+        role    Role
+    }{
+        {name: "category", handler: getCategory, target: "/categories/1", vars: map[string]string{"id": "1"}, role: RoleViewer},
+        {name: "coupon", handler: getCoupon, target: "/coupons/1", vars: map[string]string{"id": "1"}, role: RoleAdmin},
+        {name: "promotion", handler: getPromotion, target: "/promotions/1", vars: map[string]string{"id": "1"}, role: RoleViewer},
+        {name: "vendor", handler: getVendor, target: "/vendors/1", vars: map[string]string{"id": "1"}, role: RoleViewer},
+        {name: "webhook", handler: getWebhook, target: "/admin/webhooks/1", vars: map[string]string{"id": "1"}, role: RoleAdmin},
+        {name: "images", handler: getImages, target: "/products/1/images", vars: map[string]string{"id": "1"}, role: RoleViewer},
+        {name: "stock", handler: getStock, target: "/products/1/stock", vars: map[string]string{"id": "1"}, role: RoleViewer},
+        {name: "variant", handler: getVariant, target: "/products/1/variants/1", vars: map[string]string{"id": "1", "variant_id": "1"}, role: RoleViewer},
+        {name: "recommendations", handler: getRecommendations, target: "/products/1/recommendations", vars: map[string]string{"id": "1"}, role: RoleViewer},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 2500, Currency: "USD"})
+            replica := setupReplica(t)
+
+            r := newTestRequest("GET", tt.target, "", tt.role, tt.vars)
+            r = r.WithContext(withReadOnly(r.Context()))
+            tt.handler(httptest.NewRecorder(), r)
+            if len(replica.statements) == 0 || len(stubDB.statements) > 0 {
+                t.Errorf("replica ran %q and primary %q, want only the replica", replica.statements, stubDB.statements)
+            }
+        })
+    }
+}
+
+// Requests that write read from the primary, so they see what they have just written.
+func TestWritesReadFromPrimary(t *testing.T) {
+    setupHandlers(t)
+    replica := setupReplica(t)
+
+    getVendor(httptest.NewRecorder(), newTestRequest("PUT", "/vendors/1", "", RoleViewer, map[string]string{"id": "1"}))
+    if len(replica.statements) > 0 || !stubDB.ran("FROM vendors") {
+        t.Errorf("replica ran %q and primary %q, want only the primary", replica.statements, stubDB.statements)
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "time"
+)
+
+// Errors returned by a ProductRepository. Handlers map them to HTTP status codes.
+var (
+    ErrProductNotFound = errors.New("product not found")
+    ErrBarcodeInUse    = errors.New("barcode already in use")
+    ErrSKUInUse        = errors.New("sku already in use")
+    ErrUnknownCategory = errors.New("category does not exist")
+    ErrUnknownVendor   = errors.New("vendor does not exist")
+    ErrVersionMismatch = errors.New("product version does not match")
+)
+
+// ProductFilter narrows a product listing. Zero values mean "don't filter on this".
+type ProductFilter struct {
+    Name       string
+    Categories []string
+    MinPrice   *Money
+    MaxPrice   *Money
+    // Attributes only returns products that have each of these attribute values.
+    Attributes map[string]string
+    // Tags only returns products with any of these tags, or with all of them when
+    // TagsMatchAll is set.
+    Tags         []string
+    TagsMatchAll bool
+    // VendorID only returns the products of this vendor.
+    VendorID int
+    // Status only returns products with this status. PublishedOnly only returns published
+    // products whatever Status asks for; it is set for readers who can't see the others.
+    Status        ProductStatus
+    PublishedOnly bool
+    // IncludeDeleted also returns soft-deleted products.
+    IncludeDeleted bool
+    // AfterID only returns products with a greater ID, to resume a stream.
+    AfterID int
+}
+
+// ProductPatch holds the fields of a partial update. Nil fields are left unchanged.
+type ProductPatch struct {
+    Name       *string     `json:"name" xml:"name"`
+    Category   *string     `json:"category" xml:"category"`
+    Price      *Money      `json:"price" xml:"price"`
+    Currency   *string     `json:"currency" xml:"currency"`
+    ImageURL   *string     `json:"image_url" xml:"image_url"`
+    Barcode    *string     `json:"barcode" xml:"barcode"`
+    SKU        *string     `json:"sku" xml:"sku"`
+    Attributes *Attributes `json:"attributes" xml:"attributes"`
+}
+
+// SearchResult is a product found by a search with its score: the relevance Rank of a
+// full-text search, or the Similarity of its name to the text of a fuzzy one.
+type SearchResult struct {
+    Product
+    Rank       float64 `json:"rank,omitempty"`
+    Similarity float64 `json:"similarity,omitempty"`
+}
+
+// ListQuery describes one page of a product listing.
+type ListQuery struct {
+    Filter ProductFilter
+    Sort   string
+    Desc   bool
+    Limit  int
+    // Currency, when set, is the currency prices are converted to.
+    Currency string
+    // After continues the listing after the row a previous page ended with.
+    After *listCursor
+    // Deadline, when set, is when scanning must stop; what was read by then is returned
+    // as a partial page.
+    Deadline time.Time
+    // Fields, when set, are the only fields of the products the caller needs. Repositories
+    // may leave the others out.
+    Fields FieldSelection
+    // Expand is the related resources the caller will expand the products with, whose
+    // fields repositories must not leave out.
+    Expand Expansion
+}
+
+// selection returns the fields to send of each product of the page, or nil for every field
+// of a plain product.
+func (q ListQuery) selection() FieldSelection {
+    return q.Expand.selection(q.Fields, Product{})
+}
+
+// ProductRepository stores and retrieves products. Handlers depend on this interface rather
+// than on SQL, so it can be backed by Postgres in production and by memory in tests. The
+// Postgres implementation records every change in the audit log, attributed to the
+// principal and request ID found in ctx.
+type ProductRepository interface {
+    // GetByID returns the product with the given ID, or ErrProductNotFound.
+    GetByID(ctx context.Context, id int) (Product, error)
+    // GetByIDWithDeleted is like GetByID but also finds soft-deleted products.
+    GetByIDWithDeleted(ctx context.Context, id int) (Product, error)
+    // GetByIDs returns the live products with the given IDs, in ID order. IDs with no live
+    // product are left out rather than reported as an error.
+    GetByIDs(ctx context.Context, ids []int) ([]Product, error)
+    // GetByBarcode returns the product with the given barcode, or ErrProductNotFound.
+    GetByBarcode(ctx context.Context, code string) (Product, error)
+    // List returns one page of products matching the query.
+    List(ctx context.Context, q ListQuery) (ProductList, error)
+    // Each calls fn for every product matching the filter, in ID order, without loading
+    // them all at once. It stops at the first error fn returns.
+    Each(ctx context.Context, f ProductFilter, fn func(Product) error) error
+    // Search returns up to limit published products matching every term of query, most
+    // relevant first. The last term also matches as a prefix, so results follow what a user
+    // types.
+    Search(ctx context.Context, terms []string, limit int) ([]SearchResult, error)
+    // FuzzySearch returns up to limit published products whose name has a trigram
+    // similarity to text of at least threshold, most similar first, so misspelled names
+    // still match.
+    FuzzySearch(ctx context.Context, text string, threshold float64, limit int) ([]SearchResult, error)
+    // Expand returns products with the related resources e asks for, in the same order.
+    // Each kind of resource is loaded for every product at once.
+    Expand(ctx context.Context, products []Product, e Expansion) ([]ExpandedProduct, error)
+    // Facets counts the products matching the filter by category, by tag and by price, in
+    // buckets of width priceInterval, as described by ProductFacets.
+    Facets(ctx context.Context, f ProductFilter, priceInterval Money) (ProductFacets, error)
+    // Create stores a new product and fills in its ID and creation time.
+    Create(ctx context.Context, product *Product) error
+    // CreateBatch stores several new products in one transaction, filling in their IDs and
+    // creation times. The returned slice holds the error of each product that was skipped,
+    // one of the conflict and unknown reference errors; the others are committed together.
+    // If the batch as a whole fails, nothing is stored and only the second error is set.
+    CreateBatch(ctx context.Context, products []Product) ([]error, error)
+    // Update overwrites the product with product.ID, filling in any fields the caller does
+    // not control. It reports whether anything changed; when nothing would, no write is made.
+    // product.Version must be the current version of the product, or ErrVersionMismatch is
+    // returned; zero skips the check. On success it holds the new version.
+    Update(ctx context.Context, product *Product) (bool, error)
+    // Upsert updates the oldest product with the same name as product, or creates one if
+    // there is none. It fills in the ID and creation time and reports whether it created.
+    Upsert(ctx context.Context, product *Product) (bool, error)
+    // UpsertBySKU updates the product with product.SKU, restoring it if it was deleted, or
+    // creates one if there is none. It fills in the ID, creation time and version and
+    // reports whether it created the product and whether it changed it. When nothing would
+    // change, no write is made.
+    UpsertBySKU(ctx context.Context, product *Product) (created, changed bool, err error)
+    // Patch applies the non-nil fields of patch to the product with the given ID and returns
+    // the result, or ErrProductNotFound. version is checked as for Update.
+    Patch(ctx context.Context, id, version int, patch ProductPatch) (Product, error)
+    // Delete soft-deletes the product with the given ID, or returns ErrProductNotFound.
+    // Soft-deleted products are left out of every other method unless asked for.
+    // version is checked as for Update.
+    Delete(ctx context.Context, id, version int) error
+    // Restore undoes the soft delete of the product with the given ID and returns it. It
+    // returns ErrProductNotFound if there is no such deleted product and ErrBarcodeInUse
+    // if its barcode has been given to another product in the meantime.
+    Restore(ctx context.Context, id int) (Product, error)
+}
+
+// versionMatches reports whether a write made against the expected version may go ahead on
+// a product currently at version current. An expected version of zero matches anything.
+func versionMatches(expected, current int) bool {
+    return expected == 0 || expected == current
+}
+
+// Repo is a global variable that holds the product repository used by the handlers.
+var Repo ProductRepository
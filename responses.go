@@ -0,0 +1,144 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Error codes, the machine-readable part of ErrorResponse. Clients may rely on them, so
+// existing codes must not change.
+const (
+    codeInvalidBody              = "INVALID_BODY"
+    codeBodyTooLarge             = "BODY_TOO_LARGE"
+    codeInvalidUpload            = "INVALID_UPLOAD"
+    codeInvalidID                = "INVALID_ID"
+    codeInvalidParameter         = "INVALID_PARAMETER"
+    codeInvalidBatchSize         = "INVALID_BATCH_SIZE"
+    codeValidationFailed         = "VALIDATION_FAILED"
+    codeUnsupportedCurrency      = "UNSUPPORTED_CURRENCY"
+    codeInvalidIdempotencyKey    = "INVALID_IDEMPOTENCY_KEY"
+    codeIdempotencyKeyInProgress = "IDEMPOTENCY_KEY_IN_PROGRESS"
+    codeIdempotencyKeyReused     = "IDEMPOTENCY_KEY_REUSED"
+    codeUnauthorized             = "UNAUTHORIZED"
+    codeInvalidCredentials       = "INVALID_CREDENTIALS"
+    codeForbidden                = "FORBIDDEN"
+    codeProductNotFound          = "PRODUCT_NOT_FOUND"
+    codeCategoryNotFound         = "CATEGORY_NOT_FOUND"
+    codeVariantNotFound          = "VARIANT_NOT_FOUND"
+    codeImageNotFound            = "IMAGE_NOT_FOUND"
+    codePriceNotFound            = "PRICE_NOT_FOUND"
+    codeScheduledPriceNotFound   = "SCHEDULED_PRICE_NOT_FOUND"
+    codeAPIKeyNotFound           = "API_KEY_NOT_FOUND"
+    codeWebhookNotFound          = "WEBHOOK_NOT_FOUND"
+    codeDeliveryNotFound         = "DELIVERY_NOT_FOUND"
+    codeReviewNotFound           = "REVIEW_NOT_FOUND"
+    codeRelationNotFound         = "RELATION_NOT_FOUND"
+    codeTagNotFound              = "TAG_NOT_FOUND"
+    codeVendorNotFound           = "VENDOR_NOT_FOUND"
+    codeUserNotFound             = "USER_NOT_FOUND"
+    codeFavoriteNotFound         = "FAVORITE_NOT_FOUND"
+    codeCartNotFound             = "CART_NOT_FOUND"
+    codeCartItemNotFound         = "CART_ITEM_NOT_FOUND"
+    codePromotionNotFound        = "PROMOTION_NOT_FOUND"
+    codeCouponNotFound           = "COUPON_NOT_FOUND"
+    codeNoResults                = "NO_RESULTS"
+    codeNotFound                 = "NOT_FOUND"
+    codeMethodNotAllowed         = "METHOD_NOT_ALLOWED"
+    codeNotAcceptable            = "NOT_ACCEPTABLE"
+    codeBarcodeInUse             = "BARCODE_IN_USE"
+    codeSKUInUse                 = "SKU_IN_USE"
+    codeCategoryExists           = "CATEGORY_EXISTS"
+    codeReviewExists             = "REVIEW_EXISTS"
+    codeTagExists                = "TAG_EXISTS"
+    codeVendorExists             = "VENDOR_EXISTS"
+    codeCouponExists             = "COUPON_EXISTS"
+    codeCouponNotRedeemable      = "COUPON_NOT_REDEEMABLE"
+    codeCategoryNotEmpty         = "CATEGORY_NOT_EMPTY"
+    codeVendorNotEmpty           = "VENDOR_NOT_EMPTY"
+    codeInsufficientStock        = "INSUFFICIENT_STOCK"
+    codeScheduledPriceNotPending = "SCHEDULED_PRICE_NOT_PENDING"
+    codeDeliveryNotFailed        = "DELIVERY_NOT_FAILED"
+    codePreconditionFailed       = "PRECONDITION_FAILED"
+    codePreconditionRequired     = "PRECONDITION_REQUIRED"
+    codeImageTooLarge            = "IMAGE_TOO_LARGE"
+    codeUnsupportedImageType     = "UNSUPPORTED_IMAGE_TYPE"
+    codeInvalidImage             = "INVALID_IMAGE"
+    codeRateLimited              = "RATE_LIMITED"
+    codeInternal                 = "INTERNAL_ERROR"
+    codeUnavailable              = "SERVICE_UNAVAILABLE"
+    codeTimeout                  = "TIMEOUT"
+    codeTenantNotFound           = "TENANT_NOT_FOUND"
+    codeTenantDisabled           = "TENANT_DISABLED"
+    codeTenantExists             = "TENANT_EXISTS"
+    codeReadOnlyForced           = "READ_ONLY_FORCED"
+    codeInvalidConfig            = "INVALID_CONFIG"
+    codeUnknownAPIVersion        = "UNKNOWN_API_VERSION"
+)
+
+// respondError writes an error response with the given status, code and message. Every
+// error response goes through here or respondErrorBody, so they all have the same shape.
+func respondError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    respondErrorBody(w, r, status, ErrorResponse{Code: code, Error: message})
+}
+
+// respondErrorBody writes body as an error response with the given status, stamped with the
+// request ID the logging middleware assigned, in the media type the client asked for.
+func respondErrorBody(w http.ResponseWriter, r *http.Request, status int, body ErrorResponse) {
+    body.RequestID = w.Header().Get("X-Request-ID")
+    mediaType := responseMediaType(r)
+    encoded, err := marshalBody(mediaType, body)
+    if err != nil {
+        mediaType = mediaJSON
+        encoded, _ = json.Marshal(body)
+    }
+    writeBody(w, mediaType, status, encoded)
+}
+
+// defaultRetryAfter is used for 503 responses when there is no better estimate of when the
+// service will be available again.
+const defaultRetryAfter = 30 * time.Second
+
+// respondUnavailable writes a 503 Service Unavailable response. Every 503 goes through here
+// so that clients always get a Retry-After header telling them when to back off until.
+// A non-positive retryAfter falls back to defaultRetryAfter.
+func respondUnavailable(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+    if retryAfter <= 0 {
+        retryAfter = defaultRetryAfter
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+    respondError(w, r, http.StatusServiceUnavailable, codeUnavailable, message)
+}
+
+// respondEmptyList writes a 404 Not Found response for an empty listing if the server is
+// configured to prefer that over 200 with an empty array. It reports whether it responded.
+func respondEmptyList(w http.ResponseWriter, r *http.Request, count int) bool {
+    if count > 0 || !AppConfig.EmptyListNotFound {
+        return false
+    }
+    respondError(w, r, http.StatusNotFound, codeNoResults, "No matching results.")
+    return true
+}
+
+// respondStoreError answers a failed database call. If the circuit breaker of the database
+// is open it writes a 503 Service Unavailable, and if the request ran out of time waiting on
+// the database a 504 Gateway Timeout; otherwise it logs err and writes a 500 Internal Server
+// Error with the given message.
+func respondStoreError(w http.ResponseWriter, r *http.Request, err error, message string) {
+    var unavailable errDatabaseUnavailable
+    if errors.As(err, &unavailable) {
+        respondUnavailable(w, r, unavailable.RetryAfter, "The database is unavailable.")
+        return
+    }
+    if errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+        logError(r, err)
+        respondError(w, r, http.StatusGatewayTimeout, codeTimeout, "The database did not respond in time.")
+        return
+    }
+    logError(r, err)
+    respondError(w, r, http.StatusInternalServerError, codeInternal, message)
+}
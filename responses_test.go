@@ -0,0 +1,120 @@
+package main
+
+import (
+    "database/sql/driver"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRespondUnavailable(t *testing.T) {
+    tests := []struct {
+        retryAfter time.Duration
+        header     string
+    }{
+        {retryAfter: 0, header: "30"},
+        {retryAfter: -time.Second, header: "30"},
+        {retryAfter: 10 * time.Second, header: "10"},
+        {retryAfter: 1500 * time.Millisecond, header: "2"},
+        {retryAfter: time.Millisecond, header: "1"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.retryAfter.String(), func(t *testing.T) {
+            setupHandlers(t)
+
+            w := httptest.NewRecorder()
+            respondUnavailable(w, newTestRequest("GET", "/products", "", RoleViewer, nil), tt.retryAfter, "Try again later.")
+            if w.Code != http.StatusServiceUnavailable || errorCode(w) != codeUnavailable {
+                t.Errorf("got %d %q, want 503 %q", w.Code, errorCode(w), codeUnavailable)
+            }
+            if got := w.Header().Get("Retry-After"); got != tt.header {
+                t.Errorf("Retry-After = %q, want %q", got, tt.header)
+            }
+        })
+    }
+}
+
+func TestRespondStoreErrorUnavailable(t *testing.T) {
+    setupHandlers(t)
+
+    w := httptest.NewRecorder()
+    err := fmt.Errorf("listing products: %w", errDatabaseUnavailable{RetryAfter: 4200 * time.Millisecond})
+    respondStoreError(w, newTestRequest("GET", "/products", "", RoleViewer, nil), err, "Failed to retrieve products.")
+    if w.Code != http.StatusServiceUnavailable {
+        t.Fatalf("status = %d, want 503", w.Code)
+    }
+    if got := w.Header().Get("Retry-After"); got != "5" {
+        t.Errorf("Retry-After = %q, want %q", got, "5")
+    }
+}
+
+// TestEmptyLists checks that every list endpoint answers an empty array when nothing
+// matches, or 404 when EMPTY_LIST_NOT_FOUND is set. Endpoints answering a page object are
+// checked for an empty array in the field holding the list.
+func TestEmptyLists(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    tests := []struct {
+        name    string
+        handler http.HandlerFunc
+        target  string
+        vars    map[string]string
+        field   string
+    }{
+        {name: "products", handler: getProducts, target: "/products?category=garden", field: "products"},
+        {name: "search", handler: searchProducts, target: "/products/search?q=hammock"},
+        {name: "categories", handler: getCategories, target: "/categories"},
+        {name: "category tree", handler: getCategories, target: "/categories?tree=true"},
+        {name: "tags", handler: getTags, target: "/tags"},
+        {name: "vendors", handler: getVendors, target: "/vendors"},
+        {name: "promotions", handler: getPromotions, target: "/promotions"},
+        {name: "coupons", handler: getCoupons, target: "/coupons"},
+        {name: "images", handler: getImages, target: "/products/1/images", vars: product},
+        {name: "currency prices", handler: getCurrencyPrices, target: "/products/1/currency-prices", vars: product},
+        {name: "variants", handler: getVariants, target: "/products/1/variants", vars: product},
+        {name: "reviews", handler: getReviews, target: "/products/1/reviews", vars: product, field: "reviews"},
+        {name: "relations", handler: getProductRelations, target: "/products/1/relations", vars: product},
+        {name: "recommendations", handler: getRecommendations, target: "/products/1/recommendations", vars: product},
+        {name: "webhooks", handler: getWebhooks, target: "/admin/webhooks"},
+        {name: "deliveries", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries", vars: map[string]string{"id": "1"}},
+        {name: "attempts", handler: getDeliveryAttempts, target: "/admin/webhooks/1/deliveries/2/attempts", vars: map[string]string{"id": "1", "delivery_id": "2"}},
+        {name: "tenants", handler: getTenants, target: "/tenants"},
+    }
+    for _, tt := range tests {
+        for _, notFound := range []bool{false, true} {
+            t.Run(fmt.Sprintf("%s/not found %v", tt.name, notFound), func(t *testing.T) {
+                repo := setupHandlers(t)
+                AppConfig.EmptyListNotFound = notFound
+                seedProduct(t, repo, Product{Name: "Lamp", Category: "home", Price: 1999})
+                // The webhook and delivery the listings are of exist; nothing else is found.
+                stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                    if strings.HasPrefix(query, "SELECT EXISTS") {
+                        return []string{"exists"}, [][]driver.Value{{true}}, nil
+                    }
+                    return nil, nil, nil
+                }
+
+                w := httptest.NewRecorder()
+                tt.handler(w, newTestRequest("GET", tt.target, "", RoleAdmin, tt.vars))
+
+                if notFound {
+                    if w.Code != http.StatusNotFound || errorCode(w) != codeNoResults {
+                        t.Fatalf("got %d %q, want 404 %s", w.Code, errorCode(w), codeNoResults)
+                    }
+                    return
+                }
+                if w.Code != http.StatusOK {
+                    t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+                }
+                body := strings.TrimSpace(w.Body.String())
+                if tt.field == "" && body != "[]" {
+                    t.Errorf("body = %s, want []", body)
+                } else if tt.field != "" && !strings.Contains(body, `"`+tt.field+`":[]`) {
+                    t.Errorf("body = %s, want an empty %s array", body, tt.field)
+                }
+            })
+        }
+    }
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+)
+
+// Limits on the text of a review.
+const (
+    maxReviewTitleLength = 200
+    maxReviewBodyLength  = 5000
+)
+
+// ProductRating summarises the reviews of a product. The totals are kept on the product by
+// a trigger on product_reviews.
+type ProductRating struct {
+    // AverageRating is the mean star rating, rounded to two decimals, or zero without
+    // reviews.
+    AverageRating float64 `json:"average_rating" xml:"average_rating"`
+    ReviewCount   int     `json:"review_count" xml:"review_count"`
+}
+
+// Review is a customer's review of a product: a rating from one to five stars with an
+// optional title and text. Each reviewer can review a product once.
+type Review struct {
+    ID        int       `json:"id" xml:"id"`
+    ProductID int       `json:"product_id" xml:"product_id"`
+    Author    string    `json:"author" xml:"author"`
+    Rating    int       `json:"rating" xml:"rating"`
+    Title     string    `json:"title,omitempty" xml:"title,omitempty"`
+    Body      string    `json:"body,omitempty" xml:"body,omitempty"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+// ReviewPage is one page of a product's reviews, newest first, together with the rating
+// summary. NextBeforeID, when set, fetches the following page as ?before_id=.
+type ReviewPage struct {
+    ProductRating
+    Reviews      []Review `json:"reviews" xml:"reviews>review"`
+    NextBeforeID int      `json:"next_before_id,omitempty" xml:"next_before_id,omitempty"`
+}
+
+// reviewColumns are the columns scanned by scanReview, in order.
+const reviewColumns = "id, product_id, author, rating, title, body, created_at"
+
+// Validate checks the fields of a review payload.
+func (v Review) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if v.Rating < 1 || v.Rating > 5 {
+        errs.add("rating", "must be between 1 and 5")
+    }
+    if utf8.RuneCountInString(v.Title) > maxReviewTitleLength {
+        errs.add("title", "must be at most 200 characters")
+    }
+    if utf8.RuneCountInString(v.Body) > maxReviewBodyLength {
+        errs.add("body", "must be at most 5000 characters")
+    }
+    return errs
+}
+
+// scanReview reads the reviewColumns of one row through scan.
+func scanReview(scan func(dest ...interface{}) error) (Review, error) {
+    var v Review
+    err := scan(&v.ID, &v.ProductID, &v.Author, &v.Rating, &v.Title, &v.Body, &v.CreatedAt)
+    return v, err
+}
+
+// getReviews lists the reviews of a live product, newest first, a page at a time.
+func getReviews(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    limit := AppConfig.DefaultPageSize
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > AppConfig.MaxPageSize {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+    beforeID := 0
+    if beforeStr := r.URL.Query().Get("before_id"); beforeStr != "" {
+        if beforeID, err = strconv.Atoi(beforeStr); err != nil || beforeID < 1 {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid before_id.")
+            return
+        }
+    }
+
+    product, err := Repo.GetByID(r.Context(), productID)
+    if err == ErrProductNotFound {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve reviews.")
+        return
+    }
+    if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionRead, product), "Failed to retrieve reviews.") {
+        return
+    }
+
+    // Fetch one review more than the page holds to learn whether another page follows.
+    page := ReviewPage{ProductRating: product.ProductRating, Reviews: []Review{}}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        review, err := scanReview(scan)
+        if err != nil {
+            return err
+        }
+        page.Reviews = append(page.Reviews, review)
+        return nil
+    }, "SELECT "+reviewColumns+" FROM product_reviews WHERE product_id = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3",
+        productID, beforeID, limit+1)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve reviews.")
+        return
+    }
+    if len(page.Reviews) > limit {
+        page.Reviews = page.Reviews[:limit]
+        page.NextBeforeID = page.Reviews[limit-1].ID
+    }
+
+    if respondEmptyList(w, r, len(page.Reviews)) {
+        return
+    }
+
+    // If everything went well, return the page of reviews in the response body.
+    respond(w, r, http.StatusOK, page)
+}
+
+// createReview adds the caller's review of a live product from a body like
+// {"rating": 4, "title": "Sturdy", "body": "Survived a year of daily use."}. The product's
+// average rating and review count are updated with it.
+func createReview(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    // Reviews are attributed to whoever wrote them, so anonymous reads can't review.
+    principal, ok := principalFromContext(r.Context())
+    if !ok {
+        respondError(w, r, http.StatusUnauthorized, codeUnauthorized, "Sign in to review products.")
+        return
+    }
+
+    var review Review
+    if err := decodeBody(r, &review); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    review.Title, review.Body = strings.TrimSpace(review.Title), strings.TrimSpace(review.Body)
+    if errs := review.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    // Anyone who may see a product may review it.
+    if !allowProduct(w, r, ActionRead, productID, "Failed to create review.") {
+        return
+    }
+
+    // The insert selects nothing, and so returns no row, if the product isn't live.
+    review, err = scanReview(DB.QueryRowContext(r.Context(), `INSERT INTO product_reviews (product_id, author, rating, title, body)
+        SELECT id, $2, $3, $4, $5 FROM products WHERE id = $1 AND deleted_at IS NULL
+        RETURNING `+reviewColumns, productID, principal.Subject, review.Rating, review.Title, review.Body).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if isUniqueViolation(err) {
+        respondError(w, r, http.StatusConflict, codeReviewExists, "You have already reviewed this product.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create review.")
+        return
+    }
+
+    // The product's rating changed, so the cached copy is stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 201 Created response with the new review.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d/reviews/%d", productID, review.ID))
+    respond(w, r, http.StatusCreated, review)
+}
+
+// deleteReview removes a review of a product, for moderation.
+func deleteReview(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    reviewID, err := strconv.Atoi(mux.Vars(r)["review_id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid review ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM product_reviews WHERE id = $1 AND product_id = $2", reviewID, productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete review.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete review.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeReviewNotFound, "Review not found.")
+        return
+    }
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestReviewHandlers(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    missing := map[string]string{"id": "99"}
+    invalid := map[string]string{"id": "abc", "review_id": "5"}
+    review := map[string]string{"id": "1", "review_id": "5"}
+    tests := []handlerTest{
+        {name: "list", handler: getReviews, target: "/products/1/reviews", vars: product,
+            answer: answerRows(map[string][]driver.Value{"FROM product_reviews": {int64(5), int64(1), "alice", int64(4), "Sturdy", "", time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "list invalid id", handler: getReviews, target: "/products/abc/reviews", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "list invalid limit", handler: getReviews, target: "/products/1/reviews?limit=-1", vars: product, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "list invalid before_id", handler: getReviews, target: "/products/1/reviews?before_id=x", vars: product, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "list missing product", handler: getReviews, target: "/products/99/reviews", vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "create", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": 4}`, vars: product,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO product_reviews": {int64(5), int64(1), "tester", int64(4), "", "", time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create invalid id", handler: createReview, method: "POST", target: "/products/abc/reviews", body: `{"rating": 4}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "create anonymous", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": 4}`, vars: product, anonymous: true, status: http.StatusUnauthorized, code: codeUnauthorized},
+        {name: "create malformed", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": "four"}`, vars: product, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid rating", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": 6}`, vars: product, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create missing product", handler: createReview, method: "POST", target: "/products/99/reviews", body: `{"rating": 4}`, vars: missing, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "create second review", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": 4}`, vars: product, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeReviewExists},
+        {name: "delete", handler: deleteReview, method: "DELETE", target: "/products/1/reviews/5", vars: review, answer: answerRows(map[string][]driver.Value{"DELETE FROM product_reviews": {int64(5)}}), status: http.StatusNoContent},
+        {name: "delete invalid product id", handler: deleteReview, method: "DELETE", target: "/products/abc/reviews/5", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete invalid review id", handler: deleteReview, method: "DELETE", target: "/products/1/reviews/x", vars: map[string]string{"id": "1", "review_id": "x"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteReview, method: "DELETE", target: "/products/1/reviews/5", vars: review, status: http.StatusNotFound, code: codeReviewNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getReviews, target: "/products/1/reviews", vars: product},
+        handlerTest{name: "create", handler: createReview, method: "POST", target: "/products/1/reviews", body: `{"rating": 4}`, vars: product},
+        handlerTest{name: "delete", handler: deleteReview, method: "DELETE", target: "/products/1/reviews/5", vars: review},
+    ))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "log/slog"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// jobLockKey is the Postgres advisory lock key that, together with a hash of the job name,
+// keeps instances from running the same job at the same time.
+const jobLockKey = 7495006
+
+// Job is work the scheduler runs every Interval, starting when the scheduler starts. A run
+// that fails is logged and recorded, and the job is run again at the next tick.
+type Job struct {
+    Name     string
+    Interval time.Duration
+    // Shared jobs coordinate through the database themselves, like the webhook dispatcher
+    // leasing deliveries, so every instance runs them. Others run on one instance at a time.
+    Shared bool
+    Run    func(ctx context.Context) error
+}
+
+// JobStatus is a job with the outcome of its last run, on whichever instance ran it.
+type JobStatus struct {
+    Name     string `json:"name" xml:"name"`
+    Interval string `json:"interval" xml:"interval"`
+    Shared   bool   `json:"shared" xml:"shared"`
+    // NextRunAt is when this instance next runs or tries to run the job.
+    NextRunAt      *time.Time `json:"next_run_at,omitempty" xml:"next_run_at,omitempty"`
+    LastStartedAt  *time.Time `json:"last_started_at,omitempty" xml:"last_started_at,omitempty"`
+    LastFinishedAt *time.Time `json:"last_finished_at,omitempty" xml:"last_finished_at,omitempty"`
+    LastDurationMs int64      `json:"last_duration_ms" xml:"last_duration_ms"`
+    LastError      string     `json:"last_error,omitempty" xml:"last_error,omitempty"`
+    LastInstance   string     `json:"last_instance,omitempty" xml:"last_instance,omitempty"`
+    Runs           int64      `json:"runs" xml:"runs"`
+    Failures       int64      `json:"failures" xml:"failures"`
+}
+
+// Scheduler runs recurring jobs in the background. Add every job before calling Start.
+type Scheduler struct {
+    jobs []Job
+
+    mu   sync.Mutex
+    next map[string]time.Time
+}
+
+// Jobs is a global variable that holds the scheduler of this instance's background jobs.
+var Jobs = &Scheduler{}
+
+// instanceName identifies this instance in the status of the jobs it ran.
+var instanceName = func() string {
+    host, err := os.Hostname()
+    if err != nil {
+        return "unknown"
+    }
+    return host
+}()
+
+// Add registers job. Jobs with a zero interval are left out, which is how the configuration
+// turns a job off on an instance.
+func (s *Scheduler) Add(job Job) {
+    if job.Interval > 0 {
+        s.jobs = append(s.jobs, job)
+    }
+}
+
+// Start runs every job in its own goroutine until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) {
+    for _, job := range s.jobs {
+        go s.loop(ctx, job)
+    }
+}
+
+// loop runs job right away and then every interval until ctx is done.
+func (s *Scheduler) loop(ctx context.Context, job Job) {
+    ticker := time.NewTicker(job.Interval)
+    defer ticker.Stop()
+    for {
+        s.setNext(job.Name, time.Now().Add(job.Interval))
+        if err := runJob(ctx, job); err != nil && ctx.Err() == nil {
+            slog.Error("running job", "job", job.Name, "error", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// setNext notes when job is next run.
+func (s *Scheduler) setNext(name string, at time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.next == nil {
+        s.next = map[string]time.Time{}
+    }
+    s.next[name] = at
+}
+
+// nextRun returns when the job with the given name is next run, if it has been started.
+func (s *Scheduler) nextRun(name string) (time.Time, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    at, ok := s.next[name]
+    return at, ok
+}
+
+// runJob runs job once and records the outcome, unless it isn't shared and another instance
+// is running it, in which case the run is skipped.
+func runJob(ctx context.Context, job Job) error {
+    if !job.Shared {
+        // Advisory locks are held per session, so pin a connection for the whole run.
+        conn, err := DB.Conn(ctx)
+        if err != nil {
+            return err
+        }
+        defer conn.Close()
+        var locked bool
+        if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, hashtext($2))", jobLockKey, job.Name).Scan(&locked); err != nil {
+            return err
+        } else if !locked {
+            return nil
+        }
+        // Unlock with a fresh context so a cancelled run cannot return a locked session to
+        // the pool.
+        defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, hashtext($2))", jobLockKey, job.Name)
+    }
+
+    started := time.Now()
+    runErr := job.Run(ctx)
+    if ctx.Err() != nil {
+        // Shutting down; a run cut short says nothing about the job.
+        return runErr
+    }
+    if err := recordJobRun(context.Background(), job.Name, started, runErr); err != nil {
+        slog.Error("recording job run", "job", job.Name, "error", err)
+    }
+    return runErr
+}
+
+// recordJobRun stores the outcome of a run of the named job that began at started.
+func recordJobRun(ctx context.Context, name string, started time.Time, runErr error) error {
+    lastError, failures := "", 0
+    if runErr != nil {
+        lastError, failures = runErr.Error(), 1
+    }
+    _, err := DB.ExecContext(ctx, `INSERT INTO jobs (name, last_started_at, last_finished_at, last_error, last_instance, runs, failures)
+        VALUES ($1, $2, now(), $3, $4, 1, $5)
+        ON CONFLICT (name) DO UPDATE SET last_started_at = EXCLUDED.last_started_at, last_finished_at = EXCLUDED.last_finished_at,
+            last_error = EXCLUDED.last_error, last_instance = EXCLUDED.last_instance, runs = jobs.runs + 1, failures = jobs.failures + EXCLUDED.failures`,
+        name, started, lastError, instanceName, failures)
+    return err
+}
+
+// getJobs lists the background jobs of this instance with the outcome of their last run.
+func getJobs(w http.ResponseWriter, r *http.Request) {
+    statuses := make([]JobStatus, len(Jobs.jobs))
+    byName := make(map[string]*JobStatus, len(Jobs.jobs))
+    for i, job := range Jobs.jobs {
+        statuses[i] = JobStatus{Name: job.Name, Interval: job.Interval.String(), Shared: job.Shared}
+        if at, ok := Jobs.nextRun(job.Name); ok {
+            statuses[i].NextRunAt = &at
+        }
+        byName[job.Name] = &statuses[i]
+    }
+
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var name string
+        var started, finished sql.NullTime
+        var lastError, instance string
+        var runs, failures int64
+        if err := scan(&name, &started, &finished, &lastError, &instance, &runs, &failures); err != nil {
+            return err
+        }
+        status, ok := byName[name]
+        if !ok {
+            // A job that isn't configured on this instance.
+            return nil
+        }
+        if started.Valid && finished.Valid {
+            status.LastStartedAt, status.LastFinishedAt = &started.Time, &finished.Time
+            status.LastDurationMs = finished.Time.Sub(started.Time).Milliseconds()
+        }
+        status.LastError, status.LastInstance, status.Runs, status.Failures = lastError, instance, runs, failures
+        return nil
+    }, "SELECT name, last_started_at, last_finished_at, last_error, last_instance, runs, failures FROM jobs")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve jobs.")
+        return
+    }
+
+    // If everything went well, return the jobs in the response body.
+    respond(w, r, http.StatusOK, statuses)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// Bounds on search requests.
+const (
+    defaultSearchLimit = 20
+    maxSearchLimit     = 100
+    maxSearchTerms     = 10
+)
+
+// searchTerms splits text into lower-case words of letters and digits. Everything else
+// separates words, which also keeps tsquery operators out of user input.
+func searchTerms(text string) []string {
+    return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+}
+
+// searchProducts runs a full-text search over product names and categories and returns the
+// matches ordered by relevance. The search goes to the search index when one is configured,
+// and to Postgres if it is not or fails. With ?fuzzy=true it matches product names by
+// trigram similarity in Postgres instead, which tolerates typos, and orders the matches by
+// similarity.
+func searchProducts(w http.ResponseWriter, r *http.Request) {
+    terms := searchTerms(r.URL.Query().Get("q"))
+    if len(terms) == 0 || len(terms) > maxSearchTerms {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Search query must contain between 1 and 10 words.")
+        return
+    }
+
+    limit := defaultSearchLimit
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        var err error
+        limit, err = strconv.Atoi(limitStr)
+        if err != nil || limit < 1 || limit > maxSearchLimit {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+
+    fuzzy := false
+    if fuzzyStr := r.URL.Query().Get("fuzzy"); fuzzyStr != "" {
+        var err error
+        fuzzy, err = strconv.ParseBool(fuzzyStr)
+        if err != nil {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid fuzzy.")
+            return
+        }
+    }
+
+    var results []SearchResult
+    var err error
+    switch {
+    case fuzzy:
+        results, err = Repo.FuzzySearch(r.Context(), strings.Join(terms, " "), AppConfig.SearchFuzzyThreshold, limit)
+    case Searches != nil:
+        results, err = searchIndexedProducts(r.Context(), terms, limit)
+        if err != nil && r.Context().Err() == nil {
+            logError(r, err)
+            results, err = Repo.Search(r.Context(), terms, limit)
+        }
+    default:
+        results, err = Repo.Search(r.Context(), terms, limit)
+    }
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to search products.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(results)) {
+        return
+    }
+
+    // If everything went well, return the results in the response body.
+    respond(w, r, http.StatusOK, results)
+}
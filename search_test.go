@@ -0,0 +1,70 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+)
+
+func TestTrigramSimilarity(t *testing.T) {
+    tests := []struct {
+        a, b     string
+        min, max float64
+    }{
+        {a: "Desk lamp", b: "desk LAMP", min: 1, max: 1},
+        {a: "Desk lamp", b: "Chair", min: 0, max: 0},
+        {a: "Desk lamp", b: "dsk lamp", min: 0.5, max: 0.99},
+        {a: "Desk lamp", b: "", min: 0, max: 0},
+    }
+    for _, tt := range tests {
+        if got := trigramSimilarity(tt.a, tt.b); got < tt.min || got > tt.max {
+            t.Errorf("trigramSimilarity(%q, %q) = %v, want between %v and %v", tt.a, tt.b, got, tt.min, tt.max)
+        }
+    }
+}
+
+func TestSearchProductsFuzzy(t *testing.T) {
+    tests := []struct {
+        name   string
+        query  string
+        status int
+        names  []string
+    }{
+        {name: "exact words", query: "?q=desk+lamp", status: http.StatusOK, names: []string{"Desk lamp"}},
+        {name: "typo", query: "?q=dsk+lampp", status: http.StatusOK, names: []string{}},
+        {name: "fuzzy typo", query: "?q=dsk+lampp&fuzzy=true", status: http.StatusOK, names: []string{"Desk lamp"}},
+        {name: "fuzzy unrelated", query: "?q=sofa&fuzzy=true", status: http.StatusOK, names: []string{}},
+        {name: "invalid fuzzy", query: "?q=lamp&fuzzy=maybe", status: http.StatusBadRequest},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            repo := setupHandlers(t)
+            seedProduct(t, repo, Product{Name: "Floor lamp", Category: "home", Price: 8999})
+            seedProduct(t, repo, Product{Name: "Desk lamp", Category: "office", Price: 2499})
+            seedProduct(t, repo, Product{Name: "Chair", Category: "office", Price: 4999})
+            seedProduct(t, repo, Product{Name: "Desk lamp draft", Category: "office", Price: 2499, Status: StatusDraft})
+
+            w := httptest.NewRecorder()
+            searchProducts(w, newTestRequest("GET", "/products/search"+tt.query, "", RoleViewer, nil))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+            }
+            if tt.status != http.StatusOK {
+                return
+            }
+            var results []SearchResult
+            if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+                t.Fatalf("decoding results: %v", err)
+            }
+            names := []string{}
+            for _, result := range results {
+                names = append(names, result.Name)
+            }
+            if !reflect.DeepEqual(names, tt.names) {
+                t.Errorf("found %q, want %q", names, tt.names)
+            }
+        })
+    }
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "time"
+)
+
+// seedBatchSize is how many generated products SeedProducts stores per transaction.
+const seedBatchSize = 500
+
+// Price distributions fake products can be generated with.
+const (
+    // PriceUniform spreads prices evenly between the minimum and the maximum.
+    PriceUniform = "uniform"
+    // PriceNormal clusters prices around the middle of the range.
+    PriceNormal = "normal"
+    // PriceLogNormal makes most products cheap and a few expensive, like a real catalog.
+    PriceLogNormal = "lognormal"
+)
+
+// seedNouns are the kinds of product generated in each of the default categories. Products
+// of other categories are named after the category.
+var seedNouns = map[string][]string{
+    "Electronics":    {"Headphones", "Speaker", "Charger", "Keyboard", "Monitor", "Webcam", "Router", "Smartwatch"},
+    "Books":          {"Novel", "Cookbook", "Biography", "Atlas", "Field Guide", "Anthology"},
+    "Home & Kitchen": {"Kettle", "Blender", "Skillet", "Knife Set", "Coffee Grinder", "Cutting Board"},
+    "Clothing":       {"T-Shirt", "Hoodie", "Jacket", "Sneakers", "Scarf", "Jeans"},
+    "Sports":         {"Yoga Mat", "Dumbbell Set", "Water Bottle", "Tennis Racket", "Running Belt"},
+    "Toys":           {"Puzzle", "Building Blocks", "Board Game", "Plush Bear", "Kite"},
+    "Beauty":         {"Face Cream", "Shampoo", "Lip Balm", "Perfume", "Hair Dryer"},
+    "Garden":         {"Planter", "Hose", "Pruning Shears", "Bird Feeder", "Seed Kit"},
+}
+
+// defaultSeedCategories are the categories fake products are spread over unless others are
+// given, in a stable order.
+var defaultSeedCategories = []string{"Electronics", "Books", "Home & Kitchen", "Clothing", "Sports", "Toys", "Beauty", "Garden"}
+
+// seedAdjectives start the names of fake products.
+var seedAdjectives = []string{"Classic", "Premium", "Compact", "Wireless", "Organic", "Vintage", "Smart", "Deluxe", "Eco", "Portable", "Ultra", "Essential"}
+
+// SeedOptions describes the fake products GenerateProducts makes.
+type SeedOptions struct {
+    // Count is how many products to make.
+    Count int
+    // Categories are taken in turn by the products; empty means defaultSeedCategories.
+    Categories []string
+    // Prices are drawn from PriceDistribution, one of PriceUniform, PriceNormal or
+    // PriceLogNormal, and kept between MinPrice and MaxPrice.
+    PriceDistribution string
+    MinPrice          Money
+    MaxPrice          Money
+    // Seed makes the same options generate the same products every time. Zero picks a new
+    // seed on every call.
+    Seed int64
+}
+
+// DefaultSeedOptions returns options for count products in the default categories, priced
+// like a real catalog between 1.99 and 1999.99.
+func DefaultSeedOptions(count int) SeedOptions {
+    return SeedOptions{Count: count, PriceDistribution: PriceLogNormal, MinPrice: 199, MaxPrice: 199999}
+}
+
+// Validate checks that the options can generate products.
+func (o SeedOptions) Validate() error {
+    switch {
+    case o.Count < 1:
+        return errors.New("count must be positive")
+    case o.MinPrice < 0 || o.MaxPrice > maxPrice || o.MinPrice > o.MaxPrice:
+        return fmt.Errorf("prices must be between 0 and %s, with the minimum at most the maximum", maxPrice)
+    }
+    switch o.PriceDistribution {
+    case PriceUniform, PriceNormal, PriceLogNormal:
+    default:
+        return errors.New("price distribution must be one of uniform, normal or lognormal")
+    }
+    for _, category := range o.Categories {
+        var errs ValidationErrors
+        if validateCategory(&errs, category); len(errs) > 0 {
+            return fmt.Errorf("category %q %s", category, errs[0].Message)
+        }
+    }
+    return nil
+}
+
+// GenerateProducts makes the fake products described by opts. They are published, priced in
+// the base currency and valid, so they can be stored as they are.
+func GenerateProducts(opts SeedOptions) ([]Product, error) {
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+    categories := opts.Categories
+    if len(categories) == 0 {
+        categories = defaultSeedCategories
+    }
+    seed := opts.Seed
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    rng := rand.New(rand.NewSource(seed))
+
+    products := make([]Product, opts.Count)
+    for i := range products {
+        category := categories[i%len(categories)]
+        nouns, ok := seedNouns[category]
+        if !ok {
+            nouns = []string{category + " Item", category + " Set", category + " Kit"}
+        }
+        name := fmt.Sprintf("%s %s %c%c-%03d", seedAdjectives[rng.Intn(len(seedAdjectives))], nouns[rng.Intn(len(nouns))],
+            'A'+rng.Intn(26), 'A'+rng.Intn(26), rng.Intn(1000))
+        products[i] = Product{
+            Name:     name,
+            Category: category,
+            Price:    seedPrice(rng, opts),
+            Currency: AppConfig.BaseCurrency,
+            Status:   StatusPublished,
+        }
+    }
+    return products, nil
+}
+
+// seedPrice draws a price as opts describe. Prices of a unit or more end in .99, as shop
+// prices do.
+func seedPrice(rng *rand.Rand, opts SeedOptions) Money {
+    lo, hi := float64(opts.MinPrice), float64(opts.MaxPrice)
+    var price float64
+    switch opts.PriceDistribution {
+    case PriceUniform:
+        price = lo + rng.Float64()*(hi-lo)
+    case PriceNormal:
+        // Nearly every price falls within three standard deviations of the middle.
+        price = (lo+hi)/2 + rng.NormFloat64()*(hi-lo)/6
+    case PriceLogNormal:
+        // The median is the geometric mean of the bounds, and nearly every price falls
+        // within them.
+        logLo, logHi := math.Log(math.Max(lo, 1)), math.Log(math.Max(hi, 1))
+        price = math.Exp((logLo+logHi)/2 + rng.NormFloat64()*(logHi-logLo)/6)
+    }
+    cents := Money(math.Round(price))
+    if cents >= 100 {
+        cents = cents/100*100 + 99
+    }
+    if cents < opts.MinPrice {
+        cents = opts.MinPrice
+    } else if cents > opts.MaxPrice {
+        cents = opts.MaxPrice
+    }
+    return cents
+}
+
+// SeedProducts generates the products described by opts and stores them in repo, in
+// batches, returning how many were stored. The categories of the products must exist, as
+// ensureSeedCategories makes sure of for Postgres; tests can seed the memory repository
+// directly.
+func SeedProducts(ctx context.Context, repo ProductRepository, opts SeedOptions) (int, error) {
+    products, err := GenerateProducts(opts)
+    if err != nil {
+        return 0, err
+    }
+    stored := 0
+    for start := 0; start < len(products); start += seedBatchSize {
+        end := start + seedBatchSize
+        if end > len(products) {
+            end = len(products)
+        }
+        itemErrs, err := repo.CreateBatch(ctx, products[start:end])
+        if err != nil {
+            return stored, err
+        }
+        for _, itemErr := range itemErrs {
+            if itemErr == nil {
+                stored++
+            }
+        }
+    }
+    return stored, nil
+}
+
+// ensureSeedCategories creates the categories opts spreads products over that the tenant of
+// ctx doesn't have yet, as top-level categories.
+func ensureSeedCategories(ctx context.Context, opts SeedOptions) error {
+    categories := opts.Categories
+    if len(categories) == 0 {
+        categories = defaultSeedCategories
+    }
+    for _, name := range categories {
+        if _, err := DB.ExecContext(ctx, "INSERT INTO categories (name) VALUES ($1) ON CONFLICT DO NOTHING", name); err != nil {
+            return err
+        }
+    }
+    return nil
+}
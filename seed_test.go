@@ -0,0 +1,82 @@
+package main
+
+import (
+    "context"
+    "reflect"
+    "testing"
+)
+
+func TestSeedOptionsValidate(t *testing.T) {
+    tests := []struct {
+        name string
+        edit func(o *SeedOptions)
+        ok   bool
+    }{
+        {name: "default", edit: func(o *SeedOptions) {}, ok: true},
+        {name: "no products", edit: func(o *SeedOptions) { o.Count = 0 }},
+        {name: "negative price", edit: func(o *SeedOptions) { o.MinPrice = -1 }},
+        {name: "minimum above maximum", edit: func(o *SeedOptions) { o.MinPrice, o.MaxPrice = 500, 100 }},
+        {name: "price too high", edit: func(o *SeedOptions) { o.MaxPrice = maxPrice + 1 }},
+        {name: "unknown distribution", edit: func(o *SeedOptions) { o.PriceDistribution = "pareto" }},
+        {name: "invalid category", edit: func(o *SeedOptions) { o.Categories = []string{""} }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            opts := DefaultSeedOptions(10)
+            tt.edit(&opts)
+            if err := opts.Validate(); (err == nil) != tt.ok {
+                t.Errorf("Validate() = %v, want ok %v", err, tt.ok)
+            }
+        })
+    }
+}
+
+func TestGenerateProducts(t *testing.T) {
+    setupHandlers(t)
+    for _, distribution := range []string{PriceUniform, PriceNormal, PriceLogNormal} {
+        t.Run(distribution, func(t *testing.T) {
+            opts := SeedOptions{Count: 200, Categories: []string{"Books", "Lighting"}, PriceDistribution: distribution, MinPrice: 50, MaxPrice: 10000, Seed: 42}
+            products, err := GenerateProducts(opts)
+            if err != nil {
+                t.Fatalf("GenerateProducts: %v", err)
+            }
+            if len(products) != opts.Count {
+                t.Fatalf("generated %d products, want %d", len(products), opts.Count)
+            }
+            for i, product := range products {
+                if want := opts.Categories[i%2]; product.Category != want {
+                    t.Errorf("product %d is in %q, want %q", i, product.Category, want)
+                }
+                if product.Price < opts.MinPrice || product.Price > opts.MaxPrice {
+                    t.Errorf("product %d costs %s, outside %s to %s", i, product.Price, opts.MinPrice, opts.MaxPrice)
+                }
+                if product.Price >= 100 && product.Price%100 != 99 && product.Price != opts.MaxPrice {
+                    t.Errorf("product %d costs %s, want a price ending in .99", i, product.Price)
+                }
+                if errs := product.Validate(); len(errs) > 0 {
+                    t.Errorf("product %d = %+v is invalid: %v", i, product, errs)
+                }
+            }
+
+            again, _ := GenerateProducts(opts)
+            if !reflect.DeepEqual(again, products) {
+                t.Error("the same seed generated different products")
+            }
+        })
+    }
+}
+
+func TestSeedProducts(t *testing.T) {
+    repo := setupHandlers(t)
+    opts := DefaultSeedOptions(seedBatchSize + 20)
+    opts.Seed = 7
+
+    stored, err := SeedProducts(context.Background(), repo, opts)
+    if err != nil || stored != opts.Count {
+        t.Fatalf("SeedProducts = %d, %v, want %d stored", stored, err, opts.Count)
+    }
+    list, err := repo.List(context.Background(), ListQuery{Filter: ProductFilter{Categories: []string{"Garden"}}, Sort: "id", Limit: 1})
+    if err != nil || list.Total != opts.Count/len(defaultSeedCategories) {
+        t.Errorf("Garden holds %d products (%v), want %d", list.Total, err, opts.Count/len(defaultSeedCategories))
+    }
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// upsertProductBySKU creates or replaces the product with the SKU in the path, so an
+// external system can sync its catalog without first checking what exists. A deleted
+// product with the SKU is brought back. Sending the same product again writes nothing.
+func upsertProductBySKU(w http.ResponseWriter, r *http.Request) {
+    sku := mux.Vars(r)["sku"]
+    var errs ValidationErrors
+    if validateSKU(&errs, sku); strings.TrimSpace(sku) == "" || len(errs) > 0 {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid SKU.")
+        return
+    }
+
+    // Read the request body into a Product object. The SKU in the path wins over any in
+    // the body.
+    var product Product
+    if err := decodeBody(r, &product); err != nil {
+        logError(r, err)
+        respondBodyError(w, r, err)
+        return
+    }
+    product.ID, product.SKU = 0, sku
+
+    // Validate the product before storing it.
+    if errs := product.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+    if !respondPolicyError(w, r, authorizeProduct(r.Context(), ActionCreate, product), "Failed to save product.") {
+        return
+    }
+    // A product that already has the SKU is updated, so the policy has to allow that too.
+    var existingID int
+    err := DB.QueryRowContext(r.Context(), "SELECT id FROM products WHERE sku = $1", sku).Scan(&existingID)
+    if err != nil && err != sql.ErrNoRows {
+        respondStoreError(w, r, err, "Failed to save product.")
+        return
+    }
+    if existingID != 0 && !allowProduct(w, r, ActionUpdate, existingID, "Failed to save product.") {
+        return
+    }
+
+    created, changed, err := Repo.UpsertBySKU(r.Context(), &product)
+    if err == ErrBarcodeInUse {
+        respondError(w, r, http.StatusConflict, codeBarcodeInUse, "Barcode is already in use.")
+        return
+    } else if err == ErrUnknownCategory {
+        respondValidationErrors(w, r, unknownCategoryErrors)
+        return
+    } else if err == ErrUnknownVendor {
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to save product.")
+        return
+    }
+    w.Header().Set("ETag", productETag(product))
+
+    if created {
+        if err := invalidateProductLists(r.Context()); err != nil {
+            logError(r, err)
+        }
+        // If everything went well, return a 201 Created response pointing at the new product.
+        w.Header().Set("Location", fmt.Sprintf("/products/%d", product.ID))
+        respond(w, r, http.StatusCreated, product)
+        return
+    }
+
+    if !changed {
+        respond(w, r, http.StatusOK, UpdateResult{Product: product, Unchanged: true})
+        return
+    }
+
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), product.ID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the updated product in the response body.
+    respond(w, r, http.StatusOK, UpdateResult{Product: product})
+}
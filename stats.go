@@ -0,0 +1,192 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// Defaults of the stats endpoint: products with at most defaultLowStock units left count as
+// low on stock, and up to statsListLimit products are listed as recently added or low on
+// stock.
+const (
+    defaultLowStock = 5
+    statsListLimit  = 10
+)
+
+// CategoryStats is the number of live products in a category.
+type CategoryStats struct {
+    Category     string `json:"category" xml:"category"`
+    ProductCount int    `json:"product_count" xml:"product_count"`
+}
+
+// PriceStats summarises the prices of the products in one currency, as prices in different
+// currencies can't be compared.
+type PriceStats struct {
+    Currency     string `json:"currency" xml:"currency"`
+    ProductCount int    `json:"product_count" xml:"product_count"`
+    Min          Money  `json:"min" xml:"min"`
+    Avg          Money  `json:"avg" xml:"avg"`
+    Max          Money  `json:"max" xml:"max"`
+}
+
+// LowStockProduct is a product that is running out of stock.
+type LowStockProduct struct {
+    ID       int    `json:"id" xml:"id"`
+    Name     string `json:"name" xml:"name"`
+    Category string `json:"category" xml:"category"`
+    Stock    int    `json:"stock" xml:"stock"`
+}
+
+// CatalogStats is the body of the stats endpoint. Every figure covers the live products
+// created from From, inclusive, to To, exclusive; a nil bound is open.
+type CatalogStats struct {
+    From            *time.Time        `json:"from" xml:"from,omitempty"`
+    To              *time.Time        `json:"to" xml:"to,omitempty"`
+    ProductCount    int               `json:"product_count" xml:"product_count"`
+    Categories      []CategoryStats   `json:"categories" xml:"categories>category"`
+    Prices          []PriceStats      `json:"prices" xml:"prices>currency"`
+    RecentlyAdded   []Product         `json:"recently_added" xml:"recently_added>product"`
+    LowStockLimit   int               `json:"low_stock_limit" xml:"low_stock_limit"`
+    LowStock        []LowStockProduct `json:"low_stock" xml:"low_stock>product"`
+    OutOfStockCount int               `json:"out_of_stock_count" xml:"out_of_stock_count"`
+}
+
+// parseStatsTime reads a date range bound given as RFC 3339, like 2024-05-01T12:00:00Z, or
+// as a date, like 2024-05-01, which means midnight UTC.
+func parseStatsTime(values url.Values, name string) (*time.Time, error) {
+    s := values.Get(name)
+    if s == "" {
+        return nil, nil
+    }
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        t, err = time.Parse("2006-01-02", s)
+    }
+    if err != nil {
+        return nil, errors.New("Invalid " + name + "; use a date like 2024-05-01 or an RFC 3339 time.")
+    }
+    t = t.UTC()
+    return &t, nil
+}
+
+// getStats reports catalog metrics for admins: products per category, prices per currency,
+// the newest products, and the products low on or out of stock. ?from= and ?to= restrict
+// them to products created in that range, and ?low_stock= sets how few units count as low.
+func getStats(w http.ResponseWriter, r *http.Request) {
+    queryValues := r.URL.Query()
+    stats := CatalogStats{LowStockLimit: defaultLowStock}
+    var err error
+    if stats.From, err = parseStatsTime(queryValues, "from"); err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    if stats.To, err = parseStatsTime(queryValues, "to"); err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    if stats.From != nil && stats.To != nil && !stats.From.Before(*stats.To) {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "from must be before to.")
+        return
+    }
+    if lowStockStr := queryValues.Get("low_stock"); lowStockStr != "" {
+        stats.LowStockLimit, err = strconv.Atoi(lowStockStr)
+        if err != nil || stats.LowStockLimit < 1 {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid low_stock.")
+            return
+        }
+    }
+
+    if err := queryStats(r.Context(), &stats); err != nil {
+        respondStoreError(w, r, err, "Failed to compute stats.")
+        return
+    }
+
+    // If everything went well, return the stats in the response body.
+    respond(w, r, http.StatusOK, stats)
+}
+
+// queryStats fills in the metrics of stats for its date range. They are read from one
+// snapshot, so they agree with each other.
+func queryStats(ctx context.Context, stats *CatalogStats) error {
+    tx, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    b := &queryBuilder{}
+    b.Where("deleted_at IS NULL")
+    if stats.From != nil {
+        b.Where("created_at >= ?", *stats.From)
+    }
+    if stats.To != nil {
+        b.Where("created_at < ?", *stats.To)
+    }
+    where, args := b.WhereClause(), b.Args()
+
+    err = tx.QueryRowContext(ctx, "SELECT COUNT(*), COUNT(*) FILTER (WHERE stock = 0) FROM products"+where, args...).
+        Scan(&stats.ProductCount, &stats.OutOfStockCount)
+    if err != nil {
+        return err
+    }
+
+    stats.Categories = []CategoryStats{}
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var c CategoryStats
+        if err := scan(&c.Category, &c.ProductCount); err != nil {
+            return err
+        }
+        stats.Categories = append(stats.Categories, c)
+        return nil
+    }, "SELECT category, COUNT(*) FROM products"+where+" GROUP BY category ORDER BY 2 DESC, 1", args...)
+    if err != nil {
+        return err
+    }
+
+    stats.Prices = []PriceStats{}
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var p PriceStats
+        if err := scan(&p.Currency, &p.ProductCount, &p.Min, &p.Avg, &p.Max); err != nil {
+            return err
+        }
+        stats.Prices = append(stats.Prices, p)
+        return nil
+    }, "SELECT currency, COUNT(*), min(price), round(avg(price), 2), max(price) FROM products"+where+" GROUP BY currency ORDER BY currency", args...)
+    if err != nil {
+        return err
+    }
+
+    stats.RecentlyAdded = []Product{}
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var product Product
+        if err := scan(productFields(&product)...); err != nil {
+            return err
+        }
+        stats.RecentlyAdded = append(stats.RecentlyAdded, product)
+        return nil
+    }, "SELECT "+productColumns+" FROM products"+where+" ORDER BY created_at DESC, id DESC LIMIT "+strconv.Itoa(statsListLimit), args...)
+    if err != nil {
+        return err
+    }
+
+    stats.LowStock = []LowStockProduct{}
+    lowStock := b.Arg(stats.LowStockLimit)
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var p LowStockProduct
+        if err := scan(&p.ID, &p.Name, &p.Category, &p.Stock); err != nil {
+            return err
+        }
+        stats.LowStock = append(stats.LowStock, p)
+        return nil
+    }, "SELECT id, name, category, stock FROM products"+where+" AND stock BETWEEN 1 AND "+lowStock+" ORDER BY stock, id LIMIT "+strconv.Itoa(statsListLimit),
+        b.Args()...)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "sync"
+)
+
+// stmtCache keeps prepared statements for the hot queries run on a connection pool, so
+// Postgres parses and plans each of them once per connection instead of on every call. The
+// *sql.Stmt prepares itself again on whichever connection runs it.
+type stmtCache struct {
+    db *sql.DB
+    // size bounds how many statements are kept, as list queries vary with their filters.
+    // Queries past it are run unprepared; zero turns the cache off.
+    size int
+
+    mu    sync.Mutex
+    stmts map[string]*sql.Stmt
+}
+
+// newStmtCache returns a cache of at most size statements prepared on db.
+func newStmtCache(db *sql.DB, size int) *stmtCache {
+    return &stmtCache{db: db, size: size, stmts: map[string]*sql.Stmt{}}
+}
+
+// stmt returns the prepared statement for query, preparing it if there is room for it. It
+// returns nil if the query is to be run unprepared.
+func (c *stmtCache) stmt(ctx context.Context, query string) *sql.Stmt {
+    c.mu.Lock()
+    stmt, ok := c.stmts[query]
+    full := len(c.stmts) >= c.size
+    c.mu.Unlock()
+    if ok || full {
+        return stmt
+    }
+
+    // Prepare outside the lock so a slow prepare doesn't hold up cached queries. A query that
+    // fails to prepare is left to fail again, with its error, when it is run unprepared.
+    stmt, err := c.db.PrepareContext(ctx, query)
+    if err != nil {
+        return nil
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if cached, ok := c.stmts[query]; ok {
+        // Another call prepared it first.
+        stmt.Close()
+        return cached
+    }
+    if len(c.stmts) >= c.size {
+        stmt.Close()
+        return nil
+    }
+    c.stmts[query] = stmt
+    return stmt
+}
+
+// QueryContext runs query through its prepared statement, or unprepared if it has none.
+func (c *stmtCache) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+    if stmt := c.stmt(ctx, query); stmt != nil {
+        return stmt.QueryContext(ctx, args...)
+    }
+    return c.db.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs query like QueryContext, for a single row.
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+    if stmt := c.stmt(ctx, query); stmt != nil {
+        return stmt.QueryRowContext(ctx, args...)
+    }
+    return c.db.QueryRowContext(ctx, query, args...)
+}
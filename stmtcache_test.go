@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "testing"
+)
+
+func TestStmtCache(t *testing.T) {
+    setupHandlers(t)
+    stubDB.answer = func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+        return []string{"query"}, [][]driver.Value{{query}}, nil
+    }
+    ctx := context.Background()
+    cache := newStmtCache(DB, 2)
+
+    first := cache.stmt(ctx, "SELECT 1")
+    if first == nil || cache.stmt(ctx, "SELECT 1") != first {
+        t.Fatal("a repeated query was not served by the same prepared statement")
+    }
+    if cache.stmt(ctx, "SELECT 2") == nil {
+        t.Fatal("a second query was not prepared")
+    }
+    // The cache is full, so further queries run unprepared but still run.
+    if cache.stmt(ctx, "SELECT 3") != nil {
+        t.Error("a query past the cache size was prepared")
+    }
+    for _, query := range []string{"SELECT 1", "SELECT 3"} {
+        var got string
+        if err := cache.QueryRowContext(ctx, query).Scan(&got); err != nil || got != query {
+            t.Errorf("QueryRowContext(%q) = %q, %v", query, got, err)
+        }
+    }
+    if len(cache.stmts) != 2 {
+        t.Errorf("cache holds %d statements, want 2", len(cache.stmts))
+    }
+}
+
+func TestStmtCacheDisabled(t *testing.T) {
+    setupHandlers(t)
+    cache := newStmtCache(DB, 0)
+
+    if stmt := cache.stmt(context.Background(), "SELECT 1"); stmt != nil {
+        t.Error("a query was prepared with the cache turned off")
+    }
+    rows, err := cache.QueryContext(context.Background(), "SELECT 1")
+    if err != nil {
+        t.Fatalf("QueryContext: %v", err)
+    }
+    rows.Close()
+    if len(cache.stmts) != 0 {
+        t.Errorf("cache holds %d statements, want none", len(cache.stmts))
+    }
+}
+
+// The read router keeps a cache of statements per pool, so a statement prepared on the
+// primary is never used to read from the replica.
+func TestReadRouterStmtCaches(t *testing.T) {
+    setupHandlers(t)
+    replica := sql.OpenDB(&stubDatabase{})
+    defer replica.Close()
+
+    rr := newReadRouter(DB, replica, 4)
+    if len(rr.stmts) != 2 || rr.stmts[DB] == rr.stmts[replica] || rr.stmts[replica].db != replica {
+        t.Errorf("statement caches = %v, want one for each pool", rr.stmts)
+    }
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+    "context"
+    "database/sql/driver"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+    "github.com/vmihailenco/msgpack/v5"
+)
+
+// maxProductTags is the most tags a product can have.
+const maxProductTags = 20
+
+// Ways a listing's ?tags= filter can match: products with any of the tags, or with all.
+const (
+    tagsMatchAny = "any"
+    tagsMatchAll = "all"
+)
+
+// tagNamePattern is what a tag name looks like: lowercase words joined by hyphens, like
+// "back-to-school". Names can't contain commas, which separate them in ?tags=.
+var tagNamePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// validTagName reports whether name can be used as a tag.
+func validTagName(name string) bool {
+    return len(name) <= 50 && tagNamePattern.MatchString(name)
+}
+
+// TagList is the sorted tag names of a product, held joined by commas so Product stays
+// comparable. It is encoded as a list. The zero value has no tags.
+type TagList string
+
+// newTagList returns the TagList holding names, which must be valid tag names.
+func newTagList(names []string) TagList {
+    sorted := append([]string(nil), names...)
+    sort.Strings(sorted)
+    return TagList(strings.Join(sorted, ","))
+}
+
+// Names returns the tag names, which is never nil.
+func (l TagList) Names() []string {
+    if l == "" {
+        return []string{}
+    }
+    return strings.Split(string(l), ",")
+}
+
+// Has reports whether name is one of the tags.
+func (l TagList) Has(name string) bool {
+    for _, tag := range l.Names() {
+        if tag == name {
+            return true
+        }
+    }
+    return false
+}
+
+// MarshalJSON writes l as a JSON array.
+func (l TagList) MarshalJSON() ([]byte, error) {
+    return json.Marshal(l.Names())
+}
+
+// UnmarshalJSON reads a JSON array of names. Tags aren't written with a product, so this
+// only serves clients decoding our own responses.
+func (l *TagList) UnmarshalJSON(data []byte) error {
+    var names []string
+    if err := json.Unmarshal(data, &names); err != nil {
+        return err
+    }
+    *l = newTagList(names)
+    return nil
+}
+
+// MarshalXML writes l as tag elements.
+func (l TagList) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+    return e.EncodeElement(struct {
+        Tags []string `xml:"tag"`
+    }{l.Names()}, start)
+}
+
+// UnmarshalXML reads tag elements written by MarshalXML.
+func (l *TagList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+    var body struct {
+        Tags []string `xml:"tag"`
+    }
+    if err := d.DecodeElement(&body, &start); err != nil {
+        return err
+    }
+    *l = newTagList(body.Tags)
+    return nil
+}
+
+// EncodeMsgpack writes l as a MessagePack array.
+func (l TagList) EncodeMsgpack(enc *msgpack.Encoder) error {
+    return enc.Encode(l.Names())
+}
+
+// DecodeMsgpack reads a MessagePack array of names.
+func (l *TagList) DecodeMsgpack(dec *msgpack.Decoder) error {
+    var names []string
+    if err := dec.Decode(&names); err != nil {
+        return err
+    }
+    *l = newTagList(names)
+    return nil
+}
+
+// Scan reads a text[] column of names.
+func (l *TagList) Scan(src interface{}) error {
+    var names pq.StringArray
+    if err := names.Scan(src); err != nil {
+        return err
+    }
+    *l = newTagList(names)
+    return nil
+}
+
+// Value writes l as a text[] value.
+func (l TagList) Value() (driver.Value, error) {
+    return pq.StringArray(l.Names()).Value()
+}
+
+// Tag is a tag together with how many live products carry it.
+type Tag struct {
+    ID           int       `json:"id" xml:"id"`
+    Name         string    `json:"name" xml:"name"`
+    ProductCount int       `json:"product_count" xml:"product_count"`
+    CreatedAt    time.Time `json:"created_at" xml:"created_at"`
+}
+
+// ProductTagsRequest is the body of a request setting the tags of a product.
+type ProductTagsRequest struct {
+    Tags []string `json:"tags" xml:"tags>tag"`
+}
+
+// tagColumns are the columns scanned by scanTag, in order, selected from tags t.
+const tagColumns = `t.id, t.name, (SELECT count(*) FROM product_tags pt JOIN products p ON p.id = pt.product_id
+    WHERE pt.tag_id = t.id AND p.deleted_at IS NULL), t.created_at`
+
+// scanTag reads the tagColumns of one row through scan.
+func scanTag(scan func(dest ...interface{}) error) (Tag, error) {
+    var t Tag
+    err := scan(&t.ID, &t.Name, &t.ProductCount, &t.CreatedAt)
+    return t, err
+}
+
+// getTags lists every tag, by name.
+func getTags(w http.ResponseWriter, r *http.Request) {
+    tags := []Tag{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        tag, err := scanTag(scan)
+        if err != nil {
+            return err
+        }
+        tags = append(tags, tag)
+        return nil
+    }, "SELECT "+tagColumns+" FROM tags t ORDER BY t.name")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve tags.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(tags)) {
+        return
+    }
+
+    // If everything went well, return the tags in the response body.
+    respond(w, r, http.StatusOK, tags)
+}
+
+// createTag adds a tag from a body like {"name": "clearance"}. Tags are also created on the
+// fly when they are first given to a product.
+func createTag(w http.ResponseWriter, r *http.Request) {
+    var tag Tag
+    if err := decodeBody(r, &tag); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    if !validTagName(tag.Name) {
+        respondValidationErrors(w, r, ValidationErrors{{Field: "name", Message: "must be lowercase letters and digits, optionally joined by hyphens, at most 50 characters"}})
+        return
+    }
+
+    err := DB.QueryRowContext(r.Context(), "INSERT INTO tags (name) VALUES ($1) RETURNING id, created_at", tag.Name).Scan(&tag.ID, &tag.CreatedAt)
+    if isUniqueViolation(err) {
+        respondError(w, r, http.StatusConflict, codeTagExists, "Tag already exists.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create tag.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new tag.
+    w.Header().Set("Location", "/tags/"+tag.Name)
+    respond(w, r, http.StatusCreated, tag)
+}
+
+// deleteTag deletes a tag and takes it off every product. Those products get a new version
+// and an audited update, as their representation changed.
+func deleteTag(w http.ResponseWriter, r *http.Request) {
+    ctx, name := r.Context(), mux.Vars(r)["name"]
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete tag.")
+        return
+    }
+    defer tx.Rollback()
+
+    var tagged []Product
+    err = queryTxRows(ctx, tx, func(scan func(dest ...interface{}) error) error {
+        var product Product
+        if err := scan(productFields(&product)...); err != nil {
+            return err
+        }
+        tagged = append(tagged, product)
+        return nil
+    }, "SELECT "+productColumns+` FROM products
+        WHERE id IN (SELECT pt.product_id FROM product_tags pt JOIN tags t ON t.id = pt.tag_id WHERE t.name = $1)
+        ORDER BY id FOR UPDATE`, name)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete tag.")
+        return
+    }
+
+    result, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE name = $1", name)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete tag.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete tag.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeTagNotFound, "Tag not found.")
+        return
+    }
+
+    for i := range tagged {
+        before := &tagged[i]
+        var after Product
+        err := tx.QueryRowContext(ctx, "UPDATE products SET version = version + 1 WHERE id = $1 RETURNING "+productColumns, before.ID).Scan(productFields(&after)...)
+        if err == nil {
+            err = recordAudit(ctx, tx, auditUpdate, before.ID, before, &after)
+        }
+        if err != nil {
+            respondStoreError(w, r, err, "Failed to delete tag.")
+            return
+        }
+    }
+    if err := tx.Commit(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete tag.")
+        return
+    }
+    for _, product := range tagged {
+        if err := invalidateProduct(ctx, product.ID); err != nil {
+            logError(r, err)
+        }
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// setProductTags replaces the tags of a live product from a body like
+// {"tags": ["sale", "clearance"]}, creating tags that don't exist yet. Names are
+// lowercased, and duplicates dropped.
+func setProductTags(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    var request ProductTagsRequest
+    if err := decodeBody(r, &request); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    names := map[string]bool{}
+    for _, name := range request.Tags {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if !validTagName(name) {
+            respondValidationErrors(w, r, ValidationErrors{{Field: "tags", Message: fmt.Sprintf("%q is not a valid tag name", name)}})
+            return
+        }
+        names[name] = true
+    }
+    if len(names) > maxProductTags {
+        respondValidationErrors(w, r, ValidationErrors{{Field: "tags", Message: fmt.Sprintf("must have at most %d entries", maxProductTags)}})
+        return
+    }
+    tags := make([]string, 0, len(names))
+    for name := range names {
+        tags = append(tags, name)
+    }
+
+    list := newTagList(tags)
+    respondProductTagsChange(w, r, productID, func(TagList) (TagList, error) { return list, nil })
+}
+
+// deleteProductTag takes a tag off a live product.
+func deleteProductTag(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    name := mux.Vars(r)["tag"]
+    respondProductTagsChange(w, r, productID, func(current TagList) (TagList, error) {
+        if !current.Has(name) {
+            return current, errTagNotOnProduct
+        }
+        var rest []string
+        for _, tag := range current.Names() {
+            if tag != name {
+                rest = append(rest, tag)
+            }
+        }
+        return newTagList(rest), nil
+    })
+}
+
+// errTagNotOnProduct is returned when removing a tag a product doesn't have.
+var errTagNotOnProduct = errors.New("product doesn't have the tag")
+
+// respondProductTagsChange gives a live product the tags change returns for its current
+// ones, then writes the product, or the error response, to w.
+func respondProductTagsChange(w http.ResponseWriter, r *http.Request, productID int, change func(TagList) (TagList, error)) {
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to update tags.") {
+        return
+    }
+    product, err := changeProductTags(r.Context(), productID, change)
+    switch {
+    case err == ErrProductNotFound:
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    case err == errTagNotOnProduct:
+        respondError(w, r, http.StatusNotFound, codeTagNotFound, "Product doesn't have this tag.")
+        return
+    case err != nil:
+        respondStoreError(w, r, err, "Failed to update tags.")
+        return
+    }
+
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the product with its new tags.
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusOK, product)
+}
+
+// changeProductTags gives the live product with the given ID the tags change returns for
+// its current ones, creating tags that don't exist yet, and returns the product. The change
+// is versioned and audited like any other change to the product; nothing is written if the
+// tags stay the same.
+func changeProductTags(ctx context.Context, productID int, change func(TagList) (TagList, error)) (Product, error) {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return Product{}, err
+    }
+    defer tx.Rollback()
+
+    current, err := lockProduct(ctx, tx, "id = $1", productID)
+    if err != nil {
+        return Product{}, err
+    }
+    list, err := change(current.Tags)
+    if err != nil || list == current.Tags {
+        return current, err
+    }
+
+    names := pq.Array(list.Names())
+    if _, err := tx.ExecContext(ctx, "INSERT INTO tags (name) SELECT unnest($1::text[]) ON CONFLICT (tenant_id, name) DO NOTHING", names); err != nil {
+        return Product{}, err
+    }
+    if _, err := tx.ExecContext(ctx, "DELETE FROM product_tags WHERE product_id = $1", productID); err != nil {
+        return Product{}, err
+    }
+    if _, err := tx.ExecContext(ctx, "INSERT INTO product_tags (product_id, tag_id) SELECT $1, id FROM tags WHERE name = ANY($2)", productID, names); err != nil {
+        return Product{}, err
+    }
+    var product Product
+    err = tx.QueryRowContext(ctx, "UPDATE products SET version = version + 1 WHERE id = $1 RETURNING "+productColumns, productID).Scan(productFields(&product)...)
+    if err != nil {
+        return Product{}, err
+    }
+    if err := recordAudit(ctx, tx, auditUpdate, productID, &current, &product); err != nil {
+        return Product{}, err
+    }
+    return product, tx.Commit()
+}
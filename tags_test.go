@@ -0,0 +1,42 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestTagHandlers(t *testing.T) {
+    tag := map[string]string{"name": "sale"}
+    product := map[string]string{"id": "1"}
+    productTag := map[string]string{"id": "1", "tag": "sale"}
+    invalid := map[string]string{"id": "abc", "tag": "sale"}
+    _, lamp := productRow(Product{ID: 1, Name: "Lamp", Category: "home", Price: 1999, Version: 1})
+    locked := answerRows(map[string][]driver.Value{"FOR UPDATE": lamp})
+    tests := []handlerTest{
+        {name: "list", handler: getTags, target: "/tags", answer: answerRows(map[string][]driver.Value{"FROM tags": {int64(1), "sale", int64(2), time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "create", handler: createTag, method: "POST", target: "/tags", body: `{"name": "sale"}`, answer: answerRows(map[string][]driver.Value{"INSERT INTO tags": {int64(1), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createTag, method: "POST", target: "/tags", body: `{"name": 1}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid name", handler: createTag, method: "POST", target: "/tags", body: `{"name": "On Sale"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create duplicate", handler: createTag, method: "POST", target: "/tags", body: `{"name": "sale"}`, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeTagExists},
+        {name: "delete", handler: deleteTag, method: "DELETE", target: "/tags/sale", vars: tag, answer: answerRows(map[string][]driver.Value{"DELETE FROM tags": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete missing", handler: deleteTag, method: "DELETE", target: "/tags/sale", vars: tag, status: http.StatusNotFound, code: codeTagNotFound},
+        {name: "set", handler: setProductTags, method: "PUT", target: "/products/1/tags", body: `{"tags": ["sale"]}`, vars: product,
+            answer: answerRows(map[string][]driver.Value{"FOR UPDATE": lamp, "UPDATE products SET version": lamp}), status: http.StatusOK},
+        {name: "set invalid id", handler: setProductTags, method: "PUT", target: "/products/abc/tags", body: `{"tags": []}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "set malformed", handler: setProductTags, method: "PUT", target: "/products/1/tags", body: `{"tags": "sale"}`, vars: product, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "set invalid name", handler: setProductTags, method: "PUT", target: "/products/1/tags", body: `{"tags": ["on sale"]}`, vars: product, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set missing product", handler: setProductTags, method: "PUT", target: "/products/1/tags", body: `{"tags": ["sale"]}`, vars: product, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "remove invalid id", handler: deleteProductTag, method: "DELETE", target: "/products/abc/tags/sale", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "remove missing product", handler: deleteProductTag, method: "DELETE", target: "/products/1/tags/sale", vars: productTag, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "remove tag not on product", handler: deleteProductTag, method: "DELETE", target: "/products/1/tags/sale", vars: productTag, answer: locked, status: http.StatusNotFound, code: codeTagNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getTags, target: "/tags"},
+        handlerTest{name: "create", handler: createTag, method: "POST", target: "/tags", body: `{"name": "sale"}`},
+        handlerTest{name: "delete", handler: deleteTag, method: "DELETE", target: "/tags/sale", vars: tag},
+        handlerTest{name: "set", handler: setProductTags, method: "PUT", target: "/products/1/tags", body: `{"tags": ["sale"]}`, vars: product},
+        handlerTest{name: "remove", handler: deleteProductTag, method: "DELETE", target: "/products/1/tags/sale", vars: productTag},
+    ))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "strconv"
+
+    "github.com/lib/pq"
+)
+
+// tenantDriverName is the database driver the service connects with: the Postgres driver,
+// with every connection scoped to the tenant of the context it is used with.
+const tenantDriverName = "postgres-tenant"
+
+func init() {
+    sql.Register(tenantDriverName, tenantDriver{&pq.Driver{}})
+}
+
+// tenantDriver wraps a driver so its connections are tenantConns, opened by a
+// tenantConnector.
+type tenantDriver struct {
+    driver.Driver
+}
+
+func (d tenantDriver) Open(name string) (driver.Conn, error) {
+    conn, err := d.Driver.Open(name)
+    if err != nil {
+        return nil, err
+    }
+    return &tenantConn{Conn: conn}, nil
+}
+
+// tenantConn scopes a connection to the tenant of the context each statement or
+// transaction runs with, by setting app.tenant_id, which the row-level security policies
+// filter on. The setting is only changed when a statement is for a different tenant than
+// the last one, which costs an extra round trip; a context without a tenant, as background
+// jobs use, clears it so the statement works across every tenant. Inside a transaction the
+// tenant stays the one it began with.
+type tenantConn struct {
+    driver.Conn
+    // tenantID is the tenant the session is scoped to: zero for none, or -1 if unknown
+    // because setting it failed.
+    tenantID int
+    inTx     bool
+    // breaker is the circuit breaker of the pool, told whether each statement reached the
+    // database.
+    breaker *circuitBreaker
+}
+
+// scope points the session at the tenant of ctx.
+func (c *tenantConn) scope(ctx context.Context) error {
+    tenantID := tenantIDFromContext(ctx)
+    if c.inTx || tenantID == c.tenantID {
+        return nil
+    }
+    value := ""
+    if tenantID != 0 {
+        value = strconv.Itoa(tenantID)
+    }
+    _, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, "SELECT set_config('app.tenant_id', $1, false)", []driver.NamedValue{{Ordinal: 1, Value: value}})
+    c.breaker.record(err)
+    if err != nil {
+        c.tenantID = -1
+        return err
+    }
+    c.tenantID = tenantID
+    return nil
+}
+
+func (c *tenantConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+    if err := c.scope(ctx); err != nil {
+        return nil, err
+    }
+    rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+    c.breaker.record(err)
+    return rows, err
+}
+
+func (c *tenantConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+    if err := c.scope(ctx); err != nil {
+        return nil, err
+    }
+    result, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+    c.breaker.record(err)
+    return result, err
+}
+
+func (c *tenantConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+    if err := c.scope(ctx); err != nil {
+        return nil, err
+    }
+    stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    return tenantStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *tenantConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+    if err := c.scope(ctx); err != nil {
+        return nil, err
+    }
+    tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+    c.breaker.record(err)
+    if err != nil {
+        return nil, err
+    }
+    c.inTx = true
+    return tenantTx{Tx: tx, conn: c}, nil
+}
+
+func (c *tenantConn) Ping(ctx context.Context) error {
+    err := c.Conn.(driver.Pinger).Ping(ctx)
+    c.breaker.record(err)
+    return err
+}
+
+func (c *tenantConn) ResetSession(ctx context.Context) error {
+    return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *tenantConn) IsValid() bool {
+    return c.Conn.(driver.Validator).IsValid()
+}
+
+func (c *tenantConn) CheckNamedValue(nv *driver.NamedValue) error {
+    return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+// tenantStmt scopes its connection to the tenant of each execution, as a prepared statement
+// is kept and run for whichever tenant next uses the connection.
+type tenantStmt struct {
+    driver.Stmt
+    conn *tenantConn
+}
+
+func (s tenantStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+    if err := s.conn.scope(ctx); err != nil {
+        return nil, err
+    }
+    rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+    s.conn.breaker.record(err)
+    return rows, err
+}
+
+func (s tenantStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+    if err := s.conn.scope(ctx); err != nil {
+        return nil, err
+    }
+    result, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+    s.conn.breaker.record(err)
+    return result, err
+}
+
+// tenantTx ends the transaction scope of its connection when it finishes.
+type tenantTx struct {
+    driver.Tx
+    conn *tenantConn
+}
+
+func (tx tenantTx) Commit() error {
+    tx.conn.inTx = false
+    return tx.Tx.Commit()
+}
+
+func (tx tenantTx) Rollback() error {
+    tx.conn.inTx = false
+    return tx.Tx.Rollback()
+}
+
+// checkRowLevelSecurity fails if the database role the service connects as bypasses
+// row-level security, as superusers do, since tenants would then see each other's data.
+func checkRowLevelSecurity(ctx context.Context, db *sql.DB) error {
+    var bypasses bool
+    if err := db.QueryRowContext(ctx, "SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").Scan(&bypasses); err != nil {
+        return err
+    }
+    if bypasses {
+        return errors.New("the database role bypasses row-level security, so tenants would not be isolated; connect as a role without SUPERUSER or BYPASSRLS")
+    }
+    return nil
+}
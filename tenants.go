@@ -0,0 +1,350 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net"
+    "net/http"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// The default tenant owns the data of single-tenant deployments and everything created
+// before tenants existed. Its admins manage the other tenants.
+const (
+    defaultTenantID   = 1
+    defaultTenantSlug = "default"
+)
+
+// tenantLookupTTL is how long a resolved tenant is kept in memory, and so how long other
+// instances take to notice that a tenant was disabled.
+const tenantLookupTTL = 30 * time.Second
+
+// tenantSlugPattern is what a tenant slug looks like. Slugs are used as subdomains, so they
+// follow the rules for DNS labels.
+var tenantSlugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+    errTenantNotFound = errors.New("tenant not found")
+    errTenantDisabled = errors.New("tenant disabled")
+)
+
+// Tenant is a merchant with its own catalog.
+type Tenant struct {
+    ID        int       `json:"id" xml:"id"`
+    Slug      string    `json:"slug" xml:"slug"`
+    Name      string    `json:"name" xml:"name"`
+    Disabled  bool      `json:"disabled" xml:"disabled"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+}
+
+// defaultTenant is the tenant of every request when multi-tenancy is off.
+var defaultTenant = Tenant{ID: defaultTenantID, Slug: defaultTenantSlug, Name: "Default"}
+
+// tenantContextKey is the context key holding the Tenant a request is for.
+const tenantContextKey contextKey = "tenant"
+
+// withTenant returns a copy of ctx whose database work is scoped to tenant.
+func withTenant(ctx context.Context, tenant Tenant) context.Context {
+    return context.WithValue(ctx, tenantContextKey, tenant)
+}
+
+// tenantFromContext returns the tenant a request is for, if it has one.
+func tenantFromContext(ctx context.Context) (Tenant, bool) {
+    tenant, ok := ctx.Value(tenantContextKey).(Tenant)
+    return tenant, ok
+}
+
+// tenantIDFromContext returns the ID of the tenant of ctx, or zero if it has none.
+func tenantIDFromContext(ctx context.Context) int {
+    tenant, _ := tenantFromContext(ctx)
+    return tenant.ID
+}
+
+// tenantSlugFromRequest works out which tenant a request is for: the one named by the
+// tenant header, else the one whose subdomain of TenantBaseDomain the request was sent to,
+// else the default tenant.
+func tenantSlugFromRequest(r *http.Request) string {
+    if slug := r.Header.Get(AppConfig.TenantHeader); slug != "" {
+        return strings.ToLower(slug)
+    }
+    if AppConfig.TenantBaseDomain != "" {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        sub, ok := strings.CutSuffix(strings.ToLower(host), "."+AppConfig.TenantBaseDomain)
+        if ok && sub != "" && !strings.Contains(sub, ".") {
+            return sub
+        }
+    }
+    return defaultTenantSlug
+}
+
+// tenantLookup is a tenant resolved by slug and when it stops being trusted.
+type tenantLookup struct {
+    tenant  Tenant
+    expires time.Time
+}
+
+var (
+    tenantLookupsMu sync.Mutex
+    tenantLookups   = map[string]tenantLookup{}
+)
+
+// resolveTenant returns the enabled tenant with the given slug, or errTenantNotFound or
+// errTenantDisabled. Without multi-tenancy every request is for the default tenant.
+func resolveTenant(ctx context.Context, slug string) (Tenant, error) {
+    if !AppConfig.TenancyEnabled {
+        return defaultTenant, nil
+    }
+
+    tenantLookupsMu.Lock()
+    lookup, ok := tenantLookups[slug]
+    tenantLookupsMu.Unlock()
+    if !ok || time.Now().After(lookup.expires) {
+        tenant, err := queryTenant(ctx, slug)
+        if err != nil {
+            return Tenant{}, err
+        }
+        lookup = tenantLookup{tenant: tenant, expires: time.Now().Add(tenantLookupTTL)}
+        tenantLookupsMu.Lock()
+        tenantLookups[slug] = lookup
+        tenantLookupsMu.Unlock()
+    }
+    if lookup.tenant.Disabled {
+        return Tenant{}, errTenantDisabled
+    }
+    return lookup.tenant, nil
+}
+
+// forgetTenant drops a tenant from this instance's lookups after it was changed.
+func forgetTenant(slug string) {
+    tenantLookupsMu.Lock()
+    delete(tenantLookups, slug)
+    tenantLookupsMu.Unlock()
+}
+
+// tenantColumns are the columns scanned by scanTenant, in order.
+const tenantColumns = "id, slug, name, disabled_at IS NOT NULL, created_at"
+
+// scanTenant reads the tenantColumns of one row through scan.
+func scanTenant(scan func(dest ...interface{}) error) (Tenant, error) {
+    var t Tenant
+    err := scan(&t.ID, &t.Slug, &t.Name, &t.Disabled, &t.CreatedAt)
+    return t, err
+}
+
+// queryTenant returns the tenant with the given slug, or errTenantNotFound.
+func queryTenant(ctx context.Context, slug string) (Tenant, error) {
+    tenant, err := scanTenant(DB.QueryRowContext(ctx, "SELECT "+tenantColumns+" FROM tenants WHERE slug = $1", slug).Scan)
+    if err == sql.ErrNoRows {
+        return tenant, errTenantNotFound
+    }
+    return tenant, err
+}
+
+// tenantMiddleware scopes each request to its tenant, answering 404 for unknown tenants and
+// 403 for disabled ones. Health checks aren't for any tenant.
+func tenantMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        tenant, err := resolveTenant(r.Context(), tenantSlugFromRequest(r))
+        switch {
+        case err == errTenantNotFound:
+            respondError(w, r, http.StatusNotFound, codeTenantNotFound, "Tenant not found.")
+            return
+        case err == errTenantDisabled:
+            respondError(w, r, http.StatusForbidden, codeTenantDisabled, "Tenant is disabled.")
+            return
+        case err != nil:
+            respondStoreError(w, r, err, "Failed to resolve tenant.")
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+    })
+}
+
+// requirePlatformAdmin wraps a handler so that it is only reachable by admins of the default
+// tenant, who manage the others.
+func requirePlatformAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+        if tenantIDFromContext(r.Context()) != defaultTenantID {
+            respondError(w, r, http.StatusForbidden, codeForbidden, "Forbidden.")
+            return
+        }
+        next(w, r)
+    })
+}
+
+// TenantInput is the body of a request creating or changing a tenant. Fields left out of
+// a change stay as they are; the slug can't be changed.
+type TenantInput struct {
+    Slug     string  `json:"slug" xml:"slug"`
+    Name     *string `json:"name" xml:"name"`
+    Disabled *bool   `json:"disabled" xml:"disabled"`
+}
+
+// ProvisionedTenant is a new tenant together with the admin API key it was set up with,
+// which is only ever shown here.
+type ProvisionedTenant struct {
+    Tenant
+    AdminAPIKey APIKey `json:"admin_api_key" xml:"admin_api_key"`
+}
+
+// getTenants lists every tenant, by slug.
+func getTenants(w http.ResponseWriter, r *http.Request) {
+    tenants := []Tenant{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        tenant, err := scanTenant(scan)
+        if err != nil {
+            return err
+        }
+        tenants = append(tenants, tenant)
+        return nil
+    }, "SELECT "+tenantColumns+" FROM tenants ORDER BY slug")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve tenants.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(tenants)) {
+        return
+    }
+
+    // If everything went well, return the tenants in the response body.
+    respond(w, r, http.StatusOK, tenants)
+}
+
+// getTenant retrieves a single tenant by slug.
+func getTenant(w http.ResponseWriter, r *http.Request) {
+    tenant, err := queryTenant(r.Context(), mux.Vars(r)["slug"])
+    if err == errTenantNotFound {
+        respondError(w, r, http.StatusNotFound, codeTenantNotFound, "Tenant not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve tenant.")
+        return
+    }
+
+    // If everything went well, return the tenant in the response body.
+    respond(w, r, http.StatusOK, tenant)
+}
+
+// createTenant provisions a tenant from a body like {"slug": "acme", "name": "Acme Inc."}
+// with an admin API key, which the merchant uses to set up its catalog and further keys.
+func createTenant(w http.ResponseWriter, r *http.Request) {
+    var input TenantInput
+    if err := decodeBody(r, &input); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    if !tenantSlugPattern.MatchString(input.Slug) {
+        errs.add("slug", "must be lowercase letters, digits and hyphens, starting and ending with a letter or digit, at most 63 characters")
+    }
+    if input.Name == nil || strings.TrimSpace(*input.Name) == "" {
+        errs.add("name", "is required")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    key, err := generateAPIKey()
+    if err != nil {
+        logError(r, err)
+        respondError(w, r, http.StatusInternalServerError, codeInternal, "Failed to create tenant.")
+        return
+    }
+    provisioned, err := provisionTenant(r.Context(), input.Slug, strings.TrimSpace(*input.Name), key)
+    if isUniqueViolation(err) {
+        respondError(w, r, http.StatusConflict, codeTenantExists, "A tenant with this slug already exists.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create tenant.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new tenant.
+    w.Header().Set("Location", "/tenants/"+provisioned.Slug)
+    respond(w, r, http.StatusCreated, provisioned)
+}
+
+// provisionTenant creates a tenant and its first admin API key, with the given key.
+func provisionTenant(ctx context.Context, slug, name, key string) (ProvisionedTenant, error) {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return ProvisionedTenant{}, err
+    }
+    defer tx.Rollback()
+
+    var provisioned ProvisionedTenant
+    provisioned.Tenant, err = scanTenant(tx.QueryRowContext(ctx, "INSERT INTO tenants (slug, name) VALUES ($1, $2) RETURNING "+tenantColumns, slug, name).Scan)
+    if err != nil {
+        return provisioned, err
+    }
+
+    // The key belongs to the new tenant, so switch the transaction over to it.
+    if _, err := tx.ExecContext(ctx, "SELECT set_config('app.tenant_id', $1::text, true)", provisioned.ID); err != nil {
+        return provisioned, err
+    }
+    apiKey := APIKey{Name: "admin", Role: RoleAdmin, Key: key}
+    err = tx.QueryRowContext(ctx, "INSERT INTO api_keys (name, role, key_hash) VALUES ($1, $2, $3) RETURNING id, created_at",
+        apiKey.Name, apiKey.Role, hashAPIKey(apiKey.Key)).Scan(&apiKey.ID, &apiKey.CreatedAt)
+    if err != nil {
+        return provisioned, err
+    }
+    provisioned.AdminAPIKey = apiKey
+    return provisioned, tx.Commit()
+}
+
+// updateTenant renames, disables or re-enables a tenant. Requests for a disabled tenant are
+// refused with 403 Forbidden, but its data is kept. The default tenant can't be disabled.
+func updateTenant(w http.ResponseWriter, r *http.Request) {
+    slug := mux.Vars(r)["slug"]
+    var input TenantInput
+    if err := decodeBody(r, &input); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    var errs ValidationErrors
+    if input.Name != nil && strings.TrimSpace(*input.Name) == "" {
+        errs.add("name", "must not be empty")
+    }
+    if input.Disabled != nil && *input.Disabled && slug == defaultTenantSlug {
+        errs.add("disabled", "the default tenant can't be disabled")
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return
+    }
+
+    var name *string
+    if input.Name != nil {
+        trimmed := strings.TrimSpace(*input.Name)
+        name = &trimmed
+    }
+    tenant, err := scanTenant(DB.QueryRowContext(r.Context(), `UPDATE tenants SET name = COALESCE($2, name),
+        disabled_at = CASE WHEN $3::boolean IS NULL THEN disabled_at WHEN $3 THEN COALESCE(disabled_at, now()) END
+        WHERE slug = $1 RETURNING `+tenantColumns, slug, name, input.Disabled).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeTenantNotFound, "Tenant not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to update tenant.")
+        return
+    }
+    forgetTenant(slug)
+
+    // If everything went well, return the updated tenant in the response body.
+    respond(w, r, http.StatusOK, tenant)
+}
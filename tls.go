@@ -0,0 +1,69 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS sets server up to serve HTTPS as cfg asks. It returns the plain HTTP server that
+// redirects to it, or nil if there is none; with neither certificate files nor autocert
+// configured it leaves server alone and returns nil.
+func setupTLS(cfg Config, server *http.Server) (*http.Server, error) {
+    if !cfg.TLSEnabled() {
+        return nil, nil
+    }
+
+    var httpHandler http.Handler = redirectToHTTPS(cfg.Addr)
+    if len(cfg.AutocertDomains) > 0 {
+        manager := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+            Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+            Email:      cfg.AutocertEmail,
+        }
+        server.TLSConfig = manager.TLSConfig()
+        // The manager answers HTTP-01 challenges and hands every other request to the redirect.
+        httpHandler = manager.HTTPHandler(httpHandler)
+    } else {
+        // Load the certificate now, so a bad one stops the service at startup.
+        certificate, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("loading certificate: %w", err)
+        }
+        server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+    }
+    server.TLSConfig.MinVersion = tls.VersionTLS12
+
+    if cfg.HTTPRedirectAddr == "" {
+        return nil, nil
+    }
+    return &http.Server{
+        Addr:         cfg.HTTPRedirectAddr,
+        Handler:      httpHandler,
+        ReadTimeout:  cfg.ReadTimeout,
+        WriteTimeout: cfg.WriteTimeout,
+        IdleTimeout:  cfg.IdleTimeout,
+    }, nil
+}
+
+// redirectToHTTPS permanently redirects requests to the same host and path over HTTPS, on
+// the port of the HTTPS listener at addr.
+func redirectToHTTPS(addr string) http.Handler {
+    _, port, _ := net.SplitHostPort(addr)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if port != "" && port != "443" {
+            host = net.JoinHostPort(host, port)
+        }
+        // 308 rather than 301, so clients repeat the method and body rather than turning
+        // the request into a GET.
+        http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+    })
+}
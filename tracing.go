@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+
+    "github.com/XSAM/otelsql"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/sdk/resource"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// setupTracing installs an OpenTelemetry tracer provider that exports spans over OTLP/HTTP.
+// The exporter reads its endpoint and headers from the standard OTEL_EXPORTER_OTLP_*
+// environment variables. The returned function flushes and stops the provider. When tracing
+// is disabled, nothing is installed and the returned function does nothing.
+func setupTracing(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+    if !cfg.TracingEnabled {
+        return func(context.Context) error { return nil }, nil
+    }
+
+    exporter, err := otlptracehttp.New(ctx)
+    if err != nil {
+        return nil, err
+    }
+    res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+        semconv.SchemaURL,
+        semconv.ServiceName(cfg.ServiceName),
+    ))
+    if err != nil {
+        return nil, err
+    }
+
+    provider := sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(res),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+    )
+    otel.SetTracerProvider(provider)
+    otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+    return provider.Shutdown, nil
+}
+
+// openTracedDB opens a database handle whose queries are recorded as spans.
+func openTracedDB(cfg Config) (*sql.DB, error) {
+    if !cfg.TracingEnabled {
+        return sql.Open(tenantDriverName, cfg.DatabaseURL)
+    }
+    return otelsql.Open(tenantDriverName, cfg.DatabaseURL,
+        otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+        otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+    )
+}
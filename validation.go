@@ -0,0 +1,139 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "unicode/utf8"
+)
+
+// Limits on the size of product fields.
+const (
+    maxNameLength     = 200
+    maxCategoryLength = 100
+    maxImageURLLength = 2048
+    maxPrice          = Money(1e9 * 100)
+)
+
+// FieldError describes what is wrong with a single field of a request body.
+type FieldError struct {
+    Field   string `json:"field" xml:"field"`
+    Message string `json:"message" xml:"message"`
+}
+
+// ValidationErrors collects every field error found in a request body.
+type ValidationErrors []FieldError
+
+// add records an error for field.
+func (v *ValidationErrors) add(field, message string) {
+    *v = append(*v, FieldError{Field: field, Message: message})
+}
+
+// unknownCategoryErrors is reported when a product names a category that does not exist.
+var unknownCategoryErrors = ValidationErrors{{Field: "category", Message: "does not exist"}}
+
+// unknownVendorErrors is reported when a product names a vendor that does not exist.
+var unknownVendorErrors = ValidationErrors{{Field: "vendor_id", Message: "does not exist"}}
+
+// Validate checks every field of a full product payload, as sent to create or replace one.
+func (p Product) Validate() ValidationErrors {
+    var errs ValidationErrors
+    validateName(&errs, p.Name)
+    validateCategory(&errs, p.Category)
+    validatePrice(&errs, p.Price)
+    if p.Currency != "" {
+        validateCurrency(&errs, p.Currency)
+    }
+    validateImage(&errs, p.ImageURL)
+    validateBarcode(&errs, p.Barcode)
+    validateSKU(&errs, p.SKU)
+    validateAttributes(&errs, p.Attributes)
+    validatePublication(&errs, p.Status, p.PublishAt)
+    return errs
+}
+
+// Validate checks the fields present in a partial update.
+func (p ProductPatch) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if p.Name != nil {
+        validateName(&errs, *p.Name)
+    }
+    if p.Category != nil {
+        validateCategory(&errs, *p.Category)
+    }
+    if p.Price != nil {
+        validatePrice(&errs, *p.Price)
+    }
+    if p.Currency != nil {
+        validateCurrency(&errs, *p.Currency)
+    }
+    if p.ImageURL != nil {
+        validateImage(&errs, *p.ImageURL)
+    }
+    if p.Barcode != nil {
+        validateBarcode(&errs, *p.Barcode)
+    }
+    if p.SKU != nil {
+        validateSKU(&errs, *p.SKU)
+    }
+    if p.Attributes != nil {
+        validateAttributes(&errs, *p.Attributes)
+    }
+    return errs
+}
+
+func validateName(errs *ValidationErrors, name string) {
+    if strings.TrimSpace(name) == "" {
+        errs.add("name", "is required")
+    } else if utf8.RuneCountInString(name) > maxNameLength {
+        errs.add("name", "must be at most 200 characters")
+    }
+}
+
+func validateCategory(errs *ValidationErrors, category string) {
+    if strings.TrimSpace(category) == "" {
+        errs.add("category", "is required")
+    } else if utf8.RuneCountInString(category) > maxCategoryLength {
+        errs.add("category", "must be at most 100 characters")
+    }
+}
+
+func validatePrice(errs *ValidationErrors, price Money) {
+    if price < 0 || price > maxPrice {
+        errs.add("price", "must be between 0 and 1000000000")
+    }
+}
+
+func validateCurrency(errs *ValidationErrors, currency string) {
+    if !validCurrency(currency) {
+        errs.add("currency", "must be an ISO 4217 currency code like USD")
+    }
+}
+
+func validateImage(errs *ValidationErrors, imageURL string) {
+    if len(imageURL) > maxImageURLLength {
+        errs.add("image_url", "must be at most 2048 characters")
+    } else if err := validateImageURL(imageURL); err != nil {
+        errs.add("image_url", err.Error())
+    }
+}
+
+func validateBarcode(errs *ValidationErrors, barcode string) {
+    if barcode != "" && !validEAN13(barcode) {
+        errs.add("barcode", "must be a valid EAN-13 barcode")
+    }
+}
+
+// validateSKU checks a product SKU. It appears in /products/by-sku/{sku}, so it may not
+// contain slashes, nor whitespace that is easily lost on the way.
+func validateSKU(errs *ValidationErrors, sku string) {
+    if utf8.RuneCountInString(sku) > maxSKULength {
+        errs.add("sku", "must be at most 64 characters")
+    } else if strings.ContainsAny(sku, "/ \t\r\n") {
+        errs.add("sku", "must not contain slashes or whitespace")
+    }
+}
+
+// respondValidationErrors writes a 422 Unprocessable Entity response listing errs.
+func respondValidationErrors(w http.ResponseWriter, r *http.Request, errs ValidationErrors) {
+    respondErrorBody(w, r, http.StatusUnprocessableEntity, ErrorResponse{Code: codeValidationFailed, Error: "Validation failed.", Errors: errs})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "github.com/gorilla/mux"
+)
+
+// maxSKULength is the longest SKU a variant may have.
+const maxSKULength = 64
+
+// ProductVariant is a sellable version of a product, such as one size and color of a shirt.
+// Price, when set, overrides the product's price.
+type ProductVariant struct {
+    ID         int       `json:"id" xml:"id"`
+    ProductID  int       `json:"product_id" xml:"product_id"`
+    SKU        string    `json:"sku" xml:"sku"`
+    Attributes StringMap `json:"attributes" xml:"attributes"`
+    Price      *Money    `json:"price" xml:"price"`
+    Stock      int       `json:"stock" xml:"stock"`
+    CreatedAt  time.Time `json:"created_at" xml:"created_at"`
+}
+
+// variantColumns are the columns scanned by scanVariant, in order.
+const variantColumns = "id, product_id, sku, attributes, price, stock, created_at"
+
+// Validate checks the fields of a variant payload.
+func (v ProductVariant) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if strings.TrimSpace(v.SKU) == "" {
+        errs.add("sku", "is required")
+    } else if utf8.RuneCountInString(v.SKU) > maxSKULength {
+        errs.add("sku", "must be at most 64 characters")
+    }
+    for name := range v.Attributes {
+        if strings.TrimSpace(name) == "" {
+            errs.add("attributes", "names must not be empty")
+            break
+        }
+    }
+    if v.Price != nil {
+        validatePrice(&errs, *v.Price)
+    }
+    if v.Stock < 0 {
+        errs.add("stock", "must not be negative")
+    }
+    return errs
+}
+
+// variantIDFromRequest returns the variant ID from the {variant_id} path variable.
+func variantIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["variant_id"])
+}
+
+// scanVariant reads the variantColumns of one row through scan.
+func scanVariant(scan func(dest ...interface{}) error) (ProductVariant, error) {
+    var v ProductVariant
+    var attributes []byte
+    if err := scan(&v.ID, &v.ProductID, &v.SKU, &attributes, &v.Price, &v.Stock, &v.CreatedAt); err != nil {
+        return v, err
+    }
+    return v, json.Unmarshal(attributes, &v.Attributes)
+}
+
+// queryVariants returns the variants of a product, by ID.
+func queryVariants(ctx context.Context, productID int) ([]ProductVariant, error) {
+    rows, err := Reads.QueryContext(ctx, "SELECT "+variantColumns+" FROM product_variants WHERE product_id = $1 ORDER BY id", productID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    variants := []ProductVariant{}
+    for rows.Next() {
+        v, err := scanVariant(rows.Scan)
+        if err != nil {
+            return nil, err
+        }
+        variants = append(variants, v)
+    }
+    return variants, rows.Err()
+}
+
+// getVariants lists the variants of a live product.
+func getVariants(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    if !requireLiveProduct(w, r, productID, ActionRead, "Failed to retrieve variants.") {
+        return
+    }
+    variants, err := queryVariants(r.Context(), productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve variants.")
+        return
+    }
+    if respondEmptyList(w, r, len(variants)) {
+        return
+    }
+
+    // If everything went well, return the variants in the response body.
+    respond(w, r, http.StatusOK, variants)
+}
+
+// getVariant retrieves a single variant of a product.
+func getVariant(w http.ResponseWriter, r *http.Request) {
+    productID, variantID, ok := variantIDsFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if !allowProduct(w, r, ActionRead, productID, "Failed to retrieve variant.") {
+        return
+    }
+    variant, err := scanVariant(Reads.ScanRow(r.Context(), "SELECT "+variantColumns+" FROM product_variants WHERE id = $1 AND product_id = $2",
+        variantID, productID))
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeVariantNotFound, "Variant not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve variant.")
+        return
+    }
+
+    // If everything went well, return the variant in the response body.
+    respond(w, r, http.StatusOK, variant)
+}
+
+// createVariant adds a variant to a live product from a JSON body like
+// {"sku": "TS-RED-M", "attributes": {"color": "red", "size": "M"}, "price": 21.5, "stock": 10}.
+func createVariant(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+
+    variant, ok := decodeVariant(w, r)
+    if !ok {
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to save variant.") {
+        return
+    }
+
+    // The insert selects nothing, and so returns no row, if the product isn't live.
+    attributes, _ := json.Marshal(variant.Attributes)
+    variant, err = scanVariant(DB.QueryRowContext(r.Context(), `INSERT INTO product_variants (product_id, sku, attributes, price, stock)
+        SELECT id, $2, $3, $4, $5 FROM products WHERE id = $1 AND deleted_at IS NULL
+        RETURNING `+variantColumns, productID, variant.SKU, string(attributes), variant.Price, variant.Stock).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    } else if !respondVariantWriteError(w, r, err) {
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new variant.
+    w.Header().Set("Location", fmt.Sprintf("/products/%d/variants/%d", productID, variant.ID))
+    respond(w, r, http.StatusCreated, variant)
+}
+
+// updateVariant replaces the SKU, attributes, price and stock of a variant.
+func updateVariant(w http.ResponseWriter, r *http.Request) {
+    productID, variantID, ok := variantIDsFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    variant, ok := decodeVariant(w, r)
+    if !ok {
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to save variant.") {
+        return
+    }
+    attributes, _ := json.Marshal(variant.Attributes)
+    variant, err := scanVariant(DB.QueryRowContext(r.Context(), `UPDATE product_variants SET sku = $3, attributes = $4, price = $5, stock = $6
+        WHERE id = $1 AND product_id = $2 RETURNING `+variantColumns, variantID, productID, variant.SKU, string(attributes), variant.Price, variant.Stock).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeVariantNotFound, "Variant not found.")
+        return
+    } else if !respondVariantWriteError(w, r, err) {
+        return
+    }
+
+    // If everything went well, return the updated variant in the response body.
+    respond(w, r, http.StatusOK, variant)
+}
+
+// deleteVariant deletes a variant of a product.
+func deleteVariant(w http.ResponseWriter, r *http.Request) {
+    productID, variantID, ok := variantIDsFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to delete variant.") {
+        return
+    }
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM product_variants WHERE id = $1 AND product_id = $2", variantID, productID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete variant.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete variant.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeVariantNotFound, "Variant not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// variantIDsFromRequest reads the product and variant IDs from the path. If either is
+// malformed it writes a 400 Bad Request response and reports false.
+func variantIDsFromRequest(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return 0, 0, false
+    }
+    variantID, err := variantIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid variant ID.")
+        return 0, 0, false
+    }
+    return productID, variantID, true
+}
+
+// decodeVariant reads and validates a variant from the request body. If the body is
+// unusable it writes the error response and reports false.
+func decodeVariant(w http.ResponseWriter, r *http.Request) (ProductVariant, bool) {
+    var variant ProductVariant
+    if err := decodeJSON(r, &variant); err != nil {
+        respondBodyError(w, r, err)
+        return variant, false
+    }
+    variant.SKU = strings.TrimSpace(variant.SKU)
+    if errs := variant.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return variant, false
+    }
+    if variant.Attributes == nil {
+        variant.Attributes = map[string]string{}
+    }
+    return variant, true
+}
+
+// respondVariantWriteError answers a failed variant insert or update. It reports whether
+// err was nil, in which case nothing was written.
+func respondVariantWriteError(w http.ResponseWriter, r *http.Request, err error) bool {
+    switch {
+    case err == nil:
+        return true
+    case isUniqueViolation(err):
+        respondError(w, r, http.StatusConflict, codeSKUInUse, "SKU is already in use.")
+    default:
+        respondStoreError(w, r, err, "Failed to save variant.")
+    }
+    return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestVariantHandlers(t *testing.T) {
+    product := map[string]string{"id": "1"}
+    variant := map[string]string{"id": "1", "variant_id": "1"}
+    invalidVariant := map[string]string{"id": "1", "variant_id": "abc"}
+    row := []driver.Value{int64(1), int64(1), "TS-RED-M", []byte(`{"color": "red"}`), "21.50", int64(10), time.Unix(0, 0)}
+    body := `{"sku": "TS-RED-M", "attributes": {"color": "red"}, "price": 21.5, "stock": 10}`
+    tests := []handlerTest{
+        {name: "list", handler: getVariants, target: "/products/1/variants", vars: product, answer: answerRows(map[string][]driver.Value{"FROM product_variants": row}), status: http.StatusOK},
+        {name: "list invalid id", handler: getVariants, target: "/products/abc/variants", vars: map[string]string{"id": "abc"}, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "list missing product", handler: getVariants, target: "/products/99/variants", vars: map[string]string{"id": "99"}, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "get", handler: getVariant, target: "/products/1/variants/1", vars: variant, answer: answerRows(map[string][]driver.Value{"FROM product_variants": row}), status: http.StatusOK},
+        {name: "get invalid variant id", handler: getVariant, target: "/products/1/variants/abc", vars: invalidVariant, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getVariant, target: "/products/1/variants/1", vars: variant, status: http.StatusNotFound, code: codeVariantNotFound},
+        {name: "create", handler: createVariant, method: "POST", target: "/products/1/variants", body: body, vars: product,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO product_variants": row}), status: http.StatusCreated},
+        {name: "create malformed", handler: createVariant, method: "POST", target: "/products/1/variants", body: `{"sku": "TS-RED-M", "stock": "10"}`, vars: product,
+            status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create without sku", handler: createVariant, method: "POST", target: "/products/1/variants", body: `{"sku": " ", "stock": 10}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create negative stock", handler: createVariant, method: "POST", target: "/products/1/variants", body: `{"sku": "TS-RED-M", "stock": -1}`, vars: product,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create missing product", handler: createVariant, method: "POST", target: "/products/1/variants", body: body, vars: product,
+            status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "create sku in use", handler: createVariant, method: "POST", target: "/products/1/variants", body: body, vars: product,
+            answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeSKUInUse},
+        {name: "update", handler: updateVariant, method: "PUT", target: "/products/1/variants/1", body: body, vars: variant,
+            answer: answerRows(map[string][]driver.Value{"UPDATE product_variants": row}), status: http.StatusOK},
+        {name: "update invalid variant id", handler: updateVariant, method: "PUT", target: "/products/1/variants/abc", body: body, vars: invalidVariant,
+            status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update without sku", handler: updateVariant, method: "PUT", target: "/products/1/variants/1", body: `{"stock": 10}`, vars: variant,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", handler: updateVariant, method: "PUT", target: "/products/1/variants/1", body: body, vars: variant, status: http.StatusNotFound, code: codeVariantNotFound},
+        {name: "update sku in use", handler: updateVariant, method: "PUT", target: "/products/1/variants/1", body: body, vars: variant,
+            answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeSKUInUse},
+        {name: "delete", handler: deleteVariant, method: "DELETE", target: "/products/1/variants/1", vars: variant,
+            answer: answerRows(map[string][]driver.Value{"DELETE FROM product_variants": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete invalid variant id", handler: deleteVariant, method: "DELETE", target: "/products/1/variants/abc", vars: invalidVariant, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteVariant, method: "DELETE", target: "/products/1/variants/1", vars: variant, status: http.StatusNotFound, code: codeVariantNotFound},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getVariants, target: "/products/1/variants", vars: product},
+        handlerTest{name: "get", handler: getVariant, target: "/products/1/variants/1", vars: variant},
+        handlerTest{name: "create", handler: createVariant, method: "POST", target: "/products/1/variants", body: body, vars: product},
+        handlerTest{name: "update", handler: updateVariant, method: "PUT", target: "/products/1/variants/1", body: body, vars: variant},
+        handlerTest{name: "delete", handler: deleteVariant, method: "DELETE", target: "/products/1/variants/1", vars: variant},
+    ))
+}
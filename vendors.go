@@ -0,0 +1,314 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "net/mail"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gorilla/mux"
+)
+
+// Vendor is a supplier whose products are in the catalog. API keys issued to a vendor may
+// only change the vendor's own products.
+type Vendor struct {
+    ID           int       `json:"id" xml:"id"`
+    Name         string    `json:"name" xml:"name"`
+    ContactEmail string    `json:"contact_email,omitempty" xml:"contact_email,omitempty"`
+    CreatedAt    time.Time `json:"created_at" xml:"created_at"`
+}
+
+// Validate checks the fields of a vendor payload.
+func (v Vendor) Validate() ValidationErrors {
+    var errs ValidationErrors
+    if v.Name == "" {
+        errs.add("name", "is required")
+    } else if len(v.Name) > 255 {
+        errs.add("name", "must be at most 255 characters")
+    }
+    if v.ContactEmail != "" {
+        if addr, err := mail.ParseAddress(v.ContactEmail); err != nil || addr.Address != v.ContactEmail {
+            errs.add("contact_email", "must be an email address")
+        }
+    }
+    return errs
+}
+
+// ProductVendorRequest is the body of a request setting the vendor of a product. A null or
+// missing vendor_id takes the product away from its vendor.
+type ProductVendorRequest struct {
+    VendorID *int `json:"vendor_id" xml:"vendor_id"`
+}
+
+// vendorColumns are the columns scanned by scanVendor, in order.
+const vendorColumns = "id, name, contact_email, created_at"
+
+// scanVendor reads the vendorColumns of one row through scan.
+func scanVendor(scan func(dest ...interface{}) error) (Vendor, error) {
+    var v Vendor
+    err := scan(&v.ID, &v.Name, &v.ContactEmail, &v.CreatedAt)
+    return v, err
+}
+
+// vendorIDFromRequest returns the vendor ID from the {id} path variable.
+func vendorIDFromRequest(r *http.Request) (int, error) {
+    return strconv.Atoi(mux.Vars(r)["id"])
+}
+
+// queryVendor returns the vendor with the given ID, or sql.ErrNoRows.
+func queryVendor(ctx context.Context, id int) (Vendor, error) {
+    return scanVendor(Reads.ScanRow(ctx, "SELECT "+vendorColumns+" FROM vendors WHERE id = $1", id))
+}
+
+// getVendors lists every vendor, by name.
+func getVendors(w http.ResponseWriter, r *http.Request) {
+    vendors := []Vendor{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        vendor, err := scanVendor(scan)
+        if err != nil {
+            return err
+        }
+        vendors = append(vendors, vendor)
+        return nil
+    }, "SELECT "+vendorColumns+" FROM vendors ORDER BY name")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve vendors.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(vendors)) {
+        return
+    }
+
+    // If everything went well, return the vendors in the response body.
+    respond(w, r, http.StatusOK, vendors)
+}
+
+// getVendor retrieves a single vendor.
+func getVendor(w http.ResponseWriter, r *http.Request) {
+    vendorID, err := vendorIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid vendor ID.")
+        return
+    }
+
+    vendor, err := queryVendor(r.Context(), vendorID)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeVendorNotFound, "Vendor not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve vendor.")
+        return
+    }
+
+    // If everything went well, return the vendor in the response body.
+    respond(w, r, http.StatusOK, vendor)
+}
+
+// decodeVendor reads and validates a vendor payload. If it isn't valid it writes the error
+// response and reports false.
+func decodeVendor(w http.ResponseWriter, r *http.Request, vendor *Vendor) bool {
+    if err := decodeBody(r, vendor); err != nil {
+        respondBodyError(w, r, err)
+        return false
+    }
+    vendor.Name = strings.TrimSpace(vendor.Name)
+    vendor.ContactEmail = strings.TrimSpace(vendor.ContactEmail)
+    if errs := vendor.Validate(); len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return false
+    }
+    return true
+}
+
+// createVendor creates a vendor from a body like
+// {"name": "Acme", "contact_email": "sales@acme.test"}.
+func createVendor(w http.ResponseWriter, r *http.Request) {
+    var vendor Vendor
+    if !decodeVendor(w, r, &vendor) {
+        return
+    }
+
+    err := DB.QueryRowContext(r.Context(), "INSERT INTO vendors (name, contact_email) VALUES ($1, $2) RETURNING id, created_at",
+        vendor.Name, vendor.ContactEmail).Scan(&vendor.ID, &vendor.CreatedAt)
+    if isUniqueViolation(err) {
+        respondError(w, r, http.StatusConflict, codeVendorExists, "A vendor with this name already exists.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to create vendor.")
+        return
+    }
+
+    // If everything went well, return a 201 Created response with the new vendor.
+    w.Header().Set("Location", "/vendors/"+strconv.Itoa(vendor.ID))
+    respond(w, r, http.StatusCreated, vendor)
+}
+
+// updateVendor replaces the name and contact email of a vendor.
+func updateVendor(w http.ResponseWriter, r *http.Request) {
+    vendorID, err := vendorIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid vendor ID.")
+        return
+    }
+    var vendor Vendor
+    if !decodeVendor(w, r, &vendor) {
+        return
+    }
+    vendor.ID = vendorID
+
+    err = DB.QueryRowContext(r.Context(), "UPDATE vendors SET name = $1, contact_email = $2 WHERE id = $3 RETURNING created_at",
+        vendor.Name, vendor.ContactEmail, vendorID).Scan(&vendor.CreatedAt)
+    switch {
+    case err == sql.ErrNoRows:
+        respondError(w, r, http.StatusNotFound, codeVendorNotFound, "Vendor not found.")
+        return
+    case isUniqueViolation(err):
+        respondError(w, r, http.StatusConflict, codeVendorExists, "A vendor with this name already exists.")
+        return
+    case err != nil:
+        respondStoreError(w, r, err, "Failed to update vendor.")
+        return
+    }
+
+    // If everything went well, return the updated vendor in the response body.
+    respond(w, r, http.StatusOK, vendor)
+}
+
+// deleteVendor deletes a vendor that has no products, deleted ones included, and revokes
+// its API keys with it.
+func deleteVendor(w http.ResponseWriter, r *http.Request) {
+    vendorID, err := vendorIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid vendor ID.")
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM vendors WHERE id = $1", vendorID)
+    if isForeignKeyViolation(err) {
+        respondError(w, r, http.StatusConflict, codeVendorNotEmpty, "Vendor still has products.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to delete vendor.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete vendor.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeVendorNotFound, "Vendor not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// getVendorProducts lists the products of a vendor. It takes the same filter, sort and
+// paging parameters as /products.
+func getVendorProducts(w http.ResponseWriter, r *http.Request) {
+    start := time.Now()
+
+    vendorID, err := vendorIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid vendor ID.")
+        return
+    }
+    q, err := parseListQuery(r.URL.Query(), start)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+
+    if _, err := queryVendor(r.Context(), vendorID); err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeVendorNotFound, "Vendor not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve products.")
+        return
+    }
+
+    q.Filter.VendorID = vendorID
+    q.Filter.IncludeDeleted = includeDeleted(r)
+    q.Filter.PublishedOnly = !includeUnpublished(r.Context())
+    listProducts(w, r, q)
+}
+
+// setProductVendor moves a product to the vendor in a body like {"vendor_id": 4}, or takes
+// it away from its vendor with {"vendor_id": null}. The change is versioned and audited like
+// any other change to the product.
+func setProductVendor(w http.ResponseWriter, r *http.Request) {
+    productID, err := productIDFromRequest(r)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid product ID.")
+        return
+    }
+    var req ProductVendorRequest
+    if err := decodeBody(r, &req); err != nil {
+        respondBodyError(w, r, err)
+        return
+    }
+    vendorID := 0
+    if req.VendorID != nil {
+        vendorID = *req.VendorID
+    }
+    if vendorID < 0 {
+        respondValidationErrors(w, r, ValidationErrors{{Field: "vendor_id", Message: "must be positive"}})
+        return
+    }
+    if !allowProduct(w, r, ActionUpdate, productID, "Failed to update vendor.") {
+        return
+    }
+
+    product, err := changeProductVendor(r.Context(), productID, vendorID)
+    switch {
+    case err == ErrProductNotFound:
+        respondError(w, r, http.StatusNotFound, codeProductNotFound, "Product not found.")
+        return
+    case isForeignKeyViolation(err):
+        respondValidationErrors(w, r, unknownVendorErrors)
+        return
+    case err != nil:
+        respondStoreError(w, r, err, "Failed to update vendor.")
+        return
+    }
+
+    // The cached copy of the product is now stale.
+    if err := invalidateProduct(r.Context(), productID); err != nil {
+        logError(r, err)
+    }
+
+    // If everything went well, return the product with its new vendor.
+    w.Header().Set("ETag", productETag(product))
+    respond(w, r, http.StatusOK, product)
+}
+
+// changeProductVendor gives the live product with the given ID the vendor with vendorID, or
+// no vendor if it is 0, and returns the product. Nothing is written if the vendor stays the
+// same.
+func changeProductVendor(ctx context.Context, productID, vendorID int) (Product, error) {
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return Product{}, err
+    }
+    defer tx.Rollback()
+
+    current, err := lockProduct(ctx, tx, "id = $1", productID)
+    if err != nil || current.VendorID == vendorID {
+        return current, err
+    }
+
+    var product Product
+    err = tx.QueryRowContext(ctx, "UPDATE products SET vendor_id = NULLIF($2, 0), version = version + 1 WHERE id = $1 RETURNING "+productColumns,
+        productID, vendorID).Scan(productFields(&product)...)
+    if err != nil {
+        return Product{}, err
+    }
+    if err := recordAudit(ctx, tx, auditUpdate, productID, &current, &product); err != nil {
+        return Product{}, err
+    }
+    return product, tx.Commit()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestVendorHandlers(t *testing.T) {
+    vendor := map[string]string{"id": "4"}
+    invalid := map[string]string{"id": "abc"}
+    product := map[string]string{"id": "1"}
+    acme := []driver.Value{int64(4), "Acme", "sales@acme.test", time.Unix(0, 0)}
+    _, lamp := productRow(Product{ID: 1, Name: "Lamp", Category: "home", Price: 1999, Version: 1})
+    tests := []handlerTest{
+        {name: "list", handler: getVendors, target: "/vendors", answer: answerRows(map[string][]driver.Value{"FROM vendors": acme}), status: http.StatusOK},
+        {name: "get", handler: getVendor, target: "/vendors/4", vars: vendor, answer: answerRows(map[string][]driver.Value{"FROM vendors": acme}), status: http.StatusOK},
+        {name: "get invalid id", handler: getVendor, target: "/vendors/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getVendor, target: "/vendors/4", vars: vendor, status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "create", handler: createVendor, method: "POST", target: "/vendors", body: `{"name": "Acme"}`,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO vendors": {int64(4), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createVendor, method: "POST", target: "/vendors", body: `{"name": "Acme", "phone": "555"}`, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create invalid email", handler: createVendor, method: "POST", target: "/vendors", body: `{"name": "Acme", "contact_email": "sales"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create duplicate", handler: createVendor, method: "POST", target: "/vendors", body: `{"name": "Acme"}`, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeVendorExists},
+        {name: "update", handler: updateVendor, method: "PUT", target: "/vendors/4", body: `{"name": "Acme"}`, vars: vendor,
+            answer: answerRows(map[string][]driver.Value{"UPDATE vendors": {time.Unix(0, 0)}}), status: http.StatusOK},
+        {name: "update invalid id", handler: updateVendor, method: "PUT", target: "/vendors/abc", body: `{"name": "Acme"}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update without name", handler: updateVendor, method: "PUT", target: "/vendors/4", body: `{"name": ""}`, vars: vendor, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", handler: updateVendor, method: "PUT", target: "/vendors/4", body: `{"name": "Acme"}`, vars: vendor, status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "update duplicate", handler: updateVendor, method: "PUT", target: "/vendors/4", body: `{"name": "Acme"}`, vars: vendor, answer: failQueries(uniqueViolation), status: http.StatusConflict, code: codeVendorExists},
+        {name: "delete", handler: deleteVendor, method: "DELETE", target: "/vendors/4", vars: vendor, answer: answerRows(map[string][]driver.Value{"DELETE FROM vendors": {int64(4)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deleteVendor, method: "DELETE", target: "/vendors/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteVendor, method: "DELETE", target: "/vendors/4", vars: vendor, status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "delete with products", handler: deleteVendor, method: "DELETE", target: "/vendors/4", vars: vendor, answer: failQueries(foreignKeyViolation), status: http.StatusConflict, code: codeVendorNotEmpty},
+        {name: "products", handler: getVendorProducts, target: "/vendors/4/products", vars: vendor, answer: answerRows(map[string][]driver.Value{"FROM vendors": acme}), status: http.StatusOK},
+        {name: "products invalid id", handler: getVendorProducts, target: "/vendors/abc/products", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "products invalid sort", handler: getVendorProducts, target: "/vendors/4/products?sort=colour", vars: vendor, status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "products missing", handler: getVendorProducts, target: "/vendors/4/products", vars: vendor, status: http.StatusNotFound, code: codeVendorNotFound},
+        {name: "set product vendor", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 4}`, vars: product,
+            answer: answerRows(map[string][]driver.Value{"FOR UPDATE": lamp, "UPDATE products": lamp}), status: http.StatusOK},
+        {name: "set product vendor invalid id", handler: setProductVendor, method: "PUT", target: "/products/abc/vendor", body: `{"vendor_id": 4}`, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "set product vendor malformed", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": "4"}`, vars: product, status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "set product vendor negative", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": -4}`, vars: product, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "set product vendor missing product", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 4}`, vars: product, status: http.StatusNotFound, code: codeProductNotFound},
+        {name: "set product vendor unknown vendor", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 4}`, vars: product,
+            answer: func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+                if strings.HasPrefix(query, "UPDATE products") {
+                    return nil, nil, foreignKeyViolation
+                }
+                return answerRows(map[string][]driver.Value{"FOR UPDATE": lamp})(query, args)
+            }, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getVendors, target: "/vendors"},
+        handlerTest{name: "get", handler: getVendor, target: "/vendors/4", vars: vendor},
+        handlerTest{name: "create", handler: createVendor, method: "POST", target: "/vendors", body: `{"name": "Acme"}`},
+        handlerTest{name: "update", handler: updateVendor, method: "PUT", target: "/vendors/4", body: `{"name": "Acme"}`, vars: vendor},
+        handlerTest{name: "delete", handler: deleteVendor, method: "DELETE", target: "/vendors/4", vars: vendor},
+        handlerTest{name: "products", handler: getVendorProducts, target: "/vendors/4/products", vars: vendor},
+        handlerTest{name: "set product vendor", handler: setProductVendor, method: "PUT", target: "/products/1/vendor", body: `{"vendor_id": 4}`, vars: product},
+    ))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "net/http"
+    "regexp"
+    "strings"
+
+    "github.com/gorilla/mux"
+)
+
+// apiVersionHeader names the API version a request without a version prefix is for, and
+// reports the version that served every response.
+const apiVersionHeader = "API-Version"
+
+// APIVersion is a major version of the API, served under its own path prefix like /v1.
+type APIVersion struct {
+    Name string
+    // Routes registers the routes of the version. A version after the first only registers
+    // the routes it adds or changes, like a product representation with decimal prices or
+    // a new error format; requests for any other route are served by the version before it.
+    Routes func(router *mux.Router, cfg Config)
+}
+
+// apiVersions are the versions of the API, oldest first. Requests without a version prefix
+// or header are served by the first, so that clients written before versioning keep
+// working. A /v2 is mounted by appending it here.
+var apiVersions = []APIVersion{
+    {Name: "v1", Routes: registerRoutes},
+}
+
+// versionPrefixPattern matches a version prefix at the start of a path, like /v1 in
+// /v1/products.
+var versionPrefixPattern = regexp.MustCompile(`^/(v[0-9]+)(/|$)`)
+
+// versionRouter routes each request to the router of the API version it is for.
+type versionRouter struct {
+    routers map[string]*mux.Router
+}
+
+// newVersionRouter builds the router of every API version.
+func newVersionRouter(cfg Config) *versionRouter {
+    vr := &versionRouter{routers: make(map[string]*mux.Router, len(apiVersions))}
+    var previous *mux.Router
+    for _, version := range apiVersions {
+        router := newRouter(cfg)
+        version.Routes(router, cfg)
+        if previous != nil {
+            router.NotFoundHandler, router.MethodNotAllowedHandler = previous, previous
+        }
+        vr.routers[version.Name] = router
+        previous = router
+    }
+    return vr
+}
+
+// ServeHTTP serves a request with the version named by its path prefix, which is taken off
+// the path, or else by the API-Version header, or else by the first version.
+func (vr *versionRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    version := apiVersions[0].Name
+    if match := versionPrefixPattern.FindStringSubmatch(r.URL.Path); match != nil {
+        version = match[1]
+        if _, ok := vr.routers[version]; !ok {
+            respondError(w, r, http.StatusNotFound, codeUnknownAPIVersion, "Unknown API version "+version+"; the supported versions are "+supportedAPIVersions()+".")
+            return
+        }
+        r = withoutPrefix(r, "/"+version)
+    } else {
+        w.Header().Add("Vary", apiVersionHeader)
+        if requested := r.Header.Get(apiVersionHeader); requested != "" {
+            version = strings.ToLower(requested)
+            if !strings.HasPrefix(version, "v") {
+                version = "v" + version
+            }
+            if _, ok := vr.routers[version]; !ok {
+                respondError(w, r, http.StatusBadRequest, codeUnknownAPIVersion, "Unknown API version in "+apiVersionHeader+"; the supported versions are "+supportedAPIVersions()+".")
+                return
+            }
+        }
+    }
+    w.Header().Set(apiVersionHeader, version)
+    vr.routers[version].ServeHTTP(w, r)
+}
+
+// Walk walks the routes of every version, oldest first.
+func (vr *versionRouter) Walk(walkFn mux.WalkFunc) error {
+    for _, version := range apiVersions {
+        if err := vr.routers[version.Name].Walk(walkFn); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// supportedAPIVersions lists the versions of the API for error messages, like "v1, v2".
+func supportedAPIVersions() string {
+    names := make([]string, len(apiVersions))
+    for i, version := range apiVersions {
+        names[i] = version.Name
+    }
+    return strings.Join(names, ", ")
+}
+
+// withoutPrefix returns a copy of r for its path without prefix. The path of the prefix
+// itself becomes the root.
+func withoutPrefix(r *http.Request, prefix string) *http.Request {
+    r2 := r.Clone(r.Context())
+    r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+    r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+    if r2.URL.Path == "" {
+        r2.URL.Path = "/"
+    }
+    return r2
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+)
+
+// webhookEventTypes are the events a webhook can subscribe to.
+var webhookEventTypes = []string{eventProductCreated, eventProductUpdated, eventProductDeleted}
+
+// States of a webhook delivery.
+const (
+    deliveryStatusPending   = "pending"
+    deliveryStatusDelivered = "delivered"
+    deliveryStatusFailed    = "failed"
+)
+
+// Retries back off exponentially from webhookBackoffBase, up to webhookBackoffMax between
+// attempts. A claimed delivery is leased for webhookLease, so another instance only picks it
+// up again if this one died while sending it.
+const (
+    webhookBackoffBase = 10 * time.Second
+    webhookBackoffMax  = time.Hour
+    webhookLease       = time.Minute
+    webhookBatchSize   = 50
+)
+
+// Webhook is an endpoint that product change events are delivered to. The secret signs
+// the deliveries; it is never returned, except once when the service generated it.
+type Webhook struct {
+    ID        int       `json:"id"`
+    URL       string    `json:"url"`
+    Secret    string    `json:"secret,omitempty"`
+    Events    []string  `json:"events"`
+    Active    bool      `json:"active"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one webhook.
+type WebhookDelivery struct {
+    ID            int64      `json:"id"`
+    WebhookID     int        `json:"webhook_id"`
+    EventID       string     `json:"event_id"`
+    EventType     string     `json:"event_type"`
+    Status        string     `json:"status"`
+    Attempts      int        `json:"attempts"`
+    NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+    LastError     string     `json:"last_error,omitempty"`
+    CreatedAt     time.Time  `json:"created_at"`
+    DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookAttempt is one try at sending a delivery. StatusCode is 0 when no response came back.
+type WebhookAttempt struct {
+    ID          int64     `json:"id"`
+    DeliveryID  int64     `json:"delivery_id"`
+    AttemptedAt time.Time `json:"attempted_at"`
+    StatusCode  int       `json:"status_code"`
+    Error       string    `json:"error,omitempty"`
+    DurationMS  int64     `json:"duration_ms"`
+}
+
+// webhookColumns are the columns scanned by scanWebhook, in order.
+const webhookColumns = "id, url, events, active, created_at"
+
+// deliveryColumns are the columns scanned by scanDelivery, in order.
+const deliveryColumns = "id, webhook_id, event_id, event_type, status, attempts, next_attempt_at, COALESCE(last_error, ''), created_at, delivered_at"
+
+// scanWebhook reads the webhookColumns of one row through scan.
+func scanWebhook(scan func(dest ...interface{}) error) (Webhook, error) {
+    var hook Webhook
+    err := scan(&hook.ID, &hook.URL, pq.Array(&hook.Events), &hook.Active, &hook.CreatedAt)
+    return hook, err
+}
+
+// scanDelivery reads the deliveryColumns of one row through scan. Only pending deliveries
+// report when they are next attempted.
+func scanDelivery(scan func(dest ...interface{}) error) (WebhookDelivery, error) {
+    var d WebhookDelivery
+    var nextAttemptAt time.Time
+    err := scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &nextAttemptAt, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+    if d.Status == deliveryStatusPending {
+        d.NextAttemptAt = &nextAttemptAt
+    }
+    return d, err
+}
+
+// enqueueWebhookEvent queues event, encoded as payload, to every active webhook of its
+// tenant subscribed to it, as part of tx. A webhook gets at most one delivery per event, so
+// queueing an event again does nothing.
+func enqueueWebhookEvent(ctx context.Context, tx *sql.Tx, event Event, payload []byte) error {
+    _, err := tx.ExecContext(ctx, `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, correlation_id)
+        SELECT id, $1, $2, $3, NULLIF($5, '') FROM webhooks WHERE active AND $2 = ANY(events) AND tenant_id = $4
+        ON CONFLICT (webhook_id, event_id) DO NOTHING`, event.ID, event.Type, string(payload), event.TenantID, event.CorrelationID)
+    return err
+}
+
+// getWebhooks lists the registered webhooks.
+func getWebhooks(w http.ResponseWriter, r *http.Request) {
+    hooks := []Webhook{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        hook, err := scanWebhook(scan)
+        if err != nil {
+            return err
+        }
+        hooks = append(hooks, hook)
+        return nil
+    }, "SELECT "+webhookColumns+" FROM webhooks ORDER BY id")
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve webhooks.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(hooks)) {
+        return
+    }
+
+    // If everything went well, return the webhooks in the response body.
+    respond(w, r, http.StatusOK, hooks)
+}
+
+// getWebhook retrieves a single webhook.
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+    hookID, ok := webhookIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    hook, err := scanWebhook(Reads.ScanRow(r.Context(), "SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", hookID))
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeWebhookNotFound, "Webhook not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve webhook.")
+        return
+    }
+
+    // If everything went well, return the webhook in the response body.
+    respond(w, r, http.StatusOK, hook)
+}
+
+// createWebhook registers a webhook from a JSON body like
+// {"url": "https://example.com/hooks", "secret": "0123456789abcdef", "events": ["product.created"]}.
+// Without events it subscribes to all of them, and without a secret one is generated and
+// returned in the response, which is the only time it is shown.
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+    hook, ok := decodeWebhook(w, r)
+    if !ok {
+        return
+    }
+    generated := hook.Secret == ""
+    if generated {
+        hook.Secret = "whsec_" + newID() + newID()
+    }
+
+    err := DB.QueryRowContext(r.Context(), "INSERT INTO webhooks (url, secret, events, active) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+        hook.URL, hook.Secret, pq.Array(hook.Events), hook.Active).Scan(&hook.ID, &hook.CreatedAt)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to create webhook.")
+        return
+    }
+    if !generated {
+        hook.Secret = ""
+    }
+
+    // If everything went well, return a 201 Created response with the new webhook.
+    w.Header().Set("Location", fmt.Sprintf("/admin/webhooks/%d", hook.ID))
+    respond(w, r, http.StatusCreated, hook)
+}
+
+// updateWebhook replaces the URL, events and active flag of a webhook. The secret is only
+// changed when the body has one.
+func updateWebhook(w http.ResponseWriter, r *http.Request) {
+    hookID, ok := webhookIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    hook, ok := decodeWebhook(w, r)
+    if !ok {
+        return
+    }
+
+    hook, err := scanWebhook(DB.QueryRowContext(r.Context(), `UPDATE webhooks SET url = $2, secret = COALESCE(NULLIF($3, ''), secret), events = $4, active = $5
+        WHERE id = $1 RETURNING `+webhookColumns, hookID, hook.URL, hook.Secret, pq.Array(hook.Events), hook.Active).Scan)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeWebhookNotFound, "Webhook not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to update webhook.")
+        return
+    }
+
+    // If everything went well, return the updated webhook in the response body.
+    respond(w, r, http.StatusOK, hook)
+}
+
+// deleteWebhook removes a webhook together with its deliveries.
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+    hookID, ok := webhookIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    result, err := DB.ExecContext(r.Context(), "DELETE FROM webhooks WHERE id = $1", hookID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to delete webhook.")
+        return
+    }
+    if rowsAffected, err := result.RowsAffected(); err != nil {
+        respondStoreError(w, r, err, "Failed to delete webhook.")
+        return
+    } else if rowsAffected == 0 {
+        respondError(w, r, http.StatusNotFound, codeWebhookNotFound, "Webhook not found.")
+        return
+    }
+
+    // If everything went well, return a 204 No Content response.
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhookDeliveries lists the deliveries of a webhook, newest first. ?status= narrows
+// them to one state and ?limit= caps how many are returned.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+    hookID, ok := webhookIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    status := r.URL.Query().Get("status")
+    switch status {
+    case "", deliveryStatusPending, deliveryStatusDelivered, deliveryStatusFailed:
+    default:
+        respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid status.")
+        return
+    }
+    limit := AppConfig.DefaultPageSize
+    if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+        var err error
+        if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > AppConfig.MaxPageSize {
+            respondError(w, r, http.StatusBadRequest, codeInvalidParameter, "Invalid limit.")
+            return
+        }
+    }
+    if !requireWebhook(w, r, hookID) {
+        return
+    }
+
+    deliveries := []WebhookDelivery{}
+    err := queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        d, err := scanDelivery(scan)
+        if err != nil {
+            return err
+        }
+        deliveries = append(deliveries, d)
+        return nil
+    }, "SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3",
+        hookID, status, limit)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve deliveries.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(deliveries)) {
+        return
+    }
+
+    // If everything went well, return the deliveries in the response body.
+    respond(w, r, http.StatusOK, deliveries)
+}
+
+// getDeliveryAttempts lists every attempt at sending a delivery, oldest first.
+func getDeliveryAttempts(w http.ResponseWriter, r *http.Request) {
+    hookID, deliveryID, ok := deliveryIDsFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    var exists bool
+    err := Reads.QueryRowScan(r.Context(), []interface{}{&exists}, "SELECT EXISTS (SELECT 1 FROM webhook_deliveries WHERE id = $1 AND webhook_id = $2)", deliveryID, hookID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve delivery attempts.")
+        return
+    }
+    if !exists {
+        respondError(w, r, http.StatusNotFound, codeDeliveryNotFound, "Delivery not found.")
+        return
+    }
+
+    attempts := []WebhookAttempt{}
+    err = queryRows(r.Context(), func(scan func(dest ...interface{}) error) error {
+        var a WebhookAttempt
+        if err := scan(&a.ID, &a.DeliveryID, &a.AttemptedAt, &a.StatusCode, &a.Error, &a.DurationMS); err != nil {
+            return err
+        }
+        attempts = append(attempts, a)
+        return nil
+    }, "SELECT id, delivery_id, attempted_at, COALESCE(status_code, 0), error, duration_ms FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id", deliveryID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve delivery attempts.")
+        return
+    }
+
+    if respondEmptyList(w, r, len(attempts)) {
+        return
+    }
+
+    // If everything went well, return the attempts in the response body.
+    respond(w, r, http.StatusOK, attempts)
+}
+
+// retryDelivery queues a failed delivery to be sent again right away, with a fresh
+// attempt budget.
+func retryDelivery(w http.ResponseWriter, r *http.Request) {
+    hookID, deliveryID, ok := deliveryIDsFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    var status string
+    err := DB.QueryRowContext(r.Context(), `UPDATE webhook_deliveries
+        SET status = CASE WHEN status = $3 THEN $4 ELSE status END,
+            attempts = CASE WHEN status = $3 THEN 0 ELSE attempts END,
+            next_attempt_at = CASE WHEN status = $3 THEN now() ELSE next_attempt_at END
+        WHERE id = $1 AND webhook_id = $2 RETURNING status`, deliveryID, hookID, deliveryStatusFailed, deliveryStatusPending).Scan(&status)
+    if err == sql.ErrNoRows {
+        respondError(w, r, http.StatusNotFound, codeDeliveryNotFound, "Delivery not found.")
+        return
+    } else if err != nil {
+        respondStoreError(w, r, err, "Failed to retry delivery.")
+        return
+    }
+    if status != deliveryStatusPending {
+        respondError(w, r, http.StatusConflict, codeDeliveryNotFailed, "Only failed deliveries can be retried.")
+        return
+    }
+
+    // If everything went well, return a 202 Accepted response.
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// webhookIDFromRequest reads the webhook ID from the path. If it is malformed it writes a
+// 400 Bad Request response and reports false.
+func webhookIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+    hookID, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid webhook ID.")
+        return 0, false
+    }
+    return hookID, true
+}
+
+// deliveryIDsFromRequest reads the webhook and delivery IDs from the path. If either is
+// malformed it writes a 400 Bad Request response and reports false.
+func deliveryIDsFromRequest(w http.ResponseWriter, r *http.Request) (int, int64, bool) {
+    hookID, ok := webhookIDFromRequest(w, r)
+    if !ok {
+        return 0, 0, false
+    }
+    deliveryID, err := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+    if err != nil {
+        respondError(w, r, http.StatusBadRequest, codeInvalidID, "Invalid delivery ID.")
+        return 0, 0, false
+    }
+    return hookID, deliveryID, true
+}
+
+// requireWebhook checks that a webhook exists. If it doesn't, or the check fails, it writes
+// the error response and reports false.
+func requireWebhook(w http.ResponseWriter, r *http.Request, hookID int) bool {
+    var exists bool
+    err := Reads.QueryRowScan(r.Context(), []interface{}{&exists}, "SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1)", hookID)
+    if err != nil {
+        respondStoreError(w, r, err, "Failed to retrieve webhook.")
+        return false
+    }
+    if !exists {
+        respondError(w, r, http.StatusNotFound, codeWebhookNotFound, "Webhook not found.")
+        return false
+    }
+    return true
+}
+
+// decodeWebhook reads and validates a webhook from the request body. A webhook is active
+// unless the body says otherwise. If the body is unusable it writes the error response and
+// reports false.
+func decodeWebhook(w http.ResponseWriter, r *http.Request) (Webhook, bool) {
+    var body struct {
+        URL    string   `json:"url"`
+        Secret string   `json:"secret"`
+        Events []string `json:"events"`
+        Active *bool    `json:"active"`
+    }
+    if err := decodeJSON(r, &body); err != nil {
+        respondBodyError(w, r, err)
+        return Webhook{}, false
+    }
+    hook := Webhook{URL: body.URL, Secret: body.Secret, Events: body.Events, Active: body.Active == nil || *body.Active}
+    if len(hook.Events) == 0 {
+        hook.Events = webhookEventTypes
+    }
+
+    var errs ValidationErrors
+    if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        errs.add("url", "must be an absolute http or https URL")
+    }
+    if hook.Secret != "" && len(hook.Secret) < 16 {
+        errs.add("secret", "must be at least 16 characters")
+    }
+    for _, event := range hook.Events {
+        if !containsString(webhookEventTypes, event) {
+            errs.add("events", "must only contain product.created, product.updated and product.deleted")
+            break
+        }
+    }
+    if len(errs) > 0 {
+        respondValidationErrors(w, r, errs)
+        return hook, false
+    }
+    return hook, true
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+// webhookDispatchJob returns the job that sends due webhook deliveries every interval.
+// Deliveries are leased, so every instance can send them.
+func webhookDispatchJob(interval time.Duration) Job {
+    client := &http.Client{
+        Timeout: AppConfig.WebhookTimeout,
+        // Following redirects would send the signed payload somewhere nobody registered.
+        CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+    }
+    return Job{Name: "webhook-dispatcher", Interval: interval, Shared: true, Run: func(ctx context.Context) error {
+        return dispatchWebhooks(ctx, client)
+    }}
+}
+
+// claimedDelivery is a delivery the dispatcher has leased, with what it needs to send it.
+type claimedDelivery struct {
+    id            int64
+    eventID       string
+    event         string
+    payload       []byte
+    attempts      int
+    url           string
+    secret        string
+    correlationID string
+}
+
+// dispatchWebhooks sends due deliveries in batches until none are left. Each batch is
+// leased with FOR UPDATE SKIP LOCKED, so instances sharing the database split the work
+// instead of sending the same delivery twice.
+func dispatchWebhooks(ctx context.Context, client *http.Client) error {
+    for {
+        var batch []claimedDelivery
+        err := queryRows(ctx, func(scan func(dest ...interface{}) error) error {
+            var d claimedDelivery
+            if err := scan(&d.id, &d.eventID, &d.event, &d.payload, &d.attempts, &d.url, &d.secret, &d.correlationID); err != nil {
+                return err
+            }
+            batch = append(batch, d)
+            return nil
+        }, `WITH claimed AS (
+                UPDATE webhook_deliveries SET next_attempt_at = now() + $1::float8 * interval '1 second'
+                WHERE id IN (
+                    SELECT d.id FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+                    WHERE d.status = $2 AND d.next_attempt_at <= now() AND w.active
+                    ORDER BY d.next_attempt_at, d.id LIMIT $3 FOR UPDATE OF d SKIP LOCKED)
+                RETURNING id, webhook_id, event_id, event_type, payload, attempts, correlation_id)
+            SELECT c.id, c.event_id, c.event_type, c.payload, c.attempts, w.url, w.secret, COALESCE(c.correlation_id, '')
+            FROM claimed c JOIN webhooks w ON w.id = c.webhook_id`,
+            webhookLease.Seconds(), deliveryStatusPending, webhookBatchSize)
+        if err != nil {
+            return err
+        }
+        for _, d := range batch {
+            if err := sendDelivery(ctx, client, d); err != nil {
+                return err
+            }
+        }
+        if len(batch) < webhookBatchSize {
+            return nil
+        }
+    }
+}
+
+// sendDelivery makes one attempt at sending a delivery, logs the attempt and schedules the
+// next one if it failed. The returned error is about recording the outcome, not sending.
+func sendDelivery(ctx context.Context, client *http.Client, d claimedDelivery) error {
+    start := time.Now()
+    statusCode, sendErr := postWebhook(ctx, client, d)
+    duration := time.Since(start)
+    if ctx.Err() != nil {
+        // Shutting down; the lease runs out and the delivery is picked up again later.
+        return ctx.Err()
+    }
+
+    var code interface{}
+    if statusCode != 0 {
+        code = statusCode
+    }
+    errMessage := ""
+    if sendErr != nil {
+        errMessage = sendErr.Error()
+    }
+    tx, err := DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    _, err = tx.ExecContext(ctx, "INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)",
+        d.id, code, errMessage, duration.Milliseconds())
+    if err != nil {
+        return err
+    }
+
+    attempts := d.attempts + 1
+    switch {
+    case sendErr == nil:
+        _, err = tx.ExecContext(ctx, "UPDATE webhook_deliveries SET status = $2, attempts = $3, last_error = NULL, delivered_at = now() WHERE id = $1",
+            d.id, deliveryStatusDelivered, attempts)
+    case attempts >= AppConfig.WebhookMaxAttempts:
+        _, err = tx.ExecContext(ctx, "UPDATE webhook_deliveries SET status = $2, attempts = $3, last_error = $4 WHERE id = $1",
+            d.id, deliveryStatusFailed, attempts, errMessage)
+        slog.Warn("webhook delivery failed", "delivery_id", d.id, "event_id", d.eventID, "url", d.url, "attempts", attempts, "error", sendErr)
+    default:
+        _, err = tx.ExecContext(ctx, "UPDATE webhook_deliveries SET attempts = $2, last_error = $3, next_attempt_at = now() + $4::float8 * interval '1 second' WHERE id = $1",
+            d.id, attempts, errMessage, webhookBackoff(attempts).Seconds())
+    }
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// webhookBackoff returns how long to wait before the next attempt after the given number
+// of failed ones.
+func webhookBackoff(attempts int) time.Duration {
+    backoff := webhookBackoffBase
+    for i := 1; i < attempts && backoff < webhookBackoffMax; i++ {
+        backoff *= 2
+    }
+    if backoff > webhookBackoffMax {
+        backoff = webhookBackoffMax
+    }
+    return backoff
+}
+
+// postWebhook sends a delivery's payload to its webhook. Any 2xx response counts as
+// delivered. The body is signed with the webhook's secret: X-Webhook-Signature is
+// "sha256=" followed by the hex HMAC-SHA256 of the X-Webhook-Timestamp value, a dot and
+// the body, so receivers can check both the sender and how old the request is. The
+// correlation ID of the request behind the event, if any, is sent in the correlation header.
+func postWebhook(ctx context.Context, client *http.Client, d claimedDelivery) (int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+    if err != nil {
+        return 0, err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "product-api-webhooks")
+    req.Header.Set("X-Webhook-ID", d.eventID)
+    req.Header.Set("X-Webhook-Event", d.event)
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(d.secret), timestamp+"."+string(d.payload))))
+    if d.correlationID != "" {
+        req.Header.Set(AppConfig.CorrelationIDHeader, d.correlationID)
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode/100 != 2 {
+        return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "database/sql/driver"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestWebhookHandlers(t *testing.T) {
+    hook := map[string]string{"id": "1"}
+    invalid := map[string]string{"id": "abc"}
+    delivery := map[string]string{"id": "1", "delivery_id": "5"}
+    invalidDelivery := map[string]string{"id": "1", "delivery_id": "abc"}
+    row := []driver.Value{int64(1), "https://example.com/hooks", "{product.created}", true, time.Unix(0, 0)}
+    failed := []driver.Value{int64(5), int64(1), "evt-1", eventProductCreated, deliveryStatusFailed, int64(3), time.Unix(0, 0), "timeout", time.Unix(0, 0), nil}
+    found := answerRows(map[string][]driver.Value{"FROM webhooks": row})
+    body := `{"url": "https://example.com/hooks", "events": ["product.created"]}`
+    tests := []handlerTest{
+        {name: "list", handler: getWebhooks, target: "/admin/webhooks", answer: found, status: http.StatusOK},
+        {name: "get", handler: getWebhook, target: "/admin/webhooks/1", vars: hook, answer: found, status: http.StatusOK},
+        {name: "get invalid id", handler: getWebhook, target: "/admin/webhooks/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "get missing", handler: getWebhook, target: "/admin/webhooks/1", vars: hook, status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "create", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: body,
+            answer: answerRows(map[string][]driver.Value{"INSERT INTO webhooks": {int64(1), time.Unix(0, 0)}}), status: http.StatusCreated},
+        {name: "create malformed", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: `{"url": "https://example.com/hooks", "events": "all"}`,
+            status: http.StatusBadRequest, code: codeInvalidBody},
+        {name: "create relative url", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: `{"url": "/hooks"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create short secret", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: `{"url": "https://example.com/hooks", "secret": "hunter2"}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "create unknown event", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: `{"url": "https://example.com/hooks", "events": ["order.created"]}`,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update", handler: updateWebhook, method: "PUT", target: "/admin/webhooks/1", body: body, vars: hook,
+            answer: answerRows(map[string][]driver.Value{"UPDATE webhooks": row}), status: http.StatusOK},
+        {name: "update invalid id", handler: updateWebhook, method: "PUT", target: "/admin/webhooks/abc", body: body, vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "update relative url", handler: updateWebhook, method: "PUT", target: "/admin/webhooks/1", body: `{"url": "/hooks"}`, vars: hook,
+            status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+        {name: "update missing", handler: updateWebhook, method: "PUT", target: "/admin/webhooks/1", body: body, vars: hook, status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "delete", handler: deleteWebhook, method: "DELETE", target: "/admin/webhooks/1", vars: hook,
+            answer: answerRows(map[string][]driver.Value{"DELETE FROM webhooks": {int64(1)}}), status: http.StatusNoContent},
+        {name: "delete invalid id", handler: deleteWebhook, method: "DELETE", target: "/admin/webhooks/abc", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "delete missing", handler: deleteWebhook, method: "DELETE", target: "/admin/webhooks/1", vars: hook, status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "deliveries", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries?status=failed", vars: hook,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {true}, "FROM webhook_deliveries": failed}), status: http.StatusOK},
+        {name: "deliveries invalid id", handler: getWebhookDeliveries, target: "/admin/webhooks/abc/deliveries", vars: invalid, status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "deliveries invalid status", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries?status=lost", vars: hook,
+            status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "deliveries invalid limit", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries?limit=0", vars: hook,
+            status: http.StatusBadRequest, code: codeInvalidParameter},
+        {name: "deliveries missing webhook", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries", vars: hook,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {false}}), status: http.StatusNotFound, code: codeWebhookNotFound},
+        {name: "attempts", handler: getDeliveryAttempts, target: "/admin/webhooks/1/deliveries/5/attempts", vars: delivery,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS (SELECT 1 FROM webhook_deliveries": {true},
+                "FROM webhook_attempts": {int64(1), int64(5), time.Unix(0, 0), int64(500), "", int64(20)}}), status: http.StatusOK},
+        {name: "attempts invalid delivery id", handler: getDeliveryAttempts, target: "/admin/webhooks/1/deliveries/abc/attempts", vars: invalidDelivery,
+            status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "attempts missing delivery", handler: getDeliveryAttempts, target: "/admin/webhooks/1/deliveries/5/attempts", vars: delivery,
+            answer: answerRows(map[string][]driver.Value{"SELECT EXISTS": {false}}), status: http.StatusNotFound, code: codeDeliveryNotFound},
+        {name: "retry", handler: retryDelivery, method: "POST", target: "/admin/webhooks/1/deliveries/5/retry", vars: delivery,
+            answer: answerRows(map[string][]driver.Value{"UPDATE webhook_deliveries": {deliveryStatusPending}}), status: http.StatusAccepted},
+        {name: "retry invalid delivery id", handler: retryDelivery, method: "POST", target: "/admin/webhooks/1/deliveries/abc/retry", vars: invalidDelivery,
+            status: http.StatusBadRequest, code: codeInvalidID},
+        {name: "retry missing delivery", handler: retryDelivery, method: "POST", target: "/admin/webhooks/1/deliveries/5/retry", vars: delivery,
+            status: http.StatusNotFound, code: codeDeliveryNotFound},
+        {name: "retry delivered", handler: retryDelivery, method: "POST", target: "/admin/webhooks/1/deliveries/5/retry", vars: delivery,
+            answer: answerRows(map[string][]driver.Value{"UPDATE webhook_deliveries": {deliveryStatusDelivered}}), status: http.StatusConflict, code: codeDeliveryNotFailed},
+    }
+    runHandlerTests(t, withStoreErrors(tests,
+        handlerTest{name: "list", handler: getWebhooks, target: "/admin/webhooks"},
+        handlerTest{name: "get", handler: getWebhook, target: "/admin/webhooks/1", vars: hook},
+        handlerTest{name: "create", handler: createWebhook, method: "POST", target: "/admin/webhooks", body: body},
+        handlerTest{name: "update", handler: updateWebhook, method: "PUT", target: "/admin/webhooks/1", body: body, vars: hook},
+        handlerTest{name: "delete", handler: deleteWebhook, method: "DELETE", target: "/admin/webhooks/1", vars: hook},
+        handlerTest{name: "deliveries", handler: getWebhookDeliveries, target: "/admin/webhooks/1/deliveries", vars: hook},
+        handlerTest{name: "attempts", handler: getDeliveryAttempts, target: "/admin/webhooks/1/deliveries/5/attempts", vars: delivery},
+        handlerTest{name: "retry", handler: retryDelivery, method: "POST", target: "/admin/webhooks/1/deliveries/5/retry", vars: delivery},
+    ))
+}